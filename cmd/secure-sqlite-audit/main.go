@@ -0,0 +1,175 @@
+// Command secure-sqlite-audit verifies hash-chained audit logs.
+//
+// Usage:
+//
+//	secure-sqlite-audit verify [-key-file hmac.key] [-public-key-file checkpoint.pub] audit.jsonl
+//	secure-sqlite-audit verify -db audit.db [-table audit_log] [-key-file hmac.key] [-public-key-file checkpoint.pub]
+//	secure-sqlite-audit keygen name
+//
+// Keys are stored hex-encoded. The verify command exits with status 1 when the
+// chain is broken and reports the first broken link. The keygen command writes
+// an Ed25519 key pair for signing checkpoints to name.key and name.pub.
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/wemcdonald/secure_sqlite/pkg/audit"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run executes a command and returns the exit status
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		usage(stderr)
+		return 2
+	}
+
+	var err error
+	status := 0
+	switch args[0] {
+	case "verify":
+		status, err = verify(args[1:], stdout, stderr)
+	case "keygen":
+		err = keygen(args[1:], stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		usage(stdout)
+		return 0
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n", args[0])
+		usage(stderr)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	return status
+}
+
+// usage prints the available commands
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage:")
+	fmt.Fprintln(w, "  secure-sqlite-audit verify [-key-file hmac.key] [-public-key-file checkpoint.pub] audit.jsonl")
+	fmt.Fprintln(w, "  secure-sqlite-audit verify -db audit.db [-table audit_log] [-key-file hmac.key] [-public-key-file checkpoint.pub]")
+	fmt.Fprintln(w, "  secure-sqlite-audit keygen name")
+}
+
+// verify checks the hash chain of a JSON lines audit log or an audit table
+// and returns 1 if it is broken
+func verify(args []string, stdout, stderr io.Writer) (int, error) {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dbPath := flags.String("db", "", "SQLite database holding the audit table")
+	table := flags.String("table", "audit_log", "audit table in the database")
+	keyFile := flags.String("key-file", "", "file holding the HMAC key of the chain")
+	publicKeyFile := flags.String("public-key-file", "", "file holding the Ed25519 public key of the checkpoints")
+	if err := flags.Parse(args); err != nil {
+		return 0, err
+	}
+	if (*dbPath == "") == (flags.NArg() == 0) || flags.NArg() > 1 {
+		return 0, fmt.Errorf("verify expects either a single audit log or -db")
+	}
+
+	var opts audit.VerifyOptions
+	if *keyFile != "" {
+		key, err := readKey(*keyFile)
+		if err != nil {
+			return 0, err
+		}
+		opts.Key = key
+	}
+	if *publicKeyFile != "" {
+		key, err := readKey(*publicKeyFile)
+		if err != nil {
+			return 0, err
+		}
+		if len(key) != ed25519.PublicKeySize {
+			return 0, fmt.Errorf("%s: not an Ed25519 public key", *publicKeyFile)
+		}
+		opts.PublicKey = ed25519.PublicKey(key)
+	}
+
+	var report *audit.VerifyReport
+	if *dbPath != "" {
+		if _, err := os.Stat(*dbPath); err != nil {
+			return 0, fmt.Errorf("failed to open database: %w", err)
+		}
+		db, err := sql.Open("sqlite3", *dbPath)
+		if err != nil {
+			return 0, fmt.Errorf("failed to open database: %w", err)
+		}
+		defer db.Close()
+		report, err = audit.VerifySQLite(context.Background(), db, *table, opts)
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return 0, err
+		}
+		defer file.Close()
+		report, err = audit.VerifyJSONL(file, opts)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	fmt.Fprintln(stdout, report)
+	if report.Broken != nil {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// keygen writes an Ed25519 key pair for signing checkpoints
+func keygen(args []string, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("keygen expects a single key name")
+	}
+
+	publicKey, signingKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return err
+	}
+	name := flags.Arg(0)
+	if err := os.WriteFile(name+".key", []byte(hex.EncodeToString(signingKey)+"\n"), 0o600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(name+".pub", []byte(hex.EncodeToString(publicKey)+"\n"), 0o644); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "wrote %s.key and %s.pub\n", name, name)
+	return nil
+}
+
+// readKey reads a hex-encoded key from a file
+func readKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: key is not hex-encoded: %w", path, err)
+	}
+	return key, nil
+}
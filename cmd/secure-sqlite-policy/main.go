@@ -0,0 +1,233 @@
+// Command secure-sqlite-policy validates and compares declarative policy files
+// and exports the policy of an auth store.
+//
+// Usage:
+//
+//	secure-sqlite-policy validate [-db database.db] policy.yaml
+//	secure-sqlite-policy diff [-db database.db] [-format text|json] old.yaml new.yaml
+//	secure-sqlite-policy diff [-db database.db] [-format text|json] -auth-store auth.db policy.yaml
+//	secure-sqlite-policy export [-format yaml|json] -auth-store auth.db
+//
+// The diff command exits with status 1 when the policies differ, so it can be
+// used to detect access changes between two exports, or between an auth store
+// and the policy file it should match.
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/wemcdonald/secure_sqlite/pkg/auth"
+	"github.com/wemcdonald/secure_sqlite/pkg/rbac"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run executes a command and returns the exit status
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		usage(stderr)
+		return 2
+	}
+
+	var err error
+	status := 0
+	switch args[0] {
+	case "validate":
+		err = validate(args[1:], stdout, stderr)
+	case "diff":
+		status, err = diff(args[1:], stdout, stderr)
+	case "export":
+		err = export(args[1:], stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		usage(stdout)
+		return 0
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n", args[0])
+		usage(stderr)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	return status
+}
+
+// usage prints the available commands
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage:")
+	fmt.Fprintln(w, "  secure-sqlite-policy validate [-db database.db] policy.yaml")
+	fmt.Fprintln(w, "  secure-sqlite-policy diff [-db database.db] [-format text|json] old.yaml new.yaml")
+	fmt.Fprintln(w, "  secure-sqlite-policy diff [-db database.db] [-format text|json] -auth-store auth.db policy.yaml")
+	fmt.Fprintln(w, "  secure-sqlite-policy export [-format yaml|json] -auth-store auth.db")
+}
+
+// validate checks a policy file, optionally against the schema of a database
+func validate(args []string, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dbPath := flags.String("db", "", "SQLite database whose schema the policy is checked against")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("validate expects a single policy file")
+	}
+
+	policy, err := loadPolicyFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if *dbPath != "" {
+		catalog, err := loadCatalog(*dbPath)
+		if err != nil {
+			return err
+		}
+		if err := policy.Validate(catalog); err != nil {
+			return fmt.Errorf("%s: %w", flags.Arg(0), err)
+		}
+	}
+
+	fmt.Fprintf(stdout, "%s: ok\n", flags.Arg(0))
+	return nil
+}
+
+// diff compares two policy files, or the policy of an auth store with a
+// policy file, and returns 1 if they differ
+func diff(args []string, stdout, stderr io.Writer) (int, error) {
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	format := flags.String("format", "text", "output format: text or json")
+	dbPath := flags.String("db", "", "SQLite database whose tables denies narrow grants on every table to")
+	storePath := flags.String("auth-store", "", "auth store whose policy is compared with a policy file")
+	if err := flags.Parse(args); err != nil {
+		return 0, err
+	}
+	if *storePath == "" && flags.NArg() != 2 {
+		return 0, fmt.Errorf("diff expects two policy files")
+	}
+	if *storePath != "" && flags.NArg() != 1 {
+		return 0, fmt.Errorf("diff with -auth-store expects a single policy file")
+	}
+	if *format != "text" && *format != "json" {
+		return 0, fmt.Errorf("unknown format %q", *format)
+	}
+
+	var from *rbac.Policy
+	var err error
+	if *storePath != "" {
+		from, err = exportStore(*storePath)
+	} else {
+		from, err = loadPolicyFile(flags.Arg(0))
+	}
+	if err != nil {
+		return 0, err
+	}
+	to, err := loadPolicyFile(flags.Arg(flags.NArg() - 1))
+	if err != nil {
+		return 0, err
+	}
+
+	var catalog rbac.Catalog
+	if *dbPath != "" {
+		if catalog, err = loadCatalog(*dbPath); err != nil {
+			return 0, err
+		}
+	}
+
+	report, err := rbac.DiffPolicies(from, to, catalog)
+	if err != nil {
+		return 0, err
+	}
+
+	if *format == "json" {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return 0, err
+		}
+	} else {
+		fmt.Fprintln(stdout, report)
+	}
+
+	if len(report.Changes) > 0 {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// export writes the policy of an auth store
+func export(args []string, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	format := flags.String("format", "yaml", "output format: yaml or json")
+	storePath := flags.String("auth-store", "", "auth store to export")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *storePath == "" || flags.NArg() != 0 {
+		return fmt.Errorf("export expects -auth-store")
+	}
+	if *format != "yaml" && *format != "json" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	policy, err := exportStore(*storePath)
+	if err != nil {
+		return err
+	}
+	if *format == "json" {
+		return policy.WriteJSON(stdout)
+	}
+	return policy.WriteYAML(stdout)
+}
+
+// exportStore exports the policy of an existing auth store
+func exportStore(path string) (*rbac.Policy, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("failed to open auth store: %w", err)
+	}
+	store, err := auth.OpenSQLiteProvider(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open auth store: %w", err)
+	}
+	defer store.Close()
+	return rbac.System(store).ExportPolicy()
+}
+
+// loadCatalog reads the schema catalog of an existing database
+func loadCatalog(path string) (rbac.Catalog, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+	return rbac.LoadCatalog(db)
+}
+
+// loadPolicyFile reads a policy from a YAML or JSON file
+func loadPolicyFile(path string) (*rbac.Policy, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	policy, err := rbac.LoadPolicy(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return policy, nil
+}
@@ -0,0 +1,312 @@
+// Command secure-sqlite-server serves a secure SQLite database to PostgreSQL
+// clients such as psql, DBeaver and Metabase, and optionally over an HTTP/JSON
+// API and a gRPC service.
+//
+// Usage:
+//
+//	secure-sqlite-server -db database.db
+//	    (-users users.yaml [-policy policy.yaml] | -auth-store auth.db)
+//	    [-listen 127.0.0.1:5432] [-auth scram-sha-256|password]
+//	    [-tls-cert cert.pem -tls-key key.pem] [-audit-log audit.jsonl]
+//	    [-http 127.0.0.1:8080] [-grpc 127.0.0.1:9090]
+//
+// Clients log in as the users of the users file, with their tokens as
+// passwords or, over HTTP and gRPC, as bearer tokens of the form user:token.
+// Every statement runs through the checks of the user. The users file lists
+// each user with its token:
+//
+//	users:
+//	  - name: analyst
+//	    token: s3cret
+//
+// The policy file, if given, is applied to the users before the server starts.
+// Instead of a users file, -auth-store serves the users of an auth store
+// managed with secure-sqlite admin. Its tokens are stored hashed, so its users
+// log in with cleartext passwords, which should be sent over TLS.
+// Statements are SQLite statements; the PostgreSQL system catalogs are not
+// available.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/audit"
+	"github.com/wemcdonald/secure_sqlite/pkg/auth"
+	"github.com/wemcdonald/secure_sqlite/pkg/grpcapi"
+	"github.com/wemcdonald/secure_sqlite/pkg/grpcapi/securesqlitepb"
+	"github.com/wemcdonald/secure_sqlite/pkg/httpapi"
+	"github.com/wemcdonald/secure_sqlite/pkg/pgwire"
+	"github.com/wemcdonald/secure_sqlite/pkg/rbac"
+	"github.com/wemcdonald/secure_sqlite/pkg/secure_sqlite"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"gopkg.in/yaml.v3"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// usersFile lists the users clients log in as
+type usersFile struct {
+	Users []struct {
+		Name  string `yaml:"name"`
+		Token string `yaml:"token"`
+	} `yaml:"users"`
+}
+
+// run starts the server and returns the exit status once it stops
+func run(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("secure-sqlite-server", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dbPath := flags.String("db", "", "SQLite database to serve")
+	usersPath := flags.String("users", "", "YAML file of users and their tokens")
+	storePath := flags.String("auth-store", "", "SQLite auth store of users, roles and grants, instead of -users")
+	policyPath := flags.String("policy", "", "policy file applied to the users")
+	listen := flags.String("listen", "127.0.0.1:5432", "address to listen on")
+	authMethod := flags.String("auth", "", "authentication method: scram-sha-256 or password (default scram-sha-256, or password with -auth-store)")
+	certFile := flags.String("tls-cert", "", "TLS certificate file")
+	keyFile := flags.String("tls-key", "", "TLS key file")
+	auditLog := flags.String("audit-log", "", "JSONL file the audit events are appended to")
+	httpListen := flags.String("http", "", "address to serve the HTTP API on")
+	grpcListen := flags.String("grpc", "", "address to serve the gRPC service on")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *dbPath == "" || (*usersPath == "") == (*storePath == "") {
+		fmt.Fprintln(stderr, "-db and one of -users and -auth-store are required")
+		flags.Usage()
+		return 2
+	}
+
+	if _, err := os.Stat(*dbPath); err != nil {
+		fmt.Fprintf(stderr, "failed to open database: %v\n", err)
+		return 1
+	}
+	var provider auth.Provider
+	var tokens map[string]string
+	if *storePath != "" {
+		if *policyPath != "" {
+			fmt.Fprintln(stderr, "-policy applies to -users; use secure-sqlite admin policy apply for an auth store")
+			return 2
+		}
+		if *authMethod == "" {
+			*authMethod = "password"
+		} else if *authMethod == "scram-sha-256" {
+			fmt.Fprintln(stderr, "scram-sha-256 needs the tokens of -users; use -auth password with -auth-store")
+			return 2
+		}
+		if _, err := os.Stat(*storePath); err != nil {
+			fmt.Fprintf(stderr, "failed to open auth store: %v\n", err)
+			return 1
+		}
+		store, err := auth.OpenSQLiteProvider(*storePath)
+		if err != nil {
+			fmt.Fprintf(stderr, "failed to open auth store: %v\n", err)
+			return 1
+		}
+		defer store.Close()
+		provider = store
+	} else {
+		users, userTokens, err := loadUsers(*usersPath, *policyPath, *dbPath)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		provider, tokens = users, userTokens
+		if *authMethod == "" {
+			*authMethod = "scram-sha-256"
+		}
+	}
+	var handleOpts []secure_sqlite.Option
+	if *auditLog != "" {
+		sink, err := audit.OpenJSONLFile(*auditLog)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		handleOpts = append(handleOpts, secure_sqlite.WithAuditSink(sink))
+	}
+	server, err := newServer(*dbPath, provider, tokens, *authMethod, *certFile, *keyFile, handleOpts)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	// Stop on interrupt, closing the sessions of clients
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var httpServer *http.Server
+	if *httpListen != "" {
+		httpServer = newHTTPServer(*httpListen, *dbPath, provider, handleOpts)
+		go func() {
+			fmt.Fprintf(stdout, "serving HTTP API on %s\n", *httpListen)
+			var err error
+			if *certFile != "" {
+				err = httpServer.ListenAndServeTLS(*certFile, *keyFile)
+			} else {
+				err = httpServer.ListenAndServe()
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fmt.Fprintln(stderr, err)
+				stop()
+			}
+		}()
+	}
+	var grpcServer *grpc.Server
+	var service *grpcapi.Server
+	if *grpcListen != "" {
+		grpcServer, service, err = newGRPCServer(*dbPath, provider, *certFile, *keyFile, handleOpts)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		ln, err := net.Listen("tcp", *grpcListen)
+		if err != nil {
+			service.Close()
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		go func() {
+			fmt.Fprintf(stdout, "serving gRPC on %s\n", *grpcListen)
+			if err := grpcServer.Serve(ln); err != nil {
+				fmt.Fprintln(stderr, err)
+				stop()
+			}
+		}()
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+		if httpServer != nil {
+			httpServer.Close()
+		}
+		if grpcServer != nil {
+			grpcServer.Stop()
+			service.Close()
+		}
+	}()
+
+	fmt.Fprintf(stdout, "serving %s on %s\n", *dbPath, *listen)
+	if err := server.ListenAndServe(*listen); err != nil && !errors.Is(err, pgwire.ErrServerClosed) {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// loadCatalog reads the schema catalog of the database
+func loadCatalog(dbPath string) (rbac.Catalog, error) {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+	return rbac.LoadCatalog(db)
+}
+
+// loadUsers loads the users and applies the policy to them, returning the
+// auth provider of the users and their tokens
+func loadUsers(usersPath, policyPath, dbPath string) (*auth.MemoryProvider, map[string]string, error) {
+	data, err := os.ReadFile(usersPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read users: %w", err)
+	}
+	var users usersFile
+	if err := yaml.Unmarshal(data, &users); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse users: %w", err)
+	}
+	provider := auth.NewMemoryProvider()
+	tokens := make(map[string]string)
+	for _, user := range users.Users {
+		if user.Name == "" || user.Token == "" {
+			return nil, nil, fmt.Errorf("%s: every user needs a name and a token", usersPath)
+		}
+		provider.AddUser(user.Name, user.Token)
+		tokens[user.Name] = user.Token
+	}
+
+	if policyPath != "" {
+		f, err := os.Open(policyPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read policy: %w", err)
+		}
+		policy, err := rbac.LoadPolicy(f)
+		f.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", policyPath, err)
+		}
+		catalog, err := loadCatalog(dbPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := rbac.System(provider).ApplyPolicy(policy, rbac.ApplyOptions{Catalog: catalog}); err != nil {
+			return nil, nil, fmt.Errorf("failed to apply policy: %w", err)
+		}
+	}
+	return provider, tokens, nil
+}
+
+// newServer configures the PostgreSQL server
+func newServer(dbPath string, provider auth.Provider, tokens map[string]string, authMethod, certFile, keyFile string, handleOpts []secure_sqlite.Option) (*pgwire.Server, error) {
+	var opts []pgwire.Option
+	switch authMethod {
+	case "scram-sha-256":
+		opts = append(opts, pgwire.WithSCRAM(func(username string) (string, bool) {
+			token, ok := tokens[username]
+			return token, ok
+		}))
+	case "password":
+	default:
+		return nil, fmt.Errorf("unknown authentication method %q", authMethod)
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS key pair: %w", err)
+		}
+		opts = append(opts, pgwire.WithTLS(&tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}))
+	}
+	if len(handleOpts) > 0 {
+		opts = append(opts, pgwire.WithHandleOptions(handleOpts...))
+	}
+	return pgwire.NewServer(dbPath, provider, opts...), nil
+}
+
+// newHTTPServer configures the HTTP API server
+func newHTTPServer(addr, dbPath string, provider auth.Provider, handleOpts []secure_sqlite.Option) *http.Server {
+	return &http.Server{
+		Addr:    addr,
+		Handler: httpapi.NewServer(dbPath, provider, httpapi.WithHandleOptions(handleOpts...)),
+	}
+}
+
+// newGRPCServer configures the gRPC server and the service it serves
+func newGRPCServer(dbPath string, provider auth.Provider, certFile, keyFile string, handleOpts []secure_sqlite.Option) (*grpc.Server, *grpcapi.Server, error) {
+	var opts []grpc.ServerOption
+	if certFile != "" {
+		creds, err := credentials.NewServerTLSFromFile(certFile, keyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load TLS key pair: %w", err)
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	grpcServer := grpc.NewServer(opts...)
+	service := grpcapi.NewServer(dbPath, provider, grpcapi.WithHandleOptions(handleOpts...))
+	securesqlitepb.RegisterSecureSQLiteServer(grpcServer, service)
+	return grpcServer, service, nil
+}
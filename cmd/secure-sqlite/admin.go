@@ -0,0 +1,534 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/audit"
+	"github.com/wemcdonald/secure_sqlite/pkg/auth"
+	"github.com/wemcdonald/secure_sqlite/pkg/rbac"
+	"github.com/wemcdonald/secure_sqlite/pkg/secure_sqlite"
+)
+
+// adminUsage prints the admin commands
+func adminUsage(w io.Writer) {
+	fmt.Fprintln(w, "usage:")
+	fmt.Fprintln(w, "  secure-sqlite admin init -auth-store auth.db -user NAME")
+	fmt.Fprintln(w, "  secure-sqlite admin -auth-store auth.db -user NAME [-token-file FILE] [-db database.db]")
+	fmt.Fprintln(w, "      [-audit-log audit.jsonl] COMMAND")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "commands:")
+	fmt.Fprintln(w, "  user add [-token-file FILE] NAME")
+	fmt.Fprintln(w, "  user disable NAME")
+	fmt.Fprintln(w, "  user reset-token NAME")
+	fmt.Fprintln(w, "  user list")
+	fmt.Fprintln(w, "  role create NAME")
+	fmt.Fprintln(w, "  role delete NAME")
+	fmt.Fprintln(w, "  role list")
+	fmt.Fprintln(w, "  role members ROLE [add|remove USER]")
+	fmt.Fprintln(w, "  grant -table TABLE [-actions select,...] [-columns a,...] [-row COND] [-grant-option]")
+	fmt.Fprintln(w, "      [-not-before TIME] [-not-after TIME] GRANTEE")
+	fmt.Fprintln(w, "  revoke -table TABLE [-actions select,...] [-columns a,...] [-row COND] [-restrict] GRANTEE")
+	fmt.Fprintln(w, "  policy apply [-prune] [-dry-run] policy.yaml")
+	fmt.Fprintln(w, "  policy export [-format yaml|json]")
+	fmt.Fprintln(w, "  policy diff [-format text|json] policy.yaml")
+	fmt.Fprintln(w, "  session list")
+	fmt.Fprintln(w, "  session kill ID...")
+}
+
+// admin runs an admin command and returns the exit status. Commands run on a
+// handle of the admin user, so that they are checked against the privileges
+// of the user and audited.
+func admin(args []string, stdin *os.File, stdout, stderr io.Writer) int {
+	if len(args) > 0 && args[0] == "init" {
+		if err := adminInit(args[1:], stdout, stderr); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+		return 0
+	}
+
+	flags := flag.NewFlagSet("secure-sqlite admin", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() { adminUsage(stderr) }
+	storePath := flags.String("auth-store", "", "SQLite auth store of users, roles and grants")
+	dbPath := flags.String("db", "", "SQLite database whose schema policies are checked against")
+	username := flags.String("user", "", "admin user to log in as")
+	tokenFile := flags.String("token-file", "", "file holding the token of the admin user")
+	auditLog := flags.String("audit-log", "", "JSONL file the audit events are appended to")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *storePath == "" || *username == "" || flags.NArg() == 0 {
+		adminUsage(stderr)
+		return 2
+	}
+	if _, err := os.Stat(*storePath); err != nil {
+		fmt.Fprintf(stderr, "failed to open auth store: %v\n", err)
+		return 2
+	}
+
+	store, err := auth.OpenSQLiteProvider(*storePath)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to open auth store: %v\n", err)
+		return 2
+	}
+	defer store.Close()
+	token, err := readToken(*tokenFile, stdin, stderr)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	var opts []secure_sqlite.Option
+	if *auditLog != "" {
+		sink, err := audit.OpenJSONLFile(*auditLog)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+		defer sink.Close()
+		opts = append(opts, secure_sqlite.WithAuditSink(sink))
+	}
+	dsn := *dbPath
+	if dsn == "" {
+		dsn = ":memory:"
+	}
+	db, err := secure_sqlite.Open(dsn, store, *username, token, opts...)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	defer db.Close()
+
+	a := &adminCommand{db: db, checkSchema: *dbPath != "", stdout: stdout, stderr: stderr}
+	rest := flags.Args()
+	status := 0
+	switch rest[0] {
+	case "user":
+		err = a.user(rest[1:])
+	case "role":
+		err = a.role(rest[1:])
+	case "grant":
+		err = a.grant(rest[1:], false)
+	case "revoke":
+		err = a.grant(rest[1:], true)
+	case "policy":
+		status, err = a.policy(rest[1:])
+	case "session":
+		err = a.session(rest[1:])
+	default:
+		err = fmt.Errorf("unknown command %q", rest[0])
+	}
+	if errors.Is(err, errUsage) {
+		adminUsage(stderr)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	return status
+}
+
+// errUsage is returned for commands with missing or unknown arguments
+var errUsage = errors.New("usage")
+
+// adminCommand runs admin commands on a handle of the admin user
+type adminCommand struct {
+	db          *secure_sqlite.SecureSQLite
+	checkSchema bool
+	stdout      io.Writer
+	stderr      io.Writer
+}
+
+// adminInit creates an auth store with a superuser and prints the token of
+// the superuser. It refuses stores that already have users.
+func adminInit(args []string, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("init", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	storePath := flags.String("auth-store", "", "SQLite auth store to create")
+	username := flags.String("user", "", "superuser to create")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *storePath == "" || *username == "" || flags.NArg() != 0 {
+		return fmt.Errorf("init expects -auth-store and -user")
+	}
+
+	store, err := auth.OpenSQLiteProvider(*storePath)
+	if err != nil {
+		return fmt.Errorf("failed to open auth store: %w", err)
+	}
+	defer store.Close()
+	users, err := store.ListUsers()
+	if err != nil {
+		return err
+	}
+	if len(users) > 0 {
+		return fmt.Errorf("%s already has users", *storePath)
+	}
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+	if err := store.CreateUser(*username, token); err != nil {
+		return err
+	}
+	if err := rbac.BootstrapSuperuser(store, *username); err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, token)
+	return nil
+}
+
+// newToken returns a random token
+func newToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// user runs the user commands
+func (a *adminCommand) user(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	switch args[0] {
+	case "add":
+		flags := flag.NewFlagSet("user add", flag.ContinueOnError)
+		flags.SetOutput(a.stderr)
+		tokenFile := flags.String("token-file", "", "file holding the token of the user, generated if not given")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if flags.NArg() != 1 {
+			return errUsage
+		}
+		var token string
+		if *tokenFile != "" {
+			data, err := os.ReadFile(*tokenFile)
+			if err != nil {
+				return fmt.Errorf("failed to read token: %w", err)
+			}
+			token = strings.TrimSpace(string(data))
+		} else {
+			var err error
+			if token, err = newToken(); err != nil {
+				return err
+			}
+		}
+		if err := a.db.CreateUser(flags.Arg(0), token); err != nil {
+			return err
+		}
+		if *tokenFile == "" {
+			fmt.Fprintln(a.stdout, token)
+		}
+		return nil
+	case "disable":
+		if len(args) != 2 {
+			return errUsage
+		}
+		return a.db.DisableUser(args[1])
+	case "reset-token":
+		if len(args) != 2 {
+			return errUsage
+		}
+		token, err := newToken()
+		if err != nil {
+			return err
+		}
+		if err := a.db.ResetToken(args[1], token); err != nil {
+			return err
+		}
+		fmt.Fprintln(a.stdout, token)
+		return nil
+	case "list":
+		if len(args) != 1 {
+			return errUsage
+		}
+		accounts, err := a.db.ListAccounts()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(a.stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "USER\tSTATUS\tROLES")
+		for _, account := range accounts {
+			roles, err := a.db.GetUserRoles(account.Name)
+			if err != nil {
+				return err
+			}
+			sort.Strings(roles)
+			status := "active"
+			if account.Disabled {
+				status = "disabled"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", account.Name, status, strings.Join(roles, ","))
+		}
+		return w.Flush()
+	}
+	return errUsage
+}
+
+// role runs the role commands
+func (a *adminCommand) role(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	switch {
+	case args[0] == "create" && len(args) == 2:
+		_, err := a.db.CreateRole(args[1])
+		return err
+	case args[0] == "delete" && len(args) == 2:
+		return a.db.DeleteRole(args[1])
+	case args[0] == "list" && len(args) == 1:
+		roles, err := a.db.ListRoles()
+		if err != nil {
+			return err
+		}
+		for _, role := range roles {
+			fmt.Fprintln(a.stdout, role)
+		}
+		return nil
+	case args[0] == "members" && len(args) == 2:
+		members, err := a.db.RoleMembers(args[1])
+		if err != nil {
+			return err
+		}
+		for _, member := range members {
+			fmt.Fprintln(a.stdout, member)
+		}
+		return nil
+	case args[0] == "members" && len(args) == 4 && args[2] == "add":
+		return a.db.AssignRoleToUser(args[3], args[1])
+	case args[0] == "members" && len(args) == 4 && args[2] == "remove":
+		return a.db.RemoveRoleFromUser(args[3], args[1])
+	}
+	return errUsage
+}
+
+// grant runs the grant and revoke commands
+func (a *adminCommand) grant(args []string, revoke bool) error {
+	name := "grant"
+	if revoke {
+		name = "revoke"
+	}
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(a.stderr)
+	table := flags.String("table", "", "table of the grant")
+	actions := flags.String("actions", "", "comma-separated actions, such as select,update; all if empty")
+	columns := flags.String("columns", "", "comma-separated columns the grant is limited to")
+	row := flags.String("row", "", "condition on the rows of the grant")
+	grantOption := flags.Bool("grant-option", false, "allow the grantee to grant the permissions to others")
+	notBefore := flags.String("not-before", "", "RFC 3339 time the grant starts")
+	notAfter := flags.String("not-after", "", "RFC 3339 time the grant ends")
+	restrict := flags.Bool("restrict", false, "fail instead of revoking the grants made through the revoked grant option")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *table == "" || flags.NArg() != 1 {
+		return errUsage
+	}
+
+	grant := rbac.GrantPolicy{
+		Table:       *table,
+		Actions:     splitList(*actions),
+		Columns:     splitList(*columns),
+		Row:         *row,
+		GrantOption: *grantOption,
+	}
+	var err error
+	if grant.NotBefore, err = parseTime(*notBefore); err != nil {
+		return fmt.Errorf("invalid -not-before: %w", err)
+	}
+	if grant.NotAfter, err = parseTime(*notAfter); err != nil {
+		return fmt.Errorf("invalid -not-after: %w", err)
+	}
+	if revoke {
+		behavior := rbac.Cascade
+		if *restrict {
+			behavior = rbac.Restrict
+		}
+		return a.db.Revoke(flags.Arg(0), grant, behavior)
+	}
+	return a.db.Grant(flags.Arg(0), grant)
+}
+
+// policy runs the policy commands. The diff command returns 1 when the
+// policy differs from the current state.
+func (a *adminCommand) policy(args []string) (int, error) {
+	if len(args) == 0 {
+		return 0, errUsage
+	}
+	flags := flag.NewFlagSet("policy "+args[0], flag.ContinueOnError)
+	flags.SetOutput(a.stderr)
+	switch args[0] {
+	case "apply":
+		prune := flags.Bool("prune", false, "delete roles and clear users that the policy does not declare")
+		dryRun := flags.Bool("dry-run", false, "report the changes without making them")
+		if err := flags.Parse(args[1:]); err != nil {
+			return 0, err
+		}
+		if flags.NArg() != 1 {
+			return 0, errUsage
+		}
+		policy, err := a.loadPolicy(flags.Arg(0))
+		if err != nil {
+			return 0, err
+		}
+		catalog, err := rbac.LoadCatalog(a.db.DB())
+		if err != nil {
+			return 0, err
+		}
+		report, err := a.db.ApplyPolicy(policy, rbac.ApplyOptions{Prune: *prune, DryRun: *dryRun, Catalog: catalog})
+		if err != nil {
+			return 0, err
+		}
+		fmt.Fprintln(a.stdout, report)
+		return 0, nil
+	case "export":
+		format := flags.String("format", "yaml", "output format: yaml or json")
+		if err := flags.Parse(args[1:]); err != nil {
+			return 0, err
+		}
+		if flags.NArg() != 0 || (*format != "yaml" && *format != "json") {
+			return 0, errUsage
+		}
+		policy, err := a.db.ExportPolicy()
+		if err != nil {
+			return 0, err
+		}
+		if *format == "json" {
+			return 0, policy.WriteJSON(a.stdout)
+		}
+		return 0, policy.WriteYAML(a.stdout)
+	case "diff":
+		format := flags.String("format", "text", "output format: text or json")
+		if err := flags.Parse(args[1:]); err != nil {
+			return 0, err
+		}
+		if flags.NArg() != 1 || (*format != "text" && *format != "json") {
+			return 0, errUsage
+		}
+		policy, err := a.loadPolicy(flags.Arg(0))
+		if err != nil {
+			return 0, err
+		}
+		current, err := a.db.ExportPolicy()
+		if err != nil {
+			return 0, err
+		}
+		catalog, err := rbac.LoadCatalog(a.db.DB())
+		if err != nil {
+			return 0, err
+		}
+		report, err := rbac.DiffPolicies(current, policy, catalog)
+		if err != nil {
+			return 0, err
+		}
+		if *format == "json" {
+			encoder := json.NewEncoder(a.stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(report); err != nil {
+				return 0, err
+			}
+		} else {
+			fmt.Fprintln(a.stdout, report)
+		}
+		if len(report.Changes) > 0 {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, errUsage
+}
+
+// loadPolicy reads a policy file, checking it against the schema of the
+// database if one was given
+func (a *adminCommand) loadPolicy(path string) (*rbac.Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy: %w", err)
+	}
+	defer f.Close()
+	policy, err := rbac.LoadPolicy(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if a.checkSchema {
+		catalog, err := rbac.LoadCatalog(a.db.DB())
+		if err != nil {
+			return nil, err
+		}
+		if err := policy.Validate(catalog); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return policy, nil
+}
+
+// session runs the session commands
+func (a *adminCommand) session(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		sessions, err := a.db.ListSessions()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(a.stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "SESSION\tUSER\tSTARTED")
+		for _, session := range sessions {
+			id := session.ID
+			if id == a.db.SessionID() {
+				id += " (this session)"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", id, session.Username, session.Started.Format(time.RFC3339))
+		}
+		return w.Flush()
+	case args[0] == "kill" && len(args) > 1:
+		for _, id := range args[1:] {
+			if err := a.db.TerminateSession(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return errUsage
+}
+
+// splitList splits a comma-separated list, dropping empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseTime parses an optional RFC 3339 time
+func parseTime(s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// initStore creates an auth store with the superuser admin and returns its
+// path and a file holding the token of admin
+func initStore(t *testing.T) (string, string) {
+	t.Helper()
+	t.Setenv(tokenEnv, "")
+	dir := t.TempDir()
+	store := filepath.Join(dir, "auth.db")
+	var stdout, stderr bytes.Buffer
+	if status := run([]string{"admin", "init", "-auth-store", store, "-user", "admin"}, nil, &stdout, &stderr); status != 0 {
+		t.Fatalf("admin init = %d: %s", status, stderr.String())
+	}
+	tokenFile := writeFile(t, dir, "admin.token", stdout.String())
+	return store, tokenFile
+}
+
+// writeFile writes a file into a directory and returns its path
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+// runAdmin runs an admin command as the user of the token file
+func runAdmin(t *testing.T, store, user, tokenFile string, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	args = append([]string{"-auth-store", store, "-user", user, "-token-file", tokenFile}, args...)
+	status := admin(args, nil, &stdout, &stderr)
+	return status, stdout.String(), stderr.String()
+}
+
+func TestAdminCommands(t *testing.T) {
+	store, tokenFile := initStore(t)
+	dir := filepath.Dir(store)
+	clerkToken := writeFile(t, dir, "clerk.token", "clerktoken")
+
+	// The steps run in order against the same store
+	tests := []struct {
+		name       string
+		args       []string
+		wantStatus int
+		wantOut    string
+		wantErr    string
+	}{
+		{"add user with token file", []string{"user", "add", "-token-file", clerkToken, "clerk"}, 0, "", ""},
+		{"add existing user", []string{"user", "add", "-token-file", clerkToken, "clerk"}, 2, "", ""},
+		{"create role", []string{"role", "create", "analysts"}, 0, "", ""},
+		{"add member", []string{"role", "members", "analysts", "add", "clerk"}, 0, "", ""},
+		{"list roles", []string{"role", "list"}, 0, "analysts", ""},
+		{"list members", []string{"role", "members", "analysts"}, 0, "clerk\n", ""},
+		{"list users", []string{"user", "list"}, 0, "analysts", ""},
+		{"grant", []string{"grant", "-table", "orders", "-actions", "select", "-row", "qty > 0", "analysts"}, 0, "", ""},
+		{"grant with invalid time", []string{"grant", "-table", "orders", "-not-after", "tomorrow", "clerk"}, 2, "", "invalid -not-after"},
+		{"grant without table", []string{"grant", "clerk"}, 2, "", "usage:"},
+		{"export policy", []string{"policy", "export", "-format", "json"}, 0, `"name": "analysts"`, ""},
+		{"list sessions", []string{"session", "list"}, 0, "(this session)", ""},
+		{"disable user", []string{"user", "disable", "clerk"}, 0, "", ""},
+		{"list disabled user", []string{"user", "list"}, 0, "disabled", ""},
+		{"remove member", []string{"role", "members", "analysts", "remove", "clerk"}, 0, "", ""},
+		{"delete role", []string{"role", "delete", "analysts"}, 0, "", ""},
+		{"unknown command", []string{"frobnicate"}, 2, "", `unknown command "frobnicate"`},
+		{"missing subcommand", []string{"role"}, 2, "", "usage:"},
+	}
+	for _, tt := range tests {
+		status, stdout, stderr := runAdmin(t, store, "admin", tokenFile, tt.args...)
+		if status != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d (stderr: %s)", tt.name, status, tt.wantStatus, stderr)
+		}
+		if !strings.Contains(stdout, tt.wantOut) {
+			t.Errorf("%s: stdout = %q, want it to contain %q", tt.name, stdout, tt.wantOut)
+		}
+		if !strings.Contains(stderr, tt.wantErr) {
+			t.Errorf("%s: stderr = %q, want it to contain %q", tt.name, stderr, tt.wantErr)
+		}
+	}
+}
+
+func TestAdminRequiresPrivileges(t *testing.T) {
+	store, tokenFile := initStore(t)
+	clerkToken := writeFile(t, filepath.Dir(store), "clerk.token", "clerktoken")
+	if status, _, stderr := runAdmin(t, store, "admin", tokenFile, "user", "add", "-token-file", clerkToken, "clerk"); status != 0 {
+		t.Fatalf("user add = %d: %s", status, stderr)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"create role", []string{"role", "create", "clerks"}},
+		{"add user", []string{"user", "add", "mallory"}},
+		{"list roles", []string{"role", "list"}},
+		{"grant", []string{"grant", "-table", "orders", "clerk"}},
+		{"export policy", []string{"policy", "export"}},
+	}
+	for _, tt := range tests {
+		status, _, stderr := runAdmin(t, store, "clerk", clerkToken, tt.args...)
+		if status != 2 {
+			t.Errorf("%s as clerk: status = %d, want 2", tt.name, status)
+		}
+		if stderr == "" {
+			t.Errorf("%s as clerk: no error reported", tt.name)
+		}
+	}
+
+	// A wrong token does not log in
+	wrongToken := writeFile(t, filepath.Dir(store), "wrong.token", "wrong")
+	if status, _, _ := runAdmin(t, store, "admin", wrongToken, "role", "list"); status != 2 {
+		t.Errorf("role list with wrong token: status = %d, want 2", status)
+	}
+}
+
+func TestAdminInit(t *testing.T) {
+	store, _ := initStore(t)
+
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{"store with users", []string{"-auth-store", store, "-user", "root"}, "already has users"},
+		{"missing user", []string{"-auth-store", store}, "init expects -auth-store and -user"},
+		{"missing store", []string{"-user", "root"}, "init expects -auth-store and -user"},
+	}
+	for _, tt := range tests {
+		var stdout, stderr bytes.Buffer
+		status := run(append([]string{"admin", "init"}, tt.args...), nil, &stdout, &stderr)
+		if status != 2 {
+			t.Errorf("%s: status = %d, want 2", tt.name, status)
+		}
+		if !strings.Contains(stderr.String(), tt.wantErr) {
+			t.Errorf("%s: stderr = %q, want it to contain %q", tt.name, stderr.String(), tt.wantErr)
+		}
+	}
+
+	// A missing store is not created by commands other than init
+	status, _, stderr := runAdmin(t, filepath.Join(t.TempDir(), "missing.db"), "admin", "token", "role", "list")
+	if status != 2 || !strings.Contains(stderr, "failed to open auth store") {
+		t.Errorf("missing store: status = %d, stderr = %q", status, stderr)
+	}
+}
+
+func TestAdminPolicy(t *testing.T) {
+	store, tokenFile := initStore(t)
+	dir := filepath.Dir(store)
+	policy := writeFile(t, dir, "policy.yaml", `version: 1
+roles:
+  - name: auditors
+users:
+  - name: admin
+    roles: [auditors]
+    privileges:
+      - privilege: superuser
+    grants:
+      - table: orders
+        actions: [select]
+`)
+	invalid := writeFile(t, dir, "invalid.yaml", "version: 1\nroles:\n  - grants: []\n")
+
+	// The steps run in order against the same store
+	tests := []struct {
+		name       string
+		args       []string
+		wantStatus int
+		wantOut    string
+	}{
+		{"diff before apply", []string{"policy", "diff", policy}, 1, "auditors"},
+		{"dry run", []string{"policy", "apply", "-dry-run", policy}, 0, "auditors"},
+		{"diff after dry run", []string{"policy", "diff", "-format", "json", policy}, 1, "auditors"},
+		{"apply", []string{"policy", "apply", policy}, 0, "auditors"},
+		{"diff after apply", []string{"policy", "diff", policy}, 0, "no changes"},
+		{"export", []string{"policy", "export"}, 0, "name: auditors"},
+		{"invalid policy", []string{"policy", "apply", invalid}, 2, ""},
+		{"missing policy", []string{"policy", "apply", filepath.Join(dir, "missing.yaml")}, 2, ""},
+		{"unknown format", []string{"policy", "export", "-format", "xml"}, 2, ""},
+	}
+	for _, tt := range tests {
+		status, stdout, stderr := runAdmin(t, store, "admin", tokenFile, tt.args...)
+		if status != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d (stderr: %s)", tt.name, status, tt.wantStatus, stderr)
+		}
+		if !strings.Contains(stdout, tt.wantOut) {
+			t.Errorf("%s: stdout = %q, want it to contain %q", tt.name, stdout, tt.wantOut)
+		}
+	}
+}
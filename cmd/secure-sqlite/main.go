@@ -0,0 +1,374 @@
+// Command secure-sqlite is an interactive shell, like the sqlite3 shell, that
+// runs statements as a user through the checks of secure_sqlite, and an admin
+// tool for the users, roles and grants of an auth store.
+//
+// Usage:
+//
+//	secure-sqlite -db database.db (-users users.yaml | -auth-store auth.db)
+//	    -user analyst [-policy policy.yaml] [-token-file token]
+//	    [-mode table|csv|json] [-audit-log audit.jsonl] [sql ...]
+//	secure-sqlite admin -auth-store auth.db -user admin COMMAND
+//
+// The token of the user is read from the token file, from the
+// SECURE_SQLITE_TOKEN environment variable or, failing both, from a prompt.
+// The users and policy files are those of secure-sqlite-server; the auth store
+// is a SQLite database of users, roles and grants managed with the admin
+// commands. Statements given as arguments are run in order and the shell
+// exits; otherwise statements are read from standard input until .quit.
+// Statements end with a semicolon and may span lines. Lines starting with a
+// dot are commands of the shell; .help lists them.
+//
+// The admin commands manage users, roles, grants, policies and sessions of
+// the auth store as the admin user, and require its privileges. "secure-sqlite
+// admin init" creates a store with a superuser and prints its token;
+// "secure-sqlite admin help" lists the commands.
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/audit"
+	"github.com/wemcdonald/secure_sqlite/pkg/auth"
+	"github.com/wemcdonald/secure_sqlite/pkg/rbac"
+	"github.com/wemcdonald/secure_sqlite/pkg/secure_sqlite"
+	"golang.org/x/term"
+	"gopkg.in/yaml.v3"
+)
+
+// tokenEnv is the environment variable the token is read from
+const tokenEnv = "SECURE_SQLITE_TOKEN"
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// usersFile lists the users that may log in
+type usersFile struct {
+	Users []struct {
+		Name  string `yaml:"name"`
+		Token string `yaml:"token"`
+	} `yaml:"users"`
+}
+
+// run starts the shell and returns the exit status once it ends
+func run(args []string, stdin *os.File, stdout, stderr io.Writer) int {
+	if len(args) > 0 && args[0] == "admin" {
+		if len(args) > 1 && (args[1] == "help" || args[1] == "-h" || args[1] == "-help" || args[1] == "--help") {
+			adminUsage(stdout)
+			return 0
+		}
+		return admin(args[1:], stdin, stdout, stderr)
+	}
+
+	flags := flag.NewFlagSet("secure-sqlite", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dbPath := flags.String("db", "", "SQLite database to open")
+	usersPath := flags.String("users", "", "YAML file of users and their tokens")
+	storePath := flags.String("auth-store", "", "SQLite auth store of users, roles and grants")
+	policyPath := flags.String("policy", "", "policy file applied to the users")
+	username := flags.String("user", "", "user to log in as")
+	tokenFile := flags.String("token-file", "", "file holding the token of the user")
+	mode := flags.String("mode", "table", "output mode: table, csv or json")
+	auditLog := flags.String("audit-log", "", "JSONL file the audit events are appended to")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *dbPath == "" || (*usersPath == "") == (*storePath == "") || *username == "" {
+		fmt.Fprintln(stderr, "-db, -user and one of -users and -auth-store are required")
+		flags.Usage()
+		return 2
+	}
+	if !validMode(*mode) {
+		fmt.Fprintf(stderr, "unknown output mode %q\n", *mode)
+		return 2
+	}
+
+	var provider auth.Provider
+	if *storePath != "" {
+		if *policyPath != "" {
+			fmt.Fprintln(stderr, "-policy applies to -users; use secure-sqlite admin policy apply for an auth store")
+			return 2
+		}
+		if _, err := os.Stat(*storePath); err != nil {
+			fmt.Fprintf(stderr, "failed to open auth store: %v\n", err)
+			return 1
+		}
+		store, err := auth.OpenSQLiteProvider(*storePath)
+		if err != nil {
+			fmt.Fprintf(stderr, "failed to open auth store: %v\n", err)
+			return 1
+		}
+		defer store.Close()
+		provider = store
+	} else {
+		users, err := loadUsers(*usersPath, *policyPath, *dbPath)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		provider = users
+	}
+	token, err := readToken(*tokenFile, stdin, stderr)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	// Keep the events of the session for .audit
+	events := &eventLog{}
+	var sink audit.Sink = events
+	if *auditLog != "" {
+		file, err := audit.OpenJSONLFile(*auditLog)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		defer file.Close()
+		sink = audit.Multi(events, file)
+	}
+	db, err := secure_sqlite.Open(*dbPath, provider, *username, token, secure_sqlite.WithAuditSink(sink))
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer db.Close()
+
+	sh := &shell{
+		db:     db,
+		user:   *username,
+		mode:   *mode,
+		events: events,
+		stdout: stdout,
+		stderr: stderr,
+	}
+	ctx := context.Background()
+	if rest := flags.Args(); len(rest) > 0 {
+		return sh.runScript(ctx, strings.NewReader(strings.Join(rest, "\n")+"\n"))
+	}
+	if term.IsTerminal(int(stdin.Fd())) {
+		sh.prompt = "secure-sqlite> "
+		sh.continuation = "         ...> "
+		fmt.Fprintf(stdout, "Logged in to %s as %s. Enter \".help\" for usage hints.\n", *dbPath, *username)
+	}
+	sh.runScript(ctx, stdin)
+	return 0
+}
+
+// readToken reads the token of the user from a file, the environment or a
+// prompt, in that order
+func readToken(tokenFile string, stdin *os.File, stderr io.Writer) (string, error) {
+	if tokenFile != "" {
+		data, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read token: %w", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	if token := os.Getenv(tokenEnv); token != "" {
+		return token, nil
+	}
+	if !term.IsTerminal(int(stdin.Fd())) {
+		return "", errors.New("no token: use -token-file or " + tokenEnv)
+	}
+	fmt.Fprint(stderr, "Token: ")
+	token, err := term.ReadPassword(int(stdin.Fd()))
+	fmt.Fprintln(stderr)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token: %w", err)
+	}
+	return string(token), nil
+}
+
+// loadCatalog reads the schema catalog of the database
+func loadCatalog(dbPath string) (rbac.Catalog, error) {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+	return rbac.LoadCatalog(db)
+}
+
+// loadUsers loads the users and applies the policy to them, narrowing grants
+// on every table to the tables of the database
+func loadUsers(usersPath, policyPath, dbPath string) (*auth.MemoryProvider, error) {
+	data, err := os.ReadFile(usersPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read users: %w", err)
+	}
+	var users usersFile
+	if err := yaml.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("failed to parse users: %w", err)
+	}
+	provider := auth.NewMemoryProvider()
+	for _, user := range users.Users {
+		if user.Name == "" || user.Token == "" {
+			return nil, fmt.Errorf("%s: every user needs a name and a token", usersPath)
+		}
+		provider.AddUser(user.Name, user.Token)
+	}
+
+	if policyPath != "" {
+		f, err := os.Open(policyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read policy: %w", err)
+		}
+		policy, err := rbac.LoadPolicy(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", policyPath, err)
+		}
+		catalog, err := loadCatalog(dbPath)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := rbac.System(provider).ApplyPolicy(policy, rbac.ApplyOptions{Catalog: catalog}); err != nil {
+			return nil, fmt.Errorf("failed to apply policy: %w", err)
+		}
+	}
+	return provider, nil
+}
+
+// runScript runs the statements and commands of a script and returns 1 if any
+// of them failed
+func (sh *shell) runScript(ctx context.Context, r io.Reader) int {
+	status := 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	var pending string
+	sh.showPrompt(pending)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(pending) == "" && strings.HasPrefix(strings.TrimSpace(line), ".") {
+			pending = ""
+			quit, err := sh.command(ctx, strings.TrimSpace(line))
+			if err != nil {
+				sh.printError(err)
+				status = 1
+			}
+			if quit {
+				return status
+			}
+			sh.showPrompt(pending)
+			continue
+		}
+
+		var stmts []string
+		stmts, pending = splitStatements(pending + line + "\n")
+		for _, stmt := range stmts {
+			if err := sh.execute(ctx, stmt); err != nil {
+				sh.printError(err)
+				status = 1
+			}
+		}
+		sh.showPrompt(pending)
+	}
+	if err := scanner.Err(); err != nil {
+		sh.printError(err)
+		return 1
+	}
+	// Run a last statement without its semicolon
+	if stmt := strings.TrimSpace(pending); stmt != "" && !isComment(stmt) {
+		if err := sh.execute(ctx, stmt); err != nil {
+			sh.printError(err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// showPrompt prints the prompt for the next line, if the shell is interactive
+func (sh *shell) showPrompt(pending string) {
+	if sh.prompt == "" {
+		return
+	}
+	if strings.TrimSpace(pending) == "" {
+		fmt.Fprint(sh.stdout, sh.prompt)
+	} else {
+		fmt.Fprint(sh.stdout, sh.continuation)
+	}
+}
+
+// printError reports an error of a statement or command
+func (sh *shell) printError(err error) {
+	var dbErr *secure_sqlite.DBError
+	if errors.As(err, &dbErr) {
+		fmt.Fprintf(sh.stderr, "Error: %s (%s)\n", dbErr.Message, dbErr.Code)
+		return
+	}
+	fmt.Fprintf(sh.stderr, "Error: %v\n", err)
+}
+
+// splitStatements splits the complete statements, ending with a semicolon
+// outside quotes and comments, off a script. It returns the statements and the
+// incomplete rest of the script.
+func splitStatements(script string) ([]string, string) {
+	var stmts []string
+	start := 0
+	for i := 0; i < len(script); i++ {
+		switch c := script[i]; {
+		case c == '\'' || c == '"' || c == '`':
+			// Quotes are escaped by doubling them, which this also skips
+			end := strings.IndexByte(script[i+1:], c)
+			if end < 0 {
+				return stmts, script[start:]
+			}
+			i += end + 1
+		case c == '[':
+			end := strings.IndexByte(script[i+1:], ']')
+			if end < 0 {
+				return stmts, script[start:]
+			}
+			i += end + 1
+		case c == '-' && strings.HasPrefix(script[i:], "--"):
+			end := strings.IndexByte(script[i:], '\n')
+			if end < 0 {
+				return stmts, script[start:]
+			}
+			i += end
+		case c == '/' && strings.HasPrefix(script[i:], "/*"):
+			end := strings.Index(script[i+2:], "*/")
+			if end < 0 {
+				return stmts, script[start:]
+			}
+			i += end + 3
+		case c == ';':
+			if stmt := strings.TrimSpace(script[start:i]); stmt != "" && !isComment(stmt) {
+				stmts = append(stmts, stmt)
+			}
+			start = i + 1
+		}
+	}
+	return stmts, script[start:]
+}
+
+// isComment reports whether a statement holds nothing but comments
+func isComment(stmt string) bool {
+	for stmt != "" {
+		switch {
+		case strings.HasPrefix(stmt, "--"):
+			end := strings.IndexByte(stmt, '\n')
+			if end < 0 {
+				return true
+			}
+			stmt = strings.TrimSpace(stmt[end:])
+		case strings.HasPrefix(stmt, "/*"):
+			end := strings.Index(stmt, "*/")
+			if end < 0 {
+				return true
+			}
+			stmt = strings.TrimSpace(stmt[end+2:])
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// validMode reports whether an output mode is known
+func validMode(mode string) bool {
+	switch mode {
+	case "table", "csv", "json":
+		return true
+	}
+	return false
+}
+
+// writeResult prints the rows of a query in an output mode
+func writeResult(w io.Writer, mode string, columns []string, rows [][]interface{}) error {
+	switch mode {
+	case "csv":
+		return writeCSV(w, columns, rows)
+	case "json":
+		return writeJSON(w, columns, rows)
+	}
+	writeTable(w, columns, rows)
+	return nil
+}
+
+// writeTable prints rows as a table with borders
+func writeTable(w io.Writer, columns []string, rows [][]interface{}) {
+	widths := make([]int, len(columns))
+	for i, col := range columns {
+		widths[i] = utf8.RuneCountInString(col)
+	}
+	cells := make([][]string, len(rows))
+	for r, row := range rows {
+		cells[r] = make([]string, len(row))
+		for i, value := range row {
+			cells[r][i] = text(value, "NULL")
+			if n := utf8.RuneCountInString(cells[r][i]); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+
+	border := "+"
+	for _, width := range widths {
+		border += strings.Repeat("-", width+2) + "+"
+	}
+	line := func(values []string) {
+		var b strings.Builder
+		b.WriteString("|")
+		for i, value := range values {
+			fmt.Fprintf(&b, " %s%s |", value, strings.Repeat(" ", widths[i]-utf8.RuneCountInString(value)))
+		}
+		fmt.Fprintln(w, b.String())
+	}
+	fmt.Fprintln(w, border)
+	line(columns)
+	fmt.Fprintln(w, border)
+	for _, row := range cells {
+		line(row)
+	}
+	if len(rows) > 0 {
+		fmt.Fprintln(w, border)
+	}
+}
+
+// writeCSV prints rows as CSV with a header; NULL is an empty field
+func writeCSV(w io.Writer, columns []string, rows [][]interface{}) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return err
+	}
+	record := make([]string, len(columns))
+	for _, row := range rows {
+		for i, value := range row {
+			record[i] = text(value, "")
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeJSON prints rows as a JSON array of objects keyed by column
+func writeJSON(w io.Writer, columns []string, rows [][]interface{}) error {
+	objects := make([]map[string]interface{}, len(rows))
+	for r, row := range rows {
+		objects[r] = make(map[string]interface{}, len(columns))
+		for i, value := range row {
+			if b, ok := value.([]byte); ok {
+				value = string(b)
+			}
+			objects[r][columns[i]] = value
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(objects)
+}
+
+// text formats a value for display, with null standing for NULL
+func text(value interface{}, null string) string {
+	switch v := value.(type) {
+	case nil:
+		return null
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(value)
+}
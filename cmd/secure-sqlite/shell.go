@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/audit"
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+	"github.com/wemcdonald/secure_sqlite/pkg/secure_sqlite"
+)
+
+// maxEvents is the number of audit events the shell keeps for .audit
+const maxEvents = 1000
+
+// shell runs statements and commands as a user
+type shell struct {
+	db     *secure_sqlite.SecureSQLite
+	user   string
+	mode   string
+	events *eventLog
+	stdout io.Writer
+	stderr io.Writer
+	// prompt and continuation are printed before lines read interactively
+	prompt       string
+	continuation string
+}
+
+// eventLog keeps the latest audit events of the session
+type eventLog struct {
+	mu     sync.Mutex
+	events []audit.Event
+}
+
+// Record implements audit.Sink
+func (l *eventLog) Record(ctx context.Context, event audit.Event) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, event)
+	if len(l.events) > maxEvents {
+		l.events = l.events[len(l.events)-maxEvents:]
+	}
+	return nil
+}
+
+// latest returns the last n events, oldest first
+func (l *eventLog) latest(n int) []audit.Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n > len(l.events) {
+		n = len(l.events)
+	}
+	return append([]audit.Event(nil), l.events[len(l.events)-n:]...)
+}
+
+// execute runs a statement and prints its result
+func (sh *shell) execute(ctx context.Context, stmt string) error {
+	if !returnsRows(stmt) {
+		result, err := sh.db.ExecContext(ctx, stmt)
+		if err != nil {
+			return err
+		}
+		if sh.prompt != "" {
+			if n, err := result.RowsAffected(); err == nil {
+				fmt.Fprintf(sh.stdout, "%d rows affected\n", n)
+			}
+		}
+		return nil
+	}
+
+	rows, err := sh.db.QueryContext(ctx, stmt)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	var values [][]interface{}
+	for rows.Next() {
+		row := make([]interface{}, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range row {
+			dest[i] = &row[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		values = append(values, row)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return writeResult(sh.stdout, sh.mode, columns, values)
+}
+
+// returnsRows reports whether a statement is a query
+func returnsRows(stmt string) bool {
+	fields := strings.Fields(stmt)
+	if len(fields) == 0 {
+		return false
+	}
+	switch strings.ToUpper(strings.TrimLeft(fields[0], "(")) {
+	case "SELECT", "WITH", "VALUES":
+		return true
+	}
+	return false
+}
+
+// command runs a dot-command. It reports whether the shell should exit.
+func (sh *shell) command(ctx context.Context, line string) (bool, error) {
+	name, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+	switch name {
+	case ".quit", ".exit":
+		return true, nil
+	case ".help":
+		sh.help()
+	case ".mode":
+		if arg == "" {
+			fmt.Fprintf(sh.stdout, "current output mode: %s\n", sh.mode)
+			return false, nil
+		}
+		if !validMode(arg) {
+			return false, fmt.Errorf("unknown output mode %q", arg)
+		}
+		sh.mode = arg
+	case ".tables":
+		return false, sh.tables(ctx)
+	case ".whoami":
+		return false, sh.whoami()
+	case ".grants":
+		return false, sh.grants()
+	case ".explain-access":
+		if arg == "" {
+			return false, fmt.Errorf("usage: .explain-access SQL")
+		}
+		return false, sh.explainAccess(ctx, strings.TrimSuffix(arg, ";"))
+	case ".audit":
+		n := 10
+		if arg != "" {
+			var err error
+			if n, err = strconv.Atoi(arg); err != nil || n < 1 {
+				return false, fmt.Errorf("usage: .audit [N]")
+			}
+		}
+		sh.audit(n)
+	default:
+		return false, fmt.Errorf("unknown command %s, enter \".help\" for usage hints", name)
+	}
+	return false, nil
+}
+
+// help lists the dot-commands
+func (sh *shell) help() {
+	fmt.Fprint(sh.stdout, `.audit [N]              Show the last N audit events of the session (default 10)
+.exit                   Exit the shell
+.explain-access SQL     Show how the access checks treat a statement
+.grants                 List the permissions of the user
+.help                   Show this message
+.mode [table|csv|json]  Set or show the output mode
+.quit                   Exit the shell
+.tables                 List the tables the user can read
+.whoami                 Show the user, session, roles and privileges
+`)
+}
+
+// tables lists the tables the user can see
+func (sh *shell) tables(ctx context.Context) error {
+	tables, err := sh.db.VisibleTables(ctx)
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		fmt.Fprintln(sh.stdout, table)
+	}
+	return nil
+}
+
+// whoami describes the user and session
+func (sh *shell) whoami() error {
+	session, err := sh.db.Session()
+	if err != nil {
+		return err
+	}
+	roles := append([]string(nil), session.Roles...)
+	sort.Strings(roles)
+	var privileges []string
+	for _, privilege := range permissions.Privileges {
+		held, err := sh.db.HasPrivilege(sh.user, privilege, "")
+		if err != nil {
+			return err
+		}
+		if held {
+			privileges = append(privileges, privilege.String())
+		}
+	}
+	fmt.Fprintf(sh.stdout, "user:       %s\n", session.Username)
+	fmt.Fprintf(sh.stdout, "session:    %s\n", sh.db.SessionID())
+	fmt.Fprintf(sh.stdout, "roles:      %s\n", listOrNone(roles))
+	fmt.Fprintf(sh.stdout, "privileges: %s\n", listOrNone(privileges))
+	return nil
+}
+
+// grants lists the effective permissions of the user
+func (sh *shell) grants() error {
+	perms, err := sh.db.GetEffectivePermissions(sh.user)
+	if err != nil {
+		return err
+	}
+	lines := make([]string, len(perms))
+	for i, perm := range perms {
+		lines[i] = perm.String()
+	}
+	sort.Strings(lines)
+	for _, line := range lines {
+		fmt.Fprintln(sh.stdout, line)
+	}
+	return nil
+}
+
+// explainAccess describes the checks of a statement
+func (sh *shell) explainAccess(ctx context.Context, stmt string) error {
+	e, err := sh.db.ExplainAccess(ctx, stmt)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(sh.stdout, "action:  %s\n", e.Action)
+	if len(e.Tables) > 0 {
+		fmt.Fprintf(sh.stdout, "tables:  %s\n", strings.Join(e.Tables, ", "))
+	}
+	if len(e.Columns) > 0 {
+		fmt.Fprintf(sh.stdout, "columns: %s\n", strings.Join(e.Columns, ", "))
+	}
+	for _, check := range e.Checks {
+		outcome := "allow"
+		if !check.Allowed {
+			outcome = "deny "
+		}
+		target := check.Target
+		if target == "" {
+			target = "-"
+		}
+		fmt.Fprintf(sh.stdout, "  %s %-9s %s: %s\n", outcome, check.Check, target, check.Detail)
+	}
+	if e.Allowed() {
+		fmt.Fprintln(sh.stdout, "result:  allowed")
+		fmt.Fprintf(sh.stdout, "runs as: %s\n", e.Rewritten)
+	} else {
+		fmt.Fprintln(sh.stdout, "result:  denied")
+	}
+	return nil
+}
+
+// audit prints the last audit events of the session
+func (sh *shell) audit(n int) {
+	for _, event := range sh.events.latest(n) {
+		fields := []string{event.Time.Format(time.RFC3339), string(event.Type)}
+		if event.Decision != "" {
+			fields = append(fields, string(event.Decision))
+		}
+		if event.Action != "" {
+			fields = append(fields, event.Action)
+		}
+		if event.ErrorCode != "" {
+			fields = append(fields, event.ErrorCode)
+		}
+		switch {
+		case event.Statement != "":
+			fields = append(fields, event.Statement)
+		case event.Detail != "":
+			fields = append(fields, event.Detail)
+		}
+		fmt.Fprintln(sh.stdout, strings.Join(fields, "  "))
+	}
+}
+
+// listOrNone joins a list, or returns "(none)" for an empty one
+func listOrNone(items []string) string {
+	if len(items) == 0 {
+		return "(none)"
+	}
+	return strings.Join(items, ", ")
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// createDatabase creates a database with orders and secrets tables and an auth
+// store where clerk may read the orders of a positive quantity
+func createDatabase(t *testing.T) (string, string, string) {
+	t.Helper()
+	store, tokenFile := initStore(t)
+	dir := filepath.Dir(store)
+	dbPath := filepath.Join(dir, "shop.db")
+
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	for _, query := range []string{
+		"CREATE TABLE orders (id INTEGER PRIMARY KEY, item TEXT NOT NULL, qty INTEGER)",
+		"CREATE TABLE secrets (id INTEGER PRIMARY KEY, value TEXT)",
+		"INSERT INTO orders (item, qty) VALUES ('apple', 3), ('pear', 0), ('plum', 5)",
+		"INSERT INTO secrets (value) VALUES ('hidden')",
+	} {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatalf("Failed to set up database: %v", err)
+		}
+	}
+
+	clerkToken := writeFile(t, dir, "clerk.token", "clerktoken")
+	for _, args := range [][]string{
+		{"user", "add", "-token-file", clerkToken, "clerk"},
+		{"grant", "-table", "orders", "-actions", "select,insert", "-row", "qty > 0", "clerk"},
+	} {
+		if status, _, stderr := runAdmin(t, store, "admin", tokenFile, append([]string{"-db", dbPath}, args...)...); status != 0 {
+			t.Fatalf("admin %s = %d: %s", strings.Join(args, " "), status, stderr)
+		}
+	}
+	return dbPath, store, clerkToken
+}
+
+// runShell runs statements and commands in the shell as clerk
+func runShell(dbPath, store, tokenFile string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	args = append([]string{"-db", dbPath, "-auth-store", store, "-user", "clerk", "-token-file", tokenFile}, args...)
+	status := run(args, nil, &stdout, &stderr)
+	return status, stdout.String(), stderr.String()
+}
+
+func TestShell(t *testing.T) {
+	dbPath, store, clerkToken := createDatabase(t)
+
+	tests := []struct {
+		name       string
+		args       []string
+		wantStatus int
+		wantOut    string
+		wantErr    string
+	}{
+		{
+			name:    "rows limited by the row condition",
+			args:    []string{"-mode", "csv", "SELECT item, qty FROM orders ORDER BY id;"},
+			wantOut: "item,qty\napple,3\nplum,5\n",
+		},
+		{
+			name:    "json output",
+			args:    []string{"-mode", "json", "SELECT item FROM orders WHERE id = 1"},
+			wantOut: `"item": "apple"`,
+		},
+		{
+			name:       "table without grant",
+			args:       []string{"SELECT * FROM secrets;"},
+			wantStatus: 1,
+			wantErr:    "(PERMISSION_DENIED)",
+		},
+		{
+			name:       "failed statement does not stop the script",
+			args:       []string{"-mode", "csv", "SELECT * FROM secrets;", "SELECT count(*) AS n FROM orders;"},
+			wantStatus: 1,
+			wantOut:    "n\n2\n",
+			wantErr:    "(PERMISSION_DENIED)",
+		},
+		{
+			name:    "whoami",
+			args:    []string{".whoami"},
+			wantOut: "clerk",
+		},
+		{
+			name:    "tables",
+			args:    []string{".tables"},
+			wantOut: "orders",
+		},
+		{
+			name:    "grants",
+			args:    []string{".grants"},
+			wantOut: "qty > 0",
+		},
+		{
+			name:    "mode command",
+			args:    []string{".mode csv", "SELECT item FROM orders WHERE id = 3;"},
+			wantOut: "item\nplum\n",
+		},
+		{
+			name:       "unknown mode",
+			args:       []string{"-mode", "xml", "SELECT 1;"},
+			wantStatus: 2,
+			wantErr:    `unknown output mode "xml"`,
+		},
+		{
+			name:       "policy with auth store",
+			args:       []string{"-policy", "policy.yaml", "SELECT 1;"},
+			wantStatus: 2,
+			wantErr:    "-policy applies to -users",
+		},
+	}
+	for _, tt := range tests {
+		status, stdout, stderr := runShell(dbPath, store, clerkToken, tt.args...)
+		if status != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d (stderr: %s)", tt.name, status, tt.wantStatus, stderr)
+		}
+		if !strings.Contains(stdout, tt.wantOut) {
+			t.Errorf("%s: stdout = %q, want it to contain %q", tt.name, stdout, tt.wantOut)
+		}
+		if !strings.Contains(stderr, tt.wantErr) {
+			t.Errorf("%s: stderr = %q, want it to contain %q", tt.name, stderr, tt.wantErr)
+		}
+	}
+
+	// Statements given as arguments write to the database
+	if status, _, stderr := runShell(dbPath, store, clerkToken, "INSERT INTO orders (item, qty) VALUES ('fig', 2);"); status != 0 {
+		t.Errorf("insert: status = %d, want 0 (stderr: %s)", status, stderr)
+	}
+	if _, stdout, _ := runShell(dbPath, store, clerkToken, "-mode", "csv", "SELECT qty FROM orders WHERE item = 'fig';"); stdout != "qty\n2\n" {
+		t.Errorf("inserted row: stdout = %q, want %q", stdout, "qty\n2\n")
+	}
+
+	// A disabled user cannot log in
+	adminToken := filepath.Join(filepath.Dir(store), "admin.token")
+	if status, _, stderr := runAdmin(t, store, "admin", adminToken, "user", "disable", "clerk"); status != 0 {
+		t.Fatalf("user disable = %d: %s", status, stderr)
+	}
+	if status, _, _ := runShell(dbPath, store, clerkToken, "SELECT 1;"); status != 1 {
+		t.Errorf("disabled user: status = %d, want 1", status)
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		script string
+		stmts  []string
+		rest   string
+	}{
+		{"SELECT 1;", []string{"SELECT 1"}, ""},
+		{"SELECT 1; SELECT 2;\n", []string{"SELECT 1", "SELECT 2"}, "\n"},
+		{"SELECT ';';", []string{"SELECT ';'"}, ""},
+		{"SELECT 1 -- ;\n", nil, "SELECT 1 -- ;\n"},
+		{"SELECT 1 /* ; */", nil, "SELECT 1 /* ; */"},
+		{"SELECT 1; SELECT", []string{"SELECT 1"}, " SELECT"},
+	}
+	for _, tt := range tests {
+		stmts, rest := splitStatements(tt.script)
+		if !reflect.DeepEqual(stmts, tt.stmts) || rest != tt.rest {
+			t.Errorf("splitStatements(%q) = %q, %q, want %q, %q", tt.script, stmts, rest, tt.stmts, tt.rest)
+		}
+	}
+}
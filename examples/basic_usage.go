@@ -22,13 +22,6 @@ func main() {
 	// Create a memory auth provider
 	memoryAuth := auth.NewMemoryProvider()
 
-	// Create the secure database
-	db, err := secure_sqlite.Open(tmpFile.Name(), memoryAuth, "admin", "admin-token")
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer db.Close()
-
 	// Create users
 	adminUser := "admin"
 	adminToken := "admin-token"
@@ -38,8 +31,21 @@ func main() {
 	user2Token := "bob-token"
 
 	memoryAuth.AddUser(adminUser, adminToken)
-	memoryAuth.AddUser(user1, user1Token)
-	memoryAuth.AddUser(user2, user2Token)
+
+	// Create the secure database, bootstrapping the admin as superuser
+	db, err := secure_sqlite.Open(tmpFile.Name(), memoryAuth, adminUser, adminToken, secure_sqlite.WithSuperuser(adminUser))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	// The superuser creates the other users
+	if err := db.CreateUser(user1, user1Token); err != nil {
+		log.Fatal(err)
+	}
+	if err := db.CreateUser(user2, user2Token); err != nil {
+		log.Fatal(err)
+	}
 
 	// Create roles
 	adminRoleID, err := db.CreateRole("admin")
@@ -95,7 +101,7 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = db.GrantRowPermission(userRoleID, "users", "department = current_user_department()", permissions.RowPermission)
+	err = db.GrantRowPermission(userRoleID, "users", "department = current_setting('department')", permissions.RowPermission)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,324 @@
+// Package abac provides attribute-based access control policies that are
+// evaluated alongside role-based permissions
+package abac
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+)
+
+// Effect is the effect of a policy when it matches a request
+type Effect int
+
+const (
+	Allow Effect = iota
+	Deny
+)
+
+// String implements the Stringer interface for Effect
+func (e Effect) String() string {
+	switch e {
+	case Allow:
+		return "allow"
+	case Deny:
+		return "deny"
+	default:
+		return "unknown"
+	}
+}
+
+// Result is the outcome of evaluating the policies for a request
+type Result int
+
+const (
+	// NotApplicable means no policy matched and the decision is left to RBAC
+	NotApplicable Result = iota
+	// Permit means an allow policy matched and no deny policy did
+	Permit
+	// Forbid means a deny policy matched
+	Forbid
+)
+
+// String implements the Stringer interface for Result
+func (r Result) String() string {
+	switch r {
+	case Permit:
+		return "permit"
+	case Forbid:
+		return "forbid"
+	default:
+		return "not_applicable"
+	}
+}
+
+// Principal describes the user a request is made for
+type Principal struct {
+	Username   string
+	Roles      []string
+	Attributes map[string]interface{}
+}
+
+// HasRole checks if the principal holds a role
+func (p Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Resource describes what a request accesses
+type Resource struct {
+	Table string
+	// Columns are the columns of the table the request references in any
+	// clause, with * expanded
+	Columns []string
+	Action  permissions.Action
+}
+
+// Environment describes the circumstances of a request
+type Environment struct {
+	Time     time.Time
+	ClientIP net.IP
+}
+
+// Request is the input to policy evaluation
+type Request struct {
+	Principal   Principal
+	Resource    Resource
+	Environment Environment
+}
+
+// Condition decides whether a policy applies to a request
+type Condition func(req *Request) (bool, error)
+
+// Policy is an attribute-based access control rule. A policy matches a request
+// when the action, table and columns are covered by its target and its
+// condition holds.
+type Policy struct {
+	// Name uniquely identifies the policy
+	Name string
+	// Effect is applied when the policy matches
+	Effect Effect
+	// Actions the policy covers; empty means all actions
+	Actions []permissions.Action
+	// Tables the policy covers; "*" matches every table
+	Tables []string
+	// Columns the policy covers; empty means all columns. An allow policy only
+	// covers a request if every requested column is listed, a deny policy
+	// covers it if any requested column is listed.
+	Columns []string
+	// Condition must hold for the policy to match; nil always holds
+	Condition Condition
+	// RowFilter restricts the rows an allow policy grants access to. It may use
+	// the session variable functions supported by row-level conditions.
+	RowFilter string
+	// CheckFilter must hold for the rows an allow policy lets INSERT and UPDATE
+	// statements write; empty means any row may be written
+	CheckFilter string
+}
+
+// Decision is the result of evaluating the policies for a request
+type Decision struct {
+	Result Result
+	// Policy is the name of the deciding policy
+	Policy string
+	// RowFilter restricts the rows of a permitted request; empty means all rows
+	RowFilter string
+	// CheckFilter must hold for the rows written by a permitted request; empty
+	// means any row may be written
+	CheckFilter string
+}
+
+// ABACManager handles attribute-based access control policies
+type ABACManager struct {
+	policies []Policy
+	mu       sync.RWMutex
+
+	// Now returns the current time used for the request environment
+	Now func() time.Time
+}
+
+// NewABACManager creates a new ABAC manager
+func NewABACManager() *ABACManager {
+	return &ABACManager{
+		Now: time.Now,
+	}
+}
+
+// AddPolicy adds a policy
+func (m *ABACManager) AddPolicy(policy Policy) error {
+	if policy.Name == "" {
+		return fmt.Errorf("policy name cannot be empty")
+	}
+	if len(policy.Tables) == 0 {
+		return fmt.Errorf("policy %s must target at least one table", policy.Name)
+	}
+	if policy.RowFilter != "" && policy.Effect != Allow {
+		return fmt.Errorf("policy %s: only allow policies can have a row filter", policy.Name)
+	}
+	if policy.CheckFilter != "" && policy.Effect != Allow {
+		return fmt.Errorf("policy %s: only allow policies can have a check filter", policy.Name)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, p := range m.policies {
+		if p.Name == policy.Name {
+			return fmt.Errorf("policy %s already exists", policy.Name)
+		}
+	}
+	m.policies = append(m.policies, policy)
+	return nil
+}
+
+// RemovePolicy removes a policy
+func (m *ABACManager) RemovePolicy(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, p := range m.policies {
+		if p.Name == name {
+			m.policies = append(m.policies[:i], m.policies[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("policy %s not found", name)
+}
+
+// Policies returns all policies
+func (m *ABACManager) Policies() []Policy {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	policies := make([]Policy, len(m.policies))
+	copy(policies, m.policies)
+	return policies
+}
+
+// NewEnvironment builds the request environment from a context
+func (m *ABACManager) NewEnvironment(ctx context.Context) Environment {
+	return Environment{
+		Time:     m.Now(),
+		ClientIP: ClientIPFromContext(ctx),
+	}
+}
+
+// Evaluate evaluates all policies for a request. Deny policies take precedence
+// over allow policies. The row and check filters of all matching allow policies
+// are combined with OR; an allow policy without a filter grants all rows.
+func (m *ABACManager) Evaluate(req *Request) (*Decision, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var allowed []Policy
+	for _, policy := range m.policies {
+		matches, err := policy.matches(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to evaluate policy %s: %w", policy.Name, err)
+		}
+		if !matches {
+			continue
+		}
+		if policy.Effect == Deny {
+			return &Decision{Result: Forbid, Policy: policy.Name}, nil
+		}
+		allowed = append(allowed, policy)
+	}
+
+	if len(allowed) == 0 {
+		return &Decision{Result: NotApplicable}, nil
+	}
+
+	// Combine the row and check filters of the matching allow policies
+	decision := &Decision{Result: Permit, Policy: allowed[0].Name}
+	decision.RowFilter = combineFilters(allowed, func(p Policy) string { return p.RowFilter })
+	decision.CheckFilter = combineFilters(allowed, func(p Policy) string { return p.CheckFilter })
+	return decision, nil
+}
+
+// combineFilters combines a filter of several policies with OR. A policy
+// without the filter allows all rows, so the result is empty.
+func combineFilters(policies []Policy, filter func(Policy) string) string {
+	filters := make([]string, 0, len(policies))
+	for _, policy := range policies {
+		f := filter(policy)
+		if f == "" {
+			return ""
+		}
+		filters = append(filters, "("+f+")")
+	}
+	return strings.Join(filters, " OR ")
+}
+
+// matches checks if a policy matches a request
+func (p Policy) matches(req *Request) (bool, error) {
+	if !p.coversAction(req.Resource.Action) || !p.coversTable(req.Resource.Table) || !p.coversColumns(req.Resource.Columns) {
+		return false, nil
+	}
+	if p.Condition == nil {
+		return true, nil
+	}
+	return p.Condition(req)
+}
+
+// coversAction checks if the policy targets an action
+func (p Policy) coversAction(action permissions.Action) bool {
+	if len(p.Actions) == 0 {
+		return true
+	}
+	for _, a := range p.Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// coversTable checks if the policy targets a table
+func (p Policy) coversTable(table string) bool {
+	for _, t := range p.Tables {
+		if t == permissions.WildcardPermission || strings.EqualFold(t, table) {
+			return true
+		}
+	}
+	return false
+}
+
+// coversColumns checks if the policy targets the requested columns
+func (p Policy) coversColumns(columns []string) bool {
+	if len(p.Columns) == 0 {
+		return true
+	}
+	listed := func(column string) bool {
+		for _, c := range p.Columns {
+			if c == permissions.WildcardPermission || strings.EqualFold(c, column) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if p.Effect == Deny {
+		for _, column := range columns {
+			if listed(column) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, column := range columns {
+		if !listed(column) {
+			return false
+		}
+	}
+	return true
+}
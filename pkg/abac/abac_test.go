@@ -0,0 +1,195 @@
+package abac
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+)
+
+// monday10am is a time within business hours
+var monday10am = time.Date(2024, time.January, 8, 10, 0, 0, 0, time.UTC)
+
+func newAnalystRequest(table string, at time.Time) *Request {
+	return &Request{
+		Principal: Principal{
+			Username:   "alice",
+			Roles:      []string{"analyst"},
+			Attributes: map[string]interface{}{"region": "emea"},
+		},
+		Resource: Resource{
+			Table:   table,
+			Columns: []string{"id", "amount"},
+			Action:  permissions.Select,
+		},
+		Environment: Environment{
+			Time:     at,
+			ClientIP: net.ParseIP("10.1.2.3"),
+		},
+	}
+}
+
+func TestABACManager_AddPolicy(t *testing.T) {
+	m := NewABACManager()
+
+	if err := m.AddPolicy(Policy{Tables: []string{"claims"}}); err == nil {
+		t.Error("AddPolicy succeeded without a name")
+	}
+	if err := m.AddPolicy(Policy{Name: "no-tables"}); err == nil {
+		t.Error("AddPolicy succeeded without tables")
+	}
+	if err := m.AddPolicy(Policy{Name: "deny-filter", Effect: Deny, Tables: []string{"claims"}, RowFilter: "1 = 1"}); err == nil {
+		t.Error("AddPolicy succeeded for a deny policy with a row filter")
+	}
+	if err := m.AddPolicy(Policy{Name: "deny-check", Effect: Deny, Tables: []string{"claims"}, CheckFilter: "1 = 1"}); err == nil {
+		t.Error("AddPolicy succeeded for a deny policy with a check filter")
+	}
+	if err := m.AddPolicy(Policy{Name: "claims", Tables: []string{"claims"}}); err != nil {
+		t.Errorf("AddPolicy returned unexpected error: %v", err)
+	}
+	if err := m.AddPolicy(Policy{Name: "claims", Tables: []string{"claims"}}); err == nil {
+		t.Error("AddPolicy succeeded for a duplicate name")
+	}
+	if err := m.RemovePolicy("claims"); err != nil {
+		t.Errorf("RemovePolicy returned unexpected error: %v", err)
+	}
+	if len(m.Policies()) != 0 {
+		t.Errorf("Expected no policies, got %d", len(m.Policies()))
+	}
+}
+
+func TestABACManager_Evaluate(t *testing.T) {
+	m := NewABACManager()
+	mustAdd := func(p Policy) {
+		if err := m.AddPolicy(p); err != nil {
+			t.Fatalf("AddPolicy(%s) returned unexpected error: %v", p.Name, err)
+		}
+	}
+	mustAdd(Policy{
+		Name:      "analysts-read-claims",
+		Effect:    Allow,
+		Actions:   []permissions.Action{permissions.Select},
+		Tables:    []string{"claims"},
+		Condition: All(PrincipalHasRole("analyst"), BusinessHours(time.UTC)),
+		RowFilter: "region = current_setting('region')",
+	})
+	mustAdd(Policy{
+		Name:      "internal-network-only",
+		Effect:    Deny,
+		Tables:    []string{"*"},
+		Condition: Not(ClientIPIn("10.0.0.0/8")),
+	})
+	mustAdd(Policy{
+		Name:    "no-ssn",
+		Effect:  Deny,
+		Tables:  []string{"claims"},
+		Columns: []string{"ssn"},
+	})
+
+	tests := []struct {
+		name       string
+		req        *Request
+		want       Result
+		wantPolicy string
+		wantFilter string
+	}{
+		{
+			name:       "permitted during business hours",
+			req:        newAnalystRequest("claims", monday10am),
+			want:       Permit,
+			wantPolicy: "analysts-read-claims",
+			wantFilter: "(region = current_setting('region'))",
+		},
+		{
+			name: "not applicable outside business hours",
+			req:  newAnalystRequest("claims", monday10am.Add(9*time.Hour)),
+			want: NotApplicable,
+		},
+		{
+			name: "not applicable for other tables",
+			req:  newAnalystRequest("payments", monday10am),
+			want: NotApplicable,
+		},
+		{
+			name: "deny overrides allow",
+			req: func() *Request {
+				req := newAnalystRequest("claims", monday10am)
+				req.Environment.ClientIP = net.ParseIP("192.168.1.10")
+				return req
+			}(),
+			want:       Forbid,
+			wantPolicy: "internal-network-only",
+		},
+		{
+			name: "denied column",
+			req: func() *Request {
+				req := newAnalystRequest("claims", monday10am)
+				req.Resource.Columns = []string{"id", "ssn"}
+				return req
+			}(),
+			want:       Forbid,
+			wantPolicy: "no-ssn",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision, err := m.Evaluate(tt.req)
+			if err != nil {
+				t.Fatalf("Evaluate returned unexpected error: %v", err)
+			}
+			if decision.Result != tt.want {
+				t.Errorf("Evaluate result = %v, want %v", decision.Result, tt.want)
+			}
+			if decision.Policy != tt.wantPolicy {
+				t.Errorf("Evaluate policy = %q, want %q", decision.Policy, tt.wantPolicy)
+			}
+			if decision.RowFilter != tt.wantFilter {
+				t.Errorf("Evaluate row filter = %q, want %q", decision.RowFilter, tt.wantFilter)
+			}
+		})
+	}
+}
+
+func TestABACManager_EvaluateCombinesFilters(t *testing.T) {
+	m := NewABACManager()
+	for _, p := range []Policy{
+		{Name: "own-region", Tables: []string{"claims"}, RowFilter: "region = 'emea'", CheckFilter: "amount < 100"},
+		{Name: "shared", Tables: []string{"claims"}, RowFilter: "shared = 1"},
+	} {
+		if err := m.AddPolicy(p); err != nil {
+			t.Fatalf("AddPolicy(%s) returned unexpected error: %v", p.Name, err)
+		}
+	}
+
+	decision, err := m.Evaluate(newAnalystRequest("claims", monday10am))
+	if err != nil {
+		t.Fatalf("Evaluate returned unexpected error: %v", err)
+	}
+	if want := "(region = 'emea') OR (shared = 1)"; decision.RowFilter != want {
+		t.Errorf("Evaluate row filter = %q, want %q", decision.RowFilter, want)
+	}
+	// A policy without a check filter lets any row be written
+	if decision.CheckFilter != "" {
+		t.Errorf("Evaluate check filter = %q, want none", decision.CheckFilter)
+	}
+}
+
+func TestClientIPFromContext(t *testing.T) {
+	if ip := ClientIPFromContext(context.Background()); ip != nil {
+		t.Errorf("Expected no client IP, got %v", ip)
+	}
+	ctx := WithClientIP(context.Background(), net.ParseIP("10.0.0.1"))
+	if ip := ClientIPFromContext(ctx); !ip.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("Expected client IP 10.0.0.1, got %v", ip)
+	}
+
+	m := NewABACManager()
+	m.Now = func() time.Time { return monday10am }
+	env := m.NewEnvironment(ctx)
+	if !env.Time.Equal(monday10am) || !env.ClientIP.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("Unexpected environment: %+v", env)
+	}
+}
@@ -0,0 +1,164 @@
+package abac
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"time"
+)
+
+// contextKey is the type of the context keys used by this package
+type contextKey int
+
+const clientIPKey contextKey = iota
+
+// WithClientIP returns a context carrying the IP address of the client
+func WithClientIP(ctx context.Context, ip net.IP) context.Context {
+	return context.WithValue(ctx, clientIPKey, ip)
+}
+
+// ClientIPFromContext returns the client IP address carried by a context, if any
+func ClientIPFromContext(ctx context.Context) net.IP {
+	if ctx == nil {
+		return nil
+	}
+	ip, _ := ctx.Value(clientIPKey).(net.IP)
+	return ip
+}
+
+// All returns a condition that holds when all conditions hold
+func All(conditions ...Condition) Condition {
+	return func(req *Request) (bool, error) {
+		for _, condition := range conditions {
+			ok, err := condition(req)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+}
+
+// Any returns a condition that holds when at least one condition holds
+func Any(conditions ...Condition) Condition {
+	return func(req *Request) (bool, error) {
+		for _, condition := range conditions {
+			ok, err := condition(req)
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+}
+
+// Not returns a condition that holds when the given condition does not
+func Not(condition Condition) Condition {
+	return func(req *Request) (bool, error) {
+		ok, err := condition(req)
+		if err != nil {
+			return false, err
+		}
+		return !ok, nil
+	}
+}
+
+// PrincipalHasRole returns a condition that holds when the principal holds a role
+func PrincipalHasRole(role string) Condition {
+	return func(req *Request) (bool, error) {
+		return req.Principal.HasRole(role), nil
+	}
+}
+
+// PrincipalAttributeIn returns a condition that holds when a principal
+// attribute is set to one of the given values
+func PrincipalAttributeIn(name string, values ...interface{}) Condition {
+	return func(req *Request) (bool, error) {
+		value, ok := req.Principal.Attributes[name]
+		if !ok {
+			return false, nil
+		}
+		for _, v := range values {
+			if reflect.DeepEqual(value, v) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+}
+
+// TimeOfDayBetween returns a condition that holds when the request time, in the
+// given location, is between start (inclusive) and end (exclusive), expressed
+// as offsets from midnight. A nil location means UTC.
+func TimeOfDayBetween(start, end time.Duration, loc *time.Location) Condition {
+	if loc == nil {
+		loc = time.UTC
+	}
+	return func(req *Request) (bool, error) {
+		t := req.Environment.Time.In(loc)
+		offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+		if start <= end {
+			return offset >= start && offset < end, nil
+		}
+		// The window wraps around midnight
+		return offset >= start || offset < end, nil
+	}
+}
+
+// Weekdays returns a condition that holds when the request time, in the given
+// location, falls on one of the given days. A nil location means UTC.
+func Weekdays(loc *time.Location, days ...time.Weekday) Condition {
+	if loc == nil {
+		loc = time.UTC
+	}
+	return func(req *Request) (bool, error) {
+		day := req.Environment.Time.In(loc).Weekday()
+		for _, d := range days {
+			if d == day {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+}
+
+// BusinessHours returns a condition that holds Monday to Friday between 9:00 and 17:00
+func BusinessHours(loc *time.Location) Condition {
+	return All(
+		Weekdays(loc, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday),
+		TimeOfDayBetween(9*time.Hour, 17*time.Hour, loc),
+	)
+}
+
+// ClientIPIn returns a condition that holds when the client IP is within one of
+// the given CIDR ranges. Requests without a client IP never match.
+func ClientIPIn(cidrs ...string) Condition {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	var parseErr error
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			parseErr = fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+			break
+		}
+		networks = append(networks, network)
+	}
+	return func(req *Request) (bool, error) {
+		if parseErr != nil {
+			return false, parseErr
+		}
+		if req.Environment.ClientIP == nil {
+			return false, nil
+		}
+		for _, network := range networks {
+			if network.Contains(req.Environment.ClientIP) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+}
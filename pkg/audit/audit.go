@@ -0,0 +1,120 @@
+// Package audit defines the events recorded about access control and the
+// sinks they are sent to.
+package audit
+
+import (
+	"context"
+	"time"
+)
+
+// EventType identifies what an audit event records
+type EventType string
+
+const (
+	// EventGrantExpired records a permission removed after its window ended
+	EventGrantExpired EventType = "grant_expired"
+	// EventGrantRevoked records a permission revoked because the grant option
+	// it was granted through was removed
+	EventGrantRevoked EventType = "grant_revoked"
+	// EventMembershipExpired records a role membership removed after its
+	// window ended
+	EventMembershipExpired EventType = "membership_expired"
+	// EventBreakGlass records a break-glass elevation to an emergency role
+	EventBreakGlass EventType = "break_glass"
+	// EventBreakGlassStatement records a statement executed under a
+	// break-glass elevation
+	EventBreakGlassStatement EventType = "break_glass_statement"
+	// EventBreakGlassEnded records the end of a break-glass elevation
+	EventBreakGlassEnded EventType = "break_glass_ended"
+	// EventAccessRequested records a new access request
+	EventAccessRequested EventType = "access_requested"
+	// EventAccessApproved records the approval of an access request
+	EventAccessApproved EventType = "access_approved"
+	// EventAccessDenied records the denial of an access request
+	EventAccessDenied EventType = "access_denied"
+	// EventAccessExpired records an access request that expired before it was
+	// decided, or whose granted access ended
+	EventAccessExpired EventType = "access_expired"
+	// EventStatement records the authorization decision for a statement
+	EventStatement EventType = "statement"
+	// EventRBACChange records a change to users, roles or permissions
+	EventRBACChange EventType = "rbac_change"
+	// EventAuthentication records an authentication attempt
+	EventAuthentication EventType = "authentication"
+	// EventSensitiveRead records rows returned with values of sensitive columns
+	EventSensitiveRead EventType = "sensitive_read"
+)
+
+// Decision is the outcome of an audited authorization
+type Decision string
+
+const (
+	// Allow records an authorized statement or change
+	Allow Decision = "allow"
+	// Deny records a refused statement or change
+	Deny Decision = "deny"
+)
+
+// Event is an audited occurrence
+type Event struct {
+	Time time.Time `json:"time"`
+	Type EventType `json:"type"`
+	// Principal is the user who caused the event; empty for the application
+	Principal string `json:"principal,omitempty"`
+	// Subject is the user or role the event applies to
+	Subject string `json:"subject,omitempty"`
+	// Detail describes the permission or role involved
+	Detail string `json:"detail,omitempty"`
+	// SessionID identifies the session the event occurred in
+	SessionID string `json:"session_id,omitempty"`
+	// StatementID identifies the statement the event applies to
+	StatementID string `json:"statement_id,omitempty"`
+	// Operation is the method of a statement, e.g. query or exec, or the kind
+	// of an RBAC change, e.g. create_role
+	Operation string `json:"operation,omitempty"`
+	// Statement is the SQL statement the event applies to
+	Statement string `json:"statement,omitempty"`
+	// Rewritten is the statement as executed after row-level security
+	Rewritten string `json:"rewritten,omitempty"`
+	// Tables and Columns are those the statement touches
+	Tables  []string `json:"tables,omitempty"`
+	Columns []string `json:"columns,omitempty"`
+	// Keys are the primary keys of the rows a sensitive read returned
+	Keys []string `json:"keys,omitempty"`
+	// Action is the action of the statement, e.g. select
+	Action string `json:"action,omitempty"`
+	// Decision is the outcome of an authorization
+	Decision Decision `json:"decision,omitempty"`
+	// Rule is the policy or permission that allowed the statement
+	Rule string `json:"rule,omitempty"`
+	// ErrorCode is the code of the error a refused statement or change failed with
+	ErrorCode string `json:"error_code,omitempty"`
+	// BreakGlass flags events that occurred under a break-glass elevation
+	BreakGlass bool `json:"break_glass,omitempty"`
+}
+
+// Sink receives audit events
+type Sink interface {
+	Record(ctx context.Context, event Event) error
+}
+
+// SinkFunc adapts a function to the Sink interface
+type SinkFunc func(ctx context.Context, event Event) error
+
+// Record implements Sink
+func (f SinkFunc) Record(ctx context.Context, event Event) error {
+	return f(ctx, event)
+}
+
+// Multi returns a sink that records events to every sink in turn, stopping at
+// the first error
+func Multi(sinks ...Sink) Sink {
+	return SinkFunc(func(ctx context.Context, event Event) error {
+		for _, sink := range sinks {
+			if err := sink.Record(ctx, event); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
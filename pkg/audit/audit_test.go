@@ -0,0 +1,229 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// testEvent returns a statement event for the sink tests
+func testEvent(decision Decision) Event {
+	return Event{
+		Time:        time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC),
+		Type:        EventStatement,
+		Principal:   "alice",
+		SessionID:   "s1",
+		StatementID: "s1-1",
+		Operation:   "query",
+		Statement:   "SELECT id FROM orders",
+		Rewritten:   "select id from orders where region = 'eu'",
+		Tables:      []string{"orders"},
+		Columns:     []string{"id"},
+		Action:      "select",
+		Decision:    decision,
+		Rule:        "grant select on orders",
+	}
+}
+
+func TestJSONLSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	sink, err := OpenJSONLFile(path)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	ctx := context.Background()
+	for _, decision := range []Decision{Allow, Deny} {
+		if err := sink.Record(ctx, testEvent(decision)); err != nil {
+			t.Fatalf("Failed to record event: %v", err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Failed to close audit log: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read audit log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %d", len(lines))
+	}
+	var event Event
+	if err := json.Unmarshal([]byte(lines[1]), &event); err != nil {
+		t.Fatalf("Failed to decode event: %v", err)
+	}
+	if event.Decision != Deny || event.Rewritten != testEvent(Deny).Rewritten || event.Tables[0] != "orders" {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+	if !strings.Contains(lines[0], `"session_id":"s1"`) || strings.Contains(lines[0], "break_glass") {
+		t.Errorf("Unexpected JSON line: %s", lines[0])
+	}
+}
+
+func TestSlogSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewSlogSink(slog.New(slog.NewJSONHandler(&buf, nil)))
+	if err := sink.Record(context.Background(), testEvent(Deny)); err != nil {
+		t.Fatalf("Failed to record event: %v", err)
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Failed to decode log record: %v", err)
+	}
+	if record["level"] != "WARN" || record["msg"] != "audit: statement" || record["principal"] != "alice" || record["decision"] != "deny" {
+		t.Errorf("Unexpected log record: %v", record)
+	}
+}
+
+func TestSQLiteSink(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "audit.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := NewSQLiteSink(db, "audit log"); err == nil {
+		t.Error("Expected error for invalid table name")
+	}
+	sink, err := NewSQLiteSink(db, "audit_log")
+	if err != nil {
+		t.Fatalf("Failed to create sink: %v", err)
+	}
+	if err := Multi(sink, sink).Record(context.Background(), testEvent(Allow)); err != nil {
+		t.Fatalf("Failed to record event: %v", err)
+	}
+
+	var count int
+	var principal, tables string
+	if err := db.QueryRow("SELECT COUNT(*), MAX(principal), MAX(tables) FROM audit_log").Scan(&count, &principal, &tables); err != nil {
+		t.Fatalf("Failed to read audit log: %v", err)
+	}
+	if count != 2 || principal != "alice" || tables != "orders" {
+		t.Errorf("Unexpected audit log: %d rows, principal %q, tables %q", count, principal, tables)
+	}
+
+	// The audit log is append-only
+	if _, err := db.Exec("UPDATE audit_log SET principal = 'mallory'"); err == nil {
+		t.Error("Expected error updating the audit log")
+	}
+	if _, err := db.Exec("DELETE FROM audit_log"); err == nil {
+		t.Error("Expected error deleting from the audit log")
+	}
+}
+
+func TestHashChain(t *testing.T) {
+	ctx := context.Background()
+	key := []byte("audit-hmac-key")
+	publicKey, signingKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	opts := VerifyOptions{Key: key, PublicKey: publicKey}
+
+	// Reopening a log continues its chain
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	for i := 0; i < 2; i++ {
+		sink, err := OpenJSONLFile(path, WithHMACKey(key), WithCheckpoints(signingKey, 2))
+		if err != nil {
+			t.Fatalf("Failed to open audit log: %v", err)
+		}
+		for _, decision := range []Decision{Allow, Deny, Allow} {
+			if err := sink.Record(ctx, testEvent(decision)); err != nil {
+				t.Fatalf("Failed to record event: %v", err)
+			}
+		}
+		if err := sink.Close(); err != nil {
+			t.Fatalf("Failed to close audit log: %v", err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read audit log: %v", err)
+	}
+	report, err := VerifyJSONL(bytes.NewReader(data), opts)
+	if err != nil {
+		t.Fatalf("Failed to verify audit log: %v", err)
+	}
+	if report.Broken != nil || report.Entries != 10 || report.Checkpoints != 4 || report.LastCheckpoint != 10 {
+		t.Errorf("Unexpected report: %s", report)
+	}
+
+	// Edits, removals and wrong keys break the chain at the first bad entry
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	for _, tc := range []struct {
+		name     string
+		lines    []string
+		opts     VerifyOptions
+		position int
+	}{
+		{"edited", append(append([]string{}, lines[:3]...), append([]string{strings.Replace(lines[3], "alice", "mallory", 1)}, lines[4:]...)...), opts, 4},
+		{"removed", append(append([]string{}, lines[:3]...), lines[4:]...), opts, 4},
+		{"wrong key", lines, VerifyOptions{Key: []byte("other"), PublicKey: publicKey}, 1},
+		{"wrong public key", lines, VerifyOptions{Key: key, PublicKey: ed25519.PublicKey(make([]byte, ed25519.PublicKeySize))}, 3},
+	} {
+		report, err := VerifyJSONL(strings.NewReader(strings.Join(tc.lines, "\n")), tc.opts)
+		if err != nil {
+			t.Fatalf("%s: failed to verify audit log: %v", tc.name, err)
+		}
+		if report.Broken == nil || report.Broken.Position != tc.position {
+			t.Errorf("%s: expected break at entry %d, got %s", tc.name, tc.position, report)
+		}
+	}
+
+	// The SQLite sink chains its rows, which shows edits made around its triggers
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "audit.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	for i := 0; i < 2; i++ {
+		sink, err := NewSQLiteSink(db, "audit_log", WithHMACKey(key), WithCheckpoints(signingKey, 2))
+		if err != nil {
+			t.Fatalf("Failed to create sink: %v", err)
+		}
+		for _, decision := range []Decision{Allow, Deny, Allow} {
+			if err := sink.Record(ctx, testEvent(decision)); err != nil {
+				t.Fatalf("Failed to record event: %v", err)
+			}
+		}
+		read := testEvent(Allow)
+		read.Type, read.Keys = EventSensitiveRead, []string{"7", "smith, john"}
+		if err := sink.Record(ctx, read); err != nil {
+			t.Fatalf("Failed to record event: %v", err)
+		}
+		if err := sink.Checkpoint(ctx); err != nil {
+			t.Fatalf("Failed to write checkpoint: %v", err)
+		}
+	}
+	report, err = VerifySQLite(ctx, db, "audit_log", opts)
+	if err != nil {
+		t.Fatalf("Failed to verify audit table: %v", err)
+	}
+	if report.Broken != nil || report.Entries != 12 || report.LastCheckpoint != 12 {
+		t.Errorf("Unexpected report: %s", report)
+	}
+	if _, err := db.Exec("DROP TRIGGER audit_log_no_update"); err != nil {
+		t.Fatalf("Failed to drop trigger: %v", err)
+	}
+	if _, err := db.Exec("UPDATE audit_log SET decision = 'allow' WHERE seq = 2"); err != nil {
+		t.Fatalf("Failed to edit audit table: %v", err)
+	}
+	report, err = VerifySQLite(ctx, db, "audit_log", opts)
+	if err != nil {
+		t.Fatalf("Failed to verify audit table: %v", err)
+	}
+	if report.Broken == nil || report.Broken.Seq != 2 {
+		t.Errorf("Expected break at seq 2, got %s", report)
+	}
+}
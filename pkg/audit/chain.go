@@ -0,0 +1,310 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"time"
+)
+
+// defaultCheckpointEvery is the number of entries between signed checkpoints
+// when WithCheckpoints does not set one
+const defaultCheckpointEvery = 100
+
+// EventCheckpoint records a signed checkpoint of a hash-chained audit log
+const EventCheckpoint EventType = "checkpoint"
+
+// Entry is an event as written by a hash-chained sink. Each entry includes the
+// hash of the previous one, so editing, removing or reordering entries breaks
+// the chain.
+type Entry struct {
+	Event
+	// Seq numbers the entries of a chain from one
+	Seq int64 `json:"seq"`
+	// PrevHash is the hash of the previous entry; empty for the first entry
+	PrevHash string `json:"prev_hash,omitempty"`
+	// Hash covers the sequence number, the previous hash and the event
+	Hash string `json:"hash"`
+	// Signature is the Ed25519 signature of the hash of a checkpoint entry
+	Signature string `json:"signature,omitempty"`
+}
+
+// ChainOption configures the hash chain of a sink
+type ChainOption func(*chain)
+
+// WithHMACKey keys the hashes of the chain with HMAC-SHA256, so that the chain
+// cannot be recomputed after editing the log without the key
+func WithHMACKey(key []byte) ChainOption {
+	return func(c *chain) {
+		c.key = key
+	}
+}
+
+// WithCheckpoints writes a checkpoint entry signed with an Ed25519 key after
+// every given number of entries, 100 by default
+func WithCheckpoints(signingKey ed25519.PrivateKey, every int) ChainOption {
+	return func(c *chain) {
+		c.signingKey = signingKey
+		c.checkpointEvery = every
+	}
+}
+
+// chain holds the state of a hash chain
+type chain struct {
+	key             []byte
+	signingKey      ed25519.PrivateKey
+	checkpointEvery int
+	seq             int64
+	last            string
+	unsigned        int
+}
+
+// newChain creates a chain with options
+func newChain(opts []ChainOption) *chain {
+	c := &chain{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.checkpointEvery <= 0 {
+		c.checkpointEvery = defaultCheckpointEvery
+	}
+	return c
+}
+
+// resume continues a chain after its last entry
+func (c *chain) resume(last Entry, unsigned int) {
+	c.seq = last.Seq
+	c.last = last.Hash
+	c.unsigned = unsigned
+}
+
+// next returns the entry that appends an event to the chain. The chain only
+// advances when the entry is committed.
+func (c *chain) next(event Event) Entry {
+	entry := Entry{Event: canonical(event), Seq: c.seq + 1, PrevHash: c.last}
+	entry.Hash = entryHash(c.key, entry)
+	if event.Type == EventCheckpoint && c.signingKey != nil {
+		entry.Signature = hex.EncodeToString(ed25519.Sign(c.signingKey, []byte(entry.Hash)))
+	}
+	return entry
+}
+
+// commit advances the chain past a written entry
+func (c *chain) commit(entry Entry) {
+	c.seq = entry.Seq
+	c.last = entry.Hash
+	if entry.Type == EventCheckpoint {
+		c.unsigned = 0
+	} else {
+		c.unsigned++
+	}
+}
+
+// checkpointDue checks if a signed checkpoint should be written
+func (c *chain) checkpointDue() bool {
+	return c.signingKey != nil && c.unsigned >= c.checkpointEvery
+}
+
+// checkpoint returns the event of a checkpoint of the chain
+func (c *chain) checkpoint(now time.Time) Event {
+	return Event{
+		Time:   now,
+		Type:   EventCheckpoint,
+		Detail: fmt.Sprintf("%d entries", c.seq),
+	}
+}
+
+// canonical returns an event in the form that is hashed, which survives
+// being stored and read back by the sinks
+func canonical(event Event) Event {
+	event.Time = event.Time.UTC()
+	if len(event.Tables) == 0 {
+		event.Tables = nil
+	}
+	if len(event.Columns) == 0 {
+		event.Columns = nil
+	}
+	if len(event.Keys) == 0 {
+		event.Keys = nil
+	}
+	return event
+}
+
+// entryHash computes the hash of an entry, keyed with HMAC if a key is given
+func entryHash(key []byte, entry Entry) string {
+	var h hash.Hash
+	if key != nil {
+		h = hmac.New(sha256.New, key)
+	} else {
+		h = sha256.New()
+	}
+	payload, _ := json.Marshal(canonical(entry.Event))
+	fmt.Fprintf(h, "%d\n%s\n", entry.Seq, entry.PrevHash)
+	h.Write(payload)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// VerifyOptions holds the keys a chain is verified with
+type VerifyOptions struct {
+	// Key is the HMAC key of the chain, if it was written with one
+	Key []byte
+	// PublicKey verifies the signatures of checkpoints; without it signatures
+	// are not checked
+	PublicKey ed25519.PublicKey
+}
+
+// BrokenLink describes where a hash chain is broken
+type BrokenLink struct {
+	// Position is the line or row of the entry, counted from one
+	Position int
+	Seq      int64
+	Reason   string
+}
+
+// VerifyReport is the result of verifying a hash chain
+type VerifyReport struct {
+	Entries     int
+	Checkpoints int
+	// LastCheckpoint is the sequence number of the last verified checkpoint
+	LastCheckpoint int64
+	// Broken is the first broken link; nil if the chain is intact
+	Broken *BrokenLink
+}
+
+// String describes the result of a verification
+func (r *VerifyReport) String() string {
+	if r.Broken != nil {
+		return fmt.Sprintf("broken at entry %d (seq %d): %s", r.Broken.Position, r.Broken.Seq, r.Broken.Reason)
+	}
+	s := fmt.Sprintf("ok: %d entries, %d checkpoints", r.Entries, r.Checkpoints)
+	if r.LastCheckpoint > 0 {
+		s += fmt.Sprintf(", last checkpoint at seq %d", r.LastCheckpoint)
+	}
+	return s
+}
+
+// verifier walks a hash chain entry by entry
+type verifier struct {
+	opts   VerifyOptions
+	report VerifyReport
+	last   Entry
+}
+
+// check verifies the next entry of the chain and returns false at the first
+// broken link
+func (v *verifier) check(position int, entry Entry) bool {
+	broken := func(reason string) bool {
+		v.report.Broken = &BrokenLink{Position: position, Seq: entry.Seq, Reason: reason}
+		return false
+	}
+	switch {
+	case entry.Seq != v.last.Seq+1:
+		return broken(fmt.Sprintf("expected seq %d", v.last.Seq+1))
+	case entry.PrevHash != v.last.Hash:
+		return broken("previous hash does not match")
+	case entryHash(v.opts.Key, entry) != entry.Hash:
+		return broken("hash does not match entry")
+	}
+	if entry.Type == EventCheckpoint {
+		if v.opts.PublicKey != nil {
+			signature, err := hex.DecodeString(entry.Signature)
+			if err != nil || !ed25519.Verify(v.opts.PublicKey, []byte(entry.Hash), signature) {
+				return broken("invalid checkpoint signature")
+			}
+			v.report.LastCheckpoint = entry.Seq
+		}
+		v.report.Checkpoints++
+	}
+	v.report.Entries++
+	v.last = entry
+	return true
+}
+
+// VerifyJSONL verifies the hash chain of a JSON lines audit log
+func VerifyJSONL(r io.Reader, opts VerifyOptions) (*VerifyReport, error) {
+	v := &verifier{opts: opts}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for position := 1; scanner.Scan(); position++ {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			v.report.Broken = &BrokenLink{Position: position, Reason: "malformed entry"}
+			break
+		}
+		if !v.check(position, entry) {
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	return &v.report, nil
+}
+
+// VerifySQLite verifies the hash chain of an audit table written by SQLiteSink
+func VerifySQLite(ctx context.Context, db *sql.DB, table string, opts VerifyOptions) (*VerifyReport, error) {
+	if !validTableName.MatchString(table) {
+		return nil, fmt.Errorf("invalid audit table name: %s", table)
+	}
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM %s ORDER BY id", sqliteColumns, table))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit table %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	v := &verifier{opts: opts}
+	for position := 1; rows.Next(); position++ {
+		entry, err := scanEntry(rows)
+		if err != nil {
+			v.report.Broken = &BrokenLink{Position: position, Reason: "malformed entry"}
+			break
+		}
+		if !v.check(position, entry) {
+			break
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit table %s: %w", table, err)
+	}
+	return &v.report, nil
+}
+
+// scanEntry reads an entry from a row of an audit table
+func scanEntry(rows *sql.Rows) (Entry, error) {
+	var entry Entry
+	var eventTime, eventType, decision, tables, columns, keys string
+	err := rows.Scan(&entry.Seq, &entry.PrevHash, &entry.Hash, &entry.Signature, &eventTime, &eventType,
+		&entry.Principal, &entry.Subject, &entry.Detail, &entry.SessionID, &entry.StatementID, &entry.Operation,
+		&entry.Statement, &entry.Rewritten, &tables, &columns, &keys, &entry.Action, &decision,
+		&entry.Rule, &entry.ErrorCode, &entry.BreakGlass)
+	if err != nil {
+		return entry, err
+	}
+	entry.Time, err = time.Parse(time.RFC3339Nano, eventTime)
+	if err != nil {
+		return entry, err
+	}
+	entry.Type = EventType(eventType)
+	entry.Decision = Decision(decision)
+	if tables != "" {
+		entry.Tables = strings.Split(tables, ",")
+	}
+	if columns != "" {
+		entry.Columns = strings.Split(columns, ",")
+	}
+	if keys != "" {
+		if err := json.Unmarshal([]byte(keys), &entry.Keys); err != nil {
+			return entry, err
+		}
+	}
+	return entry, nil
+}
@@ -0,0 +1,329 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JSONLSink writes events as hash-chained JSON lines
+type JSONLSink struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+	chain  *chain
+}
+
+// NewJSONLSink creates a sink that writes events as JSON lines to a writer,
+// starting a new hash chain
+func NewJSONLSink(w io.Writer, opts ...ChainOption) *JSONLSink {
+	return &JSONLSink{w: w, chain: newChain(opts)}
+}
+
+// OpenJSONLFile creates a sink that appends events as JSON lines to a file,
+// creating it if needed and continuing the hash chain of its entries
+func OpenJSONLFile(path string, opts ...ChainOption) (*JSONLSink, error) {
+	sink := &JSONLSink{chain: newChain(opts)}
+	if err := sink.resume(path); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	sink.w, sink.closer = file, file
+	return sink, nil
+}
+
+// resume continues the hash chain of an existing audit log
+func (s *JSONLSink) resume(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer file.Close()
+
+	var last Entry
+	unsigned := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if err := json.Unmarshal(scanner.Bytes(), &last); err != nil {
+			return fmt.Errorf("audit log %s has a malformed entry: %w", path, err)
+		}
+		if last.Type == EventCheckpoint {
+			unsigned = 0
+		} else {
+			unsigned++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read audit log: %w", err)
+	}
+	s.chain.resume(last, unsigned)
+	return nil
+}
+
+// Record implements Sink. A signed checkpoint follows the event when one is due.
+func (s *JSONLSink) Record(ctx context.Context, event Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.write(event); err != nil {
+		return err
+	}
+	if s.chain.checkpointDue() {
+		return s.write(s.chain.checkpoint(event.Time))
+	}
+	return nil
+}
+
+// Checkpoint writes a signed checkpoint of the entries written since the last
+// one. It does nothing without a signing key.
+func (s *JSONLSink) Checkpoint(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.chain.signingKey == nil || s.chain.unsigned == 0 {
+		return nil
+	}
+	return s.write(s.chain.checkpoint(time.Now()))
+}
+
+// write appends an event to the chain
+func (s *JSONLSink) write(event Event) error {
+	entry := s.chain.next(event)
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit event: %w", err)
+	}
+	line = append(line, '\n')
+	if _, err := s.w.Write(line); err != nil {
+		return fmt.Errorf("failed to write audit event: %w", err)
+	}
+	s.chain.commit(entry)
+	return nil
+}
+
+// Close writes a final checkpoint and closes the file of a sink opened with
+// OpenJSONLFile
+func (s *JSONLSink) Close() error {
+	if err := s.Checkpoint(context.Background()); err != nil {
+		return err
+	}
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// SlogSink logs events with a structured logger. Denials are logged as
+// warnings, other events as info.
+type SlogSink struct {
+	logger *slog.Logger
+}
+
+// NewSlogSink creates a sink that logs events to a logger, or to the default
+// logger if it is nil
+func NewSlogSink(logger *slog.Logger) *SlogSink {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &SlogSink{logger: logger}
+}
+
+// Record implements Sink
+func (s *SlogSink) Record(ctx context.Context, event Event) error {
+	level := slog.LevelInfo
+	if event.Decision == Deny {
+		level = slog.LevelWarn
+	}
+	attrs := []slog.Attr{slog.Time("time", event.Time)}
+	for _, attr := range []struct{ key, value string }{
+		{"principal", event.Principal},
+		{"subject", event.Subject},
+		{"detail", event.Detail},
+		{"session_id", event.SessionID},
+		{"statement_id", event.StatementID},
+		{"operation", event.Operation},
+		{"statement", event.Statement},
+		{"rewritten", event.Rewritten},
+		{"action", event.Action},
+		{"decision", string(event.Decision)},
+		{"rule", event.Rule},
+		{"error_code", event.ErrorCode},
+	} {
+		if attr.value != "" {
+			attrs = append(attrs, slog.String(attr.key, attr.value))
+		}
+	}
+	if len(event.Tables) > 0 {
+		attrs = append(attrs, slog.Any("tables", event.Tables))
+	}
+	if len(event.Columns) > 0 {
+		attrs = append(attrs, slog.Any("columns", event.Columns))
+	}
+	if len(event.Keys) > 0 {
+		attrs = append(attrs, slog.Any("keys", event.Keys))
+	}
+	if event.BreakGlass {
+		attrs = append(attrs, slog.Bool("break_glass", true))
+	}
+	s.logger.LogAttrs(ctx, level, "audit: "+string(event.Type), attrs...)
+	return nil
+}
+
+// validTableName matches the names SQLiteSink accepts for its table
+var validTableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// sqliteColumns are the columns of an audit table in the order of an Entry
+const sqliteColumns = `seq, prev_hash, hash, signature, time, type, principal, subject, detail, session_id,
+	statement_id, operation, statement, rewritten, tables, columns, keys, action, decision, rule, error_code, break_glass`
+
+// SQLiteSink appends hash-chained events to a SQLite table. Triggers refuse
+// updates and deletes on the table, so events cannot be changed through SQL
+// once written, and the chain shows if they were changed otherwise. The chain
+// assumes a single sink writes to the table.
+type SQLiteSink struct {
+	mu     sync.Mutex
+	db     *sql.DB
+	insert string
+	chain  *chain
+}
+
+// NewSQLiteSink creates a sink that appends events to a table, creating the
+// table and its triggers if needed and continuing the hash chain of its rows
+func NewSQLiteSink(db *sql.DB, table string, opts ...ChainOption) (*SQLiteSink, error) {
+	if !validTableName.MatchString(table) {
+		return nil, fmt.Errorf("invalid audit table name: %s", table)
+	}
+	statements := []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			seq INTEGER NOT NULL UNIQUE,
+			prev_hash TEXT NOT NULL,
+			hash TEXT NOT NULL,
+			signature TEXT NOT NULL,
+			time TEXT NOT NULL,
+			type TEXT NOT NULL,
+			principal TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			detail TEXT NOT NULL,
+			session_id TEXT NOT NULL,
+			statement_id TEXT NOT NULL,
+			operation TEXT NOT NULL,
+			statement TEXT NOT NULL,
+			rewritten TEXT NOT NULL,
+			tables TEXT NOT NULL,
+			columns TEXT NOT NULL,
+			keys TEXT NOT NULL,
+			action TEXT NOT NULL,
+			decision TEXT NOT NULL,
+			rule TEXT NOT NULL,
+			error_code TEXT NOT NULL,
+			break_glass INTEGER NOT NULL
+		)`, table),
+		fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS %[1]s_no_update BEFORE UPDATE ON %[1]s
+			BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END`, table),
+		fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS %[1]s_no_delete BEFORE DELETE ON %[1]s
+			BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END`, table),
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			return nil, fmt.Errorf("failed to create audit table %s: %w", table, err)
+		}
+	}
+
+	// Continue the chain after the last row
+	sink := &SQLiteSink{
+		db:     db,
+		insert: fmt.Sprintf("INSERT INTO %s (%s) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", table, sqliteColumns),
+		chain:  newChain(opts),
+	}
+	var last Entry
+	var unsigned int
+	err := db.QueryRow(fmt.Sprintf(`SELECT seq, hash,
+		(SELECT COUNT(*) FROM %[1]s WHERE id > COALESCE((SELECT MAX(id) FROM %[1]s WHERE type = ?), 0))
+		FROM %[1]s ORDER BY id DESC LIMIT 1`, table), string(EventCheckpoint)).Scan(&last.Seq, &last.Hash, &unsigned)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to read audit table %s: %w", table, err)
+	}
+	sink.chain.resume(last, unsigned)
+	return sink, nil
+}
+
+// Record implements Sink. A signed checkpoint follows the event when one is due.
+func (s *SQLiteSink) Record(ctx context.Context, event Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.write(ctx, event); err != nil {
+		return err
+	}
+	if s.chain.checkpointDue() {
+		return s.write(ctx, s.chain.checkpoint(event.Time))
+	}
+	return nil
+}
+
+// Checkpoint writes a signed checkpoint of the entries written since the last
+// one. It does nothing without a signing key.
+func (s *SQLiteSink) Checkpoint(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.chain.signingKey == nil || s.chain.unsigned == 0 {
+		return nil
+	}
+	return s.write(ctx, s.chain.checkpoint(time.Now()))
+}
+
+// write appends an event to the chain
+func (s *SQLiteSink) write(ctx context.Context, event Event) error {
+	entry := s.chain.next(event)
+	// Keys may contain commas, so they are stored as a JSON array
+	var keys []byte
+	if len(entry.Keys) > 0 {
+		var err error
+		if keys, err = json.Marshal(entry.Keys); err != nil {
+			return fmt.Errorf("failed to encode audit event: %w", err)
+		}
+	}
+	_, err := s.db.ExecContext(ctx, s.insert,
+		entry.Seq,
+		entry.PrevHash,
+		entry.Hash,
+		entry.Signature,
+		entry.Time.Format(time.RFC3339Nano),
+		string(entry.Type),
+		entry.Principal,
+		entry.Subject,
+		entry.Detail,
+		entry.SessionID,
+		entry.StatementID,
+		entry.Operation,
+		entry.Statement,
+		entry.Rewritten,
+		strings.Join(entry.Tables, ","),
+		strings.Join(entry.Columns, ","),
+		string(keys),
+		entry.Action,
+		string(entry.Decision),
+		entry.Rule,
+		entry.ErrorCode,
+		entry.BreakGlass,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to write audit event: %w", err)
+	}
+	s.chain.commit(entry)
+	return nil
+}
@@ -3,7 +3,10 @@ package auth
 import (
 	"database/sql"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
@@ -24,8 +27,11 @@ type MemoryProvider struct {
 	permissions map[string][]permissions.Permission // username -> []permissions
 	roles       map[int64]string                    // roleID -> roleName
 	roleNames   map[string]int64                    // roleName -> roleID
-	userRoles   map[string][]string                 // username -> []roleName
-	sessions    map[string]int64                    // sessionID -> userID
+	userRoles   map[string][]RoleMembership         // username -> []membership
+	rolePerms   map[string][]permissions.Permission // roleName -> []permissions
+	disabled    map[string]bool                     // username -> disabled
+	sessions    map[string]SessionInfo              // sessionID -> session
+	rowPolicies []RowPolicy                         // row policies
 	nextRoleID  int64                               // auto-incrementing role ID
 	mu          sync.RWMutex
 	db          *sql.DB
@@ -39,8 +45,10 @@ func NewMemoryProvider() *MemoryProvider {
 		permissions: make(map[string][]permissions.Permission),
 		roles:       make(map[int64]string),
 		roleNames:   make(map[string]int64),
-		userRoles:   make(map[string][]string),
-		sessions:    make(map[string]int64),
+		userRoles:   make(map[string][]RoleMembership),
+		rolePerms:   make(map[string][]permissions.Permission),
+		disabled:    make(map[string]bool),
+		sessions:    make(map[string]SessionInfo),
 		nextRoleID:  1,
 		db:          db,
 	}
@@ -83,6 +91,9 @@ func (m *MemoryProvider) AddRole(roleName string) (int64, error) {
 func (m *MemoryProvider) Authenticate(username, token string) (bool, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
+	if m.disabled[username] {
+		return false, nil
+	}
 	return m.users[username] == token, nil
 }
 
@@ -100,16 +111,6 @@ func (m *MemoryProvider) GetUserPermissions(username string) ([]permissions.Perm
 	return perms, nil
 }
 
-// Query implements AuthProvider.Query
-func (m *MemoryProvider) Query(query string, args ...interface{}) (*sql.Rows, error) {
-	return nil, sql.ErrNoRows
-}
-
-// QueryRow implements AuthProvider.QueryRow
-func (m *MemoryProvider) QueryRow(query string, args ...interface{}) *sql.Row {
-	return nil
-}
-
 // UpdateUserPermissions implements AuthProvider.UpdateUserPermissions
 func (m *MemoryProvider) UpdateUserPermissions(username string, permissions []permissions.Permission) error {
 	m.mu.Lock()
@@ -118,6 +119,32 @@ func (m *MemoryProvider) UpdateUserPermissions(username string, permissions []pe
 	return nil
 }
 
+// ListUsers returns the names of all users
+func (m *MemoryProvider) ListUsers() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	users := make([]string, 0, len(m.users))
+	for username := range m.users {
+		users = append(users, username)
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+// ListRoles returns the names of all roles
+func (m *MemoryProvider) ListRoles() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	roles := make([]string, 0, len(m.roleNames))
+	for roleName := range m.roleNames {
+		roles = append(roles, roleName)
+	}
+	sort.Strings(roles)
+	return roles, nil
+}
+
 // GetUserID returns the numeric ID for a user
 func (m *MemoryProvider) GetUserID(username string) (int64, error) {
 	m.mu.RLock()
@@ -141,9 +168,9 @@ func (m *MemoryProvider) GetUsersWithRole(roleName string) ([]string, error) {
 	defer m.mu.RUnlock()
 
 	var users []string
-	for username, roles := range m.userRoles {
-		for _, role := range roles {
-			if role == roleName {
+	for username, memberships := range m.userRoles {
+		for _, membership := range memberships {
+			if membership.Role == roleName {
 				users = append(users, username)
 				break
 			}
@@ -168,7 +195,7 @@ func (m *MemoryProvider) GetRoleName(roleID int64) (string, error) {
 func (m *MemoryProvider) StoreSession(sessionID string, userID int64) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.sessions[sessionID] = userID
+	m.sessions[sessionID] = SessionInfo{ID: sessionID, UserID: userID, Started: time.Now()}
 	return nil
 }
 
@@ -213,17 +240,261 @@ func (m *MemoryProvider) DeleteRole(roleID int64) error {
 	// Delete role from maps
 	delete(m.roles, roleID)
 	delete(m.roleNames, roleName)
+	delete(m.rolePerms, roleName)
 
 	// Remove role from all users
-	for username, roles := range m.userRoles {
-		newRoles := make([]string, 0, len(roles))
-		for _, r := range roles {
-			if r != roleName {
-				newRoles = append(newRoles, r)
-			}
+	for username := range m.userRoles {
+		m.removeUserRole(username, roleName)
+	}
+
+	return nil
+}
+
+// AddUserRole makes a user a member of a role
+func (m *MemoryProvider) AddUserRole(username, roleName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.checkUserRole(username, roleName); err != nil {
+		return err
+	}
+
+	// Role membership is idempotent
+	for _, membership := range m.userRoles[username] {
+		if membership.Role == roleName {
+			return nil
 		}
-		m.userRoles[username] = newRoles
+	}
+	m.userRoles[username] = append(m.userRoles[username], RoleMembership{Role: roleName})
+	return nil
+}
+
+// AddUserRoleMembership makes a user a member of a role, replacing the
+// validity window of an existing membership
+func (m *MemoryProvider) AddUserRoleMembership(username string, membership RoleMembership) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.checkUserRole(username, membership.Role); err != nil {
+		return err
 	}
 
+	for i, existing := range m.userRoles[username] {
+		if existing.Role == membership.Role {
+			m.userRoles[username][i] = membership
+			return nil
+		}
+	}
+	m.userRoles[username] = append(m.userRoles[username], membership)
+	return nil
+}
+
+// checkUserRole checks that a user and a role exist
+func (m *MemoryProvider) checkUserRole(username, roleName string) error {
+	if _, ok := m.users[username]; !ok {
+		return fmt.Errorf("user %s not found", username)
+	}
+	if _, ok := m.roleNames[roleName]; !ok {
+		return fmt.Errorf("role %s not found", roleName)
+	}
+	return nil
+}
+
+// RemoveUserRole removes a user from a role
+func (m *MemoryProvider) RemoveUserRole(username, roleName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[username]; !ok {
+		return fmt.Errorf("user %s not found", username)
+	}
+	m.removeUserRole(username, roleName)
 	return nil
 }
+
+// removeUserRole removes a role from the memberships of a user
+func (m *MemoryProvider) removeUserRole(username, roleName string) {
+	memberships := m.userRoles[username]
+	remaining := make([]RoleMembership, 0, len(memberships))
+	for _, membership := range memberships {
+		if membership.Role != roleName {
+			remaining = append(remaining, membership)
+		}
+	}
+	m.userRoles[username] = remaining
+}
+
+// GetUserRoles returns the names of the roles a user is a member of
+func (m *MemoryProvider) GetUserRoles(username string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, ok := m.users[username]; !ok {
+		return nil, fmt.Errorf("user %s not found", username)
+	}
+
+	roles := make([]string, len(m.userRoles[username]))
+	for i, membership := range m.userRoles[username] {
+		roles[i] = membership.Role
+	}
+	return roles, nil
+}
+
+// GetUserRoleMemberships returns the role memberships of a user
+func (m *MemoryProvider) GetUserRoleMemberships(username string) ([]RoleMembership, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, ok := m.users[username]; !ok {
+		return nil, fmt.Errorf("user %s not found", username)
+	}
+
+	memberships := make([]RoleMembership, len(m.userRoles[username]))
+	copy(memberships, m.userRoles[username])
+	return memberships, nil
+}
+
+// GetRolePermissions returns the permissions granted to a role
+func (m *MemoryProvider) GetRolePermissions(roleName string) ([]permissions.Permission, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, ok := m.roleNames[roleName]; !ok {
+		return nil, fmt.Errorf("role %s not found", roleName)
+	}
+	perms := make([]permissions.Permission, len(m.rolePerms[roleName]))
+	copy(perms, m.rolePerms[roleName])
+	return perms, nil
+}
+
+// UpdateRolePermissions updates the permissions granted to a role
+func (m *MemoryProvider) UpdateRolePermissions(roleName string, perms []permissions.Permission) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.roleNames[roleName]; !ok {
+		return fmt.Errorf("role %s not found", roleName)
+	}
+	m.rolePerms[roleName] = perms
+	return nil
+}
+
+// ListAccounts returns the users in name order
+func (m *MemoryProvider) ListAccounts() ([]Account, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	accounts := make([]Account, 0, len(m.users))
+	for username := range m.users {
+		accounts = append(accounts, Account{Name: username, Disabled: m.disabled[username]})
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Name < accounts[j].Name })
+	return accounts, nil
+}
+
+// DisableUser keeps a user from authenticating and terminates the sessions of
+// the user
+func (m *MemoryProvider) DisableUser(username string) error {
+	userID, err := m.GetUserID(username)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.disabled[username] = true
+	for id, session := range m.sessions {
+		if session.UserID == userID {
+			delete(m.sessions, id)
+		}
+	}
+	return nil
+}
+
+// ResetToken replaces the token of a user
+func (m *MemoryProvider) ResetToken(username, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[username]; !ok {
+		return fmt.Errorf("user %s not found", username)
+	}
+	m.users[username] = token
+	return nil
+}
+
+// ListSessions returns the stored sessions in the order they started
+func (m *MemoryProvider) ListSessions() ([]SessionInfo, error) {
+	m.mu.RLock()
+	users := make([]string, 0, len(m.users))
+	for username := range m.users {
+		users = append(users, username)
+	}
+	sessions := make([]SessionInfo, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		sessions = append(sessions, session)
+	}
+	m.mu.RUnlock()
+
+	// Resolve the users of the sessions from their IDs
+	names := make(map[int64]string, len(users))
+	for _, username := range users {
+		if id, err := m.GetUserID(username); err == nil {
+			names[id] = username
+		}
+	}
+	for i := range sessions {
+		sessions[i].Username = names[sessions[i].UserID]
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].Started.Equal(sessions[j].Started) {
+			return sessions[i].Started.Before(sessions[j].Started)
+		}
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions, nil
+}
+
+// AddRowPolicy stores a policy, failing if its table has a policy of the same
+// name
+func (m *MemoryProvider) AddRowPolicy(policy RowPolicy) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, existing := range m.rowPolicies {
+		if existing.Name == policy.Name && strings.EqualFold(existing.Table, policy.Table) {
+			return fmt.Errorf("policy %s on table %s already exists", policy.Name, policy.Table)
+		}
+	}
+	m.rowPolicies = append(m.rowPolicies, policy)
+	return nil
+}
+
+// RemoveRowPolicy removes a policy of a table and reports whether it existed
+func (m *MemoryProvider) RemoveRowPolicy(table, name string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, existing := range m.rowPolicies {
+		if existing.Name == name && strings.EqualFold(existing.Table, table) {
+			m.rowPolicies = append(m.rowPolicies[:i], m.rowPolicies[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ListRowPolicies returns the policies in table and name order
+func (m *MemoryProvider) ListRowPolicies() ([]RowPolicy, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	policies := append([]RowPolicy(nil), m.rowPolicies...)
+	sort.Slice(policies, func(i, j int) bool {
+		if a, b := strings.ToLower(policies[i].Table), strings.ToLower(policies[j].Table); a != b {
+			return a < b
+		}
+		return policies[i].Name < policies[j].Name
+	})
+	return policies, nil
+}
@@ -1,8 +1,8 @@
 package auth
 
 import (
-	"database/sql"
 	"testing"
+	"time"
 
 	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
 )
@@ -107,22 +107,120 @@ func TestMemoryProvider_UpdateUserPermissions(t *testing.T) {
 	}
 }
 
-func TestMemoryProvider_Query(t *testing.T) {
+func TestMemoryProvider_UserRoles(t *testing.T) {
 	provider := NewMemoryProvider()
-	rows, err := provider.Query("SELECT * FROM test")
-	if err != sql.ErrNoRows {
-		t.Errorf("Expected sql.ErrNoRows, got %v", err)
+	username := "testuser"
+	provider.AddUser(username, "testtoken")
+
+	if err := provider.AddUserRole(username, "analyst"); err == nil {
+		t.Error("AddUserRole succeeded for a role that does not exist")
+	}
+
+	roleID, err := provider.AddRole("analyst")
+	if err != nil {
+		t.Fatalf("AddRole returned unexpected error: %v", err)
+	}
+	if err := provider.AddUserRole(username, "analyst"); err != nil {
+		t.Errorf("AddUserRole returned unexpected error: %v", err)
+	}
+	if err := provider.AddUserRole(username, "analyst"); err != nil {
+		t.Errorf("AddUserRole returned unexpected error for existing membership: %v", err)
+	}
+
+	roles, err := provider.GetUserRoles(username)
+	if err != nil {
+		t.Errorf("GetUserRoles returned unexpected error: %v", err)
+	}
+	if len(roles) != 1 || roles[0] != "analyst" {
+		t.Errorf("Expected roles [analyst], got %v", roles)
+	}
+
+	users, err := provider.GetUsersWithRole("analyst")
+	if err != nil {
+		t.Errorf("GetUsersWithRole returned unexpected error: %v", err)
+	}
+	if len(users) != 1 || users[0] != username {
+		t.Errorf("Expected users [%s], got %v", username, users)
+	}
+
+	// Deleting the role removes the membership
+	if err := provider.DeleteRole(roleID); err != nil {
+		t.Errorf("DeleteRole returned unexpected error: %v", err)
+	}
+	roles, err = provider.GetUserRoles(username)
+	if err != nil {
+		t.Errorf("GetUserRoles returned unexpected error: %v", err)
+	}
+	if len(roles) != 0 {
+		t.Errorf("Expected no roles after DeleteRole, got %v", roles)
+	}
+}
+
+func TestMemoryProvider_RoleMemberships(t *testing.T) {
+	provider := NewMemoryProvider()
+	username := "testuser"
+	provider.AddUser(username, "testtoken")
+	if _, err := provider.AddRole("oncall"); err != nil {
+		t.Fatalf("AddRole returned unexpected error: %v", err)
 	}
-	if rows != nil {
-		t.Error("Expected nil rows")
+
+	// Adding a membership again replaces its window
+	end := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := provider.AddUserRole(username, "oncall"); err != nil {
+		t.Errorf("AddUserRole returned unexpected error: %v", err)
+	}
+	if err := provider.AddUserRoleMembership(username, RoleMembership{Role: "oncall", NotAfter: end}); err != nil {
+		t.Errorf("AddUserRoleMembership returned unexpected error: %v", err)
+	}
+	memberships, err := provider.GetUserRoleMemberships(username)
+	if err != nil {
+		t.Errorf("GetUserRoleMemberships returned unexpected error: %v", err)
+	}
+	if len(memberships) != 1 || !memberships[0].NotAfter.Equal(end) {
+		t.Errorf("Expected one membership until %v, got %v", end, memberships)
+	}
+	if !memberships[0].ActiveAt(end.Add(-time.Second)) || memberships[0].ActiveAt(end) {
+		t.Error("Expected membership to end at NotAfter")
+	}
+	if err := provider.AddUserRoleMembership(username, RoleMembership{Role: "missing"}); err == nil {
+		t.Error("AddUserRoleMembership succeeded for a role that does not exist")
 	}
 }
 
-func TestMemoryProvider_QueryRow(t *testing.T) {
+func TestMemoryProvider_RolePermissions(t *testing.T) {
 	provider := NewMemoryProvider()
-	row := provider.QueryRow("SELECT * FROM test")
-	if row != nil {
-		t.Error("Expected nil row")
+
+	perms := []permissions.Permission{{
+		Type:   permissions.TablePermission,
+		Table:  "orders",
+		Action: permissions.Select,
+	}}
+	if err := provider.UpdateRolePermissions("analyst", perms); err == nil {
+		t.Error("UpdateRolePermissions succeeded for a role that does not exist")
+	}
+
+	roleID, err := provider.AddRole("analyst")
+	if err != nil {
+		t.Fatalf("AddRole returned unexpected error: %v", err)
+	}
+	if err := provider.UpdateRolePermissions("analyst", perms); err != nil {
+		t.Errorf("UpdateRolePermissions returned unexpected error: %v", err)
+	}
+
+	got, err := provider.GetRolePermissions("analyst")
+	if err != nil {
+		t.Errorf("GetRolePermissions returned unexpected error: %v", err)
+	}
+	if len(got) != 1 || got[0] != perms[0] {
+		t.Errorf("Expected permissions %v, got %v", perms, got)
+	}
+
+	// Deleting the role removes its permissions
+	if err := provider.DeleteRole(roleID); err != nil {
+		t.Errorf("DeleteRole returned unexpected error: %v", err)
+	}
+	if _, err := provider.GetRolePermissions("analyst"); err == nil {
+		t.Error("GetRolePermissions succeeded for a deleted role")
 	}
 }
 
@@ -1,11 +1,29 @@
 package auth
 
 import (
-	"database/sql"
+	"time"
 
 	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
 )
 
+// RoleMembership is the membership of a user in a role. NotBefore and NotAfter
+// bound the time the membership is valid; zero values leave the window open.
+type RoleMembership struct {
+	Role      string
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// ActiveAt checks if the membership is valid at a time
+func (m RoleMembership) ActiveAt(t time.Time) bool {
+	return permissions.InWindow(t, m.NotBefore, m.NotAfter)
+}
+
+// ExpiredAt checks if the validity window of the membership has ended at a time
+func (m RoleMembership) ExpiredAt(t time.Time) bool {
+	return !m.NotAfter.IsZero() && !t.Before(m.NotAfter)
+}
+
 // Provider defines the interface for authentication
 type Provider interface {
 	// Authenticate verifies if the given username and token are valid
@@ -14,12 +32,6 @@ type Provider interface {
 	// GetUserPermissions returns the list of permissions for a user
 	GetUserPermissions(username string) ([]permissions.Permission, error)
 
-	// Query executes a SELECT query
-	Query(query string, args ...interface{}) (*sql.Rows, error)
-
-	// QueryRow executes a query that returns at most one row
-	QueryRow(query string, args ...interface{}) *sql.Row
-
 	// UpdateUserPermissions updates the permissions for a user
 	UpdateUserPermissions(username string, permissions []permissions.Permission) error
 
@@ -29,6 +41,12 @@ type Provider interface {
 	// AddPermission adds a permission for a user
 	AddPermission(username string, permission permissions.Permission)
 
+	// ListUsers returns the names of all users
+	ListUsers() ([]string, error)
+
+	// ListRoles returns the names of all roles
+	ListRoles() ([]string, error)
+
 	// GetUserID returns the numeric ID for a user
 	GetUserID(username string) (int64, error)
 
@@ -47,6 +65,28 @@ type Provider interface {
 	// DeleteRole deletes a role
 	DeleteRole(roleID int64) error
 
+	// AddUserRole makes a user a member of a role
+	AddUserRole(username, roleName string) error
+
+	// RemoveUserRole removes a user from a role
+	RemoveUserRole(username, roleName string) error
+
+	// GetUserRoles returns the names of the roles a user is a member of
+	GetUserRoles(username string) ([]string, error)
+
+	// AddUserRoleMembership makes a user a member of a role, replacing the
+	// validity window of an existing membership
+	AddUserRoleMembership(username string, membership RoleMembership) error
+
+	// GetUserRoleMemberships returns the role memberships of a user
+	GetUserRoleMemberships(username string) ([]RoleMembership, error)
+
+	// GetRolePermissions returns the permissions granted to a role
+	GetRolePermissions(roleName string) ([]permissions.Permission, error)
+
+	// UpdateRolePermissions updates the permissions granted to a role
+	UpdateRolePermissions(roleName string, permissions []permissions.Permission) error
+
 	// StoreSession stores a session for a user
 	StoreSession(sessionID string, userID int64) error
 
@@ -56,3 +96,64 @@ type Provider interface {
 	// TerminateSession terminates a session
 	TerminateSession(sessionID string) error
 }
+
+// Account describes a user of a provider
+type Account struct {
+	Name     string
+	Disabled bool
+}
+
+// SessionInfo describes a session stored with StoreSession
+type SessionInfo struct {
+	ID       string
+	UserID   int64
+	Username string
+	Started  time.Time
+}
+
+// AccountManager is implemented by providers that can disable users, replace
+// their tokens and list their sessions
+type AccountManager interface {
+	// ListAccounts returns the users in name order
+	ListAccounts() ([]Account, error)
+
+	// DisableUser keeps a user from authenticating and terminates the
+	// sessions of the user
+	DisableUser(username string) error
+
+	// ResetToken replaces the token of a user
+	ResetToken(username, token string) error
+
+	// ListSessions returns the stored sessions in the order they started
+	ListSessions() ([]SessionInfo, error)
+}
+
+// RowPolicy is a row policy created with CREATE POLICY. It restricts the rows
+// of a table that the users it applies to may read and write.
+type RowPolicy struct {
+	// Name identifies the policy among the policies of its table
+	Name  string
+	Table string
+	// Actions the policy covers
+	Actions []permissions.Action
+	// Roles the policy applies to; empty means every user
+	Roles []string
+	// Using admits the existing rows that may be read, updated and deleted
+	Using string
+	// WithCheck admits the rows that may be inserted and updated
+	WithCheck string
+}
+
+// RowPolicyStore is implemented by providers that store row policies, so that
+// every handle of the provider enforces them
+type RowPolicyStore interface {
+	// AddRowPolicy stores a policy, failing if its table has a policy of the
+	// same name
+	AddRowPolicy(policy RowPolicy) error
+
+	// RemoveRowPolicy removes a policy of a table and reports whether it existed
+	RemoveRowPolicy(table, name string) (bool, error)
+
+	// ListRowPolicies returns the policies in table and name order
+	ListRowPolicies() ([]RowPolicy, error)
+}
@@ -0,0 +1,611 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+)
+
+// sqliteSchema creates the tables of the SQLite provider
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS auth_users (
+	id INTEGER PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE,
+	salt BLOB NOT NULL,
+	token_hash BLOB NOT NULL,
+	disabled INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS auth_roles (
+	id INTEGER PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE
+);
+CREATE TABLE IF NOT EXISTS auth_memberships (
+	user_id INTEGER NOT NULL,
+	role_id INTEGER NOT NULL,
+	not_before INTEGER,
+	not_after INTEGER,
+	PRIMARY KEY (user_id, role_id)
+);
+CREATE TABLE IF NOT EXISTS auth_permissions (
+	id INTEGER PRIMARY KEY,
+	user_id INTEGER,
+	role_id INTEGER,
+	permission TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS auth_sessions (
+	id TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	started INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS auth_row_policies (
+	table_name TEXT NOT NULL COLLATE NOCASE,
+	name TEXT NOT NULL,
+	policy TEXT NOT NULL,
+	PRIMARY KEY (table_name, name)
+);
+`
+
+// SQLiteProvider is an auth provider that keeps users, roles, permissions,
+// sessions and row policies in a SQLite database, so that they persist and can be shared by
+// processes. Tokens are stored as salted SHA-256 hashes, and are expected to
+// be random rather than chosen passwords.
+//
+// AddUser and AddPermission cannot report errors through the Provider
+// interface; failed changes are dropped.
+type SQLiteProvider struct {
+	db *sql.DB
+}
+
+var _ Provider = (*SQLiteProvider)(nil)
+var _ AccountManager = (*SQLiteProvider)(nil)
+var _ RowPolicyStore = (*SQLiteProvider)(nil)
+
+// OpenSQLiteProvider opens the auth store at a path, creating it if needed
+func OpenSQLiteProvider(path string) (*SQLiteProvider, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	p, err := NewSQLiteProvider(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// NewSQLiteProvider creates a provider that keeps its state in a database,
+// creating its tables if needed
+func NewSQLiteProvider(db *sql.DB) (*SQLiteProvider, error) {
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		return nil, fmt.Errorf("failed to create auth tables: %w", err)
+	}
+	return &SQLiteProvider{db: db}, nil
+}
+
+// Close closes the database of the provider
+func (p *SQLiteProvider) Close() error {
+	return p.db.Close()
+}
+
+// hashToken hashes a token with a salt
+func hashToken(salt []byte, token string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(token))
+	return h.Sum(nil)
+}
+
+// newSalt returns a random salt
+func newSalt() ([]byte, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// CreateUser adds a user, or replaces the token of an existing user
+func (p *SQLiteProvider) CreateUser(username, token string) error {
+	salt, err := newSalt()
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec(`INSERT INTO auth_users (name, salt, token_hash) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET salt = excluded.salt, token_hash = excluded.token_hash`,
+		username, salt, hashToken(salt, token))
+	return err
+}
+
+// AddUser adds a user with the given credentials
+func (p *SQLiteProvider) AddUser(username, token string) {
+	_ = p.CreateUser(username, token)
+}
+
+// AddPermission adds a permission for a user
+func (p *SQLiteProvider) AddPermission(username string, permission permissions.Permission) {
+	userID, err := p.GetUserID(username)
+	if err != nil {
+		return
+	}
+	data, err := encodePermission(permission)
+	if err != nil {
+		return
+	}
+	_, _ = p.db.Exec("INSERT INTO auth_permissions (user_id, permission) VALUES (?, ?)", userID, data)
+}
+
+// Authenticate verifies the token of a user. Disabled users do not
+// authenticate.
+func (p *SQLiteProvider) Authenticate(username, token string) (bool, error) {
+	var salt, hash []byte
+	var disabled bool
+	err := p.db.QueryRow("SELECT salt, token_hash, disabled FROM auth_users WHERE name = ?", username).
+		Scan(&salt, &hash, &disabled)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !disabled && subtle.ConstantTimeCompare(hashToken(salt, token), hash) == 1, nil
+}
+
+// GetUserPermissions returns the permissions granted directly to a user
+func (p *SQLiteProvider) GetUserPermissions(username string) ([]permissions.Permission, error) {
+	userID, err := p.GetUserID(username)
+	if err != nil {
+		return nil, err
+	}
+	return p.permissions("SELECT permission FROM auth_permissions WHERE user_id = ? ORDER BY id", userID)
+}
+
+// UpdateUserPermissions replaces the permissions granted directly to a user
+func (p *SQLiteProvider) UpdateUserPermissions(username string, perms []permissions.Permission) error {
+	userID, err := p.GetUserID(username)
+	if err != nil {
+		return err
+	}
+	return p.replacePermissions("user_id", userID, perms)
+}
+
+// ListUsers returns the names of all users
+func (p *SQLiteProvider) ListUsers() ([]string, error) {
+	return p.names("SELECT name FROM auth_users ORDER BY name")
+}
+
+// ListRoles returns the names of all roles
+func (p *SQLiteProvider) ListRoles() ([]string, error) {
+	return p.names("SELECT name FROM auth_roles ORDER BY name")
+}
+
+// GetUserID returns the numeric ID for a user
+func (p *SQLiteProvider) GetUserID(username string) (int64, error) {
+	var id int64
+	err := p.db.QueryRow("SELECT id FROM auth_users WHERE name = ?", username).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("user %s not found", username)
+	}
+	return id, err
+}
+
+// GetUsersWithRole returns a list of usernames that have the given role
+func (p *SQLiteProvider) GetUsersWithRole(roleName string) ([]string, error) {
+	return p.names(`SELECT u.name FROM auth_memberships m
+		JOIN auth_users u ON u.id = m.user_id
+		JOIN auth_roles r ON r.id = m.role_id
+		WHERE r.name = ? ORDER BY u.name`, roleName)
+}
+
+// GetRoleName returns the name of a role given its ID
+func (p *SQLiteProvider) GetRoleName(roleID int64) (string, error) {
+	var name string
+	err := p.db.QueryRow("SELECT name FROM auth_roles WHERE id = ?", roleID).Scan(&name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("role with ID %d not found", roleID)
+	}
+	return name, err
+}
+
+// GetRoleID returns the ID of a role given its name
+func (p *SQLiteProvider) GetRoleID(roleName string) (int64, error) {
+	var id int64
+	err := p.db.QueryRow("SELECT id FROM auth_roles WHERE name = ?", roleName).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("role %s not found", roleName)
+	}
+	return id, err
+}
+
+// AddRole adds a role and returns its ID
+func (p *SQLiteProvider) AddRole(roleName string) (int64, error) {
+	if _, err := p.GetRoleID(roleName); err == nil {
+		return 0, fmt.Errorf("role %s already exists", roleName)
+	}
+	result, err := p.db.Exec("INSERT INTO auth_roles (name) VALUES (?)", roleName)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// DeleteRole deletes a role, its permissions and its memberships
+func (p *SQLiteProvider) DeleteRole(roleID int64) error {
+	if _, err := p.GetRoleName(roleID); err != nil {
+		return err
+	}
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range []string{
+		"DELETE FROM auth_memberships WHERE role_id = ?",
+		"DELETE FROM auth_permissions WHERE role_id = ?",
+		"DELETE FROM auth_roles WHERE id = ?",
+	} {
+		if _, err := tx.Exec(stmt, roleID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// AddUserRole makes a user a member of a role
+func (p *SQLiteProvider) AddUserRole(username, roleName string) error {
+	userID, roleID, err := p.userRole(username, roleName)
+	if err != nil {
+		return err
+	}
+	// Role membership is idempotent
+	_, err = p.db.Exec("INSERT OR IGNORE INTO auth_memberships (user_id, role_id) VALUES (?, ?)", userID, roleID)
+	return err
+}
+
+// AddUserRoleMembership makes a user a member of a role, replacing the
+// validity window of an existing membership
+func (p *SQLiteProvider) AddUserRoleMembership(username string, membership RoleMembership) error {
+	userID, roleID, err := p.userRole(username, membership.Role)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec(`INSERT INTO auth_memberships (user_id, role_id, not_before, not_after) VALUES (?, ?, ?, ?)
+		ON CONFLICT (user_id, role_id) DO UPDATE SET not_before = excluded.not_before, not_after = excluded.not_after`,
+		userID, roleID, unixTime(membership.NotBefore), unixTime(membership.NotAfter))
+	return err
+}
+
+// userRole returns the IDs of a user and a role, checking that both exist
+func (p *SQLiteProvider) userRole(username, roleName string) (int64, int64, error) {
+	userID, err := p.GetUserID(username)
+	if err != nil {
+		return 0, 0, err
+	}
+	roleID, err := p.GetRoleID(roleName)
+	if err != nil {
+		return 0, 0, err
+	}
+	return userID, roleID, nil
+}
+
+// RemoveUserRole removes a user from a role
+func (p *SQLiteProvider) RemoveUserRole(username, roleName string) error {
+	userID, err := p.GetUserID(username)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec(`DELETE FROM auth_memberships WHERE user_id = ?
+		AND role_id IN (SELECT id FROM auth_roles WHERE name = ?)`, userID, roleName)
+	return err
+}
+
+// GetUserRoles returns the names of the roles a user is a member of
+func (p *SQLiteProvider) GetUserRoles(username string) ([]string, error) {
+	memberships, err := p.GetUserRoleMemberships(username)
+	if err != nil {
+		return nil, err
+	}
+	roles := make([]string, len(memberships))
+	for i, membership := range memberships {
+		roles[i] = membership.Role
+	}
+	return roles, nil
+}
+
+// GetUserRoleMemberships returns the role memberships of a user
+func (p *SQLiteProvider) GetUserRoleMemberships(username string) ([]RoleMembership, error) {
+	userID, err := p.GetUserID(username)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := p.db.Query(`SELECT r.name, m.not_before, m.not_after FROM auth_memberships m
+		JOIN auth_roles r ON r.id = m.role_id
+		WHERE m.user_id = ? ORDER BY m.rowid`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	memberships := []RoleMembership{}
+	for rows.Next() {
+		var membership RoleMembership
+		var notBefore, notAfter sql.NullInt64
+		if err := rows.Scan(&membership.Role, &notBefore, &notAfter); err != nil {
+			return nil, err
+		}
+		membership.NotBefore = fromUnixTime(notBefore)
+		membership.NotAfter = fromUnixTime(notAfter)
+		memberships = append(memberships, membership)
+	}
+	return memberships, rows.Err()
+}
+
+// GetRolePermissions returns the permissions granted to a role
+func (p *SQLiteProvider) GetRolePermissions(roleName string) ([]permissions.Permission, error) {
+	roleID, err := p.GetRoleID(roleName)
+	if err != nil {
+		return nil, err
+	}
+	return p.permissions("SELECT permission FROM auth_permissions WHERE role_id = ? ORDER BY id", roleID)
+}
+
+// UpdateRolePermissions replaces the permissions granted to a role
+func (p *SQLiteProvider) UpdateRolePermissions(roleName string, perms []permissions.Permission) error {
+	roleID, err := p.GetRoleID(roleName)
+	if err != nil {
+		return err
+	}
+	return p.replacePermissions("role_id", roleID, perms)
+}
+
+// StoreSession stores a session for a user
+func (p *SQLiteProvider) StoreSession(sessionID string, userID int64) error {
+	_, err := p.db.Exec("INSERT OR REPLACE INTO auth_sessions (id, user_id, started) VALUES (?, ?, ?)",
+		sessionID, userID, time.Now().UnixNano())
+	return err
+}
+
+// ValidateSession checks if a session is valid
+func (p *SQLiteProvider) ValidateSession(sessionID string) (bool, error) {
+	var exists bool
+	err := p.db.QueryRow("SELECT EXISTS (SELECT 1 FROM auth_sessions WHERE id = ?)", sessionID).Scan(&exists)
+	return exists, err
+}
+
+// TerminateSession terminates a session
+func (p *SQLiteProvider) TerminateSession(sessionID string) error {
+	_, err := p.db.Exec("DELETE FROM auth_sessions WHERE id = ?", sessionID)
+	return err
+}
+
+// ListAccounts returns the users in name order
+func (p *SQLiteProvider) ListAccounts() ([]Account, error) {
+	rows, err := p.db.Query("SELECT name, disabled FROM auth_users ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accounts []Account
+	for rows.Next() {
+		var account Account
+		if err := rows.Scan(&account.Name, &account.Disabled); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, rows.Err()
+}
+
+// DisableUser keeps a user from authenticating and terminates the sessions of
+// the user
+func (p *SQLiteProvider) DisableUser(username string) error {
+	userID, err := p.GetUserID(username)
+	if err != nil {
+		return err
+	}
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE auth_users SET disabled = 1 WHERE id = ?", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM auth_sessions WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ResetToken replaces the token of a user
+func (p *SQLiteProvider) ResetToken(username, token string) error {
+	salt, err := newSalt()
+	if err != nil {
+		return err
+	}
+	result, err := p.db.Exec("UPDATE auth_users SET salt = ?, token_hash = ? WHERE name = ?",
+		salt, hashToken(salt, token), username)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("user %s not found", username)
+	}
+	return nil
+}
+
+// ListSessions returns the stored sessions in the order they started
+func (p *SQLiteProvider) ListSessions() ([]SessionInfo, error) {
+	rows, err := p.db.Query(`SELECT s.id, s.user_id, COALESCE(u.name, ''), s.started FROM auth_sessions s
+		LEFT JOIN auth_users u ON u.id = s.user_id ORDER BY s.started, s.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []SessionInfo
+	for rows.Next() {
+		var session SessionInfo
+		var started int64
+		if err := rows.Scan(&session.ID, &session.UserID, &session.Username, &started); err != nil {
+			return nil, err
+		}
+		session.Started = time.Unix(0, started).UTC()
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// AddRowPolicy stores a policy, failing if its table has a policy of the same
+// name
+func (p *SQLiteProvider) AddRowPolicy(policy RowPolicy) error {
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	result, err := p.db.Exec("INSERT INTO auth_row_policies (table_name, name, policy) VALUES (?, ?, ?) ON CONFLICT DO NOTHING",
+		policy.Table, policy.Name, string(data))
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("policy %s on table %s already exists", policy.Name, policy.Table)
+	}
+	return nil
+}
+
+// RemoveRowPolicy removes a policy of a table and reports whether it existed
+func (p *SQLiteProvider) RemoveRowPolicy(table, name string) (bool, error) {
+	result, err := p.db.Exec("DELETE FROM auth_row_policies WHERE table_name = ? AND name = ?", table, name)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// ListRowPolicies returns the policies in table and name order
+func (p *SQLiteProvider) ListRowPolicies() ([]RowPolicy, error) {
+	rows, err := p.db.Query("SELECT policy FROM auth_row_policies ORDER BY table_name, name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var policies []RowPolicy
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var policy RowPolicy
+		if err := json.Unmarshal([]byte(data), &policy); err != nil {
+			return nil, fmt.Errorf("failed to decode row policy: %w", err)
+		}
+		policies = append(policies, policy)
+	}
+	return policies, rows.Err()
+}
+
+// names returns the names a query selects
+func (p *SQLiteProvider) names(query string, args ...interface{}) ([]string, error) {
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// permissions returns the permissions a query selects
+func (p *SQLiteProvider) permissions(query string, args ...interface{}) ([]permissions.Permission, error) {
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	perms := []permissions.Permission{}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var perm permissions.Permission
+		if err := json.Unmarshal([]byte(data), &perm); err != nil {
+			return nil, fmt.Errorf("failed to decode permission: %w", err)
+		}
+		perms = append(perms, perm)
+	}
+	return perms, rows.Err()
+}
+
+// replacePermissions replaces the permissions of a user or role, identified
+// by an ID column
+func (p *SQLiteProvider) replacePermissions(column string, id int64, perms []permissions.Permission) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM auth_permissions WHERE "+column+" = ?", id); err != nil {
+		return err
+	}
+	for _, perm := range perms {
+		data, err := encodePermission(perm)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO auth_permissions ("+column+", permission) VALUES (?, ?)", id, data); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// encodePermission encodes a permission for storage, with its validity
+// window in UTC
+func encodePermission(perm permissions.Permission) (string, error) {
+	if !perm.NotBefore.IsZero() {
+		perm.NotBefore = perm.NotBefore.UTC()
+	}
+	if !perm.NotAfter.IsZero() {
+		perm.NotAfter = perm.NotAfter.UTC()
+	}
+	data, err := json.Marshal(perm)
+	return string(data), err
+}
+
+// unixTime converts a time to nanoseconds since the epoch, or NULL for the
+// zero time
+func unixTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UnixNano()
+}
+
+// fromUnixTime converts nanoseconds since the epoch to a time in UTC
+func fromUnixTime(n sql.NullInt64) time.Time {
+	if !n.Valid {
+		return time.Time{}
+	}
+	return time.Unix(0, n.Int64).UTC()
+}
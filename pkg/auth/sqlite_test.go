@@ -0,0 +1,196 @@
+package auth
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+)
+
+func openTestStore(t *testing.T, path string) *SQLiteProvider {
+	t.Helper()
+	provider, err := OpenSQLiteProvider(path)
+	if err != nil {
+		t.Fatalf("OpenSQLiteProvider returned unexpected error: %v", err)
+	}
+	return provider
+}
+
+func TestSQLiteProvider_Users(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.db")
+	provider := openTestStore(t, path)
+	provider.AddUser("alice", "s3cret")
+	provider.AddUser("bob", "hunter2")
+
+	if ok, err := provider.Authenticate("alice", "s3cret"); err != nil || !ok {
+		t.Errorf("Authentication failed with correct credentials: %v", err)
+	}
+	if ok, _ := provider.Authenticate("alice", "hunter2"); ok {
+		t.Error("Authentication succeeded with incorrect token")
+	}
+	if ok, _ := provider.Authenticate("carol", "s3cret"); ok {
+		t.Error("Authentication succeeded for unknown user")
+	}
+
+	// Users persist across opens
+	provider.Close()
+	provider = openTestStore(t, path)
+	defer provider.Close()
+	users, err := provider.ListUsers()
+	if err != nil {
+		t.Fatalf("ListUsers returned unexpected error: %v", err)
+	}
+	if len(users) != 2 || users[0] != "alice" || users[1] != "bob" {
+		t.Errorf("Expected users [alice bob], got %v", users)
+	}
+
+	if err := provider.ResetToken("alice", "n3w"); err != nil {
+		t.Fatalf("ResetToken returned unexpected error: %v", err)
+	}
+	if ok, _ := provider.Authenticate("alice", "s3cret"); ok {
+		t.Error("Authentication succeeded with replaced token")
+	}
+	if ok, _ := provider.Authenticate("alice", "n3w"); !ok {
+		t.Error("Authentication failed with new token")
+	}
+	if err := provider.ResetToken("carol", "n3w"); err == nil {
+		t.Error("ResetToken succeeded for unknown user")
+	}
+
+	// Disabling a user ends the sessions of the user
+	aliceID, _ := provider.GetUserID("alice")
+	bobID, _ := provider.GetUserID("bob")
+	provider.StoreSession("s1", aliceID)
+	provider.StoreSession("s2", bobID)
+	if err := provider.DisableUser("alice"); err != nil {
+		t.Fatalf("DisableUser returned unexpected error: %v", err)
+	}
+	if ok, _ := provider.Authenticate("alice", "n3w"); ok {
+		t.Error("Authentication succeeded for disabled user")
+	}
+	sessions, err := provider.ListSessions()
+	if err != nil {
+		t.Fatalf("ListSessions returned unexpected error: %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != "s2" || sessions[0].Username != "bob" {
+		t.Errorf("Expected the session of bob, got %v", sessions)
+	}
+	accounts, err := provider.ListAccounts()
+	if err != nil {
+		t.Fatalf("ListAccounts returned unexpected error: %v", err)
+	}
+	if len(accounts) != 2 || !accounts[0].Disabled || accounts[1].Disabled {
+		t.Errorf("Expected alice to be disabled, got %v", accounts)
+	}
+
+	if err := provider.TerminateSession("s2"); err != nil {
+		t.Fatalf("TerminateSession returned unexpected error: %v", err)
+	}
+	if ok, _ := provider.ValidateSession("s2"); ok {
+		t.Error("Terminated session is still valid")
+	}
+}
+
+func TestSQLiteProvider_Roles(t *testing.T) {
+	provider := openTestStore(t, filepath.Join(t.TempDir(), "auth.db"))
+	defer provider.Close()
+	provider.AddUser("alice", "s3cret")
+
+	roleID, err := provider.AddRole("reader")
+	if err != nil {
+		t.Fatalf("AddRole returned unexpected error: %v", err)
+	}
+	if _, err := provider.AddRole("reader"); err == nil {
+		t.Error("AddRole succeeded for existing role")
+	}
+	if name, _ := provider.GetRoleName(roleID); name != "reader" {
+		t.Errorf("Expected role reader, got %s", name)
+	}
+
+	notAfter := time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+	if err := provider.AddUserRoleMembership("alice", RoleMembership{Role: "reader", NotAfter: notAfter}); err != nil {
+		t.Fatalf("AddUserRoleMembership returned unexpected error: %v", err)
+	}
+	if err := provider.AddUserRole("alice", "reader"); err != nil {
+		t.Fatalf("AddUserRole returned unexpected error: %v", err)
+	}
+	memberships, err := provider.GetUserRoleMemberships("alice")
+	if err != nil {
+		t.Fatalf("GetUserRoleMemberships returned unexpected error: %v", err)
+	}
+	if len(memberships) != 1 || !memberships[0].NotAfter.Equal(notAfter) {
+		t.Errorf("Expected one membership until %v, got %v", notAfter, memberships)
+	}
+	if err := provider.AddUserRole("carol", "reader"); err == nil {
+		t.Error("AddUserRole succeeded for unknown user")
+	}
+
+	perms := []permissions.Permission{
+		{Type: permissions.TablePermission, Table: "orders", Action: permissions.Select},
+		{Type: permissions.RowPermission, Table: "orders", Condition: "qty > 1", NotAfter: notAfter},
+	}
+	if err := provider.UpdateRolePermissions("reader", perms); err != nil {
+		t.Fatalf("UpdateRolePermissions returned unexpected error: %v", err)
+	}
+	got, err := provider.GetRolePermissions("reader")
+	if err != nil {
+		t.Fatalf("GetRolePermissions returned unexpected error: %v", err)
+	}
+	if len(got) != 2 || got[0] != perms[0] || got[1] != perms[1] {
+		t.Errorf("Expected %v, got %v", perms, got)
+	}
+
+	provider.AddPermission("alice", perms[0])
+	if got, _ := provider.GetUserPermissions("alice"); len(got) != 1 || got[0] != perms[0] {
+		t.Errorf("Expected %v, got %v", perms[:1], got)
+	}
+
+	// Deleting a role removes its memberships
+	if err := provider.DeleteRole(roleID); err != nil {
+		t.Fatalf("DeleteRole returned unexpected error: %v", err)
+	}
+	if roles, _ := provider.GetUserRoles("alice"); len(roles) != 0 {
+		t.Errorf("Expected no roles, got %v", roles)
+	}
+	if _, err := provider.GetRolePermissions("reader"); err == nil {
+		t.Error("GetRolePermissions succeeded for deleted role")
+	}
+}
+
+func TestSQLiteProvider_RowPolicies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.db")
+	provider := openTestStore(t, path)
+	policy := RowPolicy{
+		Name:    "regional",
+		Table:   "orders",
+		Actions: []permissions.Action{permissions.Select, permissions.Update},
+		Roles:   []string{"analyst"},
+		Using:   "region = current_setting('region')",
+	}
+	if err := provider.AddRowPolicy(policy); err != nil {
+		t.Fatalf("AddRowPolicy returned unexpected error: %v", err)
+	}
+	if err := provider.AddRowPolicy(RowPolicy{Name: "regional", Table: "ORDERS", Using: "1 = 1"}); err == nil {
+		t.Error("AddRowPolicy succeeded for a policy that exists")
+	}
+
+	// Policies persist across opens
+	provider.Close()
+	provider = openTestStore(t, path)
+	defer provider.Close()
+	policies, err := provider.ListRowPolicies()
+	if err != nil {
+		t.Fatalf("ListRowPolicies returned unexpected error: %v", err)
+	}
+	if len(policies) != 1 || policies[0].Using != policy.Using || len(policies[0].Actions) != 2 || policies[0].Roles[0] != "analyst" {
+		t.Errorf("Expected the stored policy, got %+v", policies)
+	}
+
+	if removed, err := provider.RemoveRowPolicy("orders", "regional"); err != nil || !removed {
+		t.Errorf("RemoveRowPolicy returned %v, %v", removed, err)
+	}
+	if removed, _ := provider.RemoveRowPolicy("orders", "regional"); removed {
+		t.Error("RemoveRowPolicy removed a policy twice")
+	}
+}
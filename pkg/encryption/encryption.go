@@ -0,0 +1,317 @@
+// Package encryption encrypts the values of designated columns with AES-GCM so
+// that they stay confidential to anyone holding the database file
+package encryption
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeySize is the size of the keys of a KeyProvider, for AES-256
+const KeySize = 32
+
+// prefix starts every encrypted value
+const prefix = "enc:1:"
+
+// KeyProvider supplies the keys that encrypt column values. Each key has an
+// ID that is stored with the values it encrypts, so that a provider can keep
+// serving old keys after rotating to a new one.
+type KeyProvider interface {
+	// CurrentKey returns the ID of the key new values are encrypted with, and
+	// the key
+	CurrentKey(ctx context.Context) (string, []byte, error)
+	// Key returns the key with an ID
+	Key(ctx context.Context, id string) ([]byte, error)
+}
+
+// Column is an encrypted column. Values of deterministic columns encrypt to
+// the same ciphertext under the same key, which allows equality lookups but
+// reveals which rows hold equal values.
+type Column struct {
+	Table         string
+	Name          string
+	Deterministic bool
+}
+
+// Cipher encrypts and decrypts the values of encrypted columns. Values are
+// bound to their column, so a ciphertext copied to another column does not
+// decrypt.
+type Cipher struct {
+	provider KeyProvider
+	columns  map[string]Column
+	keys     map[string]*columnKey
+	mu       sync.RWMutex
+}
+
+// columnKey holds the keys derived from a key of the provider
+type columnKey struct {
+	aead cipher.AEAD
+	// nonceKey derives the nonces of deterministic encryption
+	nonceKey []byte
+}
+
+// NewCipher creates a cipher for columns
+func NewCipher(provider KeyProvider, columns ...Column) (*Cipher, error) {
+	if provider == nil {
+		return nil, fmt.Errorf("key provider cannot be nil")
+	}
+	c := &Cipher{
+		provider: provider,
+		columns:  make(map[string]Column, len(columns)),
+		keys:     make(map[string]*columnKey),
+	}
+	for _, column := range columns {
+		if column.Table == "" || column.Name == "" {
+			return nil, fmt.Errorf("encrypted column must have a table and a name")
+		}
+		c.columns[columnName(column.Table, column.Name)] = column
+	}
+	return c, nil
+}
+
+// Column returns an encrypted column
+func (c *Cipher) Column(table, name string) (Column, bool) {
+	column, ok := c.columns[columnName(table, name)]
+	return column, ok
+}
+
+// Columns returns the encrypted columns of a table
+func (c *Cipher) Columns(table string) []Column {
+	var columns []Column
+	for _, column := range c.columns {
+		if strings.EqualFold(column.Table, table) {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
+
+// Encrypt encrypts a value of a column with the current key. NULL stays NULL.
+func (c *Cipher) Encrypt(ctx context.Context, table, name string, value interface{}) (interface{}, error) {
+	column, ok := c.Column(table, name)
+	if !ok {
+		return nil, fmt.Errorf("column %s.%s is not encrypted", table, name)
+	}
+	if value == nil {
+		return nil, nil
+	}
+	plaintext, err := encode(value)
+	if err != nil {
+		return nil, err
+	}
+	id, key, err := c.currentKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Deterministic nonces are derived from the value, so equal values of a
+	// column get equal ciphertexts
+	aad := []byte(columnName(table, name))
+	nonce := make([]byte, key.aead.NonceSize())
+	mode := "r"
+	if column.Deterministic {
+		mac := hmac.New(sha256.New, key.nonceKey)
+		mac.Write(aad)
+		mac.Write([]byte{0})
+		mac.Write(plaintext)
+		copy(nonce, mac.Sum(nil))
+		mode = "d"
+	} else if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := key.aead.Seal(nonce, nonce, plaintext, aad)
+	return prefix + id + ":" + mode + ":" + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt decrypts a value of a column. Values that are not encrypted, such
+// as rows written before the column was encrypted, are returned as they are.
+func (c *Cipher) Decrypt(ctx context.Context, table, name string, value interface{}) (interface{}, error) {
+	id, sealed, ok, err := parse(value)
+	if err != nil || !ok {
+		return value, err
+	}
+	key, err := c.key(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := key.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, fmt.Errorf("malformed encrypted value")
+	}
+	plaintext, err := key.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(columnName(table, name)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt value of %s.%s: %w", table, name, err)
+	}
+	return decode(plaintext)
+}
+
+// KeyID returns the ID of the key that encrypted a value, and false if the
+// value is not encrypted
+func KeyID(value interface{}) (string, bool) {
+	id, _, ok, err := parse(value)
+	return id, ok && err == nil
+}
+
+// CurrentKeyID returns the ID of the key new values are encrypted with
+func (c *Cipher) CurrentKeyID(ctx context.Context) (string, error) {
+	id, _, err := c.provider.CurrentKey(ctx)
+	return id, err
+}
+
+// currentKey returns the current key of the provider
+func (c *Cipher) currentKey(ctx context.Context) (string, *columnKey, error) {
+	id, raw, err := c.provider.CurrentKey(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	key, err := c.derive(id, raw)
+	return id, key, err
+}
+
+// key returns the key with an ID
+func (c *Cipher) key(ctx context.Context, id string) (*columnKey, error) {
+	c.mu.RLock()
+	key, ok := c.keys[id]
+	c.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+	raw, err := c.provider.Key(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return c.derive(id, raw)
+}
+
+// derive derives the encryption and nonce keys from a key of the provider
+func (c *Cipher) derive(id string, raw []byte) (*columnKey, error) {
+	if id == "" || strings.Contains(id, ":") {
+		return nil, fmt.Errorf("invalid key ID: %q", id)
+	}
+	if len(raw) != KeySize {
+		return nil, fmt.Errorf("key %s must be %d bytes", id, KeySize)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key, ok := c.keys[id]; ok {
+		return key, nil
+	}
+
+	block, err := aes.NewCipher(subkey(raw, "encrypt"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	key := &columnKey{aead: aead, nonceKey: subkey(raw, "nonce")}
+	c.keys[id] = key
+	return key, nil
+}
+
+// subkey derives a key for one purpose from a key of the provider
+func subkey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("secure_sqlite column " + purpose))
+	return mac.Sum(nil)
+}
+
+// columnName returns the name that binds encrypted values to their column
+func columnName(table, name string) string {
+	return strings.ToLower(table) + "." + strings.ToLower(name)
+}
+
+// parse splits an encrypted value into its key ID and sealed bytes. It
+// reports false if the value is not encrypted.
+func parse(value interface{}) (string, []byte, bool, error) {
+	var s string
+	switch v := value.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return "", nil, false, nil
+	}
+	if !strings.HasPrefix(s, prefix) {
+		return "", nil, false, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(s, prefix), ":", 3)
+	if len(parts) != 3 || (parts[1] != "r" && parts[1] != "d") {
+		return "", nil, false, fmt.Errorf("malformed encrypted value")
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", nil, false, fmt.Errorf("malformed encrypted value: %w", err)
+	}
+	return parts[0], sealed, true, nil
+}
+
+// encode encodes a value with a tag of its type, so that it decrypts to the
+// same SQLite type
+func encode(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case string:
+		return append([]byte{'s'}, v...), nil
+	case []byte:
+		return append([]byte{'b'}, v...), nil
+	case int:
+		return encodeInt(int64(v)), nil
+	case int64:
+		return encodeInt(v), nil
+	case bool:
+		if v {
+			return encodeInt(1), nil
+		}
+		return encodeInt(0), nil
+	case float64:
+		return binary.BigEndian.AppendUint64([]byte{'f'}, math.Float64bits(v)), nil
+	case time.Time:
+		return append([]byte{'s'}, v.Format(time.RFC3339Nano)...), nil
+	default:
+		return nil, fmt.Errorf("cannot encrypt value of type %T", value)
+	}
+}
+
+// encodeInt encodes an integer
+func encodeInt(v int64) []byte {
+	return binary.BigEndian.AppendUint64([]byte{'i'}, uint64(v))
+}
+
+// decode decodes a value encoded by encode
+func decode(plaintext []byte) (interface{}, error) {
+	if len(plaintext) == 0 {
+		return nil, fmt.Errorf("malformed plaintext")
+	}
+	data := plaintext[1:]
+	switch plaintext[0] {
+	case 's':
+		return string(data), nil
+	case 'b':
+		return data, nil
+	case 'i':
+		if len(data) != 8 {
+			return nil, fmt.Errorf("malformed plaintext")
+		}
+		return int64(binary.BigEndian.Uint64(data)), nil
+	case 'f':
+		if len(data) != 8 {
+			return nil, fmt.Errorf("malformed plaintext")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), nil
+	default:
+		return nil, fmt.Errorf("malformed plaintext")
+	}
+}
@@ -0,0 +1,144 @@
+package encryption
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestCipher(t *testing.T) (*Cipher, *FileKeyProvider) {
+	t.Helper()
+	provider, err := CreateKeyFile(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatalf("Failed to create key file: %v", err)
+	}
+	c, err := NewCipher(provider,
+		Column{Table: "users", Name: "ssn"},
+		Column{Table: "users", Name: "email", Deterministic: true},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create cipher: %v", err)
+	}
+	return c, provider
+}
+
+func TestCipherRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newTestCipher(t)
+
+	for _, value := range []interface{}{"123-45-6789", []byte{0, 1, 2}, int64(-42), 3.5, nil} {
+		encrypted, err := c.Encrypt(ctx, "users", "ssn", value)
+		if err != nil {
+			t.Fatalf("Encrypt(%v) failed: %v", value, err)
+		}
+		if value == nil {
+			if encrypted != nil {
+				t.Errorf("Encrypt(nil) = %v, want nil", encrypted)
+			}
+			continue
+		}
+		if s, ok := encrypted.(string); !ok || !strings.HasPrefix(s, prefix) {
+			t.Fatalf("Encrypt(%v) = %v, want an encrypted value", value, encrypted)
+		}
+		decrypted, err := c.Decrypt(ctx, "USERS", "SSN", encrypted)
+		if err != nil {
+			t.Fatalf("Decrypt failed: %v", err)
+		}
+		if b, ok := value.([]byte); ok {
+			if string(decrypted.([]byte)) != string(b) {
+				t.Errorf("Decrypt = %v, want %v", decrypted, value)
+			}
+		} else if decrypted != value {
+			t.Errorf("Decrypt = %v, want %v", decrypted, value)
+		}
+	}
+
+	// Plaintext passes through
+	if v, err := c.Decrypt(ctx, "users", "ssn", "plain"); err != nil || v != "plain" {
+		t.Errorf("Decrypt(plain) = %v, %v", v, err)
+	}
+
+	// Values are bound to their column
+	encrypted, err := c.Encrypt(ctx, "users", "ssn", "secret")
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if _, err := c.Decrypt(ctx, "users", "email", encrypted); err == nil {
+		t.Error("Expected a value of another column to fail to decrypt")
+	}
+	if _, err := c.Encrypt(ctx, "users", "name", "x"); err == nil {
+		t.Error("Expected encrypting an unencrypted column to fail")
+	}
+}
+
+func TestCipherDeterministic(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newTestCipher(t)
+
+	a, _ := c.Encrypt(ctx, "users", "email", "alice@example.com")
+	b, _ := c.Encrypt(ctx, "users", "email", "alice@example.com")
+	if a != b {
+		t.Error("Expected deterministic encryption to yield equal ciphertexts")
+	}
+	other, _ := c.Encrypt(ctx, "users", "email", "bob@example.com")
+	if a == other {
+		t.Error("Expected different values to yield different ciphertexts")
+	}
+
+	x, _ := c.Encrypt(ctx, "users", "ssn", "123-45-6789")
+	y, _ := c.Encrypt(ctx, "users", "ssn", "123-45-6789")
+	if x == y {
+		t.Error("Expected randomized encryption to yield different ciphertexts")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	c, provider := newTestCipher(t)
+
+	old, err := c.Encrypt(ctx, "users", "ssn", "secret")
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	oldID, ok := KeyID(old)
+	if !ok {
+		t.Fatalf("KeyID(%v) found no key", old)
+	}
+
+	newID, err := provider.Rotate()
+	if err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	if newID == oldID {
+		t.Fatalf("Rotate returned the old key ID %s", oldID)
+	}
+	if current, err := c.CurrentKeyID(ctx); err != nil || current != newID {
+		t.Errorf("CurrentKeyID = %s, %v, want %s", current, err, newID)
+	}
+	encrypted, _ := c.Encrypt(ctx, "users", "ssn", "secret")
+	if id, _ := KeyID(encrypted); id != newID {
+		t.Errorf("Expected new values to use key %s, got %s", newID, id)
+	}
+
+	// Old values still decrypt, also with the key file reopened
+	reopened, err := OpenKeyFile(provider.path)
+	if err != nil {
+		t.Fatalf("OpenKeyFile failed: %v", err)
+	}
+	c2, _ := NewCipher(reopened, Column{Table: "users", Name: "ssn"})
+	for _, cipher := range []*Cipher{c, c2} {
+		if v, err := cipher.Decrypt(ctx, "users", "ssn", old); err != nil || v != "secret" {
+			t.Errorf("Decrypt(old) = %v, %v", v, err)
+		}
+	}
+
+	info, err := os.Stat(provider.path)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected key file mode 0600, got %v", info.Mode().Perm())
+	}
+}
@@ -0,0 +1,133 @@
+package encryption
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// keyFile is the JSON layout of a key file
+type keyFile struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// FileKeyProvider serves keys from a local JSON file that maps key IDs to
+// hex-encoded keys. The file must be kept away from the database file, and is
+// only readable by its owner.
+type FileKeyProvider struct {
+	path string
+	file keyFile
+	mu   sync.RWMutex
+}
+
+// CreateKeyFile creates a key file holding a new key
+func CreateKeyFile(path string) (*FileKeyProvider, error) {
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("key file %s already exists", path)
+	}
+	p := &FileKeyProvider{path: path, file: keyFile{Keys: make(map[string]string)}}
+	if _, err := p.Rotate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// OpenKeyFile opens an existing key file
+func OpenKeyFile(path string) (*FileKeyProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file keyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("malformed key file %s: %w", path, err)
+	}
+	if _, ok := file.Keys[file.Current]; !ok {
+		return nil, fmt.Errorf("key file %s has no current key", path)
+	}
+	return &FileKeyProvider{path: path, file: file}, nil
+}
+
+// CurrentKey returns the current key
+func (p *FileKeyProvider) CurrentKey(ctx context.Context) (string, []byte, error) {
+	p.mu.RLock()
+	id := p.file.Current
+	p.mu.RUnlock()
+	key, err := p.Key(ctx, id)
+	return id, key, err
+}
+
+// Key returns the key with an ID
+func (p *FileKeyProvider) Key(ctx context.Context, id string) ([]byte, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	encoded, ok := p.file.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key: %s", id)
+	}
+	key, err := hex.DecodeString(encoded)
+	if err != nil || len(key) != KeySize {
+		return nil, fmt.Errorf("malformed key: %s", id)
+	}
+	return key, nil
+}
+
+// Rotate generates a new key, makes it the current key and saves the file.
+// Values encrypted with the previous keys still decrypt until they are
+// re-encrypted.
+func (p *FileKeyProvider) Rotate() (string, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	id := fmt.Sprintf("k%d", len(p.file.Keys)+1)
+	for p.file.Keys[id] != "" {
+		id += "x"
+	}
+	file := keyFile{Current: id, Keys: make(map[string]string, len(p.file.Keys)+1)}
+	for existing, encoded := range p.file.Keys {
+		file.Keys[existing] = encoded
+	}
+	file.Keys[id] = hex.EncodeToString(key)
+	if err := writeKeyFile(p.path, file); err != nil {
+		return "", err
+	}
+	p.file = file
+	return id, nil
+}
+
+// writeKeyFile replaces a key file atomically
+func writeKeyFile(path string, file keyFile) error {
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
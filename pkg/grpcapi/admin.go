@@ -0,0 +1,210 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/grpcapi/securesqlitepb"
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+	"github.com/wemcdonald/secure_sqlite/pkg/rbac"
+	"github.com/wemcdonald/secure_sqlite/pkg/secure_sqlite"
+)
+
+// withHandle runs an access control change on a handle of the caller, which
+// checks the privileges of the caller
+func (s *Server) withHandle(ctx context.Context, operation string, f func(db *secure_sqlite.SecureSQLite) error) (*emptypb.Empty, error) {
+	_, c, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	db, err := secure_sqlite.Open(s.dsn, s.authProvider, c.username, c.token, s.opts.handleOpts...)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	defer db.Close()
+	if err := f(db); err != nil {
+		return nil, statusError(adminError(operation, err))
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// adminError reports an error of an access control change
+func adminError(operation string, err error) error {
+	var dbErr *secure_sqlite.DBError
+	if errors.As(err, &dbErr) {
+		return err
+	}
+	if errors.Is(err, rbac.ErrInsufficientPrivilege) {
+		return &secure_sqlite.DBError{
+			Code:    "PERMISSION_DENIED",
+			Message: "insufficient privilege",
+			Err:     err,
+		}
+	}
+	return &secure_sqlite.DBError{
+		Code:    "ACCESS_CONTROL_ERROR",
+		Message: fmt.Sprintf("failed to %s", operation),
+		Err:     err,
+	}
+}
+
+// ListRoles lists the roles and their members. It requires the privilege to
+// manage roles.
+func (s *Server) ListRoles(ctx context.Context, _ *emptypb.Empty) (*securesqlitepb.ListRolesResponse, error) {
+	resp := &securesqlitepb.ListRolesResponse{}
+	_, err := s.withHandle(ctx, "list roles", func(db *secure_sqlite.SecureSQLite) error {
+		names, err := db.ListRoles()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			members, err := db.RoleMembers(name)
+			if err != nil {
+				return err
+			}
+			resp.Roles = append(resp.Roles, &securesqlitepb.Role{Name: name, Members: members})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// CreateRole creates a role
+func (s *Server) CreateRole(ctx context.Context, req *securesqlitepb.RoleRequest) (*emptypb.Empty, error) {
+	if req.Name == "" {
+		return nil, statusError(requestError("name is required", nil))
+	}
+	return s.withHandle(ctx, "create role", func(db *secure_sqlite.SecureSQLite) error {
+		_, err := db.CreateRole(req.Name)
+		return err
+	})
+}
+
+// DeleteRole deletes a role
+func (s *Server) DeleteRole(ctx context.Context, req *securesqlitepb.RoleRequest) (*emptypb.Empty, error) {
+	return s.withHandle(ctx, "delete role", func(db *secure_sqlite.SecureSQLite) error {
+		return db.DeleteRole(req.Name)
+	})
+}
+
+// AddRoleMember makes a user a member of a role, for a time window if the
+// request gives one
+func (s *Server) AddRoleMember(ctx context.Context, req *securesqlitepb.RoleMemberRequest) (*emptypb.Empty, error) {
+	notBefore, err := optionalTime(req.NotBefore)
+	if err != nil {
+		return nil, statusError(requestError("invalid not_before", err))
+	}
+	notAfter, err := optionalTime(req.NotAfter)
+	if err != nil {
+		return nil, statusError(requestError("invalid not_after", err))
+	}
+	return s.withHandle(ctx, "add role member", func(db *secure_sqlite.SecureSQLite) error {
+		var before, after time.Time
+		if notBefore != nil {
+			before = *notBefore
+		}
+		if notAfter != nil {
+			after = *notAfter
+		}
+		return db.AssignRoleToUserBetween(req.User, req.Role, before, after)
+	})
+}
+
+// RemoveRoleMember removes a user from a role
+func (s *Server) RemoveRoleMember(ctx context.Context, req *securesqlitepb.RoleMemberRequest) (*emptypb.Empty, error) {
+	return s.withHandle(ctx, "remove role member", func(db *secure_sqlite.SecureSQLite) error {
+		return db.RemoveRoleFromUser(req.User, req.Role)
+	})
+}
+
+// Grant grants permissions on a table to a role or user
+func (s *Server) Grant(ctx context.Context, req *securesqlitepb.GrantRequest) (*emptypb.Empty, error) {
+	grant, err := grantPolicy(req.Grantee, req.Grant)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return s.withHandle(ctx, "grant", func(db *secure_sqlite.SecureSQLite) error {
+		return db.Grant(req.Grantee, grant)
+	})
+}
+
+// Revoke revokes permissions on a table from a role or user
+func (s *Server) Revoke(ctx context.Context, req *securesqlitepb.RevokeRequest) (*emptypb.Empty, error) {
+	grant, err := grantPolicy(req.Grantee, req.Grant)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	behavior := rbac.Cascade
+	if req.Restrict {
+		behavior = rbac.Restrict
+	}
+	return s.withHandle(ctx, "revoke", func(db *secure_sqlite.SecureSQLite) error {
+		return db.Revoke(req.Grantee, grant, behavior)
+	})
+}
+
+// GrantPrivilege grants a system privilege to a role or user
+func (s *Server) GrantPrivilege(ctx context.Context, req *securesqlitepb.PrivilegeRequest) (*emptypb.Empty, error) {
+	privilege, err := permissions.ParsePrivilege(req.Privilege)
+	if err != nil {
+		return nil, statusError(requestError("invalid privilege", err))
+	}
+	return s.withHandle(ctx, "grant privilege", func(db *secure_sqlite.SecureSQLite) error {
+		return db.GrantPrivilege(req.Grantee, privilege, req.Table, req.GrantOption)
+	})
+}
+
+// RevokePrivilege revokes a system privilege from a role or user
+func (s *Server) RevokePrivilege(ctx context.Context, req *securesqlitepb.PrivilegeRequest) (*emptypb.Empty, error) {
+	privilege, err := permissions.ParsePrivilege(req.Privilege)
+	if err != nil {
+		return nil, statusError(requestError("invalid privilege", err))
+	}
+	return s.withHandle(ctx, "revoke privilege", func(db *secure_sqlite.SecureSQLite) error {
+		return db.RevokePrivilege(req.Grantee, privilege, req.Table)
+	})
+}
+
+// grantPolicy converts the grant of a request to a policy grant
+func grantPolicy(grantee string, g *securesqlitepb.TableGrant) (rbac.GrantPolicy, error) {
+	if grantee == "" || g.GetTable() == "" {
+		return rbac.GrantPolicy{}, requestError("grantee and table are required", nil)
+	}
+	notBefore, err := optionalTime(g.NotBefore)
+	if err != nil {
+		return rbac.GrantPolicy{}, requestError("invalid not_before", err)
+	}
+	notAfter, err := optionalTime(g.NotAfter)
+	if err != nil {
+		return rbac.GrantPolicy{}, requestError("invalid not_after", err)
+	}
+	return rbac.GrantPolicy{
+		Table:       g.Table,
+		Actions:     g.Actions,
+		Columns:     g.Columns,
+		Row:         g.Row,
+		GrantOption: g.GrantOption,
+		NotBefore:   notBefore,
+		NotAfter:    notAfter,
+	}, nil
+}
+
+// optionalTime converts an optional timestamp
+func optionalTime(ts *timestamppb.Timestamp) (*time.Time, error) {
+	if ts == nil {
+		return nil, nil
+	}
+	if err := ts.CheckValid(); err != nil {
+		return nil, err
+	}
+	t := ts.AsTime()
+	return &t, nil
+}
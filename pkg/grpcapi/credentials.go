@@ -0,0 +1,29 @@
+package grpcapi
+
+import (
+	"context"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// TokenCredentials are the per-call credentials of a user, for use with
+// grpc.WithPerRPCCredentials. They are only sent over secure transports
+// unless AllowInsecure is set.
+type TokenCredentials struct {
+	Username      string
+	Token         string
+	AllowInsecure bool
+}
+
+var _ credentials.PerRPCCredentials = TokenCredentials{}
+
+// GetRequestMetadata returns the authorization metadata of a call
+func (c TokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + c.Username + ":" + c.Token}, nil
+}
+
+// RequireTransportSecurity reports whether the credentials need a secure
+// transport
+func (c TokenCredentials) RequireTransportSecurity() bool {
+	return !c.AllowInsecure
+}
@@ -0,0 +1,82 @@
+package grpcapi
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/secure_sqlite"
+)
+
+// ErrorDomain is the domain of the ErrorInfo details of errors
+const ErrorDomain = "secure_sqlite"
+
+// statusCodes maps the codes of database errors to gRPC status codes
+var statusCodes = map[string]codes.Code{
+	"REQUEST_ERROR":            codes.InvalidArgument,
+	"AUTH_ERROR":               codes.Unauthenticated,
+	"PERMISSION_DENIED":        codes.PermissionDenied,
+	"ELEVATION_EXPIRED":        codes.PermissionDenied,
+	"PARSE_ERROR":              codes.InvalidArgument,
+	"UNSUPPORTED_QUERY":        codes.InvalidArgument,
+	"QUERY_ERROR":              codes.InvalidArgument,
+	"MASKING_ERROR":            codes.InvalidArgument,
+	"ENCRYPTION_UNSUPPORTED":   codes.Unimplemented,
+	"ACCESS_CONTROL_ERROR":     codes.FailedPrecondition,
+	"TRANSACTION_ERROR":        codes.FailedPrecondition,
+	"ACCESS_REQUEST_NOT_FOUND": codes.NotFound,
+	"TRANSACTION_NOT_FOUND":    codes.NotFound,
+	"CONNECTION_ERROR":         codes.Unavailable,
+}
+
+// statusError returns the gRPC status of an error. Database errors carry an
+// ErrorInfo detail whose reason is their code, with their message and the
+// error they wrap as metadata.
+func statusError(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	var dbErr *secure_sqlite.DBError
+	if !errors.As(err, &dbErr) {
+		switch {
+		case errors.Is(err, context.Canceled):
+			return status.Error(codes.Canceled, err.Error())
+		case errors.Is(err, context.DeadlineExceeded):
+			return status.Error(codes.DeadlineExceeded, err.Error())
+		case errors.Is(err, sql.ErrTxDone):
+			return status.Error(codes.FailedPrecondition, err.Error())
+		}
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	code, ok := statusCodes[dbErr.Code]
+	if !ok {
+		code = codes.Internal
+	}
+	info := &errdetails.ErrorInfo{
+		Reason:   dbErr.Code,
+		Domain:   ErrorDomain,
+		Metadata: map[string]string{"message": dbErr.Message},
+	}
+	if dbErr.Err != nil {
+		info.Metadata["detail"] = dbErr.Err.Error()
+	}
+	st, detailErr := status.New(code, dbErr.Error()).WithDetails(info)
+	if detailErr != nil {
+		return status.Error(code, dbErr.Error())
+	}
+	return st.Err()
+}
+
+// requestError reports a request that cannot be served as sent
+func requestError(message string, err error) error {
+	return &secure_sqlite.DBError{
+		Code:    "REQUEST_ERROR",
+		Message: message,
+		Err:     err,
+	}
+}
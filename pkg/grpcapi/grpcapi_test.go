@@ -0,0 +1,306 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/wemcdonald/secure_sqlite/pkg/grpcapi/securesqlitepb"
+	"github.com/wemcdonald/secure_sqlite/pkg/internal/servertest"
+)
+
+// startServer serves the servertest database. It returns a function that
+// connects as a user.
+func startServer(t *testing.T, opts ...Option) func(username, token string) pb.SecureSQLiteClient {
+	t.Helper()
+	path, mockAuth := servertest.Database(t)
+	server := NewServer(path, mockAuth, opts...)
+	g := grpc.NewServer()
+	pb.RegisterSecureSQLiteServer(g, server)
+	ln := bufconn.Listen(1 << 20)
+	go g.Serve(ln)
+	t.Cleanup(func() {
+		g.Stop()
+		server.Close()
+	})
+
+	return func(username, token string) pb.SecureSQLiteClient {
+		conn, err := grpc.NewClient("passthrough:///bufnet",
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				return ln.DialContext(ctx)
+			}),
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithPerRPCCredentials(TokenCredentials{Username: username, Token: token, AllowInsecure: true}),
+		)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return pb.NewSecureSQLiteClient(conn)
+	}
+}
+
+// query runs a query and collects its columns and rows
+func query(ctx context.Context, client pb.SecureSQLiteClient, req *pb.QueryRequest) ([]*pb.Column, [][]*pb.Value, error) {
+	stream, err := client.Query(ctx, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	var columns []*pb.Column
+	var rows [][]*pb.Value
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return columns, rows, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp.Columns != nil {
+			columns = resp.Columns
+		}
+		for _, row := range resp.Rows {
+			rows = append(rows, row.Values)
+		}
+	}
+}
+
+// errorReason returns the reason of the ErrorInfo detail of an error
+func errorReason(err error) string {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok && info.Domain == ErrorDomain {
+			return info.Reason
+		}
+	}
+	return ""
+}
+
+func text(s string) *pb.Value {
+	return &pb.Value{Kind: &pb.Value_TextValue{TextValue: s}}
+}
+
+func integer(n int64) *pb.Value {
+	return &pb.Value{Kind: &pb.Value_IntegerValue{IntegerValue: n}}
+}
+
+func TestQuery(t *testing.T) {
+	connect := startServer(t)
+	ctx := context.Background()
+	clerk := connect("clerk", "clerktoken")
+
+	// Calls need valid credentials
+	_, err := connect("clerk", "wrong").Exec(ctx, &pb.ExecRequest{Sql: "DELETE FROM orders"})
+	if status.Code(err) != codes.Unauthenticated || errorReason(err) != "AUTH_ERROR" {
+		t.Errorf("Expected Unauthenticated with AUTH_ERROR, got %v", err)
+	}
+
+	// Statements take positional and named parameters
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var resp *pb.ExecResponse
+	for i, req := range []*pb.ExecRequest{
+		{Sql: "INSERT INTO orders (item, qty) VALUES (?, ?)", Params: []*pb.Parameter{{Value: text("book")}, {Value: integer(1)}}},
+		{Sql: "INSERT INTO orders (item, qty) VALUES (:item, :qty)", Params: []*pb.Parameter{{Name: "item", Value: text("pen")}, {Name: ":qty", Value: integer(2)}}},
+		{Sql: "INSERT INTO orders (item, created) VALUES (?, ?)", Params: []*pb.Parameter{{Value: text("lamp")}, {Value: &pb.Value{Kind: &pb.Value_TimestampValue{TimestampValue: timestamppb.New(created)}}}}},
+	} {
+		if resp, err = clerk.Exec(ctx, req); err != nil {
+			t.Fatalf("Insert %d failed: %v", i, err)
+		}
+	}
+	if resp.RowsAffected != 1 || resp.LastInsertId != 3 {
+		t.Errorf("Expected 1 row affected with ID 3, got %v", resp)
+	}
+
+	// Queries stream typed columns and rows
+	for i := 0; i < batchSize; i++ {
+		if _, err := clerk.Exec(ctx, &pb.ExecRequest{Sql: "INSERT INTO orders (item) VALUES ('filler')"}); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	columns, rows, err := query(ctx, clerk, &pb.QueryRequest{Sql: "SELECT id, item, qty, created FROM orders ORDER BY id"})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if len(rows) != batchSize+3 {
+		t.Errorf("Expected %d rows, got %d", batchSize+3, len(rows))
+	}
+	wantAffinity := []pb.Affinity{pb.Affinity_AFFINITY_INTEGER, pb.Affinity_AFFINITY_TEXT, pb.Affinity_AFFINITY_INTEGER, pb.Affinity_AFFINITY_NUMERIC}
+	if len(columns) != len(wantAffinity) {
+		t.Fatalf("Expected %d columns, got %v", len(wantAffinity), columns)
+	}
+	for i, column := range columns {
+		if column.Affinity != wantAffinity[i] {
+			t.Errorf("Expected column %s to have affinity %v, got %v", column.Name, wantAffinity[i], column.Affinity)
+		}
+	}
+	if rows[1][1].GetTextValue() != "pen" || rows[1][2].GetIntegerValue() != 2 {
+		t.Errorf("Expected pen with quantity 2, got %v", rows[1])
+	}
+	if _, ok := rows[2][2].GetKind().(*pb.Value_NullValue); !ok {
+		t.Errorf("Expected NULL quantity, got %v", rows[2][2])
+	}
+	if got := rows[2][3].GetTimestampValue(); got == nil || !got.AsTime().Equal(created) {
+		t.Errorf("Expected timestamp %v, got %v", created, rows[2][3])
+	}
+
+	// Queries without rows still describe their columns
+	columns, rows, err = query(ctx, clerk, &pb.QueryRequest{Sql: "SELECT item FROM orders WHERE id < 0"})
+	if err != nil || len(columns) != 1 || len(rows) != 0 {
+		t.Errorf("Expected one column and no rows, got %v %v %v", columns, rows, err)
+	}
+
+	// Denials carry their reason
+	_, _, err = query(ctx, clerk, &pb.QueryRequest{Sql: "SELECT value FROM secrets"})
+	if status.Code(err) != codes.PermissionDenied || errorReason(err) != "PERMISSION_DENIED" {
+		t.Errorf("Expected PermissionDenied with PERMISSION_DENIED, got %v", err)
+	}
+	_, _, err = query(ctx, clerk, &pb.QueryRequest{Sql: "SELECT item FROM orders WHERE"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument, got %v", err)
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	connect := startServer(t)
+	ctx := context.Background()
+	clerk := connect("clerk", "clerktoken")
+	other := connect("other", "othertoken")
+
+	count := func() int {
+		_, rows, err := query(ctx, other, &pb.QueryRequest{Sql: "SELECT id FROM orders"})
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		return len(rows)
+	}
+
+	// Statements of a transaction are only visible once it commits
+	begin, err := clerk.BeginTransaction(ctx, &pb.BeginTransactionRequest{})
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	id := begin.TransactionId
+	if _, err := clerk.Exec(ctx, &pb.ExecRequest{Sql: "INSERT INTO orders (item) VALUES ('book')", TransactionId: id}); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if _, rows, err := query(ctx, clerk, &pb.QueryRequest{Sql: "SELECT item FROM orders", TransactionId: id}); err != nil || len(rows) != 1 {
+		t.Errorf("Expected the transaction to see its row, got %d rows, %v", len(rows), err)
+	}
+
+	// Only the user of a transaction may use it
+	_, err = other.Exec(ctx, &pb.ExecRequest{Sql: "DELETE FROM orders", TransactionId: id})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied for another user, got %v", err)
+	}
+	if _, err := other.CommitTransaction(ctx, &pb.TransactionRequest{TransactionId: id}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied for another user, got %v", err)
+	}
+
+	if _, err := clerk.CommitTransaction(ctx, &pb.TransactionRequest{TransactionId: id}); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if n := count(); n != 1 {
+		t.Errorf("Expected 1 committed row, got %d", n)
+	}
+	if _, err := clerk.CommitTransaction(ctx, &pb.TransactionRequest{TransactionId: id}); status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound for an ended transaction, got %v", err)
+	}
+
+	// Rolled back statements leave no trace
+	begin, _ = clerk.BeginTransaction(ctx, &pb.BeginTransactionRequest{})
+	clerk.Exec(ctx, &pb.ExecRequest{Sql: "INSERT INTO orders (item) VALUES ('pen')", TransactionId: begin.TransactionId})
+	if _, err := clerk.RollbackTransaction(ctx, &pb.TransactionRequest{TransactionId: begin.TransactionId}); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+	if n := count(); n != 1 {
+		t.Errorf("Expected rolled back row to be gone, got %d rows", n)
+	}
+}
+
+func TestTransactionTimeout(t *testing.T) {
+	connect := startServer(t, WithTransactionTimeout(50*time.Millisecond))
+	ctx := context.Background()
+	clerk := connect("clerk", "clerktoken")
+
+	begin, err := clerk.BeginTransaction(ctx, &pb.BeginTransactionRequest{})
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	clerk.Exec(ctx, &pb.ExecRequest{Sql: "INSERT INTO orders (item) VALUES ('book')", TransactionId: begin.TransactionId})
+	time.Sleep(200 * time.Millisecond)
+	if _, err := clerk.CommitTransaction(ctx, &pb.TransactionRequest{TransactionId: begin.TransactionId}); status.Code(err) != codes.NotFound {
+		t.Errorf("Expected idle transaction to be rolled back, got %v", err)
+	}
+	if _, rows, err := query(ctx, clerk, &pb.QueryRequest{Sql: "SELECT id FROM orders"}); err != nil || len(rows) != 0 {
+		t.Errorf("Expected no rows, got %d rows, %v", len(rows), err)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	connect := startServer(t)
+	ctx := context.Background()
+	admin := connect("admin", "admintoken")
+	clerk := connect("clerk", "clerktoken")
+
+	// Access control changes are checked against the privileges of the user
+	if _, err := clerk.CreateRole(ctx, &pb.RoleRequest{Name: "analyst"}); status.Code(err) != codes.PermissionDenied || errorReason(err) != "PERMISSION_DENIED" {
+		t.Errorf("Expected PermissionDenied for clerk, got %v", err)
+	}
+	if _, err := clerk.ListRoles(ctx, &emptypb.Empty{}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied for clerk, got %v", err)
+	}
+	if _, err := admin.CreateRole(ctx, &pb.RoleRequest{Name: "analyst"}); err != nil {
+		t.Fatalf("CreateRole failed: %v", err)
+	}
+	if _, err := admin.AddRoleMember(ctx, &pb.RoleMemberRequest{Role: "analyst", User: "clerk"}); err != nil {
+		t.Fatalf("AddRoleMember failed: %v", err)
+	}
+	grant := &pb.TableGrant{Table: "secrets", Actions: []string{"select"}}
+	if _, err := admin.Grant(ctx, &pb.GrantRequest{Grantee: "analyst", Grant: grant}); err != nil {
+		t.Fatalf("Grant failed: %v", err)
+	}
+
+	roles, err := admin.ListRoles(ctx, &emptypb.Empty{})
+	if err != nil {
+		t.Fatalf("ListRoles failed: %v", err)
+	}
+	if len(roles.Roles) != 1 || roles.Roles[0].Name != "analyst" || len(roles.Roles[0].Members) != 1 || roles.Roles[0].Members[0] != "clerk" {
+		t.Errorf("Expected analyst with member clerk, got %v", roles.Roles)
+	}
+
+	// Members of the role receive its grants
+	if _, _, err := query(ctx, clerk, &pb.QueryRequest{Sql: "SELECT value FROM secrets"}); err != nil {
+		t.Errorf("Expected granted query to succeed, got %v", err)
+	}
+	if _, err := admin.Revoke(ctx, &pb.RevokeRequest{Grantee: "analyst", Grant: grant}); err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+	if _, _, err := query(ctx, clerk, &pb.QueryRequest{Sql: "SELECT value FROM secrets"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected revoked query to be denied, got %v", err)
+	}
+
+	// System privileges are granted by name
+	if _, err := admin.GrantPrivilege(ctx, &pb.PrivilegeRequest{Grantee: "clerk", Privilege: "manage_roles"}); err != nil {
+		t.Fatalf("GrantPrivilege failed: %v", err)
+	}
+	if _, err := clerk.ListRoles(ctx, &emptypb.Empty{}); err != nil {
+		t.Errorf("Expected clerk to list roles, got %v", err)
+	}
+	if _, err := admin.GrantPrivilege(ctx, &pb.PrivilegeRequest{Grantee: "clerk", Privilege: "bogus"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for unknown privilege, got %v", err)
+	}
+	if _, err := admin.DeleteRole(ctx, &pb.RoleRequest{Name: "missing"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Expected FailedPrecondition for a missing role, got %v", err)
+	}
+}
@@ -0,0 +1,5 @@
+// Package securesqlitepb holds the protocol buffer messages and gRPC service
+// of secure databases, generated from securesqlite.proto.
+package securesqlitepb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative securesqlite.proto
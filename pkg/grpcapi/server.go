@@ -0,0 +1,407 @@
+// Package grpcapi serves secure databases over gRPC, with the SecureSQLite
+// service of the securesqlitepb package. Every call carries the credentials
+// of a user in its authorization metadata, as a bearer token of the form
+// user:token, and its statements run through the checks of that user:
+//
+//	server := grpcapi.NewServer("app.db", authProvider)
+//	defer server.Close()
+//	g := grpc.NewServer()
+//	securesqlitepb.RegisterSecureSQLiteServer(g, server)
+//
+// Clients pass TokenCredentials with grpc.WithPerRPCCredentials.
+package grpcapi
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/auth"
+	"github.com/wemcdonald/secure_sqlite/pkg/grpcapi/securesqlitepb"
+	"github.com/wemcdonald/secure_sqlite/pkg/secure_sqlite"
+)
+
+const (
+	// defaultTransactionTimeout is the time a transaction may stay idle before
+	// it is rolled back
+	defaultTransactionTimeout = 5 * time.Minute
+	// batchSize is the number of rows of each query response
+	batchSize = 64
+)
+
+// options configures a server
+type options struct {
+	handleOpts []secure_sqlite.Option
+	txTimeout  time.Duration
+}
+
+// Option configures a server
+type Option func(o *options)
+
+// WithHandleOptions applies options to the handles of every user
+func WithHandleOptions(opts ...secure_sqlite.Option) Option {
+	return func(o *options) {
+		o.handleOpts = append(o.handleOpts, opts...)
+	}
+}
+
+// WithTransactionTimeout rolls back transactions that no call uses for a
+// duration, five minutes by default. Zero keeps them open until they end.
+func WithTransactionTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.txTimeout = d
+	}
+}
+
+// Server implements the SecureSQLite service for a database
+type Server struct {
+	securesqlitepb.UnimplementedSecureSQLiteServer
+
+	dsn          string
+	authProvider auth.Provider
+	opts         options
+	// db runs the statements of every user, which name their user in the
+	// context of the statement
+	db *sql.DB
+
+	mu  sync.Mutex
+	txs map[string]*transaction
+}
+
+// transaction is an open transaction, which only its user may use
+type transaction struct {
+	mu     sync.Mutex
+	caller caller
+	tx     *sql.Tx
+	cancel context.CancelFunc
+	timer  *time.Timer
+}
+
+// caller is the user of a call
+type caller struct {
+	username string
+	token    string
+}
+
+// NewServer returns the service of a database whose clients authenticate as
+// users of an auth provider
+func NewServer(dataSourceName string, authProvider auth.Provider, opts ...Option) *Server {
+	s := &Server{
+		dsn:          dataSourceName,
+		authProvider: authProvider,
+		opts:         options{txTimeout: defaultTransactionTimeout},
+		txs:          make(map[string]*transaction),
+	}
+	for _, opt := range opts {
+		opt(&s.opts)
+	}
+	s.db = sql.OpenDB(secure_sqlite.NewConnector(dataSourceName, authProvider, "", "", s.opts.handleOpts...))
+	return s
+}
+
+// Close rolls back the open transactions and closes the connections of the
+// server
+func (s *Server) Close() error {
+	s.mu.Lock()
+	txs := s.txs
+	s.txs = make(map[string]*transaction)
+	s.mu.Unlock()
+	for _, t := range txs {
+		t.end(false)
+	}
+	return s.db.Close()
+}
+
+// authenticate returns the caller of a call and a context whose statements
+// run as the caller
+func (s *Server) authenticate(ctx context.Context) (context.Context, caller, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		if c, ok := bearerToken(value); ok {
+			return secure_sqlite.WithPrincipal(ctx, c.username, c.token), c, nil
+		}
+	}
+	return nil, caller{}, &secure_sqlite.DBError{
+		Code:    "AUTH_ERROR",
+		Message: "missing bearer token",
+	}
+}
+
+// bearerToken parses an authorization value, whose bearer token has the form
+// user:token
+func bearerToken(value string) (caller, bool) {
+	scheme, credentials, ok := strings.Cut(value, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return caller{}, false
+	}
+	username, token, ok := strings.Cut(strings.TrimSpace(credentials), ":")
+	if !ok || username == "" {
+		return caller{}, false
+	}
+	return caller{username: username, token: token}, true
+}
+
+// Query runs a query and streams its rows in batches
+func (s *Server) Query(req *securesqlitepb.QueryRequest, stream securesqlitepb.SecureSQLite_QueryServer) error {
+	ctx, c, err := s.authenticate(stream.Context())
+	if err != nil {
+		return statusError(err)
+	}
+	args, err := arguments(req.Params)
+	if err != nil {
+		return statusError(err)
+	}
+
+	var rows *sql.Rows
+	if req.TransactionId != "" {
+		t, err := s.acquire(req.TransactionId, c)
+		if err != nil {
+			return statusError(err)
+		}
+		defer s.release(t)
+		rows, err = t.tx.QueryContext(ctx, req.Sql, args...)
+		if err != nil {
+			return statusError(err)
+		}
+	} else {
+		rows, err = s.db.QueryContext(ctx, req.Sql, args...)
+		if err != nil {
+			return statusError(err)
+		}
+	}
+	if err := sendRows(rows, stream); err != nil {
+		return statusError(err)
+	}
+	return nil
+}
+
+// sendRows streams the rows of a query and closes them. The first response
+// carries the columns, even if there are no rows.
+func sendRows(rows *sql.Rows, stream securesqlitepb.SecureSQLite_QueryServer) error {
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		rows.Close()
+		return err
+	}
+	values := make([]interface{}, len(types))
+	pointers := make([]interface{}, len(values))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
+	resp := &securesqlitepb.QueryResponse{Columns: columns(types)}
+	sent := false
+	for rows.Next() {
+		if err = rows.Scan(pointers...); err != nil {
+			break
+		}
+		resp.Rows = append(resp.Rows, row(values))
+		if len(resp.Rows) == batchSize {
+			if err = stream.Send(resp); err != nil {
+				break
+			}
+			resp, sent = &securesqlitepb.QueryResponse{}, true
+		}
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	if closeErr := rows.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if !sent || len(resp.Rows) > 0 {
+		return stream.Send(resp)
+	}
+	return nil
+}
+
+// Exec runs a statement
+func (s *Server) Exec(ctx context.Context, req *securesqlitepb.ExecRequest) (*securesqlitepb.ExecResponse, error) {
+	ctx, c, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	args, err := arguments(req.Params)
+	if err != nil {
+		return nil, statusError(err)
+	}
+
+	var result sql.Result
+	if req.TransactionId != "" {
+		t, err := s.acquire(req.TransactionId, c)
+		if err != nil {
+			return nil, statusError(err)
+		}
+		defer s.release(t)
+		result, err = t.tx.ExecContext(ctx, req.Sql, args...)
+		if err != nil {
+			return nil, statusError(err)
+		}
+	} else {
+		result, err = s.db.ExecContext(ctx, req.Sql, args...)
+		if err != nil {
+			return nil, statusError(err)
+		}
+	}
+	resp := &securesqlitepb.ExecResponse{}
+	resp.RowsAffected, _ = result.RowsAffected()
+	resp.LastInsertId, _ = result.LastInsertId()
+	return resp, nil
+}
+
+// BeginTransaction starts a transaction of the caller
+func (s *Server) BeginTransaction(ctx context.Context, req *securesqlitepb.BeginTransactionRequest) (*securesqlitepb.BeginTransactionResponse, error) {
+	_, c, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, statusError(err)
+	}
+
+	// The transaction outlives the call, so it gets a context of its own
+	txCtx, cancel := context.WithCancel(secure_sqlite.WithPrincipal(context.Background(), c.username, c.token))
+	tx, err := s.db.BeginTx(txCtx, &sql.TxOptions{ReadOnly: req.ReadOnly})
+	if err != nil {
+		cancel()
+		return nil, statusError(err)
+	}
+	id, err := newTransactionID()
+	if err != nil {
+		tx.Rollback()
+		cancel()
+		return nil, statusError(err)
+	}
+
+	t := &transaction{caller: c, tx: tx, cancel: cancel}
+	if s.opts.txTimeout > 0 {
+		t.timer = time.AfterFunc(s.opts.txTimeout, func() {
+			if t, ok := s.take(id); ok {
+				t.end(false)
+			}
+		})
+	}
+	s.mu.Lock()
+	s.txs[id] = t
+	s.mu.Unlock()
+	return &securesqlitepb.BeginTransactionResponse{TransactionId: id}, nil
+}
+
+// CommitTransaction commits a transaction of the caller
+func (s *Server) CommitTransaction(ctx context.Context, req *securesqlitepb.TransactionRequest) (*emptypb.Empty, error) {
+	return s.endTransaction(ctx, req.TransactionId, true)
+}
+
+// RollbackTransaction rolls back a transaction of the caller
+func (s *Server) RollbackTransaction(ctx context.Context, req *securesqlitepb.TransactionRequest) (*emptypb.Empty, error) {
+	return s.endTransaction(ctx, req.TransactionId, false)
+}
+
+// endTransaction commits or rolls back a transaction of the caller
+func (s *Server) endTransaction(ctx context.Context, id string, commit bool) (*emptypb.Empty, error) {
+	_, c, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	if _, err := s.lookup(id, c); err != nil {
+		return nil, statusError(err)
+	}
+	t, ok := s.take(id)
+	if !ok {
+		return nil, statusError(transactionNotFound(id))
+	}
+	if err := t.end(commit); err != nil {
+		return nil, statusError(&secure_sqlite.DBError{
+			Code:    "TRANSACTION_ERROR",
+			Message: "failed to end transaction",
+			Err:     err,
+		})
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// newTransactionID returns a random transaction ID
+func newTransactionID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// transactionNotFound reports a transaction that is not open
+func transactionNotFound(id string) error {
+	return &secure_sqlite.DBError{
+		Code:    "TRANSACTION_NOT_FOUND",
+		Message: "transaction " + id + " not found",
+	}
+}
+
+// lookup returns an open transaction of the caller
+func (s *Server) lookup(id string, c caller) (*transaction, error) {
+	s.mu.Lock()
+	t, ok := s.txs[id]
+	s.mu.Unlock()
+	if !ok {
+		return nil, transactionNotFound(id)
+	}
+	if t.caller != c {
+		return nil, &secure_sqlite.DBError{
+			Code:    "PERMISSION_DENIED",
+			Message: "transaction belongs to another user",
+		}
+	}
+	return t, nil
+}
+
+// acquire locks an open transaction of the caller for a statement, holding
+// off its timeout until release
+func (s *Server) acquire(id string, c caller) (*transaction, error) {
+	t, err := s.lookup(id, c)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	return t, nil
+}
+
+// release unlocks a transaction after a statement and restarts its timeout
+func (s *Server) release(t *transaction) {
+	if t.timer != nil {
+		t.timer.Reset(s.opts.txTimeout)
+	}
+	t.mu.Unlock()
+}
+
+// take removes a transaction from the open ones
+func (s *Server) take(id string) (*transaction, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.txs[id]
+	delete(s.txs, id)
+	return t, ok
+}
+
+// end commits or rolls back a transaction once its statements finish
+func (t *transaction) end(commit bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	defer t.cancel()
+	if commit {
+		return t.tx.Commit()
+	}
+	return t.tx.Rollback()
+}
@@ -0,0 +1,118 @@
+package grpcapi
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/grpcapi/securesqlitepb"
+)
+
+// arguments converts the parameters of a request to statement arguments
+func arguments(params []*securesqlitepb.Parameter) ([]interface{}, error) {
+	args := make([]interface{}, len(params))
+	for i, param := range params {
+		value, err := fromValue(param.Value)
+		if err != nil {
+			return nil, requestError(fmt.Sprintf("invalid parameter %d", i+1), err)
+		}
+		if param.Name != "" {
+			// Names may carry the prefix of their placeholder
+			args[i] = sql.Named(strings.TrimLeft(param.Name, ":@$"), value)
+		} else {
+			args[i] = value
+		}
+	}
+	return args, nil
+}
+
+// fromValue converts a value of a request to a Go value
+func fromValue(v *securesqlitepb.Value) (interface{}, error) {
+	switch kind := v.GetKind().(type) {
+	case nil, *securesqlitepb.Value_NullValue:
+		return nil, nil
+	case *securesqlitepb.Value_IntegerValue:
+		return kind.IntegerValue, nil
+	case *securesqlitepb.Value_RealValue:
+		return kind.RealValue, nil
+	case *securesqlitepb.Value_TextValue:
+		return kind.TextValue, nil
+	case *securesqlitepb.Value_BlobValue:
+		return kind.BlobValue, nil
+	case *securesqlitepb.Value_BoolValue:
+		return kind.BoolValue, nil
+	case *securesqlitepb.Value_TimestampValue:
+		if err := kind.TimestampValue.CheckValid(); err != nil {
+			return nil, err
+		}
+		return kind.TimestampValue.AsTime(), nil
+	}
+	return nil, fmt.Errorf("unsupported value %T", v.GetKind())
+}
+
+// toValue converts a value scanned from a row
+func toValue(value interface{}) *securesqlitepb.Value {
+	switch v := value.(type) {
+	case nil:
+		return &securesqlitepb.Value{Kind: &securesqlitepb.Value_NullValue{NullValue: structpb.NullValue_NULL_VALUE}}
+	case int64:
+		return &securesqlitepb.Value{Kind: &securesqlitepb.Value_IntegerValue{IntegerValue: v}}
+	case float64:
+		return &securesqlitepb.Value{Kind: &securesqlitepb.Value_RealValue{RealValue: v}}
+	case string:
+		return &securesqlitepb.Value{Kind: &securesqlitepb.Value_TextValue{TextValue: v}}
+	case []byte:
+		return &securesqlitepb.Value{Kind: &securesqlitepb.Value_BlobValue{BlobValue: v}}
+	case bool:
+		return &securesqlitepb.Value{Kind: &securesqlitepb.Value_BoolValue{BoolValue: v}}
+	case time.Time:
+		return &securesqlitepb.Value{Kind: &securesqlitepb.Value_TimestampValue{TimestampValue: timestamppb.New(v)}}
+	}
+	return &securesqlitepb.Value{Kind: &securesqlitepb.Value_TextValue{TextValue: fmt.Sprint(value)}}
+}
+
+// row converts the values of a row
+func row(values []interface{}) *securesqlitepb.Row {
+	r := &securesqlitepb.Row{Values: make([]*securesqlitepb.Value, len(values))}
+	for i, value := range values {
+		r.Values[i] = toValue(value)
+	}
+	return r
+}
+
+// columns describes the columns of a query result
+func columns(types []*sql.ColumnType) []*securesqlitepb.Column {
+	cols := make([]*securesqlitepb.Column, len(types))
+	for i, t := range types {
+		cols[i] = &securesqlitepb.Column{
+			Name:         t.Name(),
+			DeclaredType: t.DatabaseTypeName(),
+			Affinity:     affinity(t.DatabaseTypeName()),
+		}
+	}
+	return cols
+}
+
+// affinity returns the affinity of a declared column type, following the
+// rules of SQLite. Columns without a declared type, such as expressions, have
+// no affinity.
+func affinity(declared string) securesqlitepb.Affinity {
+	declared = strings.ToUpper(declared)
+	switch {
+	case declared == "":
+		return securesqlitepb.Affinity_AFFINITY_UNSPECIFIED
+	case strings.Contains(declared, "INT"):
+		return securesqlitepb.Affinity_AFFINITY_INTEGER
+	case strings.Contains(declared, "CHAR"), strings.Contains(declared, "CLOB"), strings.Contains(declared, "TEXT"):
+		return securesqlitepb.Affinity_AFFINITY_TEXT
+	case strings.Contains(declared, "BLOB"):
+		return securesqlitepb.Affinity_AFFINITY_BLOB
+	case strings.Contains(declared, "REAL"), strings.Contains(declared, "FLOA"), strings.Contains(declared, "DOUB"):
+		return securesqlitepb.Affinity_AFFINITY_REAL
+	}
+	return securesqlitepb.Affinity_AFFINITY_NUMERIC
+}
@@ -0,0 +1,190 @@
+package httpapi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/rbac"
+	"github.com/wemcdonald/secure_sqlite/pkg/secure_sqlite"
+)
+
+// role is the JSON form of a role
+type role struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+// roleRequest is the body of role creation requests
+type roleRequest struct {
+	Name string `json:"name"`
+}
+
+// membershipRequest is the optional body of role membership requests, which
+// bounds the time the membership is valid
+type membershipRequest struct {
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	NotAfter  *time.Time `json:"not_after,omitempty"`
+}
+
+// grantRequest is the body of grant and revoke requests. Restrict refuses a
+// revoke that other grants depend on, instead of revoking them as well.
+type grantRequest struct {
+	Grantee string `json:"grantee"`
+	rbac.GrantPolicy
+	Restrict bool `json:"restrict,omitempty"`
+}
+
+// adminError reports an error of an access control change
+func adminError(operation string, err error) error {
+	var dbErr *secure_sqlite.DBError
+	if errors.As(err, &dbErr) {
+		return err
+	}
+	if errors.Is(err, rbac.ErrInsufficientPrivilege) {
+		return &secure_sqlite.DBError{
+			Code:    "PERMISSION_DENIED",
+			Message: "insufficient privilege",
+			Err:     err,
+		}
+	}
+	return &secure_sqlite.DBError{
+		Code:    "ACCESS_CONTROL_ERROR",
+		Message: fmt.Sprintf("failed to %s", operation),
+		Err:     err,
+	}
+}
+
+// listRoles lists the roles and their members. It requires the privilege to
+// manage roles.
+func (s *Server) listRoles(w http.ResponseWriter, r *http.Request, db *secure_sqlite.SecureSQLite) {
+	names, err := db.ListRoles()
+	if err != nil {
+		writeError(w, adminError("list roles", err))
+		return
+	}
+	roles := make([]role, 0, len(names))
+	for _, name := range names {
+		members, err := db.RoleMembers(name)
+		if err != nil {
+			writeError(w, adminError("list roles", err))
+			return
+		}
+		if members == nil {
+			members = []string{}
+		}
+		roles = append(roles, role{Name: name, Members: members})
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Roles []role `json:"roles"`
+	}{roles})
+}
+
+// createRole creates a role
+func (s *Server) createRole(w http.ResponseWriter, r *http.Request, db *secure_sqlite.SecureSQLite) {
+	var req roleRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if req.Name == "" {
+		writeError(w, requestError("name is required", nil))
+		return
+	}
+	if _, err := db.CreateRole(req.Name); err != nil {
+		writeError(w, adminError("create role", err))
+		return
+	}
+	writeJSON(w, http.StatusCreated, role{Name: req.Name, Members: []string{}})
+}
+
+// deleteRole deletes a role
+func (s *Server) deleteRole(w http.ResponseWriter, r *http.Request, db *secure_sqlite.SecureSQLite) {
+	if err := db.DeleteRole(r.PathValue("role")); err != nil {
+		writeError(w, adminError("delete role", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// addMember makes a user a member of a role, for a time window if the body
+// gives one
+func (s *Server) addMember(w http.ResponseWriter, r *http.Request, db *secure_sqlite.SecureSQLite) {
+	var req membershipRequest
+	if r.ContentLength != 0 {
+		if err := decodeJSON(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	var notBefore, notAfter time.Time
+	if req.NotBefore != nil {
+		notBefore = *req.NotBefore
+	}
+	if req.NotAfter != nil {
+		notAfter = *req.NotAfter
+	}
+	if err := db.AssignRoleToUserBetween(r.PathValue("user"), r.PathValue("role"), notBefore, notAfter); err != nil {
+		writeError(w, adminError("add role member", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeMember removes a user from a role
+func (s *Server) removeMember(w http.ResponseWriter, r *http.Request, db *secure_sqlite.SecureSQLite) {
+	if err := db.RemoveRoleFromUser(r.PathValue("user"), r.PathValue("role")); err != nil {
+		writeError(w, adminError("remove role member", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeGrant decodes the body of a grant or revoke request
+func decodeGrant(r *http.Request) (*grantRequest, error) {
+	var req grantRequest
+	if err := decodeJSON(r, &req); err != nil {
+		return nil, err
+	}
+	if req.Grantee == "" || req.Table == "" {
+		return nil, requestError("grantee and table are required", nil)
+	}
+	return &req, nil
+}
+
+// grant grants permissions on a table to a role or user
+func (s *Server) grant(w http.ResponseWriter, r *http.Request, db *secure_sqlite.SecureSQLite) {
+	req, err := decodeGrant(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if req.Restrict {
+		writeError(w, requestError("restrict applies to revokes only", nil))
+		return
+	}
+	if err := db.Grant(req.Grantee, req.GrantPolicy); err != nil {
+		writeError(w, adminError("grant", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revoke revokes permissions on a table from a role or user
+func (s *Server) revoke(w http.ResponseWriter, r *http.Request, db *secure_sqlite.SecureSQLite) {
+	req, err := decodeGrant(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	behavior := rbac.Cascade
+	if req.Restrict {
+		behavior = rbac.Restrict
+	}
+	if err := db.Revoke(req.Grantee, req.GrantPolicy, behavior); err != nil {
+		writeError(w, adminError("revoke", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
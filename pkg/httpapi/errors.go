@@ -0,0 +1,77 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/secure_sqlite"
+)
+
+// statusCodes maps the codes of database errors to HTTP status codes
+var statusCodes = map[string]int{
+	"REQUEST_ERROR":            http.StatusBadRequest,
+	"AUTH_ERROR":               http.StatusUnauthorized,
+	"PERMISSION_DENIED":        http.StatusForbidden,
+	"ELEVATION_EXPIRED":        http.StatusForbidden,
+	"PARSE_ERROR":              http.StatusBadRequest,
+	"UNSUPPORTED_QUERY":        http.StatusBadRequest,
+	"QUERY_ERROR":              http.StatusBadRequest,
+	"MASKING_ERROR":            http.StatusBadRequest,
+	"ACCESS_CONTROL_ERROR":     http.StatusBadRequest,
+	"ACCESS_REQUEST_NOT_FOUND": http.StatusNotFound,
+}
+
+// errorBody is the JSON form of an error
+type errorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// newErrorBody returns the JSON form of an error
+func newErrorBody(err error) errorBody {
+	var dbErr *secure_sqlite.DBError
+	if !errors.As(err, &dbErr) {
+		return errorBody{Code: "INTERNAL_ERROR", Message: err.Error()}
+	}
+	body := errorBody{Code: dbErr.Code, Message: dbErr.Message}
+	if dbErr.Err != nil {
+		body.Detail = dbErr.Err.Error()
+	}
+	return body
+}
+
+// statusCode returns the HTTP status code of an error
+func statusCode(err error) int {
+	var dbErr *secure_sqlite.DBError
+	if errors.As(err, &dbErr) {
+		if status, ok := statusCodes[dbErr.Code]; ok {
+			return status
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+// requestError reports a request that cannot be served as sent
+func requestError(message string, err error) error {
+	return &secure_sqlite.DBError{
+		Code:    "REQUEST_ERROR",
+		Message: message,
+		Err:     err,
+	}
+}
+
+// writeError responds with an error
+func writeError(w http.ResponseWriter, err error) {
+	writeJSON(w, statusCode(err), struct {
+		Error errorBody `json:"error"`
+	}{newErrorBody(err)})
+}
+
+// writeJSON responds with a JSON value
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,216 @@
+package httpapi
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/internal/servertest"
+)
+
+// startServer serves the servertest database
+func startServer(t *testing.T, opts ...Option) *httptest.Server {
+	t.Helper()
+	path, mockAuth := servertest.Database(t)
+	server := httptest.NewServer(NewServer(path, mockAuth, opts...))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// request sends a request as a user and decodes the JSON response into out
+func request(t *testing.T, server *httptest.Server, method, path, user, body string, out interface{}) int {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	if user != "" {
+		req.Header.Set("Authorization", "Bearer "+user)
+	}
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("Failed to decode response of %s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// queryResult is the JSON response of a query
+type queryResult struct {
+	Columns    []string        `json:"columns"`
+	Rows       [][]interface{} `json:"rows"`
+	RowCount   int             `json:"row_count"`
+	NextOffset *int            `json:"next_offset"`
+	Error      *errorBody      `json:"error"`
+}
+
+func TestQuery(t *testing.T) {
+	server := startServer(t)
+	const clerk = "clerk:clerktoken"
+
+	// Requests need a valid bearer token
+	var failure struct {
+		Error errorBody `json:"error"`
+	}
+	if status := request(t, server, "POST", "/query", "", `{"sql": "SELECT item FROM orders"}`, &failure); status != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without token, got %d", status)
+	}
+	if status := request(t, server, "POST", "/query", "clerk:wrong", `{"sql": "SELECT item FROM orders"}`, &failure); status != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for wrong token, got %d", status)
+	}
+	if failure.Error.Code != "AUTH_ERROR" {
+		t.Errorf("Expected AUTH_ERROR, got %q", failure.Error.Code)
+	}
+
+	// Statements take positional and named parameters
+	var result execResponse
+	for _, body := range []string{
+		`{"sql": "INSERT INTO orders (item, qty) VALUES (?, ?)", "params": ["book", 1]}`,
+		`{"sql": "INSERT INTO orders (item, qty) VALUES (:item, :qty)", "params": {"item": "pen", ":qty": 2}}`,
+		`{"sql": "INSERT INTO orders (item, qty) VALUES ('lamp', 3)"}`,
+	} {
+		if status := request(t, server, "POST", "/exec", clerk, body, &result); status != http.StatusOK {
+			t.Fatalf("Expected status 200 for %s, got %d", body, status)
+		}
+	}
+	if result.RowsAffected != 1 || result.LastInsertID == nil || *result.LastInsertID != 3 {
+		t.Errorf("Expected 1 row affected with ID 3, got %+v", result)
+	}
+
+	// Queries return pages of rows
+	var page queryResult
+	status := request(t, server, "POST", "/query", clerk, `{"sql": "SELECT item, qty FROM orders ORDER BY id", "limit": 2}`, &page)
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", status)
+	}
+	if want := []string{"item", "qty"}; !reflect.DeepEqual(page.Columns, want) {
+		t.Errorf("Expected columns %v, got %v", want, page.Columns)
+	}
+	if want := [][]interface{}{{"book", 1.0}, {"pen", 2.0}}; !reflect.DeepEqual(page.Rows, want) {
+		t.Errorf("Expected rows %v, got %v", want, page.Rows)
+	}
+	if page.NextOffset == nil || *page.NextOffset != 2 {
+		t.Fatalf("Expected next offset 2, got %v", page.NextOffset)
+	}
+	page = queryResult{}
+	request(t, server, "POST", "/query", clerk, `{"sql": "SELECT item FROM orders ORDER BY id", "limit": 2, "offset": 2}`, &page)
+	if len(page.Rows) != 1 || page.Rows[0][0] != "lamp" || page.NextOffset != nil || page.RowCount != 1 {
+		t.Errorf("Expected last page with lamp, got %+v", page)
+	}
+
+	// Errors of the checks map to status codes
+	for body, want := range map[string]int{
+		`{"sql": "SELECT value FROM secrets"}`:              http.StatusForbidden,
+		`{"sql": "SELECT item FROM orders WHERE"}`:          http.StatusBadRequest,
+		`{"sql": "SELECT item FROM orders", "bogus": true}`: http.StatusBadRequest,
+		`{"sql": "SELECT ?", "params": [[1]]}`:              http.StatusBadRequest,
+	} {
+		failure.Error = errorBody{}
+		if status := request(t, server, "POST", "/query", clerk, body, &failure); status != want {
+			t.Errorf("Expected status %d for %s, got %d (%+v)", want, body, status, failure.Error)
+		}
+	}
+	if status := request(t, server, "POST", "/query", clerk, `{"sql": "SELECT value FROM secrets"}`, &failure); status != http.StatusForbidden || failure.Error.Code != "PERMISSION_DENIED" {
+		t.Errorf("Expected PERMISSION_DENIED, got %d %+v", status, failure.Error)
+	}
+}
+
+func TestQueryNDJSON(t *testing.T) {
+	server := startServer(t, WithMaxRows(2))
+	for _, item := range []string{"book", "pen", "lamp"} {
+		request(t, server, "POST", "/exec", "clerk:clerktoken", `{"sql": "INSERT INTO orders (item) VALUES (?)", "params": ["`+item+`"]}`, nil)
+	}
+
+	req, _ := http.NewRequest("POST", server.URL+"/query", strings.NewReader(`{"sql": "SELECT id, item FROM orders ORDER BY id"}`))
+	req.Header.Set("Authorization", "Bearer clerk:clerktoken")
+	req.Header.Set("Accept", "application/x-ndjson")
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Expected NDJSON content type, got %q", ct)
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	want := []string{
+		`{"columns":["id","item"]}`,
+		`{"row":[1,"book"]}`,
+		`{"row":[2,"pen"]}`,
+		`{"next_offset":2,"row_count":2}`,
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("Expected lines %q, got %q", want, lines)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	server := startServer(t)
+	const admin, clerk = "admin:admintoken", "clerk:clerktoken"
+
+	// Access control changes are checked against the privileges of the user
+	var failure struct {
+		Error errorBody `json:"error"`
+	}
+	if status := request(t, server, "POST", "/roles", clerk, `{"name": "analyst"}`, &failure); status != http.StatusForbidden {
+		t.Errorf("Expected status 403 for clerk, got %d", status)
+	}
+	if status := request(t, server, "GET", "/roles", clerk, "", &failure); status != http.StatusForbidden {
+		t.Errorf("Expected status 403 for clerk, got %d", status)
+	}
+	if status := request(t, server, "POST", "/roles", admin, `{"name": "analyst"}`, &role{}); status != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d", status)
+	}
+	if status := request(t, server, "PUT", "/roles/analyst/members/clerk", admin, "", nil); status != http.StatusNoContent {
+		t.Fatalf("Expected status 204, got %d", status)
+	}
+	grant := `{"grantee": "analyst", "table": "secrets", "actions": ["select"], "columns": ["value"]}`
+	if status := request(t, server, "POST", "/grants", admin, grant, nil); status != http.StatusNoContent {
+		t.Fatalf("Expected status 204, got %d", status)
+	}
+
+	var roles struct {
+		Roles []role `json:"roles"`
+	}
+	request(t, server, "GET", "/roles", admin, "", &roles)
+	if want := []role{{Name: "analyst", Members: []string{"clerk"}}}; !reflect.DeepEqual(roles.Roles, want) {
+		t.Errorf("Expected roles %v, got %v", want, roles.Roles)
+	}
+
+	// Members of the role receive its grants
+	var page queryResult
+	if status := request(t, server, "POST", "/query", clerk, `{"sql": "SELECT value FROM secrets"}`, &page); status != http.StatusOK {
+		t.Errorf("Expected granted query to succeed, got %d", status)
+	}
+	revoke := `{"grantee": "analyst", "table": "secrets", "actions": ["select"]}`
+	if status := request(t, server, "POST", "/grants/revoke", admin, revoke, nil); status != http.StatusNoContent {
+		t.Fatalf("Expected status 204, got %d", status)
+	}
+	if status := request(t, server, "POST", "/query", clerk, `{"sql": "SELECT value FROM secrets"}`, &failure); status != http.StatusForbidden {
+		t.Errorf("Expected revoked query to be denied, got %d", status)
+	}
+
+	if status := request(t, server, "DELETE", "/roles/analyst/members/clerk", admin, "", nil); status != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", status)
+	}
+	if status := request(t, server, "DELETE", "/roles/analyst", admin, "", nil); status != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", status)
+	}
+	if status := request(t, server, "DELETE", "/roles/analyst", admin, "", &failure); status != http.StatusBadRequest {
+		t.Errorf("Expected deleting a missing role to fail, got %d", status)
+	}
+}
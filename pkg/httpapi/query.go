@@ -0,0 +1,329 @@
+package httpapi
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/secure_sqlite"
+)
+
+// flushEvery is the number of rows streamed between flushes
+const flushEvery = 64
+
+// statementRequest is the body of query and exec requests. Params is an array
+// of positional parameters or an object of named ones.
+type statementRequest struct {
+	SQL    string          `json:"sql"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Limit  int             `json:"limit,omitempty"`
+	Offset int             `json:"offset,omitempty"`
+}
+
+// execResponse is the body of exec responses
+type execResponse struct {
+	RowsAffected int64  `json:"rows_affected"`
+	LastInsertID *int64 `json:"last_insert_id,omitempty"`
+}
+
+// decodeJSON decodes a request body, refusing unknown fields
+func decodeJSON(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return requestError("invalid request body", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return requestError("invalid request body", errors.New("unexpected data after JSON value"))
+	}
+	return nil
+}
+
+// decodeStatement decodes the body of a query or exec request and its
+// parameters
+func decodeStatement(r *http.Request) (*statementRequest, []interface{}, error) {
+	var req statementRequest
+	if err := decodeJSON(r, &req); err != nil {
+		return nil, nil, err
+	}
+	if strings.TrimSpace(req.SQL) == "" {
+		return nil, nil, requestError("sql is required", nil)
+	}
+	if req.Limit < 0 || req.Offset < 0 {
+		return nil, nil, requestError("limit and offset must not be negative", nil)
+	}
+	args, err := decodeParams(req.Params)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &req, args, nil
+}
+
+// decodeParams converts the parameters of a request to statement arguments
+func decodeParams(raw json.RawMessage) ([]interface{}, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var params interface{}
+	if err := dec.Decode(&params); err != nil {
+		return nil, requestError("invalid params", err)
+	}
+
+	switch p := params.(type) {
+	case []interface{}:
+		args := make([]interface{}, len(p))
+		for i, value := range p {
+			arg, err := paramValue(value)
+			if err != nil {
+				return nil, requestError(fmt.Sprintf("invalid parameter %d", i+1), err)
+			}
+			args[i] = arg
+		}
+		return args, nil
+	case map[string]interface{}:
+		names := make([]string, 0, len(p))
+		for name := range p {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		args := make([]interface{}, len(names))
+		for i, name := range names {
+			arg, err := paramValue(p[name])
+			if err != nil {
+				return nil, requestError(fmt.Sprintf("invalid parameter %s", name), err)
+			}
+			// Names may carry the prefix of their placeholder
+			args[i] = sql.Named(strings.TrimLeft(name, ":@$"), arg)
+		}
+		return args, nil
+	}
+	return nil, requestError("params must be an array or an object", nil)
+}
+
+// paramValue converts a JSON value to a statement argument
+func paramValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil, string, bool:
+		return v, nil
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n, nil
+		}
+		return v.Float64()
+	}
+	return nil, errors.New("parameters must be strings, numbers, booleans or null")
+}
+
+// query runs a query and streams a page of its rows. Rows before the offset
+// are skipped without being read, so they are not recorded as sensitive reads.
+func (s *Server) query(w http.ResponseWriter, r *http.Request, db *secure_sqlite.SecureSQLite) {
+	req, args, err := decodeStatement(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	limit := req.Limit
+	if s.opts.maxRows > 0 && (limit == 0 || limit > s.opts.maxRows) {
+		limit = s.opts.maxRows
+	}
+
+	rows, err := db.QueryContext(r.Context(), req.SQL, args...)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		rows.Close()
+		writeError(w, err)
+		return
+	}
+
+	out := newResultWriter(w, r)
+	out.columns(columns)
+	for skipped := 0; skipped < req.Offset && rows.Next(); skipped++ {
+	}
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(values))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	count := 0
+	var nextOffset *int
+	for rows.Next() {
+		if limit > 0 && count == limit {
+			next := req.Offset + count
+			nextOffset = &next
+			break
+		}
+		if err = rows.Scan(pointers...); err != nil {
+			break
+		}
+		out.row(values)
+		count++
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	if closeErr := rows.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		nextOffset = nil
+	}
+	out.end(count, nextOffset, err)
+}
+
+// exec runs a statement
+func (s *Server) exec(w http.ResponseWriter, r *http.Request, db *secure_sqlite.SecureSQLite) {
+	req, args, err := decodeStatement(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if req.Limit != 0 || req.Offset != 0 {
+		writeError(w, requestError("limit and offset apply to queries only", nil))
+		return
+	}
+	result, err := db.ExecContext(r.Context(), req.SQL, args...)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var resp execResponse
+	resp.RowsAffected, _ = result.RowsAffected()
+	if id, err := result.LastInsertId(); err == nil && resp.RowsAffected > 0 {
+		resp.LastInsertID = &id
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// resultWriter streams the rows of a query
+type resultWriter interface {
+	columns(names []string)
+	row(values []interface{})
+	// end ends the stream with the number of rows sent, the offset of the
+	// next page if there is one, and the error that ended it early
+	end(count int, nextOffset *int, err error)
+}
+
+// newResultWriter returns a JSON writer, or an NDJSON writer for clients that
+// accept it
+func newResultWriter(w http.ResponseWriter, r *http.Request) resultWriter {
+	flusher, _ := w.(http.Flusher)
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, "application/x-ndjson") || strings.Contains(accept, "application/ndjson") {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		return &ndjsonWriter{enc: json.NewEncoder(w), flusher: flusher}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return &jsonWriter{w: w, flusher: flusher}
+}
+
+// jsonWriter streams rows as a JSON object:
+//
+//	{"columns": [...], "rows": [[...], ...], "row_count": n, "next_offset": n}
+//
+// Errors found while streaming are reported in an "error" member.
+type jsonWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+	n       int
+}
+
+// columns starts the object with the column names
+func (j *jsonWriter) columns(names []string) {
+	data, _ := json.Marshal(names)
+	fmt.Fprintf(j.w, `{"columns":%s,"rows":[`, data)
+}
+
+// row appends a row to the rows array
+func (j *jsonWriter) row(values []interface{}) {
+	if j.n > 0 {
+		io.WriteString(j.w, ",")
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		data, _ = json.Marshal(textValues(values))
+	}
+	j.w.Write(data)
+	j.n++
+	if j.n%flushEvery == 0 && j.flusher != nil {
+		j.flusher.Flush()
+	}
+}
+
+// end closes the rows array and the object
+func (j *jsonWriter) end(count int, nextOffset *int, err error) {
+	fmt.Fprintf(j.w, `],"row_count":%d`, count)
+	if nextOffset != nil {
+		fmt.Fprintf(j.w, `,"next_offset":%d`, *nextOffset)
+	}
+	if err != nil {
+		data, _ := json.Marshal(newErrorBody(err))
+		fmt.Fprintf(j.w, `,"error":%s`, data)
+	}
+	io.WriteString(j.w, "}\n")
+}
+
+// ndjsonWriter streams rows as newline-delimited JSON: a line with the
+// columns, a line for each row, and a line with the row count and next offset
+// or the error that ended the stream.
+type ndjsonWriter struct {
+	enc     *json.Encoder
+	flusher http.Flusher
+	n       int
+}
+
+// columns writes the line of the column names
+func (j *ndjsonWriter) columns(names []string) {
+	j.enc.Encode(map[string]interface{}{"columns": names})
+}
+
+// row writes the line of a row
+func (j *ndjsonWriter) row(values []interface{}) {
+	if err := j.enc.Encode(map[string]interface{}{"row": values}); err != nil {
+		j.enc.Encode(map[string]interface{}{"row": textValues(values)})
+	}
+	j.n++
+	if j.n%flushEvery == 0 && j.flusher != nil {
+		j.flusher.Flush()
+	}
+}
+
+// end writes the last line
+func (j *ndjsonWriter) end(count int, nextOffset *int, err error) {
+	if err != nil {
+		j.enc.Encode(map[string]interface{}{"error": newErrorBody(err)})
+		return
+	}
+	end := map[string]interface{}{"row_count": count}
+	if nextOffset != nil {
+		end["next_offset"] = *nextOffset
+	}
+	j.enc.Encode(end)
+}
+
+// textValues formats values that have no JSON form, such as infinite floats
+func textValues(values []interface{}) []interface{} {
+	text := make([]interface{}, len(values))
+	for i, value := range values {
+		if value == nil {
+			continue
+		}
+		if _, err := json.Marshal(value); err != nil {
+			text[i] = fmt.Sprint(value)
+		} else {
+			text[i] = value
+		}
+	}
+	return text
+}
@@ -0,0 +1,131 @@
+// Package httpapi serves secure databases over HTTP with JSON bodies. Clients
+// authenticate every request with a bearer token of a user of an auth
+// provider, and each request runs on its own handle of the user, through the
+// same checks as any other handle.
+//
+// Endpoints:
+//
+//	POST   /query                          run a query and stream its rows
+//	POST   /exec                           run a statement
+//	GET    /roles                          list roles
+//	POST   /roles                          create a role
+//	DELETE /roles/{role}                   delete a role
+//	PUT    /roles/{role}/members/{user}    add a user to a role
+//	DELETE /roles/{role}/members/{user}    remove a user from a role
+//	POST   /grants                         grant permissions
+//	POST   /grants/revoke                  revoke permissions
+package httpapi
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/auth"
+	"github.com/wemcdonald/secure_sqlite/pkg/secure_sqlite"
+)
+
+// maxBodyBytes bounds the size of request bodies
+const maxBodyBytes = 1 << 20
+
+// options configures a server
+type options struct {
+	handleOpts []secure_sqlite.Option
+	maxRows    int
+}
+
+// Option configures a server
+type Option func(o *options)
+
+// WithHandleOptions applies options to the handles of every request
+func WithHandleOptions(opts ...secure_sqlite.Option) Option {
+	return func(o *options) {
+		o.handleOpts = append(o.handleOpts, opts...)
+	}
+}
+
+// WithMaxRows limits the rows a query returns per page. Queries without a
+// limit, or with a larger one, get pages of this size.
+func WithMaxRows(n int) Option {
+	return func(o *options) {
+		o.maxRows = n
+	}
+}
+
+// Server is the HTTP handler of a secure database
+type Server struct {
+	dsn          string
+	authProvider auth.Provider
+	opts         options
+	mux          *http.ServeMux
+}
+
+// NewServer returns the HTTP handler of a database whose clients authenticate
+// as users of an auth provider
+func NewServer(dataSourceName string, authProvider auth.Provider, opts ...Option) *Server {
+	s := &Server{
+		dsn:          dataSourceName,
+		authProvider: authProvider,
+		mux:          http.NewServeMux(),
+	}
+	for _, opt := range opts {
+		opt(&s.opts)
+	}
+
+	s.mux.HandleFunc("POST /query", s.withHandle(s.query))
+	s.mux.HandleFunc("POST /exec", s.withHandle(s.exec))
+	s.mux.HandleFunc("GET /roles", s.withHandle(s.listRoles))
+	s.mux.HandleFunc("POST /roles", s.withHandle(s.createRole))
+	s.mux.HandleFunc("DELETE /roles/{role}", s.withHandle(s.deleteRole))
+	s.mux.HandleFunc("PUT /roles/{role}/members/{user}", s.withHandle(s.addMember))
+	s.mux.HandleFunc("DELETE /roles/{role}/members/{user}", s.withHandle(s.removeMember))
+	s.mux.HandleFunc("POST /grants", s.withHandle(s.grant))
+	s.mux.HandleFunc("POST /grants/revoke", s.withHandle(s.revoke))
+	return s
+}
+
+// ServeHTTP serves a request
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// handlerFunc handles a request with the handle of its user
+type handlerFunc func(w http.ResponseWriter, r *http.Request, db *secure_sqlite.SecureSQLite)
+
+// withHandle authenticates a request and opens a handle of its user for the
+// length of the request
+func (s *Server) withHandle(h handlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, token, ok := bearerToken(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="secure_sqlite"`)
+			writeError(w, &secure_sqlite.DBError{
+				Code:    "AUTH_ERROR",
+				Message: "missing bearer token",
+			})
+			return
+		}
+		db, err := secure_sqlite.Open(s.dsn, s.authProvider, username, token, s.opts.handleOpts...)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="secure_sqlite", error="invalid_token"`)
+			writeError(w, err)
+			return
+		}
+		defer db.Close()
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+		h(w, r, db)
+	}
+}
+
+// bearerToken returns the user and token of the Authorization header, whose
+// bearer token has the form user:token
+func bearerToken(r *http.Request) (string, string, bool) {
+	scheme, credentials, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", "", false
+	}
+	username, token, ok := strings.Cut(strings.TrimSpace(credentials), ":")
+	if !ok || username == "" {
+		return "", "", false
+	}
+	return username, token, true
+}
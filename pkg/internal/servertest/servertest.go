@@ -0,0 +1,59 @@
+// Package servertest provides the database fixture shared by the tests of
+// the network servers
+package servertest
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/auth"
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+	"github.com/wemcdonald/secure_sqlite/pkg/secure_sqlite"
+)
+
+// Clerks are the users that may read and write orders
+var Clerks = []string{"clerk", "other"}
+
+// Database creates a database with orders and secrets tables, where admin is a
+// superuser and the clerks may read and write the rows of orders with a
+// positive id. Each user's token is its name followed by "token".
+func Database(t *testing.T) (string, *auth.MemoryProvider) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "server.db")
+	mockAuth := auth.NewMemoryProvider()
+	mockAuth.AddUser("admin", "admintoken")
+	for _, user := range Clerks {
+		mockAuth.AddUser(user, user+"token")
+		mockAuth.AddPermission(user, permissions.Permission{
+			Type:  permissions.TablePermission,
+			Table: "orders",
+		})
+		for _, column := range []string{"id", "item", "qty", "created"} {
+			mockAuth.AddPermission(user, permissions.Permission{
+				Type:   permissions.ColumnPermission,
+				Table:  "orders",
+				Column: column,
+			})
+		}
+		mockAuth.AddPermission(user, permissions.Permission{
+			Type:      permissions.RowPermission,
+			Table:     "orders",
+			Condition: "id > 0",
+		})
+	}
+
+	admin, err := secure_sqlite.Open(path, mockAuth, "admin", "admintoken", secure_sqlite.WithSuperuser("admin"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer admin.Close()
+	for _, query := range []string{
+		"CREATE TABLE orders (id INTEGER PRIMARY KEY, item TEXT NOT NULL, qty INTEGER, created DATETIME)",
+		"CREATE TABLE secrets (id INTEGER PRIMARY KEY, value TEXT)",
+	} {
+		if _, err := admin.Exec(query); err != nil {
+			t.Fatalf("Failed to create table: %v", err)
+		}
+	}
+	return path, mockAuth
+}
@@ -0,0 +1,227 @@
+// Package masking provides per-role rules that mask the values of columns
+// returned by queries instead of denying access to them
+package masking
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+)
+
+// Mask names a function that masks the values of a column
+type Mask string
+
+const (
+	// Unmasked returns raw values; rules with it exempt privileged roles from
+	// the rules that follow
+	Unmasked Mask = "none"
+	// Redact replaces values with a fixed string
+	Redact Mask = "redact"
+	// Last4 keeps only the last four characters of values
+	Last4 Mask = "last4"
+	// Email keeps the first character of the local part and the domain of
+	// email addresses
+	Email Mask = "email"
+	// Hash replaces values with their SHA-256 hash, which keeps equal values
+	// equal. Values from a small domain can be recovered by hashing guesses.
+	Hash Mask = "hash"
+	// Null replaces values with NULL
+	Null Mask = "null"
+)
+
+// redacted is the string masked values are replaced with
+const redacted = "****"
+
+// builtin holds the functions of the built-in masks
+var builtin = map[Mask]func(value interface{}) interface{}{
+	Unmasked: func(value interface{}) interface{} { return value },
+	Redact:   func(value interface{}) interface{} { return redacted },
+	Last4: func(value interface{}) interface{} {
+		s := []rune(text(value))
+		if len(s) <= 4 {
+			return redacted
+		}
+		return redacted + string(s[len(s)-4:])
+	},
+	Email: func(value interface{}) interface{} {
+		s := text(value)
+		at := strings.LastIndex(s, "@")
+		if at <= 0 {
+			return redacted
+		}
+		return string([]rune(s)[:1]) + "***" + s[at:]
+	},
+	Hash: func(value interface{}) interface{} {
+		sum := sha256.Sum256([]byte(text(value)))
+		return hex.EncodeToString(sum[:])
+	},
+	Null: func(value interface{}) interface{} { return nil },
+}
+
+var (
+	customMu sync.RWMutex
+	custom   = make(map[Mask]func(value interface{}) interface{})
+)
+
+// Register registers a custom mask implemented by a Go function and returns
+// it. Masks are registered for the whole process since queries call them from
+// any connection.
+func Register(name string, fn func(value interface{}) interface{}) (Mask, error) {
+	mask := Mask(strings.ToLower(name))
+	if mask == "" || fn == nil {
+		return "", fmt.Errorf("mask name and function cannot be empty")
+	}
+	if _, ok := builtin[mask]; ok {
+		return "", fmt.Errorf("mask %s is built in", name)
+	}
+
+	customMu.Lock()
+	defer customMu.Unlock()
+
+	if _, ok := custom[mask]; ok {
+		return "", fmt.Errorf("mask %s already registered", name)
+	}
+	custom[mask] = fn
+	return mask, nil
+}
+
+// lookup returns the function of a mask
+func lookup(mask Mask) (func(value interface{}) interface{}, bool) {
+	if fn, ok := builtin[mask]; ok {
+		return fn, true
+	}
+	customMu.RLock()
+	defer customMu.RUnlock()
+	fn, ok := custom[mask]
+	return fn, ok
+}
+
+// Apply masks a value. NULL values stay NULL.
+func (m Mask) Apply(value interface{}) (interface{}, error) {
+	fn, ok := lookup(m)
+	if !ok {
+		return nil, fmt.Errorf("unknown mask: %s", m)
+	}
+	if value == nil {
+		return nil, nil
+	}
+	return fn(value), nil
+}
+
+// text returns the text of a value
+func text(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Rule masks columns of a table for the users it applies to
+type Rule struct {
+	Name    string
+	Table   string
+	Columns []string
+	// Roles lists the roles the rule applies to; a rule without roles applies
+	// to every user
+	Roles []string
+	Mask  Mask
+}
+
+// appliesTo checks if a rule masks a column for a user with the given roles
+func (r Rule) appliesTo(table, column string, roles []string) bool {
+	if !strings.EqualFold(r.Table, table) || !permissions.ContainsName(r.Columns, column) {
+		return false
+	}
+	if len(r.Roles) == 0 {
+		return true
+	}
+	for _, role := range roles {
+		if permissions.ContainsName(r.Roles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// Manager holds masking rules. For each column, the first rule that applies
+// to a user decides the mask, so rules that exempt privileged roles with
+// Unmasked come before the rules that mask values for everyone else.
+type Manager struct {
+	rules []Rule
+	mu    sync.RWMutex
+}
+
+// NewManager creates a new masking manager
+func NewManager() *Manager {
+	return &Manager{}
+}
+
+// AddRule adds a rule after the existing ones
+func (m *Manager) AddRule(rule Rule) error {
+	if rule.Name == "" {
+		return fmt.Errorf("masking rule name cannot be empty")
+	}
+	if rule.Table == "" || len(rule.Columns) == 0 {
+		return fmt.Errorf("masking rule %s must target a table and at least one column", rule.Name)
+	}
+	if _, ok := lookup(rule.Mask); !ok {
+		return fmt.Errorf("masking rule %s: unknown mask: %s", rule.Name, rule.Mask)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, r := range m.rules {
+		if r.Name == rule.Name {
+			return fmt.Errorf("masking rule %s already exists", rule.Name)
+		}
+	}
+	m.rules = append(m.rules, rule)
+	return nil
+}
+
+// RemoveRule removes a rule
+func (m *Manager) RemoveRule(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, r := range m.rules {
+		if r.Name == name {
+			m.rules = append(m.rules[:i], m.rules[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("masking rule %s not found", name)
+}
+
+// Rules returns all rules in order
+func (m *Manager) Rules() []Rule {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	rules := make([]Rule, len(m.rules))
+	copy(rules, m.rules)
+	return rules
+}
+
+// MaskFor returns the mask of a column for a user with the given roles, or
+// Unmasked if no rule applies
+func (m *Manager) MaskFor(table, column string, roles []string) Mask {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, rule := range m.rules {
+		if rule.appliesTo(table, column, roles) {
+			return rule.Mask
+		}
+	}
+	return Unmasked
+}
@@ -0,0 +1,104 @@
+package masking
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMaskApply(t *testing.T) {
+	tests := []struct {
+		mask  Mask
+		value interface{}
+		want  interface{}
+	}{
+		{Unmasked, "123-45-6789", "123-45-6789"},
+		{Redact, "123-45-6789", "****"},
+		{Last4, "4111111111111111", "****1111"},
+		{Last4, []byte("123"), "****"},
+		{Last4, int64(5551234567), "****4567"},
+		{Email, "alice@example.com", "a***@example.com"},
+		{Email, "not an address", "****"},
+		{Hash, "x", "2d711642b726b04401627ca9fbac32f5c8530fb1903cc4db02258717921a4881"},
+		{Null, "123-45-6789", nil},
+		{Redact, nil, nil},
+	}
+	for _, tt := range tests {
+		got, err := tt.mask.Apply(tt.value)
+		if err != nil {
+			t.Fatalf("%s.Apply(%v) error = %v", tt.mask, tt.value, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s.Apply(%v) = %v, want %v", tt.mask, tt.value, got, tt.want)
+		}
+	}
+
+	if _, err := Mask("unknown").Apply("x"); err == nil {
+		t.Error("Apply succeeded for an unknown mask")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	initials, err := Register("Initials", func(value interface{}) interface{} {
+		var initials string
+		for _, word := range strings.Fields(value.(string)) {
+			initials += word[:1] + "."
+		}
+		return initials
+	})
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	if got, _ := initials.Apply("Jane Smith"); got != "J.S." {
+		t.Errorf("Apply = %v, want J.S.", got)
+	}
+
+	if _, err := Register("initials", func(value interface{}) interface{} { return value }); err == nil {
+		t.Error("Register succeeded for a registered mask")
+	}
+	if _, err := Register("redact", func(value interface{}) interface{} { return value }); err == nil {
+		t.Error("Register succeeded for a built-in mask")
+	}
+}
+
+func TestManager(t *testing.T) {
+	m := NewManager()
+
+	if err := m.AddRule(Rule{Table: "patients", Columns: []string{"ssn"}, Mask: Redact}); err == nil {
+		t.Error("AddRule succeeded without a name")
+	}
+	if err := m.AddRule(Rule{Name: "bad", Table: "patients", Columns: []string{"ssn"}, Mask: "scramble"}); err == nil {
+		t.Error("AddRule succeeded with an unknown mask")
+	}
+	if err := m.AddRule(Rule{Name: "doctors", Table: "patients", Columns: []string{"ssn", "email"}, Roles: []string{"doctor"}, Mask: Unmasked}); err != nil {
+		t.Fatalf("AddRule failed: %v", err)
+	}
+	if err := m.AddRule(Rule{Name: "ssn", Table: "patients", Columns: []string{"ssn"}, Mask: Last4}); err != nil {
+		t.Fatalf("AddRule failed: %v", err)
+	}
+	if err := m.AddRule(Rule{Name: "ssn", Table: "patients", Columns: []string{"ssn"}, Mask: Redact}); err == nil {
+		t.Error("AddRule succeeded with a duplicate name")
+	}
+
+	if got := m.MaskFor("Patients", "SSN", []string{"clerk"}); got != Last4 {
+		t.Errorf("MaskFor(clerk) = %s, want %s", got, Last4)
+	}
+	if got := m.MaskFor("patients", "ssn", []string{"clerk", "doctor"}); got != Unmasked {
+		t.Errorf("MaskFor(doctor) = %s, want %s", got, Unmasked)
+	}
+	if got := m.MaskFor("patients", "name", nil); got != Unmasked {
+		t.Errorf("MaskFor(name) = %s, want %s", got, Unmasked)
+	}
+
+	if err := m.RemoveRule("doctors"); err != nil {
+		t.Fatalf("RemoveRule failed: %v", err)
+	}
+	if got := m.MaskFor("patients", "ssn", []string{"doctor"}); got != Last4 {
+		t.Errorf("MaskFor(doctor) after removal = %s, want %s", got, Last4)
+	}
+	if err := m.RemoveRule("doctors"); err == nil {
+		t.Error("RemoveRule succeeded for a missing rule")
+	}
+	if len(m.Rules()) != 1 {
+		t.Errorf("Rules() = %d rules, want 1", len(m.Rules()))
+	}
+}
@@ -1,5 +1,11 @@
 package permissions
 
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
 // PermissionType represents the type of permission
 type PermissionType int
 
@@ -7,8 +13,26 @@ const (
 	TablePermission PermissionType = iota
 	ColumnPermission
 	RowPermission
+	// SystemPermission grants a system privilege to manage access control
+	SystemPermission
 )
 
+// String implements the Stringer interface for PermissionType
+func (t PermissionType) String() string {
+	switch t {
+	case TablePermission:
+		return "table"
+	case ColumnPermission:
+		return "column"
+	case RowPermission:
+		return "row"
+	case SystemPermission:
+		return "system"
+	default:
+		return "unknown"
+	}
+}
+
 // Action represents the type of database action
 type Action int
 
@@ -22,6 +46,101 @@ const (
 	Alter
 )
 
+// Actions lists all actions
+var Actions = []Action{Select, Insert, Update, Delete, Create, Drop, Alter}
+
+// String implements the Stringer interface for Action
+func (a Action) String() string {
+	switch a {
+	case Select:
+		return "select"
+	case Insert:
+		return "insert"
+	case Update:
+		return "update"
+	case Delete:
+		return "delete"
+	case Create:
+		return "create"
+	case Drop:
+		return "drop"
+	case Alter:
+		return "alter"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseAction parses an action name such as "select", case-insensitively
+func ParseAction(name string) (Action, error) {
+	for _, action := range Actions {
+		if strings.EqualFold(name, action.String()) {
+			return action, nil
+		}
+	}
+	return Select, fmt.Errorf("unknown action: %s", name)
+}
+
+// Privilege represents a system privilege to manage access control
+type Privilege int
+
+const (
+	// NoPrivilege is the privilege of permissions that grant data access
+	NoPrivilege Privilege = iota
+	// Superuser holds every other privilege, with grant option
+	Superuser
+	// ManageUsers allows creating users and changing their role memberships
+	ManageUsers
+	// ManageRoles allows creating and deleting roles
+	ManageRoles
+	// GrantTable allows granting and revoking permissions on a table
+	GrantTable
+	// Decrypt allows reading the plaintext of the encrypted columns of a table
+	Decrypt
+	// RawAccess allows taking the unchecked connection of a database
+	RawAccess
+)
+
+// Privileges lists all system privileges
+var Privileges = []Privilege{Superuser, ManageUsers, ManageRoles, GrantTable, Decrypt, RawAccess}
+
+// String implements the Stringer interface for Privilege
+func (p Privilege) String() string {
+	switch p {
+	case NoPrivilege:
+		return "none"
+	case Superuser:
+		return "superuser"
+	case ManageUsers:
+		return "manage_users"
+	case ManageRoles:
+		return "manage_roles"
+	case GrantTable:
+		return "grant"
+	case Decrypt:
+		return "decrypt"
+	case RawAccess:
+		return "raw_access"
+	default:
+		return "unknown"
+	}
+}
+
+// OnTable checks if the privilege is held for a table rather than globally
+func (p Privilege) OnTable() bool {
+	return p == GrantTable || p == Decrypt
+}
+
+// ParsePrivilege parses a privilege name such as "manage_users", case-insensitively
+func ParsePrivilege(name string) (Privilege, error) {
+	for _, privilege := range Privileges {
+		if strings.EqualFold(name, privilege.String()) {
+			return privilege, nil
+		}
+	}
+	return NoPrivilege, fmt.Errorf("unknown privilege: %s", name)
+}
+
 // Special permission markers
 const (
 	// RevokedPermissionPrefix is used to mark a permission as revoked
@@ -30,6 +149,17 @@ const (
 	WildcardPermission = "*"
 )
 
+// ContainsName checks if a list of table, column or role names contains a
+// name. Names are compared ignoring case, as SQLite compares identifiers.
+func ContainsName(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
 // Permission represents a parsed permission
 type Permission struct {
 	Type      PermissionType
@@ -37,6 +167,71 @@ type Permission struct {
 	Column    string
 	Condition string
 	Action    Action
+	// Privilege is the system privilege of a SystemPermission; GrantTable
+	// and Decrypt apply to Table
+	Privilege Privilege
+	// GrantOption allows the holder to grant the permission to others
+	GrantOption bool
+	// Grantor is the user who granted the permission; empty for permissions
+	// granted by the application
+	Grantor string
+	// NotBefore and NotAfter bound the time the permission is valid; zero
+	// values leave the window open
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// ActiveAt checks if the permission is valid at a time
+func (p Permission) ActiveAt(t time.Time) bool {
+	return InWindow(t, p.NotBefore, p.NotAfter)
+}
+
+// ExpiredAt checks if the validity window of the permission has ended at a time
+func (p Permission) ExpiredAt(t time.Time) bool {
+	return !p.NotAfter.IsZero() && !t.Before(p.NotAfter)
+}
+
+// InWindow checks if a time lies within a validity window. A zero bound
+// leaves that side of the window open; NotAfter itself is outside the window.
+func InWindow(t, notBefore, notAfter time.Time) bool {
+	if !notBefore.IsZero() && t.Before(notBefore) {
+		return false
+	}
+	return notAfter.IsZero() || t.Before(notAfter)
+}
+
+// String implements the Stringer interface for Permission
+func (p Permission) String() string {
+	if !p.NotBefore.IsZero() || !p.NotAfter.IsZero() {
+		without := p
+		without.NotBefore, without.NotAfter = time.Time{}, time.Time{}
+		s := without.String()
+		if !p.NotBefore.IsZero() {
+			s += " from " + p.NotBefore.Format(time.RFC3339)
+		}
+		if !p.NotAfter.IsZero() {
+			s += " until " + p.NotAfter.Format(time.RFC3339)
+		}
+		return s
+	}
+	if p.GrantOption {
+		without := p
+		without.GrantOption = false
+		return without.String() + " with grant option"
+	}
+	switch p.Type {
+	case SystemPermission:
+		if p.Privilege.OnTable() {
+			return fmt.Sprintf("%s on %s", p.Privilege, p.Table)
+		}
+		return p.Privilege.String()
+	case ColumnPermission:
+		return fmt.Sprintf("%s (%s) on %s", p.Action, p.Column, p.Table)
+	case RowPermission:
+		return fmt.Sprintf("%s on %s where %s", p.Action, p.Table, p.Condition)
+	default:
+		return fmt.Sprintf("%s on %s", p.Action, p.Table)
+	}
 }
 
 // RowPermissionRule represents a row-level permission rule
@@ -0,0 +1,105 @@
+package pgwire
+
+import (
+	"errors"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/wemcdonald/secure_sqlite/pkg/secure_sqlite"
+)
+
+// SQLSTATE codes the server reports
+const (
+	stateInternal            = "XX000"
+	stateProtocolViolation   = "08P01"
+	stateInvalidPassword     = "28P01"
+	stateUndefinedStatement  = "26000"
+	stateUndefinedPortal     = "34000"
+	stateDuplicateStatement  = "42P05"
+	stateInvalidParameter    = "22P02"
+	stateFeatureNotSupported = "0A000"
+	stateTransactionAborted  = "25P02"
+)
+
+// sqlStates maps the codes of database errors to SQLSTATE codes
+var sqlStates = map[string]string{
+	"AUTH_ERROR":             stateInvalidPassword,
+	"PERMISSION_DENIED":      "42501",
+	"ELEVATION_EXPIRED":      "42501",
+	"PARSE_ERROR":            "42601",
+	"UNSUPPORTED_QUERY":      stateFeatureNotSupported,
+	"MASKING_ERROR":          stateFeatureNotSupported,
+	"TRANSACTION_ERROR":      "25000",
+	"AUDIT_ERROR":            "58000",
+	"CONNECTION_ERROR":       "08006",
+	"DSN_ERROR":              "08001",
+	"ENCRYPTION_KEY_ERROR":   "58000",
+	"ENCRYPTION_UNSUPPORTED": stateFeatureNotSupported,
+}
+
+// sqliteStates maps the extended codes of SQLite errors to SQLSTATE codes
+var sqliteStates = map[sqlite3.ErrNoExtended]string{
+	sqlite3.ErrConstraintUnique:     "23505",
+	sqlite3.ErrConstraintPrimaryKey: "23505",
+	sqlite3.ErrConstraintNotNull:    "23502",
+	sqlite3.ErrConstraintForeignKey: "23503",
+	sqlite3.ErrConstraintCheck:      "23514",
+}
+
+// SQLState returns the SQLSTATE code of an error. Errors of SQLite map to the
+// codes of the matching PostgreSQL errors, errors of secure databases map by
+// their code, and other errors are internal errors.
+func SQLState(err error) string {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		if state, ok := sqliteStates[sqliteErr.ExtendedCode]; ok {
+			return state
+		}
+		switch sqliteErr.Code {
+		case sqlite3.ErrConstraint:
+			return "23000"
+		case sqlite3.ErrBusy, sqlite3.ErrLocked:
+			return "55P03"
+		case sqlite3.ErrReadonly:
+			return "25006"
+		}
+	}
+	var dbErr *secure_sqlite.DBError
+	if errors.As(err, &dbErr) {
+		if state, ok := sqlStates[dbErr.Code]; ok {
+			return state
+		}
+	}
+	var wireErr *Error
+	if errors.As(err, &wireErr) {
+		return wireErr.Code
+	}
+	return stateInternal
+}
+
+// Error is an error the server reports with a SQLSTATE code
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// errorResponse returns the ErrorResponse message of an error of a severity
+func errorResponse(severity string, err error) []byte {
+	m := newMessage('E').
+		byte('S').string(severity).
+		byte('V').string(severity).
+		byte('C').string(SQLState(err))
+	var dbErr *secure_sqlite.DBError
+	if errors.As(err, &dbErr) {
+		m.byte('M').string(dbErr.Message)
+		if dbErr.Err != nil {
+			m.byte('D').string(dbErr.Err.Error())
+		}
+	} else {
+		m.byte('M').string(err.Error())
+	}
+	return m.byte(0).encode()
+}
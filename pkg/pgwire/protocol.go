@@ -0,0 +1,173 @@
+package pgwire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Codes of the startup packets of the protocol
+const (
+	protocolVersion   = 3 << 16
+	cancelRequestCode = 80877102
+	sslRequestCode    = 80877103
+	gssEncRequestCode = 80877104
+)
+
+// maxMessageSize bounds the size of the messages clients send
+const maxMessageSize = 1 << 24
+
+// errMalformed is returned for messages that cannot be parsed
+var errMalformed = errors.New("malformed message")
+
+// readStartup reads a startup packet, which has no message type
+func readStartup(r *bufio.Reader) (uint32, *buffer, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	if size < 8 || size > maxMessageSize {
+		return 0, nil, fmt.Errorf("invalid startup packet size %d", size)
+	}
+	payload := make([]byte, size-8)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return binary.BigEndian.Uint32(header[4:]), &buffer{data: payload}, nil
+}
+
+// readMessage reads a message and returns its type and payload
+func readMessage(r *bufio.Reader) (byte, *buffer, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size < 4 || size > maxMessageSize {
+		return 0, nil, fmt.Errorf("invalid message size %d", size)
+	}
+	payload := make([]byte, size-4)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], &buffer{data: payload}, nil
+}
+
+// buffer parses the payload of a message. Reading past its end sets err and
+// returns zero values.
+type buffer struct {
+	data []byte
+	err  error
+}
+
+// take returns the next n bytes of the payload
+func (b *buffer) take(n int) []byte {
+	if b.err != nil || n < 0 || n > len(b.data) {
+		b.err = errMalformed
+		return nil
+	}
+	data := b.data[:n]
+	b.data = b.data[n:]
+	return data
+}
+
+// byte reads a byte
+func (b *buffer) byte() byte {
+	data := b.take(1)
+	if data == nil {
+		return 0
+	}
+	return data[0]
+}
+
+// int16 reads a 16-bit integer
+func (b *buffer) int16() int16 {
+	data := b.take(2)
+	if data == nil {
+		return 0
+	}
+	return int16(binary.BigEndian.Uint16(data))
+}
+
+// int32 reads a 32-bit integer
+func (b *buffer) int32() int32 {
+	data := b.take(4)
+	if data == nil {
+		return 0
+	}
+	return int32(binary.BigEndian.Uint32(data))
+}
+
+// string reads a null-terminated string
+func (b *buffer) string() string {
+	if b.err != nil {
+		return ""
+	}
+	for i, c := range b.data {
+		if c == 0 {
+			s := string(b.data[:i])
+			b.data = b.data[i+1:]
+			return s
+		}
+	}
+	b.err = errMalformed
+	return ""
+}
+
+// message builds a message of the server
+type message struct {
+	data []byte
+}
+
+// newMessage starts a message of a type
+func newMessage(typ byte) *message {
+	return &message{data: []byte{typ, 0, 0, 0, 0}}
+}
+
+// byte appends a byte
+func (m *message) byte(c byte) *message {
+	m.data = append(m.data, c)
+	return m
+}
+
+// int16 appends a 16-bit integer
+func (m *message) int16(n int) *message {
+	m.data = binary.BigEndian.AppendUint16(m.data, uint16(n))
+	return m
+}
+
+// int32 appends a 32-bit integer
+func (m *message) int32(n int) *message {
+	m.data = binary.BigEndian.AppendUint32(m.data, uint32(n))
+	return m
+}
+
+// string appends a null-terminated string
+func (m *message) string(s string) *message {
+	m.data = append(m.data, s...)
+	m.data = append(m.data, 0)
+	return m
+}
+
+// bytes appends raw bytes
+func (m *message) bytes(data []byte) *message {
+	m.data = append(m.data, data...)
+	return m
+}
+
+// value appends a length-prefixed value, or -1 for NULL
+func (m *message) value(data []byte) *message {
+	if data == nil {
+		return m.int32(-1)
+	}
+	return m.int32(len(data)).bytes(data)
+}
+
+// encode sets the length of the message and returns it
+func (m *message) encode() []byte {
+	binary.BigEndian.PutUint32(m.data[1:5], uint32(len(m.data)-1))
+	return m.data
+}
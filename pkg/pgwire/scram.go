@@ -0,0 +1,138 @@
+package pgwire
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// scramMechanism is the SASL mechanism of SCRAM authentication
+const scramMechanism = "SCRAM-SHA-256"
+
+// scramIterations is the iteration count of the salted passwords
+const scramIterations = 4096
+
+// errSCRAM is returned for SCRAM messages that cannot be parsed
+var errSCRAM = errors.New("malformed SCRAM message")
+
+// scram is the server side of a SCRAM-SHA-256 exchange (RFC 5802, RFC 7677),
+// which proves that the client knows a password without sending it
+type scram struct {
+	password        string
+	salt            []byte
+	nonce           string
+	clientFirstBare string
+	serverFirst     string
+}
+
+// newSCRAM starts an exchange for a password
+func newSCRAM(password string) (*scram, error) {
+	salt := make([]byte, 16)
+	nonce := make([]byte, 18)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &scram{
+		password: password,
+		salt:     salt,
+		nonce:    base64.RawStdEncoding.EncodeToString(nonce),
+	}, nil
+}
+
+// first reads the client-first-message and returns the server-first-message
+func (s *scram) first(clientFirst string) (string, error) {
+	// Channel binding is not supported, so the GS2 header must be n,,
+	gs2, bare, ok := strings.Cut(clientFirst, ",,")
+	if !ok || (gs2 != "n" && gs2 != "y") {
+		return "", errSCRAM
+	}
+	clientNonce := scramAttribute(bare, 'r')
+	if clientNonce == "" {
+		return "", errSCRAM
+	}
+	s.clientFirstBare = bare
+	s.nonce = clientNonce + s.nonce
+	s.serverFirst = "r=" + s.nonce +
+		",s=" + base64.StdEncoding.EncodeToString(s.salt) +
+		",i=" + strconv.Itoa(scramIterations)
+	return s.serverFirst, nil
+}
+
+// final reads the client-final-message and returns the server-final-message,
+// or an error if the proof of the client is wrong
+func (s *scram) final(clientFinal string) (string, error) {
+	i := strings.LastIndex(clientFinal, ",p=")
+	if i < 0 {
+		return "", errSCRAM
+	}
+	withoutProof := clientFinal[:i]
+	proof, err := base64.StdEncoding.DecodeString(clientFinal[i+3:])
+	if err != nil {
+		return "", errSCRAM
+	}
+	if scramAttribute(withoutProof, 'r') != s.nonce {
+		return "", errSCRAM
+	}
+
+	salted := pbkdf2SHA256([]byte(s.password), s.salt, scramIterations)
+	clientKey := hmacSHA256(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	authMessage := s.clientFirstBare + "," + s.serverFirst + "," + withoutProof
+	signature := hmacSHA256(storedKey[:], authMessage)
+	if len(proof) != len(signature) {
+		return "", errSCRAM
+	}
+	for i := range signature {
+		signature[i] ^= proof[i]
+	}
+	if subtle.ConstantTimeCompare(signature, clientKey) != 1 {
+		return "", errors.New("wrong password")
+	}
+
+	serverKey := hmacSHA256(salted, "Server Key")
+	return "v=" + base64.StdEncoding.EncodeToString(hmacSHA256(serverKey, authMessage)), nil
+}
+
+// scramAttribute returns the value of an attribute of a SCRAM message
+func scramAttribute(msg string, name byte) string {
+	for _, attr := range strings.Split(msg, ",") {
+		if len(attr) >= 2 && attr[0] == name && attr[1] == '=' {
+			return attr[2:]
+		}
+	}
+	return ""
+}
+
+// hmacSHA256 returns the HMAC-SHA-256 of a message
+func hmacSHA256(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+// pbkdf2SHA256 derives a key of one block from a password with PBKDF2
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write(binary.BigEndian.AppendUint32(nil, 1))
+	u := mac.Sum(nil)
+	key := append([]byte(nil), u...)
+	for n := 1; n < iterations; n++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for i := range key {
+			key[i] ^= u[i]
+		}
+	}
+	return key
+}
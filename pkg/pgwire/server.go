@@ -0,0 +1,167 @@
+// Package pgwire serves secure databases over the PostgreSQL frontend/backend
+// protocol (version 3), so that PostgreSQL clients can query them. Clients log
+// in as users of an auth provider, and every statement runs through the checks
+// of a secure database handle of the user.
+package pgwire
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/auth"
+	"github.com/wemcdonald/secure_sqlite/pkg/secure_sqlite"
+)
+
+// ErrServerClosed is returned by Serve after Close
+var ErrServerClosed = errors.New("pgwire: server closed")
+
+// options configures a server
+type options struct {
+	tokens     func(username string) (string, bool)
+	tlsConfig  *tls.Config
+	handleOpts []secure_sqlite.Option
+}
+
+// Option configures a server
+type Option func(o *options)
+
+// WithSCRAM authenticates clients with SCRAM-SHA-256 instead of cleartext
+// passwords. SCRAM proves that the client knows the token of a user without
+// sending it, so the server must be able to look tokens up.
+func WithSCRAM(tokens func(username string) (token string, ok bool)) Option {
+	return func(o *options) {
+		o.tokens = tokens
+	}
+}
+
+// WithTLS accepts TLS connections of clients that request them
+func WithTLS(config *tls.Config) Option {
+	return func(o *options) {
+		o.tlsConfig = config
+	}
+}
+
+// WithHandleOptions applies options to the handles of every session
+func WithHandleOptions(opts ...secure_sqlite.Option) Option {
+	return func(o *options) {
+		o.handleOpts = append(o.handleOpts, opts...)
+	}
+}
+
+// Server serves a secure database to PostgreSQL clients
+type Server struct {
+	dsn          string
+	authProvider auth.Provider
+	opts         options
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// NewServer returns a server of a database whose clients log in as users of
+// an auth provider, with their tokens as passwords
+func NewServer(dataSourceName string, authProvider auth.Provider, opts ...Option) *Server {
+	s := &Server{
+		dsn:          dataSourceName,
+		authProvider: authProvider,
+		listeners:    make(map[net.Listener]struct{}),
+		conns:        make(map[net.Conn]struct{}),
+	}
+	for _, opt := range opts {
+		opt(&s.opts)
+	}
+	return s
+}
+
+// ListenAndServe listens on a TCP address and serves clients
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve serves the clients of a listener until the server is closed
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.listeners[ln] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, ln)
+		s.mu.Unlock()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go func() {
+			defer s.untrack(conn)
+			newSession(s, conn).serve()
+		}()
+	}
+}
+
+// track records an open connection, unless the server is closed
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+// untrack closes a connection and forgets it
+func (s *Server) untrack(conn net.Conn) {
+	conn.Close()
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.wg.Done()
+}
+
+// Close stops the listeners, closes the connections of clients and waits for
+// their sessions to end
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var firstErr error
+	for ln := range s.listeners {
+		if err := ln.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return firstErr
+}
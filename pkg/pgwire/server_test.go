@@ -0,0 +1,484 @@
+package pgwire
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/wemcdonald/secure_sqlite/pkg/auth"
+	"github.com/wemcdonald/secure_sqlite/pkg/internal/servertest"
+	"github.com/wemcdonald/secure_sqlite/pkg/secure_sqlite"
+)
+
+// testClient is a minimal PostgreSQL client
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// result is what the server sent for a query, up to ReadyForQuery
+type result struct {
+	rows   [][]string
+	fields []string
+	tags   []string
+	errors []string
+	status byte
+}
+
+// dial connects to a server and sends the startup packet of a user
+func dial(t *testing.T, addr, username string) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+
+	payload := binary.BigEndian.AppendUint32(nil, protocolVersion)
+	payload = append(payload, "user\x00"+username+"\x00\x00"...)
+	packet := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+4))
+	if _, err := conn.Write(append(packet, payload...)); err != nil {
+		t.Fatalf("Failed to send startup packet: %v", err)
+	}
+	return c
+}
+
+// send sends a message
+func (c *testClient) send(m *message) {
+	c.t.Helper()
+	if _, err := c.conn.Write(m.encode()); err != nil {
+		c.t.Fatalf("Failed to send message: %v", err)
+	}
+}
+
+// receive reads a message, skipping notices and parameter statuses
+func (c *testClient) receive() (byte, *buffer) {
+	c.t.Helper()
+	for {
+		typ, b, err := readMessage(c.r)
+		if err != nil {
+			c.t.Fatalf("Failed to read message: %v", err)
+		}
+		if typ != 'N' && typ != 'S' && typ != 'K' {
+			return typ, b
+		}
+	}
+}
+
+// login answers a cleartext password request, and returns the SQLSTATE of the
+// error if the login fails
+func (c *testClient) login(password string) string {
+	c.t.Helper()
+	typ, b := c.receive()
+	if typ != 'R' || b.int32() != 3 {
+		c.t.Fatalf("Expected cleartext password request, got %q", typ)
+	}
+	c.send(newMessage('p').string(password))
+	return c.ready()
+}
+
+// ready reads the end of a login, and returns the SQLSTATE of its error
+func (c *testClient) ready() string {
+	c.t.Helper()
+	for {
+		typ, b := c.receive()
+		switch typ {
+		case 'E':
+			return errorFields(b)['C']
+		case 'Z':
+			return ""
+		}
+	}
+}
+
+// query runs a simple query
+func (c *testClient) query(query string) result {
+	c.t.Helper()
+	c.send(newMessage('Q').string(query))
+	return c.results()
+}
+
+// results reads messages up to ReadyForQuery
+func (c *testClient) results() result {
+	c.t.Helper()
+	var res result
+	for {
+		typ, b := c.receive()
+		switch typ {
+		case 'T':
+			res.fields = nil
+			for n := b.int16(); n > 0; n-- {
+				res.fields = append(res.fields, b.string())
+				b.take(18)
+			}
+		case 'D':
+			var row []string
+			for n := b.int16(); n > 0; n-- {
+				size := b.int32()
+				if size < 0 {
+					row = append(row, "NULL")
+					continue
+				}
+				row = append(row, string(b.take(int(size))))
+			}
+			res.rows = append(res.rows, row)
+		case 'C':
+			res.tags = append(res.tags, b.string())
+		case 's':
+			res.tags = append(res.tags, "suspended")
+		case 'E':
+			res.errors = append(res.errors, errorFields(b)['C'])
+		case 'Z':
+			res.status = b.byte()
+			return res
+		}
+	}
+}
+
+// errorFields parses the fields of an ErrorResponse
+func errorFields(b *buffer) map[byte]string {
+	fields := make(map[byte]string)
+	for {
+		code := b.byte()
+		if code == 0 || b.err != nil {
+			return fields
+		}
+		fields[code] = b.string()
+	}
+}
+
+// startServer serves the servertest database
+func startServer(t *testing.T, opts ...Option) (string, *auth.MemoryProvider) {
+	t.Helper()
+	path, mockAuth := servertest.Database(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := NewServer(path, mockAuth, opts...)
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+	return ln.Addr().String(), mockAuth
+}
+
+func TestServer(t *testing.T) {
+	addr, _ := startServer(t)
+
+	// Logins are authenticated by the auth provider
+	if state := dial(t, addr, "clerk").login("wrong"); state != "28P01" {
+		t.Errorf("Expected SQLSTATE 28P01 for wrong password, got %q", state)
+	}
+	c := dial(t, addr, "clerk")
+	if state := c.login("clerktoken"); state != "" {
+		t.Fatalf("Login failed with SQLSTATE %s", state)
+	}
+
+	// Simple queries run through the checks of the user
+	res := c.query("INSERT INTO orders (item) VALUES ('book'); INSERT INTO orders (item) VALUES ('pen')")
+	if want := []string{"INSERT 0 1", "INSERT 0 1"}; !reflect.DeepEqual(res.tags, want) {
+		t.Errorf("Expected tags %v, got %v (errors %v)", want, res.tags, res.errors)
+	}
+	res = c.query("SELECT id, item FROM orders ORDER BY id")
+	if want := [][]string{{"1", "book"}, {"2", "pen"}}; !reflect.DeepEqual(res.rows, want) {
+		t.Errorf("Expected rows %v, got %v", want, res.rows)
+	}
+	if want := []string{"id", "item"}; !reflect.DeepEqual(res.fields, want) {
+		t.Errorf("Expected fields %v, got %v", want, res.fields)
+	}
+	if len(res.tags) != 1 || res.tags[0] != "SELECT 2" {
+		t.Errorf("Expected tag SELECT 2, got %v", res.tags)
+	}
+
+	// Errors of the database map to SQLSTATE codes
+	for query, want := range map[string]string{
+		"SELECT value FROM secrets":                       "42501",
+		"SELECT item FROM orders WHERE":                   "42601",
+		"SELEC item FROM orders":                          "0A000",
+		"INSERT INTO orders (id, item) VALUES (1, 'dup')": "23505",
+	} {
+		res := c.query(query)
+		if len(res.errors) != 1 || res.errors[0] != want {
+			t.Errorf("Expected SQLSTATE %s for %q, got %v", want, query, res.errors)
+		}
+		if res.status != 'I' {
+			t.Errorf("Expected idle status after error, got %q", res.status)
+		}
+	}
+	if res := c.query(";"); len(res.errors) != 0 || res.status != 'I' {
+		t.Errorf("Expected empty query to succeed, got %v", res.errors)
+	}
+
+	// A failed statement aborts the transaction it runs in
+	res = c.query("BEGIN")
+	if res.status != 'T' {
+		t.Errorf("Expected transaction status, got %q", res.status)
+	}
+	c.query("INSERT INTO orders (item) VALUES ('lamp')")
+	res = c.query("SELECT value FROM secrets")
+	if res.status != 'E' {
+		t.Errorf("Expected failed transaction status, got %q", res.status)
+	}
+	res = c.query("SELECT item FROM orders")
+	if len(res.errors) != 1 || res.errors[0] != "25P02" {
+		t.Errorf("Expected SQLSTATE 25P02 in failed transaction, got %v", res.errors)
+	}
+	res = c.query("COMMIT")
+	if len(res.tags) != 1 || res.tags[0] != "ROLLBACK" || res.status != 'I' {
+		t.Errorf("Expected COMMIT of failed transaction to roll back, got %v %q", res.tags, res.status)
+	}
+	res = c.query("SELECT item FROM orders")
+	if len(res.rows) != 2 {
+		t.Errorf("Expected rolled back insert to be undone, got %v", res.rows)
+	}
+
+	// Committed transactions keep their changes
+	res = c.query("BEGIN; UPDATE orders SET item = 'novel' WHERE id = 1; COMMIT")
+	if want := []string{"BEGIN", "UPDATE 1", "COMMIT"}; !reflect.DeepEqual(res.tags, want) {
+		t.Errorf("Expected tags %v, got %v (errors %v)", want, res.tags, res.errors)
+	}
+	res = c.query("SELECT item FROM orders WHERE id = 1")
+	if len(res.rows) != 1 || res.rows[0][0] != "novel" {
+		t.Errorf("Expected committed update, got %v", res.rows)
+	}
+}
+
+func TestExtendedQuery(t *testing.T) {
+	addr, _ := startServer(t)
+	c := dial(t, addr, "clerk")
+	if state := c.login("clerktoken"); state != "" {
+		t.Fatalf("Login failed with SQLSTATE %s", state)
+	}
+	c.query("INSERT INTO orders (item) VALUES ('book'), ('pen'), ('lamp')")
+
+	// Parse with an int8 parameter, and describe the statement
+	c.send(newMessage('P').string("by_id").string("SELECT id, item FROM orders WHERE id >= $1 ORDER BY id").int16(1).int32(oidInt8))
+	c.send(newMessage('D').byte('S').string("by_id"))
+	c.send(newMessage('S'))
+	if typ, _ := c.receive(); typ != '1' {
+		t.Fatalf("Expected ParseComplete, got %q", typ)
+	}
+	typ, b := c.receive()
+	if typ != 't' || b.int16() != 1 || b.int32() != oidInt8 {
+		t.Fatalf("Expected ParameterDescription of an int8 parameter, got %q", typ)
+	}
+	typ, b = c.receive()
+	if typ != 'T' || b.int16() != 2 || b.string() != "id" {
+		t.Fatalf("Expected RowDescription, got %q", typ)
+	}
+	b.take(6)
+	if oid := b.int32(); oid != oidInt8 {
+		t.Errorf("Expected id to be int8, got %d", oid)
+	}
+	if res := c.results(); len(res.errors) != 0 {
+		t.Fatalf("Describe failed with %v", res.errors)
+	}
+
+	// Bind a binary parameter, and fetch binary results two rows at a time
+	param := binary.BigEndian.AppendUint64(nil, 2)
+	c.send(newMessage('B').string("").string("by_id").
+		int16(1).int16(formatBinary).
+		int16(1).value(param).
+		int16(2).int16(formatBinary).int16(formatText))
+	c.send(newMessage('E').string("").int32(1))
+	c.send(newMessage('E').string("").int32(0))
+	c.send(newMessage('S'))
+	if typ, _ := c.receive(); typ != '2' {
+		t.Fatalf("Expected BindComplete, got %q", typ)
+	}
+	res := c.results()
+	if want := []string{"suspended", "SELECT 2"}; !reflect.DeepEqual(res.tags, want) {
+		t.Errorf("Expected tags %v, got %v (errors %v)", want, res.tags, res.errors)
+	}
+	if len(res.rows) != 2 {
+		t.Fatalf("Expected 2 rows, got %v", res.rows)
+	}
+	if id := binary.BigEndian.Uint64([]byte(res.rows[0][0])); id != 2 || res.rows[0][1] != "pen" {
+		t.Errorf("Expected row (2, pen), got (%d, %s)", id, res.rows[0][1])
+	}
+
+	// Statements that change rows take text parameters
+	c.send(newMessage('P').string("").string("UPDATE orders SET item = $2 WHERE id = $1").int16(0))
+	c.send(newMessage('B').string("").string("").int16(0).int16(2).value([]byte("3")).value([]byte("desk")).int16(0))
+	c.send(newMessage('D').byte('P').string(""))
+	c.send(newMessage('E').string("").int32(0))
+	c.send(newMessage('S'))
+	for _, want := range []byte{'1', '2', 'n'} {
+		if typ, _ := c.receive(); typ != want {
+			t.Fatalf("Expected %q, got %q", want, typ)
+		}
+	}
+	if res := c.results(); len(res.tags) != 1 || res.tags[0] != "UPDATE 1" {
+		t.Errorf("Expected tag UPDATE 1, got %v (errors %v)", res.tags, res.errors)
+	}
+
+	// Errors skip the messages up to Sync
+	c.send(newMessage('P').string("").string("SELECT value FROM secrets").int16(0))
+	c.send(newMessage('B').string("").string("").int16(0).int16(0).int16(0))
+	c.send(newMessage('E').string("").int32(0))
+	c.send(newMessage('S'))
+	if typ, _ := c.receive(); typ != '1' {
+		t.Fatalf("Expected ParseComplete, got %q", typ)
+	}
+	typ, _ = c.receive()
+	if typ != '2' {
+		t.Fatalf("Expected BindComplete, got %q", typ)
+	}
+	res = c.results()
+	if len(res.errors) != 1 || res.errors[0] != "42501" || len(res.tags) != 0 {
+		t.Errorf("Expected SQLSTATE 42501, got errors %v and tags %v", res.errors, res.tags)
+	}
+	c.send(newMessage('B').string("").string("missing").int16(0).int16(0).int16(0))
+	c.send(newMessage('S'))
+	if res := c.results(); len(res.errors) != 1 || res.errors[0] != "26000" {
+		t.Errorf("Expected SQLSTATE 26000 for missing statement, got %v", res.errors)
+	}
+	if res := c.query("SELECT item FROM orders WHERE id = 3"); len(res.rows) != 1 || res.rows[0][0] != "desk" {
+		t.Errorf("Expected session to continue after error, got %v", res.rows)
+	}
+}
+
+// scramLogin runs the client side of a SCRAM-SHA-256 exchange, and returns the
+// SQLSTATE of the error if the login fails
+func (c *testClient) scramLogin(password string) string {
+	c.t.Helper()
+	typ, b := c.receive()
+	if typ != 'R' || b.int32() != 10 || b.string() != scramMechanism {
+		c.t.Fatalf("Expected SCRAM-SHA-256 request, got %q", typ)
+	}
+	clientFirstBare := "n=,r=clientnonce"
+	c.send(newMessage('p').string(scramMechanism).int32(len(clientFirstBare) + 3).bytes([]byte("n,," + clientFirstBare)))
+
+	typ, b = c.receive()
+	if typ != 'R' || b.int32() != 11 {
+		c.t.Fatalf("Expected SASLContinue, got %q", typ)
+	}
+	serverFirst := string(b.data)
+	salt, err := base64.StdEncoding.DecodeString(scramAttribute(serverFirst, 's'))
+	if err != nil || !strings.HasPrefix(scramAttribute(serverFirst, 'r'), "clientnonce") {
+		c.t.Fatalf("Invalid server-first-message %q", serverFirst)
+	}
+	withoutProof := "c=biws,r=" + scramAttribute(serverFirst, 'r')
+	authMessage := clientFirstBare + "," + serverFirst + "," + withoutProof
+	salted := pbkdf2SHA256([]byte(password), salt, scramIterations)
+	clientKey := hmacSHA256(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	proof := hmacSHA256(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	c.send(newMessage('p').bytes([]byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof))))
+
+	typ, b = c.receive()
+	switch {
+	case typ == 'E':
+		return errorFields(b)['C']
+	case typ != 'R' || b.int32() != 12:
+		c.t.Fatalf("Expected SASLFinal, got %q", typ)
+	}
+	serverKey := hmacSHA256(salted, "Server Key")
+	if want := "v=" + base64.StdEncoding.EncodeToString(hmacSHA256(serverKey, authMessage)); string(b.data) != want {
+		c.t.Errorf("Expected server signature %q, got %q", want, b.data)
+	}
+	return c.ready()
+}
+
+func TestSCRAM(t *testing.T) {
+	tokens := map[string]string{"clerk": "clerktoken"}
+	addr, _ := startServer(t, WithSCRAM(func(username string) (string, bool) {
+		token, ok := tokens[username]
+		return token, ok
+	}))
+
+	if state := dial(t, addr, "clerk").scramLogin("wrong"); state != "28P01" {
+		t.Errorf("Expected SQLSTATE 28P01 for wrong password, got %q", state)
+	}
+	if state := dial(t, addr, "nobody").scramLogin("clerktoken"); state != "28P01" {
+		t.Errorf("Expected SQLSTATE 28P01 for unknown user, got %q", state)
+	}
+	c := dial(t, addr, "clerk")
+	if state := c.scramLogin("clerktoken"); state != "" {
+		t.Fatalf("Login failed with SQLSTATE %s", state)
+	}
+	if res := c.query("SELECT count(*) FROM orders"); len(res.rows) != 1 || res.rows[0][0] != "0" {
+		t.Errorf("Expected count 0, got %v (errors %v)", res.rows, res.errors)
+	}
+}
+
+func TestSQLState(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&secure_sqlite.DBError{Code: "PERMISSION_DENIED"}, "42501"},
+		{&secure_sqlite.DBError{Code: "PARSE_ERROR"}, "42601"},
+		{&secure_sqlite.DBError{Code: "AUTH_ERROR"}, "28P01"},
+		{&secure_sqlite.DBError{Code: "UNSUPPORTED_QUERY"}, "0A000"},
+		{&secure_sqlite.DBError{Code: "TRANSACTION_ERROR"}, "25000"},
+		{&secure_sqlite.DBError{Code: "SOMETHING_ELSE"}, "XX000"},
+		{&secure_sqlite.DBError{Code: "QUERY_ERROR", Err: sqlite3.Error{
+			Code:         sqlite3.ErrConstraint,
+			ExtendedCode: sqlite3.ErrConstraintNotNull,
+		}}, "23502"},
+		{fmt.Errorf("wrapped: %w", &Error{Code: "34000"}), "34000"},
+		{fmt.Errorf("plain"), "XX000"},
+	}
+	for _, tt := range tests {
+		if got := SQLState(tt.err); got != tt.want {
+			t.Errorf("SQLState(%v) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestStatements(t *testing.T) {
+	tests := []struct {
+		query  string
+		pieces []string
+	}{
+		{"SELECT 1", []string{"SELECT 1"}},
+		{"SELECT 1; SELECT 2;", []string{"SELECT 1", "SELECT 2"}},
+		{"SELECT ';'; -- done;\n", []string{"SELECT ';'"}},
+		{"/* ; */ ;  ", nil},
+	}
+	for _, tt := range tests {
+		if got := splitStatements(tt.query); !reflect.DeepEqual(got, tt.pieces) {
+			t.Errorf("splitStatements(%q) = %q, want %q", tt.query, got, tt.pieces)
+		}
+	}
+
+	query, params, err := convertPlaceholders("SELECT '$1', a FROM t WHERE b = $2 AND c = $1")
+	if err != nil {
+		t.Fatalf("Failed to convert placeholders: %v", err)
+	}
+	if want := "SELECT '$1', a FROM t WHERE b = ? AND c = ?"; query != want {
+		t.Errorf("Expected %q, got %q", want, query)
+	}
+	if want := []int{2, 1}; !reflect.DeepEqual(params, want) {
+		t.Errorf("Expected parameters %v, got %v", want, params)
+	}
+
+	for query, want := range map[string]string{
+		"insert into t values (1)":       "INSERT 0 3",
+		"  (SELECT 1)":                   "SELECT 3",
+		"create unique index i on t (a)": "CREATE INDEX",
+		"-- note\nDELETE FROM t":         "DELETE 3",
+		"GRANT SELECT ON t TO clerk":     "GRANT",
+	} {
+		st, err := newStatement(query, nil)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", query, err)
+		}
+		if got := st.tag(3); got != want {
+			t.Errorf("Expected tag %q for %q, got %q", want, query, got)
+		}
+	}
+}
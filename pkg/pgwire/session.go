@@ -0,0 +1,816 @@
+package pgwire
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/secure_sqlite"
+)
+
+// serverVersion is the PostgreSQL version the server reports to clients
+const serverVersion = "14.0"
+
+// queryer runs the statements of a session
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// column is a column of the rows of a portal
+type column struct {
+	name string
+	oid  uint32
+}
+
+// portal is a bound statement of a session, with the rows it returned so far
+type portal struct {
+	statement *statement
+	args      []interface{}
+	formats   []int16
+	rows      *sql.Rows
+	columns   []column
+	sent      int64
+	done      bool
+}
+
+// format returns the format of a result column
+func (p *portal) format(i int) int16 {
+	switch len(p.formats) {
+	case 0:
+		return formatText
+	case 1:
+		return p.formats[0]
+	}
+	return p.formats[i]
+}
+
+// close closes the rows of the portal
+func (p *portal) close() {
+	if p.rows != nil {
+		p.rows.Close()
+		p.rows = nil
+	}
+}
+
+// session is the connection of a client. Its statements run on one connection
+// of the secure database driver as the user the client logged in as.
+type session struct {
+	server *Server
+	conn   net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+	ctx    context.Context
+	err    error
+
+	db      *sql.DB
+	sqlConn *sql.Conn
+	tx      *sql.Tx
+	// failed is set when a statement of the open transaction failed
+	failed bool
+	// skipping is set when an extended query message failed, until Sync
+	skipping bool
+
+	statements map[string]*statement
+	portals    map[string]*portal
+}
+
+// newSession starts the session of a client connection
+func newSession(server *Server, conn net.Conn) *session {
+	return &session{
+		server:     server,
+		conn:       conn,
+		r:          bufio.NewReader(conn),
+		w:          bufio.NewWriter(conn),
+		ctx:        context.Background(),
+		statements: make(map[string]*statement),
+		portals:    make(map[string]*portal),
+	}
+}
+
+// send queues a message for the client
+func (s *session) send(data []byte) {
+	if s.err == nil {
+		_, s.err = s.w.Write(data)
+	}
+}
+
+// flush sends the queued messages
+func (s *session) flush() {
+	if s.err == nil {
+		s.err = s.w.Flush()
+	}
+}
+
+// serve runs the session until the client disconnects
+func (s *session) serve() {
+	defer s.close()
+	if err := s.startup(); err != nil {
+		return
+	}
+	for s.err == nil {
+		typ, b, err := readMessage(s.r)
+		if err != nil {
+			return
+		}
+		if s.skipping && typ != 'S' && typ != 'X' {
+			continue
+		}
+		switch typ {
+		case 'Q':
+			s.simpleQuery(b.string())
+		case 'P':
+			s.parse(b)
+		case 'B':
+			s.bind(b)
+		case 'D':
+			s.describe(b)
+		case 'E':
+			s.execute(b)
+		case 'C':
+			s.closeObject(b)
+		case 'S':
+			s.sync()
+		case 'H':
+			s.flush()
+		case 'X':
+			return
+		default:
+			s.fatal(&Error{
+				Code:    stateProtocolViolation,
+				Message: fmt.Sprintf("unsupported message type %q", typ),
+			})
+			return
+		}
+	}
+}
+
+// close ends the session, rolling back its open transaction
+func (s *session) close() {
+	for _, p := range s.portals {
+		p.close()
+	}
+	if s.tx != nil {
+		s.tx.Rollback()
+	}
+	if s.sqlConn != nil {
+		s.sqlConn.Close()
+	}
+	if s.db != nil {
+		s.db.Close()
+	}
+}
+
+// fatal reports an error that ends the session
+func (s *session) fatal(err error) {
+	s.send(errorResponse("FATAL", err))
+	s.flush()
+}
+
+// startup negotiates encryption, authenticates the client and opens its
+// connection
+func (s *session) startup() error {
+	for {
+		code, b, err := readStartup(s.r)
+		if err != nil {
+			return err
+		}
+		switch code {
+		case sslRequestCode:
+			if _, ok := s.conn.(*tls.Conn); ok || s.server.opts.tlsConfig == nil {
+				s.send([]byte{'N'})
+				s.flush()
+				continue
+			}
+			s.send([]byte{'S'})
+			s.flush()
+			conn := tls.Server(s.conn, s.server.opts.tlsConfig)
+			if err := conn.Handshake(); err != nil {
+				return err
+			}
+			s.conn, s.r, s.w = conn, bufio.NewReader(conn), bufio.NewWriter(conn)
+			continue
+		case gssEncRequestCode:
+			s.send([]byte{'N'})
+			s.flush()
+			continue
+		case cancelRequestCode:
+			return errors.New("cancel requests are not supported")
+		case protocolVersion:
+		default:
+			err := &Error{
+				Code:    stateFeatureNotSupported,
+				Message: fmt.Sprintf("unsupported protocol version %d.%d", code>>16, code&0xffff),
+			}
+			s.fatal(err)
+			return err
+		}
+
+		params := make(map[string]string)
+		for {
+			key := b.string()
+			if key == "" || b.err != nil {
+				break
+			}
+			params[key] = b.string()
+		}
+		if err := s.login(params); err != nil {
+			s.fatal(err)
+			return err
+		}
+		return s.err
+	}
+}
+
+// login authenticates the user of the startup parameters and opens the
+// connection the statements of the session run on
+func (s *session) login(params map[string]string) error {
+	username := params["user"]
+	if username == "" {
+		return &Error{Code: "28000", Message: "no user name given"}
+	}
+	token, err := s.authenticate(username)
+	if err != nil {
+		return err
+	}
+
+	// The handle of the user authenticates the token with the auth provider
+	connector := secure_sqlite.NewConnector(s.server.dsn, s.server.authProvider, username, token, s.server.opts.handleOpts...)
+	s.db = sql.OpenDB(connector)
+	s.sqlConn, err = s.db.Conn(s.ctx)
+	if err == nil {
+		err = s.sqlConn.PingContext(s.ctx)
+	}
+	var dbErr *secure_sqlite.DBError
+	if errors.As(err, &dbErr) && dbErr.Code == "AUTH_ERROR" {
+		return authFailed(username)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.send(newMessage('R').int32(0).encode())
+	for _, status := range [][2]string{
+		{"server_version", serverVersion},
+		{"server_encoding", "UTF8"},
+		{"client_encoding", "UTF8"},
+		{"DateStyle", "ISO, MDY"},
+		{"TimeZone", "UTC"},
+		{"integer_datetimes", "on"},
+		{"standard_conforming_strings", "on"},
+		{"application_name", params["application_name"]},
+		{"session_authorization", username},
+	} {
+		s.send(newMessage('S').string(status[0]).string(status[1]).encode())
+	}
+	var key [8]byte
+	rand.Read(key[:])
+	s.send(newMessage('K').bytes(key[:]).encode())
+	s.readyForQuery()
+	return nil
+}
+
+// authFailed returns the error of a failed login, which does not tell whether
+// the user exists
+func authFailed(username string) error {
+	return &Error{
+		Code:    stateInvalidPassword,
+		Message: fmt.Sprintf("password authentication failed for user %q", username),
+	}
+}
+
+// authenticate asks the client for the token of a user, with SCRAM when the
+// server can look tokens up and as a cleartext password otherwise
+func (s *session) authenticate(username string) (string, error) {
+	if s.server.opts.tokens == nil {
+		s.send(newMessage('R').int32(3).encode())
+		s.flush()
+		b, err := s.readPassword()
+		if err != nil {
+			return "", err
+		}
+		return b.string(), b.err
+	}
+
+	token, ok := s.server.opts.tokens(username)
+	if !ok {
+		// Go through the exchange with a random password, so that it fails
+		// the same way as for a wrong password
+		random := make([]byte, 32)
+		rand.Read(random)
+		token = string(random)
+	}
+	exchange, err := newSCRAM(token)
+	if err != nil {
+		return "", err
+	}
+	s.send(newMessage('R').int32(10).string(scramMechanism).byte(0).encode())
+	s.flush()
+
+	b, err := s.readPassword()
+	if err != nil {
+		return "", err
+	}
+	mechanism := b.string()
+	clientFirst := b.take(int(b.int32()))
+	if b.err != nil || mechanism != scramMechanism {
+		return "", &Error{Code: stateProtocolViolation, Message: "unsupported SASL mechanism"}
+	}
+	serverFirst, err := exchange.first(string(clientFirst))
+	if err != nil {
+		return "", &Error{Code: stateProtocolViolation, Message: err.Error()}
+	}
+	s.send(newMessage('R').int32(11).bytes([]byte(serverFirst)).encode())
+	s.flush()
+
+	b, err = s.readPassword()
+	if err != nil {
+		return "", err
+	}
+	serverFinal, err := exchange.final(string(b.data))
+	if err != nil || !ok {
+		return "", authFailed(username)
+	}
+	s.send(newMessage('R').int32(12).bytes([]byte(serverFinal)).encode())
+	return token, nil
+}
+
+// readPassword reads a password or SASL message of the client
+func (s *session) readPassword() (*buffer, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	typ, b, err := readMessage(s.r)
+	if err != nil {
+		return nil, err
+	}
+	if typ != 'p' {
+		return nil, &Error{
+			Code:    stateProtocolViolation,
+			Message: fmt.Sprintf("expected password message, got %q", typ),
+		}
+	}
+	return b, nil
+}
+
+// readyForQuery tells the client that the session is ready for a query, and
+// the state of its transaction
+func (s *session) readyForQuery() {
+	status := byte('I')
+	if s.tx != nil {
+		status = 'T'
+		if s.failed {
+			status = 'E'
+		}
+	}
+	s.send(newMessage('Z').byte(status).encode())
+	s.flush()
+}
+
+// executor returns what runs the statements of the session: its open
+// transaction or its connection
+func (s *session) executor() queryer {
+	if s.tx != nil {
+		return s.tx
+	}
+	return s.sqlConn
+}
+
+// statementError reports the error of a statement, which fails the open
+// transaction
+func (s *session) statementError(err error) {
+	if s.tx != nil {
+		s.failed = true
+	}
+	s.send(errorResponse("ERROR", err))
+}
+
+// notice sends a warning to the client
+func (s *session) notice(code, msg string) {
+	s.send(newMessage('N').
+		byte('S').string("WARNING").
+		byte('V').string("WARNING").
+		byte('C').string(code).
+		byte('M').string(msg).
+		byte(0).encode())
+}
+
+// simpleQuery runs the statements of a query string
+func (s *session) simpleQuery(query string) {
+	statements := splitStatements(query)
+	if len(statements) == 0 {
+		s.send(newMessage('I').encode())
+	}
+	for _, query := range statements {
+		st, err := newStatement(query, nil)
+		if err == nil && len(st.params) > 0 {
+			err = &Error{Code: stateProtocolViolation, Message: "query string has parameters"}
+		}
+		if err == nil {
+			p := &portal{statement: st}
+			if err = s.describePortal(p, false); err == nil {
+				err = s.run(p, 0)
+			}
+			p.close()
+		}
+		if err != nil {
+			s.statementError(err)
+			break
+		}
+	}
+	s.readyForQuery()
+}
+
+// extendedError reports the error of an extended query message, and skips
+// the messages that follow until Sync
+func (s *session) extendedError(err error) {
+	s.statementError(err)
+	s.skipping = true
+}
+
+// parse prepares a statement
+func (s *session) parse(b *buffer) {
+	name, query := b.string(), b.string()
+	paramTypes := make([]uint32, b.int16())
+	for i := range paramTypes {
+		paramTypes[i] = uint32(b.int32())
+	}
+	if b.err != nil {
+		s.extendedError(&Error{Code: stateProtocolViolation, Message: "malformed Parse message"})
+		return
+	}
+	if _, ok := s.statements[name]; ok && name != "" {
+		s.extendedError(&Error{
+			Code:    stateDuplicateStatement,
+			Message: fmt.Sprintf("prepared statement %q already exists", name),
+		})
+		return
+	}
+	statements := splitStatements(query)
+	if len(statements) > 1 {
+		s.extendedError(&Error{
+			Code:    "42601",
+			Message: "cannot insert multiple commands into a prepared statement",
+		})
+		return
+	}
+	if len(statements) == 1 {
+		query = statements[0]
+	}
+	st, err := newStatement(query, paramTypes)
+	if err != nil {
+		s.extendedError(err)
+		return
+	}
+	s.statements[name] = st
+	s.send(newMessage('1').encode())
+}
+
+// bind binds the parameters of a prepared statement to a portal
+func (s *session) bind(b *buffer) {
+	portalName, name := b.string(), b.string()
+	formats := make([]int16, b.int16())
+	for i := range formats {
+		formats[i] = b.int16()
+	}
+	values := make([][]byte, b.int16())
+	for i := range values {
+		if n := b.int32(); n >= 0 {
+			values[i] = b.take(int(n))
+		}
+	}
+	resultFormats := make([]int16, b.int16())
+	for i := range resultFormats {
+		resultFormats[i] = b.int16()
+	}
+	if b.err != nil {
+		s.extendedError(&Error{Code: stateProtocolViolation, Message: "malformed Bind message"})
+		return
+	}
+	st, ok := s.statements[name]
+	if !ok {
+		s.extendedError(&Error{
+			Code:    stateUndefinedStatement,
+			Message: fmt.Sprintf("prepared statement %q does not exist", name),
+		})
+		return
+	}
+	if len(values) != len(st.paramTypes) {
+		s.extendedError(&Error{
+			Code:    stateProtocolViolation,
+			Message: fmt.Sprintf("bind message supplies %d parameters, but prepared statement requires %d", len(values), len(st.paramTypes)),
+		})
+		return
+	}
+
+	// Decode the parameters, and pass them in the order of the placeholders
+	params := make([]interface{}, len(values))
+	for i, value := range values {
+		format := int16(formatText)
+		switch len(formats) {
+		case 1:
+			format = formats[0]
+		case len(values):
+			format = formats[i]
+		}
+		param, err := decodeParameter(value, st.paramTypes[i], format)
+		if err != nil {
+			s.extendedError(&Error{
+				Code:    stateInvalidParameter,
+				Message: fmt.Sprintf("invalid value for parameter $%d: %v", i+1, err),
+			})
+			return
+		}
+		params[i] = param
+	}
+	args := make([]interface{}, len(st.params))
+	for i, n := range st.params {
+		args[i] = params[n-1]
+	}
+
+	if p, ok := s.portals[portalName]; ok {
+		p.close()
+	}
+	s.portals[portalName] = &portal{statement: st, args: args, formats: resultFormats}
+	s.send(newMessage('2').encode())
+}
+
+// describe describes the parameters and rows of a statement, or the rows of
+// a portal
+func (s *session) describe(b *buffer) {
+	kind, name := b.byte(), b.string()
+	if b.err != nil {
+		s.extendedError(&Error{Code: stateProtocolViolation, Message: "malformed Describe message"})
+		return
+	}
+	switch kind {
+	case 'S':
+		st, ok := s.statements[name]
+		if !ok {
+			s.extendedError(&Error{
+				Code:    stateUndefinedStatement,
+				Message: fmt.Sprintf("prepared statement %q does not exist", name),
+			})
+			return
+		}
+		m := newMessage('t').int16(len(st.paramTypes))
+		for _, oid := range st.paramTypes {
+			if oid == 0 {
+				oid = oidText
+			}
+			m.int32(int(oid))
+		}
+		s.send(m.encode())
+
+		// Run the query without parameters to find its columns; its rows are
+		// not read
+		p := &portal{statement: st, args: make([]interface{}, len(st.params))}
+		err := s.describePortal(p, true)
+		p.close()
+		if err != nil {
+			s.extendedError(err)
+		}
+	case 'P':
+		p, ok := s.portals[name]
+		if !ok {
+			s.extendedError(&Error{
+				Code:    stateUndefinedPortal,
+				Message: fmt.Sprintf("portal %q does not exist", name),
+			})
+			return
+		}
+		if err := s.describePortal(p, true); err != nil {
+			s.extendedError(err)
+		}
+	default:
+		s.extendedError(&Error{Code: stateProtocolViolation, Message: "malformed Describe message"})
+	}
+}
+
+// describePortal runs the query of a portal, and sends the description of its
+// rows. Statements that return no rows are described with NoData, if noData
+// is set.
+func (s *session) describePortal(p *portal, noData bool) error {
+	if !p.statement.returnsRows() || s.failed {
+		if noData {
+			s.send(newMessage('n').encode())
+		}
+		return nil
+	}
+	if p.rows == nil && !p.done {
+		if err := s.open(p); err != nil {
+			return err
+		}
+	}
+	m := newMessage('T').int16(len(p.columns))
+	for i, c := range p.columns {
+		m.string(c.name).
+			int32(0).int16(0).
+			int32(int(c.oid)).int16(typeSize(c.oid)).int32(-1).
+			int16(int(p.format(i)))
+	}
+	s.send(m.encode())
+	return nil
+}
+
+// open runs the query of a portal
+func (s *session) open(p *portal) error {
+	rows, err := s.executor().QueryContext(s.ctx, p.statement.query, p.args...)
+	if err != nil {
+		return err
+	}
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		rows.Close()
+		return err
+	}
+	p.columns = make([]column, len(types))
+	for i, t := range types {
+		p.columns[i] = column{name: t.Name(), oid: typeOID(t.DatabaseTypeName())}
+	}
+	p.rows = rows
+	return nil
+}
+
+// execute runs a portal
+func (s *session) execute(b *buffer) {
+	name, maxRows := b.string(), b.int32()
+	if b.err != nil {
+		s.extendedError(&Error{Code: stateProtocolViolation, Message: "malformed Execute message"})
+		return
+	}
+	p, ok := s.portals[name]
+	if !ok {
+		s.extendedError(&Error{
+			Code:    stateUndefinedPortal,
+			Message: fmt.Sprintf("portal %q does not exist", name),
+		})
+		return
+	}
+	if err := s.run(p, int64(maxRows)); err != nil {
+		s.extendedError(err)
+	}
+}
+
+// run runs the statement of a portal, sending up to maxRows of its rows when
+// maxRows is positive
+func (s *session) run(p *portal, maxRows int64) error {
+	st := p.statement
+	switch st.command() {
+	case "":
+		s.send(newMessage('I').encode())
+		return nil
+	case "BEGIN", "START", "COMMIT", "END", "ROLLBACK", "ABORT":
+		return s.transaction(st)
+	case "SET", "RESET":
+		// Session settings of clients have no effect
+		s.send(newMessage('C').string(st.command()).encode())
+		return nil
+	}
+	if s.failed {
+		return &Error{
+			Code:    stateTransactionAborted,
+			Message: "current transaction is aborted, commands ignored until end of transaction block",
+		}
+	}
+
+	if !st.returnsRows() {
+		result, err := s.executor().ExecContext(s.ctx, st.query, p.args...)
+		if err != nil {
+			return err
+		}
+		affected, _ := result.RowsAffected()
+		s.send(newMessage('C').string(st.tag(affected)).encode())
+		return nil
+	}
+
+	if p.rows == nil && !p.done {
+		if err := s.open(p); err != nil {
+			return err
+		}
+	}
+	if p.rows != nil {
+		values := make([]interface{}, len(p.columns))
+		pointers := make([]interface{}, len(values))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		for n := int64(0); maxRows <= 0 || n < maxRows; n++ {
+			if !p.rows.Next() {
+				err := p.rows.Err()
+				p.close()
+				p.done = true
+				if err != nil {
+					return err
+				}
+				break
+			}
+			if err := p.rows.Scan(pointers...); err != nil {
+				p.close()
+				return err
+			}
+			m := newMessage('D').int16(len(values))
+			for i, value := range values {
+				data, err := encodeValue(value, p.columns[i].oid, p.format(i))
+				if err != nil {
+					p.close()
+					return &Error{
+						Code:    stateInvalidParameter,
+						Message: fmt.Sprintf("column %s: %v", p.columns[i].name, err),
+					}
+				}
+				m.value(data)
+			}
+			s.send(m.encode())
+			p.sent++
+		}
+		if !p.done {
+			s.send(newMessage('s').encode())
+			return nil
+		}
+	}
+	s.send(newMessage('C').string(st.tag(p.sent)).encode())
+	return nil
+}
+
+// transaction runs a transaction control statement
+func (s *session) transaction(st *statement) error {
+	tag := st.command()
+	switch tag {
+	case "BEGIN", "START":
+		tag = "BEGIN"
+		if s.tx != nil {
+			s.notice("25001", "there is already a transaction in progress")
+			break
+		}
+		tx, err := s.sqlConn.BeginTx(s.ctx, nil)
+		if err != nil {
+			return err
+		}
+		s.tx, s.failed = tx, false
+	case "COMMIT", "END", "ROLLBACK", "ABORT":
+		commit := tag == "COMMIT" || tag == "END"
+		if len(st.keywords) > 1 && st.keywords[1] == "TO" {
+			return &Error{Code: stateFeatureNotSupported, Message: "savepoints are not supported"}
+		}
+		tag = "ROLLBACK"
+		if commit && !s.failed {
+			tag = "COMMIT"
+		}
+		if s.tx == nil {
+			s.notice("25P01", "there is no transaction in progress")
+			break
+		}
+		for _, p := range s.portals {
+			p.close()
+		}
+		tx := s.tx
+		s.tx, s.failed = nil, false
+		var err error
+		if tag == "COMMIT" {
+			err = tx.Commit()
+		} else {
+			err = tx.Rollback()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	s.send(newMessage('C').string(tag).encode())
+	return nil
+}
+
+// closeObject closes a prepared statement or portal
+func (s *session) closeObject(b *buffer) {
+	kind, name := b.byte(), b.string()
+	switch {
+	case b.err != nil:
+		s.extendedError(&Error{Code: stateProtocolViolation, Message: "malformed Close message"})
+		return
+	case kind == 'S':
+		delete(s.statements, name)
+	case kind == 'P':
+		if p, ok := s.portals[name]; ok {
+			p.close()
+			delete(s.portals, name)
+		}
+	}
+	s.send(newMessage('3').encode())
+}
+
+// sync ends an extended query. Portals end with the transaction they run in.
+func (s *session) sync() {
+	s.skipping = false
+	if s.tx == nil {
+		for name, p := range s.portals {
+			p.close()
+			delete(s.portals, name)
+		}
+	}
+	s.readyForQuery()
+}
@@ -0,0 +1,227 @@
+package pgwire
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// statement is a prepared statement of a session
+type statement struct {
+	// query is the statement with its $n placeholders replaced by ?
+	query string
+	// params holds the parameter number of each placeholder, in order
+	params []int
+	// paramTypes holds the type of each parameter, 0 when unspecified
+	paramTypes []uint32
+	// keywords are the first keywords of the statement, in upper case
+	keywords []string
+}
+
+// newStatement parses a statement with parameters of given types
+func newStatement(query string, paramTypes []uint32) (*statement, error) {
+	converted, params, err := convertPlaceholders(query)
+	if err != nil {
+		return nil, err
+	}
+	st := &statement{
+		query:      converted,
+		params:     params,
+		paramTypes: paramTypes,
+		keywords:   keywords(query, 3),
+	}
+	for _, n := range params {
+		for len(st.paramTypes) < n {
+			st.paramTypes = append(st.paramTypes, 0)
+		}
+	}
+	return st, nil
+}
+
+// command returns the first keyword of the statement
+func (st *statement) command() string {
+	if len(st.keywords) == 0 {
+		return ""
+	}
+	return st.keywords[0]
+}
+
+// returnsRows reports whether the statement is a query
+func (st *statement) returnsRows() bool {
+	switch st.command() {
+	case "SELECT", "WITH", "VALUES":
+		return true
+	}
+	return false
+}
+
+// tag returns the command tag of the statement after it changed a number of
+// rows
+func (st *statement) tag(rows int64) string {
+	switch command := st.command(); command {
+	case "INSERT":
+		return fmt.Sprintf("INSERT 0 %d", rows)
+	case "UPDATE", "DELETE":
+		return fmt.Sprintf("%s %d", command, rows)
+	case "SELECT", "WITH", "VALUES":
+		return fmt.Sprintf("SELECT %d", rows)
+	case "CREATE", "DROP", "ALTER":
+		for _, word := range st.keywords[1:] {
+			switch word {
+			case "UNIQUE", "TEMP", "TEMPORARY", "VIRTUAL":
+				continue
+			}
+			return command + " " + word
+		}
+		return command
+	default:
+		return command
+	}
+}
+
+// skip returns the end of the quoted string, identifier or comment that
+// starts at i, or i when none does
+func skip(query string, i int) int {
+	switch c := query[i]; c {
+	case '\'', '"', '`':
+		for j := i + 1; j < len(query); j++ {
+			if query[j] == c {
+				// Quotes are escaped by doubling them
+				if j+1 < len(query) && query[j+1] == c {
+					j++
+					continue
+				}
+				return j + 1
+			}
+		}
+		return len(query)
+	case '-':
+		if strings.HasPrefix(query[i:], "--") {
+			if end := strings.IndexByte(query[i:], '\n'); end >= 0 {
+				return i + end + 1
+			}
+			return len(query)
+		}
+	case '/':
+		if strings.HasPrefix(query[i:], "/*") {
+			if end := strings.Index(query[i+2:], "*/"); end >= 0 {
+				return i + 2 + end + 2
+			}
+			return len(query)
+		}
+	}
+	return i
+}
+
+// splitStatements splits a query string into its statements, leaving out
+// empty ones
+func splitStatements(query string) []string {
+	var statements []string
+	start := 0
+	for i := 0; i < len(query); {
+		if end := skip(query, i); end > i {
+			i = end
+			continue
+		}
+		if query[i] == ';' {
+			statements = appendStatement(statements, query[start:i])
+			start = i + 1
+		}
+		i++
+	}
+	return appendStatement(statements, query[start:])
+}
+
+// appendStatement appends a statement unless it is empty
+func appendStatement(statements []string, query string) []string {
+	if strings.TrimSpace(stripComments(query)) == "" {
+		return statements
+	}
+	return append(statements, strings.TrimSpace(query))
+}
+
+// stripComments removes the comments of a query
+func stripComments(query string) string {
+	var b strings.Builder
+	for i := 0; i < len(query); {
+		if end := skip(query, i); end > i {
+			if query[i] == '-' || query[i] == '/' {
+				b.WriteByte(' ')
+			} else {
+				b.WriteString(query[i:end])
+			}
+			i = end
+			continue
+		}
+		b.WriteByte(query[i])
+		i++
+	}
+	return b.String()
+}
+
+// keywords returns up to n leading words of a query in upper case, skipping
+// comments and parentheses
+func keywords(query string, n int) []string {
+	var words []string
+	query = stripComments(query)
+	for i := 0; i < len(query) && len(words) < n; {
+		c := query[i]
+		if !isWordChar(c) {
+			if c != '(' && c != ' ' && c != '\t' && c != '\n' && c != '\r' {
+				break
+			}
+			i++
+			continue
+		}
+		j := i
+		for j < len(query) && isWordChar(query[j]) {
+			j++
+		}
+		words = append(words, strings.ToUpper(query[i:j]))
+		i = j
+	}
+	return words
+}
+
+// isWordChar reports whether a byte can be part of a keyword
+func isWordChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// convertPlaceholders replaces the $n placeholders of PostgreSQL with the
+// positional placeholders of the secure database, and returns the parameter
+// number of each
+func convertPlaceholders(query string) (string, []int, error) {
+	if !strings.Contains(query, "$") {
+		return query, nil, nil
+	}
+	var b strings.Builder
+	var params []int
+	for i := 0; i < len(query); {
+		if end := skip(query, i); end > i {
+			b.WriteString(query[i:end])
+			i = end
+			continue
+		}
+		if query[i] == '$' && i+1 < len(query) && query[i+1] >= '0' && query[i+1] <= '9' {
+			j := i + 1
+			for j < len(query) && query[j] >= '0' && query[j] <= '9' {
+				j++
+			}
+			n, err := strconv.Atoi(query[i+1 : j])
+			if err != nil || n < 1 || n > 65535 {
+				return "", nil, &Error{
+					Code:    "42P02",
+					Message: fmt.Sprintf("invalid parameter %s", query[i:j]),
+				}
+			}
+			params = append(params, n)
+			b.WriteByte('?')
+			i = j
+			continue
+		}
+		b.WriteByte(query[i])
+		i++
+	}
+	return b.String(), params, nil
+}
@@ -0,0 +1,295 @@
+package pgwire
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Object IDs of the PostgreSQL types that SQLite values are sent as
+const (
+	oidBool      = 16
+	oidBytea     = 17
+	oidInt8      = 20
+	oidInt2      = 21
+	oidInt4      = 23
+	oidText      = 25
+	oidFloat4    = 700
+	oidFloat8    = 701
+	oidVarchar   = 1043
+	oidTimestamp = 1114
+)
+
+// Format codes of values
+const (
+	formatText   = 0
+	formatBinary = 1
+)
+
+// timestampLayout is the text format of timestamps
+const timestampLayout = "2006-01-02 15:04:05.999999"
+
+// postgresEpoch is the epoch of binary timestamps
+var postgresEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// typeOID returns the type a column of a declared SQLite type is sent as,
+// following the rules SQLite uses to find the affinity of a column
+func typeOID(declared string) uint32 {
+	declared = strings.ToUpper(declared)
+	switch {
+	case declared == "":
+		return oidText
+	case strings.Contains(declared, "INT"):
+		return oidInt8
+	case strings.Contains(declared, "CHAR"), strings.Contains(declared, "CLOB"), strings.Contains(declared, "TEXT"):
+		return oidText
+	case strings.Contains(declared, "BLOB"):
+		return oidBytea
+	case strings.Contains(declared, "BOOL"):
+		return oidBool
+	case strings.Contains(declared, "DATETIME"), strings.Contains(declared, "TIMESTAMP"):
+		return oidTimestamp
+	case strings.Contains(declared, "REAL"), strings.Contains(declared, "FLOA"), strings.Contains(declared, "DOUB"):
+		return oidFloat8
+	case strings.Contains(declared, "NUMERIC"), strings.Contains(declared, "DECIMAL"):
+		return oidFloat8
+	}
+	return oidText
+}
+
+// typeSize returns the size of a type, or -1 for types of variable size
+func typeSize(oid uint32) int {
+	switch oid {
+	case oidBool:
+		return 1
+	case oidInt8, oidFloat8, oidTimestamp:
+		return 8
+	}
+	return -1
+}
+
+// encodeValue encodes a value of a column of a type in a format. Binary values
+// are converted to the type of their column, since SQLite columns may hold
+// values of any type.
+func encodeValue(value interface{}, oid uint32, format int16) ([]byte, error) {
+	if value == nil {
+		return nil, nil
+	}
+	if format == formatText && oid != oidBytea {
+		return []byte(textValue(value)), nil
+	}
+	switch oid {
+	case oidInt8:
+		n, err := toInt(value)
+		if err != nil {
+			return nil, err
+		}
+		return binary.BigEndian.AppendUint64(nil, uint64(n)), nil
+	case oidFloat8:
+		f, err := toFloat(value)
+		if err != nil {
+			return nil, err
+		}
+		return binary.BigEndian.AppendUint64(nil, math.Float64bits(f)), nil
+	case oidBool:
+		b, err := toBool(value)
+		if err != nil {
+			return nil, err
+		}
+		if b {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	case oidBytea:
+		data := toBytes(value)
+		if format == formatText {
+			return []byte(`\x` + hex.EncodeToString(data)), nil
+		}
+		return data, nil
+	case oidTimestamp:
+		t, err := toTime(value)
+		if err != nil {
+			return nil, err
+		}
+		micros := t.Sub(postgresEpoch).Microseconds()
+		return binary.BigEndian.AppendUint64(nil, uint64(micros)), nil
+	}
+	return []byte(textValue(value)), nil
+}
+
+// textValue returns the text format of a value
+func textValue(value interface{}) string {
+	switch v := value.(type) {
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		if v {
+			return "t"
+		}
+		return "f"
+	case time.Time:
+		return v.UTC().Format(timestampLayout)
+	}
+	return fmt.Sprint(value)
+}
+
+// toInt converts a value to an integer
+func toInt(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case int64:
+		return v, nil
+	case float64:
+		if v == math.Trunc(v) {
+			return int64(v), nil
+		}
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case string, []byte:
+		return strconv.ParseInt(strings.TrimSpace(textValue(v)), 10, 64)
+	}
+	return 0, fmt.Errorf("cannot convert %v to an integer", value)
+}
+
+// toFloat converts a value to a float
+func toFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case string, []byte:
+		return strconv.ParseFloat(strings.TrimSpace(textValue(v)), 64)
+	}
+	return 0, fmt.Errorf("cannot convert %v to a float", value)
+}
+
+// toBool converts a value to a boolean
+func toBool(value interface{}) (bool, error) {
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case int64:
+		return v != 0, nil
+	case float64:
+		return v != 0, nil
+	case string, []byte:
+		switch strings.ToLower(strings.TrimSpace(textValue(v))) {
+		case "1", "t", "true", "y", "yes", "on":
+			return true, nil
+		case "0", "f", "false", "n", "no", "off":
+			return false, nil
+		}
+	}
+	return false, fmt.Errorf("cannot convert %v to a boolean", value)
+}
+
+// toBytes converts a value to bytes
+func toBytes(value interface{}) []byte {
+	if data, ok := value.([]byte); ok {
+		return data
+	}
+	return []byte(textValue(value))
+}
+
+// timeLayouts are the formats of timestamps stored as text
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// toTime converts a value to a time
+func toTime(value interface{}) (time.Time, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, nil
+	case int64:
+		return time.Unix(v, 0).UTC(), nil
+	case string, []byte:
+		s := strings.TrimSpace(textValue(v))
+		for _, layout := range timeLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t, nil
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot convert %v to a timestamp", value)
+}
+
+// decodeParameter decodes the value of a parameter of a type sent in a format.
+// Parameters of unknown types are passed to SQLite as text or bytes.
+func decodeParameter(data []byte, oid uint32, format int16) (interface{}, error) {
+	if data == nil {
+		return nil, nil
+	}
+	if format == formatText {
+		s := string(data)
+		switch oid {
+		case oidInt2, oidInt4, oidInt8:
+			return strconv.ParseInt(s, 10, 64)
+		case oidFloat4, oidFloat8:
+			return strconv.ParseFloat(s, 64)
+		case oidBool:
+			return toBool(s)
+		case oidBytea:
+			if strings.HasPrefix(s, `\x`) {
+				return hex.DecodeString(s[2:])
+			}
+			return data, nil
+		}
+		return s, nil
+	}
+
+	switch oid {
+	case oidInt2:
+		if len(data) == 2 {
+			return int64(int16(binary.BigEndian.Uint16(data))), nil
+		}
+	case oidInt4:
+		if len(data) == 4 {
+			return int64(int32(binary.BigEndian.Uint32(data))), nil
+		}
+	case oidInt8:
+		if len(data) == 8 {
+			return int64(binary.BigEndian.Uint64(data)), nil
+		}
+	case oidFloat4:
+		if len(data) == 4 {
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(data))), nil
+		}
+	case oidFloat8:
+		if len(data) == 8 {
+			return math.Float64frombits(binary.BigEndian.Uint64(data)), nil
+		}
+	case oidBool:
+		if len(data) == 1 {
+			return data[0] != 0, nil
+		}
+	case oidTimestamp:
+		if len(data) == 8 {
+			micros := int64(binary.BigEndian.Uint64(data))
+			return postgresEpoch.Add(time.Duration(micros) * time.Microsecond).Format(timestampLayout), nil
+		}
+	case oidText, oidVarchar:
+		return string(data), nil
+	default:
+		return data, nil
+	}
+	return nil, fmt.Errorf("invalid binary value for type %d", oid)
+}
@@ -0,0 +1,85 @@
+package rbac
+
+import (
+	"errors"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/auth"
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+)
+
+// ErrAccountsUnsupported is returned when the auth provider does not
+// implement auth.AccountManager
+var ErrAccountsUnsupported = errors.New("auth provider does not manage accounts")
+
+// accounts returns the account manager of the auth provider
+func (m *RBACManager) accounts() (auth.AccountManager, error) {
+	accounts, ok := m.authProvider.(auth.AccountManager)
+	if !ok {
+		return nil, ErrAccountsUnsupported
+	}
+	return accounts, nil
+}
+
+// ListAccounts lists the users of the auth provider. The actor must hold the
+// privilege to manage users.
+func (m *RBACManager) ListAccounts() ([]auth.Account, error) {
+	if err := m.Authorize(permissions.ManageUsers, ""); err != nil {
+		return nil, err
+	}
+	accounts, err := m.accounts()
+	if err != nil {
+		return nil, err
+	}
+	return accounts.ListAccounts()
+}
+
+// DisableUser keeps a user from authenticating and terminates the sessions of
+// the user. The actor must hold the privilege to manage users.
+func (m *RBACManager) DisableUser(username string) (err error) {
+	defer func() { err = m.recordChange("disable_user", username, "", err) }()
+	if err := m.Authorize(permissions.ManageUsers, ""); err != nil {
+		return err
+	}
+	accounts, err := m.accounts()
+	if err != nil {
+		return err
+	}
+	return accounts.DisableUser(username)
+}
+
+// ResetToken replaces the token of a user. The actor must hold the privilege
+// to manage users.
+func (m *RBACManager) ResetToken(username, token string) (err error) {
+	defer func() { err = m.recordChange("reset_token", username, "", err) }()
+	if err := m.Authorize(permissions.ManageUsers, ""); err != nil {
+		return err
+	}
+	accounts, err := m.accounts()
+	if err != nil {
+		return err
+	}
+	return accounts.ResetToken(username, token)
+}
+
+// ListSessions lists the sessions stored with the auth provider. The actor
+// must hold the privilege to manage users.
+func (m *RBACManager) ListSessions() ([]auth.SessionInfo, error) {
+	if err := m.Authorize(permissions.ManageUsers, ""); err != nil {
+		return nil, err
+	}
+	accounts, err := m.accounts()
+	if err != nil {
+		return nil, err
+	}
+	return accounts.ListSessions()
+}
+
+// TerminateSession ends a session, so that its handle refuses further
+// statements. The actor must hold the privilege to manage users.
+func (m *RBACManager) TerminateSession(sessionID string) (err error) {
+	defer func() { err = m.recordChange("terminate_session", "", sessionID, err) }()
+	if err := m.Authorize(permissions.ManageUsers, ""); err != nil {
+		return err
+	}
+	return m.authProvider.TerminateSession(sessionID)
+}
@@ -0,0 +1,438 @@
+package rbac
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/auth"
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+)
+
+// ChangeType is the kind of modification reported when applying a policy
+type ChangeType string
+
+const (
+	ChangeAdded   ChangeType = "added"
+	ChangeChanged ChangeType = "changed"
+	ChangeRemoved ChangeType = "removed"
+)
+
+// ChangeKind is what a policy change applies to
+type ChangeKind string
+
+const (
+	KindRole          ChangeKind = "role"
+	KindMembership    ChangeKind = "membership"
+	KindGrant         ChangeKind = "grant"
+	KindUser          ChangeKind = "user"
+	KindInherits      ChangeKind = "inheritance"
+	KindRoleGrant     ChangeKind = "role grant"
+	KindRoleDeny      ChangeKind = "role deny"
+	KindPrivilege     ChangeKind = "privilege"
+	KindRolePrivilege ChangeKind = "role privilege"
+)
+
+// PolicyChange is a single modification made when applying a policy
+type PolicyChange struct {
+	Type    ChangeType `json:"type"`
+	Kind    ChangeKind `json:"kind"`
+	Subject string     `json:"subject"`
+	Detail  string     `json:"detail,omitempty"`
+}
+
+// String implements the Stringer interface for PolicyChange
+func (c PolicyChange) String() string {
+	if c.Detail == "" {
+		return fmt.Sprintf("%s %s %s", c.Type, c.Kind, c.Subject)
+	}
+	return fmt.Sprintf("%s %s %s: %s", c.Type, c.Kind, c.Subject, c.Detail)
+}
+
+// PolicyReport lists the changes made when applying a policy
+type PolicyReport struct {
+	Changes []PolicyChange `json:"changes"`
+}
+
+// Count returns the number of changes of a type
+func (r *PolicyReport) Count(changeType ChangeType) int {
+	count := 0
+	for _, change := range r.Changes {
+		if change.Type == changeType {
+			count++
+		}
+	}
+	return count
+}
+
+// String implements the Stringer interface for PolicyReport
+func (r *PolicyReport) String() string {
+	if len(r.Changes) == 0 {
+		return "no changes"
+	}
+	lines := make([]string, len(r.Changes))
+	for i, change := range r.Changes {
+		lines[i] = change.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// add records a change
+func (r *PolicyReport) add(changeType ChangeType, kind ChangeKind, subject, detail string) {
+	r.Changes = append(r.Changes, PolicyChange{Type: changeType, Kind: kind, Subject: subject, Detail: detail})
+}
+
+// addPermissionChanges records added and removed permissions. A row condition
+// replaced by another one for the same table and action is recorded as a change
+// rather than a removal and an addition.
+func (r *PolicyReport) addPermissionChanges(kind ChangeKind, subject string, added, removed []permissions.Permission) {
+	paired := make(map[int]bool)
+	for _, perm := range removed {
+		change := -1
+		if perm.Type == permissions.RowPermission {
+			for i, a := range added {
+				if !paired[i] && a.Type == permissions.RowPermission && a.Table == perm.Table && a.Action == perm.Action {
+					change = i
+					break
+				}
+			}
+		}
+		if change < 0 {
+			r.add(ChangeRemoved, kind, subject, perm.String())
+			continue
+		}
+		paired[change] = true
+		r.add(ChangeChanged, kind, subject, fmt.Sprintf("%s -> %s", perm.String(), added[change].Condition))
+	}
+	for i, perm := range added {
+		if !paired[i] {
+			r.add(ChangeAdded, kind, subject, perm.String())
+		}
+	}
+}
+
+// ApplyOptions controls how a policy is applied
+type ApplyOptions struct {
+	// Prune removes roles that are not declared in the policy and clears the
+	// roles and permissions of users that are not declared in the policy
+	Prune bool
+	// DryRun reports the changes without making them
+	DryRun bool
+	// Catalog lists the tables of the database, to which denies on one table
+	// narrow grants on every table
+	Catalog Catalog
+}
+
+// ApplyPolicy makes the state of the auth provider match a policy. Applying the
+// same policy twice makes no changes the second time. Users must already exist
+// since policies do not carry credentials. Declared system privileges are
+// granted, but privileges are never revoked, so that applying a policy cannot
+// lock out the administrators. Only superusers may apply policies.
+func (m *RBACManager) ApplyPolicy(policy *Policy, opts ApplyOptions) (report *PolicyReport, err error) {
+	if !opts.DryRun {
+		defer func() { err = m.recordChange("apply_policy", "", report.summary(), err) }()
+	}
+	if err := m.Authorize(permissions.Superuser, ""); err != nil {
+		return nil, err
+	}
+	if err := policy.Validate(nil); err != nil {
+		return nil, err
+	}
+
+	// Check that all declared users exist before changing anything
+	for _, user := range policy.Users {
+		if _, err := m.authProvider.GetUserID(user.Name); err != nil {
+			return nil, fmt.Errorf("user %s not found", user.Name)
+		}
+	}
+
+	report = &PolicyReport{Changes: []PolicyChange{}}
+
+	// Create missing roles
+	existingRoles, err := m.authProvider.ListRoles()
+	if err != nil {
+		return nil, err
+	}
+	declaredRoles := make(map[string]bool, len(policy.Roles))
+	for _, role := range policy.Roles {
+		declaredRoles[role.Name] = true
+		if containsString(existingRoles, role.Name) {
+			// Role grants are materialized into the members below, so grants
+			// stored on the role, e.g. by GRANT statements, are replaced
+			if err := m.clearRolePermissions(role.Name, report, opts.DryRun); err != nil {
+				return report, err
+			}
+		} else {
+			report.add(ChangeAdded, KindRole, role.Name, "")
+			if !opts.DryRun {
+				if _, err := m.CreateRole(role.Name); err != nil {
+					return report, err
+				}
+			}
+		}
+		if err := m.applyPrivileges(role.Name, true, role.Privileges, report, opts.DryRun); err != nil {
+			return report, err
+		}
+	}
+
+	// Reconcile role memberships and effective permissions of declared users
+	declaredUsers := make(map[string]bool, len(policy.Users))
+	for _, user := range policy.Users {
+		declaredUsers[user.Name] = true
+		if err := m.applyMemberships(user.Name, user.memberships(), report, opts.DryRun); err != nil {
+			return report, err
+		}
+
+		perms, err := policy.EffectivePermissions(user.Name, opts.Catalog)
+		if err != nil {
+			return report, err
+		}
+		if err := m.applyPermissions(user.Name, perms, report, opts.DryRun); err != nil {
+			return report, err
+		}
+		if err := m.applyPrivileges(user.Name, false, user.Privileges, report, opts.DryRun); err != nil {
+			return report, err
+		}
+	}
+
+	if !opts.Prune {
+		return report, nil
+	}
+
+	// Clear the roles and permissions of undeclared users
+	users, err := m.authProvider.ListUsers()
+	if err != nil {
+		return report, err
+	}
+	for _, username := range users {
+		if declaredUsers[username] {
+			continue
+		}
+		if err := m.applyMemberships(username, nil, report, opts.DryRun); err != nil {
+			return report, err
+		}
+		if err := m.applyPermissions(username, nil, report, opts.DryRun); err != nil {
+			return report, err
+		}
+	}
+
+	// Delete undeclared roles
+	for _, role := range existingRoles {
+		if declaredRoles[role] {
+			continue
+		}
+		report.add(ChangeRemoved, KindRole, role, "")
+		if !opts.DryRun {
+			if err := m.DeleteRole(role); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// clearRolePermissions removes the data permissions stored on a role, and the
+// grants that depended on them
+func (m *RBACManager) clearRolePermissions(roleName string, report *PolicyReport, dryRun bool) error {
+	perms, err := m.authProvider.GetRolePermissions(roleName)
+	if err != nil {
+		return err
+	}
+	system, current := systemPermissions(perms)
+	if len(current) == 0 {
+		return nil
+	}
+	SortPermissions(current)
+	for _, perm := range current {
+		report.add(ChangeRemoved, KindRoleGrant, roleName, perm.String())
+	}
+	if dryRun {
+		return nil
+	}
+	if system == nil {
+		system = []permissions.Permission{}
+	}
+	return m.revokeGrants(Cascade, func(state *grantState) error {
+		state.set(grantHolder{name: roleName, isRole: true}, system)
+		return nil
+	})
+}
+
+// applyPrivileges grants the declared system privileges a role or user does not
+// hold yet, or holds without the declared grant option
+func (m *RBACManager) applyPrivileges(grantee string, isRole bool, declared []PrivilegePolicy, report *PolicyReport, dryRun bool) error {
+	desired, err := privilegePermissions(declared)
+	if err != nil || len(desired) == 0 {
+		return err
+	}
+	kind := KindPrivilege
+	if isRole {
+		kind = KindRolePrivilege
+	}
+
+	// Roles created by a dry run do not exist yet
+	var current []permissions.Permission
+	exists := true
+	if isRole {
+		if exists, err = m.RoleExists(grantee); err != nil {
+			return err
+		}
+	}
+	if exists {
+		if current, err = m.granteePermissions(grantee, isRole); err != nil {
+			return err
+		}
+	}
+
+	// Keep held privileges unless the declaration adds the grant option
+	var added []permissions.Permission
+	for _, perm := range desired {
+		held := -1
+		for i, h := range current {
+			if samePrivilege(h, perm) {
+				held = i
+				break
+			}
+		}
+		switch {
+		case held < 0:
+			current = append(current, perm)
+		case perm.GrantOption && !current[held].GrantOption:
+			current[held] = perm
+		default:
+			continue
+		}
+		added = append(added, perm)
+	}
+	if len(added) == 0 {
+		return nil
+	}
+	for _, perm := range added {
+		report.add(ChangeAdded, kind, grantee, perm.String())
+	}
+	if dryRun {
+		return nil
+	}
+	return m.updateGranteePermissions(grantee, isRole, current)
+}
+
+// applyMemberships makes a user a member of exactly the given roles, with the
+// given validity windows
+func (m *RBACManager) applyMemberships(username string, desired []auth.RoleMembership, report *PolicyReport, dryRun bool) error {
+	current, err := m.authProvider.GetUserRoleMemberships(username)
+	if err != nil {
+		return err
+	}
+
+	for _, membership := range desired {
+		held, ok := findMembership(current, membership.Role)
+		switch {
+		case !ok:
+			report.add(ChangeAdded, KindMembership, username, membershipDetail(membership.Role, membership.NotBefore, membership.NotAfter))
+		case !sameWindow(held, membership):
+			report.add(ChangeChanged, KindMembership, username, membershipChange(held, membership))
+		default:
+			continue
+		}
+		if !dryRun {
+			if err := m.AssignRoleToUserBetween(username, membership.Role, membership.NotBefore, membership.NotAfter); err != nil {
+				return err
+			}
+		}
+	}
+	for _, membership := range current {
+		if _, ok := findMembership(desired, membership.Role); ok {
+			continue
+		}
+		report.add(ChangeRemoved, KindMembership, username, membershipDetail(membership.Role, membership.NotBefore, membership.NotAfter))
+		if !dryRun {
+			if err := m.RemoveRoleFromUser(username, membership.Role); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// findMembership returns the membership of a role among memberships
+func findMembership(memberships []auth.RoleMembership, role string) (auth.RoleMembership, bool) {
+	for _, membership := range memberships {
+		if membership.Role == role {
+			return membership, true
+		}
+	}
+	return auth.RoleMembership{}, false
+}
+
+// sameWindow checks if two memberships have the same validity window
+func sameWindow(a, b auth.RoleMembership) bool {
+	return a.NotBefore.Equal(b.NotBefore) && a.NotAfter.Equal(b.NotAfter)
+}
+
+// membershipChange describes a membership whose validity window changed
+func membershipChange(from, to auth.RoleMembership) string {
+	return fmt.Sprintf("%s -> %s", membershipDetail(from.Role, from.NotBefore, from.NotAfter), membershipDetail(to.Role, to.NotBefore, to.NotAfter))
+}
+
+// applyPermissions replaces the data permissions of a user if they differ from
+// the desired set, reporting every grant that is added or removed. Grantors are
+// not part of a policy, so they are ignored when comparing and dropped when the
+// permissions are replaced. Grants that depended on a removed permission are
+// revoked in turn.
+func (m *RBACManager) applyPermissions(username string, desired []permissions.Permission, report *PolicyReport, dryRun bool) error {
+	perms, err := m.authProvider.GetUserPermissions(username)
+	if err != nil {
+		return err
+	}
+	system, current := systemPermissions(perms)
+
+	added, removed := diffPermissions(withoutGrantors(current), desired)
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+	report.addPermissionChanges(KindGrant, username, added, removed)
+	if dryRun {
+		return nil
+	}
+	updated := make([]permissions.Permission, 0, len(system)+len(desired))
+	updated = append(updated, system...)
+	return m.revokeGrants(Cascade, func(state *grantState) error {
+		state.set(grantHolder{name: username}, append(updated, desired...))
+		return nil
+	})
+}
+
+// diffPermissions compares two permission lists as multisets and returns the
+// permissions only in the desired list and those only in the current list
+func diffPermissions(current, desired []permissions.Permission) (added, removed []permissions.Permission) {
+	counts := make(map[permissions.Permission]int, len(current))
+	for _, perm := range current {
+		counts[perm]++
+	}
+	for _, perm := range desired {
+		if counts[perm] > 0 {
+			counts[perm]--
+			continue
+		}
+		added = append(added, perm)
+	}
+	for _, perm := range current {
+		if counts[perm] > 0 {
+			counts[perm]--
+			removed = append(removed, perm)
+		}
+	}
+	SortPermissions(added)
+	SortPermissions(removed)
+	return added, removed
+}
+
+// containsString checks if a string is in a list
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package rbac
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/audit"
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+)
+
+// recordChange records a change to users, roles or permissions made through
+// the manager, or refused with err. A change that was made but cannot be
+// recorded returns the recording error.
+func (m *RBACManager) recordChange(operation, subject, detail string, err error) error {
+	if m.Audit == nil {
+		return err
+	}
+	event := audit.Event{
+		Time:      m.now(),
+		Type:      audit.EventRBACChange,
+		Principal: m.actor,
+		Subject:   subject,
+		Detail:    detail,
+		Operation: operation,
+		Decision:  audit.Allow,
+	}
+	if err != nil {
+		event.Decision = audit.Deny
+		event.ErrorCode = "RBAC_ERROR"
+		if errors.Is(err, ErrInsufficientPrivilege) {
+			event.ErrorCode = "PERMISSION_DENIED"
+		}
+		if detail != "" {
+			event.Detail += ": "
+		}
+		event.Detail += err.Error()
+	}
+	if recordErr := m.Audit.Record(context.Background(), event); recordErr != nil && err == nil {
+		return fmt.Errorf("failed to record %s: %w", operation, recordErr)
+	}
+	return err
+}
+
+// String describes a grant for audit records
+func (g GrantPolicy) String() string {
+	s := fmt.Sprintf("%s on %s", strings.Join(g.Actions, ", "), g.Table)
+	if len(g.Columns) > 0 {
+		s += fmt.Sprintf(" (%s)", strings.Join(g.Columns, ", "))
+	}
+	if g.Row != "" {
+		s += " where " + g.Row
+	}
+	if g.GrantOption {
+		s += " with grant option"
+	}
+	notBefore, notAfter := g.window()
+	return s + windowDetail(notBefore, notAfter)
+}
+
+// membershipDetail describes a role membership for audit records
+func membershipDetail(roleName string, notBefore, notAfter time.Time) string {
+	return roleName + windowDetail(notBefore.UTC(), notAfter.UTC())
+}
+
+// privilegeDetail describes a system privilege for audit records
+func privilegeDetail(privilege permissions.Privilege, table string, grantOption bool) string {
+	return permissions.Permission{
+		Type:        permissions.SystemPermission,
+		Privilege:   privilege,
+		Table:       table,
+		GrantOption: grantOption,
+	}.String()
+}
+
+// windowDetail describes a validity window for audit records
+func windowDetail(notBefore, notAfter time.Time) string {
+	var s string
+	if !notBefore.IsZero() {
+		s += " from " + notBefore.Format(time.RFC3339)
+	}
+	if !notAfter.IsZero() {
+		s += " until " + notAfter.Format(time.RFC3339)
+	}
+	return s
+}
+
+// summary describes the changes of a policy report for audit records
+func (r *PolicyReport) summary() string {
+	if r == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d added, %d changed, %d removed", r.Count(ChangeAdded), r.Count(ChangeChanged), r.Count(ChangeRemoved))
+}
@@ -0,0 +1,105 @@
+package rbac
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Catalog describes the tables of a database and their columns. It is used to
+// validate that policies only refer to existing tables and columns.
+type Catalog map[string][]string
+
+// LoadCatalog reads the schema catalog of a SQLite database
+func LoadCatalog(db *sql.DB) (Catalog, error) {
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type IN ('table', 'view') AND name NOT LIKE 'sqlite_%'")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to list tables: %w", err)
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+
+	catalog := make(Catalog, len(tables))
+	for _, table := range tables {
+		columns, err := loadColumns(db, table)
+		if err != nil {
+			return nil, err
+		}
+		catalog[table] = columns
+	}
+	return catalog, nil
+}
+
+// loadColumns reads the column names of a table
+func loadColumns(db *sql.DB, table string) ([]string, error) {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list columns of table %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("failed to list columns of table %s: %w", table, err)
+		}
+		columns = append(columns, name)
+	}
+	return columns, rows.Err()
+}
+
+// HasTable checks if the catalog contains a table
+func (c Catalog) HasTable(table string) bool {
+	_, ok := c.lookup(table)
+	return ok
+}
+
+// HasColumn checks if a table of the catalog contains a column
+func (c Catalog) HasColumn(table, column string) bool {
+	columns, ok := c.lookup(table)
+	if !ok {
+		return false
+	}
+	for _, col := range columns {
+		if strings.EqualFold(col, column) {
+			return true
+		}
+	}
+	return false
+}
+
+// Tables returns the sorted table names of the catalog
+func (c Catalog) Tables() []string {
+	tables := make([]string, 0, len(c))
+	for table := range c {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+// lookup finds the columns of a table; SQLite table names are case-insensitive
+func (c Catalog) lookup(table string) ([]string, bool) {
+	if columns, ok := c[table]; ok {
+		return columns, true
+	}
+	for name, columns := range c {
+		if strings.EqualFold(name, table) {
+			return columns, true
+		}
+	}
+	return nil, false
+}
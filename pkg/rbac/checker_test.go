@@ -1,8 +1,16 @@
 package rbac
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/wemcdonald/secure_sqlite/pkg/audit"
 	"github.com/wemcdonald/secure_sqlite/pkg/auth"
 	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
 )
@@ -29,7 +37,7 @@ func newTestSetup(t *testing.T) *testSetup {
 
 	return &testSetup{
 		auth: mockAuth,
-		rbac: NewRBACManager(mockAuth),
+		rbac: System(mockAuth),
 		t:    t,
 	}
 }
@@ -186,7 +194,7 @@ func TestRBACManager_GrantTablePermission(t *testing.T) {
 	// Create a mock auth provider
 	mockAuth := auth.NewMemoryProvider()
 	mockAuth.AddUser("test_user", "test_token")
-	rbacManager := NewRBACManager(mockAuth)
+	rbacManager := System(mockAuth)
 
 	// Test granting table permission
 	err := rbacManager.GrantTablePermission("test_user", "test_table", permissions.TablePermission)
@@ -208,7 +216,7 @@ func TestRBACManager_TablePermissions(t *testing.T) {
 	// Create a mock auth provider
 	mockAuth := auth.NewMemoryProvider()
 	mockAuth.AddUser("test_user", "test_token")
-	rbacManager := NewRBACManager(mockAuth)
+	rbacManager := System(mockAuth)
 
 	// Test granting table permission
 	err := rbacManager.GrantTablePermission("test_user", "test_table", permissions.TablePermission)
@@ -245,7 +253,7 @@ func TestRBACManager_ColumnPermissions(t *testing.T) {
 	// Create a mock auth provider
 	mockAuth := auth.NewMemoryProvider()
 	mockAuth.AddUser("test_user", "test_token")
-	rbacManager := NewRBACManager(mockAuth)
+	rbacManager := System(mockAuth)
 
 	// Test granting column permission
 	err := rbacManager.GrantColumnPermission("test_user", "test_table", "test_column", permissions.ColumnPermission)
@@ -282,7 +290,7 @@ func TestRBACManager_RowPermissions(t *testing.T) {
 	// Create a mock auth provider
 	mockAuth := auth.NewMemoryProvider()
 	mockAuth.AddUser("test_user", "test_token")
-	rbacManager := NewRBACManager(mockAuth)
+	rbacManager := System(mockAuth)
 
 	// Test granting row permission
 	condition := "user_id = 1"
@@ -315,3 +323,1321 @@ func TestRBACManager_RowPermissions(t *testing.T) {
 		t.Error("Expected row condition to be empty")
 	}
 }
+
+const testPolicy = `
+version: 1
+roles:
+  - name: reader
+    grants:
+      - table: documents
+        actions: [select]
+        columns: [id, title]
+  - name: editor
+    inherits: [reader]
+    grants:
+      - table: documents
+        actions: [update]
+        row: owner_id = current_user_id()
+    denies:
+      - table: documents
+        actions: [select]
+        columns: [title]
+users:
+  - name: alice
+    roles: [editor]
+  - name: bob
+    roles: [reader]
+    grants:
+      - table: audit
+        actions: [all]
+`
+
+func TestLoadPolicy(t *testing.T) {
+	policy, err := LoadPolicy(strings.NewReader(testPolicy))
+	if err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+	if len(policy.Roles) != 2 || len(policy.Users) != 2 {
+		t.Fatalf("Expected 2 roles and 2 users, got %d and %d", len(policy.Roles), len(policy.Users))
+	}
+
+	// JSON is accepted as well
+	jsonPolicy := `{"version": 1, "roles": [{"name": "reader", "grants": [{"table": "documents", "actions": ["select"]}]}]}`
+	if _, err := LoadPolicy(strings.NewReader(jsonPolicy)); err != nil {
+		t.Errorf("Failed to load JSON policy: %v", err)
+	}
+
+	// Grants may be limited to a time window
+	windowPolicy := "version: 1\nroles:\n  - name: r\n    grants:\n      - table: t\n        actions: [select]\n        not_after: 2030-01-01T00:00:00Z\n"
+	if policy, err := LoadPolicy(strings.NewReader(windowPolicy)); err != nil {
+		t.Errorf("Failed to load policy with window: %v", err)
+	} else if until := policy.Roles[0].Grants[0].NotAfter; until == nil || until.Year() != 2030 {
+		t.Errorf("Expected grant until 2030, got %v", until)
+	}
+
+	invalid := []struct {
+		name   string
+		policy string
+	}{
+		{"unknown field", "version: 1\nroles:\n  - name: reader\n    grant: []\n"},
+		{"wrong version", "version: 2\n"},
+		{"unknown action", "version: 1\nroles:\n  - name: r\n    grants:\n      - table: t\n        actions: [truncate]\n"},
+		{"undeclared role", "version: 1\nusers:\n  - name: alice\n    roles: [admin]\n"},
+		{"inheritance cycle", "version: 1\nroles:\n  - name: a\n    inherits: [b]\n  - name: b\n    inherits: [a]\n"},
+		{"deny with row", "version: 1\nroles:\n  - name: r\n    denies:\n      - table: t\n        row: id = 1\n"},
+		{"empty window", "version: 1\nroles:\n  - name: r\n    grants:\n      - table: t\n        actions: [select]\n        not_before: 2030-01-01T00:00:00Z\n        not_after: 2029-01-01T00:00:00Z\n"},
+		{"invalid row", "version: 1\nroles:\n  - name: r\n    grants:\n      - table: t\n        actions: [select]\n        row: id = = 1\n"},
+	}
+	for _, tc := range invalid {
+		if _, err := LoadPolicy(strings.NewReader(tc.policy)); err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+}
+
+func TestPolicyValidateCatalog(t *testing.T) {
+	policy, err := LoadPolicy(strings.NewReader(testPolicy))
+	if err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+
+	catalog := Catalog{
+		"documents": {"id", "title", "owner_id"},
+		"audit":     {"id", "event"},
+	}
+	if err := policy.Validate(catalog); err != nil {
+		t.Errorf("Expected policy to match catalog: %v", err)
+	}
+
+	delete(catalog, "audit")
+	catalog["documents"] = []string{"id", "title"}
+	err = policy.Validate(catalog)
+	if err == nil {
+		t.Fatal("Expected validation against catalog to fail")
+	}
+	for _, want := range []string{"unknown table audit", "unknown column documents.owner_id"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error to contain %q, got %v", want, err)
+		}
+	}
+}
+
+func TestApplyPolicy(t *testing.T) {
+	provider := auth.NewMemoryProvider()
+	provider.AddUser("alice", "alice_token")
+	provider.AddUser("bob", "bob_token")
+	provider.AddUser("carol", "carol_token")
+	provider.AddPermission("carol", permissions.Permission{Type: permissions.TablePermission, Table: "documents", Action: permissions.Select})
+	rbacManager := System(provider)
+	if _, err := rbacManager.CreateRole("legacy"); err != nil {
+		t.Fatalf("Failed to create role: %v", err)
+	}
+
+	policy, err := LoadPolicy(strings.NewReader(testPolicy))
+	if err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+
+	report, err := rbacManager.ApplyPolicy(policy, ApplyOptions{Prune: true})
+	if err != nil {
+		t.Fatalf("Failed to apply policy: %v", err)
+	}
+	if report.Count(ChangeAdded) == 0 || report.Count(ChangeRemoved) != 2 {
+		t.Errorf("Unexpected report:\n%s", report)
+	}
+
+	// The inherited grants are materialized and the denied column is removed
+	perms, err := provider.GetUserPermissions("alice")
+	if err != nil {
+		t.Fatalf("Failed to get permissions: %v", err)
+	}
+	var got []string
+	for _, perm := range perms {
+		got = append(got, perm.String())
+	}
+	want := []string{
+		"select on documents",
+		"update on documents",
+		"select (id) on documents",
+		"update on documents where owner_id = current_user_id()",
+	}
+	if strings.Join(got, "; ") != strings.Join(want, "; ") {
+		t.Errorf("Expected permissions %v, got %v", want, got)
+	}
+
+	perms, _ = provider.GetUserPermissions("bob")
+	if len(perms) != len(permissions.Actions)+3 {
+		t.Errorf("Expected %d permissions for bob, got %d", len(permissions.Actions)+3, len(perms))
+	}
+	if roles, _ := provider.GetUserRoles("alice"); len(roles) != 1 || roles[0] != "editor" {
+		t.Errorf("Expected alice to be an editor, got %v", roles)
+	}
+
+	// Pruning clears undeclared users and roles
+	if perms, _ := provider.GetUserPermissions("carol"); len(perms) != 0 {
+		t.Errorf("Expected carol's permissions to be pruned, got %v", perms)
+	}
+	if exists, _ := rbacManager.RoleExists("legacy"); exists {
+		t.Error("Expected legacy role to be pruned")
+	}
+
+	// Applying the same policy again changes nothing
+	report, err = rbacManager.ApplyPolicy(policy, ApplyOptions{Prune: true})
+	if err != nil {
+		t.Fatalf("Failed to reapply policy: %v", err)
+	}
+	if len(report.Changes) != 0 {
+		t.Errorf("Expected no changes, got:\n%s", report)
+	}
+
+	// Changing a row condition is reported as a change
+	policy.Roles[1].Grants[0].Row = "owner_id = 1"
+	report, err = rbacManager.ApplyPolicy(policy, ApplyOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("Failed to apply policy: %v", err)
+	}
+	if len(report.Changes) != 1 || report.Changes[0].Type != ChangeChanged {
+		t.Errorf("Expected a single change, got:\n%s", report)
+	}
+
+	// Undeclared users are rejected
+	policy.Users = append(policy.Users, UserPolicy{Name: "mallory"})
+	if _, err := rbacManager.ApplyPolicy(policy, ApplyOptions{}); err == nil {
+		t.Error("Expected an error for an unknown user")
+	}
+}
+
+func TestExportPolicy(t *testing.T) {
+	provider := auth.NewMemoryProvider()
+	provider.AddUser("alice", "alice_token")
+	provider.AddUser("bob", "bob_token")
+	rbacManager := System(provider)
+
+	policy, err := LoadPolicy(strings.NewReader(testPolicy))
+	if err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+	if _, err := rbacManager.ApplyPolicy(policy, ApplyOptions{}); err != nil {
+		t.Fatalf("Failed to apply policy: %v", err)
+	}
+
+	exported, err := rbacManager.ExportPolicy()
+	if err != nil {
+		t.Fatalf("Failed to export policy: %v", err)
+	}
+
+	// The export round-trips through YAML
+	var buf strings.Builder
+	if err := exported.WriteYAML(&buf); err != nil {
+		t.Fatalf("Failed to write policy: %v", err)
+	}
+	reloaded, err := LoadPolicy(strings.NewReader(buf.String()))
+	if err != nil {
+		t.Fatalf("Failed to reload exported policy: %v\n%s", err, buf.String())
+	}
+
+	// The effective permissions of the export match the original policy
+	report, err := DiffPolicies(policy, reloaded, nil)
+	if err != nil {
+		t.Fatalf("Failed to diff policies: %v", err)
+	}
+	for _, change := range report.Changes {
+		if change.Kind == KindGrant || change.Kind == KindMembership || change.Kind == KindUser {
+			t.Errorf("Unexpected change in effective access: %s", change)
+		}
+	}
+
+	// Applying the export changes nothing
+	report, err = rbacManager.ApplyPolicy(reloaded, ApplyOptions{Prune: true})
+	if err != nil {
+		t.Fatalf("Failed to apply exported policy: %v", err)
+	}
+	if len(report.Changes) != 0 {
+		t.Errorf("Expected no changes, got:\n%s", report)
+	}
+
+	// Exporting requires the privilege to manage roles
+	if _, err := rbacManager.As("bob").ExportPolicy(); !errors.Is(err, ErrInsufficientPrivilege) {
+		t.Errorf("Expected export by bob to be denied, got %v", err)
+	}
+}
+
+func TestExportPolicyWithoutTable(t *testing.T) {
+	provider := auth.NewMemoryProvider()
+	provider.AddUser("alice", "alice_token")
+	provider.AddPermission("alice", permissions.Permission{Type: permissions.ColumnPermission, Table: "documents", Column: "title", Action: permissions.Select})
+	provider.AddPermission("alice", permissions.Permission{Type: permissions.RowPermission, Table: "documents", Condition: "owner_id = current_user_id()", Action: permissions.Update})
+	rbacManager := System(provider)
+
+	exported, err := rbacManager.ExportPolicy()
+	if err != nil {
+		t.Fatalf("Failed to export policy: %v", err)
+	}
+	grants := exported.Users[0].Grants
+	if len(grants) != 2 {
+		t.Fatalf("Expected 2 grants, got %+v", grants)
+	}
+	for _, grant := range grants {
+		if !grant.WithoutTable {
+			t.Errorf("Expected grant without table, got %+v", grant)
+		}
+	}
+
+	// Applying the export does not widen the permissions to the table
+	report, err := rbacManager.ApplyPolicy(exported, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("Failed to apply exported policy: %v", err)
+	}
+	if len(report.Changes) != 0 {
+		t.Errorf("Expected no changes, got:\n%s", report)
+	}
+	perms, _ := provider.GetUserPermissions("alice")
+	for _, perm := range perms {
+		if perm.Type == permissions.TablePermission {
+			t.Errorf("Expected no table permission, got %s", perm)
+		}
+	}
+
+	// A grant without table needs columns or a row condition
+	invalid := "version: 1\nroles:\n  - name: r\n    grants:\n      - table: t\n        actions: [select]\n        without_table: true\n"
+	if _, err := LoadPolicy(strings.NewReader(invalid)); err == nil {
+		t.Error("Expected an error for a grant without table, columns or row")
+	}
+}
+
+func TestPolicyPrivileges(t *testing.T) {
+	provider := auth.NewMemoryProvider()
+	provider.AddUser("root", "root_token")
+	provider.AddUser("lead", "lead_token")
+	system := System(provider)
+	if err := BootstrapSuperuser(provider, "root"); err != nil {
+		t.Fatalf("Failed to bootstrap superuser: %v", err)
+	}
+	if _, err := system.CreateRole("admins"); err != nil {
+		t.Fatalf("Failed to create role: %v", err)
+	}
+	if err := system.GrantPrivilege("admins", permissions.ManageUsers, "", false); err != nil {
+		t.Fatalf("Failed to grant privilege: %v", err)
+	}
+	if err := system.GrantPrivilege("lead", permissions.GrantTable, "projects", true); err != nil {
+		t.Fatalf("Failed to grant privilege: %v", err)
+	}
+
+	// Exports carry system privileges and their grant option
+	exported, err := system.ExportPolicy()
+	if err != nil {
+		t.Fatalf("Failed to export policy: %v", err)
+	}
+	want := map[string][]PrivilegePolicy{
+		"admins": {{Privilege: "manage_users"}},
+		"lead":   {{Privilege: "grant", Table: "projects", GrantOption: true}},
+		"root":   {{Privilege: "superuser"}},
+	}
+	for _, role := range exported.Roles {
+		if !reflect.DeepEqual(role.Privileges, want[role.Name]) {
+			t.Errorf("Expected privileges %+v for role %s, got %+v", want[role.Name], role.Name, role.Privileges)
+		}
+	}
+	for _, user := range exported.Users {
+		if !reflect.DeepEqual(user.Privileges, want[user.Name]) {
+			t.Errorf("Expected privileges %+v for user %s, got %+v", want[user.Name], user.Name, user.Privileges)
+		}
+	}
+	var buf bytes.Buffer
+	if err := exported.WriteYAML(&buf); err != nil {
+		t.Fatalf("Failed to write policy: %v", err)
+	}
+	document := buf.String()
+	loaded, err := LoadPolicy(strings.NewReader(document))
+	if err != nil {
+		t.Fatalf("Failed to load exported policy: %v", err)
+	}
+
+	// The diff reports changed privileges and grant options
+	changed, err := LoadPolicy(strings.NewReader(document))
+	if err != nil {
+		t.Fatalf("Failed to load exported policy: %v", err)
+	}
+	for i := range changed.Users {
+		if changed.Users[i].Name == "lead" {
+			changed.Users[i].Privileges = []PrivilegePolicy{{Privilege: "grant", Table: "projects"}, {Privilege: "manage_roles"}}
+		}
+	}
+	changed.Roles[0].Privileges = nil
+	report, err := DiffPolicies(loaded, changed, nil)
+	if err != nil {
+		t.Fatalf("Failed to diff policies: %v", err)
+	}
+	got := make(map[string]bool)
+	for _, change := range report.Changes {
+		got[change.String()] = true
+	}
+	for _, want := range []string{
+		"removed role privilege admins: manage_users",
+		"removed privilege lead: grant on projects with grant option",
+		"added privilege lead: grant on projects",
+		"added privilege lead: manage_roles",
+	} {
+		if !got[want] {
+			t.Errorf("Expected change %q, got:\n%s", want, report)
+		}
+	}
+
+	// Applying grants declared privileges but never revokes any
+	report, err = system.As("root").ApplyPolicy(changed, ApplyOptions{Prune: true})
+	if err != nil {
+		t.Fatalf("Failed to apply policy: %v", err)
+	}
+	if report.String() != "added privilege lead: manage_roles" {
+		t.Errorf("Expected only the added privilege, got:\n%s", report)
+	}
+	for _, check := range []struct {
+		user      string
+		privilege permissions.Privilege
+		table     string
+	}{
+		{"lead", permissions.ManageRoles, ""},
+		{"lead", permissions.GrantTable, "projects"},
+	} {
+		if ok, err := system.HasPrivilege(check.user, check.privilege, check.table); err != nil || !ok {
+			t.Errorf("Expected %s to hold %s, got %v, %v", check.user, check.privilege, ok, err)
+		}
+	}
+
+	// Unknown privileges and misplaced tables are rejected
+	for _, invalid := range []string{
+		"version: 1\nusers:\n  - name: lead\n    privileges:\n      - privilege: owner\n",
+		"version: 1\nusers:\n  - name: lead\n    privileges:\n      - privilege: manage_users\n        table: projects\n",
+		"version: 1\nusers:\n  - name: lead\n    privileges:\n      - privilege: grant\n",
+	} {
+		if _, err := LoadPolicy(strings.NewReader(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestPolicyMemberships(t *testing.T) {
+	policy, err := LoadPolicy(strings.NewReader(`
+version: 1
+roles:
+  - name: reader
+    grants:
+      - table: documents
+        actions: [select]
+      - table: reports
+        actions: [select]
+        not_after: 2030-01-01T00:00:00Z
+  - name: oncall
+users:
+  - name: alice
+    roles: [oncall]
+    memberships:
+      - role: reader
+        not_before: 2029-01-01T00:00:00Z
+        not_after: 2031-01-01T00:00:00Z
+`))
+	if err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+
+	// The grants of a time-bound membership are limited to its window
+	perms, err := policy.EffectivePermissions("alice", nil)
+	if err != nil {
+		t.Fatalf("Failed to get effective permissions: %v", err)
+	}
+	var got []string
+	for _, perm := range perms {
+		got = append(got, perm.String())
+	}
+	want := []string{
+		"select on documents from 2029-01-01T00:00:00Z until 2031-01-01T00:00:00Z",
+		"select on reports from 2029-01-01T00:00:00Z until 2030-01-01T00:00:00Z",
+	}
+	if strings.Join(got, "; ") != strings.Join(want, "; ") {
+		t.Errorf("Expected permissions %v, got %v", want, got)
+	}
+
+	// Applying stores the window, and the export carries it
+	provider := auth.NewMemoryProvider()
+	provider.AddUser("alice", "alice_token")
+	system := System(provider)
+	if _, err := system.ApplyPolicy(policy, ApplyOptions{}); err != nil {
+		t.Fatalf("Failed to apply policy: %v", err)
+	}
+	memberships, err := provider.GetUserRoleMemberships("alice")
+	if err != nil {
+		t.Fatalf("Failed to get memberships: %v", err)
+	}
+	for _, membership := range memberships {
+		if membership.Role == "reader" && membership.NotAfter.Year() != 2031 {
+			t.Errorf("Expected membership until 2031, got %+v", membership)
+		}
+	}
+	exported, err := system.ExportPolicy()
+	if err != nil {
+		t.Fatalf("Failed to export policy: %v", err)
+	}
+	alice := exported.Users[0]
+	if len(alice.Roles) != 1 || alice.Roles[0] != "oncall" {
+		t.Errorf("Expected open-ended roles [oncall], got %v", alice.Roles)
+	}
+	if len(alice.Memberships) != 1 || alice.Memberships[0].Role != "reader" || alice.Memberships[0].NotBefore == nil || alice.Memberships[0].NotAfter == nil {
+		t.Fatalf("Expected a time-bound reader membership, got %+v", alice.Memberships)
+	}
+	report, err := system.ApplyPolicy(exported, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("Failed to apply exported policy: %v", err)
+	}
+	if len(report.Changes) != 0 {
+		t.Errorf("Expected no changes, got:\n%s", report)
+	}
+
+	// Diffs and applies report changed windows
+	changed := *exported
+	changed.Users = []UserPolicy{alice}
+	extended := time.Date(2032, 1, 1, 0, 0, 0, 0, time.UTC)
+	changed.Users[0].Memberships = []MembershipPolicy{{Role: "reader", NotAfter: &extended}}
+	report, err = DiffPolicies(exported, &changed, nil)
+	if err != nil {
+		t.Fatalf("Failed to diff policies: %v", err)
+	}
+	wantChange := "changed membership alice: reader from 2029-01-01T00:00:00Z until 2031-01-01T00:00:00Z -> reader until 2032-01-01T00:00:00Z"
+	if len(report.Changes) == 0 || report.Changes[0].String() != wantChange {
+		t.Errorf("Expected change %q, got:\n%s", wantChange, report)
+	}
+	report, err = system.ApplyPolicy(&changed, ApplyOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("Failed to apply policy: %v", err)
+	}
+	if len(report.Changes) == 0 || report.Changes[0].String() != wantChange {
+		t.Errorf("Expected change %q, got:\n%s", wantChange, report)
+	}
+
+	// Memberships must not repeat a role or end before they start
+	for _, invalid := range []string{
+		"version: 1\nroles:\n  - name: r\nusers:\n  - name: u\n    roles: [r]\n    memberships:\n      - role: r\n        not_after: 2030-01-01T00:00:00Z\n",
+		"version: 1\nroles:\n  - name: r\nusers:\n  - name: u\n    memberships:\n      - role: r\n        not_before: 2030-01-01T00:00:00Z\n        not_after: 2029-01-01T00:00:00Z\n",
+	} {
+		if _, err := LoadPolicy(strings.NewReader(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestDiffPolicies(t *testing.T) {
+	from, err := LoadPolicy(strings.NewReader(testPolicy))
+	if err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+	to, err := LoadPolicy(strings.NewReader(testPolicy))
+	if err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+
+	report, err := DiffPolicies(from, to, nil)
+	if err != nil {
+		t.Fatalf("Failed to diff policies: %v", err)
+	}
+	if len(report.Changes) != 0 {
+		t.Errorf("Expected identical policies, got:\n%s", report)
+	}
+
+	// Drop the deny, move bob to the editor role and add a user
+	to.Roles[1].Denies = nil
+	to.Users[1].Roles = []string{"editor"}
+	to.Users = append(to.Users, UserPolicy{Name: "carol", Roles: []string{"reader"}})
+
+	report, err = DiffPolicies(from, to, nil)
+	if err != nil {
+		t.Fatalf("Failed to diff policies: %v", err)
+	}
+	got := make(map[string]bool)
+	for _, change := range report.Changes {
+		got[change.String()] = true
+	}
+	for _, want := range []string{
+		"removed role deny editor: select (title) on documents",
+		"added grant alice: select (title) on documents",
+		"removed membership bob: reader",
+		"added membership bob: editor",
+		"added grant bob: update on documents where owner_id = current_user_id()",
+		"added user carol",
+		"added grant carol: select on documents",
+	} {
+		if !got[want] {
+			t.Errorf("Expected change %q, got:\n%s", want, report)
+		}
+	}
+}
+
+func TestPolicyWildcardDenies(t *testing.T) {
+	policy, err := LoadPolicy(strings.NewReader(`
+version: 1
+users:
+  - name: alice
+    grants:
+      - table: orders
+        actions: [select]
+    denies:
+      - table: "*"
+        actions: [select]
+  - name: bob
+    grants:
+      - table: "*"
+        actions: [select, update]
+    denies:
+      - table: orders
+        actions: [select]
+`))
+	if err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+	catalog := Catalog{
+		"orders":    {"id"},
+		"customers": {"id"},
+		"items":     {"id"},
+	}
+
+	tests := []struct {
+		user string
+		want []string
+	}{
+		// A deny on every table removes grants on each table
+		{"alice", nil},
+		// A deny on one table narrows a grant on every table to the others
+		{"bob", []string{"select on customers", "select on items", "update on *"}},
+	}
+	for _, tc := range tests {
+		perms, err := policy.EffectivePermissions(tc.user, catalog)
+		if err != nil {
+			t.Fatalf("%s: failed to get effective permissions: %v", tc.user, err)
+		}
+		var got []string
+		for _, perm := range perms {
+			got = append(got, perm.String())
+		}
+		sort.Strings(got)
+		if strings.Join(got, "; ") != strings.Join(tc.want, "; ") {
+			t.Errorf("%s: expected permissions %v, got %v", tc.user, tc.want, got)
+		}
+	}
+
+	// Without a catalog the grant on every table cannot be narrowed
+	if _, err := policy.EffectivePermissions("bob", nil); err == nil {
+		t.Error("Expected an error narrowing a grant on every table without a catalog")
+	}
+}
+
+func TestRBACManager_GrantRevoke(t *testing.T) {
+	ts := newTestSetup(t)
+
+	_, err := ts.rbac.CreateRole("analyst")
+	ts.assertNoError(err, "Failed to create role")
+	ts.assertNoError(ts.rbac.AssignRoleToUser(testUsername, "analyst"), "Failed to assign role")
+
+	// Grants to a role apply to its members
+	ts.assertNoError(ts.rbac.Grant("analyst", GrantPolicy{
+		Table:   testTable,
+		Actions: []string{"select"},
+		Columns: []string{testColumn},
+	}), "Failed to grant to role")
+	rolePerms, err := ts.rbac.GetRolePermissions("analyst")
+	ts.assertNoError(err, "Failed to get role permissions")
+	if len(rolePerms) != 2 {
+		t.Errorf("Expected table and column permission on role, got %v", rolePerms)
+	}
+	hasPermission, err := ts.rbac.CheckPermission(testUsername, testTable, permissions.Select)
+	ts.assertNoError(err, "Failed to check permission")
+	ts.assertPermission(hasPermission, true, "Role grant should apply to member")
+
+	// Granting twice does not duplicate permissions
+	ts.assertNoError(ts.rbac.Grant("analyst", GrantPolicy{Table: testTable, Actions: []string{"select"}}), "Failed to grant to role")
+	rolePerms, err = ts.rbac.GetRolePermissions("analyst")
+	ts.assertNoError(err, "Failed to get role permissions")
+	if len(rolePerms) != 2 {
+		t.Errorf("Expected no duplicate permissions, got %v", rolePerms)
+	}
+
+	// Revoking a column keeps the table permission
+	ts.assertNoError(ts.rbac.Revoke("analyst", GrantPolicy{
+		Table:   testTable,
+		Actions: []string{"select"},
+		Columns: []string{testColumn},
+	}, Cascade), "Failed to revoke column")
+	rolePerms, err = ts.rbac.GetRolePermissions("analyst")
+	ts.assertNoError(err, "Failed to get role permissions")
+	if len(rolePerms) != 1 || rolePerms[0].Type != permissions.TablePermission {
+		t.Errorf("Expected only the table permission, got %v", rolePerms)
+	}
+
+	ts.assertNoError(ts.rbac.Revoke("analyst", GrantPolicy{Table: testTable, Actions: []string{"select"}}, Cascade), "Failed to revoke table")
+	hasPermission, err = ts.rbac.CheckPermission(testUsername, testTable, permissions.Select)
+	ts.assertNoError(err, "Failed to check permission")
+	ts.assertPermission(hasPermission, false, "Revoked role grant should not apply")
+
+	// Grants to users are stored on the user
+	ts.assertNoError(ts.rbac.Grant(testUsername, GrantPolicy{Table: testTable, Actions: []string{"insert"}}), "Failed to grant to user")
+	userPerms, err := ts.auth.GetUserPermissions(testUsername)
+	ts.assertNoError(err, "Failed to get user permissions")
+	if len(userPerms) != 1 || userPerms[0].Action != permissions.Insert {
+		t.Errorf("Expected insert permission on user, got %v", userPerms)
+	}
+
+	if err := ts.rbac.Grant("nobody", GrantPolicy{Table: testTable}); err == nil {
+		t.Error("Expected error granting to unknown grantee")
+	}
+}
+
+func TestRBACManager_Privileges(t *testing.T) {
+	ts := newTestSetup(t)
+	ts.auth.AddUser("lead", "lead_token")
+	ts.auth.AddUser("dev", "dev_token")
+
+	// Changes made by the system manager are not checked
+	ts.assertNoError(ts.rbac.GrantPrivilege(testUsername, permissions.Superuser, "", false), "Failed to bootstrap superuser")
+	root := ts.rbac.As(testUsername)
+	lead := ts.rbac.As("lead")
+	dev := ts.rbac.As("dev")
+
+	// Users without privileges cannot change access
+	if _, err := lead.CreateRole("analyst"); !errors.Is(err, ErrInsufficientPrivilege) {
+		t.Errorf("Expected insufficient privilege creating role, got %v", err)
+	}
+	if err := lead.Grant("lead", GrantPolicy{Table: testTable}); !errors.Is(err, ErrInsufficientPrivilege) {
+		t.Errorf("Expected insufficient privilege granting on table, got %v", err)
+	}
+	if err := lead.CreateUser("eve", "eve_token"); !errors.Is(err, ErrInsufficientPrivilege) {
+		t.Errorf("Expected insufficient privilege creating user, got %v", err)
+	}
+
+	// The superuser delegates the grant privilege on a table with grant option
+	ts.assertNoError(root.GrantPrivilege("lead", permissions.GrantTable, testTable, true), "Failed to grant privilege")
+	ts.assertNoError(lead.Grant("dev", GrantPolicy{Table: testTable, Actions: []string{"select"}}), "Failed to grant on table")
+	if err := lead.Grant("dev", GrantPolicy{Table: "other_table"}); !errors.Is(err, ErrInsufficientPrivilege) {
+		t.Errorf("Expected insufficient privilege granting on other table, got %v", err)
+	}
+
+	// The grant option allows delegating the privilege, but not more
+	ts.assertNoError(lead.GrantPrivilege("dev", permissions.GrantTable, testTable, false), "Failed to delegate privilege")
+	hasPrivilege, err := ts.rbac.HasPrivilege("dev", permissions.GrantTable, testTable)
+	ts.assertNoError(err, "Failed to check privilege")
+	ts.assertPermission(hasPrivilege, true, "Delegated grant privilege")
+	if err := dev.GrantPrivilege("lead", permissions.GrantTable, testTable, false); !errors.Is(err, ErrInsufficientPrivilege) {
+		t.Errorf("Expected insufficient privilege delegating without grant option, got %v", err)
+	}
+	if err := lead.GrantPrivilege("dev", permissions.ManageRoles, "", false); !errors.Is(err, ErrInsufficientPrivilege) {
+		t.Errorf("Expected insufficient privilege delegating unheld privilege, got %v", err)
+	}
+
+	// Privileges granted to roles apply to their members, and granting such a
+	// role requires being able to delegate its privileges
+	_, err = root.CreateRole("role_admins")
+	ts.assertNoError(err, "Failed to create role")
+	ts.assertNoError(root.GrantPrivilege("role_admins", permissions.ManageRoles, "", false), "Failed to grant privilege to role")
+	ts.assertNoError(root.GrantPrivilege("lead", permissions.ManageUsers, "", false), "Failed to grant privilege")
+	if err := lead.AssignRoleToUser("lead", "role_admins"); !errors.Is(err, ErrInsufficientPrivilege) {
+		t.Errorf("Expected insufficient privilege assigning privileged role, got %v", err)
+	}
+	ts.assertNoError(root.AssignRoleToUser("dev", "role_admins"), "Failed to assign role")
+	_, err = dev.CreateRole("analyst")
+	ts.assertNoError(err, "Failed to create role through role privilege")
+
+	// Revoking the privilege removes it
+	ts.assertNoError(root.RevokePrivilege("dev", permissions.GrantTable, testTable), "Failed to revoke privilege")
+	hasPrivilege, err = ts.rbac.HasPrivilege("dev", permissions.GrantTable, testTable)
+	ts.assertNoError(err, "Failed to check privilege")
+	ts.assertPermission(hasPrivilege, false, "Revoked grant privilege")
+
+	// Data revokes leave system privileges alone
+	ts.assertNoError(root.Revoke("lead", GrantPolicy{Table: testTable}, Cascade), "Failed to revoke on table")
+	hasPrivilege, err = ts.rbac.HasPrivilege("lead", permissions.GrantTable, testTable)
+	ts.assertNoError(err, "Failed to check privilege")
+	ts.assertPermission(hasPrivilege, true, "Grant privilege after data revoke")
+
+	if _, err := lead.ApplyPolicy(&Policy{Version: PolicyVersion}, ApplyOptions{}); !errors.Is(err, ErrInsufficientPrivilege) {
+		t.Errorf("Expected insufficient privilege applying policy, got %v", err)
+	}
+
+	// Applying a policy leaves system privileges alone
+	_, err = root.ApplyPolicy(&Policy{Version: PolicyVersion}, ApplyOptions{Prune: true})
+	ts.assertNoError(err, "Failed to apply policy")
+	hasPrivilege, err = ts.rbac.HasPrivilege("lead", permissions.GrantTable, testTable)
+	ts.assertNoError(err, "Failed to check privilege")
+	ts.assertPermission(hasPrivilege, true, "Grant privilege after applying policy")
+}
+
+func TestRBACManager_SystemActor(t *testing.T) {
+	ts := newTestSetup(t)
+	ts.auth.AddUser("mallory", "mallory_token")
+
+	// A manager without an actor answers checks but makes no changes
+	m := NewRBACManager(ts.auth)
+	if err := m.GrantPrivilege("mallory", permissions.Superuser, "", false); !errors.Is(err, ErrInsufficientPrivilege) {
+		t.Errorf("Expected insufficient privilege without an actor, got %v", err)
+	}
+	if _, err := m.CreateRole("analyst"); !errors.Is(err, ErrInsufficientPrivilege) {
+		t.Errorf("Expected insufficient privilege creating role without an actor, got %v", err)
+	}
+	if _, err := m.ExportPolicy(); !errors.Is(err, ErrInsufficientPrivilege) {
+		t.Errorf("Expected insufficient privilege exporting without an actor, got %v", err)
+	}
+	if _, err := m.As("").ListRoles(); !errors.Is(err, ErrInsufficientPrivilege) {
+		t.Errorf("Expected insufficient privilege listing roles with an empty actor, got %v", err)
+	}
+
+	// The superuser is bootstrapped once; bootstrapping another user fails
+	ts.assertNoError(BootstrapSuperuser(ts.auth, testUsername), "Failed to bootstrap superuser")
+	ts.assertNoError(BootstrapSuperuser(ts.auth, testUsername), "Failed to repeat bootstrap")
+	if err := BootstrapSuperuser(ts.auth, "mallory"); !errors.Is(err, ErrSuperuserExists) {
+		t.Errorf("Expected existing superuser error, got %v", err)
+	}
+	hasPrivilege, err := m.HasPrivilege("mallory", permissions.Superuser, "")
+	ts.assertNoError(err, "Failed to check privilege")
+	ts.assertPermission(hasPrivilege, false, "Superuser after second bootstrap")
+
+	// The bootstrapped superuser lists roles and their members
+	root := m.As(testUsername)
+	_, err = root.CreateRole("analyst")
+	ts.assertNoError(err, "Failed to create role")
+	ts.assertNoError(root.AssignRoleToUser("mallory", "analyst"), "Failed to assign role")
+	roles, err := root.ListRoles()
+	ts.assertNoError(err, "Failed to list roles")
+	if len(roles) != 1 || roles[0] != "analyst" {
+		t.Errorf("Expected roles [analyst], got %v", roles)
+	}
+	members, err := root.RoleMembers("analyst")
+	ts.assertNoError(err, "Failed to list role members")
+	if len(members) != 1 || members[0] != "mallory" {
+		t.Errorf("Expected members [mallory], got %v", members)
+	}
+	if _, err := root.As("mallory").RoleMembers("analyst"); !errors.Is(err, ErrInsufficientPrivilege) {
+		t.Errorf("Expected insufficient privilege listing members, got %v", err)
+	}
+}
+
+func TestRBACManager_Accounts(t *testing.T) {
+	ts := newTestSetup(t)
+	ts.auth.AddUser("ops", "ops_token")
+	ts.auth.AddUser("dev", "dev_token")
+	ops := ts.rbac.As("ops")
+	var events []audit.Event
+	ops.Audit = audit.SinkFunc(func(ctx context.Context, event audit.Event) error {
+		events = append(events, event)
+		return nil
+	})
+
+	// Managing accounts requires the privilege to manage users
+	if err := ops.DisableUser("dev"); !errors.Is(err, ErrInsufficientPrivilege) {
+		t.Errorf("Expected insufficient privilege disabling user, got %v", err)
+	}
+	if _, err := ops.ListSessions(); !errors.Is(err, ErrInsufficientPrivilege) {
+		t.Errorf("Expected insufficient privilege listing sessions, got %v", err)
+	}
+	ts.assertNoError(ts.rbac.GrantPrivilege("ops", permissions.ManageUsers, "", false), "Failed to grant privilege")
+
+	devID, err := ts.auth.GetUserID("dev")
+	ts.assertNoError(err, "Failed to get user ID")
+	ts.assertNoError(ts.auth.StoreSession("dev-session", devID), "Failed to store session")
+	sessions, err := ops.ListSessions()
+	ts.assertNoError(err, "Failed to list sessions")
+	if len(sessions) != 1 || sessions[0].Username != "dev" {
+		t.Errorf("Expected the session of dev, got %v", sessions)
+	}
+	ts.assertNoError(ops.TerminateSession("dev-session"), "Failed to terminate session")
+	valid, err := ts.auth.ValidateSession("dev-session")
+	ts.assertNoError(err, "Failed to validate session")
+	ts.assertPermission(valid, false, "Terminated session")
+
+	ts.assertNoError(ops.ResetToken("dev", "new_token"), "Failed to reset token")
+	authenticated, err := ts.auth.Authenticate("dev", "new_token")
+	ts.assertNoError(err, "Failed to authenticate")
+	ts.assertPermission(authenticated, true, "New token")
+	ts.assertNoError(ops.DisableUser("dev"), "Failed to disable user")
+	authenticated, err = ts.auth.Authenticate("dev", "new_token")
+	ts.assertNoError(err, "Failed to authenticate")
+	ts.assertPermission(authenticated, false, "Disabled user")
+
+	accounts, err := ops.ListAccounts()
+	ts.assertNoError(err, "Failed to list accounts")
+	for _, account := range accounts {
+		if account.Disabled != (account.Name == "dev") {
+			t.Errorf("Unexpected account state %v", account)
+		}
+	}
+
+	// Changes and refusals are audited
+	var operations []string
+	for _, event := range events {
+		operations = append(operations, event.Operation+" "+string(event.Decision))
+	}
+	expected := []string{"disable_user deny", "terminate_session allow", "reset_token allow", "disable_user allow"}
+	if strings.Join(operations, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("Expected audited operations %v, got %v", expected, operations)
+	}
+}
+
+func TestRBACManager_GrantOption(t *testing.T) {
+	ts := newTestSetup(t)
+	ts.auth.AddUser("lead", "lead_token")
+	ts.auth.AddUser("dev", "dev_token")
+	ts.auth.AddUser("intern", "intern_token")
+	lead := ts.rbac.As("lead")
+	dev := ts.rbac.As("dev")
+	selectGrant := GrantPolicy{Table: testTable, Actions: []string{"select"}}
+
+	// Holders of a grant option may re-grant the same or a narrower permission
+	ts.assertNoError(ts.rbac.Grant("lead", GrantPolicy{Table: testTable, Actions: []string{"select"}, GrantOption: true}), "Failed to grant with grant option")
+	ts.assertNoError(lead.Grant("dev", GrantPolicy{Table: testTable, Actions: []string{"select"}, Columns: []string{testColumn}, GrantOption: true}), "Failed to re-grant")
+	ts.assertNoError(dev.Grant("intern", selectGrant), "Failed to re-grant narrower")
+	if err := lead.Grant("dev", GrantPolicy{Table: testTable, Actions: []string{"insert"}}); !errors.Is(err, ErrInsufficientPrivilege) {
+		t.Errorf("Expected insufficient privilege granting unheld action, got %v", err)
+	}
+	if err := dev.Grant("intern", GrantPolicy{Table: "other_table", Actions: []string{"select"}}); !errors.Is(err, ErrInsufficientPrivilege) {
+		t.Errorf("Expected insufficient privilege granting on other table, got %v", err)
+	}
+
+	// Grants record their grantor
+	devPerms, err := ts.auth.GetUserPermissions("dev")
+	ts.assertNoError(err, "Failed to get user permissions")
+	for _, perm := range devPerms {
+		if perm.Grantor != "lead" || !perm.GrantOption {
+			t.Errorf("Expected grant option from lead, got %v", perm)
+		}
+	}
+
+	// Users without the grant privilege only revoke their own grants
+	ts.assertNoError(ts.rbac.Grant("intern", GrantPolicy{Table: testTable, Actions: []string{"update"}}), "Failed to grant")
+	ts.assertNoError(dev.Revoke("intern", GrantPolicy{Table: testTable, Actions: []string{"select", "update"}}, Cascade), "Failed to revoke own grant")
+	internPerms, err := ts.auth.GetUserPermissions("intern")
+	ts.assertNoError(err, "Failed to get user permissions")
+	if len(internPerms) != 1 || internPerms[0].Action != permissions.Update {
+		t.Errorf("Expected only the application grant to remain, got %v", internPerms)
+	}
+	if err := ts.rbac.As("intern").Revoke("dev", selectGrant, Cascade); !errors.Is(err, ErrInsufficientPrivilege) {
+		t.Errorf("Expected insufficient privilege revoking without grant option, got %v", err)
+	}
+	ts.assertNoError(dev.Grant("intern", selectGrant), "Failed to re-grant")
+
+	// Restrict refuses to revoke a grant option others depend on
+	if err := ts.rbac.Revoke("lead", GrantPolicy{Table: testTable, Actions: []string{"select"}, GrantOption: true}, Restrict); err == nil {
+		t.Error("Expected restrict to refuse revoking a grant option with dependents")
+	}
+	hasPermission, err := ts.rbac.CheckPermission("intern", testTable, permissions.Select)
+	ts.assertNoError(err, "Failed to check permission")
+	ts.assertPermission(hasPermission, true, "Grant after refused revoke")
+
+	// Revoking only the grant option keeps the permission but cascades
+	ts.assertNoError(ts.rbac.Revoke("lead", GrantPolicy{Table: testTable, Actions: []string{"select"}, GrantOption: true}, Cascade), "Failed to revoke grant option")
+	hasPermission, err = ts.rbac.CheckPermission("lead", testTable, permissions.Select)
+	ts.assertNoError(err, "Failed to check permission")
+	ts.assertPermission(hasPermission, true, "Permission after revoking grant option")
+	for _, user := range []string{"dev", "intern"} {
+		perms, err := ts.auth.GetUserPermissions(user)
+		ts.assertNoError(err, "Failed to get user permissions")
+		for _, perm := range perms {
+			if perm.Action == permissions.Select {
+				t.Errorf("Expected cascading revoke to remove %v from %s", perm, user)
+			}
+		}
+	}
+
+	// Grants through a holder of the grant privilege do not depend on grant options
+	ts.assertNoError(ts.rbac.GrantPrivilege("lead", permissions.GrantTable, testTable, false), "Failed to grant privilege")
+	ts.assertNoError(lead.Grant("dev", selectGrant), "Failed to grant with privilege")
+	ts.assertNoError(ts.rbac.Revoke("lead", selectGrant, Restrict), "Failed to revoke without dependents")
+	hasPermission, err = ts.rbac.CheckPermission("dev", testTable, permissions.Select)
+	ts.assertNoError(err, "Failed to check permission")
+	ts.assertPermission(hasPermission, true, "Grant by privilege holder after revoke")
+}
+
+func TestRBACManager_GrantOptionCycle(t *testing.T) {
+	ts := newTestSetup(t)
+	ts.auth.AddUser("alice", "alice_token")
+	ts.auth.AddUser("bob", "bob_token")
+	option := GrantPolicy{Table: testTable, Actions: []string{"select"}, GrantOption: true}
+
+	// Grants that only support each other are revoked together
+	ts.assertNoError(ts.rbac.Grant("alice", option), "Failed to grant")
+	ts.assertNoError(ts.rbac.As("alice").Grant("bob", option), "Failed to re-grant")
+	ts.assertNoError(ts.rbac.As("bob").Grant("alice", option), "Failed to grant back")
+	ts.assertNoError(ts.rbac.Revoke("alice", GrantPolicy{Table: testTable, Actions: []string{"select"}}, Cascade), "Failed to revoke")
+	for _, user := range []string{"alice", "bob"} {
+		hasPermission, err := ts.rbac.CheckPermission(user, testTable, permissions.Select)
+		ts.assertNoError(err, "Failed to check permission")
+		ts.assertPermission(hasPermission, false, "Circular grant after revoke")
+	}
+}
+
+func TestRBACManager_TimeBoundGrants(t *testing.T) {
+	ts := newTestSetup(t)
+	ts.auth.AddUser("contractor", "contractor_token")
+	ts.auth.AddUser("helper", "helper_token")
+	now := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	ts.rbac.Now = func() time.Time { return now }
+	start, end := now.Add(time.Hour), now.Add(8*time.Hour)
+
+	// Grants are ignored outside their window
+	ts.assertNoError(ts.rbac.Grant("contractor", GrantPolicy{
+		Table:       testTable,
+		Actions:     []string{"select"},
+		GrantOption: true,
+		NotBefore:   &start,
+		NotAfter:    &end,
+	}), "Failed to grant")
+	for _, tc := range []struct {
+		at   time.Time
+		want bool
+	}{
+		{now, false},
+		{start, true},
+		{end.Add(-time.Second), true},
+		{end, false},
+	} {
+		now = tc.at
+		hasPermission, err := ts.rbac.CheckPermission("contractor", testTable, permissions.Select)
+		ts.assertNoError(err, "Failed to check permission")
+		ts.assertPermission(hasPermission, tc.want, "Permission at "+tc.at.Format(time.Kitchen))
+	}
+
+	// Re-grants cannot outlast the grant option they are made through
+	now = start
+	contractor := ts.rbac.As("contractor")
+	later := end.Add(time.Hour)
+	if err := contractor.Grant("helper", GrantPolicy{Table: testTable, Actions: []string{"select"}}); !errors.Is(err, ErrInsufficientPrivilege) {
+		t.Errorf("Expected insufficient privilege granting beyond the window, got %v", err)
+	}
+	if err := contractor.Grant("helper", GrantPolicy{Table: testTable, Actions: []string{"select"}, NotBefore: &start, NotAfter: &later}); !errors.Is(err, ErrInsufficientPrivilege) {
+		t.Errorf("Expected insufficient privilege granting beyond the window, got %v", err)
+	}
+	ts.assertNoError(contractor.Grant("helper", GrantPolicy{Table: testTable, Actions: []string{"select"}, NotBefore: &start, NotAfter: &end}), "Failed to re-grant within the window")
+
+	// Role memberships are ignored outside their window
+	_, err := ts.rbac.CreateRole("oncall")
+	ts.assertNoError(err, "Failed to create role")
+	ts.assertNoError(ts.rbac.Grant("oncall", GrantPolicy{Table: testTable, Actions: []string{"update"}}), "Failed to grant to role")
+	if err := ts.rbac.AssignRoleToUserBetween("contractor", "oncall", end, start); err == nil {
+		t.Error("Expected error for membership ending before it starts")
+	}
+	ts.assertNoError(ts.rbac.AssignRoleToUserBetween("contractor", "oncall", time.Time{}, end), "Failed to assign role")
+	hasRole, err := ts.rbac.UserHasRole("contractor", "oncall")
+	ts.assertNoError(err, "Failed to check role")
+	ts.assertPermission(hasRole, true, "Role within window")
+	now = end
+	hasRole, err = ts.rbac.UserHasRole("contractor", "oncall")
+	ts.assertNoError(err, "Failed to check role")
+	ts.assertPermission(hasRole, false, "Role after window")
+	hasPermission, err := ts.rbac.CheckPermission("contractor", testTable, permissions.Update)
+	ts.assertNoError(err, "Failed to check permission")
+	ts.assertPermission(hasPermission, false, "Role permission after window")
+
+	// The sweeper purges expired grants, the grants made through them and
+	// expired memberships, and records each of them
+	var events []audit.Event
+	sink := audit.SinkFunc(func(ctx context.Context, event audit.Event) error {
+		events = append(events, event)
+		return nil
+	})
+	expired, err := NewSweeper(ts.rbac, sink, time.Minute).Sweep(context.Background())
+	ts.assertNoError(err, "Failed to sweep")
+	if len(expired) != 3 || len(events) != 3 {
+		t.Fatalf("Expected 3 purged grants and events, got %v and %v", expired, events)
+	}
+	counts := make(map[audit.EventType]int)
+	for _, event := range events {
+		counts[event.Type]++
+		if !event.Time.Equal(now) {
+			t.Errorf("Expected event at %v, got %v", now, event.Time)
+		}
+	}
+	if counts[audit.EventGrantExpired] != 2 || counts[audit.EventMembershipExpired] != 1 {
+		t.Errorf("Unexpected audit events: %v", events)
+	}
+	for _, user := range []string{"contractor", "helper"} {
+		perms, err := ts.auth.GetUserPermissions(user)
+		ts.assertNoError(err, "Failed to get user permissions")
+		if len(perms) != 0 {
+			t.Errorf("Expected no permissions for %s after sweep, got %v", user, perms)
+		}
+	}
+	roles, err := ts.auth.GetUserRoles("contractor")
+	ts.assertNoError(err, "Failed to get user roles")
+	if len(roles) != 0 {
+		t.Errorf("Expected no roles after sweep, got %v", roles)
+	}
+
+	expired, err = ts.rbac.PurgeExpired()
+	ts.assertNoError(err, "Failed to purge")
+	if len(expired) != 0 {
+		t.Errorf("Expected nothing left to purge, got %v", expired)
+	}
+}
+
+func TestRBACManager_PurgeCascades(t *testing.T) {
+	ts := newTestSetup(t)
+	ts.auth.AddUser("lead", "lead_token")
+	ts.auth.AddUser("dev", "dev_token")
+	now := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	ts.rbac.Now = func() time.Time { return now }
+
+	// Grants made through the grant option of an expired membership are revoked
+	_, err := ts.rbac.CreateRole("leads")
+	ts.assertNoError(err, "Failed to create role")
+	ts.assertNoError(ts.rbac.Grant("leads", GrantPolicy{Table: testTable, Actions: []string{"select"}, GrantOption: true}), "Failed to grant to role")
+	ts.assertNoError(ts.rbac.AssignRoleToUserBetween("lead", "leads", time.Time{}, now.Add(time.Hour)), "Failed to assign role")
+	ts.assertNoError(ts.rbac.As("lead").Grant("dev", GrantPolicy{Table: testTable, Actions: []string{"select"}}), "Failed to re-grant")
+	ts.assertNoError(ts.rbac.Grant("dev", GrantPolicy{Table: testTable, Actions: []string{"insert"}}), "Failed to grant")
+
+	now = now.Add(time.Hour)
+	expired, err := ts.rbac.PurgeExpired()
+	ts.assertNoError(err, "Failed to purge")
+	if len(expired) != 2 || expired[0].Role != "leads" || !expired[1].Cascaded {
+		t.Errorf("Expected the membership and a cascaded grant, got %v", expired)
+	}
+	perms, err := ts.auth.GetUserPermissions("dev")
+	ts.assertNoError(err, "Failed to get user permissions")
+	if len(perms) != 1 || perms[0].Action != permissions.Insert {
+		t.Errorf("Expected only the application grant to remain, got %v", perms)
+	}
+}
+
+func TestRBACManager_RevokeCascades(t *testing.T) {
+	tableGrant := GrantPolicy{Table: testTable, Actions: []string{"select"}}
+	columnGrant := GrantPolicy{Table: testTable, Actions: []string{"select"}, Columns: []string{testColumn}, WithoutTable: true}
+	rowGrant := GrantPolicy{Table: testTable, Actions: []string{"select"}, Row: "id > 0", WithoutTable: true}
+	withOption := func(grant GrantPolicy) GrantPolicy {
+		grant.GrantOption = true
+		return grant
+	}
+	tests := []struct {
+		name   string
+		grant  GrantPolicy
+		setup  func(m *RBACManager) error
+		revoke func(m *RBACManager) error
+	}{
+		{
+			name:   "remove role",
+			grant:  tableGrant,
+			setup:  func(m *RBACManager) error { return m.Grant("leads", withOption(tableGrant)) },
+			revoke: func(m *RBACManager) error { return m.RemoveRoleFromUser("lead", "leads") },
+		},
+		{
+			name:   "delete role",
+			grant:  tableGrant,
+			setup:  func(m *RBACManager) error { return m.Grant("leads", withOption(tableGrant)) },
+			revoke: func(m *RBACManager) error { return m.DeleteRole("leads") },
+		},
+		{
+			name:  "revoke table permission",
+			grant: tableGrant,
+			setup: func(m *RBACManager) error { return m.Grant("lead", withOption(tableGrant)) },
+			revoke: func(m *RBACManager) error {
+				return m.RevokeTablePermission("lead", testTable, permissions.TablePermission)
+			},
+		},
+		{
+			name:  "revoke column permission",
+			grant: columnGrant,
+			setup: func(m *RBACManager) error { return m.Grant("lead", withOption(columnGrant)) },
+			revoke: func(m *RBACManager) error {
+				return m.RevokeColumnPermission("lead", testTable, testColumn, permissions.ColumnPermission)
+			},
+		},
+		{
+			name:  "revoke row permission",
+			grant: rowGrant,
+			setup: func(m *RBACManager) error { return m.Grant("lead", withOption(rowGrant)) },
+			revoke: func(m *RBACManager) error {
+				return m.RevokeRowPermission("lead", testTable, "id > 0", permissions.RowPermission)
+			},
+		},
+		{
+			name:  "revoke grant privilege",
+			grant: tableGrant,
+			setup: func(m *RBACManager) error { return m.GrantPrivilege("lead", permissions.GrantTable, testTable, false) },
+			revoke: func(m *RBACManager) error {
+				return m.RevokePrivilege("lead", permissions.GrantTable, testTable)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestSetup(t)
+			ts.auth.AddUser("lead", "lead_token")
+			ts.auth.AddUser("dev", "dev_token")
+			_, err := ts.rbac.CreateRole("leads")
+			ts.assertNoError(err, "Failed to create role")
+			ts.assertNoError(ts.rbac.AssignRoleToUser("lead", "leads"), "Failed to assign role")
+			ts.assertNoError(tt.setup(ts.rbac), "Failed to grant to lead")
+			ts.assertNoError(ts.rbac.As("lead").Grant("dev", tt.grant), "Failed to re-grant")
+
+			// Grants made through the removed permission or membership are revoked
+			ts.assertNoError(tt.revoke(ts.rbac), "Failed to revoke")
+			perms, err := ts.auth.GetUserPermissions("dev")
+			ts.assertNoError(err, "Failed to get user permissions")
+			if len(perms) != 0 {
+				t.Errorf("Expected cascading revoke to remove the grants to dev, got %v", perms)
+			}
+		})
+	}
+}
+
+func TestRBACManager_Elevate(t *testing.T) {
+	ts := newTestSetup(t)
+	ts.auth.AddUser("responder", "responder_token")
+	now := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	ts.rbac.Now = func() time.Time { return now }
+	_, err := ts.rbac.CreateRole("emergency")
+	ts.assertNoError(err, "Failed to create role")
+	ts.assertNoError(ts.rbac.Grant("emergency", GrantPolicy{Table: "*", Actions: []string{"select"}, GrantOption: true}), "Failed to grant to role")
+
+	// The elevation confers the role's permissions on the elevated tables only
+	elevated := ts.rbac.As("responder").Elevate(Elevation{Role: "emergency", Tables: []string{testTable}, NotAfter: now.Add(time.Hour)})
+	hasPermission, err := elevated.CheckPermission("responder", testTable, permissions.Select)
+	ts.assertNoError(err, "Failed to check permission")
+	ts.assertPermission(hasPermission, true, "Elevated table")
+	hasPermission, err = elevated.CheckPermission("responder", "other_table", permissions.Select)
+	ts.assertNoError(err, "Failed to check permission")
+	ts.assertPermission(hasPermission, false, "Table outside the elevation")
+	hasPermission, err = ts.rbac.CheckPermission("responder", testTable, permissions.Select)
+	ts.assertNoError(err, "Failed to check permission")
+	ts.assertPermission(hasPermission, false, "Manager without elevation")
+
+	// The emergency role only applies to the elevated tables
+	if role, ok := elevated.ElevatedRole(testTable); !ok || role != "emergency" {
+		t.Errorf("Expected the emergency role on the elevated table, got %q", role)
+	}
+	if _, ok := elevated.ElevatedRole("other_table"); ok {
+		t.Error("Expected no elevated role on a table outside the elevation")
+	}
+	roles, err := elevated.GetUserRoles("responder")
+	ts.assertNoError(err, "Failed to get roles")
+	if len(roles) != 0 {
+		t.Errorf("Expected the emergency role not to be held on every table, got %v", roles)
+	}
+
+	// The elevation cannot be passed on and ends at NotAfter
+	if err := elevated.Grant("helper", GrantPolicy{Table: testTable, Actions: []string{"select"}}); !errors.Is(err, ErrInsufficientPrivilege) {
+		t.Errorf("Expected insufficient privilege re-granting an elevation, got %v", err)
+	}
+	now = now.Add(time.Hour)
+	hasPermission, err = elevated.CheckPermission("responder", testTable, permissions.Select)
+	ts.assertNoError(err, "Failed to check permission")
+	ts.assertPermission(hasPermission, false, "Elevated table after the elevation")
+}
+
+func TestAccessWorkflow(t *testing.T) {
+	ts := newTestSetup(t)
+	for _, user := range []string{"alice", "bob", "carol"} {
+		ts.auth.AddUser(user, user+"_token")
+	}
+	now := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	ts.rbac.Now = func() time.Time { return now }
+	for _, role := range []string{"approvers", "analyst"} {
+		_, err := ts.rbac.CreateRole(role)
+		ts.assertNoError(err, "Failed to create role")
+	}
+	ts.assertNoError(ts.rbac.Grant("analyst", GrantPolicy{Table: "reports", Actions: []string{"select"}}), "Failed to grant to role")
+	ts.assertNoError(ts.rbac.AssignRoleToUser("alice", "approvers"), "Failed to assign role")
+	ts.assertNoError(ts.rbac.AssignRoleToUser("bob", "approvers"), "Failed to assign role")
+
+	var events []audit.Event
+	var notified []AccessRequestStatus
+	workflow, err := NewAccessWorkflow(ts.rbac, AccessWorkflowConfig{
+		ApproverRole:      "approvers",
+		RequiredApprovals: 2,
+		MaxDuration:       4 * time.Hour,
+		PendingTimeout:    time.Hour,
+		Sink: audit.SinkFunc(func(ctx context.Context, event audit.Event) error {
+			events = append(events, event)
+			return nil
+		}),
+		Notifier: NotifierFunc(func(ctx context.Context, request AccessRequest) {
+			notified = append(notified, request.Status)
+		}),
+	})
+	ts.assertNoError(err, "Failed to create workflow")
+	ctx := context.Background()
+
+	// Requests need a justification and stay within the maximum duration
+	if _, err := workflow.Request(ctx, "carol", AccessRequest{Role: "analyst"}); err == nil {
+		t.Error("Expected error for request without justification")
+	}
+	if _, err := workflow.Request(ctx, "carol", AccessRequest{Role: "analyst", Justification: "Q1 report", Duration: 5 * time.Hour}); err == nil {
+		t.Error("Expected error for request beyond the maximum duration")
+	}
+	if _, err := workflow.Request(ctx, "carol", AccessRequest{Grant: &GrantPolicy{Table: testTable, Actions: []string{"delete"}, GrantOption: true}, Justification: "cleanup"}); err == nil {
+		t.Error("Expected error for request with grant option")
+	}
+
+	// A role request is granted once it has the required approvals
+	request, err := workflow.Request(ctx, "carol", AccessRequest{Role: "analyst", Justification: "Q1 report", Duration: 2 * time.Hour})
+	ts.assertNoError(err, "Failed to request access")
+	if _, err := workflow.Approve(ctx, "carol", request.ID); !errors.Is(err, ErrInsufficientPrivilege) {
+		t.Errorf("Expected insufficient privilege approving as a non-approver, got %v", err)
+	}
+	request, err = workflow.Approve(ctx, "alice", request.ID)
+	ts.assertNoError(err, "Failed to approve")
+	if request.Status != RequestPending {
+		t.Errorf("Expected request to await a second approval, got %s", request.Status)
+	}
+	if _, err := workflow.Approve(ctx, "alice", request.ID); err == nil {
+		t.Error("Expected error approving twice")
+	}
+	request, err = workflow.Approve(ctx, "bob", request.ID)
+	ts.assertNoError(err, "Failed to approve")
+	if request.Status != RequestApproved || !request.NotAfter.Equal(now.Add(2*time.Hour)) {
+		t.Errorf("Expected request approved until %v, got %s until %v", now.Add(2*time.Hour), request.Status, request.NotAfter)
+	}
+	hasPermission, err := ts.rbac.CheckPermission("carol", "reports", permissions.Select)
+	ts.assertNoError(err, "Failed to check permission")
+	ts.assertPermission(hasPermission, true, "Approved role")
+
+	// Table grants can be denied, and undecided requests expire
+	denied, err := workflow.Request(ctx, "carol", AccessRequest{Grant: &GrantPolicy{Table: testTable, Actions: []string{"delete"}}, Justification: "cleanup"})
+	ts.assertNoError(err, "Failed to request access")
+	_, err = workflow.Deny(ctx, "alice", denied.ID, "use the cleanup job")
+	ts.assertNoError(err, "Failed to deny")
+	if _, err := workflow.Approve(ctx, "bob", denied.ID); err == nil {
+		t.Error("Expected error approving a denied request")
+	}
+	pending, err := workflow.Request(ctx, "carol", AccessRequest{Grant: &GrantPolicy{Table: testTable, Actions: []string{"update"}}, Justification: "fix typo"})
+	ts.assertNoError(err, "Failed to request access")
+	now = now.Add(2 * time.Hour)
+
+	// Requesters see their own requests, approvers see every request
+	requests, err := workflow.List(ctx, "carol", AccessRequestFilter{})
+	ts.assertNoError(err, "Failed to list requests")
+	var statuses []AccessRequestStatus
+	for _, r := range requests {
+		statuses = append(statuses, r.Status)
+	}
+	if want := []AccessRequestStatus{RequestExpired, RequestDenied, RequestExpired}; len(statuses) != len(want) || statuses[0] != want[0] || statuses[1] != want[1] || statuses[2] != want[2] {
+		t.Errorf("Expected statuses %v, got %v", want, statuses)
+	}
+	if requests, err := workflow.List(ctx, testUsername, AccessRequestFilter{}); err != nil || len(requests) != 0 {
+		t.Errorf("Expected no requests visible to another user, got %v, %v", requests, err)
+	}
+	if requests, err := workflow.List(ctx, "alice", AccessRequestFilter{Status: RequestExpired}); err != nil || len(requests) != 2 {
+		t.Errorf("Expected two expired requests visible to an approver, got %v, %v", requests, err)
+	}
+	if _, err := workflow.Get(ctx, testUsername, pending.ID); !errors.Is(err, ErrRequestNotFound) {
+		t.Errorf("Expected request to be hidden from another user, got %v", err)
+	}
+	hasPermission, err = ts.rbac.CheckPermission("carol", "reports", permissions.Select)
+	ts.assertNoError(err, "Failed to check permission")
+	ts.assertPermission(hasPermission, false, "Role after the access ended")
+
+	// Every change of a request is audited and notified
+	var types []string
+	for _, event := range events {
+		types = append(types, string(event.Type))
+	}
+	want := "access_requested access_approved access_approved access_requested access_denied access_requested access_expired access_expired"
+	if strings.Join(types, " ") != want {
+		t.Errorf("Expected events %s, got %s", want, strings.Join(types, " "))
+	}
+	if len(notified) != 7 {
+		t.Errorf("Expected 7 notifications, got %v", notified)
+	}
+}
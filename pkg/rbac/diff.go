@@ -0,0 +1,216 @@
+package rbac
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/auth"
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+)
+
+// DiffPolicies compares two policies, e.g. two exports taken at different
+// times. The report lists the roles, role inheritance, role grants and denies,
+// users, role memberships and system privileges that were added or removed
+// between from and to, and the changes to the effective permissions of every
+// user. The catalog lists
+// the tables that denies on one table narrow grants on every table to, as with
+// ApplyOptions.
+func DiffPolicies(from, to *Policy, catalog Catalog) (*PolicyReport, error) {
+	if err := from.Validate(nil); err != nil {
+		return nil, fmt.Errorf("invalid source policy: %w", err)
+	}
+	if err := to.Validate(nil); err != nil {
+		return nil, fmt.Errorf("invalid target policy: %w", err)
+	}
+
+	report := &PolicyReport{Changes: []PolicyChange{}}
+
+	// Compare roles
+	fromRoles := make(map[string]RolePolicy, len(from.Roles))
+	for _, role := range from.Roles {
+		fromRoles[role.Name] = role
+	}
+	toRoles := make(map[string]RolePolicy, len(to.Roles))
+	for _, role := range to.Roles {
+		toRoles[role.Name] = role
+	}
+	for _, name := range unionKeys(fromRoles, toRoles) {
+		oldRole, inFrom := fromRoles[name]
+		newRole, inTo := toRoles[name]
+		switch {
+		case !inFrom:
+			report.add(ChangeAdded, KindRole, name, "")
+		case !inTo:
+			report.add(ChangeRemoved, KindRole, name, "")
+		}
+
+		added, removed := diffStrings(oldRole.Inherits, newRole.Inherits)
+		for _, parent := range removed {
+			report.add(ChangeRemoved, KindInherits, name, parent)
+		}
+		for _, parent := range added {
+			report.add(ChangeAdded, KindInherits, name, parent)
+		}
+		if err := report.addPrivilegeChanges(KindRolePrivilege, name, oldRole.Privileges, newRole.Privileges); err != nil {
+			return nil, err
+		}
+
+		oldGrants, err := compileGrants(oldRole.Grants)
+		if err != nil {
+			return nil, err
+		}
+		newGrants, err := compileGrants(newRole.Grants)
+		if err != nil {
+			return nil, err
+		}
+		addedPerms, removedPerms := diffPermissions(sortedPermissions(oldGrants), sortedPermissions(newGrants))
+		report.addPermissionChanges(KindRoleGrant, name, addedPerms, removedPerms)
+
+		oldDenies, err := denyPermissions(oldRole.Denies)
+		if err != nil {
+			return nil, err
+		}
+		newDenies, err := denyPermissions(newRole.Denies)
+		if err != nil {
+			return nil, err
+		}
+		addedPerms, removedPerms = diffPermissions(oldDenies, newDenies)
+		report.addPermissionChanges(KindRoleDeny, name, addedPerms, removedPerms)
+	}
+
+	// Compare users, their memberships and their effective permissions
+	fromUsers := make(map[string]UserPolicy, len(from.Users))
+	for _, user := range from.Users {
+		fromUsers[user.Name] = user
+	}
+	toUsers := make(map[string]UserPolicy, len(to.Users))
+	for _, user := range to.Users {
+		toUsers[user.Name] = user
+	}
+	for _, name := range unionKeys(fromUsers, toUsers) {
+		oldUser, inFrom := fromUsers[name]
+		newUser, inTo := toUsers[name]
+		switch {
+		case !inFrom:
+			report.add(ChangeAdded, KindUser, name, "")
+		case !inTo:
+			report.add(ChangeRemoved, KindUser, name, "")
+		}
+
+		report.addMembershipChanges(name, oldUser.memberships(), newUser.memberships())
+		if err := report.addPrivilegeChanges(KindPrivilege, name, oldUser.Privileges, newUser.Privileges); err != nil {
+			return nil, err
+		}
+
+		var oldPerms, newPerms []permissions.Permission
+		var err error
+		if inFrom {
+			if oldPerms, err = from.EffectivePermissions(name, catalog); err != nil {
+				return nil, err
+			}
+		}
+		if inTo {
+			if newPerms, err = to.EffectivePermissions(name, catalog); err != nil {
+				return nil, err
+			}
+		}
+		addedPerms, removedPerms := diffPermissions(oldPerms, newPerms)
+		report.addPermissionChanges(KindGrant, name, addedPerms, removedPerms)
+	}
+
+	return report, nil
+}
+
+// addMembershipChanges records the role memberships of a user that were added
+// or removed, or whose validity window changed
+func (r *PolicyReport) addMembershipChanges(username string, from, to []auth.RoleMembership) {
+	sortMemberships := func(memberships []auth.RoleMembership) {
+		sort.Slice(memberships, func(i, j int) bool { return memberships[i].Role < memberships[j].Role })
+	}
+	sortMemberships(from)
+	sortMemberships(to)
+	for _, membership := range from {
+		if _, ok := findMembership(to, membership.Role); !ok {
+			r.add(ChangeRemoved, KindMembership, username, membershipDetail(membership.Role, membership.NotBefore, membership.NotAfter))
+		}
+	}
+	for _, membership := range to {
+		held, ok := findMembership(from, membership.Role)
+		switch {
+		case !ok:
+			r.add(ChangeAdded, KindMembership, username, membershipDetail(membership.Role, membership.NotBefore, membership.NotAfter))
+		case !sameWindow(held, membership):
+			r.add(ChangeChanged, KindMembership, username, membershipChange(held, membership))
+		}
+	}
+}
+
+// addPrivilegeChanges records the system privileges added and removed between
+// two declarations. A changed grant option is recorded as a removal and an
+// addition.
+func (r *PolicyReport) addPrivilegeChanges(kind ChangeKind, subject string, from, to []PrivilegePolicy) error {
+	oldPerms, err := privilegePermissions(from)
+	if err != nil {
+		return err
+	}
+	newPerms, err := privilegePermissions(to)
+	if err != nil {
+		return err
+	}
+	added, removed := diffPermissions(oldPerms, newPerms)
+	r.addPermissionChanges(kind, subject, added, removed)
+	return nil
+}
+
+// denyPermissions returns the permissions denies remove: the table permission
+// for denies without columns and the column permissions otherwise
+func denyPermissions(denies []GrantPolicy) ([]permissions.Permission, error) {
+	set := make(map[permissions.Permission]bool)
+	for _, deny := range denies {
+		actions, err := expandActions(deny.Actions)
+		if err != nil {
+			return nil, err
+		}
+		for _, action := range actions {
+			if len(deny.Columns) == 0 {
+				set[permissions.Permission{Type: permissions.TablePermission, Table: deny.Table, Action: action}] = true
+			}
+			for _, column := range deny.Columns {
+				set[permissions.Permission{Type: permissions.ColumnPermission, Table: deny.Table, Column: column, Action: action}] = true
+			}
+		}
+	}
+	return sortedPermissions(set), nil
+}
+
+// diffStrings returns the strings only in b and the strings only in a
+func diffStrings(a, b []string) (added, removed []string) {
+	for _, s := range b {
+		if !containsString(a, s) {
+			added = append(added, s)
+		}
+	}
+	for _, s := range a {
+		if !containsString(b, s) {
+			removed = append(removed, s)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// unionKeys returns the sorted keys of two maps
+func unionKeys[V any](a, b map[string]V) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
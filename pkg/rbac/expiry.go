@@ -0,0 +1,173 @@
+package rbac
+
+import (
+	"context"
+	"time"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/audit"
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+)
+
+// ExpiredGrant describes a permission or role membership removed by PurgeExpired
+type ExpiredGrant struct {
+	// Grantee is the user or role that held the permission, or the user of a
+	// role membership
+	Grantee string
+	// Permission is the removed permission; nil for role memberships
+	Permission *permissions.Permission
+	// Role is the role of a removed membership
+	Role string
+	// Cascaded is set for permissions that had not expired themselves but were
+	// granted through an expired grant option
+	Cascaded bool
+}
+
+// PurgeExpired removes the permissions and role memberships whose validity
+// window has ended, together with the grants made through expired grant
+// options. Expired grants are already ignored by permission checks, so purging
+// them does not change access and requires no privilege.
+func (m *RBACManager) PurgeExpired() ([]ExpiredGrant, error) {
+	now := m.now()
+	state, err := m.loadGrantState()
+	if err != nil {
+		return nil, err
+	}
+	unsupported := state.unsupportedGrants()
+	var expired []ExpiredGrant
+
+	// Remove the expired role memberships
+	users, err := m.authProvider.ListUsers()
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		memberships, err := m.authProvider.GetUserRoleMemberships(user)
+		if err != nil {
+			return nil, err
+		}
+		var roles []string
+		for _, membership := range memberships {
+			if membership.ExpiredAt(now) {
+				expired = append(expired, ExpiredGrant{Grantee: user, Role: membership.Role})
+			} else {
+				roles = append(roles, membership.Role)
+			}
+		}
+		state.roles[user] = roles
+	}
+
+	// Remove the expired permissions
+	for _, holder := range state.holders() {
+		perms := state.perms[holder]
+		remaining := make([]permissions.Permission, 0, len(perms))
+		for _, perm := range perms {
+			if perm.ExpiredAt(now) {
+				perm := perm
+				expired = append(expired, ExpiredGrant{Grantee: holder.name, Permission: &perm})
+			} else {
+				remaining = append(remaining, perm)
+			}
+		}
+		if len(remaining) < len(perms) {
+			state.set(holder, remaining)
+		}
+	}
+
+	// Revoke the grants made through expired grant options
+	before := make(map[grantHolder][]permissions.Permission, len(state.perms))
+	for holder, perms := range state.perms {
+		before[holder] = perms
+	}
+	if err := state.revokeDependents(unsupported, Cascade); err != nil {
+		return nil, err
+	}
+	for _, holder := range state.holders() {
+		for _, perm := range before[holder] {
+			if !containsPermission(state.perms[holder], perm) {
+				perm := perm
+				expired = append(expired, ExpiredGrant{Grantee: holder.name, Permission: &perm, Cascaded: true})
+			}
+		}
+	}
+
+	if err := m.saveGrantState(state); err != nil {
+		return nil, err
+	}
+	for _, grant := range expired {
+		if grant.Permission == nil {
+			if err := m.authProvider.RemoveUserRole(grant.Grantee, grant.Role); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return expired, nil
+}
+
+// Sweeper periodically purges expired grants and records an audit event for
+// every permission and role membership it removes
+type Sweeper struct {
+	manager  *RBACManager
+	sink     audit.Sink
+	interval time.Duration
+}
+
+// NewSweeper creates a sweeper that purges expired grants every interval
+func NewSweeper(manager *RBACManager, sink audit.Sink, interval time.Duration) *Sweeper {
+	return &Sweeper{
+		manager:  manager,
+		sink:     sink,
+		interval: interval,
+	}
+}
+
+// Sweep purges the expired grants once and records them
+func (s *Sweeper) Sweep(ctx context.Context) ([]ExpiredGrant, error) {
+	expired, err := s.manager.PurgeExpired()
+	if err != nil {
+		return nil, err
+	}
+	if s.sink == nil {
+		return expired, nil
+	}
+
+	now := s.manager.now()
+	for _, grant := range expired {
+		event := audit.Event{
+			Time:      now,
+			Principal: s.manager.actor,
+			Subject:   grant.Grantee,
+		}
+		switch {
+		case grant.Permission == nil:
+			event.Type = audit.EventMembershipExpired
+			event.Detail = grant.Role
+		case grant.Cascaded:
+			event.Type = audit.EventGrantRevoked
+			event.Detail = grant.Permission.String()
+		default:
+			event.Type = audit.EventGrantExpired
+			event.Detail = grant.Permission.String()
+		}
+		if err := s.sink.Record(ctx, event); err != nil {
+			return expired, err
+		}
+	}
+	return expired, nil
+}
+
+// Run sweeps every interval until the context is done. Errors of a sweep are
+// passed to onError, if set, and do not stop the sweeper.
+func (s *Sweeper) Run(ctx context.Context, onError func(error)) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.Sweep(ctx); err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
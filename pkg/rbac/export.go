@@ -0,0 +1,255 @@
+package rbac
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/auth"
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+	"gopkg.in/yaml.v3"
+)
+
+// ExportPolicy exports the current state of the auth provider as a policy.
+// Roles are exported with the permissions stored on them and users with their
+// direct permissions, which include the materialized grants of applied
+// policies. Applying the exported policy reproduces the current effective
+// permissions. Column and row permissions without a table permission are
+// exported as grants without table, and system privileges are exported with
+// their grant option. Time-bound role memberships are exported with their
+// window. It requires the privilege to manage roles. Revoked row permissions
+// and grantors are left out.
+func (m *RBACManager) ExportPolicy() (*Policy, error) {
+	if err := m.Authorize(permissions.ManageRoles, ""); err != nil {
+		return nil, err
+	}
+	policy := &Policy{Version: PolicyVersion}
+
+	roles, err := m.authProvider.ListRoles()
+	if err != nil {
+		return nil, err
+	}
+	for _, role := range roles {
+		perms, err := m.authProvider.GetRolePermissions(role)
+		if err != nil {
+			return nil, err
+		}
+		policy.Roles = append(policy.Roles, RolePolicy{
+			Name:       role,
+			Privileges: permissionPrivileges(perms),
+			Grants:     permissionGrants(perms),
+		})
+	}
+
+	users, err := m.authProvider.ListUsers()
+	if err != nil {
+		return nil, err
+	}
+	for _, username := range users {
+		memberships, err := m.authProvider.GetUserRoleMemberships(username)
+		if err != nil {
+			return nil, err
+		}
+		userRoles, bounded := membershipPolicies(memberships)
+
+		perms, err := m.authProvider.GetUserPermissions(username)
+		if err != nil {
+			return nil, err
+		}
+
+		policy.Users = append(policy.Users, UserPolicy{
+			Name:        username,
+			Roles:       userRoles,
+			Memberships: bounded,
+			Privileges:  permissionPrivileges(perms),
+			Grants:      permissionGrants(perms),
+		})
+	}
+
+	return policy, nil
+}
+
+// membershipPolicies splits role memberships into the open-ended roles and the
+// time-bound memberships of a user, both ordered by role
+func membershipPolicies(memberships []auth.RoleMembership) (roles []string, bounded []MembershipPolicy) {
+	for _, membership := range memberships {
+		if membership.NotBefore.IsZero() && membership.NotAfter.IsZero() {
+			roles = append(roles, membership.Role)
+			continue
+		}
+		bounded = append(bounded, MembershipPolicy{
+			Role:      membership.Role,
+			NotBefore: timeRef(membership.NotBefore.UTC()),
+			NotAfter:  timeRef(membership.NotAfter.UTC()),
+		})
+	}
+	sort.Strings(roles)
+	sort.Slice(bounded, func(i, j int) bool { return bounded[i].Role < bounded[j].Role })
+	return roles, bounded
+}
+
+// permissionPrivileges converts the system permissions among permissions into
+// the privileges they confer, ordered by privilege and table
+func permissionPrivileges(perms []permissions.Permission) []PrivilegePolicy {
+	system, _ := systemPermissions(perms)
+	sort.SliceStable(system, func(i, j int) bool {
+		if system[i].Privilege != system[j].Privilege {
+			return system[i].Privilege < system[j].Privilege
+		}
+		return system[i].Table < system[j].Table
+	})
+	var privileges []PrivilegePolicy
+	for _, perm := range system {
+		privileges = append(privileges, PrivilegePolicy{
+			Privilege:   perm.Privilege.String(),
+			Table:       perm.Table,
+			GrantOption: perm.GrantOption,
+		})
+	}
+	return privileges
+}
+
+// permissionGrants converts permissions into the grants that confer them.
+// Actions with the same columns and row condition on a table share a grant.
+func permissionGrants(perms []permissions.Permission) []GrantPolicy {
+	type target struct {
+		table       string
+		action      permissions.Action
+		grantOption bool
+		notBefore   time.Time
+		notAfter    time.Time
+	}
+	type scope struct {
+		table   bool
+		columns []string
+		rows    []string
+	}
+
+	// Collect the columns and row conditions of every table and action
+	scopes := make(map[target]*scope)
+	var targets []target
+	for _, perm := range perms {
+		if perm.Type == permissions.SystemPermission {
+			continue
+		}
+		if perm.Type == permissions.RowPermission && (perm.Condition == "" || strings.HasPrefix(perm.Condition, permissions.RevokedPermissionPrefix)) {
+			continue
+		}
+		key := target{table: perm.Table, action: perm.Action, grantOption: perm.GrantOption, notBefore: perm.NotBefore.UTC(), notAfter: perm.NotAfter.UTC()}
+		s, ok := scopes[key]
+		if !ok {
+			s = &scope{}
+			scopes[key] = s
+			targets = append(targets, key)
+		}
+		switch perm.Type {
+		case permissions.TablePermission:
+			s.table = true
+		case permissions.ColumnPermission:
+			if !containsString(s.columns, perm.Column) {
+				s.columns = append(s.columns, perm.Column)
+			}
+		case permissions.RowPermission:
+			if !containsString(s.rows, perm.Condition) {
+				s.rows = append(s.rows, perm.Condition)
+			}
+		}
+	}
+
+	// Build one grant per row condition, merging actions with the same scope
+	var grants []GrantPolicy
+	index := make(map[string]int)
+	for _, key := range targets {
+		s := scopes[key]
+		sort.Strings(s.columns)
+		sort.Strings(s.rows)
+
+		base := GrantPolicy{Table: key.table, GrantOption: key.grantOption, WithoutTable: !s.table, NotBefore: timeRef(key.notBefore), NotAfter: timeRef(key.notAfter)}
+		specs := []GrantPolicy{base}
+		specs[0].Columns = s.columns
+		for i, row := range s.rows {
+			if i == 0 {
+				specs[0].Row = row
+				continue
+			}
+			spec := base
+			spec.Row = row
+			specs = append(specs, spec)
+		}
+
+		for _, spec := range specs {
+			id := fmt.Sprintf("%s\x00%s\x00%s\x00%t\x00%t\x00%s\x00%s", spec.Table, strings.Join(spec.Columns, "\x00"), spec.Row, spec.GrantOption, spec.WithoutTable, key.notBefore, key.notAfter)
+			i, ok := index[id]
+			if !ok {
+				i = len(grants)
+				index[id] = i
+				grants = append(grants, spec)
+			}
+			grants[i].Actions = append(grants[i].Actions, key.action.String())
+		}
+	}
+
+	// Order actions as declared and grants by table
+	for i := range grants {
+		sort.Slice(grants[i].Actions, func(a, b int) bool {
+			x, _ := permissions.ParseAction(grants[i].Actions[a])
+			y, _ := permissions.ParseAction(grants[i].Actions[b])
+			return x < y
+		})
+	}
+	sort.SliceStable(grants, func(i, j int) bool {
+		if grants[i].Table != grants[j].Table {
+			return grants[i].Table < grants[j].Table
+		}
+		if grants[i].Row != grants[j].Row {
+			return grants[i].Row < grants[j].Row
+		}
+		if grants[i].GrantOption != grants[j].GrantOption {
+			return !grants[i].GrantOption
+		}
+		if grants[i].WithoutTable != grants[j].WithoutTable {
+			return !grants[i].WithoutTable
+		}
+		if a, b := strings.Join(grants[i].Columns, ","), strings.Join(grants[j].Columns, ","); a != b {
+			return a < b
+		}
+		aFrom, aUntil := grants[i].window()
+		bFrom, bUntil := grants[j].window()
+		if !aFrom.Equal(bFrom) {
+			return aFrom.Before(bFrom)
+		}
+		return aUntil.Before(bUntil)
+	})
+	return grants
+}
+
+// timeRef returns a reference to a time, or nil for the zero time
+func timeRef(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// WriteYAML writes the policy as a YAML document
+func (p *Policy) WriteYAML(w io.Writer) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(p); err != nil {
+		return fmt.Errorf("failed to encode policy: %w", err)
+	}
+	return encoder.Close()
+}
+
+// WriteJSON writes the policy as an indented JSON document
+func (p *Policy) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(p); err != nil {
+		return fmt.Errorf("failed to encode policy: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,382 @@
+package rbac
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+)
+
+// RevokeBehavior controls what a revoke does with the grants that were made
+// through the revoked permissions
+type RevokeBehavior int
+
+const (
+	// Cascade revokes the dependent grants as well
+	Cascade RevokeBehavior = iota
+	// Restrict refuses the revoke if other grants depend on it
+	Restrict
+)
+
+// String returns the SQL keyword of a revoke behavior
+func (b RevokeBehavior) String() string {
+	if b == Restrict {
+		return "RESTRICT"
+	}
+	return "CASCADE"
+}
+
+// authorizeGrant checks that the actor may grant data permissions on a table:
+// holders of the grant privilege may grant anything, other users only what
+// they hold with grant option
+func (m *RBACManager) authorizeGrant(table string, perms []permissions.Permission) error {
+	if checked, err := m.checked(); !checked {
+		return err
+	}
+	if ok, err := m.HasPrivilege(m.actor, permissions.GrantTable, table); err != nil || ok {
+		return err
+	}
+	held, err := m.GetEffectivePermissions(m.actor)
+	if err != nil {
+		return err
+	}
+	for _, perm := range perms {
+		if !mayGrant(held, perm) {
+			return fmt.Errorf("%w: %s cannot grant %s", ErrInsufficientPrivilege, m.actor, perm)
+		}
+	}
+	return nil
+}
+
+// authorizeRevoke checks that the actor may revoke data permissions on a table
+// and reports whether the actor may revoke the grants of every grantor rather
+// than only its own
+func (m *RBACManager) authorizeRevoke(table string) (bool, error) {
+	if checked, err := m.checked(); !checked {
+		return err == nil, err
+	}
+	if ok, err := m.HasPrivilege(m.actor, permissions.GrantTable, table); err != nil || ok {
+		return ok, err
+	}
+	held, err := m.GetEffectivePermissions(m.actor)
+	if err != nil {
+		return false, err
+	}
+	for _, h := range held {
+		if h.Type != permissions.SystemPermission && h.GrantOption && coversTable(h.Table, table) {
+			return false, nil
+		}
+	}
+	return false, fmt.Errorf("%w: %s requires %s on %s or a grant option", ErrInsufficientPrivilege, m.actor, permissions.GrantTable, table)
+}
+
+// mayGrant checks if held permissions include a grant option covering a permission
+func mayGrant(held []permissions.Permission, perm permissions.Permission) bool {
+	for _, h := range held {
+		if h.GrantOption && coversGrant(h, perm) {
+			return true
+		}
+	}
+	return false
+}
+
+// coversGrant checks if a data permission includes another one: a table
+// permission includes every permission on the table for its action, column
+// and row permissions only the same column or condition. The validity window
+// of the included permission must lie within that of the held one.
+func coversGrant(held, perm permissions.Permission) bool {
+	if held.Type == permissions.SystemPermission || perm.Type == permissions.SystemPermission {
+		return false
+	}
+	if held.Action != perm.Action || !coversTable(held.Table, perm.Table) || !coversWindow(held, perm) {
+		return false
+	}
+	switch held.Type {
+	case permissions.TablePermission:
+		return true
+	case permissions.ColumnPermission:
+		return perm.Type == permissions.ColumnPermission && strings.EqualFold(held.Column, perm.Column)
+	case permissions.RowPermission:
+		return perm.Type == permissions.RowPermission && held.Condition == perm.Condition &&
+			!strings.HasPrefix(held.Condition, permissions.RevokedPermissionPrefix)
+	}
+	return false
+}
+
+// coversWindow checks if the validity window of a held permission includes
+// that of another permission
+func coversWindow(held, perm permissions.Permission) bool {
+	if !held.NotBefore.IsZero() && (perm.NotBefore.IsZero() || perm.NotBefore.Before(held.NotBefore)) {
+		return false
+	}
+	return held.NotAfter.IsZero() || (!perm.NotAfter.IsZero() && !perm.NotAfter.After(held.NotAfter))
+}
+
+// addGrant adds a permission to a list unless the list already holds it from
+// the same grantor. A grant option upgrades the held permission and the
+// validity window of the new permission replaces the held one.
+func addGrant(perms []permissions.Permission, perm permissions.Permission) []permissions.Permission {
+	for i, p := range perms {
+		same := perm
+		same.GrantOption, same.NotBefore, same.NotAfter = p.GrantOption, p.NotBefore, p.NotAfter
+		if p != same {
+			continue
+		}
+		perm.GrantOption = perm.GrantOption || p.GrantOption
+		perms[i] = perm
+		return perms
+	}
+	return append(perms, perm)
+}
+
+// withoutGrantors removes the grantors from permissions, merging the
+// permissions that only differed by grantor
+func withoutGrantors(perms []permissions.Permission) []permissions.Permission {
+	merged := make([]permissions.Permission, 0, len(perms))
+	for _, perm := range perms {
+		perm.Grantor = ""
+		merged = addGrant(merged, perm)
+	}
+	return merged
+}
+
+// grantHolder identifies a role or user that holds permissions
+type grantHolder struct {
+	name   string
+	isRole bool
+}
+
+// grantRef identifies a permission held by a role or user
+type grantRef struct {
+	holder grantHolder
+	perm   permissions.Permission
+}
+
+// grantState is a snapshot of every stored permission and role membership,
+// used to find the grants that depend on a revoked grant option
+type grantState struct {
+	perms   map[grantHolder][]permissions.Permission
+	roles   map[string][]string
+	changed map[grantHolder]bool
+}
+
+// loadGrantState reads the permissions of every role and user
+func (m *RBACManager) loadGrantState() (*grantState, error) {
+	state := &grantState{
+		perms:   make(map[grantHolder][]permissions.Permission),
+		roles:   make(map[string][]string),
+		changed: make(map[grantHolder]bool),
+	}
+
+	roles, err := m.authProvider.ListRoles()
+	if err != nil {
+		return nil, err
+	}
+	for _, role := range roles {
+		perms, err := m.authProvider.GetRolePermissions(role)
+		if err != nil {
+			return nil, err
+		}
+		state.perms[grantHolder{name: role, isRole: true}] = perms
+	}
+
+	users, err := m.authProvider.ListUsers()
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		perms, err := m.authProvider.GetUserPermissions(user)
+		if err != nil {
+			return nil, err
+		}
+		state.perms[grantHolder{name: user}] = perms
+		if state.roles[user], err = m.authProvider.GetUserRoles(user); err != nil {
+			return nil, err
+		}
+	}
+	return state, nil
+}
+
+// saveGrantState stores the permissions of the roles and users that changed
+func (m *RBACManager) saveGrantState(state *grantState) error {
+	for _, holder := range state.holders() {
+		if !state.changed[holder] {
+			continue
+		}
+		if err := m.updateGranteePermissions(holder.name, holder.isRole, state.perms[holder]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revokeGrants applies a change that removes permissions or role memberships
+// to the grant state, handles the grants that depended on the removed ones
+// with the given behavior and stores the permissions that changed. Role
+// memberships are not stored; the change's caller removes them afterwards.
+func (m *RBACManager) revokeGrants(behavior RevokeBehavior, change func(state *grantState) error) error {
+	state, err := m.loadGrantState()
+	if err != nil {
+		return err
+	}
+	unsupported := state.unsupportedGrants()
+	if err := change(state); err != nil {
+		return err
+	}
+	if err := state.revokeDependents(unsupported, behavior); err != nil {
+		return err
+	}
+	return m.saveGrantState(state)
+}
+
+// userPermissions returns the permissions held directly by a user
+func (s *grantState) userPermissions(username string) ([]permissions.Permission, error) {
+	perms, ok := s.perms[grantHolder{name: username}]
+	if !ok {
+		return nil, fmt.Errorf("user %s not found", username)
+	}
+	return perms, nil
+}
+
+// removeRole removes a role from the roles of a user
+func (s *grantState) removeRole(username, roleName string) {
+	remaining := make([]string, 0, len(s.roles[username]))
+	for _, role := range s.roles[username] {
+		if role != roleName {
+			remaining = append(remaining, role)
+		}
+	}
+	s.roles[username] = remaining
+}
+
+// set replaces the permissions of a role or user
+func (s *grantState) set(holder grantHolder, perms []permissions.Permission) {
+	s.perms[holder] = perms
+	s.changed[holder] = true
+}
+
+// holders returns the roles and users in a stable order
+func (s *grantState) holders() []grantHolder {
+	holders := make([]grantHolder, 0, len(s.perms))
+	for holder := range s.perms {
+		holders = append(holders, holder)
+	}
+	sort.Slice(holders, func(i, j int) bool {
+		if holders[i].isRole != holders[j].isRole {
+			return holders[i].isRole
+		}
+		return holders[i].name < holders[j].name
+	})
+	return holders
+}
+
+// effective returns the grants a user holds directly and through its roles
+func (s *grantState) effective(user string) []grantRef {
+	refs := grantRefs(grantHolder{name: user}, s.perms[grantHolder{name: user}])
+	for _, role := range s.roles[user] {
+		holder := grantHolder{name: role, isRole: true}
+		refs = append(refs, grantRefs(holder, s.perms[holder])...)
+	}
+	return refs
+}
+
+// unsupportedGrants returns the data permissions whose grantor no longer
+// holds a grant option covering them. Permissions granted by the application
+// or by holders of the grant privilege are always supported; the others are
+// supported if a supported grant option of the grantor covers them, which is
+// resolved as a fixpoint so that circular grants do not support each other.
+func (s *grantState) unsupportedGrants() map[grantRef]bool {
+	supported := make(map[grantRef]bool)
+	pending := make(map[grantRef]bool)
+	for holder, perms := range s.perms {
+		for _, ref := range grantRefs(holder, perms) {
+			if ref.perm.Type == permissions.SystemPermission {
+				continue
+			}
+			if ref.perm.Grantor == "" || s.holdsGrantPrivilege(ref.perm.Grantor, ref.perm.Table) {
+				supported[ref] = true
+			} else {
+				pending[ref] = true
+			}
+		}
+	}
+
+	// Resolve the grants supported through other grants until nothing changes
+	for progress := true; progress; {
+		progress = false
+		for ref := range pending {
+			for _, h := range s.effective(ref.perm.Grantor) {
+				if supported[h] && h.perm.GrantOption && coversGrant(h.perm, ref.perm) {
+					supported[ref] = true
+					delete(pending, ref)
+					progress = true
+					break
+				}
+			}
+		}
+	}
+	return pending
+}
+
+// holdsGrantPrivilege checks if a user holds the grant privilege on a table
+func (s *grantState) holdsGrantPrivilege(user, table string) bool {
+	for _, ref := range s.effective(user) {
+		if confersPrivilege(ref.perm, permissions.GrantTable, table) {
+			return true
+		}
+	}
+	return false
+}
+
+// revokeDependents handles the grants that lost their support since the
+// baseline was taken: Cascade removes them, Restrict fails
+func (s *grantState) revokeDependents(baseline map[grantRef]bool, behavior RevokeBehavior) error {
+	dependents := make(map[grantHolder][]permissions.Permission)
+	for ref := range s.unsupportedGrants() {
+		if !baseline[ref] {
+			dependents[ref.holder] = append(dependents[ref.holder], ref.perm)
+		}
+	}
+	if len(dependents) == 0 {
+		return nil
+	}
+
+	for _, holder := range s.holders() {
+		perms, ok := dependents[holder]
+		if !ok {
+			continue
+		}
+		if behavior == Restrict {
+			SortPermissions(perms)
+			return fmt.Errorf("cannot revoke: %s granted to %s by %s depends on it", perms[0], holder.name, perms[0].Grantor)
+		}
+		remaining := make([]permissions.Permission, 0, len(s.perms[holder]))
+		for _, perm := range s.perms[holder] {
+			if !containsPermission(perms, perm) {
+				remaining = append(remaining, perm)
+			}
+		}
+		s.set(holder, remaining)
+	}
+	return nil
+}
+
+// grantRefs returns references to the permissions of a role or user
+func grantRefs(holder grantHolder, perms []permissions.Permission) []grantRef {
+	refs := make([]grantRef, len(perms))
+	for i, perm := range perms {
+		refs[i] = grantRef{holder: holder, perm: perm}
+	}
+	return refs
+}
+
+// containsPermission checks if a permission is in a list
+func containsPermission(perms []permissions.Permission, perm permissions.Permission) bool {
+	for _, p := range perms {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
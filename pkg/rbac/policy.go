@@ -0,0 +1,613 @@
+package rbac
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/auth"
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+	"github.com/xwb1989/sqlparser"
+	"gopkg.in/yaml.v3"
+)
+
+// PolicyVersion is the version of the declarative policy format
+const PolicyVersion = 1
+
+// allActions is the action name that expands to every action
+const allActions = "all"
+
+// Policy is a declarative description of users, roles and their grants. Role
+// grants are materialized into the permissions of every member, including
+// members of roles that inherit the role, when the policy is applied.
+type Policy struct {
+	Version int          `yaml:"version" json:"version"`
+	Roles   []RolePolicy `yaml:"roles,omitempty" json:"roles,omitempty"`
+	Users   []UserPolicy `yaml:"users,omitempty" json:"users,omitempty"`
+}
+
+// RolePolicy declares a role
+type RolePolicy struct {
+	Name       string            `yaml:"name" json:"name"`
+	Inherits   []string          `yaml:"inherits,omitempty" json:"inherits,omitempty"`
+	Privileges []PrivilegePolicy `yaml:"privileges,omitempty" json:"privileges,omitempty"`
+	Grants     []GrantPolicy     `yaml:"grants,omitempty" json:"grants,omitempty"`
+	Denies     []GrantPolicy     `yaml:"denies,omitempty" json:"denies,omitempty"`
+}
+
+// UserPolicy declares the roles and direct grants of a user. Users must already
+// exist in the auth provider since policies do not carry credentials. Roles
+// lists open-ended memberships and Memberships time-bound ones.
+type UserPolicy struct {
+	Name        string             `yaml:"name" json:"name"`
+	Roles       []string           `yaml:"roles,omitempty" json:"roles,omitempty"`
+	Memberships []MembershipPolicy `yaml:"memberships,omitempty" json:"memberships,omitempty"`
+	Privileges  []PrivilegePolicy  `yaml:"privileges,omitempty" json:"privileges,omitempty"`
+	Grants      []GrantPolicy      `yaml:"grants,omitempty" json:"grants,omitempty"`
+	Denies      []GrantPolicy      `yaml:"denies,omitempty" json:"denies,omitempty"`
+}
+
+// MembershipPolicy declares a time-bound membership of a user in a role.
+// NotBefore and NotAfter bound the time the membership, and the grants it
+// confers, are valid.
+type MembershipPolicy struct {
+	Role      string     `yaml:"role" json:"role"`
+	NotBefore *time.Time `yaml:"not_before,omitempty" json:"not_before,omitempty"`
+	NotAfter  *time.Time `yaml:"not_after,omitempty" json:"not_after,omitempty"`
+}
+
+// memberships returns the role memberships of a user, with windows in UTC
+func (u UserPolicy) memberships() []auth.RoleMembership {
+	memberships := make([]auth.RoleMembership, 0, len(u.Roles)+len(u.Memberships))
+	for _, role := range u.Roles {
+		memberships = append(memberships, auth.RoleMembership{Role: role})
+	}
+	for _, m := range u.Memberships {
+		membership := auth.RoleMembership{Role: m.Role}
+		if m.NotBefore != nil {
+			membership.NotBefore = m.NotBefore.UTC()
+		}
+		if m.NotAfter != nil {
+			membership.NotAfter = m.NotAfter.UTC()
+		}
+		memberships = append(memberships, membership)
+	}
+	return memberships
+}
+
+// PrivilegePolicy declares a system privilege, such as "manage_users". The
+// table only applies to "grant" and "decrypt". With grant option, the grantee
+// may grant the privilege to others.
+type PrivilegePolicy struct {
+	Privilege   string `yaml:"privilege" json:"privilege"`
+	Table       string `yaml:"table,omitempty" json:"table,omitempty"`
+	GrantOption bool   `yaml:"grant_option,omitempty" json:"grant_option,omitempty"`
+}
+
+// privilegePermissions returns the permissions that confer declared
+// privileges, sorted
+func privilegePermissions(privileges []PrivilegePolicy) ([]permissions.Permission, error) {
+	perms := make([]permissions.Permission, 0, len(privileges))
+	for _, p := range privileges {
+		privilege, err := permissions.ParsePrivilege(p.Privilege)
+		if err != nil {
+			return nil, err
+		}
+		perm, err := privilegePermission(privilege, p.Table)
+		if err != nil {
+			return nil, err
+		}
+		for _, declared := range perms {
+			if samePrivilege(declared, perm) {
+				return nil, fmt.Errorf("privilege %s declared more than once", perm)
+			}
+		}
+		perm.GrantOption = p.GrantOption
+		perms = append(perms, perm)
+	}
+	SortPermissions(perms)
+	return perms, nil
+}
+
+// GrantPolicy grants or denies actions on a table. A grant includes the table
+// permission, unless WithoutTable is set, plus a column permission for every
+// listed column and a row permission if a row condition is given. With grant
+// option, the grantee may
+// grant the permissions to others. NotBefore and NotAfter limit the time the
+// permissions are valid. A deny removes the matching grants: all of them for
+// the table, or only the listed columns. A deny on every table removes them
+// from all tables, and a deny on one table narrows grants on every table to
+// the other tables of the schema catalog.
+type GrantPolicy struct {
+	Table        string     `yaml:"table" json:"table"`
+	Actions      []string   `yaml:"actions,omitempty" json:"actions,omitempty"`
+	Columns      []string   `yaml:"columns,omitempty" json:"columns,omitempty"`
+	Row          string     `yaml:"row,omitempty" json:"row,omitempty"`
+	GrantOption  bool       `yaml:"grant_option,omitempty" json:"grant_option,omitempty"`
+	WithoutTable bool       `yaml:"without_table,omitempty" json:"without_table,omitempty"`
+	NotBefore    *time.Time `yaml:"not_before,omitempty" json:"not_before,omitempty"`
+	NotAfter     *time.Time `yaml:"not_after,omitempty" json:"not_after,omitempty"`
+}
+
+// window returns the validity window of a grant in UTC
+func (g GrantPolicy) window() (notBefore, notAfter time.Time) {
+	if g.NotBefore != nil {
+		notBefore = g.NotBefore.UTC()
+	}
+	if g.NotAfter != nil {
+		notAfter = g.NotAfter.UTC()
+	}
+	return notBefore, notAfter
+}
+
+// within limits the validity window of a grant to another window. It reports
+// false if the windows do not overlap.
+func (g GrantPolicy) within(notBefore, notAfter time.Time) (GrantPolicy, bool) {
+	from, until := g.window()
+	if from.IsZero() || notBefore.After(from) {
+		from = notBefore
+	}
+	if until.IsZero() || (!notAfter.IsZero() && notAfter.Before(until)) {
+		until = notAfter
+	}
+	if !from.IsZero() && !until.IsZero() && !until.After(from) {
+		return g, false
+	}
+	g.NotBefore, g.NotAfter = timeRef(from), timeRef(until)
+	return g, true
+}
+
+// LoadPolicy reads a policy document in YAML or JSON format and checks that it
+// is well-formed. Use Validate to also check it against a schema catalog.
+func LoadPolicy(r io.Reader) (*Policy, error) {
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+
+	var policy Policy
+	if err := decoder.Decode(&policy); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("empty policy document")
+		}
+		return nil, fmt.Errorf("failed to decode policy: %w", err)
+	}
+	if err := policy.Validate(nil); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// Validate checks that a policy is consistent. If a catalog is given, tables,
+// columns and the columns used in row conditions must exist in it.
+func (p *Policy) Validate(catalog Catalog) error {
+	var errs []error
+	if p.Version != PolicyVersion {
+		errs = append(errs, fmt.Errorf("unsupported policy version %d, expected %d", p.Version, PolicyVersion))
+	}
+
+	roles := make(map[string]*RolePolicy, len(p.Roles))
+	for i := range p.Roles {
+		role := &p.Roles[i]
+		if role.Name == "" {
+			errs = append(errs, fmt.Errorf("role %d: name cannot be empty", i))
+			continue
+		}
+		if _, ok := roles[role.Name]; ok {
+			errs = append(errs, fmt.Errorf("role %s: declared more than once", role.Name))
+		}
+		roles[role.Name] = role
+	}
+
+	for _, role := range p.Roles {
+		subject := "role " + role.Name
+		for _, parent := range role.Inherits {
+			if _, ok := roles[parent]; !ok {
+				errs = append(errs, fmt.Errorf("%s: inherits undeclared role %s", subject, parent))
+			}
+		}
+		if _, err := privilegePermissions(role.Privileges); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", subject, err))
+		}
+		errs = append(errs, validateGrants(subject, role.Grants, role.Denies, catalog)...)
+	}
+	if err := checkInheritanceCycles(roles); err != nil {
+		errs = append(errs, err)
+	}
+
+	users := make(map[string]bool, len(p.Users))
+	for i, user := range p.Users {
+		if user.Name == "" {
+			errs = append(errs, fmt.Errorf("user %d: name cannot be empty", i))
+			continue
+		}
+		if users[user.Name] {
+			errs = append(errs, fmt.Errorf("user %s: declared more than once", user.Name))
+		}
+		users[user.Name] = true
+
+		subject := "user " + user.Name
+		members := make(map[string]bool)
+		for _, membership := range user.memberships() {
+			role := membership.Role
+			if _, ok := roles[role]; !ok {
+				errs = append(errs, fmt.Errorf("%s: member of undeclared role %s", subject, role))
+			}
+			if members[role] {
+				errs = append(errs, fmt.Errorf("%s: member of role %s more than once", subject, role))
+			}
+			members[role] = true
+			if !membership.NotBefore.IsZero() && !membership.NotAfter.IsZero() && !membership.NotAfter.After(membership.NotBefore) {
+				errs = append(errs, fmt.Errorf("%s: membership of role %s ends before it starts", subject, role))
+			}
+		}
+		if _, err := privilegePermissions(user.Privileges); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", subject, err))
+		}
+		errs = append(errs, validateGrants(subject, user.Grants, user.Denies, catalog)...)
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateGrants checks the grants and denies of a role or user
+func validateGrants(subject string, grants, denies []GrantPolicy, catalog Catalog) []error {
+	var errs []error
+	check := func(kind string, i int, grant GrantPolicy) {
+		prefix := fmt.Sprintf("%s: %s %d", subject, kind, i)
+		if grant.Table == "" {
+			errs = append(errs, fmt.Errorf("%s: table cannot be empty", prefix))
+			return
+		}
+		if kind == "grant" && len(grant.Actions) == 0 {
+			errs = append(errs, fmt.Errorf("%s: at least one action is required", prefix))
+		}
+		if _, err := expandActions(grant.Actions); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", prefix, err))
+		}
+		if kind == "deny" && grant.Row != "" {
+			errs = append(errs, fmt.Errorf("%s: denies cannot have a row condition", prefix))
+		}
+		if kind == "deny" && grant.GrantOption {
+			errs = append(errs, fmt.Errorf("%s: denies cannot have a grant option", prefix))
+		}
+		if kind == "deny" && grant.WithoutTable {
+			errs = append(errs, fmt.Errorf("%s: denies cannot be without table", prefix))
+		}
+		if kind == "grant" && grant.WithoutTable && len(grant.Columns) == 0 && grant.Row == "" {
+			errs = append(errs, fmt.Errorf("%s: a grant without table requires columns or a row condition", prefix))
+		}
+		if kind == "deny" && (grant.NotBefore != nil || grant.NotAfter != nil) {
+			errs = append(errs, fmt.Errorf("%s: denies cannot have a validity window", prefix))
+		}
+		if grant.NotBefore != nil && grant.NotAfter != nil && !grant.NotAfter.After(*grant.NotBefore) {
+			errs = append(errs, fmt.Errorf("%s: not_after must be after not_before", prefix))
+		}
+
+		wildcard := grant.Table == permissions.WildcardPermission
+		if catalog != nil && !wildcard && !catalog.HasTable(grant.Table) {
+			errs = append(errs, fmt.Errorf("%s: unknown table %s", prefix, grant.Table))
+			return
+		}
+		for _, column := range grant.Columns {
+			if catalog != nil && !wildcard && column != permissions.WildcardPermission && !catalog.HasColumn(grant.Table, column) {
+				errs = append(errs, fmt.Errorf("%s: unknown column %s.%s", prefix, grant.Table, column))
+			}
+		}
+		if grant.Row != "" {
+			columns, err := conditionColumns(grant.Row, grant.Table)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", prefix, err))
+				return
+			}
+			for _, column := range columns {
+				if catalog != nil && !wildcard && !catalog.HasColumn(grant.Table, column) {
+					errs = append(errs, fmt.Errorf("%s: row condition uses unknown column %s.%s", prefix, grant.Table, column))
+				}
+			}
+		}
+	}
+	for i, grant := range grants {
+		check("grant", i, grant)
+	}
+	for i, deny := range denies {
+		check("deny", i, deny)
+	}
+	return errs
+}
+
+// conditionColumns parses a row condition and returns the columns it uses from
+// the given table, i.e. unqualified columns and columns qualified with the table
+func conditionColumns(condition, table string) ([]string, error) {
+	stmt, err := sqlparser.Parse(fmt.Sprintf("SELECT * FROM dual WHERE %s", condition))
+	if err != nil {
+		return nil, fmt.Errorf("invalid row condition %q: %v", condition, err)
+	}
+	selectStmt, ok := stmt.(*sqlparser.Select)
+	if !ok || selectStmt.Where == nil || selectStmt.OrderBy != nil || selectStmt.Limit != nil {
+		return nil, fmt.Errorf("invalid row condition %q", condition)
+	}
+
+	var columns []string
+	err = sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		switch n := node.(type) {
+		case *sqlparser.Subquery:
+			return false, nil
+		case *sqlparser.ColName:
+			if n.Qualifier.IsEmpty() || strings.EqualFold(n.Qualifier.Name.String(), table) {
+				columns = append(columns, n.Name.String())
+			}
+		}
+		return true, nil
+	}, selectStmt.Where.Expr)
+	return columns, err
+}
+
+// checkInheritanceCycles reports an error if role inheritance is cyclic
+func checkInheritanceCycles(roles map[string]*RolePolicy) error {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(roles))
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("role inheritance cycle: %s", strings.Join(append(path, name), " -> "))
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		if role, ok := roles[name]; ok {
+			for _, parent := range role.Inherits {
+				if err := visit(parent, append(path, name)); err != nil {
+					return err
+				}
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+
+	names := make([]string, 0, len(roles))
+	for name := range roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandActions parses action names; "all" and an empty list expand to every action
+func expandActions(names []string) ([]permissions.Action, error) {
+	if len(names) == 0 {
+		return permissions.Actions, nil
+	}
+	var actions []permissions.Action
+	for _, name := range names {
+		if strings.EqualFold(name, allActions) {
+			return permissions.Actions, nil
+		}
+		action, err := permissions.ParseAction(name)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, action)
+	}
+	return actions, nil
+}
+
+// EffectivePermissions returns the permissions a user receives from a policy:
+// the user's own grants and the grants of all roles the user holds directly or
+// through inheritance, minus everything denied to the user or those roles. The
+// grants of a time-bound membership are limited to its window. The catalog
+// lists the tables that grants on every table are narrowed to by denies on one
+// table; without it, such denies fail.
+func (p *Policy) EffectivePermissions(username string, catalog Catalog) ([]permissions.Permission, error) {
+	var user *UserPolicy
+	for i := range p.Users {
+		if p.Users[i].Name == username {
+			user = &p.Users[i]
+			break
+		}
+	}
+	if user == nil {
+		return nil, fmt.Errorf("user %s not declared in policy", username)
+	}
+
+	roles := make(map[string]*RolePolicy, len(p.Roles))
+	for i := range p.Roles {
+		roles[p.Roles[i].Name] = &p.Roles[i]
+	}
+
+	// The grants of a role are limited to the window of the membership
+	grants := append([]GrantPolicy(nil), user.Grants...)
+	denies := append([]GrantPolicy(nil), user.Denies...)
+	seen := make(map[auth.RoleMembership]bool)
+	var collect func(membership auth.RoleMembership)
+	collect = func(membership auth.RoleMembership) {
+		if seen[membership] {
+			return
+		}
+		seen[membership] = true
+		role, ok := roles[membership.Role]
+		if !ok {
+			return
+		}
+		for _, grant := range role.Grants {
+			if grant, ok := grant.within(membership.NotBefore, membership.NotAfter); ok {
+				grants = append(grants, grant)
+			}
+		}
+		denies = append(denies, role.Denies...)
+		for _, parent := range role.Inherits {
+			collect(auth.RoleMembership{Role: parent, NotBefore: membership.NotBefore, NotAfter: membership.NotAfter})
+		}
+	}
+	for _, membership := range user.memberships() {
+		collect(membership)
+	}
+
+	set, err := compileGrants(grants)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyDenies(set, denies, catalog); err != nil {
+		return nil, err
+	}
+	return sortedPermissions(set), nil
+}
+
+// compileGrants converts grants into the set of permissions they confer
+func compileGrants(grants []GrantPolicy) (map[permissions.Permission]bool, error) {
+	set := make(map[permissions.Permission]bool)
+	for _, grant := range grants {
+		actions, err := expandActions(grant.Actions)
+		if err != nil {
+			return nil, err
+		}
+		notBefore, notAfter := grant.window()
+		for _, action := range actions {
+			base := permissions.Permission{Table: grant.Table, Action: action, GrantOption: grant.GrantOption, NotBefore: notBefore, NotAfter: notAfter}
+			if !grant.WithoutTable {
+				perm := base
+				perm.Type = permissions.TablePermission
+				set[perm] = true
+			}
+			for _, column := range grant.Columns {
+				perm := base
+				perm.Type, perm.Column = permissions.ColumnPermission, column
+				set[perm] = true
+			}
+			if grant.Row != "" {
+				perm := base
+				perm.Type, perm.Condition = permissions.RowPermission, grant.Row
+				set[perm] = true
+			}
+		}
+	}
+
+	// A permission with grant option includes the same permission without it
+	for perm := range set {
+		if perm.GrantOption {
+			without := perm
+			without.GrantOption = false
+			delete(set, without)
+		}
+	}
+	return set, nil
+}
+
+// applyDenies removes the permissions matched by denies from a set. A deny on
+// one table removes a matching permission on every table and adds it back for
+// each other table of the catalog.
+func applyDenies(set map[permissions.Permission]bool, denies []GrantPolicy, catalog Catalog) error {
+	for _, deny := range denies {
+		actions, err := expandActions(deny.Actions)
+		if err != nil {
+			return err
+		}
+		for perm := range set {
+			if !deny.denies(actions, perm) {
+				continue
+			}
+			delete(set, perm)
+			if perm.Table != permissions.WildcardPermission || deny.Table == permissions.WildcardPermission {
+				continue
+			}
+			if catalog == nil {
+				return fmt.Errorf("deny on %s cannot narrow %s without a schema catalog", deny.Table, perm)
+			}
+			for _, table := range catalog.Tables() {
+				if !strings.EqualFold(table, deny.Table) {
+					narrowed := perm
+					narrowed.Table = table
+					set[narrowed] = true
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// removes checks if a revoke for the given actions removes a permission on its
+// table: every data permission on the table, or only the listed column
+// permissions
+func (g GrantPolicy) removes(actions []permissions.Action, perm permissions.Permission) bool {
+	return strings.EqualFold(perm.Table, g.Table) && g.matches(actions, perm)
+}
+
+// denies checks if a deny for the given actions matches a permission on its
+// table, or where either of them is on every table
+func (g GrantPolicy) denies(actions []permissions.Action, perm permissions.Permission) bool {
+	return (coversTable(g.Table, perm.Table) || coversTable(perm.Table, g.Table)) && g.matches(actions, perm)
+}
+
+// matches checks if a deny or revoke for the given actions matches a permission
+// regardless of its table: every data permission, or only the listed column
+// permissions
+func (g GrantPolicy) matches(actions []permissions.Action, perm permissions.Permission) bool {
+	if perm.Type == permissions.SystemPermission || !containsAction(actions, perm.Action) {
+		return false
+	}
+	return len(g.Columns) == 0 || (perm.Type == permissions.ColumnPermission && permissions.ContainsName(g.Columns, perm.Column))
+}
+
+// sortedPermissions returns the permissions of a set in a stable order
+func sortedPermissions(set map[permissions.Permission]bool) []permissions.Permission {
+	perms := make([]permissions.Permission, 0, len(set))
+	for perm := range set {
+		perms = append(perms, perm)
+	}
+	SortPermissions(perms)
+	return perms
+}
+
+// SortPermissions sorts permissions by table, type, action, column and condition
+func SortPermissions(perms []permissions.Permission) {
+	sort.Slice(perms, func(i, j int) bool {
+		a, b := perms[i], perms[j]
+		if a.Table != b.Table {
+			return a.Table < b.Table
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		if a.Action != b.Action {
+			return a.Action < b.Action
+		}
+		if a.Column != b.Column {
+			return a.Column < b.Column
+		}
+		if a.Privilege != b.Privilege {
+			return a.Privilege < b.Privilege
+		}
+		if a.Condition != b.Condition {
+			return a.Condition < b.Condition
+		}
+		if a.GrantOption != b.GrantOption {
+			return !a.GrantOption
+		}
+		if !a.NotBefore.Equal(b.NotBefore) {
+			return a.NotBefore.Before(b.NotBefore)
+		}
+		return a.NotAfter.Before(b.NotAfter)
+	})
+}
+
+// containsAction checks if an action is in a list
+func containsAction(actions []permissions.Action, action permissions.Action) bool {
+	for _, a := range actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
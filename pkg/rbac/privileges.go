@@ -0,0 +1,295 @@
+package rbac
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/auth"
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+)
+
+// ErrInsufficientPrivilege is returned when the actor of a manager lacks the
+// privilege an operation requires
+var ErrInsufficientPrivilege = errors.New("insufficient privilege")
+
+// As returns a manager that makes changes on behalf of a user
+func (m *RBACManager) As(actor string) *RBACManager {
+	return &RBACManager{
+		authProvider: m.authProvider,
+		actor:        actor,
+		Now:          m.Now,
+		Audit:        m.Audit,
+	}
+}
+
+// HasPrivilege checks if a user holds a system privilege, directly or through
+// a role. GrantTable and Decrypt must be held for the table or for every
+// table. Superusers hold every privilege.
+func (m *RBACManager) HasPrivilege(username string, privilege permissions.Privilege, table string) (bool, error) {
+	perms, err := m.GetEffectivePermissions(username)
+	if err != nil {
+		return false, err
+	}
+	for _, perm := range perms {
+		if confersPrivilege(perm, privilege, table) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ErrSuperuserExists is returned when a superuser is bootstrapped into an auth
+// store that already has another superuser
+var ErrSuperuserExists = errors.New("auth store already has a superuser")
+
+// BootstrapSuperuser makes a user the superuser of an auth store that has
+// none. Bootstrapping the superuser the store already has does nothing, so
+// that it can be repeated each time the database is opened.
+func BootstrapSuperuser(authProvider auth.Provider, username string) error {
+	m := System(authProvider)
+	users, err := authProvider.ListUsers()
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		ok, err := m.HasPrivilege(user, permissions.Superuser, "")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if user == username {
+			return nil
+		}
+		return fmt.Errorf("%w: %s", ErrSuperuserExists, user)
+	}
+	return m.GrantPrivilege(username, permissions.Superuser, "", false)
+}
+
+// CreateUser adds a user with the given credentials
+func (m *RBACManager) CreateUser(username, token string) (err error) {
+	defer func() { err = m.recordChange("create_user", username, "", err) }()
+	if err := m.Authorize(permissions.ManageUsers, ""); err != nil {
+		return err
+	}
+	if username == "" {
+		return fmt.Errorf("username cannot be empty")
+	}
+	if _, err := m.authProvider.GetUserID(username); err == nil {
+		return fmt.Errorf("user %s already exists", username)
+	}
+	m.authProvider.AddUser(username, token)
+	return nil
+}
+
+// GrantPrivilege grants a system privilege to a role, or to a user if no role
+// has the name. The table only applies to GrantTable and Decrypt. With grant option the
+// grantee may grant the privilege to others in turn. The actor must hold the
+// privilege with grant option, or be a superuser.
+func (m *RBACManager) GrantPrivilege(grantee string, privilege permissions.Privilege, table string, grantOption bool) (err error) {
+	defer func() {
+		err = m.recordChange("grant_privilege", grantee, privilegeDetail(privilege, table, grantOption), err)
+	}()
+	perm, err := privilegePermission(privilege, table)
+	if err != nil {
+		return err
+	}
+	perm.GrantOption = grantOption
+	if err := m.authorizeDelegation(perm); err != nil {
+		return err
+	}
+
+	isRole, err := m.isRole(grantee)
+	if err != nil {
+		return err
+	}
+	current, err := m.granteePermissions(grantee, isRole)
+	if err != nil {
+		return err
+	}
+
+	// Keep an existing grant unless the new one adds the grant option
+	updated := make([]permissions.Permission, 0, len(current)+1)
+	for _, held := range current {
+		if samePrivilege(held, perm) {
+			if held.GrantOption || !grantOption {
+				return nil
+			}
+			continue
+		}
+		updated = append(updated, held)
+	}
+	return m.updateGranteePermissions(grantee, isRole, append(updated, perm))
+}
+
+// RevokePrivilege revokes a system privilege from a role or user. The actor
+// must hold the privilege with grant option, or be a superuser. Grants made
+// through the privilege are revoked in turn.
+func (m *RBACManager) RevokePrivilege(grantee string, privilege permissions.Privilege, table string) (err error) {
+	defer func() {
+		err = m.recordChange("revoke_privilege", grantee, privilegeDetail(privilege, table, false), err)
+	}()
+	perm, err := privilegePermission(privilege, table)
+	if err != nil {
+		return err
+	}
+	if err := m.authorizeDelegation(perm); err != nil {
+		return err
+	}
+
+	isRole, err := m.isRole(grantee)
+	if err != nil {
+		return err
+	}
+
+	// Revoke the privilege and the grants made through it
+	return m.revokeGrants(Cascade, func(state *grantState) error {
+		holder := grantHolder{name: grantee, isRole: isRole}
+		current := state.perms[holder]
+		remaining := make([]permissions.Permission, 0, len(current))
+		for _, held := range current {
+			if !samePrivilege(held, perm) {
+				remaining = append(remaining, held)
+			}
+		}
+		state.set(holder, remaining)
+		return nil
+	})
+}
+
+// checked reports whether the privileges of the actor are checked. Only the
+// system manager is unchecked; a manager without an actor may not make
+// changes.
+func (m *RBACManager) checked() (bool, error) {
+	if m.system {
+		return false, nil
+	}
+	if m.actor == "" {
+		return false, fmt.Errorf("%w: the manager has no actor", ErrInsufficientPrivilege)
+	}
+	return true, nil
+}
+
+// Authorize checks that the actor holds a system privilege
+func (m *RBACManager) Authorize(privilege permissions.Privilege, table string) error {
+	if checked, err := m.checked(); !checked {
+		return err
+	}
+	ok, err := m.HasPrivilege(m.actor, privilege, table)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if privilege.OnTable() {
+			return fmt.Errorf("%w: %s requires %s on %s", ErrInsufficientPrivilege, m.actor, privilege, table)
+		}
+		return fmt.Errorf("%w: %s requires %s", ErrInsufficientPrivilege, m.actor, privilege)
+	}
+	return nil
+}
+
+// authorizeDelegation checks that the actor may grant or revoke a system
+// permission: superusers may delegate every privilege, other users only the
+// privileges they hold with grant option
+func (m *RBACManager) authorizeDelegation(perm permissions.Permission) error {
+	if checked, err := m.checked(); !checked {
+		return err
+	}
+	held, err := m.GetEffectivePermissions(m.actor)
+	if err != nil {
+		return err
+	}
+	for _, h := range held {
+		if h.Type != permissions.SystemPermission {
+			continue
+		}
+		if h.Privilege == permissions.Superuser || (h.GrantOption && h.Privilege == perm.Privilege && coversTable(h.Table, perm.Table)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s cannot grant %s", ErrInsufficientPrivilege, m.actor, perm)
+}
+
+// authorizeRoleMembership checks that the actor may delegate every system
+// privilege of a role, so that granting the role does not escalate privileges
+func (m *RBACManager) authorizeRoleMembership(roleName string) error {
+	if checked, err := m.checked(); !checked {
+		return err
+	}
+	if exists, err := m.RoleExists(roleName); err != nil || !exists {
+		// The auth provider reports unknown roles
+		return err
+	}
+	perms, err := m.authProvider.GetRolePermissions(roleName)
+	if err != nil {
+		return err
+	}
+	for _, perm := range perms {
+		if perm.Type != permissions.SystemPermission {
+			continue
+		}
+		if err := m.authorizeDelegation(perm); err != nil {
+			return fmt.Errorf("role %s: %w", roleName, err)
+		}
+	}
+	return nil
+}
+
+// privilegePermission returns the permission that confers a system privilege
+func privilegePermission(privilege permissions.Privilege, table string) (permissions.Permission, error) {
+	perm := permissions.Permission{Type: permissions.SystemPermission, Privilege: privilege}
+	switch privilege {
+	case permissions.Superuser, permissions.ManageUsers, permissions.ManageRoles, permissions.RawAccess:
+		if table != "" {
+			return perm, fmt.Errorf("privilege %s does not apply to a table", privilege)
+		}
+	case permissions.GrantTable, permissions.Decrypt:
+		if table == "" {
+			return perm, fmt.Errorf("privilege %s requires a table", privilege)
+		}
+		perm.Table = table
+	default:
+		return perm, fmt.Errorf("unknown privilege: %s", privilege)
+	}
+	return perm, nil
+}
+
+// confersPrivilege checks if a permission confers a system privilege
+func confersPrivilege(perm permissions.Permission, privilege permissions.Privilege, table string) bool {
+	if perm.Type != permissions.SystemPermission {
+		return false
+	}
+	if perm.Privilege == permissions.Superuser {
+		return true
+	}
+	if perm.Privilege != privilege {
+		return false
+	}
+	return !privilege.OnTable() || coversTable(perm.Table, table)
+}
+
+// coversTable checks if a grant on a table, or on every table, covers another table
+func coversTable(granted, table string) bool {
+	return granted == permissions.WildcardPermission || strings.EqualFold(granted, table)
+}
+
+// samePrivilege checks if two system permissions confer the same privilege,
+// regardless of the grant option
+func samePrivilege(a, b permissions.Permission) bool {
+	return a.Type == permissions.SystemPermission && b.Type == permissions.SystemPermission &&
+		a.Privilege == b.Privilege && strings.EqualFold(a.Table, b.Table)
+}
+
+// systemPermissions splits permissions into system and data permissions
+func systemPermissions(perms []permissions.Permission) (system, data []permissions.Permission) {
+	for _, perm := range perms {
+		if perm.Type == permissions.SystemPermission {
+			system = append(system, perm)
+		} else {
+			data = append(data, perm)
+		}
+	}
+	return system, data
+}
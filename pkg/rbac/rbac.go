@@ -3,24 +3,66 @@ package rbac
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/wemcdonald/secure_sqlite/pkg/audit"
 	"github.com/wemcdonald/secure_sqlite/pkg/auth"
 	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
 )
 
 // RBACManager handles role-based access control operations
 type RBACManager struct {
-	AuthProvider auth.Provider
+	authProvider auth.Provider
+	// actor is the user on whose behalf changes are made. Every operation that
+	// changes users, roles or permissions checks the privileges of the actor.
+	actor string
+	// system marks the manager of the application itself, whose changes are
+	// not checked
+	system bool
+	// Now returns the current time, against which the validity windows of
+	// permissions and role memberships are checked
+	Now func() time.Time
+	// Elevation temporarily extends the permissions of the actor
+	Elevation *Elevation
+	// Audit receives an event for every change made or refused through the
+	// manager
+	Audit audit.Sink
 }
 
-// NewRBACManager creates a new RBAC manager
+// NewRBACManager creates a new RBAC manager without an actor. It answers
+// permission checks, but changes require an actor, see As, or the system
+// manager.
 func NewRBACManager(authProvider auth.Provider) *RBACManager {
 	return &RBACManager{
-		AuthProvider: authProvider,
+		authProvider: authProvider,
+		Now:          time.Now,
 	}
 }
 
+// System creates the RBAC manager of the application itself, whose changes are
+// not checked. It is meant for bootstrapping and administration tools that own
+// the auth store, and must not be reachable from user handles.
+func System(authProvider auth.Provider) *RBACManager {
+	m := NewRBACManager(authProvider)
+	m.system = true
+	return m
+}
+
+// Actor returns the user on whose behalf the manager makes changes
+func (m *RBACManager) Actor() string {
+	return m.actor
+}
+
+// now returns the current time of the manager
+func (m *RBACManager) now() time.Time {
+	if m.Now == nil {
+		return time.Now()
+	}
+	return m.Now()
+}
+
 // ParsePermission parses a permission string into its components
 func ParsePermission(permission string) (*permissions.Permission, error) {
 	parts := strings.Split(permission, ".")
@@ -60,7 +102,7 @@ func ParsePermission(permission string) (*permissions.Permission, error) {
 
 // CheckPermission checks if a user has permission for a specific operation
 func (m *RBACManager) CheckPermission(username string, tableName string, action permissions.Action) (bool, error) {
-	userPerms, err := m.AuthProvider.GetUserPermissions(username)
+	userPerms, err := m.GetEffectivePermissions(username)
 	if err != nil {
 		return false, err
 	}
@@ -92,7 +134,7 @@ func (m *RBACManager) CheckPermission(username string, tableName string, action
 
 // CheckColumnPermission checks if a user has permission for a specific column
 func (m *RBACManager) CheckColumnPermission(username string, tableName string, columnName string) (bool, error) {
-	userPerms, err := m.AuthProvider.GetUserPermissions(username)
+	userPerms, err := m.GetEffectivePermissions(username)
 	if err != nil {
 		return false, err
 	}
@@ -111,8 +153,8 @@ func (m *RBACManager) CheckColumnPermission(username string, tableName string, c
 
 // GetRowCondition returns the row-level condition for a user on a table
 func (m *RBACManager) GetRowCondition(username string, tableName string) (string, error) {
-	// Get user permissions from AuthProvider
-	userPerms, err := m.AuthProvider.GetUserPermissions(username)
+	// Get the permissions of the user and their roles
+	userPerms, err := m.GetEffectivePermissions(username)
 	if err != nil {
 		return "", err
 	}
@@ -167,103 +209,235 @@ func (m *RBACManager) ValidateQueryPermissions(username string, tables []string,
 
 // AssignRoleToUser assigns a role to a user
 func (m *RBACManager) AssignRoleToUser(username, roleName string) error {
-	// Verify user exists via AuthProvider
-	valid, err := m.AuthProvider.Authenticate(username, "")
-	if err != nil {
+	return m.AssignRoleToUserBetween(username, roleName, time.Time{}, time.Time{})
+}
+
+// AssignRoleToUserBetween assigns a role to a user for a time window. A zero
+// time leaves that side of the window open. Assigning a role the user is
+// already a member of replaces the window.
+func (m *RBACManager) AssignRoleToUserBetween(username, roleName string, notBefore, notAfter time.Time) (err error) {
+	defer func() {
+		err = m.recordChange("assign_role", username, membershipDetail(roleName, notBefore, notAfter), err)
+	}()
+	// Check that the actor may manage users and grant the role's privileges
+	if err := m.Authorize(permissions.ManageUsers, ""); err != nil {
 		return err
 	}
-	if !valid {
+	if err := m.authorizeRoleMembership(roleName); err != nil {
+		return err
+	}
+
+	// Verify user exists via AuthProvider
+	if _, err := m.authProvider.GetUserID(username); err != nil {
 		return errors.New("user not found")
 	}
 
-	// Store role assignment in auth provider
-	perm := permissions.Permission{
-		Type:  permissions.TablePermission,
-		Table: roleName,
+	if !notBefore.IsZero() && !notAfter.IsZero() && !notAfter.After(notBefore) {
+		return fmt.Errorf("role %s: membership ends before it starts", roleName)
 	}
-	return m.AuthProvider.UpdateUserPermissions(username, []permissions.Permission{perm})
+
+	// Store role membership in auth provider
+	return m.authProvider.AddUserRoleMembership(username, auth.RoleMembership{
+		Role:      roleName,
+		NotBefore: notBefore.UTC(),
+		NotAfter:  notAfter.UTC(),
+	})
 }
 
 // UserHasRole checks if a user has a specific role
 func (m *RBACManager) UserHasRole(username, roleName string) (bool, error) {
-	// Get user permissions from AuthProvider
-	userPerms, err := m.AuthProvider.GetUserPermissions(username)
+	// Get the active user roles
+	roles, err := m.GetUserRoles(username)
 	if err != nil {
 		return false, err
 	}
 
-	// Check if user has the role permission
-	for _, perm := range userPerms {
-		if perm.Type == permissions.TablePermission && perm.Table == roleName {
+	// Check if user is a member of the role
+	for _, role := range roles {
+		if role == roleName {
 			return true, nil
 		}
 	}
 	return false, nil
 }
 
-// RemoveRoleFromUser removes a role from a user
-func (m *RBACManager) RemoveRoleFromUser(username, roleName string) error {
-	// Verify user exists via AuthProvider
-	valid, err := m.AuthProvider.Authenticate(username, "")
+// GetEffectivePermissions returns the permissions of a user, including the
+// permissions granted to the roles the user is a member of and, for the actor,
+// those of an active elevation. Permissions and memberships outside their
+// validity window are left out.
+func (m *RBACManager) GetEffectivePermissions(username string) ([]permissions.Permission, error) {
+	now := m.now()
+	userPerms, err := m.authProvider.GetUserPermissions(username)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if !valid {
-		return errors.New("user not found")
+	roles, err := m.memberRoles(username)
+	if err != nil {
+		return nil, err
 	}
 
-	// Get current permissions
-	userPerms, err := m.AuthProvider.GetUserPermissions(username)
+	perms := activePermissions(nil, userPerms, now)
+	for _, role := range roles {
+		rolePerms, err := m.authProvider.GetRolePermissions(role)
+		if err != nil {
+			return nil, err
+		}
+		perms = activePermissions(perms, rolePerms, now)
+	}
+	if _, ok := m.elevatedRole(username); ok {
+		elevated, err := m.ElevatedPermissions()
+		if err != nil {
+			return nil, err
+		}
+		perms = append(perms, elevated...)
+	}
+	return perms, nil
+}
+
+// GetUserRoles returns the roles a user currently holds. The role of an
+// elevation of the actor is not included, since it only applies to the
+// elevated tables; see ElevatedRole.
+func (m *RBACManager) GetUserRoles(username string) ([]string, error) {
+	return m.memberRoles(username)
+}
+
+// memberRoles returns the roles a user is currently a member of
+func (m *RBACManager) memberRoles(username string) ([]string, error) {
+	memberships, err := m.authProvider.GetUserRoleMemberships(username)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	now := m.now()
+	roles := make([]string, 0, len(memberships))
+	for _, membership := range memberships {
+		if membership.ActiveAt(now) {
+			roles = append(roles, membership.Role)
+		}
 	}
+	return roles, nil
+}
 
-	// Remove the role permission
-	newPerms := make([]permissions.Permission, 0)
-	for _, perm := range userPerms {
-		if !(perm.Type == permissions.TablePermission && perm.Table == roleName) {
-			newPerms = append(newPerms, perm)
+// ListRoles returns the names of all roles, sorted. The actor must hold the
+// privilege to manage roles.
+func (m *RBACManager) ListRoles() ([]string, error) {
+	if err := m.Authorize(permissions.ManageRoles, ""); err != nil {
+		return nil, err
+	}
+	roles, err := m.authProvider.ListRoles()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(roles)
+	return roles, nil
+}
+
+// RoleMembers returns the names of the members of a role, sorted. The actor
+// must hold the privilege to manage roles.
+func (m *RBACManager) RoleMembers(roleName string) ([]string, error) {
+	if err := m.Authorize(permissions.ManageRoles, ""); err != nil {
+		return nil, err
+	}
+	if _, err := m.authProvider.GetRoleID(roleName); err != nil {
+		return nil, err
+	}
+	members, err := m.authProvider.GetUsersWithRole(roleName)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
+// activePermissions appends the permissions that are valid at a time
+func activePermissions(dst, perms []permissions.Permission, now time.Time) []permissions.Permission {
+	for _, perm := range perms {
+		if perm.ActiveAt(now) {
+			dst = append(dst, perm)
 		}
 	}
+	return dst
+}
 
-	// Update user permissions
-	return m.AuthProvider.UpdateUserPermissions(username, newPerms)
+// RemoveRoleFromUser removes a role from a user. Grants the user made through
+// the grant options of the role are revoked in turn.
+func (m *RBACManager) RemoveRoleFromUser(username, roleName string) (err error) {
+	defer func() { err = m.recordChange("remove_role", username, roleName, err) }()
+	if err := m.Authorize(permissions.ManageUsers, ""); err != nil {
+		return err
+	}
+
+	// Verify user exists via AuthProvider
+	if _, err := m.authProvider.GetUserID(username); err != nil {
+		return errors.New("user not found")
+	}
+
+	// Revoke the grants that depended on the membership, then remove it
+	err = m.revokeGrants(Cascade, func(state *grantState) error {
+		state.removeRole(username, roleName)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return m.authProvider.RemoveUserRole(username, roleName)
 }
 
-// DeleteRole deletes a role
-func (m *RBACManager) DeleteRole(name string) error {
+// DeleteRole deletes a role. Grants made through the grant options of the
+// role are revoked in turn.
+func (m *RBACManager) DeleteRole(name string) (err error) {
+	defer func() { err = m.recordChange("delete_role", name, "", err) }()
+	if err := m.Authorize(permissions.ManageRoles, ""); err != nil {
+		return err
+	}
+
 	// Get role ID
-	roleID, err := m.AuthProvider.GetRoleID(name)
+	roleID, err := m.authProvider.GetRoleID(name)
 	if err != nil {
 		return err
 	}
 
 	// Get all users with this role
-	users, err := m.AuthProvider.GetUsersWithRole(name)
+	users, err := m.authProvider.GetUsersWithRole(name)
+	if err != nil {
+		return err
+	}
+
+	// Revoke the grants that depended on the role
+	err = m.revokeGrants(Cascade, func(state *grantState) error {
+		delete(state.perms, grantHolder{name: name, isRole: true})
+		for _, username := range users {
+			state.removeRole(username, name)
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
 	// Remove role from all users
 	for _, username := range users {
-		if err := m.RemoveRoleFromUser(username, name); err != nil {
+		if err := m.authProvider.RemoveUserRole(username, name); err != nil {
 			return err
 		}
 	}
 
 	// Delete role from auth provider
-	return m.AuthProvider.DeleteRole(roleID)
+	return m.authProvider.DeleteRole(roleID)
 }
 
 // CreateRole creates a new role
-func (m *RBACManager) CreateRole(name string) (int64, error) {
-	return m.AuthProvider.AddRole(name)
+func (m *RBACManager) CreateRole(name string) (_ int64, err error) {
+	defer func() { err = m.recordChange("create_role", name, "", err) }()
+	if err := m.Authorize(permissions.ManageRoles, ""); err != nil {
+		return 0, err
+	}
+	return m.authProvider.AddRole(name)
 }
 
 // RoleExists checks if a role exists
 func (m *RBACManager) RoleExists(name string) (bool, error) {
 	// Try to get role ID from name
-	roleID, err := m.AuthProvider.GetRoleID(name)
+	roleID, err := m.authProvider.GetRoleID(name)
 	if err != nil {
 		return false, nil
 	}
@@ -272,6 +446,9 @@ func (m *RBACManager) RoleExists(name string) (bool, error) {
 
 // CreatePermission creates a new permission
 func (m *RBACManager) CreatePermission(name string) (int64, error) {
+	if err := m.Authorize(permissions.ManageRoles, ""); err != nil {
+		return 0, err
+	}
 	// Permissions are managed by the auth provider
 	return 1, nil
 }
@@ -285,7 +462,7 @@ func (m *RBACManager) PermissionExists(name string) (bool, error) {
 // AssignPermissionToRole assigns a permission to a role
 func (m *RBACManager) AssignPermissionToRole(roleName, permissionName string) error {
 	// Permissions are managed by the auth provider
-	return nil
+	return m.Authorize(permissions.ManageRoles, "")
 }
 
 // RoleHasPermission checks if a role has a permission
@@ -297,28 +474,35 @@ func (m *RBACManager) RoleHasPermission(roleName, permissionName string) (bool,
 // RemovePermissionFromRole removes a permission from a role
 func (m *RBACManager) RemovePermissionFromRole(roleName, permissionName string) error {
 	// Permissions are managed by the auth provider
-	return nil
+	return m.Authorize(permissions.ManageRoles, "")
 }
 
 // HasTablePermission checks if a user has a specific permission on a table
 func (m *RBACManager) HasTablePermission(username string, tableName string, permission permissions.PermissionType) (bool, error) {
+	perm, err := m.TablePermissionRule(username, tableName, permission)
+	return perm != nil, err
+}
+
+// TablePermissionRule returns the permission that gives a user a specific
+// permission on a table, or nil if the user has none
+func (m *RBACManager) TablePermissionRule(username string, tableName string, permission permissions.PermissionType) (*permissions.Permission, error) {
 	if username == "" {
-		return false, fmt.Errorf("username cannot be empty")
+		return nil, fmt.Errorf("username cannot be empty")
 	}
 
-	// Get user permissions from AuthProvider
-	userPerms, err := m.AuthProvider.GetUserPermissions(username)
+	// Get the permissions of the user and their roles
+	userPerms, err := m.GetEffectivePermissions(username)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
 	// Check if user has the table permission
 	for _, perm := range userPerms {
 		if perm.Type == permission && (perm.Table == tableName || perm.Table == permissions.WildcardPermission) {
-			return true, nil
+			return &perm, nil
 		}
 	}
-	return false, nil
+	return nil, nil
 }
 
 // HasColumnPermission checks if a user has a specific permission on a column
@@ -327,8 +511,8 @@ func (m *RBACManager) HasColumnPermission(username string, tableName, columnName
 		return false, fmt.Errorf("username cannot be empty")
 	}
 
-	// Get user permissions from AuthProvider
-	userPerms, err := m.AuthProvider.GetUserPermissions(username)
+	// Get the permissions of the user and their roles
+	userPerms, err := m.GetEffectivePermissions(username)
 	if err != nil {
 		return false, err
 	}
@@ -348,8 +532,8 @@ func (m *RBACManager) GetRowPermissions(username string, tableName string, permi
 		return nil, fmt.Errorf("username cannot be empty")
 	}
 
-	// Get user permissions from AuthProvider
-	userPerms, err := m.AuthProvider.GetUserPermissions(username)
+	// Get the permissions of the user and their roles
+	userPerms, err := m.GetEffectivePermissions(username)
 	if err != nil {
 		return nil, err
 	}
@@ -374,8 +558,8 @@ func (m *RBACManager) GetRowPermissions(username string, tableName string, permi
 
 // CheckQueryPermissions performs a comprehensive permission check for a query
 func (m *RBACManager) CheckQueryPermissions(username string, tableName string, permission permissions.PermissionType) (bool, error) {
-	// Get user permissions from AuthProvider
-	userPerms, err := m.AuthProvider.GetUserPermissions(username)
+	// Get the permissions of the user and their roles
+	userPerms, err := m.GetEffectivePermissions(username)
 	if err != nil {
 		return false, err
 	}
@@ -418,9 +602,16 @@ func (m *RBACManager) CheckQueryPermissions(username string, tableName string, p
 }
 
 // GrantTablePermission grants a permission on a table to a user
-func (m *RBACManager) GrantTablePermission(username string, tableName string, permission permissions.PermissionType) error {
+func (m *RBACManager) GrantTablePermission(username string, tableName string, permission permissions.PermissionType) (err error) {
+	defer func() {
+		err = m.recordChange("grant", username, permissions.Permission{Type: permission, Table: tableName}.String(), err)
+	}()
+	if err := m.Authorize(permissions.GrantTable, tableName); err != nil {
+		return err
+	}
+
 	// Get current permissions
-	userPerms, err := m.AuthProvider.GetUserPermissions(username)
+	userPerms, err := m.authProvider.GetUserPermissions(username)
 	if err != nil {
 		return err
 	}
@@ -433,33 +624,46 @@ func (m *RBACManager) GrantTablePermission(username string, tableName string, pe
 	userPerms = append(userPerms, newPerm)
 
 	// Update user permissions
-	return m.AuthProvider.UpdateUserPermissions(username, userPerms)
+	return m.authProvider.UpdateUserPermissions(username, userPerms)
 }
 
 // RevokeTablePermission revokes a permission on a table from a user
-func (m *RBACManager) RevokeTablePermission(username string, tableName string, permission permissions.PermissionType) error {
-	// Get current permissions
-	userPerms, err := m.AuthProvider.GetUserPermissions(username)
-	if err != nil {
+func (m *RBACManager) RevokeTablePermission(username string, tableName string, permission permissions.PermissionType) (err error) {
+	defer func() {
+		err = m.recordChange("revoke", username, permissions.Permission{Type: permission, Table: tableName}.String(), err)
+	}()
+	if err := m.Authorize(permissions.GrantTable, tableName); err != nil {
 		return err
 	}
 
-	// Remove the permission
-	newPerms := make([]permissions.Permission, 0)
-	for _, perm := range userPerms {
-		if !(perm.Type == permission && perm.Table == tableName) {
-			newPerms = append(newPerms, perm)
+	// Remove the permission and the grants that depended on it
+	return m.revokeGrants(Cascade, func(state *grantState) error {
+		userPerms, err := state.userPermissions(username)
+		if err != nil {
+			return err
 		}
-	}
-
-	// Update user permissions
-	return m.AuthProvider.UpdateUserPermissions(username, newPerms)
+		newPerms := make([]permissions.Permission, 0)
+		for _, perm := range userPerms {
+			if !(perm.Type == permission && perm.Table == tableName) {
+				newPerms = append(newPerms, perm)
+			}
+		}
+		state.set(grantHolder{name: username}, newPerms)
+		return nil
+	})
 }
 
 // GrantColumnPermission grants a permission on a column to a user
-func (m *RBACManager) GrantColumnPermission(username string, tableName, columnName string, permission permissions.PermissionType) error {
+func (m *RBACManager) GrantColumnPermission(username string, tableName, columnName string, permission permissions.PermissionType) (err error) {
+	defer func() {
+		err = m.recordChange("grant", username, permissions.Permission{Type: permission, Table: tableName, Column: columnName}.String(), err)
+	}()
+	if err := m.Authorize(permissions.GrantTable, tableName); err != nil {
+		return err
+	}
+
 	// Get current permissions
-	userPerms, err := m.AuthProvider.GetUserPermissions(username)
+	userPerms, err := m.authProvider.GetUserPermissions(username)
 	if err != nil {
 		return err
 	}
@@ -473,33 +677,46 @@ func (m *RBACManager) GrantColumnPermission(username string, tableName, columnNa
 	userPerms = append(userPerms, newPerm)
 
 	// Update user permissions
-	return m.AuthProvider.UpdateUserPermissions(username, userPerms)
+	return m.authProvider.UpdateUserPermissions(username, userPerms)
 }
 
 // RevokeColumnPermission revokes a permission on a column from a user
-func (m *RBACManager) RevokeColumnPermission(username string, tableName, columnName string, permission permissions.PermissionType) error {
-	// Get current permissions
-	userPerms, err := m.AuthProvider.GetUserPermissions(username)
-	if err != nil {
+func (m *RBACManager) RevokeColumnPermission(username string, tableName, columnName string, permission permissions.PermissionType) (err error) {
+	defer func() {
+		err = m.recordChange("revoke", username, permissions.Permission{Type: permission, Table: tableName, Column: columnName}.String(), err)
+	}()
+	if err := m.Authorize(permissions.GrantTable, tableName); err != nil {
 		return err
 	}
 
-	// Remove the permission
-	newPerms := make([]permissions.Permission, 0)
-	for _, perm := range userPerms {
-		if !(perm.Type == permission && perm.Table == tableName && perm.Column == columnName) {
-			newPerms = append(newPerms, perm)
+	// Remove the permission and the grants that depended on it
+	return m.revokeGrants(Cascade, func(state *grantState) error {
+		userPerms, err := state.userPermissions(username)
+		if err != nil {
+			return err
 		}
-	}
-
-	// Update user permissions
-	return m.AuthProvider.UpdateUserPermissions(username, newPerms)
+		newPerms := make([]permissions.Permission, 0)
+		for _, perm := range userPerms {
+			if !(perm.Type == permission && perm.Table == tableName && perm.Column == columnName) {
+				newPerms = append(newPerms, perm)
+			}
+		}
+		state.set(grantHolder{name: username}, newPerms)
+		return nil
+	})
 }
 
 // GrantRowPermission grants a row-level permission to a user
-func (m *RBACManager) GrantRowPermission(username string, tableName, condition string, permission permissions.PermissionType) error {
+func (m *RBACManager) GrantRowPermission(username string, tableName, condition string, permission permissions.PermissionType) (err error) {
+	defer func() {
+		err = m.recordChange("grant", username, permissions.Permission{Type: permission, Table: tableName, Condition: condition}.String(), err)
+	}()
+	if err := m.Authorize(permissions.GrantTable, tableName); err != nil {
+		return err
+	}
+
 	// Get current permissions
-	userPerms, err := m.AuthProvider.GetUserPermissions(username)
+	userPerms, err := m.authProvider.GetUserPermissions(username)
 	if err != nil {
 		return err
 	}
@@ -513,25 +730,146 @@ func (m *RBACManager) GrantRowPermission(username string, tableName, condition s
 	userPerms = append(userPerms, newPerm)
 
 	// Update user permissions
-	return m.AuthProvider.UpdateUserPermissions(username, userPerms)
+	return m.authProvider.UpdateUserPermissions(username, userPerms)
 }
 
 // RevokeRowPermission revokes a row-level permission from a user
-func (m *RBACManager) RevokeRowPermission(username string, tableName, condition string, permission permissions.PermissionType) error {
-	// Get current permissions
-	userPerms, err := m.AuthProvider.GetUserPermissions(username)
+func (m *RBACManager) RevokeRowPermission(username string, tableName, condition string, permission permissions.PermissionType) (err error) {
+	defer func() {
+		err = m.recordChange("revoke", username, permissions.Permission{Type: permission, Table: tableName, Condition: condition}.String(), err)
+	}()
+	if err := m.Authorize(permissions.GrantTable, tableName); err != nil {
+		return err
+	}
+
+	// Instead of removing the permission, mark it as revoked, and revoke the
+	// grants that depended on it
+	return m.revokeGrants(Cascade, func(state *grantState) error {
+		userPerms, err := state.userPermissions(username)
+		if err != nil {
+			return err
+		}
+		for i, perm := range userPerms {
+			if perm.Type == permission && perm.Table == tableName && perm.Condition == condition {
+				// Mark the permission as revoked by setting a special condition
+				newPerms := append([]permissions.Permission(nil), userPerms...)
+				newPerms[i].Condition = permissions.RevokedPermissionPrefix + condition
+				state.set(grantHolder{name: username}, newPerms)
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// GetRolePermissions returns the permissions granted to a role
+func (m *RBACManager) GetRolePermissions(roleName string) ([]permissions.Permission, error) {
+	return m.authProvider.GetRolePermissions(roleName)
+}
+
+// Grant grants the permissions described by a grant to a role, or to a user if
+// no role has the name. Members of a role receive its permissions through
+// GetEffectivePermissions. The actor needs the grant privilege on the table or
+// must hold every permission with grant option, and is recorded as the
+// grantor. Permissions the grantee already holds from the actor are not added
+// again.
+func (m *RBACManager) Grant(grantee string, grant GrantPolicy) (err error) {
+	defer func() { err = m.recordChange("grant", grantee, grant.String(), err) }()
+	granted, err := compileGrants([]GrantPolicy{grant})
 	if err != nil {
 		return err
 	}
+	perms := sortedPermissions(granted)
+	if err := m.authorizeGrant(grant.Table, perms); err != nil {
+		return err
+	}
 
-	// Instead of removing the permission, mark it as revoked
-	for i, perm := range userPerms {
-		if perm.Type == permission && perm.Table == tableName && perm.Condition == condition {
-			// Mark the permission as revoked by setting a special condition
-			userPerms[i].Condition = permissions.RevokedPermissionPrefix + condition
-			return m.AuthProvider.UpdateUserPermissions(username, userPerms)
+	isRole, err := m.isRole(grantee)
+	if err != nil {
+		return err
+	}
+	current, err := m.granteePermissions(grantee, isRole)
+	if err != nil {
+		return err
+	}
+
+	// Add the permissions in a stable order, skipping those already held
+	for _, perm := range perms {
+		perm.Grantor = m.actor
+		current = addGrant(current, perm)
+	}
+	return m.updateGranteePermissions(grantee, isRole, current)
+}
+
+// Revoke revokes the permissions described by a grant from a role or user. A
+// grant without columns revokes every permission on the table for its actions,
+// a grant with columns only the column permissions; a grant with grant option
+// only revokes the grant option. Actors with the grant privilege on the table
+// revoke the permissions of every grantor, other actors only the permissions
+// they granted. Grants that depended on a revoked grant option are revoked in
+// turn, or with Restrict the revoke fails.
+func (m *RBACManager) Revoke(grantee string, grant GrantPolicy, behavior RevokeBehavior) (err error) {
+	defer func() { err = m.recordChange("revoke", grantee, grant.String()+" "+behavior.String(), err) }()
+	actions, err := expandActions(grant.Actions)
+	if err != nil {
+		return err
+	}
+	anyGrantor, err := m.authorizeRevoke(grant.Table)
+	if err != nil {
+		return err
+	}
+
+	isRole, err := m.isRole(grantee)
+	if err != nil {
+		return err
+	}
+
+	// Revoke the permissions and the grants that depended on them
+	return m.revokeGrants(behavior, func(state *grantState) error {
+		holder := grantHolder{name: grantee, isRole: isRole}
+		current := state.perms[holder]
+		remaining := make([]permissions.Permission, 0, len(current))
+		for _, perm := range current {
+			if !grant.removes(actions, perm) || !(anyGrantor || perm.Grantor == m.actor) {
+				remaining = append(remaining, perm)
+				continue
+			}
+			if grant.GrantOption {
+				perm.GrantOption = false
+				remaining = addGrant(remaining, perm)
+			}
 		}
+		state.set(holder, remaining)
+		return nil
+	})
+}
+
+// isRole resolves a grantee name, which refers to a role if one exists with
+// the name and to a user otherwise
+func (m *RBACManager) isRole(grantee string) (bool, error) {
+	if exists, err := m.RoleExists(grantee); err != nil {
+		return false, err
+	} else if exists {
+		return true, nil
+	}
+	if _, err := m.authProvider.GetUserID(grantee); err != nil {
+		return false, fmt.Errorf("role or user %s not found", grantee)
+	}
+	return false, nil
+}
+
+// granteePermissions returns the permissions granted directly to a role or user
+func (m *RBACManager) granteePermissions(grantee string, isRole bool) ([]permissions.Permission, error) {
+	if isRole {
+		return m.authProvider.GetRolePermissions(grantee)
 	}
+	return m.authProvider.GetUserPermissions(grantee)
+}
 
-	return nil
+// updateGranteePermissions replaces the permissions granted directly to a role or user
+func (m *RBACManager) updateGranteePermissions(grantee string, isRole bool, perms []permissions.Permission) error {
+	if isRole {
+		return m.authProvider.UpdateRolePermissions(grantee, perms)
+	}
+	return m.authProvider.UpdateUserPermissions(grantee, perms)
 }
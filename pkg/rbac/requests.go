@@ -0,0 +1,469 @@
+package rbac
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/audit"
+)
+
+const (
+	// defaultRequestDuration is the longest access a workflow grants when its
+	// configuration does not set MaxDuration
+	defaultRequestDuration = 8 * time.Hour
+	// defaultRequestTimeout is how long requests stay pending when the
+	// workflow configuration does not set PendingTimeout
+	defaultRequestTimeout = 24 * time.Hour
+)
+
+// ErrRequestNotFound is returned for an unknown access request
+var ErrRequestNotFound = errors.New("access request not found")
+
+// AccessRequestStatus is the state of an access request
+type AccessRequestStatus string
+
+const (
+	// RequestPending is a request awaiting approval
+	RequestPending AccessRequestStatus = "pending"
+	// RequestApproved is a request whose access has been granted
+	RequestApproved AccessRequestStatus = "approved"
+	// RequestDenied is a request an approver denied
+	RequestDenied AccessRequestStatus = "denied"
+	// RequestExpired is a request that was not decided in time, or whose
+	// granted access has ended
+	RequestExpired AccessRequestStatus = "expired"
+)
+
+// AccessRequest is a request for temporary access, either membership of a role
+// or a table grant
+type AccessRequest struct {
+	ID        int64
+	Requester string
+	// Role requests membership of a role
+	Role string
+	// Grant requests a table grant; it may not have a window or grant option
+	Grant *GrantPolicy
+	// Justification explains why the access is needed
+	Justification string
+	// Duration of the access once approved; zero requests the maximum duration
+	Duration time.Duration
+
+	Status    AccessRequestStatus
+	Approvals []string
+	// DecidedBy is the approver who denied the request or gave the last approval
+	DecidedBy string
+	// Reason is the reason given for a denial
+	Reason    string
+	CreatedAt time.Time
+	DecidedAt time.Time
+	// NotAfter is the end of the granted access
+	NotAfter time.Time
+}
+
+// Target describes the access a request is for
+func (r AccessRequest) Target() string {
+	if r.Grant == nil {
+		return "role " + r.Role
+	}
+	target := fmt.Sprintf("%s on %s", strings.Join(r.Grant.Actions, ", "), r.Grant.Table)
+	if len(r.Grant.Columns) > 0 {
+		target += fmt.Sprintf(" (%s)", strings.Join(r.Grant.Columns, ", "))
+	}
+	if r.Grant.Row != "" {
+		target += " where " + r.Grant.Row
+	}
+	return target
+}
+
+// AccessRequestFilter selects access requests; empty fields match every request
+type AccessRequestFilter struct {
+	Requester string
+	Status    AccessRequestStatus
+}
+
+// Notifier is told about new and decided access requests, e.g. to alert
+// approvers or the requester
+type Notifier interface {
+	Notify(ctx context.Context, request AccessRequest)
+}
+
+// NotifierFunc adapts a function to the Notifier interface
+type NotifierFunc func(ctx context.Context, request AccessRequest)
+
+// Notify implements Notifier
+func (f NotifierFunc) Notify(ctx context.Context, request AccessRequest) {
+	f(ctx, request)
+}
+
+// AccessWorkflowConfig configures the approval of access requests
+type AccessWorkflowConfig struct {
+	// ApproverRole is the role whose members approve or deny requests
+	ApproverRole string
+	// RequiredApprovals is the number of distinct approvers a request needs,
+	// one by default
+	RequiredApprovals int
+	// MaxDuration is the longest access a request may ask for, eight hours by
+	// default
+	MaxDuration time.Duration
+	// PendingTimeout is how long a request waits for approval before it
+	// expires, one day by default
+	PendingTimeout time.Duration
+	// Sink receives an audit event for every change of a request
+	Sink audit.Sink
+	// Notifier is told about new and decided requests
+	Notifier Notifier
+}
+
+// AccessWorkflow lets users request temporary access that approvers grant or
+// deny. Approved requests become time-bound grants or role memberships in the
+// auth provider, made by the workflow's manager; it is usually the application
+// manager, as approvers need not hold the privileges to grant the access.
+type AccessWorkflow struct {
+	manager  *RBACManager
+	config   AccessWorkflowConfig
+	mu       sync.Mutex
+	requests map[int64]*AccessRequest
+	nextID   int64
+}
+
+// NewAccessWorkflow creates a workflow that grants approved access through a
+// manager
+func NewAccessWorkflow(manager *RBACManager, config AccessWorkflowConfig) (*AccessWorkflow, error) {
+	if config.ApproverRole == "" {
+		return nil, fmt.Errorf("access workflow requires an approver role")
+	}
+	if config.RequiredApprovals <= 0 {
+		config.RequiredApprovals = 1
+	}
+	if config.MaxDuration <= 0 {
+		config.MaxDuration = defaultRequestDuration
+	}
+	if config.PendingTimeout <= 0 {
+		config.PendingTimeout = defaultRequestTimeout
+	}
+	return &AccessWorkflow{
+		manager:  manager,
+		config:   config,
+		requests: make(map[int64]*AccessRequest),
+	}, nil
+}
+
+// Request files an access request on behalf of a user
+func (w *AccessWorkflow) Request(ctx context.Context, requester string, req AccessRequest) (*AccessRequest, error) {
+	if strings.TrimSpace(req.Justification) == "" {
+		return nil, fmt.Errorf("access request requires a justification")
+	}
+	if (req.Role == "") == (req.Grant == nil) {
+		return nil, fmt.Errorf("access request must be for either a role or a grant")
+	}
+	if req.Duration <= 0 {
+		req.Duration = w.config.MaxDuration
+	}
+	if req.Duration > w.config.MaxDuration {
+		return nil, fmt.Errorf("access is limited to %s", w.config.MaxDuration)
+	}
+	if _, err := w.manager.authProvider.GetUserID(requester); err != nil {
+		return nil, fmt.Errorf("user %s not found", requester)
+	}
+
+	// Check that the requested access exists and can be granted
+	if req.Role != "" {
+		if exists, err := w.manager.RoleExists(req.Role); err != nil {
+			return nil, err
+		} else if !exists {
+			return nil, fmt.Errorf("role %s not found", req.Role)
+		}
+		if hasRole, err := w.manager.UserHasRole(requester, req.Role); err != nil {
+			return nil, err
+		} else if hasRole {
+			return nil, fmt.Errorf("user %s already has role %s", requester, req.Role)
+		}
+	} else {
+		grant := *req.Grant
+		if grant.Table == "" {
+			return nil, fmt.Errorf("access request grant requires a table")
+		}
+		if grant.GrantOption || grant.NotBefore != nil || grant.NotAfter != nil {
+			return nil, fmt.Errorf("access request grant may not have a grant option or window")
+		}
+		if _, err := expandActions(grant.Actions); err != nil {
+			return nil, err
+		}
+		req.Grant = &grant
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := w.manager.now()
+	if err := w.expire(ctx, now); err != nil {
+		return nil, err
+	}
+
+	// The request is only filed once it is recorded
+	w.nextID++
+	request := &AccessRequest{
+		ID:            w.nextID,
+		Requester:     requester,
+		Role:          req.Role,
+		Grant:         req.Grant,
+		Justification: req.Justification,
+		Duration:      req.Duration,
+		Status:        RequestPending,
+		CreatedAt:     now,
+	}
+	detail := fmt.Sprintf("for %s: %s", request.Duration, request.Justification)
+	if err := w.record(ctx, audit.EventAccessRequested, requester, *request, detail); err != nil {
+		return nil, err
+	}
+	w.requests[request.ID] = request
+	w.notify(ctx, *request)
+	return request.copy(), nil
+}
+
+// Approve approves a pending request on behalf of an approver. The access is
+// granted once the request has the required number of approvals.
+func (w *AccessWorkflow) Approve(ctx context.Context, approver string, id int64) (*AccessRequest, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	request, err := w.decidable(ctx, approver, id)
+	if err != nil {
+		return nil, err
+	}
+	for _, existing := range request.Approvals {
+		if existing == approver {
+			return nil, fmt.Errorf("access request %d already approved by %s", id, approver)
+		}
+	}
+
+	now := w.manager.now()
+	approvals := len(request.Approvals) + 1
+	detail := fmt.Sprintf("approval %d of %d", approvals, w.config.RequiredApprovals)
+	if approvals < w.config.RequiredApprovals {
+		if err := w.record(ctx, audit.EventAccessApproved, approver, *request, detail); err != nil {
+			return nil, err
+		}
+		request.Approvals = append(request.Approvals, approver)
+		return request.copy(), nil
+	}
+
+	// Grant the access for the requested duration once the approval is recorded
+	notAfter := now.Add(request.Duration)
+	detail += ", granted until " + notAfter.UTC().Format(time.RFC3339)
+	if err := w.record(ctx, audit.EventAccessApproved, approver, *request, detail); err != nil {
+		return nil, err
+	}
+	if err := w.grant(*request, now, notAfter); err != nil {
+		return nil, err
+	}
+	request.Approvals = append(request.Approvals, approver)
+	request.Status = RequestApproved
+	request.DecidedBy = approver
+	request.DecidedAt = now
+	request.NotAfter = notAfter
+	w.notify(ctx, *request)
+	return request.copy(), nil
+}
+
+// Deny denies a pending request on behalf of an approver
+func (w *AccessWorkflow) Deny(ctx context.Context, approver string, id int64, reason string) (*AccessRequest, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	request, err := w.decidable(ctx, approver, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := w.record(ctx, audit.EventAccessDenied, approver, *request, reason); err != nil {
+		return nil, err
+	}
+	request.Status = RequestDenied
+	request.DecidedBy = approver
+	request.DecidedAt = w.manager.now()
+	request.Reason = reason
+	w.notify(ctx, *request)
+	return request.copy(), nil
+}
+
+// Get returns an access request. Users see their own requests, approvers and
+// the application see every request.
+func (w *AccessWorkflow) Get(ctx context.Context, username string, id int64) (*AccessRequest, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.expire(ctx, w.manager.now()); err != nil {
+		return nil, err
+	}
+	request, ok := w.requests[id]
+	if !ok {
+		return nil, ErrRequestNotFound
+	}
+	if request.Requester != username {
+		if approver, err := w.isApprover(username); err != nil {
+			return nil, err
+		} else if !approver {
+			return nil, ErrRequestNotFound
+		}
+	}
+	return request.copy(), nil
+}
+
+// List returns the access requests matching a filter in the order they were
+// filed. Users see their own requests, approvers and the application see
+// every request.
+func (w *AccessWorkflow) List(ctx context.Context, username string, filter AccessRequestFilter) ([]AccessRequest, error) {
+	approver, err := w.isApprover(username)
+	if err != nil {
+		return nil, err
+	}
+	if !approver {
+		filter.Requester = username
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.expire(ctx, w.manager.now()); err != nil {
+		return nil, err
+	}
+	var requests []AccessRequest
+	for _, request := range w.requests {
+		if filter.Requester != "" && request.Requester != filter.Requester {
+			continue
+		}
+		if filter.Status != "" && request.Status != filter.Status {
+			continue
+		}
+		requests = append(requests, *request.copy())
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].ID < requests[j].ID
+	})
+	return requests, nil
+}
+
+// Expire expires the pending requests that were not decided in time and the
+// approved requests whose access has ended
+func (w *AccessWorkflow) Expire(ctx context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.expire(ctx, w.manager.now())
+}
+
+// decidable returns a pending request an approver may decide
+func (w *AccessWorkflow) decidable(ctx context.Context, approver string, id int64) (*AccessRequest, error) {
+	if err := w.expire(ctx, w.manager.now()); err != nil {
+		return nil, err
+	}
+	if approver == "" {
+		return nil, fmt.Errorf("access requests are decided by an approver")
+	}
+	if ok, err := w.isApprover(approver); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, fmt.Errorf("%w: %s is not an approver", ErrInsufficientPrivilege, approver)
+	}
+	request, ok := w.requests[id]
+	if !ok {
+		return nil, ErrRequestNotFound
+	}
+	if request.Requester == approver {
+		return nil, fmt.Errorf("%w: users may not decide their own access requests", ErrInsufficientPrivilege)
+	}
+	if request.Status != RequestPending {
+		return nil, fmt.Errorf("access request %d is %s", id, request.Status)
+	}
+	return request, nil
+}
+
+// grant creates the time-bound grant or role membership of a request
+func (w *AccessWorkflow) grant(request AccessRequest, notBefore, notAfter time.Time) error {
+	if request.Grant == nil {
+		return w.manager.AssignRoleToUserBetween(request.Requester, request.Role, notBefore, notAfter)
+	}
+	grant := *request.Grant
+	grant.NotBefore, grant.NotAfter = &notBefore, &notAfter
+	return w.manager.Grant(request.Requester, grant)
+}
+
+// expire expires the requests that ended before a time and records them
+func (w *AccessWorkflow) expire(ctx context.Context, now time.Time) error {
+	for _, id := range w.sortedIDs() {
+		request := w.requests[id]
+		var detail string
+		switch {
+		case request.Status == RequestPending && !now.Before(request.CreatedAt.Add(w.config.PendingTimeout)):
+			detail = "not decided in time"
+		case request.Status == RequestApproved && !now.Before(request.NotAfter):
+			detail = "access ended"
+		default:
+			continue
+		}
+		if err := w.record(ctx, audit.EventAccessExpired, "", *request, detail); err != nil {
+			return err
+		}
+		request.Status = RequestExpired
+		w.notify(ctx, *request)
+	}
+	return nil
+}
+
+// isApprover checks if a user may decide access requests; the application
+// always may
+func (w *AccessWorkflow) isApprover(username string) (bool, error) {
+	if username == "" {
+		return true, nil
+	}
+	return w.manager.UserHasRole(username, w.config.ApproverRole)
+}
+
+// record sends an audit event about a request to the workflow's sink
+func (w *AccessWorkflow) record(ctx context.Context, eventType audit.EventType, principal string, request AccessRequest, detail string) error {
+	if w.config.Sink == nil {
+		return nil
+	}
+	event := audit.Event{
+		Time:      w.manager.now(),
+		Type:      eventType,
+		Principal: principal,
+		Subject:   request.Requester,
+		Detail:    fmt.Sprintf("request %d for %s", request.ID, request.Target()),
+	}
+	if detail != "" {
+		event.Detail += ": " + detail
+	}
+	if err := w.config.Sink.Record(ctx, event); err != nil {
+		return fmt.Errorf("failed to record access request %d: %w", request.ID, err)
+	}
+	return nil
+}
+
+// notify tells the workflow's notifier about a request
+func (w *AccessWorkflow) notify(ctx context.Context, request AccessRequest) {
+	if w.config.Notifier != nil {
+		w.config.Notifier.Notify(ctx, *request.copy())
+	}
+}
+
+// sortedIDs returns the IDs of the requests in the order they were filed
+func (w *AccessWorkflow) sortedIDs() []int64 {
+	ids := make([]int64, 0, len(w.requests))
+	for id := range w.requests {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// copy returns a copy of a request that shares no state with it
+func (r *AccessRequest) copy() *AccessRequest {
+	c := *r
+	c.Approvals = append([]string(nil), r.Approvals...)
+	if r.Grant != nil {
+		grant := *r.Grant
+		c.Grant = &grant
+	}
+	return &c
+}
@@ -0,0 +1,71 @@
+package rbac
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/auth"
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+)
+
+// ErrRowPoliciesUnsupported is returned when the auth provider does not
+// implement auth.RowPolicyStore
+var ErrRowPoliciesUnsupported = errors.New("auth provider does not store row policies")
+
+// ErrRowPolicyNotFound is returned when a row policy to drop does not exist
+var ErrRowPolicyNotFound = errors.New("row policy not found")
+
+// rowPolicyStore returns the row policy store of the auth provider
+func (m *RBACManager) rowPolicyStore() (auth.RowPolicyStore, error) {
+	store, ok := m.authProvider.(auth.RowPolicyStore)
+	if !ok {
+		return nil, ErrRowPoliciesUnsupported
+	}
+	return store, nil
+}
+
+// CreateRowPolicy stores a row policy, which restricts the rows of its table
+// for every handle of the auth provider. The actor must hold the grant
+// privilege on the table.
+func (m *RBACManager) CreateRowPolicy(policy auth.RowPolicy) (err error) {
+	defer func() { err = m.recordChange("create_policy", policy.Table, policy.Name, err) }()
+	if err := m.Authorize(permissions.GrantTable, policy.Table); err != nil {
+		return err
+	}
+	store, err := m.rowPolicyStore()
+	if err != nil {
+		return err
+	}
+	return store.AddRowPolicy(policy)
+}
+
+// DropRowPolicy removes a row policy of a table. The actor must hold the grant
+// privilege on the table.
+func (m *RBACManager) DropRowPolicy(table, name string) (err error) {
+	defer func() { err = m.recordChange("drop_policy", table, name, err) }()
+	if err := m.Authorize(permissions.GrantTable, table); err != nil {
+		return err
+	}
+	store, err := m.rowPolicyStore()
+	if err != nil {
+		return err
+	}
+	removed, err := store.RemoveRowPolicy(table, name)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return fmt.Errorf("%w: %s on table %s", ErrRowPolicyNotFound, name, table)
+	}
+	return nil
+}
+
+// RowPolicies returns the row policies of the auth provider, or none if it
+// does not store them
+func (m *RBACManager) RowPolicies() ([]auth.RowPolicy, error) {
+	store, ok := m.authProvider.(auth.RowPolicyStore)
+	if !ok {
+		return nil, nil
+	}
+	return store.ListRowPolicies()
+}
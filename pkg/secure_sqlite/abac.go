@@ -0,0 +1,238 @@
+package secure_sqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/abac"
+	"github.com/wemcdonald/secure_sqlite/pkg/audit"
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+	"github.com/wemcdonald/secure_sqlite/pkg/sqlparser"
+	xsqlparser "github.com/xwb1989/sqlparser"
+)
+
+// WithABAC evaluates the policies of an ABAC manager for the statements of the
+// handle. The manager is shared by every handle opened with it; handles opened
+// without it get their own.
+func WithABAC(manager *abac.ABACManager) Option {
+	return func(o *options) {
+		o.abac = manager
+	}
+}
+
+// AddABACPolicy adds an attribute-based policy. Allow policies bypass the RBAC
+// checks, so changing policies requires the ManageRoles privilege.
+func (db *SecureSQLite) AddABACPolicy(policy abac.Policy) (err error) {
+	defer func() { err = db.recordPolicyChange("add_abac_policy", policy.Name, err) }()
+	if err := db.rbacManager.Authorize(permissions.ManageRoles, ""); err != nil {
+		return privilegeError(err)
+	}
+	return db.abacManager.AddPolicy(policy)
+}
+
+// RemoveABACPolicy removes an attribute-based policy. It requires the
+// ManageRoles privilege.
+func (db *SecureSQLite) RemoveABACPolicy(name string) (err error) {
+	defer func() { err = db.recordPolicyChange("remove_abac_policy", name, err) }()
+	if err := db.rbacManager.Authorize(permissions.ManageRoles, ""); err != nil {
+		return privilegeError(err)
+	}
+	return db.abacManager.RemovePolicy(name)
+}
+
+// recordPolicyChange records a change to the ABAC policies like the RBAC
+// changes of the handle. A change that cannot be recorded fails.
+func (db *SecureSQLite) recordPolicyChange(operation, name string, err error) error {
+	sink := db.sessionSink()
+	if sink == nil {
+		return err
+	}
+	event := audit.Event{
+		Time:      time.Now(),
+		Type:      audit.EventRBACChange,
+		Principal: db.username,
+		Subject:   name,
+		Operation: operation,
+		Decision:  audit.Allow,
+	}
+	if err != nil {
+		event.Decision = audit.Deny
+		event.ErrorCode = "POLICY_ERROR"
+		var dbErr *DBError
+		if errors.As(err, &dbErr) {
+			event.ErrorCode = dbErr.Code
+		}
+		event.Detail = err.Error()
+	}
+	if recordErr := sink.Record(context.Background(), event); recordErr != nil && err == nil {
+		return &DBError{
+			Code:    "AUDIT_ERROR",
+			Message: fmt.Sprintf("failed to record %s", operation),
+			Err:     recordErr,
+		}
+	}
+	return err
+}
+
+// policyDecisions holds the ABAC decision for each table of a statement
+type policyDecisions map[string]*abac.Decision
+
+// permits checks if a policy permitted access to a table, in which case the
+// RBAC checks for the table are skipped
+func (d policyDecisions) permits(table string) bool {
+	decision, ok := d[table]
+	return ok && decision.Result == abac.Permit
+}
+
+// addRowFilters adds the row filters of the permitting policies to a session
+func (d policyDecisions) addRowFilters(session *sqlparser.Session) {
+	for table, decision := range d {
+		if decision.Result == abac.Permit && decision.RowFilter != "" {
+			session.AddRowFilter(table, decision.RowFilter)
+		}
+	}
+}
+
+// checkFilters returns the check filters of the permitting policies by table.
+// Check filters only apply to statements that write rows.
+func (d policyDecisions) checkFilters(action permissions.Action) map[string]string {
+	if action != permissions.Insert && action != permissions.Update {
+		return nil
+	}
+	checks := make(map[string]string)
+	for table, decision := range d {
+		if decision.Result == abac.Permit && decision.CheckFilter != "" {
+			checks[table] = decision.CheckFilter
+		}
+	}
+	return checks
+}
+
+// evaluatePolicies evaluates the ABAC policies for every table of a statement,
+// with the columns of the table, by lower-case table name, that the statement
+// references. A table denied by a policy fails the whole statement.
+func (db *SecureSQLite) evaluatePolicies(ctx context.Context, action permissions.Action, tables []string, columns map[string][]string) (policyDecisions, error) {
+	if db.abacManager == nil || len(db.abacManager.Policies()) == 0 {
+		return nil, nil
+	}
+
+	session, err := db.Session()
+	if err != nil {
+		return nil, &DBError{
+			Code:    "SESSION_ERROR",
+			Message: "failed to build session",
+			Err:     err,
+		}
+	}
+	environment := db.abacManager.NewEnvironment(ctx)
+
+	decisions := make(policyDecisions, len(tables))
+	for _, table := range tables {
+		decision, err := db.abacManager.Evaluate(&abac.Request{
+			Principal: abac.Principal{
+				Username:   session.Username,
+				Roles:      db.tableRoles(session.Roles, table),
+				Attributes: session.Attributes,
+			},
+			Resource: abac.Resource{
+				Table:   table,
+				Columns: columns[strings.ToLower(table)],
+				Action:  action,
+			},
+			Environment: environment,
+		})
+		if err != nil {
+			return nil, &DBError{
+				Code:    "POLICY_ERROR",
+				Message: fmt.Sprintf("failed to evaluate policies for table: %s", table),
+				Err:     err,
+			}
+		}
+		if decision.Result == abac.Forbid {
+			return nil, &DBError{
+				Code:    "PERMISSION_DENIED",
+				Message: fmt.Sprintf("permission denied for table: %s by policy: %s", table, decision.Policy),
+			}
+		}
+		decisions[table] = decision
+	}
+	return decisions, nil
+}
+
+// verifyChecks verifies that every row an INSERT or UPDATE statement writes
+// satisfies the check filters of the tables, before the statement is executed
+// in the same transaction
+func (db *SecureSQLite) verifyChecks(ctx context.Context, tx executor, stmt xsqlparser.Statement, args []interface{}, checks map[string]string) error {
+	if len(checks) == 0 {
+		return nil
+	}
+	session, err := db.Session()
+	if err != nil {
+		return &DBError{
+			Code:    "SESSION_ERROR",
+			Message: "failed to build session",
+			Err:     err,
+		}
+	}
+
+	// Count the written rows that violate each check filter
+	for table, check := range checks {
+		var columns []string
+		if insert, ok := stmt.(*xsqlparser.Insert); ok && len(insert.Columns) == 0 {
+			columns, err = tableColumns(ctx, tx, table)
+			if err != nil {
+				return &DBError{
+					Code:    "CHECK_ERROR",
+					Message: fmt.Sprintf("failed to read columns of table: %s", table),
+					Err:     err,
+				}
+			}
+		}
+
+		checkQuery, checkArgs, err := sqlparser.BuildCheckQuery(stmt, check, session, columns, args)
+		if err != nil {
+			return &DBError{
+				Code:    "CHECK_ERROR",
+				Message: fmt.Sprintf("failed to build policy check for table: %s", table),
+				Err:     err,
+			}
+		}
+		var violations int
+		if err := tx.QueryRowContext(ctx, checkQuery, checkArgs...).Scan(&violations); err != nil {
+			return &DBError{
+				Code:    "CHECK_ERROR",
+				Message: fmt.Sprintf("failed to run policy check for table: %s", table),
+				Err:     err,
+			}
+		}
+		if violations > 0 {
+			return &DBError{
+				Code:    "PERMISSION_DENIED",
+				Message: fmt.Sprintf("new row violates policy check for table: %s", table),
+			}
+		}
+	}
+	return nil
+}
+
+// tableColumns returns the columns of a table in declaration order
+func tableColumns(ctx context.Context, q queryer, table string) ([]string, error) {
+	rows, err := q.QueryContext(ctx, "SELECT name FROM pragma_table_info(?) ORDER BY cid", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+	return columns, rows.Err()
+}
@@ -0,0 +1,249 @@
+package secure_sqlite
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/auth"
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+	"github.com/wemcdonald/secure_sqlite/pkg/rbac"
+	"github.com/wemcdonald/secure_sqlite/pkg/sqlparser"
+)
+
+// execAccessStatement executes a GRANT, REVOKE, CREATE/DROP ROLE or CREATE/DROP
+// POLICY statement. These statements change access rather than data, so they
+// are handled by the RBAC manager instead of SQLite, and require the system
+// privileges of the corresponding RBAC operations.
+func (db *SecureSQLite) execAccessStatement(query string) (sql.Result, error) {
+	stmt, err := sqlparser.ParseAccessStatement(query)
+	if err != nil {
+		return nil, &DBError{
+			Code:    "PARSE_ERROR",
+			Message: "failed to parse access control statement",
+			Err:     err,
+		}
+	}
+
+	if err := db.applyAccessStatement(stmt); err != nil {
+		if errors.Is(err, rbac.ErrInsufficientPrivilege) {
+			return nil, &DBError{
+				Code:    "PERMISSION_DENIED",
+				Message: fmt.Sprintf("insufficient privilege for %s", stmt.Type),
+				Err:     err,
+			}
+		}
+		return nil, &DBError{
+			Code:    "ACCESS_CONTROL_ERROR",
+			Message: fmt.Sprintf("failed to execute %s", stmt.Type),
+			Err:     err,
+		}
+	}
+	return driver.RowsAffected(0), nil
+}
+
+// applyAccessStatement applies a parsed access control statement
+func (db *SecureSQLite) applyAccessStatement(stmt *sqlparser.AccessStatement) error {
+	switch stmt.Type {
+	case sqlparser.AccessGrant, sqlparser.AccessRevoke:
+		for _, grantee := range stmt.Grantees {
+			for _, privilege := range stmt.Privileges {
+				grant := rbac.GrantPolicy{
+					Table:       stmt.Table,
+					Actions:     []string{privilege.Action.String()},
+					Columns:     privilege.Columns,
+					GrantOption: stmt.GrantOption,
+				}
+				var err error
+				if stmt.Type == sqlparser.AccessGrant {
+					err = db.rbacManager.Grant(grantee, grant)
+				} else {
+					err = db.rbacManager.Revoke(grantee, grant, revokeBehavior(stmt))
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+	case sqlparser.AccessGrantRole, sqlparser.AccessRevokeRole:
+		for _, grantee := range stmt.Grantees {
+			for _, role := range stmt.Roles {
+				var err error
+				if stmt.Type == sqlparser.AccessGrantRole {
+					err = db.rbacManager.AssignRoleToUser(grantee, role)
+				} else {
+					err = db.rbacManager.RemoveRoleFromUser(grantee, role)
+				}
+				if err != nil {
+					return fmt.Errorf("role %s, user %s: %w", role, grantee, err)
+				}
+			}
+		}
+
+	case sqlparser.AccessCreateRole:
+		exists, err := db.rbacManager.RoleExists(stmt.Name)
+		if err != nil {
+			return err
+		}
+		if exists && stmt.IfNotExists {
+			return nil
+		}
+		_, err = db.rbacManager.CreateRole(stmt.Name)
+		return err
+
+	case sqlparser.AccessDropRole:
+		exists, err := db.rbacManager.RoleExists(stmt.Name)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if stmt.IfExists {
+				return nil
+			}
+			return fmt.Errorf("role %s not found", stmt.Name)
+		}
+		return db.rbacManager.DeleteRole(stmt.Name)
+
+	case sqlparser.AccessCreatePolicy:
+		return db.rbacManager.CreateRowPolicy(auth.RowPolicy{
+			Name:      stmt.Name,
+			Table:     stmt.Table,
+			Actions:   stmt.Actions,
+			Roles:     stmt.Roles,
+			Using:     stmt.Using,
+			WithCheck: stmt.WithCheck,
+		})
+
+	case sqlparser.AccessDropPolicy:
+		err := db.rbacManager.DropRowPolicy(stmt.Table, stmt.Name)
+		if stmt.IfExists && errors.Is(err, rbac.ErrRowPolicyNotFound) {
+			return nil
+		}
+		return err
+
+	default:
+		return fmt.Errorf("unsupported access control statement: %s", stmt.Type)
+	}
+	return nil
+}
+
+// revokeBehavior returns how a REVOKE statement handles dependent grants
+func revokeBehavior(stmt *sqlparser.AccessStatement) rbac.RevokeBehavior {
+	if stmt.Restrict {
+		return rbac.Restrict
+	}
+	return rbac.Cascade
+}
+
+// rowPolicyConditions returns the condition that rows must satisfy for every
+// table with row policies covering an action: any of the USING conditions of
+// the policies that apply to one of the roles, or of their WITH CHECK
+// conditions for written rows. The emergency role of an elevation only
+// counts for the tables it covers. A table whose policies apply to none of the
+// roles admits no rows. Row policies restrict access on top of the granted
+// permissions and never grant it.
+func (db *SecureSQLite) rowPolicyConditions(action permissions.Action, roles []string, check bool) (map[string]string, error) {
+	policies, err := db.rbacManager.RowPolicies()
+	if err != nil {
+		return nil, &DBError{
+			Code:    "POLICY_ERROR",
+			Message: "failed to load row policies",
+			Err:     err,
+		}
+	}
+
+	admitted := make(map[string][]string)
+	for _, policy := range policies {
+		if !containsAction(policy.Actions, action) {
+			continue
+		}
+		table := strings.ToLower(policy.Table)
+		if _, ok := admitted[table]; !ok {
+			admitted[table] = nil
+		}
+		if !appliesToRoles(policy.Roles, db.tableRoles(roles, table)) {
+			continue
+		}
+		condition := policy.Using
+		if check && policy.WithCheck != "" {
+			condition = policy.WithCheck
+		}
+		if condition != "" {
+			admitted[table] = append(admitted[table], "("+condition+")")
+		}
+	}
+
+	conditions := make(map[string]string, len(admitted))
+	for table, admits := range admitted {
+		if len(admits) == 0 {
+			conditions[table] = "1 = 0"
+			continue
+		}
+		conditions[table] = strings.Join(admits, " OR ")
+	}
+	return conditions, nil
+}
+
+// addRowPolicyChecks adds the WITH CHECK conditions of the row policies of the
+// tables an INSERT or UPDATE statement writes to the check filters of its ABAC
+// policies, so that the written rows must satisfy both
+func (db *SecureSQLite) addRowPolicyChecks(action permissions.Action, tables []string, checks map[string]string) (map[string]string, error) {
+	if action != permissions.Insert && action != permissions.Update {
+		return checks, nil
+	}
+	roles, err := db.rbacManager.GetUserRoles(db.username)
+	if err != nil {
+		return nil, &DBError{
+			Code:    "POLICY_ERROR",
+			Message: "failed to get roles for row policies",
+			Err:     err,
+		}
+	}
+	conditions, err := db.rowPolicyConditions(action, roles, true)
+	if err != nil {
+		return nil, err
+	}
+	for _, table := range tables {
+		condition, ok := conditions[strings.ToLower(table)]
+		if !ok {
+			continue
+		}
+		if checks == nil {
+			checks = make(map[string]string)
+		}
+		if existing := checks[table]; existing != "" {
+			condition = "(" + existing + ") AND (" + condition + ")"
+		}
+		checks[table] = condition
+	}
+	return checks, nil
+}
+
+// containsAction checks if a list of actions contains an action
+func containsAction(actions []permissions.Action, action permissions.Action) bool {
+	for _, a := range actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// appliesToRoles checks if a policy for the given roles applies to a user
+// holding the other roles. A policy without roles applies to everyone.
+func appliesToRoles(policyRoles, roles []string) bool {
+	if len(policyRoles) == 0 {
+		return true
+	}
+	for _, policyRole := range policyRoles {
+		for _, role := range roles {
+			if strings.EqualFold(policyRole, role) {
+				return true
+			}
+		}
+	}
+	return false
+}
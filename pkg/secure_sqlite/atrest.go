@@ -0,0 +1,205 @@
+package secure_sqlite
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/wemcdonald/secure_sqlite/pkg/encryption"
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+)
+
+var (
+	// errWrongKey is returned by connections of an encrypted database keyed
+	// with a key that does not decrypt it
+	errWrongKey = errors.New("key does not decrypt the database")
+	// errNoCodec is returned by connections of an encrypted database when
+	// SQLite is not built with SQLCipher, which would ignore the key
+	errNoCodec = errors.New("SQLite is not built with SQLCipher")
+)
+
+// databaseKey holds the key that connections of an encrypted database are
+// keyed with
+type databaseKey struct {
+	id  string
+	key []byte
+	mu  sync.RWMutex
+}
+
+// dataSourceName returns a data source name that keys a connection as SQLite
+// opens it. The driver reads the schema before its connect hook runs, which
+// fails on an encrypted file unless the connection is keyed already, so the
+// key is passed in the key parameter of a URI filename.
+func (k *databaseKey) dataSourceName(dsn string) string {
+	name, query, _ := strings.Cut(dsn, "?")
+	if !strings.HasPrefix(name, "file:") {
+		// SQLite reads the parameters of URI filenames only
+		name = "file:" + (&url.URL{Path: name}).EscapedPath()
+	}
+	if query != "" {
+		query += "&"
+	}
+	k.mu.RLock()
+	key := fmt.Sprintf("x'%s'", hex.EncodeToString(k.key))
+	k.mu.RUnlock()
+	return name + "?" + query + "key=" + url.QueryEscape(key)
+}
+
+// check checks that a new connection is encrypted and that its key decrypts
+// the database
+func (k *databaseKey) check(conn *sqlite3.SQLiteConn) error {
+	// SQLite without a codec ignores the key and would write plaintext
+	rows, err := conn.Query("PRAGMA cipher_version", nil)
+	if err != nil {
+		return err
+	}
+	err = rows.Next(make([]driver.Value, len(rows.Columns())))
+	rows.Close()
+	if err == io.EOF {
+		return errNoCodec
+	}
+	if err != nil {
+		return err
+	}
+
+	// SQLCipher only reads the file when it is first used
+	rows, err = conn.Query("SELECT count(*) FROM sqlite_master", nil)
+	if err == nil {
+		err = rows.Next(make([]driver.Value, 1))
+		rows.Close()
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrNotADB {
+		return errWrongKey
+	}
+	return err
+}
+
+// keyPragma returns a PRAGMA that sets a raw key, which SQLCipher uses without
+// deriving a key from it
+func keyPragma(name string, key []byte) string {
+	return fmt.Sprintf(`PRAGMA %s = "x'%s'"`, name, hex.EncodeToString(key))
+}
+
+// openEncrypted opens an encrypted database with the current key of a key
+// provider
+func openEncrypted(ctx context.Context, dataSourceName string, provider encryption.KeyProvider, cipher *encryption.Cipher) (*sql.DB, *databaseKey, error) {
+	id, key, err := provider.CurrentKey(ctx)
+	if err == nil && len(key) != encryption.KeySize {
+		err = fmt.Errorf("key %s has %d bytes, want %d", id, len(key), encryption.KeySize)
+	}
+	if err != nil {
+		return nil, nil, &DBError{
+			Code:    "ENCRYPTION_ERROR",
+			Message: "failed to get database key",
+			Err:     err,
+		}
+	}
+	k := &databaseKey{id: id, key: key}
+	db := openDB(dataSourceName, cipher, k)
+
+	// Connect now, so that a wrong key fails Open
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, nil, databaseKeyError(err)
+	}
+	return db, k, nil
+}
+
+// databaseKeyError reports an error keying a connection
+func databaseKeyError(err error) error {
+	switch {
+	case errors.Is(err, errWrongKey):
+		return &DBError{
+			Code:    "ENCRYPTION_KEY_ERROR",
+			Message: "wrong key for encrypted database",
+			Err:     err,
+		}
+	case errors.Is(err, errNoCodec):
+		return &DBError{
+			Code:    "ENCRYPTION_UNSUPPORTED",
+			Message: "database encryption requires SQLite built with SQLCipher",
+			Err:     err,
+		}
+	}
+	return &DBError{
+		Code:    "ENCRYPTION_ERROR",
+		Message: "failed to open encrypted database",
+		Err:     err,
+	}
+}
+
+// RekeyDatabase re-encrypts an encrypted database with the current key of its
+// key provider, after the provider rotated to a new key. It requires the
+// superuser privilege, and should run while the handle is otherwise idle,
+// since connections in use keep the old key.
+func (db *SecureSQLite) RekeyDatabase(ctx context.Context) (err error) {
+	a := db.auditStatement(operationRekey, "PRAGMA rekey")
+	a.rule = permissions.Superuser.String()
+	defer func() { db.refused(ctx, a, err) }()
+
+	if err := db.rbacManager.Authorize(permissions.Superuser, ""); err != nil {
+		return privilegeError(err)
+	}
+	if db.databaseKey == nil {
+		return &DBError{
+			Code:    "ENCRYPTION_ERROR",
+			Message: "database is not encrypted",
+		}
+	}
+	id, key, err := db.databaseKeys.CurrentKey(ctx)
+	if err == nil && len(key) != encryption.KeySize {
+		err = fmt.Errorf("key %s has %d bytes, want %d", id, len(key), encryption.KeySize)
+	}
+	if err != nil {
+		return &DBError{
+			Code:    "ENCRYPTION_ERROR",
+			Message: "failed to get database key",
+			Err:     err,
+		}
+	}
+	db.databaseKey.mu.RLock()
+	current := db.databaseKey.id
+	db.databaseKey.mu.RUnlock()
+	if id == current {
+		return nil
+	}
+	if err := db.authorized(ctx, a); err != nil {
+		return err
+	}
+
+	conn, err := db.sqlDB.Conn(ctx)
+	if err != nil {
+		return databaseKeyError(err)
+	}
+	_, err = conn.ExecContext(ctx, keyPragma("rekey", key))
+	conn.Close()
+	if err != nil {
+		return &DBError{
+			Code:    "ENCRYPTION_ERROR",
+			Message: "failed to rekey database",
+			Err:     err,
+		}
+	}
+
+	// Key new connections with the new key, and drop idle connections keyed
+	// with the old one
+	db.databaseKey.mu.Lock()
+	db.databaseKey.id, db.databaseKey.key = id, key
+	db.databaseKey.mu.Unlock()
+	db.sqlDB.SetMaxIdleConns(0)
+	db.sqlDB.SetMaxIdleConns(defaultMaxIdleConns)
+	return nil
+}
+
+// defaultMaxIdleConns is the default number of idle connections of a
+// database/sql pool
+const defaultMaxIdleConns = 2
@@ -0,0 +1,17 @@
+//go:build sqlcipher
+
+package secure_sqlite
+
+import (
+	"github.com/wemcdonald/secure_sqlite/pkg/encryption"
+)
+
+// WithDatabaseEncryption encrypts the whole database file with the current key
+// of a key provider, using SQLCipher page encryption. It is only built with
+// the sqlcipher tag, together with the libsqlite3 tag of the driver to link a
+// SQLite built with SQLCipher; the raw key is handed to SQLCipher as is.
+func WithDatabaseEncryption(provider encryption.KeyProvider) Option {
+	return func(o *options) {
+		o.databaseKeys = provider
+	}
+}
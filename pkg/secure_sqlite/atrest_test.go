@@ -0,0 +1,62 @@
+//go:build sqlcipher
+
+package secure_sqlite
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wemcdonald/secure_sqlite/pkg/auth"
+	"github.com/wemcdonald/secure_sqlite/pkg/encryption"
+)
+
+func TestDatabaseEncryption(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "encrypted.db")
+	keys, err := encryption.CreateKeyFile(filepath.Join(dir, "keys.json"))
+	assert.NoError(t, err)
+	mockAuth := auth.NewMemoryProvider()
+	mockAuth.AddUser("admin", "admintoken")
+
+	db, err := Open(path, mockAuth, "admin", "admintoken", WithSuperuser("admin"), WithDatabaseEncryption(keys))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = db.Exec("CREATE TABLE secrets (id INTEGER PRIMARY KEY, value TEXT)")
+	assert.NoError(t, err)
+	_, err = db.sqlDB.Exec("INSERT INTO secrets (value) VALUES ('plaintext marker')")
+	assert.NoError(t, err)
+	assert.NoError(t, db.Close())
+
+	// The file holds no plaintext
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), "plaintext marker")
+	assert.NotContains(t, string(data), "SQLite format 3")
+
+	// Opening without the key or with another key fails clearly
+	other, err := encryption.CreateKeyFile(filepath.Join(dir, "other.json"))
+	assert.NoError(t, err)
+	_, err = Open(path, mockAuth, "admin", "admintoken", WithDatabaseEncryption(other))
+	if assert.Error(t, err) {
+		assert.Equal(t, "ENCRYPTION_KEY_ERROR", err.(*DBError).Code)
+	}
+
+	// Rekeying switches the file to the rotated key
+	db, err = Open(path, mockAuth, "admin", "admintoken", WithDatabaseEncryption(keys))
+	assert.NoError(t, err)
+	_, err = keys.Rotate()
+	assert.NoError(t, err)
+	assert.NoError(t, db.RekeyDatabase(context.Background()))
+	var value string
+	assert.NoError(t, db.sqlDB.QueryRow("SELECT value FROM secrets").Scan(&value))
+	assert.Equal(t, "plaintext marker", value)
+	assert.NoError(t, db.Close())
+	db, err = Open(path, mockAuth, "admin", "admintoken", WithDatabaseEncryption(keys))
+	assert.NoError(t, err)
+	assert.NoError(t, db.sqlDB.QueryRow("SELECT value FROM secrets").Scan(&value))
+	assert.NoError(t, db.Close())
+}
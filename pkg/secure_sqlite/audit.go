@@ -0,0 +1,161 @@
+package secure_sqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/audit"
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+)
+
+// Operations of statement audit events
+const (
+	operationQuery     = "query"
+	operationQueryRow  = "query_row"
+	operationExec      = "exec"
+	operationPrepare   = "prepare"
+	operationHistory   = "row_history"
+	operationReencrypt = "reencrypt"
+	operationRekey     = "rekey"
+	operationUnsafe    = "unsafe"
+)
+
+// statementAudit collects what the authorization of a statement decided, for
+// the audit event recorded about it
+type statementAudit struct {
+	id        string
+	operation string
+	query     string
+	rewritten string
+	action    string
+	tables    []string
+	columns   []string
+	decisions policyDecisions
+	rule      string
+	detail    string
+	recorded  bool
+}
+
+// auditStatement starts the audit record of a statement and gives the
+// statement an ID within the session
+func (db *SecureSQLite) auditStatement(operation, query string) *statementAudit {
+	return &statementAudit{
+		id:        fmt.Sprintf("%s-%d", db.sessionID, db.statements.Add(1)),
+		operation: operation,
+		query:     query,
+	}
+}
+
+// authorized records that a statement was allowed, before it is executed. The
+// statement must not be executed if the decision cannot be recorded.
+func (db *SecureSQLite) authorized(ctx context.Context, a *statementAudit) error {
+	a.recorded = true
+	if db.auditSink == nil {
+		return nil
+	}
+	event := db.statementEvent(a)
+	event.Decision = audit.Allow
+	event.Rule = a.rule
+	if event.Rule == "" {
+		event.Rule = db.matchingRules(a)
+	}
+	if err := db.auditSink.Record(ctx, event); err != nil {
+		return &DBError{
+			Code:    "AUDIT_ERROR",
+			Message: "failed to record statement",
+			Err:     err,
+		}
+	}
+	return nil
+}
+
+// refused records that a statement failed authorization with an error. It
+// does nothing for statements already recorded as allowed.
+func (db *SecureSQLite) refused(ctx context.Context, a *statementAudit, err error) {
+	if db.auditSink == nil || a.recorded || err == nil {
+		return
+	}
+	a.recorded = true
+	event := db.statementEvent(a)
+	event.Decision = audit.Deny
+	event.Detail = err.Error()
+	var dbErr *DBError
+	if errors.As(err, &dbErr) {
+		event.ErrorCode = dbErr.Code
+	}
+	// The statement is refused whether or not the refusal can be recorded
+	_ = db.auditSink.Record(ctx, event)
+}
+
+// statementEvent returns the audit event of a statement
+func (db *SecureSQLite) statementEvent(a *statementAudit) audit.Event {
+	return audit.Event{
+		Time:        db.rbacManager.Now(),
+		Type:        audit.EventStatement,
+		Principal:   db.username,
+		SessionID:   db.sessionID,
+		StatementID: a.id,
+		Operation:   a.operation,
+		Statement:   a.query,
+		Rewritten:   a.rewritten,
+		Tables:      a.tables,
+		Columns:     a.columns,
+		Action:      a.action,
+		Detail:      a.detail,
+		BreakGlass:  db.elevation != nil,
+	}
+}
+
+// matchingRules describes the policy or permission that allowed access to
+// each table of a statement
+func (db *SecureSQLite) matchingRules(a *statementAudit) string {
+	var rules []string
+	for _, table := range a.tables {
+		if decision, ok := a.decisions[table]; ok && a.decisions.permits(table) {
+			rules = append(rules, "policy "+decision.Policy)
+			continue
+		}
+		perm, err := db.rbacManager.TablePermissionRule(db.username, table, permissions.TablePermission)
+		if err == nil && perm != nil {
+			rules = append(rules, "grant "+perm.String())
+		}
+	}
+	return strings.Join(rules, "; ")
+}
+
+// sessionSink returns a sink that stamps the events of the handle's RBAC
+// manager with its session
+func (db *SecureSQLite) sessionSink() audit.Sink {
+	if db.auditSink == nil {
+		return nil
+	}
+	return audit.SinkFunc(func(ctx context.Context, event audit.Event) error {
+		event.SessionID = db.sessionID
+		event.BreakGlass = db.elevation != nil
+		return db.auditSink.Record(ctx, event)
+	})
+}
+
+// recordAuthentication records an attempt to authenticate when opening a
+// database; failed attempts carry the error they failed with
+func recordAuthentication(sink audit.Sink, username, sessionID string, authErr *DBError) error {
+	if sink == nil {
+		return nil
+	}
+	event := audit.Event{
+		Time:      time.Now(),
+		Type:      audit.EventAuthentication,
+		Principal: username,
+		SessionID: sessionID,
+		Decision:  audit.Allow,
+	}
+	if authErr != nil {
+		event.SessionID = ""
+		event.Decision = audit.Deny
+		event.ErrorCode = authErr.Code
+	}
+	return sink.Record(context.Background(), event)
+}
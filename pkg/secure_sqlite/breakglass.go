@@ -0,0 +1,283 @@
+package secure_sqlite
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/audit"
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+	"github.com/wemcdonald/secure_sqlite/pkg/rbac"
+)
+
+// defaultBreakGlassDuration is the longest elevation of a break-glass policy
+// that does not set MaxDuration
+const defaultBreakGlassDuration = time.Hour
+
+// BreakGlassPolicy defines an emergency role that responders may elevate to
+// during an incident
+type BreakGlassPolicy struct {
+	// Role is the emergency role whose data permissions the elevation confers
+	Role string
+	// Responders lists the users, or roles whose members, may elevate
+	Responders []string
+	// Tables limits elevations to these tables; empty allows every table the
+	// role has permissions on
+	Tables []string
+	// MaxDuration is the longest elevation allowed, one hour by default
+	MaxDuration time.Duration
+}
+
+// BreakGlassRequest requests a break-glass elevation
+type BreakGlassRequest struct {
+	Role string
+	// Justification explains the emergency and is recorded in the audit log
+	Justification string
+	// Duration of the elevation; zero requests the maximum duration
+	Duration time.Duration
+	// Tables limits the elevation to some of the tables the policy allows
+	Tables []string
+}
+
+// elevation is the state of a break-glass elevated handle
+type elevation struct {
+	id       string
+	role     string
+	notAfter time.Time
+}
+
+// WithBreakGlass defines the emergency roles of break-glass elevations.
+// Elevations require an audit sink.
+func WithBreakGlass(policies ...BreakGlassPolicy) Option {
+	return func(o *options) {
+		o.breakGlass = append(o.breakGlass, policies...)
+	}
+}
+
+// WithAuditSink sends the audit events of the database to a sink
+func WithAuditSink(sink audit.Sink) Option {
+	return func(o *options) {
+		o.auditSink = sink
+	}
+}
+
+// BreakGlass elevates the user to an emergency role for a short time. It
+// returns a separate handle that holds the data permissions of the role, on
+// which every statement is recorded in the audit log; the original handle is
+// not elevated. The elevation is recorded with its justification and ends when
+// its duration passes or the elevated handle is closed.
+func (db *SecureSQLite) BreakGlass(ctx context.Context, req BreakGlassRequest) (*SecureSQLite, error) {
+	if db.elevation != nil {
+		return nil, &DBError{
+			Code:    "BREAK_GLASS_ERROR",
+			Message: "handle is already elevated",
+		}
+	}
+	if db.auditSink == nil {
+		return nil, &DBError{
+			Code:    "BREAK_GLASS_ERROR",
+			Message: "break-glass access requires an audit sink",
+		}
+	}
+	if strings.TrimSpace(req.Justification) == "" {
+		return nil, &DBError{
+			Code:    "BREAK_GLASS_ERROR",
+			Message: "break-glass access requires a justification",
+		}
+	}
+
+	// Find the policy and check that the request stays within it
+	policy, ok := db.breakGlassPolicy(req.Role)
+	if !ok {
+		return nil, &DBError{
+			Code:    "BREAK_GLASS_ERROR",
+			Message: fmt.Sprintf("no break-glass policy for role: %s", req.Role),
+		}
+	}
+	responder, err := db.isResponder(policy)
+	if err != nil {
+		return nil, &DBError{
+			Code:    "BREAK_GLASS_ERROR",
+			Message: "failed to check responders",
+			Err:     err,
+		}
+	}
+	if !responder {
+		return nil, &DBError{
+			Code:    "PERMISSION_DENIED",
+			Message: fmt.Sprintf("user %s may not elevate to role: %s", db.username, req.Role),
+		}
+	}
+	maxDuration := policy.MaxDuration
+	if maxDuration <= 0 {
+		maxDuration = defaultBreakGlassDuration
+	}
+	duration := req.Duration
+	if duration <= 0 {
+		duration = maxDuration
+	}
+	if duration > maxDuration {
+		return nil, &DBError{
+			Code:    "BREAK_GLASS_ERROR",
+			Message: fmt.Sprintf("elevation to role %s is limited to %s", req.Role, maxDuration),
+		}
+	}
+	tables := req.Tables
+	if len(tables) == 0 {
+		tables = policy.Tables
+	}
+	for _, table := range tables {
+		if len(policy.Tables) > 0 && !permissions.ContainsName(policy.Tables, table) {
+			return nil, &DBError{
+				Code:    "BREAK_GLASS_ERROR",
+				Message: fmt.Sprintf("elevation to role %s does not allow table: %s", req.Role, table),
+			}
+		}
+	}
+
+	id, err := newSessionID()
+	if err != nil {
+		return nil, &DBError{
+			Code:    "BREAK_GLASS_ERROR",
+			Message: "failed to create elevation ID",
+			Err:     err,
+		}
+	}
+	now := db.rbacManager.Now()
+	e := &elevation{id: id, role: policy.Role, notAfter: now.Add(duration)}
+
+	// The elevation is only granted once it is recorded
+	detail := fmt.Sprintf("role %s until %s", e.role, e.notAfter.Format(time.RFC3339))
+	if len(tables) > 0 {
+		detail += " on " + strings.Join(tables, ", ")
+	}
+	if err := db.auditSink.Record(ctx, audit.Event{
+		Time:       now,
+		Type:       audit.EventBreakGlass,
+		Principal:  db.username,
+		Subject:    e.role,
+		Detail:     detail + ": " + req.Justification,
+		SessionID:  e.id,
+		BreakGlass: true,
+	}); err != nil {
+		return nil, &DBError{
+			Code:    "AUDIT_ERROR",
+			Message: "failed to record break-glass elevation",
+			Err:     err,
+		}
+	}
+
+	elevated := &SecureSQLite{
+		sqlDB:        db.sqlDB,
+		hardened:     db.hardened,
+		authProvider: db.authProvider,
+		rbacManager: db.rbacManager.Elevate(rbac.Elevation{
+			Role:     e.role,
+			Tables:   tables,
+			NotAfter: e.notAfter,
+		}),
+		abacManager:    db.abacManager,
+		maskingManager: db.maskingManager,
+		username:       db.username,
+		token:          db.token,
+		sessionID:      e.id,
+		storedSession:  db.storedSession,
+		sessionAttrs:   make(map[string]interface{}),
+		auditSink:      db.auditSink,
+		elevation:      e,
+		history:        db.history,
+		sensitive:      db.sensitive,
+		cipher:         db.cipher,
+		databaseKeys:   db.databaseKeys,
+		databaseKey:    db.databaseKey,
+	}
+	elevated.rbacManager.Audit = elevated.sessionSink()
+	db.sessionMu.RLock()
+	for name, value := range db.sessionAttrs {
+		elevated.sessionAttrs[name] = value
+	}
+	db.sessionMu.RUnlock()
+	return elevated, nil
+}
+
+// breakGlassPolicy returns the break-glass policy of an emergency role
+func (db *SecureSQLite) breakGlassPolicy(role string) (BreakGlassPolicy, bool) {
+	for _, policy := range db.breakGlass {
+		if policy.Role == role {
+			return policy, true
+		}
+	}
+	return BreakGlassPolicy{}, false
+}
+
+// isResponder checks if the user is a responder of a break-glass policy
+func (db *SecureSQLite) isResponder(policy BreakGlassPolicy) (bool, error) {
+	roles, err := db.rbacManager.GetUserRoles(db.username)
+	if err != nil {
+		return false, err
+	}
+	for _, responder := range policy.Responders {
+		if responder == db.username || permissions.ContainsName(roles, responder) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// tableRoles returns the roles that apply to a statement on a table: the roles
+// the user holds and the emergency role of an elevation covering the table
+func (db *SecureSQLite) tableRoles(roles []string, table string) []string {
+	role, ok := db.rbacManager.ElevatedRole(table)
+	if !ok || permissions.ContainsName(roles, role) {
+		return roles
+	}
+	return append(roles[:len(roles):len(roles)], role)
+}
+
+// recordStatement records a statement executed on a break-glass elevated
+// handle. Statements fail once the elevation has ended or if they cannot be
+// recorded.
+func (db *SecureSQLite) recordStatement(ctx context.Context, query string) error {
+	if db.elevation == nil {
+		return nil
+	}
+	now := db.rbacManager.Now()
+	db.sessionMu.RLock()
+	ended := !now.Before(db.elevation.notAfter)
+	db.sessionMu.RUnlock()
+	if ended {
+		return &DBError{
+			Code:    "ELEVATION_EXPIRED",
+			Message: fmt.Sprintf("break-glass elevation to role %s has ended", db.elevation.role),
+		}
+	}
+	if err := db.auditSink.Record(ctx, audit.Event{
+		Time:       now,
+		Type:       audit.EventBreakGlassStatement,
+		Principal:  db.username,
+		Subject:    db.elevation.role,
+		SessionID:  db.elevation.id,
+		Statement:  query,
+		BreakGlass: true,
+	}); err != nil {
+		return &DBError{
+			Code:    "AUDIT_ERROR",
+			Message: "failed to record break-glass statement",
+			Err:     err,
+		}
+	}
+	return nil
+}
+
+// endElevation records the end of a break-glass elevation when its handle is closed
+func (db *SecureSQLite) endElevation() error {
+	return db.auditSink.Record(context.Background(), audit.Event{
+		Time:       db.rbacManager.Now(),
+		Type:       audit.EventBreakGlassEnded,
+		Principal:  db.username,
+		Subject:    db.elevation.role,
+		SessionID:  db.elevation.id,
+		BreakGlass: true,
+	})
+}
@@ -1,12 +1,19 @@
 package secure_sqlite
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/wemcdonald/secure_sqlite/pkg/abac"
+	"github.com/wemcdonald/secure_sqlite/pkg/audit"
 	"github.com/wemcdonald/secure_sqlite/pkg/auth"
-	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+	"github.com/wemcdonald/secure_sqlite/pkg/encryption"
+	"github.com/wemcdonald/secure_sqlite/pkg/masking"
 	"github.com/wemcdonald/secure_sqlite/pkg/rbac"
 	"github.com/wemcdonald/secure_sqlite/pkg/sqlparser"
 	xsqlparser "github.com/xwb1989/sqlparser"
@@ -32,140 +39,325 @@ func (e *DBError) Unwrap() error {
 
 // SecureSQLite implements the SecureDB interface
 type SecureSQLite struct {
-	SqlDB        *sql.DB
+	sqlDB        *sql.DB
+	hardened     bool
 	authProvider auth.Provider
-	RBACManager  *rbac.RBACManager
-	username     string
-	token        string
+	// rbacManager acts on behalf of the user of the handle
+	rbacManager *rbac.RBACManager
+	// abacManager holds the attribute-based policies evaluated for the user
+	abacManager *abac.ABACManager
+	// maskingManager holds the rules that mask columns for the user, which
+	// the handle only reads
+	maskingManager *masking.Manager
+	username       string
+	token          string
+	sessionID      string
+	// storedSession is the session stored with the auth provider, which
+	// statements check has not been terminated
+	storedSession string
+	sessionAttrs  map[string]interface{}
+	sessionMu     sync.RWMutex
+	statements    atomic.Int64
+	auditSink     audit.Sink
+	breakGlass    []BreakGlassPolicy
+	elevation     *elevation
+	workflow      *rbac.AccessWorkflow
+	history       map[string]bool
+	sensitive     map[string][]string
+	cipher        *encryption.Cipher
+	databaseKeys  encryption.KeyProvider
+	databaseKey   *databaseKey
 }
 
-// Open creates a new secure SQLite database connection
-func Open(dataSourceName string, authProvider auth.Provider, username, token string) (*SecureSQLite, error) {
+// Option configures a database opened with Open
+type Option func(*options)
+
+// options holds the configuration of Open
+type options struct {
+	superuser    string
+	auditSink    audit.Sink
+	breakGlass   []BreakGlassPolicy
+	workflow     *rbac.AccessWorkflow
+	history      []string
+	sensitive    map[string][]string
+	masking      *masking.Manager
+	abac         *abac.ABACManager
+	keyProvider  encryption.KeyProvider
+	encrypted    []encryption.Column
+	databaseKeys encryption.KeyProvider
+	hardened     bool
+}
+
+// WithSuperuser makes a user the superuser of an auth store that has none when
+// the database is opened. The superuser holds every system privilege and
+// bootstraps the privileges of other users. Opening fails if another user is
+// already the superuser.
+func WithSuperuser(username string) Option {
+	return func(o *options) {
+		o.superuser = username
+	}
+}
+
+// Open creates a new secure SQLite database connection. Changes to users, roles
+// and permissions made through the connection require system privileges.
+func Open(dataSourceName string, authProvider auth.Provider, username, token string, opts ...Option) (*SecureSQLite, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	// Check authentication first
 	authenticated, err := authProvider.Authenticate(username, token)
-	if err != nil {
-		return nil, &DBError{
+	if err != nil || !authenticated {
+		authErr := &DBError{
 			Code:    "AUTH_ERROR",
 			Message: "authentication failed",
 			Err:     err,
 		}
+		// The attempt fails whether or not it can be recorded
+		_ = recordAuthentication(o.auditSink, username, "", authErr)
+		return nil, authErr
 	}
-	if !authenticated {
-		return nil, &DBError{
-			Code:    "AUTH_ERROR",
-			Message: "authentication failed",
+
+	// Bootstrap the superuser
+	if o.superuser != "" {
+		if err := rbac.BootstrapSuperuser(authProvider, o.superuser); err != nil {
+			return nil, &DBError{
+				Code:    "BOOTSTRAP_ERROR",
+				Message: fmt.Sprintf("failed to bootstrap superuser: %s", o.superuser),
+				Err:     err,
+			}
+		}
+	}
+	// The cipher of encrypted columns is given to the connections of the handle
+	var cipher *encryption.Cipher
+	if o.keyProvider != nil {
+		cipher, err = encryption.NewCipher(o.keyProvider, o.encrypted...)
+		if err != nil {
+			return nil, &DBError{
+				Code:    "ENCRYPTION_ERROR",
+				Message: "failed to configure column encryption",
+				Err:     err,
+			}
+		}
+	}
+
+	var db *sql.DB
+	var dbKey *databaseKey
+	if o.databaseKeys != nil {
+		db, dbKey, err = openEncrypted(context.Background(), dataSourceName, o.databaseKeys, cipher)
+	} else {
+		db = openDB(dataSourceName, cipher, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the history table for tables whose changes are recorded
+	history := make(map[string]bool, len(o.history))
+	for _, table := range o.history {
+		history[strings.ToLower(table)] = true
+	}
+	if len(history) > 0 {
+		if err := createHistoryTable(db); err != nil {
+			db.Close()
+			return nil, &DBError{
+				Code:    "HISTORY_ERROR",
+				Message: "failed to create change history table",
+				Err:     err,
+			}
 		}
 	}
 
-	db, err := sql.Open("sqlite3", dataSourceName)
+	// The session is stored last, so that a failed open leaves none behind
+	sessionID, err := newSessionID()
 	if err != nil {
+		db.Close()
+		return nil, &DBError{
+			Code:    "SESSION_ERROR",
+			Message: "failed to create session ID",
+			Err:     err,
+		}
+	}
+	if err := recordAuthentication(o.auditSink, username, sessionID, nil); err != nil {
+		db.Close()
+		return nil, &DBError{
+			Code:    "AUDIT_ERROR",
+			Message: "failed to record authentication",
+			Err:     err,
+		}
+	}
+	if err := storeSession(authProvider, username, sessionID); err != nil {
+		db.Close()
 		return nil, err
 	}
 
-	// Initialize RBAC manager
-	rbacManager := rbac.NewRBACManager(authProvider)
+	// Initialize RBAC manager acting on behalf of the user
+	rbacManager := rbac.NewRBACManager(authProvider).As(username)
+	abacManager := o.abac
+	if abacManager == nil {
+		abacManager = abac.NewABACManager()
+	}
 
 	secureDB := &SecureSQLite{
-		SqlDB:        db,
-		authProvider: authProvider,
-		RBACManager:  rbacManager,
-		username:     username,
-		token:        token,
+		sqlDB:          db,
+		hardened:       o.hardened,
+		authProvider:   authProvider,
+		rbacManager:    rbacManager,
+		abacManager:    abacManager,
+		maskingManager: o.masking,
+		username:       username,
+		token:          token,
+		sessionID:      sessionID,
+		storedSession:  sessionID,
+		sessionAttrs:   make(map[string]interface{}),
+		auditSink:      o.auditSink,
+		breakGlass:     o.breakGlass,
+		workflow:       o.workflow,
+		history:        history,
+		sensitive:      o.sensitive,
+		cipher:         cipher,
+		databaseKeys:   o.databaseKeys,
+		databaseKey:    dbKey,
 	}
+	rbacManager.Audit = secureDB.sessionSink()
 
 	return secureDB, nil
 }
 
-// Close closes the database connection
+// Close closes the database connection. Closing a break-glass elevated handle
+// ends the elevation and leaves the connection of the original handle open.
 func (db *SecureSQLite) Close() error {
-	return db.SqlDB.Close()
+	if db.elevation != nil {
+		db.sessionMu.Lock()
+		ended := !db.elevation.notAfter.After(db.rbacManager.Now())
+		db.elevation.notAfter = db.rbacManager.Now()
+		db.sessionMu.Unlock()
+		if ended {
+			return nil
+		}
+		return db.endElevation()
+	}
+	// The connection is closed whether or not the session can be ended
+	_ = db.authProvider.TerminateSession(db.storedSession)
+	return db.sqlDB.Close()
 }
 
-// AuthProvider returns the authentication provider used by the database
-func (db *SecureSQLite) AuthProvider() auth.Provider {
-	return db.authProvider
+// SessionID returns the ID that identifies the handle's session in audit events
+func (db *SecureSQLite) SessionID() string {
+	return db.sessionID
 }
 
-// DB returns the underlying database connection
+// DB returns the underlying database connection, which bypasses every check,
+// or nil in hardened mode
 func (db *SecureSQLite) DB() *sql.DB {
-	return db.SqlDB
+	if db.hardened {
+		return nil
+	}
+	return db.sqlDB
 }
 
 // Ping checks the database connection
 func (db *SecureSQLite) Ping() error {
-	return db.SqlDB.Ping()
+	return db.sqlDB.Ping()
 }
 
 // QueryRow executes a query that returns at most one row with RBAC checks
 func (db *SecureSQLite) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.QueryRowContext(context.Background(), query, args...)
+}
+
+// QueryRowContext executes a query that returns at most one row with RBAC and ABAC checks
+func (db *SecureSQLite) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	a := db.auditStatement(operationQueryRow, query)
+	query, args, err := db.authorizeQueryRow(ctx, a, query, args)
+	var read *sensitiveRead
+	if err == nil {
+		read, _, _, err = db.sensitiveReads(ctx, a, query, args, false)
+	}
+	if err == nil {
+		err = db.authorized(ctx, a)
+	}
+	if err == nil {
+		err = db.recordUnkeyed(ctx, a, read)
+	}
+	if err != nil {
+		db.refused(ctx, a, err)
+		return db.sqlDB.QueryRow("SELECT 1 WHERE 1=0") // Return empty row that will error on Scan
+	}
+	return db.executor(ctx).QueryRowContext(ctx, query, args...)
+}
+
+// authorizeQueryRow checks a query of QueryRowContext and returns it with
+// row-level conditions applied
+func (db *SecureSQLite) authorizeQueryRow(ctx context.Context, a *statementAudit, query string, args []interface{}) (string, []interface{}, error) {
+	if err := db.checkSession(); err != nil {
+		return "", nil, err
+	}
+	if err := db.recordStatement(ctx, query); err != nil {
+		return "", nil, err
+	}
+
 	// Create parser and parse the query
 	parser := sqlparser.NewParser(db.authProvider)
 	stmt, err := parser.Parse(query)
 	if err != nil {
-		return db.SqlDB.QueryRow("SELECT 1 WHERE 1=0") // Return empty row that will error on Scan
-	}
-
-	// Extract tables and columns based on statement type
-	var tables []string
-	var columns []string
-
-	switch s := stmt.(type) {
-	case *xsqlparser.Select:
-		// Extract tables from FROM clause
-		for _, tableExpr := range s.From {
-			switch expr := tableExpr.(type) {
-			case *xsqlparser.AliasedTableExpr:
-				if tableName, ok := expr.Expr.(xsqlparser.TableName); ok {
-					tables = append(tables, tableName.Name.String())
-				}
-			}
-		}
-		// Extract columns from SELECT list
-		for _, selectExpr := range s.SelectExprs {
-			switch expr := selectExpr.(type) {
-			case *xsqlparser.AliasedExpr:
-				if colName, ok := expr.Expr.(*xsqlparser.ColName); ok {
-					columns = append(columns, colName.Name.String())
-				}
-			}
+		return "", nil, &DBError{
+			Code:    "PARSE_ERROR",
+			Message: "failed to parse query",
+			Err:     err,
 		}
 	}
 
-	// Check table-level permissions
-	for _, table := range tables {
-		hasPermission, err := db.RBACManager.HasTablePermission(db.username, table, permissions.TablePermission)
-		if err != nil || !hasPermission {
-			return db.SqlDB.QueryRow("SELECT 1 WHERE 1=0") // Return empty row that will error on Scan
-		}
+	// Check the statement against the policies and permissions of the user
+	action, err := db.getActionType(query)
+	if err != nil {
+		return "", nil, err
+	}
+	a.action = action.String()
+	_, decisions, err := db.authorizeStatement(ctx, a, action, stmt)
+	if err != nil {
+		return "", nil, err
 	}
 
-	// Check column-level permissions
-	for _, table := range tables {
-		for _, col := range columns {
-			hasPermission, err := db.RBACManager.HasColumnPermission(db.username, table, col, permissions.ColumnPermission)
-			if err != nil || !hasPermission {
-				return db.SqlDB.QueryRow("SELECT 1 WHERE 1=0") // Return empty row that will error on Scan
-			}
-		}
+	// Mask restricted columns
+	query, args, err = db.applyMasks(ctx, stmt, query, args)
+	if err != nil {
+		return "", nil, err
 	}
 
-	// Check row-level permissions
-	for _, table := range tables {
-		rowPerms, err := db.RBACManager.GetRowPermissions(db.username, table, permissions.RowPermission)
-		if err != nil {
-			return db.SqlDB.QueryRow("SELECT 1 WHERE 1=0") // Return empty row that will error on Scan
-		}
-		// Only check if row permissions are defined
-		if len(rowPerms) > 0 && !rowPerms[0].Granted {
-			return db.SqlDB.QueryRow("SELECT 1 WHERE 1=0") // Return empty row that will error on Scan
-		}
+	// Decrypt encrypted columns the user may read
+	query, args, err = db.applyEncryption(ctx, stmt, query, args)
+	if err != nil {
+		return "", nil, err
 	}
 
-	return db.SqlDB.QueryRow(query, args...)
+	// Apply row-level conditions
+	query, args, err = db.applyRowSecurity(parser, stmt, query, args, decisions)
+	if err != nil {
+		return "", nil, err
+	}
+	a.rewritten = query
+	return query, args, nil
 }
 
 // Prepare creates a prepared statement with RBAC checks
-func (db *SecureSQLite) Prepare(query string) (*sql.Stmt, error) {
+func (db *SecureSQLite) Prepare(query string) (*Stmt, error) {
+	return db.PrepareContext(context.Background(), query)
+}
+
+// PrepareContext creates a prepared statement with RBAC and ABAC checks. The
+// statement is checked again each time it is executed.
+func (db *SecureSQLite) PrepareContext(ctx context.Context, query string) (_ *Stmt, err error) {
+	a := db.auditStatement(operationPrepare, query)
+	defer func() { db.refused(ctx, a, err) }()
+	if err := db.checkSession(); err != nil {
+		return nil, err
+	}
+	if err := db.recordStatement(ctx, query); err != nil {
+		return nil, err
+	}
+
 	// Create parser and parse the query
 	parser := sqlparser.NewParser(db.authProvider)
 	stmt, err := parser.Parse(query)
@@ -177,110 +369,66 @@ func (db *SecureSQLite) Prepare(query string) (*sql.Stmt, error) {
 		}
 	}
 
-	// Extract tables and columns based on statement type
-	var tables []string
-	var columns []string
-
-	switch s := stmt.(type) {
-	case *xsqlparser.Select:
-		// Extract tables from FROM clause
-		for _, tableExpr := range s.From {
-			switch expr := tableExpr.(type) {
-			case *xsqlparser.AliasedTableExpr:
-				if tableName, ok := expr.Expr.(xsqlparser.TableName); ok {
-					tables = append(tables, tableName.Name.String())
-				}
-			}
-		}
-		// Extract columns from SELECT list
-		for _, selectExpr := range s.SelectExprs {
-			switch expr := selectExpr.(type) {
-			case *xsqlparser.AliasedExpr:
-				if colName, ok := expr.Expr.(*xsqlparser.ColName); ok {
-					columns = append(columns, colName.Name.String())
-				}
-			}
-		}
-	case *xsqlparser.Insert:
-		tables = append(tables, s.Table.Name.String())
-		for _, col := range s.Columns {
-			columns = append(columns, col.String())
-		}
-	case *xsqlparser.Update:
-		if tableName, ok := s.TableExprs[0].(*xsqlparser.AliasedTableExpr).Expr.(xsqlparser.TableName); ok {
-			tables = append(tables, tableName.Name.String())
-		}
-		for _, expr := range s.Exprs {
-			columns = append(columns, expr.Name.Name.String())
-		}
-	case *xsqlparser.Delete:
-		if tableName, ok := s.TableExprs[0].(*xsqlparser.AliasedTableExpr).Expr.(xsqlparser.TableName); ok {
-			tables = append(tables, tableName.Name.String())
-		}
+	// Get the action type
+	action, err := db.getActionType(query)
+	if err != nil {
+		return nil, err
 	}
+	a.action = action.String()
 
-	// Check table-level permissions
-	for _, table := range tables {
-		hasPermission, err := db.RBACManager.HasTablePermission(db.username, table, permissions.TablePermission)
-		if err != nil {
-			return nil, &DBError{
-				Code:    "PERMISSION_ERROR",
-				Message: fmt.Sprintf("failed to check table permission: %s", table),
-				Err:     err,
-			}
-		}
-		if !hasPermission {
-			return nil, &DBError{
-				Code:    "PERMISSION_DENIED",
-				Message: fmt.Sprintf("permission denied for table: %s", table),
-			}
+	// Schema changes run unchanged, as in Exec
+	if _, ok := stmt.(*xsqlparser.DDL); ok {
+		if err := db.authorized(ctx, a); err != nil {
+			return nil, err
 		}
+		return &Stmt{db: db, query: query}, nil
 	}
 
-	// Check column-level permissions
-	for _, table := range tables {
-		for _, col := range columns {
-			hasPermission, err := db.RBACManager.HasColumnPermission(db.username, table, col, permissions.ColumnPermission)
-			if err != nil {
-				return nil, &DBError{
-					Code:    "PERMISSION_ERROR",
-					Message: fmt.Sprintf("failed to check column permission: %s.%s", table, col),
-					Err:     err,
-				}
-			}
-			if !hasPermission {
-				return nil, &DBError{
-					Code:    "PERMISSION_DENIED",
-					Message: fmt.Sprintf("permission denied for column: %s.%s", table, col),
-				}
-			}
-		}
+	// Check the statement against the policies and permissions of the user
+	_, decisions, err := db.authorizeStatement(ctx, a, action, stmt)
+	if err != nil {
+		return nil, err
 	}
 
-	// Check row-level permissions
-	for _, table := range tables {
-		rowPerms, err := db.RBACManager.GetRowPermissions(db.username, table, permissions.RowPermission)
-		if err != nil {
-			return nil, &DBError{
-				Code:    "PERMISSION_ERROR",
-				Message: fmt.Sprintf("failed to check row permissions: %s", table),
-				Err:     err,
-			}
-		}
-		if len(rowPerms) > 0 && !rowPerms[0].Granted {
-			return nil, &DBError{
-				Code:    "PERMISSION_DENIED",
-				Message: fmt.Sprintf("permission denied for rows in table: %s", table),
-			}
-		}
+	// Rewrite the statement as it would run now, so that SQLite reports
+	// errors in it when it is prepared
+	rewritten, _, err := db.applyMasks(ctx, stmt, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	rewritten, _, err = db.applyEncryption(ctx, stmt, rewritten, nil)
+	if err != nil {
+		return nil, err
+	}
+	rewritten, _, err = db.applyRowSecurity(parser, stmt, rewritten, nil, decisions)
+	if err != nil {
+		return nil, err
+	}
+	a.rewritten = rewritten
+	prepared, err := db.executor(ctx).PrepareContext(ctx, rewritten)
+	if err != nil {
+		return nil, err
+	}
+	prepared.Close()
+	if err := db.authorized(ctx, a); err != nil {
+		return nil, err
 	}
 
-	return db.SqlDB.Prepare(query)
+	// Session values, grants and policies may change before the statement
+	// runs, so it is rewritten each time it is executed
+	return &Stmt{db: db, query: query}, nil
 }
 
-// Begin starts a transaction with RBAC checks
+// Begin starts a transaction on the underlying connection. Like DB, it is an
+// escape hatch: the statements of the transaction bypass every check. Checked
+// transactions run through the database/sql driver, see NewConnector. Hardened
+// handles refuse it.
 func (db *SecureSQLite) Begin() (*sql.Tx, error) {
-	// For transactions, we don't need to check permissions at the start
-	// because each operation within the transaction will be checked individually
-	return db.SqlDB.Begin()
+	if db.hardened {
+		return nil, &DBError{
+			Code:    "PERMISSION_DENIED",
+			Message: "transactions of hardened handles bypass checks; use the database/sql driver",
+		}
+	}
+	return db.sqlDB.Begin()
 }
@@ -0,0 +1,102 @@
+package secure_sqlite
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/wemcdonald/secure_sqlite/pkg/encryption"
+	"github.com/wemcdonald/secure_sqlite/pkg/masking"
+	"github.com/wemcdonald/secure_sqlite/pkg/sqlparser"
+)
+
+// errNoCipher is returned by the encryption functions of connections of a
+// handle without column encryption
+var errNoCipher = errors.New("column encryption is not configured")
+
+func init() {
+	sql.Register(DriverName, &Driver{})
+}
+
+// connector opens the connections of a handle
+type connector struct {
+	dsn    string
+	key    *databaseKey
+	driver *sqlite3.SQLiteDriver
+}
+
+// Connect opens a connection, keyed with the key of an encrypted database
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	if c.key == nil {
+		return c.driver.Open(c.dsn)
+	}
+	conn, err := c.driver.Open(c.key.dataSourceName(c.dsn))
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrNotADB {
+		return nil, errWrongKey
+	}
+	return conn, err
+}
+
+// Driver returns the driver of the connector
+func (c *connector) Driver() driver.Driver {
+	return c.driver
+}
+
+// openDB opens the connection pool of a handle. Its connections provide the
+// functions that rewritten statements call, encrypting and decrypting with
+// the column cipher of the handle, and are keyed with the key of an encrypted
+// database.
+func openDB(dataSourceName string, cipher *encryption.Cipher, key *databaseKey) *sql.DB {
+	return sql.OpenDB(&connector{
+		dsn: dataSourceName,
+		key: key,
+		driver: &sqlite3.SQLiteDriver{
+			ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+				if key != nil {
+					if err := key.check(conn); err != nil {
+						return err
+					}
+				}
+				return registerFunctions(conn, cipher)
+			},
+		},
+	})
+}
+
+// registerFunctions registers the functions that rewritten statements call on
+// a new connection. Without a cipher the encryption functions fail.
+func registerFunctions(conn *sqlite3.SQLiteConn, cipher *encryption.Cipher) error {
+	if err := conn.RegisterFunc(sqlparser.MaskFunc, func(mask string, value interface{}) (interface{}, error) {
+		return masking.Mask(mask).Apply(sqlValue(value))
+	}, true); err != nil {
+		return err
+	}
+	// Encryption is not pure, since randomized encryption yields a different
+	// ciphertext on each call
+	if err := conn.RegisterFunc(sqlparser.EncryptFunc, func(table, column string, value interface{}) (interface{}, error) {
+		if cipher == nil {
+			return nil, errNoCipher
+		}
+		return cipher.Encrypt(context.Background(), table, column, sqlValue(value))
+	}, false); err != nil {
+		return err
+	}
+	return conn.RegisterFunc(sqlparser.DecryptFunc, func(table, column string, value interface{}) (interface{}, error) {
+		if cipher == nil {
+			return nil, errNoCipher
+		}
+		return cipher.Decrypt(context.Background(), table, column, sqlValue(value))
+	}, true)
+}
+
+// sqlValue converts an argument of a function to its value. The driver passes
+// NULL as a nil byte slice.
+func sqlValue(value interface{}) interface{} {
+	if b, ok := value.([]byte); ok && b == nil {
+		return nil
+	}
+	return value
+}
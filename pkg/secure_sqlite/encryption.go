@@ -0,0 +1,220 @@
+package secure_sqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/encryption"
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+	"github.com/wemcdonald/secure_sqlite/pkg/sqlparser"
+	xsqlparser "github.com/xwb1989/sqlparser"
+)
+
+// WithColumnEncryption encrypts columns with AES-GCM under keys of a key
+// provider. Values written through the handle are encrypted, and values read
+// through it are decrypted for users with the decrypt privilege on the table;
+// other users read the ciphertext.
+func WithColumnEncryption(provider encryption.KeyProvider, columns ...encryption.Column) Option {
+	return func(o *options) {
+		o.keyProvider = provider
+		o.encrypted = append(o.encrypted, columns...)
+	}
+}
+
+// applyEncryption rewrites a statement so that it encrypts the values it
+// writes to encrypted columns and decrypts the values it returns if the user
+// may decrypt them. It returns the query and arguments to execute, which are
+// the originals when the statement does not touch encrypted columns.
+func (db *SecureSQLite) applyEncryption(ctx context.Context, stmt xsqlparser.Statement, query string, args []interface{}) (string, []interface{}, error) {
+	if db.cipher == nil {
+		return query, args, nil
+	}
+
+	// Check the decrypt privilege once per table
+	decrypt := make(map[string]bool)
+	var privilegeErr error
+	encrypted := func(table, column string) (sqlparser.EncryptedColumn, bool) {
+		col, ok := db.cipher.Column(table, column)
+		if !ok {
+			return sqlparser.EncryptedColumn{}, false
+		}
+		key := strings.ToLower(table)
+		allowed, checked := decrypt[key]
+		if !checked {
+			var err error
+			allowed, err = db.rbacManager.HasPrivilege(db.username, permissions.Decrypt, table)
+			if err != nil && privilegeErr == nil {
+				privilegeErr = err
+			}
+			decrypt[key] = allowed
+		}
+		return sqlparser.EncryptedColumn{Deterministic: col.Deterministic, Decrypt: allowed}, true
+	}
+
+	changed, err := sqlparser.ApplyEncryption(stmt, encrypted, func(table string) ([]string, error) {
+		return tableColumns(ctx, db.executor(ctx), table)
+	})
+	if err == nil {
+		err = privilegeErr
+	}
+	if errors.Is(err, sqlparser.ErrEncryptedCondition) {
+		return "", nil, &DBError{
+			Code:    "ENCRYPTION_ERROR",
+			Message: "encrypted columns can only be compared for equality, and only if deterministic",
+			Err:     err,
+		}
+	}
+	if err != nil {
+		return "", nil, &DBError{
+			Code:    "ENCRYPTION_ERROR",
+			Message: "failed to apply column encryption",
+			Err:     err,
+		}
+	}
+	if !changed {
+		return query, args, nil
+	}
+
+	// The rewritten query uses named placeholders, so bind everything by name
+	return xsqlparser.String(stmt), sqlparser.BindStatementArgs(args), nil
+}
+
+// ReencryptTable re-encrypts the values of the encrypted columns of a table
+// that are not encrypted with the current key of the key provider, such as
+// values written before a key rotation or before the column was encrypted,
+// and returns the number of rows changed. It requires the decrypt privilege
+// on the table. Deterministic columns only match lookups for values encrypted
+// with the current key, so tables should be re-encrypted after each rotation.
+func (db *SecureSQLite) ReencryptTable(ctx context.Context, table string) (_ int64, err error) {
+	var columns []string
+	if db.cipher != nil {
+		for _, column := range db.cipher.Columns(table) {
+			columns = append(columns, column.Name)
+		}
+	}
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = xsqlparser.String(xsqlparser.NewColIdent(column))
+	}
+	query := fmt.Sprintf("SELECT rowid, %s FROM %s", strings.Join(quoted, ", "), xsqlparser.String(xsqlparser.NewTableIdent(table)))
+	a := db.auditStatement(operationReencrypt, query)
+	a.action = permissions.Update.String()
+	a.tables, a.columns = []string{table}, columns
+	a.rule = fmt.Sprintf("%s on %s", permissions.Decrypt, table)
+	defer func() { db.refused(ctx, a, err) }()
+
+	if len(columns) == 0 {
+		return 0, &DBError{
+			Code:    "ENCRYPTION_ERROR",
+			Message: fmt.Sprintf("table has no encrypted columns: %s", table),
+		}
+	}
+
+	// Check the privilege
+	ok, err := db.rbacManager.HasPrivilege(db.username, permissions.Decrypt, table)
+	if err != nil {
+		return 0, &DBError{
+			Code:    "PERMISSION_ERROR",
+			Message: fmt.Sprintf("failed to check privilege on table: %s", table),
+			Err:     err,
+		}
+	}
+	if !ok {
+		return 0, &DBError{
+			Code:    "PERMISSION_DENIED",
+			Message: fmt.Sprintf("permission denied to decrypt table: %s", table),
+		}
+	}
+	if err := db.authorized(ctx, a); err != nil {
+		return 0, err
+	}
+
+	encryptionErr := func(err error) error {
+		return &DBError{
+			Code:    "ENCRYPTION_ERROR",
+			Message: fmt.Sprintf("failed to re-encrypt table: %s", table),
+			Err:     err,
+		}
+	}
+	current, err := db.cipher.CurrentKeyID(ctx)
+	if err != nil {
+		return 0, encryptionErr(err)
+	}
+	tx, err := db.beginTx(ctx)
+	if err != nil {
+		return 0, &DBError{
+			Code:    "TRANSACTION_ERROR",
+			Message: "failed to begin transaction",
+			Err:     err,
+		}
+	}
+	defer tx.Rollback()
+
+	// Read the rows first, then update the values that need it
+	type update struct {
+		rowID  int64
+		values []interface{}
+	}
+	var updates []update
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return 0, encryptionErr(err)
+	}
+	for rows.Next() {
+		var rowID int64
+		values := make([]interface{}, len(columns))
+		dest := []interface{}{&rowID}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return 0, encryptionErr(err)
+		}
+		stale := false
+		for _, value := range values {
+			if id, ok := encryption.KeyID(value); value != nil && (!ok || id != current) {
+				stale = true
+			}
+		}
+		if stale {
+			updates = append(updates, update{rowID: rowID, values: values})
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return 0, encryptionErr(err)
+	}
+
+	assignments := make([]string, len(columns))
+	for i := range quoted {
+		assignments[i] = quoted[i] + " = ?"
+	}
+	statement := fmt.Sprintf("UPDATE %s SET %s WHERE rowid = ?", xsqlparser.String(xsqlparser.NewTableIdent(table)), strings.Join(assignments, ", "))
+	for _, u := range updates {
+		args := make([]interface{}, 0, len(columns)+1)
+		for i, value := range u.values {
+			plaintext, err := db.cipher.Decrypt(ctx, table, columns[i], value)
+			if err != nil {
+				return 0, encryptionErr(err)
+			}
+			ciphertext, err := db.cipher.Encrypt(ctx, table, columns[i], plaintext)
+			if err != nil {
+				return 0, encryptionErr(err)
+			}
+			args = append(args, ciphertext)
+		}
+		if _, err := tx.ExecContext(ctx, statement, append(args, u.rowID)...); err != nil {
+			return 0, encryptionErr(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, &DBError{
+			Code:    "TRANSACTION_ERROR",
+			Message: "failed to commit transaction",
+			Err:     err,
+		}
+	}
+	return int64(len(updates)), nil
+}
@@ -0,0 +1,115 @@
+package secure_sqlite
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// executor runs the statements of a handle
+type executor interface {
+	queryer
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
+
+// transaction is a transaction a handle runs a statement in
+type transaction interface {
+	executor
+	Commit() error
+	Rollback() error
+}
+
+// pinnedConn is a connection of a handle pinned for a transaction of a
+// connection of the database/sql driver, so that its statements run in it
+type pinnedConn struct {
+	handle *SecureSQLite
+	conn   *sql.Conn
+	tx     *sql.Tx
+	mu     sync.Mutex
+}
+
+// pinnedKey is the context key of the pinned connection of statements
+type pinnedKey struct{}
+
+// withPinned returns a context whose statements on the handle of a pinned
+// connection run in it
+func withPinned(ctx context.Context, pinned *pinnedConn) context.Context {
+	return context.WithValue(ctx, pinnedKey{}, pinned)
+}
+
+// pinned returns the connection of the handle that a statement is pinned to,
+// or nil
+func (db *SecureSQLite) pinned(ctx context.Context) *pinnedConn {
+	if pinned, ok := ctx.Value(pinnedKey{}).(*pinnedConn); ok && pinned.handle == db {
+		return pinned
+	}
+	return nil
+}
+
+// executor returns what runs a statement of the handle: the transaction or
+// connection it is pinned to, or the connection pool of the handle
+func (db *SecureSQLite) executor(ctx context.Context) executor {
+	pinned := db.pinned(ctx)
+	if pinned == nil {
+		return db.sqlDB
+	}
+	pinned.mu.Lock()
+	defer pinned.mu.Unlock()
+	if pinned.tx != nil {
+		return pinned.tx
+	}
+	return pinned.conn
+}
+
+// beginTx starts a transaction for a statement. Within the transaction of a
+// pinned connection, it starts a savepoint instead.
+func (db *SecureSQLite) beginTx(ctx context.Context) (transaction, error) {
+	pinned := db.pinned(ctx)
+	if pinned == nil {
+		return db.sqlDB.BeginTx(ctx, nil)
+	}
+	pinned.mu.Lock()
+	defer pinned.mu.Unlock()
+	if pinned.tx == nil {
+		return pinned.conn.BeginTx(ctx, nil)
+	}
+	if _, err := pinned.tx.ExecContext(ctx, "SAVEPOINT "+savepointName); err != nil {
+		return nil, err
+	}
+	return &savepoint{Tx: pinned.tx, ctx: ctx}, nil
+}
+
+// savepointName names the savepoints of statements in transactions
+const savepointName = "secure_sqlite_statement"
+
+// savepoint is a transaction nested in the transaction of a pinned connection
+type savepoint struct {
+	*sql.Tx
+	ctx  context.Context
+	done bool
+}
+
+// Commit releases the savepoint, keeping its changes in the transaction
+func (s *savepoint) Commit() error {
+	if s.done {
+		return sql.ErrTxDone
+	}
+	s.done = true
+	_, err := s.Tx.ExecContext(s.ctx, "RELEASE "+savepointName)
+	return err
+}
+
+// Rollback undoes the changes made since the savepoint and releases it
+func (s *savepoint) Rollback() error {
+	if s.done {
+		return sql.ErrTxDone
+	}
+	s.done = true
+	if _, err := s.Tx.ExecContext(s.ctx, "ROLLBACK TO "+savepointName); err != nil {
+		return err
+	}
+	_, err := s.Tx.ExecContext(s.ctx, "RELEASE "+savepointName)
+	return err
+}
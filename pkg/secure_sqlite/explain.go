@@ -0,0 +1,268 @@
+package secure_sqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/abac"
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+	"github.com/wemcdonald/secure_sqlite/pkg/sqlparser"
+	xsqlparser "github.com/xwb1989/sqlparser"
+)
+
+// Kinds of access checks
+const (
+	CheckPolicy    = "policy"
+	CheckTable     = "table"
+	CheckColumn    = "column"
+	CheckRow       = "row"
+	CheckPrivilege = "privilege"
+	CheckRewrite   = "rewrite"
+)
+
+// AccessCheck is a check of a statement and its outcome
+type AccessCheck struct {
+	// Check is the kind of check, such as CheckTable
+	Check string
+	// Target is the checked table or column, as table.column
+	Target  string
+	Allowed bool
+	// Detail explains the outcome, such as the deciding policy
+	Detail string
+}
+
+// AccessExplanation describes how the checks of a handle treat a statement
+type AccessExplanation struct {
+	Action  string
+	Tables  []string
+	Columns []string
+	Checks  []AccessCheck
+	// Err is the first error that refuses the statement, nil if it is allowed
+	Err error
+	// Rewritten is the statement as it would run, with masks, encryption and
+	// row conditions applied, if it is allowed
+	Rewritten string
+}
+
+// Allowed reports whether the checks allow the statement
+func (e *AccessExplanation) Allowed() bool {
+	return e.Err == nil
+}
+
+// deny records a refused check
+func (e *AccessExplanation) deny(check, target string, err error) {
+	detail := err.Error()
+	var dbErr *DBError
+	if errors.As(err, &dbErr) {
+		detail = dbErr.Message
+	}
+	e.Checks = append(e.Checks, AccessCheck{Check: check, Target: target, Detail: detail})
+	if e.Err == nil {
+		e.Err = err
+	}
+}
+
+// allow records a passed check
+func (e *AccessExplanation) allow(check, target, detail string) {
+	e.Checks = append(e.Checks, AccessCheck{Check: check, Target: target, Allowed: true, Detail: detail})
+}
+
+// ExplainAccess runs the checks of a statement without executing it, and
+// describes the outcome of each check and the statement as it would run.
+// Unlike Query and Exec it goes on after a refused check, so that every
+// missing permission is reported. Errors that keep the statement from being
+// checked, such as parse errors, are returned.
+func (db *SecureSQLite) ExplainAccess(ctx context.Context, query string, args ...interface{}) (*AccessExplanation, error) {
+	e := &AccessExplanation{}
+
+	// Access control statements are authorized as they are applied
+	if sqlparser.IsAccessStatement(query) {
+		e.Action = "ACCESS CONTROL"
+		e.allow(CheckPrivilege, "", "checked against the system privileges of the user when applied")
+		e.Rewritten = query
+		return e, nil
+	}
+
+	action, err := db.getActionType(query)
+	if err != nil {
+		return nil, err
+	}
+	e.Action = action.String()
+	parser := sqlparser.NewParser(db.authProvider)
+	stmt, err := parser.Parse(query)
+	if err != nil {
+		return nil, &DBError{
+			Code:    "PARSE_ERROR",
+			Message: "failed to parse query",
+			Err:     err,
+		}
+	}
+	if _, ok := stmt.(*xsqlparser.DDL); ok {
+		e.allow(CheckTable, "", "schema changes are not checked by table")
+		e.Rewritten = query
+		return e, nil
+	}
+	tables, columns, err := db.statementTargets(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	e.Tables, e.Columns = tables, columnNames(tables, columns)
+
+	// Evaluate attribute-based policies
+	decisions, err := db.evaluatePolicies(ctx, action, tables, columns)
+	var dbErr *DBError
+	if errors.As(err, &dbErr) && dbErr.Code == "PERMISSION_DENIED" {
+		e.deny(CheckPolicy, "", err)
+		return e, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, table := range e.Tables {
+		if decision, ok := decisions[table]; ok && decision.Result == abac.Permit {
+			detail := "permitted by policy " + decision.Policy
+			if decision.RowFilter != "" {
+				detail += " for rows where " + decision.RowFilter
+			}
+			e.allow(CheckPolicy, table, detail)
+		}
+	}
+
+	// Check the permissions of the tables the policies do not permit
+	permissionType := db.getPermissionType(action)
+	checkColumns := action == permissions.Select || action == permissions.Insert || action == permissions.Update
+	for _, table := range e.Tables {
+		if decisions.permits(table) {
+			continue
+		}
+		hasPermission, err := db.rbacManager.HasTablePermission(db.username, table, permissionType)
+		if err != nil {
+			return nil, &DBError{
+				Code:    "PERMISSION_ERROR",
+				Message: fmt.Sprintf("failed to check table permission: %s", table),
+				Err:     err,
+			}
+		}
+		if hasPermission {
+			e.allow(CheckTable, table, "table permission granted")
+		} else {
+			e.deny(CheckTable, table, &DBError{
+				Code:    "PERMISSION_DENIED",
+				Message: fmt.Sprintf("permission denied for table: %s", table),
+			})
+		}
+
+		if checkColumns {
+			for _, col := range columns[strings.ToLower(table)] {
+				target := table + "." + col
+				hasPermission, err := db.rbacManager.HasColumnPermission(db.username, table, col, permissionType)
+				if err != nil {
+					return nil, &DBError{
+						Code:    "PERMISSION_ERROR",
+						Message: fmt.Sprintf("failed to check column permission: %s", target),
+						Err:     err,
+					}
+				}
+				if hasPermission {
+					e.allow(CheckColumn, target, "column permission granted")
+				} else {
+					e.deny(CheckColumn, target, &DBError{
+						Code:    "PERMISSION_DENIED",
+						Message: fmt.Sprintf("permission denied for column: %s", target),
+					})
+				}
+			}
+		}
+
+		rowPerms, err := db.rbacManager.GetRowPermissions(db.username, table, permissionType)
+		if err != nil {
+			return nil, &DBError{
+				Code:    "PERMISSION_ERROR",
+				Message: fmt.Sprintf("failed to check row permissions: %s", table),
+				Err:     err,
+			}
+		}
+		if len(rowPerms) > 0 && !rowPerms[0].Granted {
+			e.deny(CheckRow, table, &DBError{
+				Code:    "PERMISSION_DENIED",
+				Message: fmt.Sprintf("permission denied for rows in table: %s", table),
+			})
+		} else {
+			e.allow(CheckRow, table, "row permission granted")
+		}
+	}
+	if e.Err != nil {
+		return e, nil
+	}
+
+	// Rewrite the statement as it would run
+	query, args, err = db.applyMasks(ctx, stmt, query, args)
+	if err == nil {
+		query, args, err = db.applyEncryption(ctx, stmt, query, args)
+	}
+	if err == nil {
+		query, _, err = db.applyRowSecurity(parser, stmt, query, args, decisions)
+	}
+	if err != nil {
+		e.deny(CheckRewrite, "", err)
+		return e, nil
+	}
+	e.Rewritten = query
+	return e, nil
+}
+
+// VisibleTables lists the tables the user may select from, through a policy
+// or a table permission, in name order
+func (db *SecureSQLite) VisibleTables(ctx context.Context) ([]string, error) {
+	rows, err := db.executor(ctx).QueryContext(ctx,
+		"SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name")
+	if err != nil {
+		return nil, &DBError{
+			Code:    "QUERY_ERROR",
+			Message: "failed to list tables",
+			Err:     err,
+		}
+	}
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var visible []string
+	for _, table := range tables {
+		decisions, err := db.evaluatePolicies(ctx, permissions.Select, []string{table}, nil)
+		if err != nil {
+			var dbErr *DBError
+			if errors.As(err, &dbErr) && dbErr.Code == "PERMISSION_DENIED" {
+				continue
+			}
+			return nil, err
+		}
+		if decisions.permits(table) {
+			visible = append(visible, table)
+			continue
+		}
+		hasPermission, err := db.rbacManager.HasTablePermission(db.username, table, permissions.TablePermission)
+		if err != nil {
+			return nil, &DBError{
+				Code:    "PERMISSION_ERROR",
+				Message: fmt.Sprintf("failed to check table permission: %s", table),
+				Err:     err,
+			}
+		}
+		if hasPermission {
+			visible = append(visible, table)
+		}
+	}
+	return visible, nil
+}
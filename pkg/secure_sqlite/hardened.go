@@ -0,0 +1,48 @@
+package secure_sqlite
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+)
+
+// WithHardened opens the database in hardened mode, where the underlying
+// connection is not exposed through DB or Begin. Code that needs it
+// must call Unsafe, which requires the raw access privilege and is audited.
+func WithHardened() Option {
+	return func(o *options) {
+		o.hardened = true
+	}
+}
+
+// Unsafe returns the underlying connection, which bypasses every check. It
+// requires the raw access privilege, an audit sink and a reason, which is
+// recorded in the audit log.
+func (db *SecureSQLite) Unsafe(ctx context.Context, reason string) (_ *sql.DB, err error) {
+	a := db.auditStatement(operationUnsafe, "")
+	a.rule = permissions.RawAccess.String()
+	a.detail = reason
+	defer func() { db.refused(ctx, a, err) }()
+
+	if db.auditSink == nil {
+		return nil, &DBError{
+			Code:    "UNSAFE_ERROR",
+			Message: "raw access requires an audit sink",
+		}
+	}
+	if strings.TrimSpace(reason) == "" {
+		return nil, &DBError{
+			Code:    "UNSAFE_ERROR",
+			Message: "raw access requires a reason",
+		}
+	}
+	if err := db.rbacManager.Authorize(permissions.RawAccess, ""); err != nil {
+		return nil, privilegeError(err)
+	}
+	if err := db.authorized(ctx, a); err != nil {
+		return nil, err
+	}
+	return db.sqlDB, nil
+}
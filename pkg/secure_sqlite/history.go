@@ -0,0 +1,286 @@
+package secure_sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+	"github.com/wemcdonald/secure_sqlite/pkg/sqlparser"
+	xsqlparser "github.com/xwb1989/sqlparser"
+)
+
+// historyTable is the table that holds the change history of tables
+const historyTable = "secure_sqlite_history"
+
+// historySchema creates the history table. Triggers refuse updates and
+// deletes, so recorded changes cannot be altered through SQL.
+var historySchema = []string{
+	`CREATE TABLE IF NOT EXISTS ` + historyTable + ` (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		statement_id TEXT NOT NULL,
+		time TEXT NOT NULL,
+		principal TEXT NOT NULL,
+		session_id TEXT NOT NULL,
+		table_name TEXT NOT NULL,
+		row_id INTEGER NOT NULL,
+		operation TEXT NOT NULL,
+		before_image TEXT,
+		after_image TEXT
+	)`,
+	`CREATE INDEX IF NOT EXISTS ` + historyTable + `_row ON ` + historyTable + ` (table_name COLLATE NOCASE, row_id)`,
+	`CREATE TRIGGER IF NOT EXISTS ` + historyTable + `_no_update BEFORE UPDATE ON ` + historyTable + `
+		BEGIN SELECT RAISE(ABORT, 'change history is append-only'); END`,
+	`CREATE TRIGGER IF NOT EXISTS ` + historyTable + `_no_delete BEFORE DELETE ON ` + historyTable + `
+		BEGIN SELECT RAISE(ABORT, 'change history is append-only'); END`,
+}
+
+// WithChangeHistory records the rows that UPDATE and DELETE statements change
+// in the given tables, as they were before and after each statement. Changes
+// are only recorded for statements executed through handles opened with the
+// option.
+func WithChangeHistory(tables ...string) Option {
+	return func(o *options) {
+		o.history = append(o.history, tables...)
+	}
+}
+
+// RowChange is a recorded change to a row
+type RowChange struct {
+	ID int64
+	// StatementID identifies the statement in the audit log
+	StatementID string
+	Time        time.Time
+	Principal   string
+	SessionID   string
+	Table       string
+	RowID       int64
+	// Operation is the action of the statement, update or delete
+	Operation string
+	// Before and After map the columns of the row to their values; After is
+	// nil for deleted rows
+	Before map[string]interface{}
+	After  map[string]interface{}
+}
+
+// rowImage is a row as it is before or after a statement changes it
+type rowImage struct {
+	rowID  int64
+	values map[string]interface{}
+}
+
+// createHistoryTable creates the history table if needed
+func createHistoryTable(db *sql.DB) error {
+	for _, statement := range historySchema {
+		if _, err := db.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordsHistory checks if the change history of the table a statement
+// writes is recorded
+func (db *SecureSQLite) recordsHistory(action permissions.Action, tables []string) bool {
+	if action != permissions.Update && action != permissions.Delete || len(tables) != 1 {
+		return false
+	}
+	return db.history[strings.ToLower(tables[0])]
+}
+
+// beforeImages reads the rows an UPDATE or DELETE statement is about to change
+func beforeImages(ctx context.Context, tx executor, stmt xsqlparser.Statement, args []interface{}) (string, []rowImage, error) {
+	table, query, imageArgs, err := sqlparser.BuildImageQuery(stmt, args)
+	if err != nil {
+		return "", nil, err
+	}
+	images, err := readImages(ctx, tx, query, imageArgs...)
+	return table, images, err
+}
+
+// readImages reads rows selected together with their rowid
+func readImages(ctx context.Context, tx executor, query string, args ...interface{}) ([]rowImage, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var images []rowImage
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		rowID, ok := values[0].(int64)
+		if !ok {
+			return nil, fmt.Errorf("table has no rowid")
+		}
+		image := rowImage{rowID: rowID, values: make(map[string]interface{}, len(columns)-1)}
+		for i, column := range columns[1:] {
+			image.values[column] = values[i+1]
+		}
+		images = append(images, image)
+	}
+	return images, rows.Err()
+}
+
+// recordHistory records the changes a statement made to rows of a table,
+// given the rows as they were before it. Rows are matched by rowid, so the
+// after image of a row whose rowid the statement changed is not recorded.
+func (db *SecureSQLite) recordHistory(ctx context.Context, tx executor, a *statementAudit, table string, before []rowImage) error {
+	if len(before) == 0 {
+		return nil
+	}
+
+	// Read the rows as they are after an UPDATE
+	after := make(map[int64]map[string]interface{})
+	if a.action == permissions.Update.String() {
+		rowIDs := make([]int64, len(before))
+		for i, image := range before {
+			rowIDs[i] = image.rowID
+		}
+		ids, err := json.Marshal(rowIDs)
+		if err != nil {
+			return err
+		}
+		images, err := readImages(ctx, tx, fmt.Sprintf("SELECT rowid, * FROM %s WHERE rowid IN (SELECT value FROM json_each(?))",
+			xsqlparser.String(xsqlparser.NewTableIdent(table))), string(ids))
+		if err != nil {
+			return err
+		}
+		for _, image := range images {
+			after[image.rowID] = image.values
+		}
+	}
+
+	now := db.rbacManager.Now().UTC().Format(time.RFC3339Nano)
+	for _, image := range before {
+		beforeJSON, err := json.Marshal(image.values)
+		if err != nil {
+			return err
+		}
+		var afterJSON interface{}
+		if values, ok := after[image.rowID]; ok {
+			encoded, err := json.Marshal(values)
+			if err != nil {
+				return err
+			}
+			afterJSON = string(encoded)
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO `+historyTable+`
+			(statement_id, time, principal, session_id, table_name, row_id, operation, before_image, after_image)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			a.id, now, db.username, db.sessionID, table, image.rowID, a.action, string(beforeJSON), afterJSON)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RowHistory returns the recorded changes to a row, oldest first. Reading the
+// history of a table requires the grant_table privilege on it, since the
+// history shows values that row-level security may hide.
+func (db *SecureSQLite) RowHistory(ctx context.Context, table string, rowID int64) (_ []RowChange, err error) {
+	query := `SELECT id, statement_id, time, principal, session_id, table_name, row_id, operation, before_image, after_image
+		FROM ` + historyTable + ` WHERE table_name = ? COLLATE NOCASE AND row_id = ? ORDER BY id`
+	a := db.auditStatement(operationHistory, query)
+	a.action = permissions.Select.String()
+	a.tables = []string{table}
+	a.rule = fmt.Sprintf("%s on %s", permissions.GrantTable, table)
+	defer func() { db.refused(ctx, a, err) }()
+
+	// Check the privilege
+	ok, err := db.rbacManager.HasPrivilege(db.username, permissions.GrantTable, table)
+	if err != nil {
+		return nil, &DBError{
+			Code:    "PERMISSION_ERROR",
+			Message: fmt.Sprintf("failed to check privilege on table: %s", table),
+			Err:     err,
+		}
+	}
+	if !ok {
+		return nil, &DBError{
+			Code:    "PERMISSION_DENIED",
+			Message: fmt.Sprintf("permission denied for history of table: %s", table),
+		}
+	}
+	if err := db.authorized(ctx, a); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.executor(ctx).QueryContext(ctx, query, table, rowID)
+	if err != nil {
+		return nil, &DBError{
+			Code:    "QUERY_ERROR",
+			Message: "failed to read change history",
+			Err:     err,
+		}
+	}
+	defer rows.Close()
+
+	var changes []RowChange
+	for rows.Next() {
+		var change RowChange
+		var changeTime string
+		var before, after sql.NullString
+		if err := rows.Scan(&change.ID, &change.StatementID, &changeTime, &change.Principal, &change.SessionID,
+			&change.Table, &change.RowID, &change.Operation, &before, &after); err != nil {
+			return nil, &DBError{
+				Code:    "QUERY_ERROR",
+				Message: "failed to read change history",
+				Err:     err,
+			}
+		}
+		change.Time, err = time.Parse(time.RFC3339Nano, changeTime)
+		if err == nil {
+			change.Before, err = decodeImage(before)
+		}
+		if err == nil {
+			change.After, err = decodeImage(after)
+		}
+		if err != nil {
+			return nil, &DBError{
+				Code:    "HISTORY_ERROR",
+				Message: fmt.Sprintf("malformed change history entry: %d", change.ID),
+				Err:     err,
+			}
+		}
+		changes = append(changes, change)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &DBError{
+			Code:    "QUERY_ERROR",
+			Message: "failed to read change history",
+			Err:     err,
+		}
+	}
+	return changes, nil
+}
+
+// decodeImage decodes a recorded row image. Numbers are decoded as
+// json.Number so that integers keep their precision.
+func decodeImage(image sql.NullString) (map[string]interface{}, error) {
+	if !image.Valid {
+		return nil, nil
+	}
+	decoder := json.NewDecoder(strings.NewReader(image.String))
+	decoder.UseNumber()
+	var values map[string]interface{}
+	if err := decoder.Decode(&values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
@@ -1,29 +1,47 @@
 package secure_sqlite
 
 import (
+	"context"
 	"database/sql"
+	"time"
 
+	"github.com/wemcdonald/secure_sqlite/pkg/abac"
 	"github.com/wemcdonald/secure_sqlite/pkg/auth"
 	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+	"github.com/wemcdonald/secure_sqlite/pkg/rbac"
 )
 
 // SecureDB defines the interface for secure database operations
 type SecureDB interface {
 	// Core operations
-	Open(dataSourceName string, authProvider auth.Provider, username, token string) (*SecureSQLite, error)
+	Open(dataSourceName string, authProvider auth.Provider, username, token string, opts ...Option) (*SecureSQLite, error)
 	Close() error
-	AuthProvider() auth.Provider
 	DB() *sql.DB
+	Unsafe(ctx context.Context, reason string) (*sql.DB, error)
 	Ping() error
 
 	// User management
 	CreateUser(username, token string) error
+	DisableUser(username string) error
+	ResetToken(username, token string) error
+	TerminateSession(sessionID string) error
+	ListAccounts() ([]auth.Account, error)
+	ListSessions() ([]auth.SessionInfo, error)
+
+	// System privileges
+	HasPrivilege(username string, privilege permissions.Privilege, table string) (bool, error)
+	GrantPrivilege(grantee string, privilege permissions.Privilege, table string, grantOption bool) error
+	RevokePrivilege(grantee string, privilege permissions.Privilege, table string) error
 
 	// RBAC operations
 	CreateRole(name string) (int64, error)
 	RoleExists(name string) (bool, error)
 	AssignRoleToUser(username, roleName string) error
+	AssignRoleToUserBetween(username, roleName string, notBefore, notAfter time.Time) error
 	UserHasRole(username, roleName string) (bool, error)
+	GetUserRoles(username string) ([]string, error)
+	ListRoles() ([]string, error)
+	RoleMembers(roleName string) ([]string, error)
 	RemoveRoleFromUser(username, roleName string) error
 	DeleteRole(name string) error
 	CreatePermission(name string) (int64, error)
@@ -34,11 +52,44 @@ type SecureDB interface {
 	GrantTablePermission(roleID int64, tableName string, permissionType permissions.PermissionType) error
 	GrantColumnPermission(roleID int64, tableName, columnName string, permissionType permissions.PermissionType) error
 	GrantRowPermission(roleID int64, tableName, condition string, permissionType permissions.PermissionType) error
+	Grant(grantee string, grant rbac.GrantPolicy) error
+	Revoke(grantee string, grant rbac.GrantPolicy, behavior rbac.RevokeBehavior) error
+	GetEffectivePermissions(username string) ([]permissions.Permission, error)
+
+	// Policies
+	ApplyPolicy(policy *rbac.Policy, opts rbac.ApplyOptions) (*rbac.PolicyReport, error)
+	ExportPolicy() (*rbac.Policy, error)
+	AddABACPolicy(policy abac.Policy) error
+	RemoveABACPolicy(name string) error
 
 	// Query operations
-	Query(query string, args ...interface{}) (*sql.Rows, error)
+	Query(query string, args ...interface{}) (*Rows, error)
 	QueryRow(query string, args ...interface{}) *sql.Row
 	Exec(query string, args ...interface{}) (sql.Result, error)
-	Prepare(query string) (*sql.Stmt, error)
+	Prepare(query string) (*Stmt, error)
 	Begin() (*sql.Tx, error)
+
+	// Context-aware query operations
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	PrepareContext(ctx context.Context, query string) (*Stmt, error)
+	ExplainAccess(ctx context.Context, query string, args ...interface{}) (*AccessExplanation, error)
+	VisibleTables(ctx context.Context) ([]string, error)
+
+	// Break-glass access
+	BreakGlass(ctx context.Context, req BreakGlassRequest) (*SecureSQLite, error)
+
+	// Access requests
+	RequestAccess(ctx context.Context, req rbac.AccessRequest) (*rbac.AccessRequest, error)
+	ApproveAccessRequest(ctx context.Context, id int64) (*rbac.AccessRequest, error)
+	DenyAccessRequest(ctx context.Context, id int64, reason string) (*rbac.AccessRequest, error)
+	AccessRequests(ctx context.Context, filter rbac.AccessRequestFilter) ([]rbac.AccessRequest, error)
+
+	// Change history
+	RowHistory(ctx context.Context, table string, rowID int64) ([]RowChange, error)
+
+	// Encryption
+	ReencryptTable(ctx context.Context, table string) (int64, error)
+	RekeyDatabase(ctx context.Context) error
 }
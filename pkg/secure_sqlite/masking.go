@@ -0,0 +1,68 @@
+package secure_sqlite
+
+import (
+	"context"
+	"errors"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/masking"
+	"github.com/wemcdonald/secure_sqlite/pkg/sqlparser"
+	xsqlparser "github.com/xwb1989/sqlparser"
+)
+
+// WithMasking masks columns according to the rules of a masking manager. The
+// manager is shared by every handle opened with it. Handles only read its
+// rules, so users cannot unmask columns; the rules are changed through the
+// manager by the application.
+func WithMasking(manager *masking.Manager) Option {
+	return func(o *options) {
+		o.masking = manager
+	}
+}
+
+// applyMasks rewrites a statement so that it returns masked values of the
+// columns masked for the user, and refuses statements that filter or order
+// rows by them. It returns the query and arguments to execute, which are the
+// originals when no column is masked.
+func (db *SecureSQLite) applyMasks(ctx context.Context, stmt xsqlparser.Statement, query string, args []interface{}) (string, []interface{}, error) {
+	if db.maskingManager == nil || len(db.maskingManager.Rules()) == 0 {
+		return query, args, nil
+	}
+	roles, err := db.rbacManager.GetUserRoles(db.username)
+	if err != nil {
+		return "", nil, &DBError{
+			Code:    "SESSION_ERROR",
+			Message: "failed to get user roles",
+			Err:     err,
+		}
+	}
+
+	changed, err := sqlparser.ApplyMasks(stmt, func(table, column string) string {
+		mask := db.maskingManager.MaskFor(table, column, db.tableRoles(roles, table))
+		if mask == masking.Unmasked {
+			return ""
+		}
+		return string(mask)
+	}, func(table string) ([]string, error) {
+		return tableColumns(ctx, db.executor(ctx), table)
+	})
+	if errors.Is(err, sqlparser.ErrMaskedCondition) {
+		return "", nil, &DBError{
+			Code:    "PERMISSION_DENIED",
+			Message: "masked columns cannot filter, group, order or join rows",
+			Err:     err,
+		}
+	}
+	if err != nil {
+		return "", nil, &DBError{
+			Code:    "MASKING_ERROR",
+			Message: "failed to apply column masks",
+			Err:     err,
+		}
+	}
+	if !changed {
+		return query, args, nil
+	}
+
+	// The rewritten query uses named placeholders, so bind everything by name
+	return xsqlparser.String(stmt), sqlparser.BindStatementArgs(args), nil
+}
@@ -1,6 +1,7 @@
 package secure_sqlite
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"strings"
@@ -11,12 +12,28 @@ import (
 )
 
 // Query executes a SELECT query with RBAC checks
-func (db *SecureSQLite) Query(query string, args ...interface{}) (*sql.Rows, error) {
+func (db *SecureSQLite) Query(query string, args ...interface{}) (*Rows, error) {
+	return db.QueryContext(context.Background(), query, args...)
+}
+
+// QueryContext executes a SELECT query with RBAC and ABAC checks. The context
+// supplies the request environment, e.g. the client IP, to ABAC policies.
+func (db *SecureSQLite) QueryContext(ctx context.Context, query string, args ...interface{}) (_ *Rows, err error) {
+	a := db.auditStatement(operationQuery, query)
+	defer func() { db.refused(ctx, a, err) }()
+	if err := db.checkSession(); err != nil {
+		return nil, err
+	}
+	if err := db.recordStatement(ctx, query); err != nil {
+		return nil, err
+	}
+
 	// Get the action type
 	action, err := db.getActionType(query)
 	if err != nil {
 		return nil, err
 	}
+	a.action = action.String()
 
 	// Create parser and parse the query
 	parser := sqlparser.NewParser(db.authProvider)
@@ -29,106 +46,42 @@ func (db *SecureSQLite) Query(query string, args ...interface{}) (*sql.Rows, err
 		}
 	}
 
-	// Extract tables and columns based on statement type
-	var tables []string
-	var columns []string
+	// Check the statement against the policies and permissions of the user
+	_, decisions, err := db.authorizeStatement(ctx, a, action, stmt)
+	if err != nil {
+		return nil, err
+	}
 
-	switch s := stmt.(type) {
-	case *xsqlparser.Select:
-		// Extract tables from FROM clause
-		for _, tableExpr := range s.From {
-			switch expr := tableExpr.(type) {
-			case *xsqlparser.AliasedTableExpr:
-				if tableName, ok := expr.Expr.(xsqlparser.TableName); ok {
-					tables = append(tables, tableName.Name.String())
-				}
-			}
-		}
-		// Extract columns from SELECT list
-		for _, selectExpr := range s.SelectExprs {
-			switch expr := selectExpr.(type) {
-			case *xsqlparser.AliasedExpr:
-				if colName, ok := expr.Expr.(*xsqlparser.ColName); ok {
-					columns = append(columns, colName.Name.String())
-				}
-			}
-		}
-	case *xsqlparser.Insert:
-		tables = append(tables, s.Table.Name.String())
-		for _, col := range s.Columns {
-			columns = append(columns, col.String())
-		}
-	case *xsqlparser.Update:
-		if tableName, ok := s.TableExprs[0].(*xsqlparser.AliasedTableExpr).Expr.(xsqlparser.TableName); ok {
-			tables = append(tables, tableName.Name.String())
-		}
-		for _, expr := range s.Exprs {
-			columns = append(columns, expr.Name.Name.String())
-		}
-	case *xsqlparser.Delete:
-		if tableName, ok := s.TableExprs[0].(*xsqlparser.AliasedTableExpr).Expr.(xsqlparser.TableName); ok {
-			tables = append(tables, tableName.Name.String())
-		}
+	// Mask restricted columns
+	query, args, err = db.applyMasks(ctx, stmt, query, args)
+	if err != nil {
+		return nil, err
 	}
 
-	// Check table-level permissions
-	for _, table := range tables {
-		hasPermission, err := db.RBACManager.HasTablePermission(db.username, table, db.getPermissionType(action))
-		if err != nil {
-			return nil, &DBError{
-				Code:    "PERMISSION_ERROR",
-				Message: fmt.Sprintf("failed to check table permission: %s", table),
-				Err:     err,
-			}
-		}
-		if !hasPermission {
-			return nil, &DBError{
-				Code:    "PERMISSION_DENIED",
-				Message: fmt.Sprintf("permission denied for table: %s", table),
-			}
-		}
+	// Encrypt written values and decrypt encrypted columns the user may read
+	query, args, err = db.applyEncryption(ctx, stmt, query, args)
+	if err != nil {
+		return nil, err
 	}
 
-	// Check column-level permissions
-	for _, table := range tables {
-		for _, col := range columns {
-			hasPermission, err := db.RBACManager.HasColumnPermission(db.username, table, col, db.getPermissionType(action))
-			if err != nil {
-				return nil, &DBError{
-					Code:    "PERMISSION_ERROR",
-					Message: fmt.Sprintf("failed to check column permission: %s.%s", table, col),
-					Err:     err,
-				}
-			}
-			if !hasPermission {
-				return nil, &DBError{
-					Code:    "PERMISSION_DENIED",
-					Message: fmt.Sprintf("permission denied for column: %s.%s", table, col),
-				}
-			}
-		}
+	// Apply row-level conditions
+	query, args, err = db.applyRowSecurity(parser, stmt, query, args, decisions)
+	if err != nil {
+		return nil, err
 	}
 
-	// Check row-level permissions
-	for _, table := range tables {
-		rowPerms, err := db.RBACManager.GetRowPermissions(db.username, table, db.getPermissionType(action))
-		if err != nil {
-			return nil, &DBError{
-				Code:    "PERMISSION_ERROR",
-				Message: fmt.Sprintf("failed to check row permissions: %s", table),
-				Err:     err,
-			}
-		}
-		if len(rowPerms) > 0 && !rowPerms[0].Granted {
-			return nil, &DBError{
-				Code:    "PERMISSION_DENIED",
-				Message: fmt.Sprintf("permission denied for rows in table: %s", table),
-			}
-		}
+	// Select the keys of rows returned with sensitive columns
+	read, query, args, err := db.sensitiveReads(ctx, a, query, args, true)
+	if err != nil {
+		return nil, err
+	}
+	a.rewritten = query
+	if err := db.authorized(ctx, a); err != nil {
+		return nil, err
 	}
 
 	// Execute the query
-	rows, err := db.SqlDB.Query(query, args...)
+	rows, err := db.executor(ctx).QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, &DBError{
 			Code:    "QUERY_ERROR",
@@ -136,16 +89,41 @@ func (db *SecureSQLite) Query(query string, args ...interface{}) (*sql.Rows, err
 			Err:     err,
 		}
 	}
-	return rows, nil
+	return newRows(rows, read), nil
 }
 
 // Exec executes a non-SELECT query with RBAC checks
 func (db *SecureSQLite) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.ExecContext(context.Background(), query, args...)
+}
+
+// ExecContext executes a non-SELECT query with RBAC and ABAC checks
+func (db *SecureSQLite) ExecContext(ctx context.Context, query string, args ...interface{}) (_ sql.Result, err error) {
+	a := db.auditStatement(operationExec, query)
+	defer func() { db.refused(ctx, a, err) }()
+	if err := db.checkSession(); err != nil {
+		return nil, err
+	}
+	if err := db.recordStatement(ctx, query); err != nil {
+		return nil, err
+	}
+
+	// Access control statements are handled by the RBAC and ABAC managers,
+	// which authorize them as they are applied
+	if sqlparser.IsAccessStatement(query) {
+		result, err := db.execAccessStatement(query)
+		if err != nil {
+			return nil, err
+		}
+		return result, db.authorized(ctx, a)
+	}
+
 	// Get the action type
 	action, err := db.getActionType(query)
 	if err != nil {
 		return nil, err
 	}
+	a.action = action.String()
 
 	// Create parser and parse the query
 	parser := sqlparser.NewParser(db.authProvider)
@@ -158,170 +136,198 @@ func (db *SecureSQLite) Exec(query string, args ...interface{}) (sql.Result, err
 		}
 	}
 
-	// Extract tables and columns based on statement type
-	var tables []string
-	var columns []string
-
-	switch s := stmt.(type) {
-	case *xsqlparser.Select:
-		// Extract tables from FROM clause
-		for _, tableExpr := range s.From {
-			switch expr := tableExpr.(type) {
-			case *xsqlparser.AliasedTableExpr:
-				if tableName, ok := expr.Expr.(xsqlparser.TableName); ok {
-					tables = append(tables, tableName.Name.String())
-				}
-			}
+	// For DDL operations, we'll handle permissions at the database level
+	if _, ok := stmt.(*xsqlparser.DDL); ok {
+		if err := db.authorized(ctx, a); err != nil {
+			return nil, err
 		}
-		// Extract columns from SELECT list
-		for _, selectExpr := range s.SelectExprs {
-			switch expr := selectExpr.(type) {
-			case *xsqlparser.AliasedExpr:
-				if colName, ok := expr.Expr.(*xsqlparser.ColName); ok {
-					columns = append(columns, colName.Name.String())
-				}
-			}
+		return db.executor(ctx).ExecContext(ctx, query, args...)
+	}
+
+	// Check the statement against the policies and permissions of the user
+	tables, decisions, err := db.authorizeStatement(ctx, a, action, stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Mask restricted columns
+	query, args, err = db.applyMasks(ctx, stmt, query, args)
+	if err != nil {
+		return nil, err
+	}
+
+	// Encrypt written values and decrypt encrypted columns the user may read
+	query, args, err = db.applyEncryption(ctx, stmt, query, args)
+	if err != nil {
+		return nil, err
+	}
+
+	// Apply row-level conditions
+	query, args, err = db.applyRowSecurity(parser, stmt, query, args, decisions)
+	if err != nil {
+		return nil, err
+	}
+	a.rewritten = query
+	if err := db.authorized(ctx, a); err != nil {
+		return nil, err
+	}
+
+	// Execute the query, checking the written rows against policy checks and
+	// recording the changed rows of tables with a change history
+	checks, err := db.addRowPolicyChecks(action, tables, decisions.checkFilters(action))
+	if err != nil {
+		return nil, err
+	}
+	history := db.recordsHistory(action, tables)
+	if len(checks) > 0 || history {
+		return db.execInTransaction(ctx, a, query, args, checks, history)
+	}
+	return db.executor(ctx).ExecContext(ctx, query, args...)
+}
+
+// execInTransaction executes a statement in a transaction after verifying its
+// written rows against the check filters of the tables, and records the rows
+// it changes if history is set
+func (db *SecureSQLite) execInTransaction(ctx context.Context, a *statementAudit, query string, args []interface{}, checks map[string]string, history bool) (sql.Result, error) {
+	stmt, err := xsqlparser.Parse(query)
+	if err != nil {
+		return nil, &DBError{
+			Code:    "PARSE_ERROR",
+			Message: "failed to parse query",
+			Err:     err,
 		}
-	case *xsqlparser.Insert:
-		tables = append(tables, s.Table.Name.String())
-		for _, col := range s.Columns {
-			columns = append(columns, col.String())
+	}
+
+	tx, err := db.beginTx(ctx)
+	if err != nil {
+		return nil, &DBError{
+			Code:    "TRANSACTION_ERROR",
+			Message: "failed to begin transaction",
+			Err:     err,
 		}
-	case *xsqlparser.Update:
-		if tableName, ok := s.TableExprs[0].(*xsqlparser.AliasedTableExpr).Expr.(xsqlparser.TableName); ok {
-			tables = append(tables, tableName.Name.String())
+	}
+	defer tx.Rollback()
+
+	if err := db.verifyChecks(ctx, tx, stmt, args, checks); err != nil {
+		return nil, err
+	}
+
+	// Read the rows the statement changes as they are before it
+	var table string
+	var before []rowImage
+	if history {
+		table, before, err = beforeImages(ctx, tx, stmt, args)
+		if err != nil {
+			return nil, &DBError{
+				Code:    "HISTORY_ERROR",
+				Message: "failed to read rows before change",
+				Err:     err,
+			}
 		}
-		for _, expr := range s.Exprs {
-			columns = append(columns, expr.Name.Name.String())
+	}
+
+	result, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	if history {
+		if err := db.recordHistory(ctx, tx, a, table, before); err != nil {
+			return nil, &DBError{
+				Code:    "HISTORY_ERROR",
+				Message: fmt.Sprintf("failed to record change history of table: %s", table),
+				Err:     err,
+			}
 		}
-	case *xsqlparser.Delete:
-		if tableName, ok := s.TableExprs[0].(*xsqlparser.AliasedTableExpr).Expr.(xsqlparser.TableName); ok {
-			tables = append(tables, tableName.Name.String())
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, &DBError{
+			Code:    "TRANSACTION_ERROR",
+			Message: "failed to commit transaction",
+			Err:     err,
 		}
-	case *xsqlparser.DDL:
-		// For DDL operations, we'll handle permissions at the database level
-		return db.SqlDB.Exec(query, args...)
 	}
+	return result, nil
+}
+
+// authorizeStatement checks a statement against the ABAC policies and, for
+// the tables no policy permits, the table, column and row permissions of the
+// user. It records the targets and decisions in the audit record of the
+// statement and returns the tables and decisions.
+func (db *SecureSQLite) authorizeStatement(ctx context.Context, a *statementAudit, action permissions.Action, stmt xsqlparser.Statement) ([]string, policyDecisions, error) {
+	// Extract tables and columns based on statement type
+	tables, columns, err := db.statementTargets(ctx, stmt)
+	if err != nil {
+		return nil, nil, err
+	}
+	a.tables, a.columns = tables, columnNames(tables, columns)
+
+	// Evaluate attribute-based policies
+	decisions, err := db.evaluatePolicies(ctx, action, tables, columns)
+	if err != nil {
+		return nil, nil, err
+	}
+	a.decisions = decisions
 
-	// Check table-level permissions
+	permissionType := db.getPermissionType(action)
+	checkColumns := action == permissions.Select || action == permissions.Insert || action == permissions.Update
 	for _, table := range tables {
-		hasPermission, err := db.RBACManager.HasTablePermission(db.username, table, db.getPermissionType(action))
+		if decisions.permits(table) {
+			continue
+		}
+
+		// Check table-level permissions
+		hasPermission, err := db.rbacManager.HasTablePermission(db.username, table, permissionType)
 		if err != nil {
-			return nil, &DBError{
+			return nil, nil, &DBError{
 				Code:    "PERMISSION_ERROR",
 				Message: fmt.Sprintf("failed to check table permission: %s", table),
 				Err:     err,
 			}
 		}
 		if !hasPermission {
-			return nil, &DBError{
+			return nil, nil, &DBError{
 				Code:    "PERMISSION_DENIED",
 				Message: fmt.Sprintf("permission denied for table: %s", table),
 			}
 		}
-	}
 
-	// Check column-level permissions for INSERT/UPDATE
-	switch action {
-	case permissions.Insert, permissions.Update:
-		for _, table := range tables {
-			for _, col := range columns {
-				hasPermission, err := db.RBACManager.HasColumnPermission(db.username, table, col, db.getPermissionType(action))
+		// Check column-level permissions
+		if checkColumns {
+			for _, col := range columns[strings.ToLower(table)] {
+				hasPermission, err := db.rbacManager.HasColumnPermission(db.username, table, col, permissionType)
 				if err != nil {
-					return nil, &DBError{
+					return nil, nil, &DBError{
 						Code:    "PERMISSION_ERROR",
 						Message: fmt.Sprintf("failed to check column permission: %s.%s", table, col),
 						Err:     err,
 					}
 				}
 				if !hasPermission {
-					return nil, &DBError{
+					return nil, nil, &DBError{
 						Code:    "PERMISSION_DENIED",
 						Message: fmt.Sprintf("permission denied for column: %s.%s", table, col),
 					}
 				}
 			}
 		}
-	}
 
-	// Check row-level permissions
-	for _, table := range tables {
-		rowPerms, err := db.RBACManager.GetRowPermissions(db.username, table, db.getPermissionType(action))
+		// Check row-level permissions
+		rowPerms, err := db.rbacManager.GetRowPermissions(db.username, table, permissionType)
 		if err != nil {
-			return nil, &DBError{
+			return nil, nil, &DBError{
 				Code:    "PERMISSION_ERROR",
 				Message: fmt.Sprintf("failed to check row permissions: %s", table),
 				Err:     err,
 			}
 		}
 		if len(rowPerms) > 0 && !rowPerms[0].Granted {
-			return nil, &DBError{
+			return nil, nil, &DBError{
 				Code:    "PERMISSION_DENIED",
 				Message: fmt.Sprintf("permission denied for rows in table: %s", table),
 			}
 		}
 	}
-
-	// Execute the query
-	return db.SqlDB.Exec(query, args...)
-}
-
-// addRowLevelCondition adds a row-level permission condition to a query
-func (db *SecureSQLite) addRowLevelCondition(query, condition string) string {
-	// Parse the query using sqlparser
-	stmt, err := xsqlparser.Parse(query)
-	if err != nil {
-		return query // Return original query if parsing fails
-	}
-
-	// Parse the condition into an expression
-	conditionStmt, err := xsqlparser.Parse(fmt.Sprintf("SELECT * FROM dual WHERE %s", condition))
-	if err != nil {
-		return query // Return original query if condition parsing fails
-	}
-	conditionExpr := conditionStmt.(*xsqlparser.Select).Where.Expr
-
-	// Add the condition to the WHERE clause
-	switch s := stmt.(type) {
-	case *xsqlparser.Select:
-		if s.Where == nil {
-			s.Where = &xsqlparser.Where{
-				Type: "where",
-				Expr: conditionExpr,
-			}
-		} else {
-			s.Where.Expr = &xsqlparser.AndExpr{
-				Left:  s.Where.Expr,
-				Right: conditionExpr,
-			}
-		}
-	case *xsqlparser.Update:
-		if s.Where == nil {
-			s.Where = &xsqlparser.Where{
-				Type: "where",
-				Expr: conditionExpr,
-			}
-		} else {
-			s.Where.Expr = &xsqlparser.AndExpr{
-				Left:  s.Where.Expr,
-				Right: conditionExpr,
-			}
-		}
-	case *xsqlparser.Delete:
-		if s.Where == nil {
-			s.Where = &xsqlparser.Where{
-				Type: "where",
-				Expr: conditionExpr,
-			}
-		} else {
-			s.Where.Expr = &xsqlparser.AndExpr{
-				Left:  s.Where.Expr,
-				Right: conditionExpr,
-			}
-		}
-	}
-
-	return xsqlparser.String(stmt)
+	return tables, decisions, nil
 }
 
 // getActionType determines the type of action from the SQL query
@@ -363,3 +369,83 @@ func (db *SecureSQLite) getPermissionType(action permissions.Action) permissions
 		return permissions.TablePermission
 	}
 }
+
+// statementTargets extracts the tables a statement accesses and the columns
+// of each table, by lower-case table name, that it references in any clause.
+// The tables include those of joins and subqueries, and * stands for every
+// column of its tables. The target of UPDATE and DELETE must be a single
+// table, since the checks cannot tell which table of a join the statement
+// changes.
+func (db *SecureSQLite) statementTargets(ctx context.Context, stmt xsqlparser.Statement) (tables []string, columns map[string][]string, err error) {
+	switch s := stmt.(type) {
+	case *xsqlparser.Insert:
+		tables = append(tables, s.Table.Name.String())
+	case *xsqlparser.Update:
+		table, err := targetTable(s.TableExprs)
+		if err != nil {
+			return nil, nil, err
+		}
+		tables = append(tables, table)
+	case *xsqlparser.Delete:
+		table, err := targetTable(s.TableExprs)
+		if err != nil {
+			return nil, nil, err
+		}
+		tables = append(tables, table)
+	}
+
+	// Add every other table the statement reads, e.g. through joins and
+	// subqueries
+	err = xsqlparser.Walk(func(node xsqlparser.SQLNode) (bool, error) {
+		if expr, ok := node.(*xsqlparser.AliasedTableExpr); ok {
+			if tableName, ok := expr.Expr.(xsqlparser.TableName); ok && !permissions.ContainsName(tables, tableName.Name.String()) {
+				tables = append(tables, tableName.Name.String())
+			}
+		}
+		return true, nil
+	}, stmt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	columns, err = sqlparser.ReferencedColumns(stmt, func(table string) ([]string, error) {
+		return tableColumns(ctx, db.executor(ctx), table)
+	})
+	if err != nil {
+		return nil, nil, &DBError{
+			Code:    "QUERY_ERROR",
+			Message: "failed to resolve the columns of the statement",
+			Err:     err,
+		}
+	}
+	return tables, columns, nil
+}
+
+// columnNames returns the names of the columns of the tables of a statement,
+// as recorded in audit events
+func columnNames(tables []string, columns map[string][]string) []string {
+	var names []string
+	for _, table := range tables {
+		for _, column := range columns[strings.ToLower(table)] {
+			if !permissions.ContainsName(names, column) {
+				names = append(names, column)
+			}
+		}
+	}
+	return names
+}
+
+// targetTable returns the table an UPDATE or DELETE statement changes
+func targetTable(exprs xsqlparser.TableExprs) (string, error) {
+	if len(exprs) == 1 {
+		if aliased, ok := exprs[0].(*xsqlparser.AliasedTableExpr); ok {
+			if tableName, ok := aliased.Expr.(xsqlparser.TableName); ok {
+				return tableName.Name.String(), nil
+			}
+		}
+	}
+	return "", &DBError{
+		Code:    "UNSUPPORTED_QUERY",
+		Message: "statements must change a single table",
+	}
+}
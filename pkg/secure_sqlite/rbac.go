@@ -1,68 +1,110 @@
 package secure_sqlite
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
+	"github.com/wemcdonald/secure_sqlite/pkg/auth"
 	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+	"github.com/wemcdonald/secure_sqlite/pkg/rbac"
 )
 
 // CreateRole creates a new role
 func (db *SecureSQLite) CreateRole(name string) (int64, error) {
-	return db.RBACManager.CreateRole(name)
+	roleID, err := db.rbacManager.CreateRole(name)
+	return roleID, privilegeError(err)
 }
 
 // RoleExists checks if a role exists
 func (db *SecureSQLite) RoleExists(name string) (bool, error) {
-	return db.RBACManager.RoleExists(name)
+	return db.rbacManager.RoleExists(name)
 }
 
 // AssignRoleToUser assigns a role to a user
 func (db *SecureSQLite) AssignRoleToUser(username, roleName string) error {
-	return db.RBACManager.AssignRoleToUser(username, roleName)
+	return privilegeError(db.rbacManager.AssignRoleToUser(username, roleName))
 }
 
-// UserHasRole checks if a user has a role
+// AssignRoleToUserBetween assigns a role to a user for a time window
+func (db *SecureSQLite) AssignRoleToUserBetween(username, roleName string, notBefore, notAfter time.Time) error {
+	return privilegeError(db.rbacManager.AssignRoleToUserBetween(username, roleName, notBefore, notAfter))
+}
+
+// UserHasRole checks if a user has a role. Checking another user requires
+// the ManageUsers or ManageRoles privilege.
 func (db *SecureSQLite) UserHasRole(username, roleName string) (bool, error) {
-	return db.RBACManager.UserHasRole(username, roleName)
+	if err := db.authorizeInspect(username); err != nil {
+		return false, err
+	}
+	return db.rbacManager.UserHasRole(username, roleName)
+}
+
+// GetUserRoles returns the roles a user currently holds. Listing the roles of
+// another user requires the ManageUsers or ManageRoles privilege.
+func (db *SecureSQLite) GetUserRoles(username string) ([]string, error) {
+	if err := db.authorizeInspect(username); err != nil {
+		return nil, err
+	}
+	return db.rbacManager.GetUserRoles(username)
+}
+
+// ListRoles returns the names of all roles, sorted
+func (db *SecureSQLite) ListRoles() ([]string, error) {
+	roles, err := db.rbacManager.ListRoles()
+	return roles, privilegeError(err)
+}
+
+// RoleMembers returns the names of the members of a role, sorted
+func (db *SecureSQLite) RoleMembers(roleName string) ([]string, error) {
+	members, err := db.rbacManager.RoleMembers(roleName)
+	return members, privilegeError(err)
 }
 
 // RemoveRoleFromUser removes a role from a user
 func (db *SecureSQLite) RemoveRoleFromUser(username, roleName string) error {
-	return db.RBACManager.RemoveRoleFromUser(username, roleName)
+	return privilegeError(db.rbacManager.RemoveRoleFromUser(username, roleName))
 }
 
 // DeleteRole deletes a role
 func (db *SecureSQLite) DeleteRole(name string) error {
-	return db.RBACManager.DeleteRole(name)
+	return privilegeError(db.rbacManager.DeleteRole(name))
 }
 
 // CreatePermission creates a new permission
 func (db *SecureSQLite) CreatePermission(name string) (int64, error) {
-	return db.RBACManager.CreatePermission(name)
+	permID, err := db.rbacManager.CreatePermission(name)
+	return permID, privilegeError(err)
 }
 
 // PermissionExists checks if a permission exists
 func (db *SecureSQLite) PermissionExists(name string) (bool, error) {
-	return db.RBACManager.PermissionExists(name)
+	return db.rbacManager.PermissionExists(name)
 }
 
 // AssignPermissionToRole assigns a permission to a role
 func (db *SecureSQLite) AssignPermissionToRole(roleName, permissionName string) error {
-	return db.RBACManager.AssignPermissionToRole(roleName, permissionName)
+	return privilegeError(db.rbacManager.AssignPermissionToRole(roleName, permissionName))
 }
 
 // RoleHasPermission checks if a role has a permission
 func (db *SecureSQLite) RoleHasPermission(roleName, permissionName string) (bool, error) {
-	return db.RBACManager.RoleHasPermission(roleName, permissionName)
+	return db.rbacManager.RoleHasPermission(roleName, permissionName)
 }
 
 // RemovePermissionFromRole removes a permission from a role
 func (db *SecureSQLite) RemovePermissionFromRole(roleName, permissionName string) error {
-	return db.RBACManager.RemovePermissionFromRole(roleName, permissionName)
+	return privilegeError(db.rbacManager.RemovePermissionFromRole(roleName, permissionName))
 }
 
 // GrantTablePermission grants a table-level permission to a role
 func (db *SecureSQLite) GrantTablePermission(roleID int64, tableName string, permissionType permissions.PermissionType) error {
+	// Check the privilege before the members, so that it is required for
+	// roles without members as well
+	if err := db.rbacManager.Authorize(permissions.GrantTable, tableName); err != nil {
+		return privilegeError(err)
+	}
+
 	// Get role name from role ID
 	roleName, err := db.authProvider.GetRoleName(roleID)
 	if err != nil {
@@ -77,8 +119,8 @@ func (db *SecureSQLite) GrantTablePermission(roleID int64, tableName string, per
 
 	// Grant permission to each user
 	for _, username := range users {
-		if err := db.RBACManager.GrantTablePermission(username, tableName, permissionType); err != nil {
-			return fmt.Errorf("failed to grant permission to user %s: %v", username, err)
+		if err := db.rbacManager.GrantTablePermission(username, tableName, permissionType); err != nil {
+			return privilegeError(fmt.Errorf("failed to grant permission to user %s: %w", username, err))
 		}
 	}
 
@@ -87,6 +129,12 @@ func (db *SecureSQLite) GrantTablePermission(roleID int64, tableName string, per
 
 // GrantColumnPermission grants a column-level permission to a role
 func (db *SecureSQLite) GrantColumnPermission(roleID int64, tableName, columnName string, permissionType permissions.PermissionType) error {
+	// Check the privilege before the members, so that it is required for
+	// roles without members as well
+	if err := db.rbacManager.Authorize(permissions.GrantTable, tableName); err != nil {
+		return privilegeError(err)
+	}
+
 	// Get role name from role ID
 	roleName, err := db.authProvider.GetRoleName(roleID)
 	if err != nil {
@@ -101,8 +149,8 @@ func (db *SecureSQLite) GrantColumnPermission(roleID int64, tableName, columnNam
 
 	// Grant permission to each user
 	for _, username := range users {
-		if err := db.RBACManager.GrantColumnPermission(username, tableName, columnName, permissionType); err != nil {
-			return fmt.Errorf("failed to grant permission to user %s: %v", username, err)
+		if err := db.rbacManager.GrantColumnPermission(username, tableName, columnName, permissionType); err != nil {
+			return privilegeError(fmt.Errorf("failed to grant permission to user %s: %w", username, err))
 		}
 	}
 
@@ -111,6 +159,12 @@ func (db *SecureSQLite) GrantColumnPermission(roleID int64, tableName, columnNam
 
 // GrantRowPermission grants a row-level permission to a role
 func (db *SecureSQLite) GrantRowPermission(roleID int64, tableName, condition string, permissionType permissions.PermissionType) error {
+	// Check the privilege before the members, so that it is required for
+	// roles without members as well
+	if err := db.rbacManager.Authorize(permissions.GrantTable, tableName); err != nil {
+		return privilegeError(err)
+	}
+
 	// Get role name from role ID
 	roleName, err := db.authProvider.GetRoleName(roleID)
 	if err != nil {
@@ -125,10 +179,122 @@ func (db *SecureSQLite) GrantRowPermission(roleID int64, tableName, condition st
 
 	// Grant permission to each user
 	for _, username := range users {
-		if err := db.RBACManager.GrantRowPermission(username, tableName, condition, permissionType); err != nil {
-			return fmt.Errorf("failed to grant permission to user %s: %v", username, err)
+		if err := db.rbacManager.GrantRowPermission(username, tableName, condition, permissionType); err != nil {
+			return privilegeError(fmt.Errorf("failed to grant permission to user %s: %w", username, err))
 		}
 	}
 
 	return nil
 }
+
+// CreateUser creates a new user with the given credentials
+func (db *SecureSQLite) CreateUser(username, token string) error {
+	return privilegeError(db.rbacManager.CreateUser(username, token))
+}
+
+// DisableUser keeps a user from authenticating and terminates the sessions of
+// the user
+func (db *SecureSQLite) DisableUser(username string) error {
+	return privilegeError(db.rbacManager.DisableUser(username))
+}
+
+// ResetToken replaces the token of a user
+func (db *SecureSQLite) ResetToken(username, token string) error {
+	return privilegeError(db.rbacManager.ResetToken(username, token))
+}
+
+// TerminateSession ends a session, so that its handle refuses further
+// statements
+func (db *SecureSQLite) TerminateSession(sessionID string) error {
+	return privilegeError(db.rbacManager.TerminateSession(sessionID))
+}
+
+// ListAccounts lists the users of the auth provider
+func (db *SecureSQLite) ListAccounts() ([]auth.Account, error) {
+	accounts, err := db.rbacManager.ListAccounts()
+	return accounts, privilegeError(err)
+}
+
+// ListSessions lists the sessions stored with the auth provider
+func (db *SecureSQLite) ListSessions() ([]auth.SessionInfo, error) {
+	sessions, err := db.rbacManager.ListSessions()
+	return sessions, privilegeError(err)
+}
+
+// HasPrivilege checks if a user holds a system privilege. Checking another
+// user requires the ManageUsers or ManageRoles privilege.
+func (db *SecureSQLite) HasPrivilege(username string, privilege permissions.Privilege, table string) (bool, error) {
+	if err := db.authorizeInspect(username); err != nil {
+		return false, err
+	}
+	return db.rbacManager.HasPrivilege(username, privilege, table)
+}
+
+// GrantPrivilege grants a system privilege to a role or user
+func (db *SecureSQLite) GrantPrivilege(grantee string, privilege permissions.Privilege, table string, grantOption bool) error {
+	return privilegeError(db.rbacManager.GrantPrivilege(grantee, privilege, table, grantOption))
+}
+
+// RevokePrivilege revokes a system privilege from a role or user
+func (db *SecureSQLite) RevokePrivilege(grantee string, privilege permissions.Privilege, table string) error {
+	return privilegeError(db.rbacManager.RevokePrivilege(grantee, privilege, table))
+}
+
+// Grant grants the permissions of a grant to a role, or to a user if no role
+// has the name
+func (db *SecureSQLite) Grant(grantee string, grant rbac.GrantPolicy) error {
+	return privilegeError(db.rbacManager.Grant(grantee, grant))
+}
+
+// Revoke revokes the permissions of a grant from a role or user
+func (db *SecureSQLite) Revoke(grantee string, grant rbac.GrantPolicy, behavior rbac.RevokeBehavior) error {
+	return privilegeError(db.rbacManager.Revoke(grantee, grant, behavior))
+}
+
+// GetEffectivePermissions returns the permissions a user currently holds.
+// Listing the permissions of another user requires the ManageUsers or
+// ManageRoles privilege.
+func (db *SecureSQLite) GetEffectivePermissions(username string) ([]permissions.Permission, error) {
+	if err := db.authorizeInspect(username); err != nil {
+		return nil, err
+	}
+	return db.rbacManager.GetEffectivePermissions(username)
+}
+
+// ApplyPolicy makes the state of the auth provider match a policy
+func (db *SecureSQLite) ApplyPolicy(policy *rbac.Policy, opts rbac.ApplyOptions) (*rbac.PolicyReport, error) {
+	report, err := db.rbacManager.ApplyPolicy(policy, opts)
+	return report, privilegeError(err)
+}
+
+// ExportPolicy exports the current state of the auth provider as a policy
+func (db *SecureSQLite) ExportPolicy() (*rbac.Policy, error) {
+	policy, err := db.rbacManager.ExportPolicy()
+	return policy, privilegeError(err)
+}
+
+// authorizeInspect checks that the user may see the roles and permissions of
+// another user, which requires one of the privileges that list accounts and
+// role members. Users may always see their own.
+func (db *SecureSQLite) authorizeInspect(username string) error {
+	if username == db.username {
+		return nil
+	}
+	err := db.rbacManager.Authorize(permissions.ManageUsers, "")
+	if errors.Is(err, rbac.ErrInsufficientPrivilege) {
+		err = db.rbacManager.Authorize(permissions.ManageRoles, "")
+	}
+	return privilegeError(err)
+}
+
+// privilegeError reports a missing system privilege as a permission denied error
+func privilegeError(err error) error {
+	if errors.Is(err, rbac.ErrInsufficientPrivilege) {
+		return &DBError{
+			Code:    "PERMISSION_DENIED",
+			Message: "insufficient privilege",
+			Err:     err,
+		}
+	}
+	return err
+}
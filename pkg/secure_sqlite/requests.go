@@ -0,0 +1,85 @@
+package secure_sqlite
+
+import (
+	"context"
+	"errors"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/rbac"
+)
+
+// WithAccessWorkflow lets users of the database request temporary access
+// through a workflow. The workflow is shared by every handle opened with it.
+func WithAccessWorkflow(workflow *rbac.AccessWorkflow) Option {
+	return func(o *options) {
+		o.workflow = workflow
+	}
+}
+
+// RequestAccess files a request for temporary access on behalf of the user
+func (db *SecureSQLite) RequestAccess(ctx context.Context, req rbac.AccessRequest) (*rbac.AccessRequest, error) {
+	if err := db.checkWorkflow(); err != nil {
+		return nil, err
+	}
+	request, err := db.workflow.Request(ctx, db.username, req)
+	return request, requestError(err)
+}
+
+// ApproveAccessRequest approves a pending access request on behalf of the user
+func (db *SecureSQLite) ApproveAccessRequest(ctx context.Context, id int64) (*rbac.AccessRequest, error) {
+	if err := db.checkWorkflow(); err != nil {
+		return nil, err
+	}
+	request, err := db.workflow.Approve(ctx, db.username, id)
+	return request, requestError(err)
+}
+
+// DenyAccessRequest denies a pending access request on behalf of the user
+func (db *SecureSQLite) DenyAccessRequest(ctx context.Context, id int64, reason string) (*rbac.AccessRequest, error) {
+	if err := db.checkWorkflow(); err != nil {
+		return nil, err
+	}
+	request, err := db.workflow.Deny(ctx, db.username, id, reason)
+	return request, requestError(err)
+}
+
+// AccessRequests returns the access requests the user may see that match a
+// filter
+func (db *SecureSQLite) AccessRequests(ctx context.Context, filter rbac.AccessRequestFilter) ([]rbac.AccessRequest, error) {
+	if err := db.checkWorkflow(); err != nil {
+		return nil, err
+	}
+	requests, err := db.workflow.List(ctx, db.username, filter)
+	return requests, requestError(err)
+}
+
+// checkWorkflow checks that the database was opened with an access workflow
+func (db *SecureSQLite) checkWorkflow() error {
+	if db.workflow == nil {
+		return &DBError{
+			Code:    "ACCESS_REQUEST_ERROR",
+			Message: "access requests are not enabled",
+		}
+	}
+	return nil
+}
+
+// requestError converts an error of the access workflow to a DBError
+func requestError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, rbac.ErrInsufficientPrivilege):
+		return privilegeError(err)
+	case errors.Is(err, rbac.ErrRequestNotFound):
+		return &DBError{
+			Code:    "ACCESS_REQUEST_NOT_FOUND",
+			Message: "access request not found",
+			Err:     err,
+		}
+	}
+	return &DBError{
+		Code:    "ACCESS_REQUEST_ERROR",
+		Message: err.Error(),
+		Err:     err,
+	}
+}
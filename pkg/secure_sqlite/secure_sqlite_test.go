@@ -1,14 +1,25 @@
 package secure_sqlite
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"net"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/wemcdonald/secure_sqlite/pkg/abac"
+	"github.com/wemcdonald/secure_sqlite/pkg/audit"
 	"github.com/wemcdonald/secure_sqlite/pkg/auth"
+	"github.com/wemcdonald/secure_sqlite/pkg/encryption"
+	"github.com/wemcdonald/secure_sqlite/pkg/masking"
 	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+	"github.com/wemcdonald/secure_sqlite/pkg/rbac"
 )
 
 func setupTestDB(t *testing.T) (*SecureSQLite, string, func()) {
@@ -22,7 +33,7 @@ func setupTestDB(t *testing.T) (*SecureSQLite, string, func()) {
 	token := "testtoken"
 	mockAuth.AddUser(username, token)
 
-	db, err := Open(tmpFile.Name(), mockAuth, username, token)
+	db, err := Open(tmpFile.Name(), mockAuth, username, token, WithSuperuser(username))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -40,9 +51,9 @@ func TestOpen(t *testing.T) {
 	defer cleanup()
 
 	assert.NotNil(t, db)
-	assert.NotNil(t, db.SqlDB)
+	assert.NotNil(t, db.sqlDB)
 	assert.NotNil(t, db.authProvider)
-	assert.NotNil(t, db.RBACManager)
+	assert.NotNil(t, db.rbacManager)
 	assert.Equal(t, "testuser", db.username)
 	assert.Equal(t, "testtoken", db.token)
 }
@@ -160,6 +171,27 @@ func TestAuthentication(t *testing.T) {
 	assert.Nil(t, db)
 }
 
+func TestOpenFailure(t *testing.T) {
+	var events []audit.Event
+	sink := audit.SinkFunc(func(ctx context.Context, event audit.Event) error {
+		events = append(events, event)
+		return nil
+	})
+	mockAuth := auth.NewMemoryProvider()
+	mockAuth.AddUser("testuser", "testtoken")
+
+	// The database of a path in a missing directory can't be opened, which
+	// leaves neither a session nor a record of it
+	path := filepath.Join(t.TempDir(), "missing", "test.db")
+	db, err := Open(path, mockAuth, "testuser", "testtoken", WithChangeHistory("orders"), WithAuditSink(sink))
+	assert.Error(t, err)
+	assert.Nil(t, db)
+	sessions, err := mockAuth.ListSessions()
+	assert.NoError(t, err)
+	assert.Empty(t, sessions)
+	assert.Empty(t, events)
+}
+
 func TestErrorHandling(t *testing.T) {
 	db, _, cleanup := setupTestDB(t)
 	defer cleanup()
@@ -279,6 +311,85 @@ func TestPrepare(t *testing.T) {
 	assert.IsType(t, &DBError{}, err)
 }
 
+func TestPrepareRowConditions(t *testing.T) {
+	db, _, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	mockAuth := db.authProvider.(*auth.MemoryProvider)
+	mockAuth.AddPermission(db.username, permissions.Permission{
+		Type:  permissions.TablePermission,
+		Table: "documents",
+	})
+
+	_, err := db.Exec(`
+		CREATE TABLE documents (
+			id INTEGER PRIMARY KEY,
+			owner_id INTEGER NOT NULL,
+			tenant TEXT NOT NULL
+		)
+	`)
+	assert.NoError(t, err)
+
+	userID, err := mockAuth.GetUserID(db.username)
+	assert.NoError(t, err)
+	for _, ownerID := range []int64{userID, userID, userID + 1, userID + 1} {
+		_, err = db.Exec("INSERT INTO documents (owner_id, tenant) VALUES (?, ?)", ownerID, "acme")
+		assert.NoError(t, err)
+	}
+
+	mockAuth.AddPermission(db.username, permissions.Permission{
+		Type:      permissions.RowPermission,
+		Table:     "documents",
+		Condition: "owner_id = current_user_id() AND tenant = current_setting('tenant')",
+	})
+	mockAuth.AddPermission(db.username, permissions.Permission{
+		Type:   permissions.ColumnPermission,
+		Table:  "documents",
+		Column: "tenant",
+	})
+	db.SetSessionAttribute("tenant", "acme")
+
+	// Prepared statements are restricted to the same rows as other statements
+	query, err := db.Prepare("SELECT COUNT(*) FROM documents WHERE id > ?")
+	assert.NoError(t, err)
+	defer query.Close()
+	var count int
+	assert.NoError(t, query.QueryRow(0).Scan(&count))
+	assert.Equal(t, 2, count)
+	rows, err := query.Query(0)
+	assert.NoError(t, err)
+	assert.True(t, rows.Next())
+	assert.NoError(t, rows.Scan(&count))
+	assert.NoError(t, rows.Close())
+	assert.Equal(t, 2, count)
+
+	// Session values are bound when the statement runs, not when it is prepared
+	db.SetSessionAttribute("tenant", "globex")
+	assert.NoError(t, query.QueryRow(0).Scan(&count))
+	assert.Equal(t, 0, count)
+	db.SetSessionAttribute("tenant", "acme")
+
+	update, err := db.Prepare("UPDATE documents SET tenant = ? WHERE id > ?")
+	assert.NoError(t, err)
+	result, err := update.Exec("acme", 0)
+	assert.NoError(t, err)
+	rowsAffected, err := result.RowsAffected()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), rowsAffected)
+	assert.NoError(t, update.Close())
+	_, err = update.Exec("acme", 0)
+	assert.Error(t, err)
+
+	remove, err := db.Prepare("DELETE FROM documents")
+	assert.NoError(t, err)
+	result, err = remove.Exec()
+	assert.NoError(t, err)
+	rowsAffected, err = result.RowsAffected()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), rowsAffected)
+	assert.NoError(t, remove.Close())
+}
+
 func TestTransaction(t *testing.T) {
 	db, _, cleanup := setupTestDB(t)
 	defer cleanup()
@@ -351,3 +462,1933 @@ func TestPing(t *testing.T) {
 	err := db.Ping()
 	assert.NoError(t, err)
 }
+
+func TestRowLevelSessionVariables(t *testing.T) {
+	db, _, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	mockAuth := db.authProvider.(*auth.MemoryProvider)
+	mockAuth.AddPermission(db.username, permissions.Permission{
+		Type:  permissions.TablePermission,
+		Table: "documents",
+	})
+
+	_, err := db.Exec(`
+		CREATE TABLE documents (
+			id INTEGER PRIMARY KEY,
+			owner_id INTEGER NOT NULL,
+			tenant TEXT NOT NULL
+		)
+	`)
+	assert.NoError(t, err)
+
+	userID, err := mockAuth.GetUserID(db.username)
+	assert.NoError(t, err)
+	for _, row := range []struct {
+		ownerID int64
+		tenant  string
+	}{
+		{userID, "acme"},
+		{userID, "acme"},
+		{userID, "globex"},
+		{userID + 1, "acme"},
+	} {
+		_, err = db.Exec("INSERT INTO documents (owner_id, tenant) VALUES (?, ?)", row.ownerID, row.tenant)
+		assert.NoError(t, err)
+	}
+
+	mockAuth.AddPermission(db.username, permissions.Permission{
+		Type:      permissions.RowPermission,
+		Table:     "documents",
+		Condition: "owner_id = current_user_id() AND tenant = current_setting('tenant')",
+	})
+
+	// Unset session attributes deny the query instead of matching nothing
+	_, err = db.Query("SELECT id FROM documents")
+	assert.Error(t, err)
+	assert.IsType(t, &DBError{}, err)
+
+	db.SetSessionAttribute("tenant", "acme")
+
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM documents WHERE id > ?", 0).Scan(&count)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// Row conditions also restrict which rows can be deleted
+	result, err := db.Exec("DELETE FROM documents")
+	assert.NoError(t, err)
+	rowsAffected, err := result.RowsAffected()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), rowsAffected)
+}
+
+func TestRowLevelUnionAndInsertSelect(t *testing.T) {
+	db, _, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	mockAuth := db.authProvider.(*auth.MemoryProvider)
+	for _, table := range []string{"documents", "copy"} {
+		mockAuth.AddPermission(db.username, permissions.Permission{
+			Type:  permissions.TablePermission,
+			Table: table,
+		})
+	}
+	for _, query := range []string{
+		"CREATE TABLE documents (id INTEGER PRIMARY KEY, owner_id INTEGER NOT NULL)",
+		"CREATE TABLE copy (id INTEGER, owner_id INTEGER)",
+	} {
+		_, err := db.Exec(query)
+		assert.NoError(t, err)
+	}
+	userID, err := mockAuth.GetUserID(db.username)
+	assert.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = db.Exec("INSERT INTO documents (owner_id) VALUES (?)", userID+1)
+		assert.NoError(t, err)
+	}
+	_, err = db.Exec("INSERT INTO documents (owner_id) VALUES (?)", userID)
+	assert.NoError(t, err)
+
+	mockAuth.AddPermission(db.username, permissions.Permission{
+		Type:      permissions.RowPermission,
+		Table:     "documents",
+		Condition: "owner_id = current_user_id()",
+	})
+
+	// Each branch of a UNION reads only the user's rows
+	rows, err := db.Query("SELECT id FROM documents UNION ALL SELECT id FROM documents")
+	if assert.NoError(t, err) {
+		var n int
+		for rows.Next() {
+			n++
+		}
+		rows.Close()
+		assert.Equal(t, 2, n)
+	}
+
+	// The source of INSERT ... SELECT reads only the user's rows
+	result, err := db.Exec("INSERT INTO copy SELECT id, owner_id FROM documents")
+	assert.NoError(t, err)
+	rowsAffected, err := result.RowsAffected()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), rowsAffected)
+
+	// Statements whose rows can't be limited are refused
+	_, err = db.Query("CREATE TABLE other (id INTEGER)")
+	var dbErr *DBError
+	if assert.ErrorAs(t, err, &dbErr) {
+		assert.Equal(t, "UNSUPPORTED_QUERY", dbErr.Code)
+	}
+}
+
+func TestABACPolicies(t *testing.T) {
+	db, _, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	_, err := db.Exec(`
+		CREATE TABLE claims (
+			id INTEGER PRIMARY KEY,
+			region TEXT NOT NULL,
+			amount INTEGER NOT NULL
+		)
+	`)
+	assert.NoError(t, err)
+	_, err = db.sqlDB.Exec("INSERT INTO claims (region, amount) VALUES ('emea', 10), ('emea', 20), ('apac', 30)")
+	assert.NoError(t, err)
+
+	_, err = db.CreateRole("analyst")
+	assert.NoError(t, err)
+	assert.NoError(t, db.AssignRoleToUser(db.username, "analyst"))
+	db.SetSessionAttribute("region", "emea")
+
+	now := time.Date(2024, time.January, 8, 10, 0, 0, 0, time.UTC)
+	db.abacManager.Now = func() time.Time { return now }
+	assert.NoError(t, db.AddABACPolicy(abac.Policy{
+		Name:      "analysts-read-claims",
+		Effect:    abac.Allow,
+		Actions:   []permissions.Action{permissions.Select},
+		Tables:    []string{"claims"},
+		Condition: abac.All(abac.PrincipalHasRole("analyst"), abac.BusinessHours(time.UTC)),
+		RowFilter: "region = current_setting('region')",
+	}))
+	assert.NoError(t, db.AddABACPolicy(abac.Policy{
+		Name:      "internal-network-only",
+		Effect:    abac.Deny,
+		Tables:    []string{"*"},
+		Condition: abac.Not(abac.ClientIPIn("10.0.0.0/8")),
+	}))
+
+	internal := abac.WithClientIP(context.Background(), net.ParseIP("10.0.0.5"))
+
+	// The policy grants access without any RBAC grant and filters the rows
+	var count int
+	err = db.QueryRowContext(internal, "SELECT COUNT(*) FROM claims").Scan(&count)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// Prepared statements are filtered the same way
+	stmt, err := db.PrepareContext(internal, "SELECT COUNT(*) FROM claims")
+	assert.NoError(t, err)
+	assert.NoError(t, stmt.QueryRowContext(internal).Scan(&count))
+	assert.Equal(t, 2, count)
+	assert.NoError(t, stmt.Close())
+
+	// Rows written through prepared statements must satisfy the check filter
+	assert.NoError(t, db.AddABACPolicy(abac.Policy{
+		Name:        "analysts-file-claims",
+		Effect:      abac.Allow,
+		Actions:     []permissions.Action{permissions.Insert},
+		Tables:      []string{"claims"},
+		Condition:   abac.PrincipalHasRole("analyst"),
+		CheckFilter: "region = current_setting('region')",
+	}))
+	stmt, err = db.PrepareContext(internal, "INSERT INTO claims (region, amount) VALUES (?, ?)")
+	assert.NoError(t, err)
+	_, err = stmt.ExecContext(internal, "emea", 40)
+	assert.NoError(t, err)
+	_, err = stmt.ExecContext(internal, "apac", 50)
+	assert.Error(t, err)
+	assert.NoError(t, stmt.Close())
+	assert.NoError(t, db.QueryRowContext(internal, "SELECT COUNT(*) FROM claims").Scan(&count))
+	assert.Equal(t, 3, count)
+
+	// Requests from outside the internal network are denied
+	_, err = db.QueryContext(abac.WithClientIP(context.Background(), net.ParseIP("203.0.113.7")), "SELECT id FROM claims")
+	assert.Error(t, err)
+	assert.IsType(t, &DBError{}, err)
+
+	// Outside business hours the decision falls back to RBAC, which has no grant
+	now = now.Add(12 * time.Hour)
+	_, err = db.QueryContext(internal, "SELECT id FROM claims")
+	assert.Error(t, err)
+}
+
+func TestABACPolicyColumns(t *testing.T) {
+	db, _, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	_, err := db.Exec("CREATE TABLE claims (id INTEGER PRIMARY KEY, region TEXT NOT NULL, ssn TEXT)")
+	assert.NoError(t, err)
+	_, err = db.sqlDB.Exec("INSERT INTO claims (region, ssn) VALUES ('emea', '111-22-3333')")
+	assert.NoError(t, err)
+	assert.NoError(t, db.AddABACPolicy(abac.Policy{
+		Name:    "regions",
+		Effect:  abac.Allow,
+		Actions: []permissions.Action{permissions.Select},
+		Tables:  []string{"claims"},
+		Columns: []string{"region"},
+	}))
+
+	// The allow policy only covers statements that reference no other column,
+	// in any clause or through *
+	rows, err := db.Query("SELECT region FROM claims ORDER BY region")
+	if assert.NoError(t, err) {
+		rows.Close()
+	}
+	for _, query := range []string{
+		"SELECT * FROM claims",
+		"SELECT claims.* FROM claims",
+		"SELECT region, ssn || '' FROM claims",
+		"SELECT region FROM claims WHERE ssn LIKE '111%'",
+		"SELECT region FROM claims GROUP BY region HAVING max(ssn) > ''",
+		"SELECT region FROM claims WHERE id IN (SELECT id FROM claims WHERE ssn IS NOT NULL)",
+	} {
+		_, err := db.Query(query)
+		assert.Error(t, err, query)
+	}
+
+	// A deny policy on a column covers every reference to it
+	assert.NoError(t, db.RemoveABACPolicy("regions"))
+	db.authProvider.(*auth.MemoryProvider).AddPermission(db.username, permissions.Permission{
+		Type:  permissions.TablePermission,
+		Table: "claims",
+	})
+	assert.NoError(t, db.AddABACPolicy(abac.Policy{
+		Name:    "no-ssn",
+		Effect:  abac.Deny,
+		Tables:  []string{"claims"},
+		Columns: []string{"ssn"},
+	}))
+	rows, err = db.Query("SELECT id, region FROM claims")
+	if assert.NoError(t, err) {
+		rows.Close()
+	}
+	for _, query := range []string{
+		"SELECT * FROM claims",
+		"SELECT length(ssn) FROM claims",
+		"SELECT id FROM claims WHERE ssn LIKE '111%'",
+		"UPDATE claims SET region = ssn",
+	} {
+		_, err := db.Exec(query)
+		var dbErr *DBError
+		if assert.ErrorAs(t, err, &dbErr, query) {
+			assert.Equal(t, "PERMISSION_DENIED", dbErr.Code, query)
+		}
+	}
+}
+
+func TestABACPolicyPrivileges(t *testing.T) {
+	db, path, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	_, err := db.Exec("CREATE TABLE secrets (id INTEGER PRIMARY KEY, value TEXT)")
+	assert.NoError(t, err)
+	_, err = db.sqlDB.Exec("INSERT INTO secrets (value) VALUES ('launch code')")
+	assert.NoError(t, err)
+
+	var events []audit.Event
+	sink := audit.SinkFunc(func(ctx context.Context, event audit.Event) error {
+		events = append(events, event)
+		return nil
+	})
+	policies := abac.NewABACManager()
+	assert.NoError(t, db.CreateUser("eve", "evetoken"))
+	eve, err := Open(path, db.authProvider, "eve", "evetoken", WithHardened(), WithABAC(policies), WithAuditSink(sink))
+	assert.NoError(t, err)
+	defer eve.Close()
+
+	// A user without ManageRoles cannot permit themselves access
+	_, err = eve.Query("SELECT value FROM secrets")
+	assert.Error(t, err)
+	err = eve.AddABACPolicy(abac.Policy{Name: "everything", Effect: abac.Allow, Tables: []string{"*"}})
+	if dbErr, ok := err.(*DBError); assert.True(t, ok) {
+		assert.Equal(t, "PERMISSION_DENIED", dbErr.Code)
+	}
+	assert.Empty(t, policies.Policies())
+	_, err = eve.Query("SELECT value FROM secrets")
+	assert.Error(t, err)
+
+	// Refused changes are recorded
+	var refused []audit.Event
+	for _, event := range events {
+		if event.Type == audit.EventRBACChange {
+			refused = append(refused, event)
+		}
+	}
+	if assert.Len(t, refused, 1) {
+		assert.Equal(t, "add_abac_policy", refused[0].Operation)
+		assert.Equal(t, audit.Deny, refused[0].Decision)
+		assert.Equal(t, "PERMISSION_DENIED", refused[0].ErrorCode)
+	}
+
+	// Policies added by the application apply to every handle sharing them,
+	// and cannot be removed by the user
+	assert.NoError(t, policies.AddPolicy(abac.Policy{Name: "deny-secrets", Effect: abac.Deny, Tables: []string{"secrets"}}))
+	assert.Error(t, eve.RemoveABACPolicy("deny-secrets"))
+	assert.Len(t, policies.Policies(), 1)
+}
+
+func TestAccessControlStatements(t *testing.T) {
+	db, path, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	_, err := db.Exec(`
+		CREATE TABLE orders (
+			id INTEGER PRIMARY KEY,
+			region TEXT NOT NULL,
+			amount INTEGER NOT NULL
+		)
+	`)
+	assert.NoError(t, err)
+	_, err = db.sqlDB.Exec("INSERT INTO orders (region, amount) VALUES ('emea', 10), ('emea', 20), ('apac', 30)")
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.CreateUser("alice", "alicetoken"))
+	alice, err := Open(path, db.authProvider, "alice", "alicetoken")
+	assert.NoError(t, err)
+	defer alice.Close()
+
+	for _, stmt := range []string{
+		"CREATE ROLE analyst",
+		"CREATE ROLE IF NOT EXISTS analyst",
+		"GRANT SELECT (id, amount) ON orders TO analyst",
+		"GRANT analyst TO alice",
+	} {
+		_, err = db.Exec(stmt)
+		assert.NoError(t, err, stmt)
+	}
+
+	// Alice gets the permissions of the role
+	rows, err := alice.Query("SELECT id, amount FROM orders")
+	assert.NoError(t, err)
+	if err == nil {
+		rows.Close()
+	}
+
+	// Alice has no privileges to change access
+	for _, stmt := range []string{
+		"CREATE ROLE auditor",
+		"GRANT INSERT ON orders TO alice",
+		"CREATE POLICY everything ON orders USING (1 = 1)",
+	} {
+		_, err = alice.Exec(stmt)
+		if dbErr, ok := err.(*DBError); assert.True(t, ok, stmt) {
+			assert.Equal(t, "PERMISSION_DENIED", dbErr.Code, stmt)
+		}
+	}
+
+	_, err = db.Exec("REVOKE analyst FROM alice")
+	assert.NoError(t, err)
+	_, err = alice.Query("SELECT id FROM orders")
+	assert.Error(t, err)
+
+	// Row policies filter reads and check written rows
+	for _, stmt := range []string{
+		"GRANT analyst TO alice",
+		"GRANT SELECT, INSERT, UPDATE ON orders TO analyst",
+		"CREATE POLICY regional ON orders FOR ALL TO analyst USING (region = current_setting('region'))",
+	} {
+		_, err = db.Exec(stmt)
+		assert.NoError(t, err, stmt)
+	}
+	alice.SetSessionAttribute("region", "emea")
+
+	countOrders := func(handle *SecureSQLite) int {
+		rows, err := handle.Query("SELECT id FROM orders")
+		if !assert.NoError(t, err) {
+			return -1
+		}
+		defer rows.Close()
+		count := 0
+		for rows.Next() {
+			count++
+		}
+		return count
+	}
+	assert.Equal(t, 2, countOrders(alice))
+
+	// Policies are stored with the auth provider, so every handle enforces them
+	again, err := Open(path, db.authProvider, "alice", "alicetoken")
+	assert.NoError(t, err)
+	again.SetSessionAttribute("region", "apac")
+	assert.Equal(t, 1, countOrders(again))
+	again.Close()
+
+	// Users the policies of a table do not apply to see none of its rows
+	assert.NoError(t, db.CreateUser("bob", "bobtoken"))
+	_, err = db.Exec("GRANT SELECT ON orders TO bob")
+	assert.NoError(t, err)
+	bob, err := Open(path, db.authProvider, "bob", "bobtoken")
+	assert.NoError(t, err)
+	defer bob.Close()
+	assert.Equal(t, 0, countOrders(bob))
+
+	var count int
+	_, err = alice.Exec("INSERT INTO orders (region, amount) VALUES (?, ?)", "emea", 40)
+	assert.NoError(t, err)
+	_, err = alice.Exec("INSERT INTO orders (region, amount) VALUES (?, ?)", "apac", 50)
+	assert.Error(t, err)
+	_, err = alice.Exec("UPDATE orders SET region = 'apac' WHERE amount = ?", 10)
+	assert.Error(t, err)
+	_, err = alice.Exec("UPDATE orders SET amount = 15 WHERE amount = ?", 10)
+	assert.NoError(t, err)
+
+	// Rejected writes leave the table unchanged
+	err = db.sqlDB.QueryRow("SELECT COUNT(*) FROM orders WHERE region = 'apac'").Scan(&count)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	for _, stmt := range []string{
+		"DROP POLICY regional ON orders",
+		"DROP POLICY IF EXISTS regional ON orders",
+		"DROP ROLE analyst",
+	} {
+		_, err = db.Exec(stmt)
+		assert.NoError(t, err, stmt)
+	}
+	_, err = db.Exec("DROP ROLE analyst")
+	assert.Error(t, err)
+	_, err = db.Exec("DROP POLICY regional ON orders")
+	assert.Error(t, err)
+	_, err = alice.Query("SELECT id FROM orders")
+	assert.Error(t, err)
+
+	// Policies restrict the granted permissions but grant nothing themselves
+	_, err = db.Exec("CREATE POLICY everyone ON orders FOR SELECT USING (1 = 1)")
+	assert.NoError(t, err)
+	_, err = alice.Query("SELECT id FROM orders")
+	assert.Error(t, err)
+	assert.Equal(t, 4, countOrders(bob))
+}
+
+func TestSystemPrivileges(t *testing.T) {
+	db, path, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	assert.NoError(t, db.CreateUser("lead", "leadtoken"))
+	assert.Error(t, db.CreateUser("lead", "othertoken"))
+	lead, err := Open(path, db.authProvider, "lead", "leadtoken")
+	assert.NoError(t, err)
+	defer lead.Close()
+
+	// A normal user cannot grant themselves anything
+	_, err = lead.CreateRole("leads")
+	if dbErr, ok := err.(*DBError); assert.True(t, ok) {
+		assert.Equal(t, "PERMISSION_DENIED", dbErr.Code)
+	}
+	assert.Error(t, lead.CreateUser("eve", "evetoken"))
+	assert.Error(t, lead.GrantPrivilege("lead", permissions.Superuser, "", false))
+
+	// Users see their own roles and permissions, but not those of others
+	_, err = lead.GetEffectivePermissions("lead")
+	assert.NoError(t, err)
+	_, err = lead.GetUserRoles("lead")
+	assert.NoError(t, err)
+	_, err = lead.GetEffectivePermissions("testuser")
+	assert.Error(t, err)
+	_, err = lead.HasPrivilege("testuser", permissions.Superuser, "")
+	assert.Error(t, err)
+	_, err = lead.UserHasRole("testuser", "leads")
+	assert.Error(t, err)
+	_, err = lead.GetUserRoles("dev")
+	if dbErr, ok := err.(*DBError); assert.True(t, ok) {
+		assert.Equal(t, "PERMISSION_DENIED", dbErr.Code)
+	}
+
+	// Delegated privileges allow managing users and granting on a table
+	assert.NoError(t, db.GrantPrivilege("lead", permissions.ManageUsers, "", false))
+	assert.NoError(t, db.GrantPrivilege("lead", permissions.GrantTable, "projects", true))
+	assert.NoError(t, lead.CreateUser("dev", "devtoken"))
+	_, err = lead.Exec("GRANT SELECT ON projects TO dev")
+	assert.NoError(t, err)
+	_, err = lead.Exec("GRANT SELECT ON salaries TO dev")
+	assert.Error(t, err)
+
+	hasPrivilege, err := lead.HasPrivilege("lead", permissions.ManageRoles, "")
+	assert.NoError(t, err)
+	assert.False(t, hasPrivilege)
+
+	// WithSuperuser only bootstraps a store without a superuser
+	_, err = Open(path, db.authProvider, "lead", "leadtoken", WithSuperuser("lead"))
+	if dbErr, ok := err.(*DBError); assert.True(t, ok) {
+		assert.Equal(t, "BOOTSTRAP_ERROR", dbErr.Code)
+	}
+	hasPrivilege, err = db.HasPrivilege("lead", permissions.Superuser, "")
+	assert.NoError(t, err)
+	assert.False(t, hasPrivilege)
+
+	// Roles are listed by users who manage them
+	_, err = lead.ListRoles()
+	assert.Error(t, err)
+	_, err = db.CreateRole("leads")
+	assert.NoError(t, err)
+	assert.NoError(t, db.AssignRoleToUser("lead", "leads"))
+	members, err := db.RoleMembers("leads")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"lead"}, members)
+}
+
+func TestDelegatedGrants(t *testing.T) {
+	db, path, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	_, err := db.Exec("CREATE TABLE projects (id INTEGER PRIMARY KEY, name TEXT)")
+	assert.NoError(t, err)
+	for _, user := range []string{"lead", "dev"} {
+		assert.NoError(t, db.CreateUser(user, user+"token"))
+	}
+	lead, err := Open(path, db.authProvider, "lead", "leadtoken")
+	assert.NoError(t, err)
+	defer lead.Close()
+	dev, err := Open(path, db.authProvider, "dev", "devtoken")
+	assert.NoError(t, err)
+	defer dev.Close()
+
+	// A team lead with grant option re-grants access without being an admin
+	_, err = db.Exec("GRANT SELECT, INSERT ON projects TO lead WITH GRANT OPTION")
+	assert.NoError(t, err)
+	_, err = lead.Exec("GRANT SELECT ON projects TO dev")
+	assert.NoError(t, err)
+	_, err = lead.Exec("GRANT DELETE ON projects TO dev")
+	if dbErr, ok := err.(*DBError); assert.True(t, ok) {
+		assert.Equal(t, "PERMISSION_DENIED", dbErr.Code)
+	}
+	rows, err := dev.Query("SELECT id FROM projects")
+	assert.NoError(t, err)
+	if err == nil {
+		rows.Close()
+	}
+
+	// RESTRICT refuses to revoke a grant others depend on, CASCADE follows it
+	_, err = db.Exec("REVOKE GRANT OPTION FOR SELECT ON projects FROM lead RESTRICT")
+	assert.Error(t, err)
+	_, err = db.Exec("REVOKE GRANT OPTION FOR SELECT ON projects FROM lead CASCADE")
+	assert.NoError(t, err)
+	_, err = dev.Query("SELECT id FROM projects")
+	assert.Error(t, err)
+	rows, err = lead.Query("SELECT id FROM projects")
+	assert.NoError(t, err)
+	if err == nil {
+		rows.Close()
+	}
+}
+
+func TestBreakGlass(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "secure_sqlite_test_*.db")
+	assert.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+
+	var events []audit.Event
+	sink := audit.SinkFunc(func(ctx context.Context, event audit.Event) error {
+		events = append(events, event)
+		return nil
+	})
+	mockAuth := auth.NewMemoryProvider()
+	mockAuth.AddUser("admin", "admintoken")
+	db, err := Open(tmpFile.Name(), mockAuth, "admin", "admintoken", WithSuperuser("admin"))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE patients (id INTEGER PRIMARY KEY, name TEXT)")
+	assert.NoError(t, err)
+	_, err = db.Exec("CREATE TABLE billing (id INTEGER PRIMARY KEY, amount INTEGER)")
+	assert.NoError(t, err)
+	_, err = db.CreateRole("emergency")
+	assert.NoError(t, err)
+	_, err = db.Exec("GRANT SELECT ON patients TO emergency")
+	assert.NoError(t, err)
+	_, err = db.Exec("GRANT SELECT ON billing TO emergency")
+	assert.NoError(t, err)
+	for _, user := range []string{"oncall", "intern"} {
+		assert.NoError(t, db.CreateUser(user, user+"token"))
+	}
+
+	policy := BreakGlassPolicy{Role: "emergency", Responders: []string{"oncall"}, MaxDuration: time.Hour}
+	oncall, err := Open(tmpFile.Name(), mockAuth, "oncall", "oncalltoken", WithBreakGlass(policy), WithAuditSink(sink))
+	assert.NoError(t, err)
+	defer oncall.Close()
+	intern, err := Open(tmpFile.Name(), mockAuth, "intern", "interntoken", WithBreakGlass(policy), WithAuditSink(sink))
+	assert.NoError(t, err)
+	defer intern.Close()
+	events = nil
+
+	// Elevation requires a justification, a responder and a duration within the policy
+	ctx := context.Background()
+	_, err = oncall.BreakGlass(ctx, BreakGlassRequest{Role: "emergency"})
+	assert.Error(t, err)
+	_, err = intern.BreakGlass(ctx, BreakGlassRequest{Role: "emergency", Justification: "INC-42"})
+	if dbErr, ok := err.(*DBError); assert.True(t, ok) {
+		assert.Equal(t, "PERMISSION_DENIED", dbErr.Code)
+	}
+	_, err = oncall.BreakGlass(ctx, BreakGlassRequest{Role: "emergency", Justification: "INC-42", Duration: 2 * time.Hour})
+	assert.Error(t, err)
+	assert.Empty(t, events)
+
+	// The elevated handle reads the elevated tables, the original handle does not
+	elevated, err := oncall.BreakGlass(ctx, BreakGlassRequest{
+		Role:          "emergency",
+		Justification: "INC-42: patient records missing",
+		Tables:        []string{"patients"},
+	})
+	assert.NoError(t, err)
+	if !assert.Len(t, events, 1) {
+		return
+	}
+	assert.Equal(t, audit.EventBreakGlass, events[0].Type)
+	assert.Contains(t, events[0].Detail, "INC-42: patient records missing")
+	sessionID := events[0].SessionID
+	assert.NotEmpty(t, sessionID)
+
+	rows, err := elevated.Query("SELECT id, name FROM patients")
+	assert.NoError(t, err)
+	if err == nil {
+		rows.Close()
+	}
+	_, err = elevated.Query("SELECT id FROM billing")
+	assert.Error(t, err)
+	_, err = oncall.Query("SELECT id FROM patients")
+	assert.Error(t, err)
+
+	// Every statement on the elevated handle is flagged in the audit log
+	var statements []string
+	for _, event := range events {
+		if event.Type == audit.EventBreakGlassStatement {
+			assert.True(t, event.BreakGlass)
+			assert.Equal(t, sessionID, event.SessionID)
+			statements = append(statements, event.Statement)
+		}
+	}
+	assert.Equal(t, []string{"SELECT id, name FROM patients", "SELECT id FROM billing"}, statements)
+
+	// Closing the elevated handle ends the elevation but not the database
+	assert.NoError(t, elevated.Close())
+	assert.Equal(t, audit.EventBreakGlassEnded, events[len(events)-1].Type)
+	_, err = elevated.Query("SELECT id FROM patients")
+	if dbErr, ok := err.(*DBError); assert.True(t, ok) {
+		assert.Equal(t, "ELEVATION_EXPIRED", dbErr.Code)
+	}
+	assert.NoError(t, oncall.Ping())
+}
+
+func TestBreakGlassTableRoles(t *testing.T) {
+	db, path, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	sink := audit.SinkFunc(func(ctx context.Context, event audit.Event) error { return nil })
+	for _, stmt := range []string{
+		"CREATE TABLE patients (id INTEGER PRIMARY KEY, name TEXT)",
+		"CREATE TABLE billing (id INTEGER PRIMARY KEY, amount INTEGER, card TEXT)",
+		"CREATE ROLE clerk",
+		"CREATE ROLE emergency",
+		"GRANT SELECT ON billing TO clerk",
+		"GRANT SELECT ON patients TO emergency",
+		"GRANT SELECT ON billing TO emergency",
+		"CREATE POLICY small ON billing FOR SELECT TO clerk USING (amount < 100)",
+		"CREATE POLICY everything ON billing FOR SELECT TO emergency USING (1 = 1)",
+	} {
+		_, err := db.Exec(stmt)
+		assert.NoError(t, err, stmt)
+	}
+	_, err := db.sqlDB.Exec("INSERT INTO patients (name) VALUES ('Ada')")
+	assert.NoError(t, err)
+	_, err = db.sqlDB.Exec("INSERT INTO billing (amount, card) VALUES (10, '4111111111111111'), (500, '5500000000000004')")
+	assert.NoError(t, err)
+	assert.NoError(t, db.CreateUser("oncall", "oncalltoken"))
+	assert.NoError(t, db.AssignRoleToUser("oncall", "clerk"))
+
+	rules := masking.NewManager()
+	for _, table := range []string{"patients", "billing"} {
+		assert.NoError(t, rules.AddRule(masking.Rule{Name: table + "-emergency", Table: table, Columns: []string{"name", "card"}, Roles: []string{"emergency"}, Mask: masking.Unmasked}))
+		assert.NoError(t, rules.AddRule(masking.Rule{Name: table, Table: table, Columns: []string{"name", "card"}, Mask: masking.Redact}))
+	}
+	policy := BreakGlassPolicy{Role: "emergency", Responders: []string{"oncall"}}
+	oncall, err := Open(path, db.authProvider, "oncall", "oncalltoken", WithBreakGlass(policy), WithAuditSink(sink), WithMasking(rules))
+	assert.NoError(t, err)
+	defer oncall.Close()
+	elevated, err := oncall.BreakGlass(context.Background(), BreakGlassRequest{
+		Role:          "emergency",
+		Justification: "INC-7",
+		Tables:        []string{"patients"},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer elevated.Close()
+
+	// The emergency role lifts the mask on the elevated table
+	assert.Equal(t, []string{"Ada"}, queryStrings(t, elevated, "SELECT name FROM patients"))
+
+	// but not the row policies and masks of other tables
+	assert.Equal(t, []string{"****"}, queryStrings(t, elevated, "SELECT card FROM billing"))
+}
+
+// queryStrings returns the first column of the rows of a query
+func queryStrings(t *testing.T, db *SecureSQLite, query string) []string {
+	rows, err := db.Query(query)
+	if !assert.NoError(t, err, query) {
+		return nil
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var value string
+		assert.NoError(t, rows.Scan(&value))
+		values = append(values, value)
+	}
+	assert.NoError(t, rows.Err())
+	return values
+}
+
+func TestAccessRequests(t *testing.T) {
+	db, path, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	_, err := db.Exec("CREATE TABLE invoices (id INTEGER PRIMARY KEY, total INTEGER)")
+	assert.NoError(t, err)
+	_, err = db.CreateRole("finance_approvers")
+	assert.NoError(t, err)
+	for _, user := range []string{"clerk", "manager"} {
+		assert.NoError(t, db.CreateUser(user, user+"token"))
+	}
+	assert.NoError(t, db.AssignRoleToUser("manager", "finance_approvers"))
+
+	workflow, err := rbac.NewAccessWorkflow(rbac.System(db.authProvider), rbac.AccessWorkflowConfig{
+		ApproverRole: "finance_approvers",
+	})
+	assert.NoError(t, err)
+	clerk, err := Open(path, db.authProvider, "clerk", "clerktoken", WithAccessWorkflow(workflow))
+	assert.NoError(t, err)
+	defer clerk.Close()
+	manager, err := Open(path, db.authProvider, "manager", "managertoken", WithAccessWorkflow(workflow))
+	assert.NoError(t, err)
+	defer manager.Close()
+
+	// The clerk requests read access, which the manager approves
+	ctx := context.Background()
+	_, err = clerk.Query("SELECT id FROM invoices")
+	assert.Error(t, err)
+	request, err := clerk.RequestAccess(ctx, rbac.AccessRequest{
+		Grant:         &rbac.GrantPolicy{Table: "invoices", Actions: []string{"select"}},
+		Justification: "month-end reconciliation",
+		Duration:      time.Hour,
+	})
+	assert.NoError(t, err)
+	_, err = clerk.ApproveAccessRequest(ctx, request.ID)
+	if dbErr, ok := err.(*DBError); assert.True(t, ok) {
+		assert.Equal(t, "PERMISSION_DENIED", dbErr.Code)
+	}
+	pending, err := manager.AccessRequests(ctx, rbac.AccessRequestFilter{Status: rbac.RequestPending})
+	assert.NoError(t, err)
+	assert.Len(t, pending, 1)
+	request, err = manager.ApproveAccessRequest(ctx, request.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, rbac.RequestApproved, request.Status)
+
+	rows, err := clerk.Query("SELECT id FROM invoices")
+	assert.NoError(t, err)
+	if err == nil {
+		rows.Close()
+	}
+	_, err = manager.DenyAccessRequest(ctx, 42, "unknown")
+	if dbErr, ok := err.(*DBError); assert.True(t, ok) {
+		assert.Equal(t, "ACCESS_REQUEST_NOT_FOUND", dbErr.Code)
+	}
+	_, err = db.RequestAccess(ctx, rbac.AccessRequest{Role: "finance_approvers", Justification: "audit"})
+	if dbErr, ok := err.(*DBError); assert.True(t, ok) {
+		assert.Equal(t, "ACCESS_REQUEST_ERROR", dbErr.Code)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "secure_sqlite_test_*.db")
+	assert.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+
+	var events []audit.Event
+	sink := audit.SinkFunc(func(ctx context.Context, event audit.Event) error {
+		events = append(events, event)
+		return nil
+	})
+	mockAuth := auth.NewMemoryProvider()
+	mockAuth.AddUser("admin", "admintoken")
+	db, err := Open(tmpFile.Name(), mockAuth, "admin", "admintoken", WithSuperuser("admin"), WithAuditSink(sink))
+	assert.NoError(t, err)
+	defer db.Close()
+	_, err = Open(tmpFile.Name(), mockAuth, "admin", "wrongtoken", WithAuditSink(sink))
+	assert.Error(t, err)
+
+	// Authentications are recorded with their session
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, audit.EventAuthentication, events[0].Type)
+		assert.Equal(t, audit.Allow, events[0].Decision)
+		assert.Equal(t, db.SessionID(), events[0].SessionID)
+		assert.Equal(t, audit.Deny, events[1].Decision)
+		assert.Equal(t, "AUTH_ERROR", events[1].ErrorCode)
+	}
+
+	_, err = db.Exec("CREATE TABLE orders (id INTEGER PRIMARY KEY, region TEXT, total INTEGER)")
+	assert.NoError(t, err)
+	_, err = db.Exec("CREATE TABLE customers (id INTEGER PRIMARY KEY, name TEXT)")
+	assert.NoError(t, err)
+	assert.NoError(t, db.CreateUser("analyst", "analysttoken"))
+	_, err = db.Exec("GRANT SELECT ON orders TO analyst")
+	assert.NoError(t, err)
+	analyst, err := Open(tmpFile.Name(), mockAuth, "analyst", "analysttoken", WithAuditSink(sink))
+	assert.NoError(t, err)
+	defer analyst.Close()
+
+	// Statements are recorded with their decision, whether allowed or not
+	events = nil
+	rows, err := analyst.Query("SELECT id, total FROM orders")
+	assert.NoError(t, err)
+	if err == nil {
+		rows.Close()
+	}
+	_, err = analyst.Exec("DELETE FROM customers")
+	assert.Error(t, err)
+	var total int
+	assert.Error(t, analyst.QueryRow("SELECT total FROM customers").Scan(&total))
+	_, err = analyst.Prepare("UPDATE customers SET name = ?")
+	assert.Error(t, err)
+	_, err = analyst.Exec("GRANT SELECT ON orders TO admin")
+	assert.Error(t, err)
+
+	if assert.Len(t, events, 6) {
+		query := events[0]
+		assert.Equal(t, audit.EventStatement, query.Type)
+		assert.Equal(t, "analyst", query.Principal)
+		assert.Equal(t, analyst.SessionID(), query.SessionID)
+		assert.Equal(t, "query", query.Operation)
+		assert.Equal(t, "SELECT id, total FROM orders", query.Statement)
+		assert.NotEmpty(t, query.Rewritten)
+		assert.Equal(t, []string{"orders"}, query.Tables)
+		assert.Equal(t, []string{"id", "total"}, query.Columns)
+		assert.Equal(t, "select", query.Action)
+		assert.Equal(t, audit.Allow, query.Decision)
+		assert.Equal(t, "grant select on orders", query.Rule)
+
+		assert.Equal(t, "exec", events[1].Operation)
+		assert.Equal(t, audit.Deny, events[1].Decision)
+		assert.Equal(t, "PERMISSION_DENIED", events[1].ErrorCode)
+		assert.Equal(t, "query_row", events[2].Operation)
+		assert.Equal(t, audit.Deny, events[2].Decision)
+		assert.Equal(t, "prepare", events[3].Operation)
+		assert.Equal(t, audit.Deny, events[3].Decision)
+
+		// Access control statements also record the refused RBAC change
+		assert.Equal(t, audit.EventRBACChange, events[4].Type)
+		assert.Equal(t, "grant", events[4].Operation)
+		assert.Equal(t, analyst.SessionID(), events[4].SessionID)
+		assert.Equal(t, "PERMISSION_DENIED", events[4].ErrorCode)
+		assert.Equal(t, audit.EventStatement, events[5].Type)
+		assert.Equal(t, audit.Deny, events[5].Decision)
+	}
+
+	// A statement whose decision cannot be recorded is not executed
+	failing, err := Open(tmpFile.Name(), mockAuth, "admin", "admintoken", WithAuditSink(audit.SinkFunc(func(ctx context.Context, event audit.Event) error {
+		if event.Type == audit.EventStatement {
+			return assert.AnError
+		}
+		return nil
+	})))
+	assert.NoError(t, err)
+	defer failing.Close()
+	_, err = failing.Exec("CREATE TABLE shipments (id INTEGER PRIMARY KEY)")
+	if dbErr, ok := err.(*DBError); assert.True(t, ok) {
+		assert.Equal(t, "AUDIT_ERROR", dbErr.Code)
+	}
+	var count int
+	assert.NoError(t, db.sqlDB.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'shipments'").Scan(&count))
+	assert.Equal(t, 0, count)
+}
+
+func TestChangeHistory(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "secure_sqlite_test_*.db")
+	assert.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+
+	var events []audit.Event
+	sink := audit.SinkFunc(func(ctx context.Context, event audit.Event) error {
+		events = append(events, event)
+		return nil
+	})
+	mockAuth := auth.NewMemoryProvider()
+	mockAuth.AddUser("admin", "admintoken")
+	mockAuth.AddUser("clerk", "clerktoken")
+	db, err := Open(tmpFile.Name(), mockAuth, "admin", "admintoken", WithSuperuser("admin"))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE orders (id INTEGER PRIMARY KEY, region TEXT, total INTEGER)")
+	assert.NoError(t, err)
+	_, err = db.sqlDB.Exec("INSERT INTO orders (region, total) VALUES ('eu', 100), ('us', 200), ('eu', 300)")
+	assert.NoError(t, err)
+
+	// The clerk only sees orders from the EU
+	mockAuth.AddPermission("clerk", permissions.Permission{
+		Type:  permissions.TablePermission,
+		Table: "orders",
+	})
+	mockAuth.AddPermission("clerk", permissions.Permission{
+		Type:      permissions.RowPermission,
+		Table:     "orders",
+		Condition: "region = 'eu'",
+	})
+	clerk, err := Open(tmpFile.Name(), mockAuth, "clerk", "clerktoken", WithChangeHistory("orders"), WithAuditSink(sink))
+	assert.NoError(t, err)
+	defer clerk.Close()
+
+	result, err := clerk.Exec("UPDATE orders SET total = total + ?", 1)
+	assert.NoError(t, err)
+	rowsAffected, err := result.RowsAffected()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), rowsAffected)
+	_, err = clerk.Exec("DELETE FROM orders WHERE id = ?", 3)
+	assert.NoError(t, err)
+
+	// Each change records the row before and after the statement
+	changes, err := db.RowHistory(context.Background(), "orders", 3)
+	assert.NoError(t, err)
+	if assert.Len(t, changes, 2) {
+		assert.Equal(t, "update", changes[0].Operation)
+		assert.Equal(t, "clerk", changes[0].Principal)
+		assert.Equal(t, clerk.SessionID(), changes[0].SessionID)
+		assert.Equal(t, "eu", changes[0].Before["region"])
+		assert.Equal(t, json.Number("300"), changes[0].Before["total"])
+		assert.Equal(t, json.Number("301"), changes[0].After["total"])
+		assert.Equal(t, "delete", changes[1].Operation)
+		assert.Equal(t, json.Number("301"), changes[1].Before["total"])
+		assert.Nil(t, changes[1].After)
+
+		// Statement IDs link changes to the audit log
+		if assert.Len(t, events, 3) {
+			assert.Equal(t, events[1].StatementID, changes[0].StatementID)
+			assert.Equal(t, events[2].StatementID, changes[1].StatementID)
+			assert.NotEqual(t, changes[0].StatementID, changes[1].StatementID)
+		}
+	}
+
+	// Rows hidden by row-level security are not changed, so they have no history
+	changes, err = db.RowHistory(context.Background(), "orders", 2)
+	assert.NoError(t, err)
+	assert.Empty(t, changes)
+
+	// Reading the history requires grant_table on the table
+	_, err = clerk.RowHistory(context.Background(), "orders", 3)
+	assert.Error(t, err)
+	if dbErr, ok := err.(*DBError); assert.True(t, ok) {
+		assert.Equal(t, "PERMISSION_DENIED", dbErr.Code)
+	}
+
+	// The history is append-only
+	_, err = db.sqlDB.Exec("DELETE FROM secure_sqlite_history")
+	assert.Error(t, err)
+}
+
+func TestSensitiveReads(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "secure_sqlite_test_*.db")
+	assert.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+
+	var events []audit.Event
+	sink := audit.SinkFunc(func(ctx context.Context, event audit.Event) error {
+		if event.Type == audit.EventSensitiveRead {
+			events = append(events, event)
+		}
+		return nil
+	})
+	mockAuth := auth.NewMemoryProvider()
+	mockAuth.AddUser("admin", "admintoken")
+	mockAuth.AddUser("nurse", "nursetoken")
+	db, err := Open(tmpFile.Name(), mockAuth, "admin", "admintoken", WithSuperuser("admin"))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE patients (id INTEGER PRIMARY KEY, name TEXT, ssn TEXT, ward TEXT)")
+	assert.NoError(t, err)
+	_, err = db.sqlDB.Exec("INSERT INTO patients (name, ssn, ward) VALUES ('ann', '111', 'a'), ('bob', '222', 'b'), ('cy', '333', 'a')")
+	assert.NoError(t, err)
+
+	// The nurse only sees patients of ward a
+	mockAuth.AddPermission("nurse", permissions.Permission{
+		Type:  permissions.TablePermission,
+		Table: "patients",
+	})
+	mockAuth.AddPermission("nurse", permissions.Permission{
+		Type:      permissions.RowPermission,
+		Table:     "patients",
+		Condition: "ward = 'a'",
+	})
+	nurse, err := Open(tmpFile.Name(), mockAuth, "nurse", "nursetoken", WithSensitiveColumns("patients", "ssn"), WithAuditSink(sink))
+	assert.NoError(t, err)
+	defer nurse.Close()
+
+	// Reads of sensitive columns record the keys of the rows returned, which
+	// stay hidden from the caller
+	rows, err := nurse.Query("SELECT name, ssn FROM patients")
+	assert.NoError(t, err)
+	columns, err := rows.Columns()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"name", "ssn"}, columns)
+	var ssns []string
+	for rows.Next() {
+		var name, ssn string
+		assert.NoError(t, rows.Scan(&name, &ssn))
+		ssns = append(ssns, ssn)
+	}
+	assert.NoError(t, rows.Err())
+	assert.NoError(t, rows.Close())
+	assert.Equal(t, []string{"111", "333"}, ssns)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, "nurse", events[0].Principal)
+		assert.Equal(t, []string{"patients"}, events[0].Tables)
+		assert.Equal(t, []string{"ssn"}, events[0].Columns)
+		assert.Equal(t, []string{"1", "3"}, events[0].Keys)
+		assert.Equal(t, "rows: 2; key: id", events[0].Detail)
+	}
+
+	// Only the rows the caller reads are recorded
+	events = nil
+	rows, err = nurse.Query("SELECT * FROM patients WHERE id > ?", 0)
+	assert.NoError(t, err)
+	columns, err = rows.Columns()
+	assert.NoError(t, err)
+	assert.Len(t, columns, 4)
+	assert.True(t, rows.Next())
+	var id int64
+	var name, ssn, ward string
+	assert.NoError(t, rows.Scan(&id, &name, &ssn, &ward))
+	assert.NoError(t, rows.Close())
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, []string{"1"}, events[0].Keys)
+	}
+
+	// Queries without sensitive columns are not recorded
+	events = nil
+	rows, err = nurse.Query("SELECT name FROM patients")
+	assert.NoError(t, err)
+	for rows.Next() {
+	}
+	assert.NoError(t, rows.Close())
+	assert.Empty(t, events)
+
+	// Keys cannot be captured for aggregates or QueryRow, but the read is recorded
+	var count int
+	assert.NoError(t, nurse.QueryRow("SELECT COUNT(ssn) FROM patients").Scan(&count))
+	rows, err = nurse.Query("SELECT COUNT(ssn) FROM patients")
+	assert.NoError(t, err)
+	assert.True(t, rows.Next())
+	assert.NoError(t, rows.Scan(&count))
+	assert.NoError(t, rows.Close())
+	assert.Equal(t, 2, count)
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, "query_row", events[0].Operation)
+		assert.Equal(t, "keys not captured", events[0].Detail)
+		assert.Equal(t, "query", events[1].Operation)
+		assert.Equal(t, "rows: 1; keys not captured", events[1].Detail)
+		assert.Empty(t, events[1].Keys)
+	}
+}
+
+func TestDataMasking(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "secure_sqlite_test_*.db")
+	assert.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+
+	mockAuth := auth.NewMemoryProvider()
+	mockAuth.AddUser("admin", "admintoken")
+	mockAuth.AddUser("clerk", "clerktoken")
+	mockAuth.AddUser("doc", "doctoken")
+	db, err := Open(tmpFile.Name(), mockAuth, "admin", "admintoken", WithSuperuser("admin"))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE patients (id INTEGER PRIMARY KEY, name TEXT, ssn TEXT, email TEXT)")
+	assert.NoError(t, err)
+	_, err = db.sqlDB.Exec("INSERT INTO patients (name, ssn, email) VALUES ('Ann Lee', '123-45-6789', 'ann@example.com'), ('Bob', NULL, 'bob@example.com')")
+	assert.NoError(t, err)
+	_, err = db.CreateRole("doctor")
+	assert.NoError(t, err)
+	assert.NoError(t, db.AssignRoleToUser("doc", "doctor"))
+	for _, user := range []string{"clerk", "doc"} {
+		mockAuth.AddPermission(user, permissions.Permission{
+			Type:  permissions.TablePermission,
+			Table: "patients",
+		})
+		mockAuth.AddPermission(user, permissions.Permission{
+			Type:   permissions.ColumnPermission,
+			Table:  "patients",
+			Column: "ssn",
+		})
+		mockAuth.AddPermission(user, permissions.Permission{
+			Type:      permissions.RowPermission,
+			Table:     "patients",
+			Condition: "id > 0",
+		})
+	}
+
+	// Doctors see raw values, everyone else sees masked ones
+	initials, err := masking.Register("test_initials", func(value interface{}) interface{} {
+		var initials string
+		for _, word := range strings.Fields(value.(string)) {
+			initials += word[:1] + "."
+		}
+		return initials
+	})
+	assert.NoError(t, err)
+	rules := masking.NewManager()
+	assert.NoError(t, rules.AddRule(masking.Rule{Name: "doctors", Table: "patients", Columns: []string{"name", "ssn", "email"}, Roles: []string{"doctor"}, Mask: masking.Unmasked}))
+	assert.NoError(t, rules.AddRule(masking.Rule{Name: "names", Table: "patients", Columns: []string{"name"}, Mask: initials}))
+	assert.NoError(t, rules.AddRule(masking.Rule{Name: "ssns", Table: "patients", Columns: []string{"ssn"}, Mask: masking.Last4}))
+	assert.NoError(t, rules.AddRule(masking.Rule{Name: "emails", Table: "patients", Columns: []string{"email"}, Mask: masking.Email}))
+
+	clerk, err := Open(tmpFile.Name(), mockAuth, "clerk", "clerktoken", WithMasking(rules))
+	assert.NoError(t, err)
+	defer clerk.Close()
+	doc, err := Open(tmpFile.Name(), mockAuth, "doc", "doctoken", WithMasking(rules))
+	assert.NoError(t, err)
+	defer doc.Close()
+
+	// Masked columns keep their names, and NULL stays NULL
+	rows, err := clerk.Query("SELECT * FROM patients WHERE id > ? ORDER BY id", 0)
+	assert.NoError(t, err)
+	columns, err := rows.Columns()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"id", "name", "ssn", "email"}, columns)
+	var got [][]interface{}
+	for rows.Next() {
+		var id int64
+		var name, email string
+		var ssn sql.NullString
+		assert.NoError(t, rows.Scan(&id, &name, &ssn, &email))
+		got = append(got, []interface{}{name, ssn.String, email})
+	}
+	assert.NoError(t, rows.Close())
+	assert.Equal(t, [][]interface{}{{"A.L.", "****6789", "a***@example.com"}, {"B.", "", "b***@example.com"}}, got)
+
+	var ssn string
+	assert.NoError(t, clerk.QueryRow("SELECT ssn FROM patients WHERE id = ?", 1).Scan(&ssn))
+	assert.Equal(t, "****6789", ssn)
+	assert.NoError(t, doc.QueryRow("SELECT ssn FROM patients WHERE id = ?", 1).Scan(&ssn))
+	assert.Equal(t, "123-45-6789", ssn)
+
+	// Masked columns cannot be used to find rows
+	for _, query := range []string{
+		"SELECT id FROM patients WHERE ssn LIKE '123%'",
+		"SELECT id FROM patients ORDER BY email",
+	} {
+		_, err = clerk.Query(query)
+		if assert.Error(t, err, query) {
+			assert.Equal(t, "PERMISSION_DENIED", err.(*DBError).Code)
+		}
+	}
+	_, err = clerk.Exec("DELETE FROM patients WHERE ssn = '123-45-6789'")
+	assert.Error(t, err)
+	_, err = doc.Query("SELECT id FROM patients WHERE ssn LIKE '123%'")
+	assert.NoError(t, err)
+}
+
+func TestColumnEncryption(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "secure_sqlite_test_*.db")
+	assert.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+	keys, err := encryption.CreateKeyFile(filepath.Join(t.TempDir(), "keys.json"))
+	assert.NoError(t, err)
+	columns := []encryption.Column{
+		{Table: "patients", Name: "ssn"},
+		{Table: "patients", Name: "email", Deterministic: true},
+	}
+
+	mockAuth := auth.NewMemoryProvider()
+	mockAuth.AddUser("admin", "admintoken")
+	mockAuth.AddUser("clerk", "clerktoken")
+	mockAuth.AddUser("doc", "doctoken")
+	db, err := Open(tmpFile.Name(), mockAuth, "admin", "admintoken", WithSuperuser("admin"))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE patients (id INTEGER PRIMARY KEY, name TEXT, ssn TEXT, email TEXT)")
+	assert.NoError(t, err)
+	_, err = db.sqlDB.Exec("INSERT INTO patients (name, ssn, email) VALUES ('Legacy', '000-00-0000', 'legacy@example.com')")
+	assert.NoError(t, err)
+	for _, user := range []string{"clerk", "doc"} {
+		mockAuth.AddPermission(user, permissions.Permission{
+			Type:  permissions.TablePermission,
+			Table: "patients",
+		})
+		for _, column := range []string{"name", "ssn", "email"} {
+			mockAuth.AddPermission(user, permissions.Permission{
+				Type:   permissions.ColumnPermission,
+				Table:  "patients",
+				Column: column,
+			})
+		}
+		mockAuth.AddPermission(user, permissions.Permission{
+			Type:      permissions.RowPermission,
+			Table:     "patients",
+			Condition: "id > 0",
+		})
+	}
+	assert.NoError(t, db.GrantPrivilege("doc", permissions.Decrypt, "patients", false))
+
+	clerk, err := Open(tmpFile.Name(), mockAuth, "clerk", "clerktoken", WithColumnEncryption(keys, columns...))
+	assert.NoError(t, err)
+	defer clerk.Close()
+	doc, err := Open(tmpFile.Name(), mockAuth, "doc", "doctoken", WithColumnEncryption(keys, columns...))
+	assert.NoError(t, err)
+	defer doc.Close()
+
+	// Values are encrypted on write, whoever writes them
+	_, err = clerk.Exec("INSERT INTO patients (name, ssn, email) VALUES (?, ?, ?)", "Ann", "123-45-6789", "ann@example.com")
+	assert.NoError(t, err)
+	var rawSSN, rawEmail string
+	assert.NoError(t, db.sqlDB.QueryRow("SELECT ssn, email FROM patients WHERE name = 'Ann'").Scan(&rawSSN, &rawEmail))
+	assert.True(t, strings.HasPrefix(rawSSN, "enc:"), rawSSN)
+	assert.NotContains(t, rawSSN, "6789")
+	assert.True(t, strings.HasPrefix(rawEmail, "enc:"), rawEmail)
+
+	// Only users with the decrypt privilege read the plaintext
+	var ssn, email string
+	assert.NoError(t, doc.QueryRow("SELECT ssn, email FROM patients WHERE name = ?", "Ann").Scan(&ssn, &email))
+	assert.Equal(t, "123-45-6789", ssn)
+	assert.Equal(t, "ann@example.com", email)
+	assert.NoError(t, clerk.QueryRow("SELECT ssn FROM patients WHERE name = ?", "Ann").Scan(&ssn))
+	assert.Equal(t, rawSSN, ssn)
+
+	// Deterministic columns support equality lookups, randomized ones do not
+	var name string
+	assert.NoError(t, clerk.QueryRow("SELECT name FROM patients WHERE email = ?", "ann@example.com").Scan(&name))
+	assert.Equal(t, "Ann", name)
+	_, err = doc.Query("SELECT name FROM patients WHERE ssn = ?", "123-45-6789")
+	if assert.Error(t, err) {
+		assert.Equal(t, "ENCRYPTION_ERROR", err.(*DBError).Code)
+	}
+	_, err = doc.Query("SELECT secure_decrypt('patients', 'ssn', ssn) FROM patients")
+	if assert.Error(t, err) {
+		assert.Equal(t, "PARSE_ERROR", err.(*DBError).Code)
+	}
+	_, err = db.Exec("CREATE VIEW leak AS SELECT secure_decrypt('patients', 'ssn', ssn) AS ssn FROM patients")
+	assert.Error(t, err)
+
+	// Only the connections of handles with the cipher can decrypt
+	var leaked string
+	err = db.sqlDB.QueryRow("SELECT secure_decrypt('patients', 'ssn', ssn) FROM patients WHERE name = 'Ann'").Scan(&leaked)
+	assert.ErrorContains(t, err, errNoCipher.Error())
+
+	// Updates are encrypted too
+	_, err = doc.Exec("UPDATE patients SET ssn = ? WHERE email = ?", "987-65-4321", "ann@example.com")
+	assert.NoError(t, err)
+	assert.NoError(t, doc.QueryRow("SELECT ssn FROM patients WHERE name = ?", "Ann").Scan(&ssn))
+	assert.Equal(t, "987-65-4321", ssn)
+
+	// Re-encryption requires the decrypt privilege, and moves plaintext and
+	// values under old keys to the current key
+	_, err = clerk.ReencryptTable(context.Background(), "patients")
+	assert.Error(t, err)
+	current, err := keys.Rotate()
+	assert.NoError(t, err)
+	n, err := doc.ReencryptTable(context.Background(), "patients")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+	rows, err := db.sqlDB.Query("SELECT ssn, email FROM patients")
+	assert.NoError(t, err)
+	for rows.Next() {
+		assert.NoError(t, rows.Scan(&rawSSN, &rawEmail))
+		for _, value := range []string{rawSSN, rawEmail} {
+			id, ok := encryption.KeyID(value)
+			assert.True(t, ok, value)
+			assert.Equal(t, current, id)
+		}
+	}
+	assert.NoError(t, rows.Close())
+	assert.NoError(t, doc.QueryRow("SELECT ssn FROM patients WHERE email = ?", "legacy@example.com").Scan(&ssn))
+	assert.Equal(t, "000-00-0000", ssn)
+	n, err = doc.ReencryptTable(context.Background(), "patients")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+}
+
+func TestRekeyUnencrypted(t *testing.T) {
+	dir := t.TempDir()
+	mockAuth := auth.NewMemoryProvider()
+	mockAuth.AddUser("admin", "admintoken")
+
+	plain, err := Open(filepath.Join(dir, "plain.db"), mockAuth, "admin", "admintoken", WithSuperuser("admin"))
+	assert.NoError(t, err)
+	err = plain.RekeyDatabase(context.Background())
+	if assert.Error(t, err) {
+		assert.Equal(t, "ENCRYPTION_ERROR", err.(*DBError).Code)
+	}
+	assert.NoError(t, plain.Close())
+}
+
+func TestDriver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "driver.db")
+	mockAuth := auth.NewMemoryProvider()
+	mockAuth.AddUser("admin", "admintoken")
+	mockAuth.AddUser("clerk", "clerktoken")
+	mockAuth.AddUser("guest", "guesttoken")
+	mockAuth.AddPermission("clerk", permissions.Permission{
+		Type:  permissions.TablePermission,
+		Table: "orders",
+	})
+	mockAuth.AddPermission("clerk", permissions.Permission{
+		Type:   permissions.ColumnPermission,
+		Table:  "orders",
+		Column: "item",
+	})
+	mockAuth.AddPermission("clerk", permissions.Permission{
+		Type:      permissions.RowPermission,
+		Table:     "orders",
+		Condition: "id > 0",
+	})
+	RegisterAuthProvider("driver_test", mockAuth)
+
+	admin, err := sql.Open(DriverName, path+"?_secure_auth=driver_test&_secure_user=admin&_secure_token=admintoken")
+	assert.NoError(t, err)
+	defer admin.Close()
+	assert.NoError(t, admin.Ping())
+	_, err = admin.Exec("CREATE TABLE orders (id INTEGER PRIMARY KEY, item TEXT)")
+	assert.NoError(t, err)
+	_, err = admin.Exec("CREATE TABLE secrets (id INTEGER PRIMARY KEY, value TEXT)")
+	assert.NoError(t, err)
+
+	// Statements run as the user of the connector, through the same checks
+	db := sql.OpenDB(NewConnector(path, mockAuth, "clerk", "clerktoken"))
+	defer db.Close()
+	_, err = db.Exec("INSERT INTO orders (item) VALUES (?)", "book")
+	assert.NoError(t, err)
+	var item string
+	assert.NoError(t, db.QueryRow("SELECT item FROM orders WHERE id = ?", 1).Scan(&item))
+	assert.Equal(t, "book", item)
+	_, err = db.Query("SELECT value FROM secrets")
+	assert.Error(t, err)
+
+	// Tables reached through joins and subqueries are checked as well
+	for _, query := range []string{
+		"SELECT s.value FROM orders o JOIN secrets s ON s.id = o.id",
+		"SELECT item FROM orders WHERE id IN (SELECT id FROM secrets)",
+		"SELECT item FROM orders UNION SELECT value FROM secrets",
+		"SELECT v FROM (SELECT value AS v FROM secrets) AS t",
+	} {
+		_, err = db.Query(query)
+		if assert.Error(t, err, query) {
+			assert.Equal(t, "PERMISSION_DENIED", err.(*DBError).Code, query)
+		}
+		assert.Error(t, db.QueryRow(query).Scan(&item), query)
+		_, err = db.Prepare(query)
+		assert.Error(t, err, query)
+	}
+	_, err = db.Exec("INSERT INTO orders (item) SELECT value FROM secrets")
+	assert.Error(t, err)
+
+	// The context overrides the user
+	guest := WithPrincipal(context.Background(), "guest", "guesttoken")
+	_, err = db.QueryContext(guest, "SELECT item FROM orders")
+	if assert.Error(t, err) {
+		assert.Equal(t, "PERMISSION_DENIED", err.(*DBError).Code)
+	}
+	_, err = db.QueryContext(WithPrincipal(context.Background(), "guest", "wrong"), "SELECT item FROM orders")
+	assert.Error(t, err)
+
+	// Transactions run their checked statements on one connection
+	tx, err := db.Begin()
+	assert.NoError(t, err)
+	_, err = tx.Exec("INSERT INTO orders (item) VALUES (?)", "pen")
+	assert.NoError(t, err)
+	rows, err := tx.Query("SELECT item FROM orders")
+	assert.NoError(t, err)
+	var items []string
+	for rows.Next() {
+		assert.NoError(t, rows.Scan(&item))
+		items = append(items, item)
+	}
+	assert.NoError(t, rows.Close())
+	assert.Equal(t, []string{"book", "pen"}, items)
+	_, err = tx.ExecContext(guest, "INSERT INTO orders (item) VALUES (?)", "cup")
+	assert.Error(t, err)
+	assert.NoError(t, tx.Rollback())
+	var count int
+	assert.NoError(t, db.QueryRow("SELECT count(item) FROM orders").Scan(&count))
+	assert.Equal(t, 1, count)
+
+	// Prepared statements are checked when they are prepared and when they run
+	stmt, err := db.Prepare("INSERT INTO orders (item) VALUES (?)")
+	assert.NoError(t, err)
+	for _, item := range []string{"cup", "mug"} {
+		_, err = stmt.Exec(item)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, stmt.Close())
+	_, err = db.PrepareContext(guest, "INSERT INTO orders (item) VALUES (?)")
+	assert.Error(t, err)
+	assert.NoError(t, db.QueryRow("SELECT count(item) FROM orders").Scan(&count))
+	assert.Equal(t, 3, count)
+
+	// Statements that need a transaction of their own use a savepoint
+	history := sql.OpenDB(NewConnector(path, mockAuth, "clerk", "clerktoken", WithChangeHistory("orders")))
+	defer history.Close()
+	tx, err = history.Begin()
+	assert.NoError(t, err)
+	_, err = tx.Exec("UPDATE orders SET item = ? WHERE id = ?", "novel", 1)
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit())
+	assert.NoError(t, db.QueryRow("SELECT item FROM orders WHERE id = ?", 1).Scan(&item))
+	assert.Equal(t, "novel", item)
+
+	// Without a user, statements must name one
+	anonymous := sql.OpenDB(NewConnector(path, mockAuth, "", ""))
+	defer anonymous.Close()
+	_, err = anonymous.Exec("INSERT INTO orders (item) VALUES ('x')")
+	assert.Error(t, err)
+	_, err = anonymous.ExecContext(WithPrincipal(context.Background(), "clerk", "clerktoken"), "INSERT INTO orders (item) VALUES ('x')")
+	assert.NoError(t, err)
+}
+
+func TestDriverSharesHandles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shared.db")
+	mockAuth := auth.NewMemoryProvider()
+	for _, user := range []string{"clerk", "guest"} {
+		mockAuth.AddUser(user, user+"token")
+		mockAuth.AddPermission(user, permissions.Permission{
+			Type:  permissions.TablePermission,
+			Table: "orders",
+		})
+		mockAuth.AddPermission(user, permissions.Permission{
+			Type:   permissions.ColumnPermission,
+			Table:  "orders",
+			Column: "item",
+		})
+	}
+	raw, err := sql.Open("sqlite3", path)
+	assert.NoError(t, err)
+	_, err = raw.Exec("CREATE TABLE orders (id INTEGER PRIMARY KEY, item TEXT)")
+	assert.NoError(t, err)
+	assert.NoError(t, raw.Close())
+
+	// Every connection of the pool runs statements of both users through the
+	// same two handles
+	connector := NewConnector(path, mockAuth, "clerk", "clerktoken")
+	db := sql.OpenDB(connector)
+	ctx := context.Background()
+	guest := WithPrincipal(ctx, "guest", "guesttoken")
+	var conns []*sql.Conn
+	for i := 0; i < 4; i++ {
+		c, err := db.Conn(ctx)
+		assert.NoError(t, err)
+		conns = append(conns, c)
+		for _, ctx := range []context.Context{ctx, guest} {
+			_, err = c.ExecContext(ctx, "INSERT INTO orders (item) VALUES (?)", "book")
+			assert.NoError(t, err)
+			tx, err := c.BeginTx(ctx, nil)
+			assert.NoError(t, err)
+			_, err = tx.ExecContext(ctx, "INSERT INTO orders (item) VALUES (?)", "pen")
+			assert.NoError(t, err)
+			assert.NoError(t, tx.Commit())
+		}
+	}
+	assert.Len(t, connector.handles, 2)
+	sessions, err := mockAuth.ListSessions()
+	assert.NoError(t, err)
+	assert.Len(t, sessions, 2)
+	var count int
+	assert.NoError(t, db.QueryRow("SELECT count(item) FROM orders").Scan(&count))
+	assert.Equal(t, 16, count)
+
+	// Closing the pool closes the handles and ends their sessions
+	for _, c := range conns {
+		assert.NoError(t, c.Close())
+	}
+	assert.NoError(t, db.Close())
+	assert.Empty(t, connector.handles)
+	sessions, err = mockAuth.ListSessions()
+	assert.NoError(t, err)
+	assert.Empty(t, sessions)
+}
+
+func TestDriverPreparedRowSecurity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "driver_rows.db")
+	mockAuth := auth.NewMemoryProvider()
+	mockAuth.AddUser("admin", "admintoken")
+	mockAuth.AddUser("agent", "agenttoken")
+	for _, action := range []permissions.Action{permissions.Select, permissions.Update} {
+		mockAuth.AddPermission("agent", permissions.Permission{Type: permissions.TablePermission, Table: "tickets", Action: action})
+		for _, column := range []string{"id", "owner", "title"} {
+			mockAuth.AddPermission("agent", permissions.Permission{Type: permissions.ColumnPermission, Table: "tickets", Column: column, Action: action})
+		}
+		mockAuth.AddPermission("agent", permissions.Permission{Type: permissions.RowPermission, Table: "tickets", Condition: "owner = 'agent'", Action: action})
+	}
+
+	admin, err := Open(path, mockAuth, "admin", "admintoken", WithSuperuser("admin"))
+	assert.NoError(t, err)
+	defer admin.Close()
+	_, err = admin.Exec("CREATE TABLE tickets (id INTEGER PRIMARY KEY, owner TEXT, title TEXT)")
+	assert.NoError(t, err)
+	_, err = admin.sqlDB.Exec("INSERT INTO tickets (owner, title) VALUES ('agent', 'mine'), ('other', 'theirs')")
+	assert.NoError(t, err)
+
+	db := sql.OpenDB(NewConnector(path, mockAuth, "agent", "agenttoken", WithChangeHistory("tickets")))
+	defer db.Close()
+
+	// Prepared queries only see the rows the user may read
+	query, err := db.Prepare("SELECT title FROM tickets WHERE id > ?")
+	assert.NoError(t, err)
+	defer query.Close()
+	rows, err := query.Query(0)
+	assert.NoError(t, err)
+	var titles []string
+	for rows.Next() {
+		var title string
+		assert.NoError(t, rows.Scan(&title))
+		titles = append(titles, title)
+	}
+	assert.NoError(t, rows.Close())
+	assert.Equal(t, []string{"mine"}, titles)
+
+	// Prepared writes leave other rows alone and record their changes
+	update, err := db.Prepare("UPDATE tickets SET title = ? WHERE id = ?")
+	assert.NoError(t, err)
+	defer update.Close()
+	for id, want := range map[int64]int64{1: 1, 2: 0} {
+		result, err := update.Exec("changed", id)
+		if assert.NoError(t, err) {
+			affected, err := result.RowsAffected()
+			assert.NoError(t, err)
+			assert.Equal(t, want, affected, "rows affected updating ticket %d", id)
+		}
+	}
+	var title string
+	assert.NoError(t, admin.sqlDB.QueryRow("SELECT title FROM tickets WHERE id = 2").Scan(&title))
+	assert.Equal(t, "theirs", title)
+	changes, err := admin.RowHistory(context.Background(), "tickets", 1)
+	assert.NoError(t, err)
+	if assert.Len(t, changes, 1) {
+		assert.Equal(t, "agent", changes[0].Principal)
+	}
+	changes, err = admin.RowHistory(context.Background(), "tickets", 2)
+	assert.NoError(t, err)
+	assert.Empty(t, changes)
+}
+
+func TestHardenedMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hardened.db")
+	var events []audit.Event
+	sink := audit.SinkFunc(func(ctx context.Context, event audit.Event) error {
+		if event.Operation == operationUnsafe {
+			events = append(events, event)
+		}
+		return nil
+	})
+	mockAuth := auth.NewMemoryProvider()
+	mockAuth.AddUser("admin", "admintoken")
+	mockAuth.AddUser("dba", "dbatoken")
+	mockAuth.AddUser("dev", "devtoken")
+	db, err := Open(path, mockAuth, "admin", "admintoken", WithSuperuser("admin"), WithHardened(), WithAuditSink(sink))
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.NoError(t, db.GrantPrivilege("dba", permissions.RawAccess, "", false))
+
+	// The underlying connection is not exposed
+	assert.Nil(t, db.DB())
+	_, err = db.Begin()
+	assert.Error(t, err)
+	_, err = db.Exec("CREATE TABLE notes (id INTEGER PRIMARY KEY, body TEXT)")
+	assert.NoError(t, err)
+
+	// Only privileged users get it, with a reason, and every attempt is audited
+	dba, err := Open(path, mockAuth, "dba", "dbatoken", WithHardened(), WithAuditSink(sink))
+	assert.NoError(t, err)
+	defer dba.Close()
+	dev, err := Open(path, mockAuth, "dev", "devtoken", WithHardened(), WithAuditSink(sink))
+	assert.NoError(t, err)
+	defer dev.Close()
+	_, err = dev.Unsafe(context.Background(), "migration")
+	if assert.Error(t, err) {
+		assert.Equal(t, "PERMISSION_DENIED", err.(*DBError).Code)
+	}
+	_, err = dba.Unsafe(context.Background(), " ")
+	assert.Error(t, err)
+	raw, err := dba.Unsafe(context.Background(), "schema migration 42")
+	assert.NoError(t, err)
+	_, err = raw.Exec("INSERT INTO notes (body) VALUES ('raw')")
+	assert.NoError(t, err)
+
+	if assert.Len(t, events, 3) {
+		assert.Equal(t, audit.Deny, events[0].Decision)
+		assert.Equal(t, "dev", events[0].Principal)
+		assert.Equal(t, audit.Allow, events[2].Decision)
+		assert.Equal(t, "dba", events[2].Principal)
+		assert.Equal(t, "schema migration 42", events[2].Detail)
+		assert.Equal(t, "raw_access", events[2].Rule)
+	}
+
+	// Unsafe is audited, so it needs a sink
+	unaudited, err := Open(path, mockAuth, "dba", "dbatoken", WithHardened())
+	assert.NoError(t, err)
+	defer unaudited.Close()
+	_, err = unaudited.Unsafe(context.Background(), "migration")
+	assert.Error(t, err)
+
+	// A manager without an actor is not the unchecked system manager
+	dev.rbacManager = dev.rbacManager.As("")
+	_, err = dev.Unsafe(context.Background(), "migration")
+	if assert.Error(t, err) {
+		assert.Equal(t, "PERMISSION_DENIED", err.(*DBError).Code)
+	}
+}
+
+func TestHardenedSurface(t *testing.T) {
+	db, path, cleanup := setupTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	_, err := db.Exec("CREATE TABLE notes (id INTEGER PRIMARY KEY, body TEXT)")
+	assert.NoError(t, err)
+	readers, err := db.CreateRole("readers")
+	assert.NoError(t, err)
+	assert.NoError(t, db.GrantTablePermission(readers, "notes", permissions.TablePermission))
+	_, err = db.CreateRole("approvers")
+	assert.NoError(t, err)
+	assert.NoError(t, db.CreateUser("dev", "devtoken"))
+
+	var changes []audit.Event
+	sink := audit.SinkFunc(func(ctx context.Context, event audit.Event) error {
+		if event.Type == audit.EventRBACChange && event.Decision == audit.Allow {
+			changes = append(changes, event)
+		}
+		return nil
+	})
+	policies := abac.NewABACManager()
+	assert.NoError(t, policies.AddPolicy(abac.Policy{Name: "notes-closed", Effect: abac.Deny, Tables: []string{"notes"}}))
+	workflow, err := rbac.NewAccessWorkflow(rbac.System(db.authProvider), rbac.AccessWorkflowConfig{ApproverRole: "approvers"})
+	assert.NoError(t, err)
+	keys, err := encryption.CreateKeyFile(filepath.Join(t.TempDir(), "keys.json"))
+	assert.NoError(t, err)
+	dev, err := Open(path, db.authProvider, "dev", "devtoken", WithHardened(), WithAuditSink(sink),
+		WithABAC(policies), WithAccessWorkflow(workflow),
+		WithBreakGlass(BreakGlassPolicy{Role: "readers", Responders: []string{"approvers"}}),
+		WithColumnEncryption(keys, encryption.Column{Table: "notes", Name: "body"}))
+	assert.NoError(t, err)
+	defer dev.Close()
+	request, err := dev.RequestAccess(ctx, rbac.AccessRequest{Role: "readers", Justification: "triage"})
+	assert.NoError(t, err)
+
+	// The handle exposes no fields
+	typ := reflect.TypeOf(dev).Elem()
+	for i := 0; i < typ.NumField(); i++ {
+		assert.False(t, typ.Field(i).IsExported(), typ.Field(i).Name)
+	}
+
+	// Every method that changes access is refused to a user without privileges
+	grant := rbac.GrantPolicy{Table: "notes", Actions: []string{"select"}}
+	refused := map[string]func() error{
+		"AddABACPolicy": func() error {
+			return dev.AddABACPolicy(abac.Policy{Name: "notes-open", Effect: abac.Allow, Tables: []string{"notes"}})
+		},
+		"RemoveABACPolicy": func() error { return dev.RemoveABACPolicy("notes-closed") },
+		"ApplyPolicy": func() error {
+			_, err := dev.ApplyPolicy(&rbac.Policy{Version: 1, Users: []rbac.UserPolicy{{Name: "dev", Roles: []string{"readers"}}}}, rbac.ApplyOptions{})
+			return err
+		},
+		"ApproveAccessRequest": func() error {
+			_, err := dev.ApproveAccessRequest(ctx, request.ID)
+			return err
+		},
+		"DenyAccessRequest": func() error {
+			_, err := dev.DenyAccessRequest(ctx, request.ID, "withdrawn")
+			return err
+		},
+		"AssignPermissionToRole": func() error { return dev.AssignPermissionToRole("readers", "notes_admin") },
+		"AssignRoleToUser":       func() error { return dev.AssignRoleToUser("dev", "readers") },
+		"AssignRoleToUserBetween": func() error {
+			return dev.AssignRoleToUserBetween("dev", "readers", time.Now(), time.Now().Add(time.Hour))
+		},
+		"Begin": func() error {
+			_, err := dev.Begin()
+			return err
+		},
+		"BreakGlass": func() error {
+			_, err := dev.BreakGlass(ctx, BreakGlassRequest{Role: "readers", Justification: "incident"})
+			return err
+		},
+		"CreatePermission": func() error {
+			_, err := dev.CreatePermission("notes_admin")
+			return err
+		},
+		"CreateRole": func() error {
+			_, err := dev.CreateRole("devs")
+			return err
+		},
+		"CreateUser": func() error { return dev.CreateUser("mallory", "mallorytoken") },
+		"DB": func() error {
+			if dev.DB() != nil {
+				return nil
+			}
+			return sql.ErrConnDone
+		},
+		"DeleteRole":               func() error { return dev.DeleteRole("approvers") },
+		"DisableUser":              func() error { return dev.DisableUser(db.username) },
+		"Grant":                    func() error { return dev.Grant("dev", grant) },
+		"GrantColumnPermission":    func() error { return dev.GrantColumnPermission(readers, "notes", "body", permissions.ColumnPermission) },
+		"GrantPrivilege":           func() error { return dev.GrantPrivilege("dev", permissions.RawAccess, "", false) },
+		"GrantRowPermission":       func() error { return dev.GrantRowPermission(readers, "notes", "1 = 1", permissions.RowPermission) },
+		"GrantTablePermission":     func() error { return dev.GrantTablePermission(readers, "notes", permissions.TablePermission) },
+		"RekeyDatabase":            func() error { return dev.RekeyDatabase(ctx) },
+		"ReencryptTable":           func() error { _, err := dev.ReencryptTable(ctx, "notes"); return err },
+		"RemovePermissionFromRole": func() error { return dev.RemovePermissionFromRole("readers", "notes_admin") },
+		"RemoveRoleFromUser":       func() error { return dev.RemoveRoleFromUser(db.username, "readers") },
+		"ResetToken":               func() error { return dev.ResetToken(db.username, "stolen") },
+		"Revoke":                   func() error { return dev.Revoke(db.username, grant, rbac.Restrict) },
+		"RevokePrivilege":          func() error { return dev.RevokePrivilege(db.username, permissions.Superuser, "") },
+		"TerminateSession":         func() error { return dev.TerminateSession(db.storedSession) },
+		"Unsafe": func() error {
+			_, err := dev.Unsafe(ctx, "migration")
+			return err
+		},
+	}
+	// The other methods run checked statements, read access control state,
+	// request access from approvers, or set the session attributes the
+	// application passes to row conditions
+	checked := []string{
+		"AccessRequests", "Close", "Exec", "ExecContext", "ExplainAccess",
+		"ExportPolicy", "GetEffectivePermissions", "GetUserRoles", "HasPrivilege", "ListAccounts",
+		"ListRoles", "ListSessions", "PermissionExists", "Ping", "Prepare",
+		"PrepareContext", "Query", "QueryContext", "QueryRow", "QueryRowContext",
+		"RequestAccess", "RoleExists", "RoleHasPermission", "RoleMembers",
+		"RowHistory", "Session", "SessionID", "SetSessionAttribute", "UserHasRole",
+		"VisibleTables",
+	}
+	methods := reflect.TypeOf(dev)
+	for i := 0; i < methods.NumMethod(); i++ {
+		name := methods.Method(i).Name
+		if call, ok := refused[name]; ok {
+			err := call()
+			if dbErr, ok := err.(*DBError); ok {
+				assert.Equal(t, "PERMISSION_DENIED", dbErr.Code, name)
+			} else {
+				assert.Error(t, err, name)
+			}
+			continue
+		}
+		assert.Contains(t, checked, name, "method %s is not classified", name)
+	}
+
+	// None of them changed anything
+	assert.Empty(t, changes)
+	_, err = dev.Query("SELECT body FROM notes")
+	assert.Error(t, err)
+	roles, err := dev.GetUserRoles("dev")
+	assert.NoError(t, err)
+	assert.Empty(t, roles)
+	assert.Len(t, policies.Policies(), 1)
+	valid, err := db.authProvider.ValidateSession(db.storedSession)
+	assert.NoError(t, err)
+	assert.True(t, valid)
+}
+
+func TestExplainAccess(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "secure_sqlite_test_*.db")
+	assert.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+
+	mockAuth := auth.NewMemoryProvider()
+	mockAuth.AddUser("admin", "admintoken")
+	mockAuth.AddUser("analyst", "analysttoken")
+	db, err := Open(tmpFile.Name(), mockAuth, "admin", "admintoken", WithSuperuser("admin"))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE orders (id INTEGER PRIMARY KEY, item TEXT, qty INTEGER)")
+	assert.NoError(t, err)
+	_, err = db.Exec("CREATE TABLE secrets (id INTEGER PRIMARY KEY, value TEXT)")
+	assert.NoError(t, err)
+	assert.NoError(t, db.Grant("analyst", rbac.GrantPolicy{
+		Table:   "orders",
+		Actions: []string{"select"},
+		Row:     "qty > 1",
+	}))
+
+	analyst, err := Open(tmpFile.Name(), mockAuth, "analyst", "analysttoken")
+	assert.NoError(t, err)
+	defer analyst.Close()
+	ctx := context.Background()
+
+	// Allowed statements are explained with their row conditions applied
+	e, err := analyst.ExplainAccess(ctx, "SELECT id, item FROM orders")
+	assert.NoError(t, err)
+	assert.True(t, e.Allowed())
+	assert.Equal(t, "select", e.Action)
+	assert.Equal(t, []string{"orders"}, e.Tables)
+	assert.Contains(t, e.Rewritten, "qty > 1")
+
+	// Every refused check is reported, not only the first
+	e, err = analyst.ExplainAccess(ctx, "SELECT id, value FROM secrets")
+	assert.NoError(t, err)
+	assert.False(t, e.Allowed())
+	assert.IsType(t, &DBError{}, e.Err)
+	assert.Empty(t, e.Rewritten)
+	var denied []string
+	for _, check := range e.Checks {
+		if !check.Allowed {
+			denied = append(denied, check.Check+" "+check.Target)
+		}
+	}
+	assert.Equal(t, []string{"table secrets", "column secrets.id", "column secrets.value", "row secrets"}, denied)
+
+	// The explanation agrees with the checks of Query
+	_, err = analyst.Query("SELECT id, value FROM secrets")
+	assert.Error(t, err)
+
+	_, err = analyst.ExplainAccess(ctx, "SELEKT id FROM orders")
+	assert.Error(t, err)
+
+	// Tables without a permission are not visible
+	tables, err := analyst.VisibleTables(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"orders"}, tables)
+}
+
+func TestSessionTermination(t *testing.T) {
+	dir := t.TempDir()
+	store, err := auth.OpenSQLiteProvider(filepath.Join(dir, "auth.db"))
+	assert.NoError(t, err)
+	defer store.Close()
+	store.AddUser("admin", "admintoken")
+	store.AddUser("analyst", "analysttoken")
+
+	dbPath := filepath.Join(dir, "app.db")
+	db, err := Open(dbPath, store, "admin", "admintoken", WithSuperuser("admin"))
+	assert.NoError(t, err)
+	defer db.Close()
+	_, err = db.Exec("CREATE TABLE orders (id INTEGER PRIMARY KEY, item TEXT)")
+	assert.NoError(t, err)
+	assert.NoError(t, db.Grant("analyst", rbac.GrantPolicy{Table: "orders", Actions: []string{"select"}}))
+
+	// Handles store their sessions until they are closed
+	analyst, err := Open(dbPath, store, "analyst", "analysttoken")
+	assert.NoError(t, err)
+	sessions, err := db.rbacManager.ListSessions()
+	assert.NoError(t, err)
+	assert.Len(t, sessions, 2)
+	analyst.Close()
+	sessions, err = db.rbacManager.ListSessions()
+	assert.NoError(t, err)
+	assert.Len(t, sessions, 1)
+
+	// A terminated session refuses further statements
+	analyst, err = Open(dbPath, store, "analyst", "analysttoken")
+	assert.NoError(t, err)
+	defer analyst.Close()
+	rows, err := analyst.Query("SELECT id FROM orders")
+	assert.NoError(t, err)
+	rows.Close()
+	assert.NoError(t, db.TerminateSession(analyst.SessionID()))
+	_, err = analyst.Query("SELECT id FROM orders")
+	assert.Error(t, err)
+	var dbErr *DBError
+	if assert.ErrorAs(t, err, &dbErr) {
+		assert.Equal(t, "SESSION_ERROR", dbErr.Code)
+	}
+
+	// Disabled users cannot log in, and only privileged users may disable
+	assert.Error(t, analyst.DisableUser("admin"))
+	assert.NoError(t, db.DisableUser("analyst"))
+	_, err = Open(dbPath, store, "analyst", "analysttoken")
+	assert.Error(t, err)
+}
+
+func TestMultiTableTargets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "targets.db")
+	mockAuth := auth.NewMemoryProvider()
+	mockAuth.AddUser("admin", "admintoken")
+	mockAuth.AddUser("clerk", "clerktoken")
+	admin, err := Open(path, mockAuth, "admin", "admintoken", WithSuperuser("admin"))
+	assert.NoError(t, err)
+	defer admin.Close()
+	for _, query := range []string{
+		"CREATE TABLE orders (id INTEGER PRIMARY KEY, customer_id INTEGER, item TEXT)",
+		"CREATE TABLE customers (id INTEGER PRIMARY KEY, name TEXT)",
+	} {
+		_, err = admin.sqlDB.Exec(query)
+		assert.NoError(t, err)
+	}
+	for _, table := range []string{"orders", "customers"} {
+		assert.NoError(t, admin.Grant("clerk", rbac.GrantPolicy{Table: table}))
+	}
+
+	clerk, err := Open(path, mockAuth, "clerk", "clerktoken")
+	assert.NoError(t, err)
+	defer clerk.Close()
+
+	// Statements that change a join are refused rather than checked against
+	// one of its tables
+	for _, query := range []string{
+		"UPDATE orders JOIN customers ON orders.customer_id = customers.id SET item = 'x'",
+		"UPDATE orders, customers SET item = 'x' WHERE orders.customer_id = customers.id",
+		"DELETE orders FROM orders JOIN customers ON orders.customer_id = customers.id",
+	} {
+		_, err = clerk.Exec(query)
+		if assert.IsType(t, &DBError{}, err, query) {
+			assert.Equal(t, "UNSUPPORTED_QUERY", err.(*DBError).Code, query)
+		}
+		_, err = clerk.Prepare(query)
+		assert.Error(t, err, query)
+		_, err = clerk.ExplainAccess(context.Background(), query)
+		assert.Error(t, err, query)
+	}
+
+	// Single-table statements are checked as before
+	_, err = clerk.Exec("UPDATE orders SET item = 'x' WHERE customer_id = 1")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,344 @@
+package secure_sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/audit"
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+	"github.com/wemcdonald/secure_sqlite/pkg/sqlparser"
+	xsqlparser "github.com/xwb1989/sqlparser"
+)
+
+// WithSensitiveColumns tags columns of a table as sensitive. Whenever a query
+// through the handle returns values of them, a sensitive_read event records
+// the principal, table, columns and the primary keys of the rows returned.
+func WithSensitiveColumns(table string, columns ...string) Option {
+	return func(o *options) {
+		if o.sensitive == nil {
+			o.sensitive = make(map[string][]string)
+		}
+		table = strings.ToLower(table)
+		o.sensitive[table] = append(o.sensitive[table], columns...)
+	}
+}
+
+// queryer runs queries on a database or in a transaction
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// sensitiveRead collects the keys of the rows a query returns from tables with
+// sensitive columns, for the events recorded once the rows are read
+type sensitiveRead struct {
+	db     *SecureSQLite
+	ctx    context.Context
+	a      *statementAudit
+	tables []*sensitiveTable
+	// hidden is the number of key columns appended to the select list; zero
+	// if the keys of the rows cannot be captured
+	hidden   int
+	rows     int
+	recorded bool
+}
+
+// sensitiveTable is a table whose sensitive columns a query returns
+type sensitiveTable struct {
+	table   string
+	columns []string
+	// keyColumns are the primary key columns selected for the table, and
+	// offset is the position of the first of them among the hidden columns
+	keyColumns []string
+	offset     int
+	keys       []string
+	seen       map[string]bool
+}
+
+// sensitiveReads finds the sensitive columns a query returns and, if keys are
+// captured and it can, appends the primary keys of their tables to the select
+// list. It returns nil if the query returns no sensitive columns.
+func (db *SecureSQLite) sensitiveReads(ctx context.Context, a *statementAudit, query string, args []interface{}, captureKeys bool) (*sensitiveRead, string, []interface{}, error) {
+	if db.auditSink == nil || !db.touchesSensitive(a.tables) {
+		return nil, query, args, nil
+	}
+	sensitiveErr := func(err error) error {
+		return &DBError{
+			Code:    "SENSITIVE_READ_ERROR",
+			Message: "failed to find sensitive columns of query",
+			Err:     err,
+		}
+	}
+	stmt, err := xsqlparser.Parse(query)
+	if err != nil {
+		return nil, "", nil, sensitiveErr(err)
+	}
+	returned, err := sqlparser.ReturnedColumns(stmt, func(table string) ([]string, error) {
+		return tableColumns(ctx, db.executor(ctx), table)
+	})
+	if err != nil {
+		return nil, "", nil, sensitiveErr(err)
+	}
+
+	// Keep the sensitive columns of each table and select the keys of the
+	// tables the rows are read from directly
+	read := &sensitiveRead{db: db, ctx: ctx, a: a}
+	var keys []sqlparser.TableColumns
+	for _, tableRead := range returned {
+		var columns []string
+		for _, column := range tableRead.Columns {
+			if permissions.ContainsName(db.sensitive[strings.ToLower(tableRead.Table)], column) && !permissions.ContainsName(columns, column) {
+				columns = append(columns, column)
+			}
+		}
+		if len(columns) == 0 {
+			continue
+		}
+		table := &sensitiveTable{table: tableRead.Table, columns: columns, seen: make(map[string]bool)}
+		read.tables = append(read.tables, table)
+		if tableRead.Qualifier == "" || !captureKeys {
+			continue
+		}
+		keyColumns, err := primaryKey(ctx, db.sqlDB, tableRead.Table)
+		if err != nil {
+			return nil, "", nil, sensitiveErr(err)
+		}
+		table.keyColumns = keyColumns
+		table.offset = read.hidden
+		read.hidden += len(keyColumns)
+		keys = append(keys, sqlparser.TableColumns{Table: tableRead.Table, Qualifier: tableRead.Qualifier, Columns: keyColumns})
+	}
+	if len(read.tables) == 0 {
+		return nil, query, args, nil
+	}
+	if read.hidden == 0 {
+		return read, query, args, nil
+	}
+
+	keyed, ok := sqlparser.AppendKeyColumns(stmt, keys)
+	if !ok {
+		read.hidden = 0
+		for _, table := range read.tables {
+			table.keyColumns = nil
+		}
+		return read, query, args, nil
+	}
+	// The rewritten query uses named placeholders, so bind everything by name
+	return read, keyed, sqlparser.BindStatementArgs(args), nil
+}
+
+// touchesSensitive checks if any of the tables of a statement has sensitive
+// columns
+func (db *SecureSQLite) touchesSensitive(tables []string) bool {
+	for _, table := range tables {
+		if len(db.sensitive[strings.ToLower(table)]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// primaryKey returns the primary key columns of a table in key order, or the
+// rowid for a table without a declared primary key
+func primaryKey(ctx context.Context, q queryer, table string) ([]string, error) {
+	rows, err := q.QueryContext(ctx, "SELECT name FROM pragma_table_info(?) WHERE pk > 0 ORDER BY pk", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 {
+		columns = []string{"rowid"}
+	}
+	return columns, nil
+}
+
+// scanned notes that a row was read, with the values of its hidden key columns
+func (r *sensitiveRead) scanned(values []interface{}) {
+	r.rows++
+	for _, table := range r.tables {
+		if len(table.keyColumns) == 0 {
+			continue
+		}
+		parts := make([]string, len(table.keyColumns))
+		for i := range table.keyColumns {
+			parts[i] = keyValue(values[table.offset+i])
+		}
+		key := parts[0]
+		if len(parts) > 1 {
+			key = "(" + strings.Join(parts, ", ") + ")"
+		}
+		if !table.seen[key] {
+			table.seen[key] = true
+			table.keys = append(table.keys, key)
+		}
+	}
+}
+
+// keyValue formats the value of a key column
+func keyValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// record records a sensitive_read event for each table whose sensitive
+// columns the caller read. It records nothing if no rows were read.
+func (r *sensitiveRead) record() error {
+	if r.recorded || r.rows == 0 {
+		return nil
+	}
+	r.recorded = true
+	for _, table := range r.tables {
+		event := r.db.sensitiveEvent(r.a, table)
+		if len(table.keyColumns) > 0 {
+			event.Keys = table.keys
+			event.Detail = fmt.Sprintf("rows: %d; key: %s", r.rows, strings.Join(table.keyColumns, ", "))
+		} else {
+			event.Detail = fmt.Sprintf("rows: %d; keys not captured", r.rows)
+		}
+		if err := r.db.auditSink.Record(r.ctx, event); err != nil {
+			return &DBError{
+				Code:    "AUDIT_ERROR",
+				Message: "failed to record sensitive read",
+				Err:     err,
+			}
+		}
+	}
+	return nil
+}
+
+// recordUnkeyed records that a statement may read sensitive columns when the
+// rows it returns cannot be observed, as with QueryRow and Prepare
+func (db *SecureSQLite) recordUnkeyed(ctx context.Context, a *statementAudit, read *sensitiveRead) error {
+	if read == nil {
+		return nil
+	}
+	for _, table := range read.tables {
+		event := db.sensitiveEvent(a, table)
+		event.Detail = "keys not captured"
+		if err := db.auditSink.Record(ctx, event); err != nil {
+			return &DBError{
+				Code:    "AUDIT_ERROR",
+				Message: "failed to record sensitive read",
+				Err:     err,
+			}
+		}
+	}
+	return nil
+}
+
+// sensitiveEvent returns the sensitive_read event of a table read by a statement
+func (db *SecureSQLite) sensitiveEvent(a *statementAudit, table *sensitiveTable) audit.Event {
+	return audit.Event{
+		Time:        db.rbacManager.Now(),
+		Type:        audit.EventSensitiveRead,
+		Principal:   db.username,
+		SessionID:   db.sessionID,
+		StatementID: a.id,
+		Operation:   a.operation,
+		Statement:   a.query,
+		Tables:      []string{table.table},
+		Columns:     table.columns,
+		BreakGlass:  db.elevation != nil,
+	}
+}
+
+// Rows is the result of a query. It hides the key columns added to capture
+// sensitive reads, and records the reads as the caller scans the rows.
+type Rows struct {
+	*sql.Rows
+	read *sensitiveRead
+	err  error
+}
+
+// newRows wraps the result of a query
+func newRows(rows *sql.Rows, read *sensitiveRead) *Rows {
+	return &Rows{Rows: rows, read: read}
+}
+
+// Columns returns the column names of the result
+func (r *Rows) Columns() ([]string, error) {
+	columns, err := r.Rows.Columns()
+	if err != nil || r.read == nil {
+		return columns, err
+	}
+	return columns[:len(columns)-r.read.hidden], nil
+}
+
+// ColumnTypes returns the column types of the result
+func (r *Rows) ColumnTypes() ([]*sql.ColumnType, error) {
+	types, err := r.Rows.ColumnTypes()
+	if err != nil || r.read == nil {
+		return types, err
+	}
+	return types[:len(types)-r.read.hidden], nil
+}
+
+// Next prepares the next row for Scan. Sensitive reads are recorded once the
+// rows are exhausted.
+func (r *Rows) Next() bool {
+	if r.Rows.Next() {
+		return true
+	}
+	r.finish()
+	return false
+}
+
+// Scan copies the columns of the current row into dest
+func (r *Rows) Scan(dest ...interface{}) error {
+	if r.read == nil {
+		return r.Rows.Scan(dest...)
+	}
+	values := make([]interface{}, r.read.hidden)
+	for i := range values {
+		dest = append(dest, &values[i])
+	}
+	if err := r.Rows.Scan(dest...); err != nil {
+		return err
+	}
+	r.read.scanned(values)
+	return nil
+}
+
+// Err returns the error of the iteration, or of recording sensitive reads
+func (r *Rows) Err() error {
+	if err := r.Rows.Err(); err != nil {
+		return err
+	}
+	return r.err
+}
+
+// Close closes the rows and records the sensitive reads
+func (r *Rows) Close() error {
+	err := r.Rows.Close()
+	r.finish()
+	if err != nil {
+		return err
+	}
+	return r.err
+}
+
+// finish records the sensitive reads of the rows
+func (r *Rows) finish() {
+	if r.read != nil && r.err == nil {
+		r.err = r.read.record()
+	}
+}
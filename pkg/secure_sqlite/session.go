@@ -0,0 +1,149 @@
+package secure_sqlite
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/auth"
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+	"github.com/wemcdonald/secure_sqlite/pkg/sqlparser"
+	xsqlparser "github.com/xwb1989/sqlparser"
+)
+
+// SetSessionAttribute sets a session attribute that row-level conditions can
+// read through current_setting(name), e.g. a tenant ID or region
+func (db *SecureSQLite) SetSessionAttribute(name string, value interface{}) {
+	db.sessionMu.Lock()
+	defer db.sessionMu.Unlock()
+	db.sessionAttrs[name] = value
+}
+
+// Session returns a snapshot of the current session, including the roles the
+// user currently holds
+func (db *SecureSQLite) Session() (*sqlparser.Session, error) {
+	userID, err := db.authProvider.GetUserID(db.username)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := db.rbacManager.GetUserRoles(db.username)
+	if err != nil {
+		return nil, err
+	}
+
+	session := sqlparser.NewSession(db.username, userID, roles)
+	if session.Permissions, err = db.rbacManager.ElevatedPermissions(); err != nil {
+		return nil, err
+	}
+
+	db.sessionMu.RLock()
+	defer db.sessionMu.RUnlock()
+	for name, value := range db.sessionAttrs {
+		session.SetAttribute(name, value)
+	}
+	return session, nil
+}
+
+// applyRowSecurity adds the row-level conditions of the session user to a
+// SELECT, UNION, INSERT, UPDATE or DELETE statement. The rows of each branch of
+// a UNION and of the source of an INSERT are read, so they get the conditions
+// of SELECT. It returns the query and arguments to execute, which are the
+// originals when no condition applies. Row filters of permitting ABAC policies
+// and the conditions of row policies are applied in addition to the granted
+// conditions. Other statements are refused, since their rows can't be limited.
+func (db *SecureSQLite) applyRowSecurity(parser *sqlparser.Parser, stmt xsqlparser.Statement, query string, args []interface{}, decisions policyDecisions) (string, []interface{}, error) {
+	var action permissions.Action
+	switch stmt.(type) {
+	case *xsqlparser.Select, *xsqlparser.Union, *xsqlparser.Insert:
+		action = permissions.Select
+	case *xsqlparser.Update:
+		action = permissions.Update
+	case *xsqlparser.Delete:
+		action = permissions.Delete
+	default:
+		return "", nil, &DBError{
+			Code:    "UNSUPPORTED_QUERY",
+			Message: "row-level security cannot be applied to the statement",
+		}
+	}
+
+	session, err := db.Session()
+	if err != nil {
+		return "", nil, &DBError{
+			Code:    "SESSION_ERROR",
+			Message: "failed to build session",
+			Err:     err,
+		}
+	}
+
+	decisions.addRowFilters(session)
+	filters, err := db.rowPolicyConditions(action, session.Roles, false)
+	if err != nil {
+		return "", nil, err
+	}
+	for table, filter := range filters {
+		session.AddRowFilter(table, filter)
+	}
+
+	original := xsqlparser.String(stmt)
+	rewritten, sessionArgs, err := parser.TransformQueryWithSession(stmt, session)
+	if err != nil {
+		return "", nil, &DBError{
+			Code:    "ROW_SECURITY_ERROR",
+			Message: fmt.Sprintf("failed to apply row-level security for user: %s", db.username),
+			Err:     err,
+		}
+	}
+	if rewritten == original {
+		return query, args, nil
+	}
+
+	// The rewritten query uses named placeholders, so bind everything by name
+	return rewritten, append(sqlparser.BindStatementArgs(args), sessionArgs...), nil
+}
+
+// newSessionID returns a random ID for the session of a handle, which also
+// identifies break-glass elevations in audit events
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// storeSession stores the session of a handle with the auth provider
+func storeSession(authProvider auth.Provider, username, sessionID string) error {
+	userID, err := authProvider.GetUserID(username)
+	if err == nil {
+		err = authProvider.StoreSession(sessionID, userID)
+	}
+	if err != nil {
+		return &DBError{
+			Code:    "SESSION_ERROR",
+			Message: "failed to store session",
+			Err:     err,
+		}
+	}
+	return nil
+}
+
+// checkSession checks that the session of the handle has not been
+// terminated, e.g. by an administrator
+func (db *SecureSQLite) checkSession() error {
+	valid, err := db.authProvider.ValidateSession(db.storedSession)
+	if err != nil {
+		return &DBError{
+			Code:    "SESSION_ERROR",
+			Message: "failed to validate session",
+			Err:     err,
+		}
+	}
+	if !valid {
+		return &DBError{
+			Code:    "SESSION_ERROR",
+			Message: "session has been terminated",
+		}
+	}
+	return nil
+}
@@ -0,0 +1,508 @@
+package secure_sqlite
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/auth"
+)
+
+// DriverName is the name of the database/sql driver that runs every statement
+// through the checks of a SecureSQLite handle
+const DriverName = "secure_sqlite"
+
+// DSN parameters of the driver, which are removed before the DSN is passed to
+// SQLite
+const (
+	dsnAuth  = "_secure_auth"
+	dsnUser  = "_secure_user"
+	dsnToken = "_secure_token"
+)
+
+// defaultAuthProvider names the provider of DSNs without _secure_auth
+const defaultAuthProvider = "default"
+
+// authProviders holds the authentication providers of the driver by name
+var (
+	authProvidersMu sync.RWMutex
+	authProviders   = make(map[string]auth.Provider)
+)
+
+// RegisterAuthProvider makes an authentication provider available to the
+// driver under a name, which DSNs select with the _secure_auth parameter. The
+// provider named "default" serves DSNs without it.
+func RegisterAuthProvider(name string, provider auth.Provider) {
+	authProvidersMu.Lock()
+	defer authProvidersMu.Unlock()
+	authProviders[name] = provider
+}
+
+// principal is a user that statements run as
+type principal struct {
+	username string
+	token    string
+}
+
+// principalKey is the context key of the principal of statements
+type principalKey struct{}
+
+// WithPrincipal returns a context whose statements on connections of the
+// driver run as a user, overriding the user of the connector or DSN
+func WithPrincipal(ctx context.Context, username, token string) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal{username: username, token: token})
+}
+
+// Driver is the database/sql driver of secure databases. DSNs are SQLite DSNs
+// with the parameters _secure_user and _secure_token for the user statements
+// run as, and _secure_auth for the name of a provider registered with
+// RegisterAuthProvider.
+type Driver struct{}
+
+// Open opens a connection, which closes the handles it opens when it is closed
+func (d *Driver) Open(dsn string) (driver.Conn, error) {
+	c, err := d.OpenConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{connector: c.(*Connector), owned: true}, nil
+}
+
+// OpenConnector parses a DSN into a connector
+func (d *Driver) OpenConnector(dsn string) (driver.Connector, error) {
+	name, query, _ := strings.Cut(dsn, "?")
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, &DBError{
+			Code:    "DSN_ERROR",
+			Message: "failed to parse DSN",
+			Err:     err,
+		}
+	}
+	providerName := params.Get(dsnAuth)
+	if providerName == "" {
+		providerName = defaultAuthProvider
+	}
+	authProvidersMu.RLock()
+	provider, ok := authProviders[providerName]
+	authProvidersMu.RUnlock()
+	if !ok {
+		return nil, &DBError{
+			Code:    "DSN_ERROR",
+			Message: fmt.Sprintf("authentication provider not registered: %s", providerName),
+		}
+	}
+
+	// Pass the remaining parameters on to SQLite
+	username, token := params.Get(dsnUser), params.Get(dsnToken)
+	params.Del(dsnAuth)
+	params.Del(dsnUser)
+	params.Del(dsnToken)
+	if len(params) > 0 {
+		name += "?" + params.Encode()
+	}
+	return NewConnector(name, provider, username, token), nil
+}
+
+// Connector opens connections of the driver for a database, for use with
+// sql.OpenDB. It opens a handle with Open for each user that runs statements,
+// which its connections share until it is closed.
+type Connector struct {
+	dsn          string
+	authProvider auth.Provider
+	principal    principal
+	opts         []Option
+	handles      map[principal]*SecureSQLite
+	mu           sync.Mutex
+}
+
+// NewConnector returns a connector whose statements run as a user, unless
+// their context names another with WithPrincipal. Without a user, every
+// statement must name one. The options apply to every handle the connections
+// open.
+func NewConnector(dataSourceName string, authProvider auth.Provider, username, token string, opts ...Option) *Connector {
+	return &Connector{
+		dsn:          dataSourceName,
+		authProvider: authProvider,
+		principal:    principal{username: username, token: token},
+		opts:         opts,
+		handles:      make(map[principal]*SecureSQLite),
+	}
+}
+
+// Connect opens a connection
+func (c *Connector) Connect(ctx context.Context) (driver.Conn, error) {
+	return &conn{connector: c}, nil
+}
+
+// Driver returns the driver of the connector
+func (c *Connector) Driver() driver.Driver {
+	return &Driver{}
+}
+
+// handle returns the handle of a user, opening it when the user first runs a
+// statement
+func (c *Connector) handle(p principal) (*SecureSQLite, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if h, ok := c.handles[p]; ok {
+		return h, nil
+	}
+	h, err := Open(c.dsn, c.authProvider, p.username, p.token, c.opts...)
+	if err != nil {
+		return nil, err
+	}
+	c.handles[p] = h
+	return h, nil
+}
+
+// Close closes the handles of the connector. sql.DB closes its connector when
+// it is closed.
+func (c *Connector) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var firstErr error
+	for p, h := range c.handles {
+		if err := h.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(c.handles, p)
+	}
+	return firstErr
+}
+
+// conn is a connection of the driver. It runs the statements of each user
+// through the handle of the user, and pins a connection of the handle for a
+// transaction, so that the statements of the transaction run in it.
+type conn struct {
+	connector *Connector
+	// owned is set for connections opened by Driver.Open, which alone use
+	// their connector
+	owned bool
+	// tx is the pinned connection of the open transaction, and txPrincipal
+	// its user
+	tx          *pinnedConn
+	txPrincipal principal
+}
+
+var (
+	_ driver.Conn               = (*conn)(nil)
+	_ driver.ConnBeginTx        = (*conn)(nil)
+	_ driver.ConnPrepareContext = (*conn)(nil)
+	_ driver.QueryerContext     = (*conn)(nil)
+	_ driver.ExecerContext      = (*conn)(nil)
+	_ driver.Pinger             = (*conn)(nil)
+)
+
+// principal returns the user a statement runs as
+func (c *conn) principal(ctx context.Context) principal {
+	if p, ok := ctx.Value(principalKey{}).(principal); ok {
+		return p
+	}
+	return c.connector.principal
+}
+
+// handle returns the handle that runs a statement, and the context that pins
+// the statement to the open transaction
+func (c *conn) handle(ctx context.Context) (*SecureSQLite, context.Context, error) {
+	p := c.principal(ctx)
+	if c.tx != nil {
+		if p != c.txPrincipal {
+			return nil, nil, &DBError{
+				Code:    "TRANSACTION_ERROR",
+				Message: "statement runs as another user than its transaction",
+			}
+		}
+		return c.tx.handle, withPinned(ctx, c.tx), nil
+	}
+	if p.username == "" {
+		return nil, nil, &DBError{
+			Code:    "AUTH_ERROR",
+			Message: "no user to run statement as",
+		}
+	}
+	h, err := c.connector.handle(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	return h, ctx, nil
+}
+
+// Prepare creates a prepared statement
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+// PrepareContext creates a prepared statement with the checks of the handle
+func (c *conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	h, ctx, err := c.handle(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stmt, err := h.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &connStmt{conn: c, stmt: stmt}, nil
+}
+
+// QueryContext runs a query with the checks of the handle
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	h, ctx, err := c.handle(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result, err := h.QueryContext(ctx, query, namedArgs(args)...)
+	if err != nil {
+		return nil, err
+	}
+	return &connRows{rows: result}, nil
+}
+
+// ExecContext runs a statement with the checks of the handle
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	h, ctx, err := c.handle(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return h.ExecContext(ctx, query, namedArgs(args)...)
+}
+
+// Ping checks the connection of the user, if there is one
+func (c *conn) Ping(ctx context.Context) error {
+	if c.tx == nil && c.principal(ctx).username == "" {
+		return nil
+	}
+	h, ctx, err := c.handle(ctx)
+	if err != nil {
+		return err
+	}
+	if pinned := h.pinned(ctx); pinned != nil {
+		return pinned.conn.PingContext(ctx)
+	}
+	return h.sqlDB.PingContext(ctx)
+}
+
+// Begin starts a transaction
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// BeginTx starts a transaction on a connection of the handle of the user,
+// which is pinned until the transaction ends. Its statements must run as the
+// same user.
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if c.tx != nil {
+		return nil, &DBError{
+			Code:    "TRANSACTION_ERROR",
+			Message: "transaction already open",
+		}
+	}
+	h, _, err := c.handle(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sqlConn, err := h.sqlDB.Conn(ctx)
+	if err != nil {
+		return nil, &DBError{
+			Code:    "CONNECTION_ERROR",
+			Message: "failed to open connection",
+			Err:     err,
+		}
+	}
+	tx, err := sqlConn.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.IsolationLevel(opts.Isolation),
+		ReadOnly:  opts.ReadOnly,
+	})
+	if err != nil {
+		sqlConn.Close()
+		return nil, &DBError{
+			Code:    "TRANSACTION_ERROR",
+			Message: "failed to begin transaction",
+			Err:     err,
+		}
+	}
+	c.tx = &pinnedConn{handle: h, conn: sqlConn, tx: tx}
+	c.txPrincipal = c.principal(ctx)
+	return &connTx{conn: c}, nil
+}
+
+// endTx ends the open transaction of the connection and unpins its
+// connection
+func (c *conn) endTx(commit bool) error {
+	pinned := c.tx
+	if pinned == nil {
+		return sql.ErrTxDone
+	}
+	c.tx = nil
+	pinned.mu.Lock()
+	tx := pinned.tx
+	pinned.tx = nil
+	pinned.mu.Unlock()
+	defer pinned.conn.Close()
+	if commit {
+		return tx.Commit()
+	}
+	return tx.Rollback()
+}
+
+// Close closes the connection, rolling back its open transaction
+func (c *conn) Close() error {
+	if c.tx != nil {
+		c.endTx(false)
+	}
+	if c.owned {
+		return c.connector.Close()
+	}
+	return nil
+}
+
+// connTx is a transaction of a connection of the driver
+type connTx struct {
+	conn *conn
+}
+
+// Commit commits the transaction
+func (t *connTx) Commit() error {
+	return t.conn.endTx(true)
+}
+
+// Rollback rolls the transaction back
+func (t *connTx) Rollback() error {
+	return t.conn.endTx(false)
+}
+
+// connStmt is a prepared statement of the driver, checked when it is prepared
+// and each time it runs
+type connStmt struct {
+	conn *conn
+	stmt *Stmt
+}
+
+// pin returns the context that pins a run of the statement to the open
+// transaction of its connection
+func (s *connStmt) pin(ctx context.Context) context.Context {
+	if s.conn.tx != nil {
+		return withPinned(ctx, s.conn.tx)
+	}
+	return ctx
+}
+
+// Close closes the statement
+func (s *connStmt) Close() error {
+	return s.stmt.Close()
+}
+
+// NumInput returns -1, since the number of arguments is checked by SQLite
+func (s *connStmt) NumInput() int {
+	return -1
+}
+
+// Exec executes the statement
+func (s *connStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), valueArgs(args))
+}
+
+// ExecContext executes the statement
+func (s *connStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return s.stmt.ExecContext(s.pin(ctx), namedArgs(args)...)
+}
+
+// Query runs the statement as a query
+func (s *connStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), valueArgs(args))
+}
+
+// QueryContext runs the statement as a query
+func (s *connStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	result, err := s.stmt.QueryContext(s.pin(ctx), namedArgs(args)...)
+	if err != nil {
+		return nil, err
+	}
+	return &connRows{rows: result}, nil
+}
+
+// resultRows is the result of a query run by a handle or prepared statement
+type resultRows interface {
+	Columns() ([]string, error)
+	ColumnTypes() ([]*sql.ColumnType, error)
+	Next() bool
+	Scan(dest ...interface{}) error
+	Err() error
+	Close() error
+}
+
+// connRows are the rows a query of the driver returns
+type connRows struct {
+	rows resultRows
+}
+
+// Columns returns the column names of the rows
+func (r *connRows) Columns() []string {
+	columns, _ := r.rows.Columns()
+	return columns
+}
+
+// ColumnTypeDatabaseTypeName returns the declared type of a column of the
+// rows, which is empty for expressions
+func (r *connRows) ColumnTypeDatabaseTypeName(index int) string {
+	types, err := r.rows.ColumnTypes()
+	if err != nil || index >= len(types) {
+		return ""
+	}
+	return types[index].DatabaseTypeName()
+}
+
+// Next reads the next row into dest
+func (r *connRows) Next(dest []driver.Value) error {
+	if !r.rows.Next() {
+		if err := r.rows.Err(); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+	values := make([]interface{}, len(dest))
+	pointers := make([]interface{}, len(dest))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	if err := r.rows.Scan(pointers...); err != nil {
+		return err
+	}
+	for i, value := range values {
+		dest[i] = value
+	}
+	return nil
+}
+
+// Close closes the rows
+func (r *connRows) Close() error {
+	return r.rows.Close()
+}
+
+// namedArgs converts the arguments of the driver to arguments of a handle
+func namedArgs(args []driver.NamedValue) []interface{} {
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			values[i] = sql.Named(arg.Name, arg.Value)
+		} else {
+			values[i] = arg.Value
+		}
+	}
+	return values
+}
+
+// valueArgs converts positional arguments to named values
+func valueArgs(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	return named
+}
@@ -0,0 +1,70 @@
+package secure_sqlite
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+)
+
+// Stmt is a prepared statement of a handle. It is checked when it is prepared
+// and runs through the checks of the handle each time it is executed, so that
+// row conditions, policy filters and checks apply with the session values and
+// grants of that moment.
+type Stmt struct {
+	db     *SecureSQLite
+	query  string
+	closed atomic.Bool
+}
+
+// errStmtClosed is returned when a closed statement is executed
+var errStmtClosed = &DBError{
+	Code:    "STATEMENT_ERROR",
+	Message: "statement is closed",
+}
+
+// Exec executes the statement with RBAC checks
+func (s *Stmt) Exec(args ...interface{}) (sql.Result, error) {
+	return s.ExecContext(context.Background(), args...)
+}
+
+// ExecContext executes the statement with RBAC and ABAC checks
+func (s *Stmt) ExecContext(ctx context.Context, args ...interface{}) (sql.Result, error) {
+	if s.closed.Load() {
+		return nil, errStmtClosed
+	}
+	return s.db.ExecContext(ctx, s.query, args...)
+}
+
+// Query runs the statement as a query with RBAC checks
+func (s *Stmt) Query(args ...interface{}) (*Rows, error) {
+	return s.QueryContext(context.Background(), args...)
+}
+
+// QueryContext runs the statement as a query with RBAC and ABAC checks
+func (s *Stmt) QueryContext(ctx context.Context, args ...interface{}) (*Rows, error) {
+	if s.closed.Load() {
+		return nil, errStmtClosed
+	}
+	return s.db.QueryContext(ctx, s.query, args...)
+}
+
+// QueryRow runs the statement as a query that returns at most one row with
+// RBAC checks
+func (s *Stmt) QueryRow(args ...interface{}) *sql.Row {
+	return s.QueryRowContext(context.Background(), args...)
+}
+
+// QueryRowContext runs the statement as a query that returns at most one row
+// with RBAC and ABAC checks
+func (s *Stmt) QueryRowContext(ctx context.Context, args ...interface{}) *sql.Row {
+	if s.closed.Load() {
+		return s.db.sqlDB.QueryRow("SELECT 1 WHERE 1=0") // Return empty row that will error on Scan
+	}
+	return s.db.QueryRowContext(ctx, s.query, args...)
+}
+
+// Close closes the statement
+func (s *Stmt) Close() error {
+	s.closed.Store(true)
+	return nil
+}
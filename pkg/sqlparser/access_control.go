@@ -0,0 +1,621 @@
+package sqlparser
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+)
+
+// AccessStatementType is the kind of an access control statement
+type AccessStatementType int
+
+const (
+	// AccessGrant is GRANT privileges ON table TO grantees
+	AccessGrant AccessStatementType = iota
+	// AccessRevoke is REVOKE privileges ON table FROM grantees
+	AccessRevoke
+	// AccessGrantRole is GRANT roles TO users
+	AccessGrantRole
+	// AccessRevokeRole is REVOKE roles FROM users
+	AccessRevokeRole
+	// AccessCreateRole is CREATE ROLE name
+	AccessCreateRole
+	// AccessDropRole is DROP ROLE name
+	AccessDropRole
+	// AccessCreatePolicy is CREATE POLICY name ON table ...
+	AccessCreatePolicy
+	// AccessDropPolicy is DROP POLICY name ON table
+	AccessDropPolicy
+)
+
+// String implements the Stringer interface for AccessStatementType
+func (t AccessStatementType) String() string {
+	switch t {
+	case AccessGrant, AccessGrantRole:
+		return "GRANT"
+	case AccessRevoke, AccessRevokeRole:
+		return "REVOKE"
+	case AccessCreateRole:
+		return "CREATE ROLE"
+	case AccessDropRole:
+		return "DROP ROLE"
+	case AccessCreatePolicy:
+		return "CREATE POLICY"
+	case AccessDropPolicy:
+		return "DROP POLICY"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// Privilege is an action granted on a table, optionally limited to columns
+type Privilege struct {
+	Action  permissions.Action
+	Columns []string
+}
+
+// AccessStatement is a parsed GRANT, REVOKE, CREATE/DROP ROLE or CREATE/DROP
+// POLICY statement. These statements manage access instead of data and are
+// not understood by the SQL parser used for queries.
+type AccessStatement struct {
+	Type AccessStatementType
+
+	// Privileges granted or revoked on Table
+	Privileges []Privilege
+	// Table the privileges or the policy apply to
+	Table string
+	// Roles granted or revoked, or the roles a policy applies to; a policy
+	// without roles applies to everyone (TO PUBLIC)
+	Roles []string
+	// Grantees receiving or losing privileges or roles
+	Grantees []string
+	// GrantOption is set for GRANT ... WITH GRANT OPTION and for REVOKE GRANT
+	// OPTION FOR, which only revokes the grant option
+	GrantOption bool
+	// Restrict is set for REVOKE ... RESTRICT, which fails instead of revoking
+	// the grants that depend on the revoked ones
+	Restrict bool
+
+	// Name of the role or policy created or dropped
+	Name string
+	// IfExists is set for DROP ... IF EXISTS
+	IfExists bool
+	// IfNotExists is set for CREATE ROLE IF NOT EXISTS
+	IfNotExists bool
+
+	// Actions a policy applies to (FOR ...)
+	Actions []permissions.Action
+	// Using is the condition rows must satisfy to be visible to a policy
+	Using string
+	// WithCheck is the condition rows written under a policy must satisfy
+	WithCheck string
+}
+
+// accessTokenKind is the kind of a token of an access control statement
+type accessTokenKind int
+
+const (
+	tokenEOF accessTokenKind = iota
+	tokenWord
+	tokenQuotedIdent
+	tokenString
+	tokenPunct
+)
+
+// accessToken is a token of an access control statement
+type accessToken struct {
+	kind  accessTokenKind
+	text  string
+	start int
+	end   int
+}
+
+// IsAccessStatement reports whether a query is an access control statement
+// that must be handled by ParseAccessStatement
+func IsAccessStatement(query string) bool {
+	tokens, err := tokenizeAccessStatement(query)
+	if err != nil || len(tokens) < 2 || tokens[0].kind != tokenWord {
+		return false
+	}
+	switch strings.ToUpper(tokens[0].text) {
+	case "GRANT", "REVOKE":
+		return true
+	case "CREATE", "DROP":
+		next := strings.ToUpper(tokens[1].text)
+		return tokens[1].kind == tokenWord && (next == "ROLE" || next == "POLICY")
+	}
+	return false
+}
+
+// ParseAccessStatement parses an access control statement
+func ParseAccessStatement(query string) (*AccessStatement, error) {
+	tokens, err := tokenizeAccessStatement(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &accessParser{query: query, tokens: tokens}
+
+	var stmt *AccessStatement
+	switch {
+	case p.keyword("GRANT"):
+		stmt, err = p.parseGrant(false)
+	case p.keyword("REVOKE"):
+		stmt, err = p.parseGrant(true)
+	case p.keyword("CREATE"):
+		switch {
+		case p.keyword("ROLE"):
+			stmt, err = p.parseCreateRole()
+		case p.keyword("POLICY"):
+			stmt, err = p.parseCreatePolicy()
+		default:
+			err = p.errorf("expected ROLE or POLICY")
+		}
+	case p.keyword("DROP"):
+		switch {
+		case p.keyword("ROLE"):
+			stmt, err = p.parseDropRole()
+		case p.keyword("POLICY"):
+			stmt, err = p.parseDropPolicy()
+		default:
+			err = p.errorf("expected ROLE or POLICY")
+		}
+	default:
+		err = p.errorf("expected GRANT, REVOKE, CREATE or DROP")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Allow a single trailing semicolon
+	p.punct(";")
+	if p.peek().kind != tokenEOF {
+		return nil, p.errorf("unexpected %q", p.peek().text)
+	}
+	return stmt, nil
+}
+
+// accessParser is a recursive descent parser for access control statements
+type accessParser struct {
+	query  string
+	tokens []accessToken
+	pos    int
+}
+
+// parseGrant parses the rest of a GRANT or REVOKE statement
+func (p *accessParser) parseGrant(revoke bool) (*AccessStatement, error) {
+	stmt := &AccessStatement{}
+	if revoke && p.keywords("GRANT", "OPTION", "FOR") {
+		stmt.GrantOption = true
+	}
+
+	// The items are privileges if an ON clause follows and roles otherwise
+	type item struct {
+		name    string
+		columns []string
+	}
+	var items []item
+	for {
+		name, err := p.identifier()
+		if err != nil {
+			return nil, err
+		}
+		it := item{name: name}
+		if strings.EqualFold(name, "ALL") {
+			p.keyword("PRIVILEGES")
+		}
+		if p.punct("(") {
+			if it.columns, err = p.identifierList(); err != nil {
+				return nil, err
+			}
+			if !p.punct(")") {
+				return nil, p.errorf("expected )")
+			}
+		}
+		items = append(items, it)
+		if !p.punct(",") {
+			break
+		}
+	}
+
+	preposition := "TO"
+	if revoke {
+		preposition = "FROM"
+	}
+
+	if p.keyword("ON") {
+		stmt.Type = AccessGrant
+		if revoke {
+			stmt.Type = AccessRevoke
+		}
+		for _, it := range items {
+			if strings.EqualFold(it.name, "ALL") {
+				for _, action := range permissions.Actions {
+					stmt.Privileges = append(stmt.Privileges, Privilege{Action: action, Columns: it.columns})
+				}
+				continue
+			}
+			action, err := permissions.ParseAction(it.name)
+			if err != nil {
+				return nil, fmt.Errorf("unknown privilege: %s", it.name)
+			}
+			stmt.Privileges = append(stmt.Privileges, Privilege{Action: action, Columns: it.columns})
+		}
+
+		p.keyword("TABLE")
+		table, err := p.identifier()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Table = table
+	} else {
+		stmt.Type = AccessGrantRole
+		if revoke {
+			stmt.Type = AccessRevokeRole
+		}
+		if stmt.GrantOption {
+			return nil, fmt.Errorf("GRANT OPTION FOR requires privileges")
+		}
+		for _, it := range items {
+			if it.columns != nil {
+				return nil, p.errorf("expected ON after privileges")
+			}
+			stmt.Roles = append(stmt.Roles, it.name)
+		}
+	}
+
+	if !p.keyword(preposition) {
+		return nil, p.errorf("expected %s", preposition)
+	}
+	grantees, err := p.identifierList()
+	if err != nil {
+		return nil, err
+	}
+	for _, grantee := range grantees {
+		if strings.EqualFold(grantee, "PUBLIC") {
+			return nil, fmt.Errorf("%s PUBLIC is not supported", preposition)
+		}
+	}
+	stmt.Grantees = grantees
+
+	// Revokes cascade to dependent grants unless RESTRICT is given
+	switch {
+	case revoke && p.keyword("RESTRICT"):
+		stmt.Restrict = true
+	case revoke:
+		p.keyword("CASCADE")
+	case p.keywords("WITH", "GRANT", "OPTION"):
+		if stmt.Type != AccessGrant {
+			return nil, fmt.Errorf("WITH GRANT OPTION requires privileges")
+		}
+		stmt.GrantOption = true
+	}
+	return stmt, nil
+}
+
+// parseCreateRole parses the rest of a CREATE ROLE statement
+func (p *accessParser) parseCreateRole() (*AccessStatement, error) {
+	stmt := &AccessStatement{Type: AccessCreateRole}
+	if p.keyword("IF") {
+		if !p.keyword("NOT") || !p.keyword("EXISTS") {
+			return nil, p.errorf("expected IF NOT EXISTS")
+		}
+		stmt.IfNotExists = true
+	}
+	name, err := p.identifier()
+	if err != nil {
+		return nil, err
+	}
+	stmt.Name = name
+	return stmt, nil
+}
+
+// parseDropRole parses the rest of a DROP ROLE statement
+func (p *accessParser) parseDropRole() (*AccessStatement, error) {
+	stmt := &AccessStatement{Type: AccessDropRole}
+	if p.keyword("IF") {
+		if !p.keyword("EXISTS") {
+			return nil, p.errorf("expected IF EXISTS")
+		}
+		stmt.IfExists = true
+	}
+	name, err := p.identifier()
+	if err != nil {
+		return nil, err
+	}
+	stmt.Name = name
+	return stmt, nil
+}
+
+// parseCreatePolicy parses the rest of a CREATE POLICY statement:
+//
+//	CREATE POLICY name ON table [AS PERMISSIVE] [FOR command] [TO roles]
+//	    [USING (condition)] [WITH CHECK (condition)]
+func (p *accessParser) parseCreatePolicy() (*AccessStatement, error) {
+	stmt := &AccessStatement{Type: AccessCreatePolicy}
+	var err error
+	if stmt.Name, err = p.identifier(); err != nil {
+		return nil, err
+	}
+	if !p.keyword("ON") {
+		return nil, p.errorf("expected ON")
+	}
+	if stmt.Table, err = p.identifier(); err != nil {
+		return nil, err
+	}
+
+	if p.keyword("AS") {
+		switch {
+		case p.keyword("PERMISSIVE"):
+		case p.keyword("RESTRICTIVE"):
+			return nil, fmt.Errorf("restrictive policies are not supported")
+		default:
+			return nil, p.errorf("expected PERMISSIVE")
+		}
+	}
+
+	// Policies apply to all commands unless FOR names one
+	command := "ALL"
+	if p.keyword("FOR") {
+		if command, err = p.identifier(); err != nil {
+			return nil, err
+		}
+		command = strings.ToUpper(command)
+	}
+	switch command {
+	case "ALL":
+		stmt.Actions = []permissions.Action{permissions.Select, permissions.Insert, permissions.Update, permissions.Delete}
+	case "SELECT":
+		stmt.Actions = []permissions.Action{permissions.Select}
+	case "INSERT":
+		stmt.Actions = []permissions.Action{permissions.Insert}
+	case "UPDATE":
+		stmt.Actions = []permissions.Action{permissions.Update}
+	case "DELETE":
+		stmt.Actions = []permissions.Action{permissions.Delete}
+	default:
+		return nil, fmt.Errorf("unknown policy command: %s", command)
+	}
+
+	if p.keyword("TO") {
+		roles, err := p.identifierList()
+		if err != nil {
+			return nil, err
+		}
+		for _, role := range roles {
+			if strings.EqualFold(role, "PUBLIC") {
+				stmt.Roles = nil
+				break
+			}
+			stmt.Roles = append(stmt.Roles, role)
+		}
+	}
+
+	if p.keyword("USING") {
+		if stmt.Using, err = p.condition(); err != nil {
+			return nil, err
+		}
+	}
+	if p.keyword("WITH") {
+		if !p.keyword("CHECK") {
+			return nil, p.errorf("expected CHECK")
+		}
+		if stmt.WithCheck, err = p.condition(); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case stmt.Using == "" && stmt.WithCheck == "":
+		return nil, fmt.Errorf("policy %s needs a USING or WITH CHECK condition", stmt.Name)
+	case command == "INSERT" && stmt.Using != "":
+		return nil, fmt.Errorf("only WITH CHECK is allowed for INSERT policies")
+	case (command == "SELECT" || command == "DELETE") && stmt.WithCheck != "":
+		return nil, fmt.Errorf("WITH CHECK is not allowed for %s policies", command)
+	}
+	return stmt, nil
+}
+
+// parseDropPolicy parses the rest of a DROP POLICY statement
+func (p *accessParser) parseDropPolicy() (*AccessStatement, error) {
+	stmt := &AccessStatement{Type: AccessDropPolicy}
+	if p.keyword("IF") {
+		if !p.keyword("EXISTS") {
+			return nil, p.errorf("expected IF EXISTS")
+		}
+		stmt.IfExists = true
+	}
+	var err error
+	if stmt.Name, err = p.identifier(); err != nil {
+		return nil, err
+	}
+	if !p.keyword("ON") {
+		return nil, p.errorf("expected ON")
+	}
+	if stmt.Table, err = p.identifier(); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// condition reads a parenthesized condition and returns its text. The text is
+// checked to be a valid row-level condition.
+func (p *accessParser) condition() (string, error) {
+	open := p.peek()
+	if !p.punct("(") {
+		return "", p.errorf("expected (")
+	}
+	depth := 1
+	for depth > 0 {
+		token := p.next()
+		switch {
+		case token.kind == tokenEOF:
+			return "", p.errorf("unbalanced parentheses")
+		case token.kind == tokenPunct && token.text == "(":
+			depth++
+		case token.kind == tokenPunct && token.text == ")":
+			depth--
+			if depth == 0 {
+				condition := strings.TrimSpace(p.query[open.end:token.start])
+				if condition == "" {
+					return "", p.errorf("empty condition")
+				}
+				if _, err := parseConditionExpr(condition); err != nil {
+					return "", err
+				}
+				return condition, nil
+			}
+		}
+	}
+	return "", p.errorf("unbalanced parentheses")
+}
+
+// identifierList reads a comma-separated list of identifiers
+func (p *accessParser) identifierList() ([]string, error) {
+	var names []string
+	for {
+		name, err := p.identifier()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		if !p.punct(",") {
+			return names, nil
+		}
+	}
+}
+
+// identifier reads a bare or quoted identifier
+func (p *accessParser) identifier() (string, error) {
+	token := p.peek()
+	if token.kind != tokenWord && token.kind != tokenQuotedIdent {
+		return "", p.errorf("expected identifier")
+	}
+	p.pos++
+	return token.text, nil
+}
+
+// keyword consumes the next token if it is the given keyword
+func (p *accessParser) keyword(keyword string) bool {
+	token := p.peek()
+	if token.kind == tokenWord && strings.EqualFold(token.text, keyword) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// keywords consumes the next tokens if they are the given keywords in order
+func (p *accessParser) keywords(keywords ...string) bool {
+	if p.pos+len(keywords) >= len(p.tokens) {
+		return false
+	}
+	for i, keyword := range keywords {
+		token := p.tokens[p.pos+i]
+		if token.kind != tokenWord || !strings.EqualFold(token.text, keyword) {
+			return false
+		}
+	}
+	p.pos += len(keywords)
+	return true
+}
+
+// punct consumes the next token if it is the given punctuation
+func (p *accessParser) punct(punct string) bool {
+	token := p.peek()
+	if token.kind == tokenPunct && token.text == punct {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// peek returns the next token without consuming it
+func (p *accessParser) peek() accessToken {
+	return p.tokens[p.pos]
+}
+
+// next consumes and returns the next token
+func (p *accessParser) next() accessToken {
+	token := p.tokens[p.pos]
+	if token.kind != tokenEOF {
+		p.pos++
+	}
+	return token
+}
+
+// errorf returns a syntax error at the current token
+func (p *accessParser) errorf(format string, args ...interface{}) error {
+	token := p.peek()
+	near := token.text
+	if token.kind == tokenEOF {
+		near = "end of statement"
+	}
+	return fmt.Errorf("syntax error at position %d near %q: %s", token.start+1, near, fmt.Sprintf(format, args...))
+}
+
+// tokenizeAccessStatement splits an access control statement into tokens. The
+// last token is always tokenEOF.
+func tokenizeAccessStatement(query string) ([]accessToken, error) {
+	var tokens []accessToken
+	runes := []rune(query)
+	offsets := make([]int, len(runes)+1)
+	offset := 0
+	for i, r := range runes {
+		offsets[i] = offset
+		offset += len(string(r))
+	}
+	offsets[len(runes)] = offset
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '-' && i+1 < len(runes) && runes[i+1] == '-':
+			// Line comment
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == '$') {
+				i++
+			}
+			tokens = append(tokens, accessToken{kind: tokenWord, text: string(runes[start:i]), start: offsets[start], end: offsets[i]})
+		case r == '"' || r == '`' || r == '\'':
+			// Quoted identifiers and string literals; a doubled quote escapes it
+			start := i
+			var text strings.Builder
+			i++
+			for {
+				if i >= len(runes) {
+					return nil, fmt.Errorf("unterminated quote at position %d", offsets[start]+1)
+				}
+				if runes[i] == r {
+					if i+1 < len(runes) && runes[i+1] == r {
+						text.WriteRune(r)
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				text.WriteRune(runes[i])
+				i++
+			}
+			kind := tokenQuotedIdent
+			if r == '\'' {
+				kind = tokenString
+			}
+			tokens = append(tokens, accessToken{kind: kind, text: text.String(), start: offsets[start], end: offsets[i]})
+		default:
+			// Everything else, e.g. operators, is a single-character token
+			tokens = append(tokens, accessToken{kind: tokenPunct, text: string(r), start: offsets[i], end: offsets[i+1]})
+			i++
+		}
+	}
+	tokens = append(tokens, accessToken{kind: tokenEOF, start: len(query), end: len(query)})
+	return tokens, nil
+}
@@ -0,0 +1,200 @@
+package sqlparser
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+	"github.com/xwb1989/sqlparser"
+)
+
+// checkRowAlias is the name under which check queries for INSERT statements
+// expose the inserted rows
+const checkRowAlias = "new_row"
+
+// BuildCheckQuery builds a query that counts the rows an INSERT or UPDATE
+// statement would write that violate a check condition. A row violates the
+// condition unless the condition is true for it. Columns lists the columns of
+// the table in order and is only needed for an INSERT without a column list.
+// Args are the arguments of the statement; the returned arguments are the
+// ones the check query needs, including the bound session values.
+func BuildCheckQuery(stmt sqlparser.Statement, check string, session *Session, columns []string, args []interface{}) (string, []interface{}, error) {
+	conditionExpr, err := parseConditionExpr(check)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var query string
+	switch s := stmt.(type) {
+	case *sqlparser.Insert:
+		query, conditionExpr, err = insertCheckQuery(s, conditionExpr, columns)
+	case *sqlparser.Update:
+		query, conditionExpr, err = updateCheckQuery(s, conditionExpr)
+	default:
+		return "", nil, fmt.Errorf("check conditions only apply to INSERT and UPDATE statements")
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Bind session variables under their own prefix since the statement may
+	// already use the session parameter names
+	binder := newSessionBinder(session)
+	binder.prefix = checkArgPrefix
+	conditionExpr, err = binder.bind(conditionExpr)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to bind session variables: %v", err)
+	}
+	query += fmt.Sprintf("not coalesce((%s), 0)", sqlparser.String(conditionExpr))
+
+	// Pass only the statement arguments the check query refers to
+	checkArgs, err := usedArgs(query, args)
+	if err != nil {
+		return "", nil, err
+	}
+	return query, append(checkArgs, binder.args...), nil
+}
+
+// insertCheckQuery returns the check query for an INSERT statement up to the
+// violation condition, and the condition rewritten to refer to the inserted rows. Columns the
+// statement does not set are NULL in the condition.
+func insertCheckQuery(stmt *sqlparser.Insert, conditionExpr sqlparser.Expr, columns []string) (string, sqlparser.Expr, error) {
+	table := stmt.Table.Name.String()
+	if len(stmt.Columns) > 0 {
+		columns = columns[:0:0]
+		for _, column := range stmt.Columns {
+			columns = append(columns, column.String())
+		}
+	}
+	if len(columns) == 0 {
+		return "", nil, fmt.Errorf("columns of table %s are unknown", table)
+	}
+
+	var rows string
+	switch r := stmt.Rows.(type) {
+	case sqlparser.Values:
+		rows = sqlparser.String(r)
+	case sqlparser.SelectStatement:
+		rows = sqlparser.String(r)
+	default:
+		return "", nil, fmt.Errorf("unsupported INSERT rows")
+	}
+
+	// Columns that are not inserted are NULL
+	var missing []*sqlparser.ColName
+	err := walkTableColumns(conditionExpr, table, table, func(col *sqlparser.ColName) {
+		if !permissions.ContainsName(columns, col.Name.String()) {
+			missing = append(missing, col)
+		}
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	for _, col := range missing {
+		conditionExpr = sqlparser.ReplaceExpr(conditionExpr, col, &sqlparser.NullVal{})
+	}
+	if err := qualifyColumns(conditionExpr, table, checkRowAlias); err != nil {
+		return "", nil, err
+	}
+
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = sqlparser.String(sqlparser.NewColIdent(column))
+	}
+	query := fmt.Sprintf("with %s(%s) as (%s) select count(*) from %s where ",
+		checkRowAlias, strings.Join(quoted, ", "), rows, checkRowAlias)
+	return query, conditionExpr, nil
+}
+
+// updateCheckQuery returns the check query for an UPDATE statement up to the
+// violation condition, and the condition rewritten to refer to the updated values
+func updateCheckQuery(stmt *sqlparser.Update, conditionExpr sqlparser.Expr) (string, sqlparser.Expr, error) {
+	instances := collectTableInstances(stmt.TableExprs, &stmt.Where, nil)
+	if len(instances) != 1 {
+		return "", nil, fmt.Errorf("check conditions require a single-table UPDATE")
+	}
+	instance := instances[0]
+
+	// Columns set by the statement take their new values
+	values := make(map[string]sqlparser.Expr, len(stmt.Exprs))
+	for _, update := range stmt.Exprs {
+		values[update.Name.Name.Lowered()] = update.Expr
+	}
+	var replaced []*sqlparser.ColName
+	err := walkTableColumns(conditionExpr, instance.table, instance.qualifier, func(col *sqlparser.ColName) {
+		if _, ok := values[col.Name.Lowered()]; ok {
+			replaced = append(replaced, col)
+		}
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	for _, col := range replaced {
+		value, err := cloneExpr(values[col.Name.Lowered()])
+		if err != nil {
+			return "", nil, err
+		}
+		conditionExpr = sqlparser.ReplaceExpr(conditionExpr, col, &sqlparser.ParenExpr{Expr: value})
+	}
+	if err := qualifyColumns(conditionExpr, instance.table, instance.qualifier); err != nil {
+		return "", nil, err
+	}
+
+	query := fmt.Sprintf("select count(*) from %s where ", sqlparser.String(stmt.TableExprs))
+	if stmt.Where != nil {
+		query += fmt.Sprintf("(%s) and ", sqlparser.String(stmt.Where.Expr))
+	}
+	return query, conditionExpr, nil
+}
+
+// walkTableColumns calls fn for every column of a condition that refers to a
+// table, either unqualified or qualified with the table name or its alias.
+// Columns inside subqueries are skipped.
+func walkTableColumns(expr sqlparser.Expr, table, qualifier string, fn func(col *sqlparser.ColName)) error {
+	return sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		switch n := node.(type) {
+		case *sqlparser.Subquery:
+			return false, nil
+		case *sqlparser.ColName:
+			name := n.Qualifier.Name.String()
+			if n.Qualifier.IsEmpty() || strings.EqualFold(name, table) || strings.EqualFold(name, qualifier) {
+				fn(n)
+			}
+		}
+		return true, nil
+	}, expr)
+}
+
+// valArgNames returns the names of the named placeholders of a query
+func valArgNames(query string) (map[string]bool, error) {
+	names := make(map[string]bool)
+	tokenizer := sqlparser.NewStringTokenizer(query)
+	for {
+		typ, val := tokenizer.Scan()
+		switch typ {
+		case 0:
+			return names, nil
+		case sqlparser.LEX_ERROR:
+			return nil, fmt.Errorf("failed to scan check query: %q", val)
+		case sqlparser.VALUE_ARG:
+			names[strings.TrimPrefix(string(val), ":")] = true
+		}
+	}
+}
+
+// usedArgs returns the arguments of a statement, bound by name, that a query
+// derived from it refers to
+func usedArgs(query string, args []interface{}) ([]interface{}, error) {
+	used, err := valArgNames(query)
+	if err != nil {
+		return nil, err
+	}
+	var queryArgs []interface{}
+	for _, arg := range BindStatementArgs(args) {
+		if named, ok := arg.(sql.NamedArg); ok && used[named.Name] {
+			queryArgs = append(queryArgs, arg)
+		}
+	}
+	return queryArgs, nil
+}
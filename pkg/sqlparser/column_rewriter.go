@@ -0,0 +1,408 @@
+package sqlparser
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+	"github.com/xwb1989/sqlparser"
+)
+
+// columnRewriter rewrites the references of a statement to table columns,
+// depending on whether the statement returns, filters by or writes their
+// values. It resolves columns through the FROM clauses of nested statements,
+// so that correlated references reach the tables of the outer statement.
+type columnRewriter struct {
+	// project returns the expression that replaces a column in a select
+	// list, or nil to keep it
+	project func(table, column string, col *sqlparser.ColName) (sqlparser.Expr, error)
+	// filter checks a column that filters, groups, orders or joins rows, or
+	// that an UPDATE statement reads. Operand is the comparison or IS
+	// expression the column is an operand of, if any, which it may rewrite.
+	// It reports whether it rewrote the operand.
+	filter func(table, column string, col *sqlparser.ColName, operand sqlparser.Expr) (bool, error)
+	// write rewrites the value an INSERT or UPDATE statement writes to a
+	// column, and reports whether it did. Value is nil if the value is
+	// computed by a query.
+	write   func(table, column string, value *sqlparser.Expr) (bool, error)
+	columns func(table string) ([]string, error)
+	known   map[string][]string
+	changed bool
+}
+
+// rewriteScope holds the tables of a statement, with the scope of the
+// statement it is nested in for correlated column references
+type rewriteScope struct {
+	instances []tableInstance
+	// derived holds the aliases of derived tables, whose values are
+	// rewritten by their own select lists
+	derived []string
+	// opaque is set if * cannot be expanded from the table columns alone, as
+	// with derived tables and joins with USING or NATURAL
+	opaque bool
+	parent *rewriteScope
+}
+
+// newColumnRewriter creates a rewriter that reads the columns of tables with
+// columns
+func newColumnRewriter(columns func(table string) ([]string, error)) *columnRewriter {
+	return &columnRewriter{columns: columns, known: make(map[string][]string)}
+}
+
+// rewrite rewrites a statement and reports whether it was changed
+func (r *columnRewriter) rewrite(stmt sqlparser.Statement) (bool, error) {
+	switch s := stmt.(type) {
+	case sqlparser.SelectStatement:
+		if err := r.statement(s, nil); err != nil {
+			return false, err
+		}
+	case *sqlparser.Insert:
+		if err := r.insert(s); err != nil {
+			return false, err
+		}
+	case *sqlparser.Update:
+		scope := &rewriteScope{instances: collectTableInstances(s.TableExprs, &s.Where, nil)}
+		for _, expr := range s.Exprs {
+			if err := r.condition(scope, expr.Expr); err != nil {
+				return false, err
+			}
+			if r.write != nil && len(scope.instances) > 0 {
+				if err := r.writeValue(scope.instances[0].table, expr.Name.Name.String(), &expr.Expr); err != nil {
+					return false, err
+				}
+			}
+		}
+		if err := r.conditions(scope, s.Where, s.OrderBy); err != nil {
+			return false, err
+		}
+	case *sqlparser.Delete:
+		scope := &rewriteScope{instances: collectTableInstances(s.TableExprs, &s.Where, nil)}
+		if err := r.conditions(scope, s.Where, s.OrderBy); err != nil {
+			return false, err
+		}
+	}
+	return r.changed, nil
+}
+
+// insert rewrites the rows of an INSERT statement
+func (r *columnRewriter) insert(stmt *sqlparser.Insert) error {
+	rows, isSelect := stmt.Rows.(sqlparser.SelectStatement)
+	if isSelect {
+		if err := r.statement(rows, nil); err != nil {
+			return err
+		}
+	}
+	if r.write == nil {
+		return nil
+	}
+
+	table := stmt.Table.Name.String()
+	columns := make([]string, len(stmt.Columns))
+	for i, col := range stmt.Columns {
+		columns[i] = col.String()
+	}
+	if len(columns) == 0 {
+		var err error
+		if columns, err = r.tableColumns(table); err != nil {
+			return err
+		}
+	}
+	if isSelect {
+		for _, column := range columns {
+			if err := r.writeValue(table, column, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	values, ok := stmt.Rows.(sqlparser.Values)
+	if !ok {
+		return nil
+	}
+	for _, row := range values {
+		for i := range row {
+			if i >= len(columns) {
+				break
+			}
+			if err := r.writeValue(table, columns[i], &row[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeValue rewrites a value written to a column
+func (r *columnRewriter) writeValue(table, column string, value *sqlparser.Expr) error {
+	rewritten, err := r.write(table, column, value)
+	r.changed = r.changed || rewritten
+	return err
+}
+
+// tableColumns returns the columns of a table
+func (r *columnRewriter) tableColumns(table string) ([]string, error) {
+	key := strings.ToLower(table)
+	if cols, ok := r.known[key]; ok {
+		return cols, nil
+	}
+	cols, err := r.columns(table)
+	if err != nil {
+		return nil, err
+	}
+	r.known[key] = cols
+	return cols, nil
+}
+
+// resolve returns the table a column reference resolves to, or false if it
+// does not resolve to a table column, e.g. a column of a derived table
+func (r *columnRewriter) resolve(scope *rewriteScope, col *sqlparser.ColName) (string, bool, error) {
+	name := col.Name.String()
+	for s := scope; s != nil; s = s.parent {
+		if !col.Qualifier.IsEmpty() && permissions.ContainsName(s.derived, col.Qualifier.Name.String()) {
+			return "", false, nil
+		}
+		for _, instance := range s.instances {
+			if !col.Qualifier.IsEmpty() {
+				if strings.EqualFold(col.Qualifier.Name.String(), instance.qualifier) {
+					return instance.table, true, nil
+				}
+				continue
+			}
+			cols, err := r.tableColumns(instance.table)
+			if err != nil {
+				return "", false, err
+			}
+			if permissions.ContainsName(cols, name) {
+				return instance.table, true, nil
+			}
+		}
+	}
+	return "", false, nil
+}
+
+// statement rewrites a SELECT or UNION statement
+func (r *columnRewriter) statement(stmt sqlparser.SelectStatement, parent *rewriteScope) error {
+	switch s := stmt.(type) {
+	case *sqlparser.Select:
+		return r.selectStatement(s, parent)
+	case *sqlparser.Union:
+		if err := r.statement(s.Left, parent); err != nil {
+			return err
+		}
+		return r.statement(s.Right, parent)
+	case *sqlparser.ParenSelect:
+		return r.statement(s.Select, parent)
+	}
+	return nil
+}
+
+// selectStatement rewrites the select list and conditions of a SELECT
+// statement
+func (r *columnRewriter) selectStatement(sel *sqlparser.Select, parent *rewriteScope) error {
+	scope := &rewriteScope{instances: collectTableInstances(sel.From, &sel.Where, nil), parent: parent}
+	var joins []*sqlparser.JoinTableExpr
+	if err := r.fromClause(scope, sel.From, &joins); err != nil {
+		return err
+	}
+	for _, join := range joins {
+		if err := r.condition(scope, join.Condition.On); err != nil {
+			return err
+		}
+		for _, column := range join.Condition.Using {
+			if err := r.condition(scope, &sqlparser.ColName{Name: column}); err != nil {
+				return err
+			}
+		}
+	}
+
+	var exprs sqlparser.SelectExprs
+	for _, selectExpr := range sel.SelectExprs {
+		switch expr := selectExpr.(type) {
+		case *sqlparser.StarExpr:
+			expanded, err := r.expandStar(scope, expr)
+			if err != nil {
+				return err
+			}
+			exprs = append(exprs, expanded...)
+		case *sqlparser.AliasedExpr:
+			if err := r.projectExpr(scope, expr); err != nil {
+				return err
+			}
+			exprs = append(exprs, expr)
+		default:
+			exprs = append(exprs, selectExpr)
+		}
+	}
+	sel.SelectExprs = exprs
+
+	if err := r.conditions(scope, sel.Where, sel.OrderBy); err != nil {
+		return err
+	}
+	if err := r.condition(scope, sel.GroupBy); err != nil {
+		return err
+	}
+	if sel.Having != nil {
+		return r.condition(scope, sel.Having.Expr)
+	}
+	return nil
+}
+
+// fromClause rewrites the derived tables of a FROM clause and collects its
+// joins
+func (r *columnRewriter) fromClause(scope *rewriteScope, tableExprs sqlparser.TableExprs, joins *[]*sqlparser.JoinTableExpr) error {
+	for _, tableExpr := range tableExprs {
+		switch expr := tableExpr.(type) {
+		case *sqlparser.AliasedTableExpr:
+			if subquery, ok := expr.Expr.(*sqlparser.Subquery); ok {
+				scope.derived = append(scope.derived, expr.As.String())
+				scope.opaque = true
+				if err := r.statement(subquery.Select, scope.parent); err != nil {
+					return err
+				}
+			}
+		case *sqlparser.ParenTableExpr:
+			if err := r.fromClause(scope, expr.Exprs, joins); err != nil {
+				return err
+			}
+		case *sqlparser.JoinTableExpr:
+			if len(expr.Condition.Using) > 0 || strings.HasPrefix(expr.Join, "natural") {
+				scope.opaque = true
+			}
+			if err := r.fromClause(scope, sqlparser.TableExprs{expr.LeftExpr, expr.RightExpr}, joins); err != nil {
+				return err
+			}
+			*joins = append(*joins, expr)
+		}
+	}
+	return nil
+}
+
+// expandStar replaces * with the columns it covers if any of them is
+// rewritten, and leaves it alone otherwise
+func (r *columnRewriter) expandStar(scope *rewriteScope, star *sqlparser.StarExpr) (sqlparser.SelectExprs, error) {
+	qualified := !star.TableName.IsEmpty()
+	var exprs sqlparser.SelectExprs
+	rewritten := false
+	for _, instance := range scope.instances {
+		if qualified && !strings.EqualFold(star.TableName.Name.String(), instance.qualifier) {
+			continue
+		}
+		cols, err := r.tableColumns(instance.table)
+		if err != nil {
+			return nil, err
+		}
+		for _, column := range cols {
+			col := &sqlparser.ColName{
+				Name:      sqlparser.NewColIdent(column),
+				Qualifier: sqlparser.TableName{Name: sqlparser.NewTableIdent(instance.qualifier)},
+			}
+			expr := &sqlparser.AliasedExpr{Expr: col}
+			replacement, err := r.project(instance.table, column, col)
+			if err != nil {
+				return nil, err
+			}
+			if replacement != nil {
+				expr.Expr, expr.As = replacement, col.Name
+				rewritten = true
+			}
+			exprs = append(exprs, expr)
+		}
+	}
+	if !rewritten {
+		return sqlparser.SelectExprs{star}, nil
+	}
+	if !qualified && scope.opaque {
+		return nil, fmt.Errorf("cannot expand * with derived tables or USING joins; select the columns explicitly")
+	}
+	r.changed = true
+	return exprs, nil
+}
+
+// projectExpr rewrites the columns of an expression of a select list
+func (r *columnRewriter) projectExpr(scope *rewriteScope, expr *sqlparser.AliasedExpr) error {
+	var cols []*sqlparser.ColName
+	err := sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		switch n := node.(type) {
+		case *sqlparser.Subquery:
+			return false, r.statement(n.Select, scope)
+		case *sqlparser.ColName:
+			cols = append(cols, n)
+		}
+		return true, nil
+	}, expr.Expr)
+	if err != nil {
+		return err
+	}
+
+	for _, col := range cols {
+		table, ok, err := r.resolve(scope, col)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		replacement, err := r.project(table, col.Name.String(), col)
+		if err != nil {
+			return err
+		}
+		if replacement == nil {
+			continue
+		}
+		// A rewritten column keeps its name in the result
+		if expr.Expr == sqlparser.Expr(col) && expr.As.IsEmpty() {
+			expr.As = col.Name
+		}
+		expr.Expr = sqlparser.ReplaceExpr(expr.Expr, col, replacement)
+		r.changed = true
+	}
+	return nil
+}
+
+// conditions checks the columns of the WHERE and ORDER BY clauses of a
+// statement
+func (r *columnRewriter) conditions(scope *rewriteScope, where *sqlparser.Where, orderBy sqlparser.OrderBy) error {
+	if where != nil {
+		if err := r.condition(scope, where.Expr); err != nil {
+			return err
+		}
+	}
+	return r.condition(scope, orderBy)
+}
+
+// condition checks the columns of a part of a statement that filters, groups
+// or orders rows, and rewrites its subqueries
+func (r *columnRewriter) condition(scope *rewriteScope, node sqlparser.SQLNode) error {
+	if node == nil {
+		return nil
+	}
+	// Comparisons are visited before their operands
+	operands := make(map[*sqlparser.ColName]sqlparser.Expr)
+	return sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		switch n := node.(type) {
+		case *sqlparser.Subquery:
+			return false, r.statement(n.Select, scope)
+		case *sqlparser.ComparisonExpr:
+			for _, operand := range []sqlparser.Expr{n.Left, n.Right} {
+				if col, ok := operand.(*sqlparser.ColName); ok {
+					operands[col] = n
+				}
+			}
+		case *sqlparser.IsExpr:
+			if col, ok := n.Expr.(*sqlparser.ColName); ok {
+				operands[col] = n
+			}
+		case *sqlparser.ColName:
+			table, ok, err := r.resolve(scope, n)
+			if err != nil || !ok {
+				return false, err
+			}
+			rewritten, err := r.filter(table, n.Name.String(), n, operands[n])
+			if err != nil {
+				return false, err
+			}
+			r.changed = r.changed || rewritten
+		}
+		return true, nil
+	}, node)
+}
@@ -0,0 +1,127 @@
+package sqlparser
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/xwb1989/sqlparser"
+)
+
+// EncryptFunc and DecryptFunc are the SQL functions that encrypt and decrypt
+// the values of a column with the cipher of the connection, called as
+// secure_encrypt('table', 'column', value) and secure_decrypt('table',
+// 'column', column)
+const (
+	EncryptFunc = "secure_encrypt"
+	DecryptFunc = "secure_decrypt"
+)
+
+// ErrEncryptedCondition is returned when a statement filters, groups, orders
+// or joins rows by an encrypted column in a way the ciphertext cannot answer
+var ErrEncryptedCondition = errors.New("encrypted column cannot be used in a condition")
+
+// EncryptedColumn describes an encrypted column to ApplyEncryption
+type EncryptedColumn struct {
+	// Deterministic columns encrypt equal values to equal ciphertexts, so
+	// they can be compared for equality
+	Deterministic bool
+	// Decrypt is set if the user may read the plaintext of the column
+	Decrypt bool
+}
+
+// ApplyEncryption rewrites a statement on tables with encrypted columns. Values
+// written to encrypted columns by INSERT and UPDATE are wrapped in
+// EncryptFunc, and columns the statement returns are wrapped in DecryptFunc
+// if the user may decrypt them. Deterministic columns may be compared with =,
+// !=, IN and NOT IN against literals and parameters, which are encrypted in
+// turn; any other use of an encrypted column in a condition, except IS NULL,
+// fails with ErrEncryptedCondition. Encrypted returns the encryption of a
+// column, and columns lists the columns of a table. It reports whether the
+// statement was changed. Statements calling the functions themselves are
+// rejected by Parse.
+func ApplyEncryption(stmt sqlparser.Statement, encrypted func(table, column string) (EncryptedColumn, bool), columns func(table string) ([]string, error)) (bool, error) {
+	r := newColumnRewriter(columns)
+	r.project = func(table, column string, col *sqlparser.ColName) (sqlparser.Expr, error) {
+		if enc, ok := encrypted(table, column); ok && enc.Decrypt {
+			return cipherExpr(DecryptFunc, table, column, col), nil
+		}
+		return nil, nil
+	}
+	r.filter = func(table, column string, col *sqlparser.ColName, operand sqlparser.Expr) (bool, error) {
+		enc, ok := encrypted(table, column)
+		if !ok {
+			return false, nil
+		}
+		switch op := operand.(type) {
+		case *sqlparser.IsExpr:
+			if op.Operator == sqlparser.IsNullStr || op.Operator == sqlparser.IsNotNullStr {
+				return false, nil
+			}
+		case *sqlparser.ComparisonExpr:
+			if !enc.Deterministic {
+				break
+			}
+			switch op.Operator {
+			case sqlparser.EqualStr, sqlparser.NotEqualStr, sqlparser.InStr, sqlparser.NotInStr:
+			default:
+				return false, fmt.Errorf("%w: %s.%s only supports equality comparisons", ErrEncryptedCondition, table, column)
+			}
+			other := &op.Right
+			if op.Right == sqlparser.Expr(col) {
+				other = &op.Left
+			}
+			if err := encryptOperand(other, table, column); err != nil {
+				return false, fmt.Errorf("%w: %s.%s: %v", ErrEncryptedCondition, table, column, err)
+			}
+			return true, nil
+		}
+		if enc.Deterministic {
+			return false, fmt.Errorf("%w: %s.%s only supports equality comparisons", ErrEncryptedCondition, table, column)
+		}
+		return false, fmt.Errorf("%w: %s.%s is not deterministic", ErrEncryptedCondition, table, column)
+	}
+	r.write = func(table, column string, value *sqlparser.Expr) (bool, error) {
+		if _, ok := encrypted(table, column); !ok {
+			return false, nil
+		}
+		if value == nil {
+			return false, fmt.Errorf("values of encrypted column %s.%s must be given in VALUES", table, column)
+		}
+		*value = cipherExpr(EncryptFunc, table, column, *value)
+		return true, nil
+	}
+	return r.rewrite(stmt)
+}
+
+// encryptOperand encrypts the literals or parameters an encrypted column is
+// compared with
+func encryptOperand(operand *sqlparser.Expr, table, column string) error {
+	if tuple, ok := (*operand).(sqlparser.ValTuple); ok {
+		for i := range tuple {
+			if err := encryptOperand(&tuple[i], table, column); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	switch (*operand).(type) {
+	case *sqlparser.SQLVal, *sqlparser.NullVal:
+		*operand = cipherExpr(EncryptFunc, table, column, *operand)
+		return nil
+	}
+	return fmt.Errorf("can only be compared with literals and parameters, not %s", strings.TrimSpace(sqlparser.String(*operand)))
+}
+
+// cipherExpr returns a call of EncryptFunc or DecryptFunc on a value of a
+// column
+func cipherExpr(fn, table, column string, value sqlparser.Expr) sqlparser.Expr {
+	return &sqlparser.FuncExpr{
+		Name: sqlparser.NewColIdent(fn),
+		Exprs: sqlparser.SelectExprs{
+			&sqlparser.AliasedExpr{Expr: sqlparser.NewStrVal([]byte(table))},
+			&sqlparser.AliasedExpr{Expr: sqlparser.NewStrVal([]byte(column))},
+			&sqlparser.AliasedExpr{Expr: value},
+		},
+	}
+}
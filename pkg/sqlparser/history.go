@@ -0,0 +1,45 @@
+package sqlparser
+
+import (
+	"fmt"
+
+	"github.com/xwb1989/sqlparser"
+)
+
+// BuildImageQuery builds a query that selects the rowid and every column of
+// the rows an UPDATE or DELETE statement writes, as they are before it runs.
+// It returns the name of the table, the query and the arguments it needs out
+// of the arguments of the statement. The statement should already carry its
+// row-level conditions so that the query selects exactly the rows it writes.
+func BuildImageQuery(stmt sqlparser.Statement, args []interface{}) (string, string, []interface{}, error) {
+	var tableExprs sqlparser.TableExprs
+	var where *sqlparser.Where
+	var orderBy sqlparser.OrderBy
+	var limit *sqlparser.Limit
+	switch s := stmt.(type) {
+	case *sqlparser.Update:
+		tableExprs, where, orderBy, limit = s.TableExprs, s.Where, s.OrderBy, s.Limit
+	case *sqlparser.Delete:
+		if len(s.Targets) > 0 {
+			return "", "", nil, fmt.Errorf("row images require a single-table DELETE")
+		}
+		tableExprs, where, orderBy, limit = s.TableExprs, s.Where, s.OrderBy, s.Limit
+	default:
+		return "", "", nil, fmt.Errorf("row images only apply to UPDATE and DELETE statements")
+	}
+	instances := collectTableInstances(tableExprs, &where, nil)
+	if len(instances) != 1 || len(tableExprs) != 1 {
+		return "", "", nil, fmt.Errorf("row images require a single-table statement")
+	}
+	instance := instances[0]
+
+	qualifier := sqlparser.String(sqlparser.NewTableIdent(instance.qualifier))
+	query := fmt.Sprintf("select %s.rowid, %s.* from %s", qualifier, qualifier, sqlparser.String(tableExprs))
+	query += sqlparser.String(where) + sqlparser.String(orderBy) + sqlparser.String(limit)
+
+	imageArgs, err := usedArgs(query, args)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return instance.table, query, imageArgs, nil
+}
@@ -0,0 +1,52 @@
+package sqlparser
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/xwb1989/sqlparser"
+)
+
+// MaskFunc is the SQL function that masks the values of a column,
+// called as secure_mask('mask', column)
+const MaskFunc = "secure_mask"
+
+// ErrMaskedCondition is returned when a statement filters, groups, orders or
+// joins rows by a masked column, which would reveal its raw values
+var ErrMaskedCondition = errors.New("masked column cannot be used in a condition")
+
+// ApplyMasks rewrites a statement so that it returns masked values of the
+// columns that mask names a mask for, by wrapping them in MaskFunc wherever
+// the statement returns their values, including inside expressions and
+// subqueries. * is expanded when it covers masked columns. Masked columns in
+// WHERE, GROUP BY, HAVING, ORDER BY and join conditions, and in the values
+// and conditions of UPDATE and DELETE statements, fail with
+// ErrMaskedCondition. Mask returns "" for unmasked columns, and columns lists
+// the columns of a table. It reports whether the statement was changed.
+func ApplyMasks(stmt sqlparser.Statement, mask func(table, column string) string, columns func(table string) ([]string, error)) (bool, error) {
+	r := newColumnRewriter(columns)
+	r.project = func(table, column string, col *sqlparser.ColName) (sqlparser.Expr, error) {
+		if kind := mask(table, column); kind != "" {
+			return maskExpr(kind, col), nil
+		}
+		return nil, nil
+	}
+	r.filter = func(table, column string, col *sqlparser.ColName, operand sqlparser.Expr) (bool, error) {
+		if mask(table, column) != "" {
+			return false, fmt.Errorf("%w: %s.%s", ErrMaskedCondition, table, column)
+		}
+		return false, nil
+	}
+	return r.rewrite(stmt)
+}
+
+// maskExpr returns the call of MaskFunc that masks a column
+func maskExpr(kind string, col *sqlparser.ColName) sqlparser.Expr {
+	return &sqlparser.FuncExpr{
+		Name: sqlparser.NewColIdent(MaskFunc),
+		Exprs: sqlparser.SelectExprs{
+			&sqlparser.AliasedExpr{Expr: sqlparser.NewStrVal([]byte(kind))},
+			&sqlparser.AliasedExpr{Expr: col},
+		},
+	}
+}
@@ -1,6 +1,7 @@
 package sqlparser
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/wemcdonald/secure_sqlite/pkg/auth"
@@ -30,16 +31,58 @@ func NewParser(authProvider auth.Provider) *Parser {
 	}
 }
 
-// Parse parses a SQL query and returns a parsed statement
+// ErrInternalFunction is returned when a query names one of the SQL functions
+// that only rewritten statements may call
+var ErrInternalFunction = errors.New("internal function cannot be called directly")
+
+// internalFuncs are the SQL functions of rewritten statements, which would let
+// users mask, encrypt and decrypt arbitrary values
+var internalFuncs = []string{MaskFunc, EncryptFunc, DecryptFunc}
+
+// Parse parses a SQL query and returns a parsed statement. Queries that name
+// an internal function are rejected with ErrInternalFunction.
 func (p *Parser) Parse(query string) (sqlparser.Statement, error) {
+	if err := checkInternalFunctions(query); err != nil {
+		return nil, err
+	}
 	return sqlparser.Parse(query)
 }
 
+// checkInternalFunctions checks that a query does not name an internal
+// function. The tokens of the query are checked rather than its statement,
+// since the bodies of statements such as CREATE VIEW and CREATE TRIGGER are
+// not parsed. Quoted strings are only checked where they name a function.
+func checkInternalFunctions(query string) error {
+	tokenizer := sqlparser.NewStringTokenizer(query)
+	var previous []byte
+	for {
+		typ, value := tokenizer.Scan()
+		switch {
+		case typ == 0 || typ == sqlparser.LEX_ERROR:
+			return nil
+		case typ == sqlparser.ID && permissions.ContainsName(internalFuncs, string(value)):
+			return fmt.Errorf("%w: %s", ErrInternalFunction, value)
+		case typ == '(' && permissions.ContainsName(internalFuncs, string(previous)):
+			return fmt.Errorf("%w: %s", ErrInternalFunction, previous)
+		}
+		previous = nil
+		if typ == sqlparser.STRING {
+			previous = value
+		}
+	}
+}
+
 // TransformQuery transforms a SQL query based on user permissions
 func (p *Parser) TransformQuery(stmt sqlparser.Statement, userID int64) (string, error) {
 	return p.transformer.TransformQuery(stmt, userID)
 }
 
+// TransformQueryWithSession transforms a SQL query based on the permissions of
+// the session user and returns the session values bound by the transformation
+func (p *Parser) TransformQueryWithSession(stmt sqlparser.Statement, session *Session) (string, []interface{}, error) {
+	return p.transformer.TransformQueryWithSession(stmt, session)
+}
+
 // ValidatePermissions checks if the user has permission to execute the statement
 func (p *Parser) ValidatePermissions(stmt sqlparser.Statement, username string) error {
 	return p.validator.ValidatePermissions(stmt, username)
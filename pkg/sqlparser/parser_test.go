@@ -1,7 +1,10 @@
 package sqlparser
 
 import (
+	"database/sql"
+	"errors"
 	"os"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -422,3 +425,857 @@ func TestCheckPermission(t *testing.T) {
 		})
 	}
 }
+
+func TestTransformQueryWithSession(t *testing.T) {
+	authProvider, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	authProvider.AddUser("alice", "alice_token")
+	session := NewSession("alice", 42, []string{"analyst", "auditor"})
+	session.SetAttribute("tenant_id", "acme")
+
+	tests := []struct {
+		name      string
+		query     string
+		condition string
+		want      string
+		wantArgs  []interface{}
+		wantErr   bool
+	}{
+		{
+			name:      "current user id",
+			query:     "SELECT * FROM documents",
+			condition: "owner_id = current_user_id()",
+			want:      "select * from documents where documents.owner_id = :sess_1",
+			wantArgs:  []interface{}{sql.Named("sess_1", int64(42))},
+		},
+		{
+			name:      "current user and setting",
+			query:     "SELECT * FROM documents WHERE id = ?",
+			condition: "owner = current_user() AND tenant_id = current_setting('tenant_id')",
+			want:      "select * from documents where id = :v1 and documents.owner = :sess_1 and documents.tenant_id = :sess_2",
+			wantArgs:  []interface{}{sql.Named("sess_1", "alice"), sql.Named("sess_2", "acme")},
+		},
+		{
+			name:      "existing OR is parenthesized",
+			query:     "SELECT * FROM documents WHERE public = 1 OR id = 2",
+			condition: "owner_id = current_user_id() OR shared = 1",
+			want:      "select * from documents where (public = 1 or id = 2) and (documents.owner_id = :sess_1 or documents.shared = 1)",
+			wantArgs:  []interface{}{sql.Named("sess_1", int64(42))},
+		},
+		{
+			name:      "current roles",
+			query:     "DELETE FROM documents",
+			condition: "role IN (current_roles())",
+			want:      "delete from documents where documents.role in (:sess_1, :sess_2)",
+			wantArgs:  []interface{}{sql.Named("sess_1", "analyst"), sql.Named("sess_2", "auditor")},
+		},
+		{
+			name:      "missing session attribute",
+			query:     "SELECT * FROM documents",
+			condition: "region = current_setting('region')",
+			wantErr:   true,
+		},
+		{
+			name:      "current roles outside IN list",
+			query:     "SELECT * FROM documents",
+			condition: "role = current_roles()",
+			wantErr:   true,
+		},
+	}
+
+	parser := NewParser(authProvider)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := authProvider.UpdateUserPermissions("alice", []permissions.Permission{{
+				Type:      permissions.RowPermission,
+				Table:     "documents",
+				Condition: tt.condition,
+			}})
+			if err != nil {
+				t.Fatalf("UpdateUserPermissions() error = %v", err)
+			}
+
+			stmt, err := sqlparser.Parse(tt.query)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+
+			got, args, err := parser.TransformQueryWithSession(stmt, session)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("TransformQueryWithSession() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			if normalizeSQL(got) != normalizeSQL(tt.want) {
+				t.Errorf("TransformQueryWithSession() = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("TransformQueryWithSession() args = %v, want %v", args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestTransformQueryTableInstances(t *testing.T) {
+	authProvider, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	authProvider.AddUser("alice", "alice_token")
+	authProvider.AddPermission("alice", permissions.Permission{
+		Type:      permissions.RowPermission,
+		Table:     "employees",
+		Condition: "region = 'emea' AND employees.active = 1",
+	})
+	session := NewSession("alice", 42, nil)
+
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{
+			name:  "unaliased table",
+			query: "SELECT name FROM employees",
+			want:  "select name from employees where employees.region = 'emea' and employees.active = 1",
+		},
+		{
+			name:  "self join",
+			query: "SELECT e.name, m.name FROM employees e JOIN employees m ON e.manager_id = m.id",
+			want: "select e.name, m.name from employees as e join employees as m on e.manager_id = m.id " +
+				"where e.region = 'emea' and e.active = 1 and m.region = 'emea' and m.active = 1",
+		},
+		{
+			name:  "left join filters in ON clause",
+			query: "SELECT d.name, e.name FROM departments d LEFT JOIN employees e ON e.department_id = d.id",
+			want: "select d.name, e.name from departments as d left join employees as e " +
+				"on e.department_id = d.id and e.region = 'emea' and e.active = 1",
+		},
+		{
+			name:  "subquery",
+			query: "SELECT name FROM departments WHERE id IN (SELECT department_id FROM employees x WHERE x.salary > 10)",
+			want: "select name from departments where id in " +
+				"(select department_id from employees as x where x.salary > 10 and x.region = 'emea' and x.active = 1)",
+		},
+		{
+			name:  "update target",
+			query: "UPDATE employees SET salary = 0 WHERE id = 7",
+			want:  "update employees set salary = 0 where id = 7 and employees.region = 'emea' and employees.active = 1",
+		},
+	}
+
+	// Count the parses of row conditions
+	parses := 0
+	defer func(parse func(string) (sqlparser.Expr, error)) { parseRowCondition = parse }(parseRowCondition)
+	parseRowCondition = func(condition string) (sqlparser.Expr, error) {
+		parses++
+		return parseConditionExpr(condition)
+	}
+
+	parser := NewParser(authProvider)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stmt, err := sqlparser.Parse(tt.query)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+
+			got, _, err := parser.TransformQueryWithSession(stmt, session)
+			if err != nil {
+				t.Fatalf("TransformQueryWithSession() error = %v", err)
+			}
+
+			wantAST, err := sqlparser.Parse(tt.want)
+			if err != nil {
+				t.Fatalf("Failed to parse expected query: %v", err)
+			}
+			if normalizeSQL(got) != normalizeSQL(sqlparser.String(wantAST)) {
+				t.Errorf("TransformQueryWithSession() = %v\nwant %v", got, sqlparser.String(wantAST))
+			}
+		})
+	}
+
+	// The condition is parsed once for every occurrence of every statement
+	if parses != 1 {
+		t.Errorf("Expected the condition to be parsed once, got %d parses", parses)
+	}
+}
+
+func TestParseAccessStatement(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    *AccessStatement
+		wantErr bool
+	}{
+		{
+			name:  "grant columns",
+			query: "GRANT SELECT (id, amount), UPDATE ON TABLE orders TO analyst, alice",
+			want: &AccessStatement{
+				Type: AccessGrant,
+				Privileges: []Privilege{
+					{Action: permissions.Select, Columns: []string{"id", "amount"}},
+					{Action: permissions.Update},
+				},
+				Table:    "orders",
+				Grantees: []string{"analyst", "alice"},
+			},
+		},
+		{
+			name:  "revoke all",
+			query: "REVOKE ALL PRIVILEGES ON orders FROM analyst;",
+			want: &AccessStatement{
+				Type: AccessRevoke,
+				Privileges: []Privilege{
+					{Action: permissions.Select},
+					{Action: permissions.Insert},
+					{Action: permissions.Update},
+					{Action: permissions.Delete},
+					{Action: permissions.Create},
+					{Action: permissions.Drop},
+					{Action: permissions.Alter},
+				},
+				Table:    "orders",
+				Grantees: []string{"analyst"},
+			},
+		},
+		{
+			name:  "grant with grant option",
+			query: "GRANT SELECT ON orders TO lead WITH GRANT OPTION",
+			want: &AccessStatement{
+				Type:        AccessGrant,
+				Privileges:  []Privilege{{Action: permissions.Select}},
+				Table:       "orders",
+				Grantees:    []string{"lead"},
+				GrantOption: true,
+			},
+		},
+		{
+			name:  "revoke grant option restrict",
+			query: "REVOKE GRANT OPTION FOR SELECT ON orders FROM lead RESTRICT",
+			want: &AccessStatement{
+				Type:        AccessRevoke,
+				Privileges:  []Privilege{{Action: permissions.Select}},
+				Table:       "orders",
+				Grantees:    []string{"lead"},
+				GrantOption: true,
+				Restrict:    true,
+			},
+		},
+		{
+			name:  "revoke cascade",
+			query: "REVOKE SELECT ON orders FROM lead CASCADE",
+			want: &AccessStatement{
+				Type:       AccessRevoke,
+				Privileges: []Privilege{{Action: permissions.Select}},
+				Table:      "orders",
+				Grantees:   []string{"lead"},
+			},
+		},
+		{
+			name:    "role with grant option",
+			query:   "GRANT analyst TO alice WITH GRANT OPTION",
+			wantErr: true,
+		},
+		{
+			name:  "grant role",
+			query: `GRANT analyst TO "alice"`,
+			want:  &AccessStatement{Type: AccessGrantRole, Roles: []string{"analyst"}, Grantees: []string{"alice"}},
+		},
+		{
+			name:  "drop role",
+			query: "DROP ROLE IF EXISTS analyst",
+			want:  &AccessStatement{Type: AccessDropRole, Name: "analyst", IfExists: true},
+		},
+		{
+			name: "create policy",
+			query: "CREATE POLICY regional ON orders FOR UPDATE TO analyst " +
+				"USING (region = current_setting('region')) WITH CHECK (amount < 100)",
+			want: &AccessStatement{
+				Type:      AccessCreatePolicy,
+				Name:      "regional",
+				Table:     "orders",
+				Roles:     []string{"analyst"},
+				Actions:   []permissions.Action{permissions.Update},
+				Using:     "region = current_setting('region')",
+				WithCheck: "amount < 100",
+			},
+		},
+		{
+			name:    "grant to public",
+			query:   "GRANT SELECT ON orders TO PUBLIC",
+			wantErr: true,
+		},
+		{
+			name:    "check on select policy",
+			query:   "CREATE POLICY p ON orders FOR SELECT WITH CHECK (amount < 100)",
+			wantErr: true,
+		},
+		{
+			name:    "trailing tokens",
+			query:   "DROP ROLE analyst CASCADE",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !IsAccessStatement(tt.query) {
+				t.Fatalf("IsAccessStatement(%q) = false", tt.query)
+			}
+			got, err := ParseAccessStatement(tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseAccessStatement() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseAccessStatement() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	for _, query := range []string{"SELECT * FROM grants", "CREATE TABLE roles (id INTEGER)", "DROP TABLE policy"} {
+		if IsAccessStatement(query) {
+			t.Errorf("IsAccessStatement(%q) = true", query)
+		}
+	}
+}
+
+func TestBuildCheckQuery(t *testing.T) {
+	session := NewSession("alice", 42, nil)
+	session.SetAttribute("region", "emea")
+
+	tests := []struct {
+		name     string
+		query    string
+		args     []interface{}
+		columns  []string
+		check    string
+		want     string
+		wantArgs []interface{}
+		wantErr  bool
+	}{
+		{
+			name:  "insert with columns",
+			query: "INSERT INTO orders (region, amount) VALUES (?, ?)",
+			args:  []interface{}{"emea", 10},
+			check: "region = current_setting('region') AND owner_id IS NULL",
+			want: "with new_row(region, amount) as (values (:v1, :v2)) select count(*) from new_row " +
+				"where not coalesce((new_row.region = :chk_1 and null is null), 0)",
+			wantArgs: []interface{}{sql.Named("v1", "emea"), sql.Named("v2", 10), sql.Named("chk_1", "emea")},
+		},
+		{
+			name:    "insert without columns",
+			query:   "INSERT INTO orders VALUES (1, 'emea', 10)",
+			columns: []string{"id", "region", "amount"},
+			check:   "amount < 100",
+			want: "with new_row(id, region, amount) as (values (1, 'emea', 10)) select count(*) from new_row " +
+				"where not coalesce((new_row.amount < 100), 0)",
+		},
+		{
+			name:  "update",
+			query: "UPDATE orders SET region = ? WHERE id = ?",
+			args:  []interface{}{"apac", 7},
+			check: "region = current_setting('region') OR amount > 0",
+			want: "select count(*) from orders where (id = :v2) " +
+				"and not coalesce(((:v1) = :chk_1 or orders.amount > 0), 0)",
+			wantArgs: []interface{}{sql.Named("v1", "apac"), sql.Named("v2", 7), sql.Named("chk_1", "emea")},
+		},
+		{
+			name:    "insert without known columns",
+			query:   "INSERT INTO orders VALUES (1, 'emea', 10)",
+			check:   "amount < 100",
+			wantErr: true,
+		},
+		{
+			name:    "delete",
+			query:   "DELETE FROM orders",
+			check:   "amount < 100",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stmt, err := sqlparser.Parse(tt.query)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+
+			got, args, err := BuildCheckQuery(stmt, tt.check, session, tt.columns, tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("BuildCheckQuery() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if normalizeSQL(got) != normalizeSQL(tt.want) {
+				t.Errorf("BuildCheckQuery() = %v\nwant %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("BuildCheckQuery() args = %v, want %v", args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestBuildImageQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		args     []interface{}
+		want     string
+		wantArgs []interface{}
+		wantErr  bool
+	}{
+		{
+			name:     "update",
+			query:    "UPDATE orders SET total = ? WHERE id = ?",
+			args:     []interface{}{10, 7},
+			want:     "select orders.rowid, orders.* from orders where id = :v2",
+			wantArgs: []interface{}{sql.Named("v2", 7)},
+		},
+		{
+			name:  "update with alias and limit",
+			query: "UPDATE orders AS o SET total = 0 WHERE o.region = 'emea' ORDER BY o.id LIMIT 5",
+			want:  "select o.rowid, o.* from orders as o where o.region = 'emea' order by o.id asc limit 5",
+		},
+		{
+			name:  "delete",
+			query: "DELETE FROM orders",
+			want:  "select orders.rowid, orders.* from orders",
+		},
+		{
+			name:    "insert",
+			query:   "INSERT INTO orders (id) VALUES (1)",
+			wantErr: true,
+		},
+		{
+			name:    "multi-table update",
+			query:   "UPDATE orders, customers SET orders.total = 0",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stmt, err := sqlparser.Parse(tt.query)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+
+			table, got, args, err := BuildImageQuery(stmt, tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("BuildImageQuery() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if table != "orders" {
+				t.Errorf("BuildImageQuery() table = %v, want orders", table)
+			}
+			if normalizeSQL(got) != normalizeSQL(tt.want) {
+				t.Errorf("BuildImageQuery() = %v\nwant %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("BuildImageQuery() args = %v, want %v", args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestReturnedColumns(t *testing.T) {
+	schema := map[string][]string{
+		"patients": {"id", "name", "ssn"},
+		"visits":   {"patient_id", "diagnosis"},
+	}
+	columns := func(table string) ([]string, error) {
+		return schema[table], nil
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		want     []TableColumns
+		wantKeys string
+	}{
+		{
+			name:     "columns and expressions",
+			query:    "SELECT name, upper(ssn) AS s FROM patients WHERE id = 1",
+			want:     []TableColumns{{Table: "patients", Qualifier: "patients", Columns: []string{"name", "ssn"}}},
+			wantKeys: "select name, upper(ssn) as s, patients.id from patients where id = 1",
+		},
+		{
+			name:  "star and unqualified join columns",
+			query: "SELECT p.*, diagnosis FROM patients AS p JOIN visits AS v ON v.patient_id = p.id",
+			want: []TableColumns{
+				{Table: "patients", Qualifier: "p", Columns: []string{"id", "name", "ssn"}},
+				{Table: "visits", Qualifier: "v", Columns: []string{"diagnosis"}},
+			},
+			wantKeys: "select p.*, diagnosis, p.id, v.patient_id from patients as p join visits as v on v.patient_id = p.id",
+		},
+		{
+			name:  "subqueries",
+			query: "SELECT name, (SELECT diagnosis FROM visits LIMIT 1) FROM (SELECT name FROM patients) AS t",
+			want: []TableColumns{
+				{Table: "patients", Columns: []string{"name"}},
+				{Table: "visits", Columns: []string{"diagnosis"}},
+			},
+		},
+		{
+			name:  "aggregate",
+			query: "SELECT count(ssn) FROM patients",
+			want:  []TableColumns{{Table: "patients", Qualifier: "patients", Columns: []string{"ssn"}}},
+		},
+		{
+			name:  "distinct",
+			query: "SELECT DISTINCT name FROM patients",
+			want:  []TableColumns{{Table: "patients", Qualifier: "patients", Columns: []string{"name"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stmt, err := sqlparser.Parse(tt.query)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+
+			got, err := ReturnedColumns(stmt, columns)
+			if err != nil {
+				t.Fatalf("ReturnedColumns() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReturnedColumns() = %+v, want %+v", got, tt.want)
+			}
+
+			var keys []TableColumns
+			for _, read := range got {
+				if read.Qualifier != "" {
+					keys = append(keys, TableColumns{Table: read.Table, Qualifier: read.Qualifier, Columns: []string{schema[read.Table][0]}})
+				}
+			}
+			if len(keys) == 0 {
+				return
+			}
+			query, ok := AppendKeyColumns(stmt, keys)
+			if ok != (tt.wantKeys != "") {
+				t.Fatalf("AppendKeyColumns() ok = %v, want %v", ok, tt.wantKeys != "")
+			}
+			if ok && normalizeSQL(query) != normalizeSQL(tt.wantKeys) {
+				t.Errorf("AppendKeyColumns() = %v\nwant %v", query, tt.wantKeys)
+			}
+		})
+	}
+}
+
+func TestReferencedColumns(t *testing.T) {
+	schema := map[string][]string{
+		"patients": {"id", "name", "ssn"},
+		"visits":   {"patient_id", "diagnosis"},
+	}
+	columns := func(table string) ([]string, error) {
+		return schema[table], nil
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  map[string][]string
+	}{
+		{
+			name:  "star",
+			query: "SELECT * FROM patients",
+			want:  map[string][]string{"patients": {"id", "name", "ssn"}},
+		},
+		{
+			name:  "expressions and conditions",
+			query: "SELECT name || '' FROM patients WHERE ssn LIKE '1%' GROUP BY name HAVING max(id) > 0 ORDER BY name",
+			want:  map[string][]string{"patients": {"name", "ssn", "id"}},
+		},
+		{
+			name:  "joins and subqueries",
+			query: "SELECT p.name FROM patients AS p JOIN visits AS v ON v.patient_id = p.id WHERE p.ssn IN (SELECT ssn FROM patients)",
+			want: map[string][]string{
+				"patients": {"id", "name", "ssn"},
+				"visits":   {"patient_id"},
+			},
+		},
+		{
+			name:  "insert without columns",
+			query: "INSERT INTO visits SELECT id, name FROM patients",
+			want: map[string][]string{
+				"patients": {"id", "name"},
+				"visits":   {"patient_id", "diagnosis"},
+			},
+		},
+		{
+			name:  "update",
+			query: "UPDATE patients SET name = ssn WHERE id = 1",
+			want:  map[string][]string{"patients": {"ssn", "name", "id"}},
+		},
+		{
+			name:  "count star",
+			query: "SELECT count(*) FROM patients",
+			want:  map[string][]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stmt, err := sqlparser.Parse(tt.query)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			got, err := ReferencedColumns(stmt, columns)
+			if err != nil {
+				t.Fatalf("ReferencedColumns() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReferencedColumns() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyMasks(t *testing.T) {
+	schema := map[string][]string{
+		"patients": {"id", "name", "ssn"},
+		"visits":   {"patient_id", "diagnosis"},
+	}
+	columns := func(table string) ([]string, error) {
+		return schema[table], nil
+	}
+	mask := func(table, column string) string {
+		if table == "patients" && column == "ssn" {
+			return "last4"
+		}
+		return ""
+	}
+
+	tests := []struct {
+		name    string
+		query   string
+		want    string
+		wantErr error
+	}{
+		{
+			name:  "column keeps its name",
+			query: "SELECT id, ssn FROM patients",
+			want:  "select id, secure_mask('last4', ssn) as ssn from patients",
+		},
+		{
+			name:  "expressions and aliases",
+			query: "SELECT upper(p.ssn) AS s FROM patients AS p",
+			want:  "select upper(secure_mask('last4', p.ssn)) as s from patients as p",
+		},
+		{
+			name:  "star",
+			query: "SELECT p.*, v.diagnosis FROM patients AS p JOIN visits AS v ON v.patient_id = p.id",
+			want:  "select p.id, p.name, secure_mask('last4', p.ssn) as ssn, v.diagnosis from patients as p join visits as v on v.patient_id = p.id",
+		},
+		{
+			name:  "star without masked columns",
+			query: "SELECT * FROM visits",
+		},
+		{
+			name:  "subqueries",
+			query: "SELECT t.s FROM (SELECT ssn AS s FROM patients) AS t WHERE t.s = '1234'",
+			want:  "select t.s from (select secure_mask('last4', ssn) as s from patients) as t where t.s = '1234'",
+		},
+		{
+			name:  "correlated subquery",
+			query: "SELECT diagnosis, (SELECT ssn FROM patients WHERE id = patient_id) FROM visits",
+			want:  "select diagnosis, (select secure_mask('last4', ssn) as ssn from patients where id = patient_id) from visits",
+		},
+		{
+			name:    "where",
+			query:   "SELECT id FROM patients WHERE ssn LIKE '123%'",
+			wantErr: ErrMaskedCondition,
+		},
+		{
+			name:    "order by",
+			query:   "SELECT id FROM patients ORDER BY ssn",
+			wantErr: ErrMaskedCondition,
+		},
+		{
+			name:    "join condition",
+			query:   "SELECT v.diagnosis FROM visits AS v JOIN patients AS p ON p.ssn = v.patient_id",
+			wantErr: ErrMaskedCondition,
+		},
+		{
+			name:    "subquery condition",
+			query:   "SELECT diagnosis FROM visits WHERE patient_id IN (SELECT id FROM patients WHERE ssn = '1')",
+			wantErr: ErrMaskedCondition,
+		},
+		{
+			name:    "update value",
+			query:   "UPDATE patients SET name = ssn WHERE id = 1",
+			wantErr: ErrMaskedCondition,
+		},
+		{
+			name:    "delete condition",
+			query:   "DELETE FROM patients WHERE ssn = '1'",
+			wantErr: ErrMaskedCondition,
+		},
+		{
+			name:  "insert select",
+			query: "INSERT INTO visits (patient_id, diagnosis) SELECT id, ssn FROM patients",
+			want:  "insert into visits(patient_id, diagnosis) select id, secure_mask('last4', ssn) as ssn from patients",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stmt, err := sqlparser.Parse(tt.query)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+
+			changed, err := ApplyMasks(stmt, mask, columns)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("ApplyMasks() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ApplyMasks() error = %v", err)
+			}
+			if changed != (tt.want != "") {
+				t.Fatalf("ApplyMasks() changed = %v, want %v", changed, tt.want != "")
+			}
+			if changed && normalizeSQL(sqlparser.String(stmt)) != normalizeSQL(tt.want) {
+				t.Errorf("ApplyMasks() = %v\nwant %v", sqlparser.String(stmt), tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyEncryption(t *testing.T) {
+	schema := map[string][]string{
+		"patients": {"id", "name", "ssn", "email"},
+	}
+	columns := func(table string) ([]string, error) {
+		return schema[table], nil
+	}
+	encrypted := func(table, column string) (EncryptedColumn, bool) {
+		switch column {
+		case "ssn":
+			return EncryptedColumn{Decrypt: true}, true
+		case "email":
+			return EncryptedColumn{Deterministic: true}, true
+		}
+		return EncryptedColumn{}, false
+	}
+
+	tests := []struct {
+		name    string
+		query   string
+		want    string
+		wantErr error
+	}{
+		{
+			name:  "decrypt readable column",
+			query: "SELECT id, ssn, email FROM patients",
+			want:  "select id, secure_decrypt('patients', 'ssn', ssn) as ssn, email from patients",
+		},
+		{
+			name:  "star",
+			query: "SELECT * FROM patients",
+			want:  "select patients.id, patients.name, secure_decrypt('patients', 'ssn', patients.ssn) as ssn, patients.email from patients",
+		},
+		{
+			name:  "insert",
+			query: "INSERT INTO patients (id, ssn, email) VALUES (1, ?, 'a@example.com')",
+			want:  "insert into patients(id, ssn, email) values (1, secure_encrypt('patients', 'ssn', :v1), secure_encrypt('patients', 'email', 'a@example.com'))",
+		},
+		{
+			name:  "update",
+			query: "UPDATE patients SET ssn = ? WHERE id = 1",
+			want:  "update patients set ssn = secure_encrypt('patients', 'ssn', :v1) where id = 1",
+		},
+		{
+			name:  "deterministic equality",
+			query: "SELECT id FROM patients WHERE email = ? OR email IN ('a', 'b')",
+			want:  "select id from patients where email = secure_encrypt('patients', 'email', :v1) or email in (secure_encrypt('patients', 'email', 'a'), secure_encrypt('patients', 'email', 'b'))",
+		},
+		{
+			name:  "is null",
+			query: "SELECT id FROM patients WHERE ssn IS NULL",
+		},
+		{
+			name:    "randomized equality",
+			query:   "SELECT id FROM patients WHERE ssn = '123'",
+			wantErr: ErrEncryptedCondition,
+		},
+		{
+			name:    "deterministic range",
+			query:   "SELECT id FROM patients WHERE email > 'a'",
+			wantErr: ErrEncryptedCondition,
+		},
+		{
+			name:    "deterministic comparison with column",
+			query:   "SELECT id FROM patients WHERE email = name",
+			wantErr: ErrEncryptedCondition,
+		},
+		{
+			name:    "order by",
+			query:   "SELECT id FROM patients ORDER BY email",
+			wantErr: ErrEncryptedCondition,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stmt, err := sqlparser.Parse(tt.query)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+
+			changed, err := ApplyEncryption(stmt, encrypted, columns)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("ApplyEncryption() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ApplyEncryption() error = %v", err)
+			}
+			if changed != (tt.want != "") {
+				t.Fatalf("ApplyEncryption() changed = %v, want %v", changed, tt.want != "")
+			}
+			if changed && normalizeSQL(sqlparser.String(stmt)) != normalizeSQL(tt.want) {
+				t.Errorf("ApplyEncryption() = %v\nwant %v", sqlparser.String(stmt), tt.want)
+			}
+		})
+	}
+
+}
+
+func TestParseInternalFunctions(t *testing.T) {
+	parser := NewParser(auth.NewMemoryProvider())
+	for _, query := range []string{
+		"SELECT secure_decrypt('patients', 'ssn', ssn) FROM patients",
+		"SELECT SECURE_ENCRYPT('patients', 'ssn', '123') FROM dual",
+		"SELECT `secure_mask`('redact', name) FROM patients",
+		"CREATE VIEW leak AS SELECT secure_decrypt('patients', 'ssn', ssn) FROM patients",
+		`CREATE VIEW leak AS SELECT "secure_decrypt" ('patients', 'ssn', ssn) FROM patients`,
+	} {
+		if _, err := parser.Parse(query); !errors.Is(err, ErrInternalFunction) {
+			t.Errorf("Parse(%q) error = %v, want %v", query, err, ErrInternalFunction)
+		}
+	}
+
+	// The names may appear as values
+	if _, err := parser.Parse("SELECT id FROM patients WHERE note = 'secure_decrypt'"); err != nil {
+		t.Errorf("Parse() error = %v", err)
+	}
+}
@@ -0,0 +1,224 @@
+package sqlparser
+
+import (
+	"strings"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+	"github.com/xwb1989/sqlparser"
+)
+
+// TableColumns lists columns of one occurrence of a table in a statement
+type TableColumns struct {
+	Table string
+	// Qualifier is the alias of the occurrence, or the table name if it has
+	// none; empty for tables read in subqueries
+	Qualifier string
+	Columns   []string
+}
+
+// ReturnedColumns returns the columns of each table that a SELECT statement
+// returns values of, directly or within expressions. Columns lists the columns
+// of a table and is used to expand * and to resolve unqualified columns of
+// statements with several tables. Tables read in subqueries of the select list
+// or the FROM clause are included without a qualifier, since their values can
+// be returned through the outer statement.
+func ReturnedColumns(stmt sqlparser.Statement, columns func(table string) ([]string, error)) ([]TableColumns, error) {
+	switch s := stmt.(type) {
+	case *sqlparser.Select:
+		return selectReturnedColumns(s, columns)
+	case *sqlparser.Union:
+		left, err := ReturnedColumns(s.Left, columns)
+		if err != nil {
+			return nil, err
+		}
+		right, err := ReturnedColumns(s.Right, columns)
+		if err != nil {
+			return nil, err
+		}
+		return nested(append(left, right...)), nil
+	case *sqlparser.ParenSelect:
+		return ReturnedColumns(s.Select, columns)
+	}
+	return nil, nil
+}
+
+// selectReturnedColumns returns the columns a SELECT statement returns values of
+func selectReturnedColumns(sel *sqlparser.Select, columns func(table string) ([]string, error)) ([]TableColumns, error) {
+	instances := collectTableInstances(sel.From, &sel.Where, nil)
+	result := make([]TableColumns, len(instances))
+	known := make([][]string, len(instances))
+	for i, instance := range instances {
+		result[i] = TableColumns{Table: instance.table, Qualifier: instance.qualifier}
+	}
+	tableColumns := func(i int) ([]string, error) {
+		if known[i] == nil {
+			cols, err := columns(instances[i].table)
+			if err != nil {
+				return nil, err
+			}
+			known[i] = append([]string{}, cols...)
+		}
+		return known[i], nil
+	}
+	add := func(i int, column string) {
+		if !permissions.ContainsName(result[i].Columns, column) {
+			result[i].Columns = append(result[i].Columns, column)
+		}
+	}
+
+	// Values of derived tables can be returned through the outer statement
+	var subqueries []TableColumns
+	for _, tableExpr := range sel.From {
+		err := sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+			if subquery, ok := node.(*sqlparser.Subquery); ok {
+				read, err := ReturnedColumns(subquery.Select, columns)
+				subqueries = append(subqueries, nested(read)...)
+				return false, err
+			}
+			return true, nil
+		}, tableExpr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, selectExpr := range sel.SelectExprs {
+		switch expr := selectExpr.(type) {
+		case *sqlparser.StarExpr:
+			for i, instance := range instances {
+				if !expr.TableName.IsEmpty() && !strings.EqualFold(expr.TableName.Name.String(), instance.qualifier) {
+					continue
+				}
+				cols, err := tableColumns(i)
+				if err != nil {
+					return nil, err
+				}
+				for _, column := range cols {
+					add(i, column)
+				}
+			}
+		case *sqlparser.AliasedExpr:
+			err := sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+				switch n := node.(type) {
+				case *sqlparser.Subquery:
+					read, err := ReturnedColumns(n.Select, columns)
+					subqueries = append(subqueries, nested(read)...)
+					return false, err
+				case *sqlparser.ColName:
+					column := n.Name.String()
+					for i, instance := range instances {
+						switch {
+						case !n.Qualifier.IsEmpty():
+							if !strings.EqualFold(n.Qualifier.Name.String(), instance.qualifier) {
+								continue
+							}
+						case len(instances) > 1:
+							cols, err := tableColumns(i)
+							if err != nil {
+								return false, err
+							}
+							if !permissions.ContainsName(cols, column) {
+								continue
+							}
+						}
+						add(i, column)
+					}
+				}
+				return true, nil
+			}, expr.Expr)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var returned []TableColumns
+	for _, read := range result {
+		if len(read.Columns) > 0 {
+			returned = append(returned, read)
+		}
+	}
+	return append(returned, subqueries...), nil
+}
+
+// ReferencedColumns returns the columns of each table, by lower-case table
+// name, that a statement references in any clause: the select list, WHERE,
+// GROUP BY, HAVING, ORDER BY and join conditions, subqueries, and the columns
+// INSERT and UPDATE statements write. * is expanded, and an INSERT without a
+// column list writes every column. Columns lists the columns of a table.
+func ReferencedColumns(stmt sqlparser.Statement, columns func(table string) ([]string, error)) (map[string][]string, error) {
+	referenced := make(map[string][]string)
+	add := func(table, column string) {
+		key := strings.ToLower(table)
+		if !permissions.ContainsName(referenced[key], column) {
+			referenced[key] = append(referenced[key], column)
+		}
+	}
+	r := newColumnRewriter(columns)
+	r.project = func(table, column string, col *sqlparser.ColName) (sqlparser.Expr, error) {
+		add(table, column)
+		return nil, nil
+	}
+	r.filter = func(table, column string, col *sqlparser.ColName, operand sqlparser.Expr) (bool, error) {
+		add(table, column)
+		return false, nil
+	}
+	r.write = func(table, column string, value *sqlparser.Expr) (bool, error) {
+		add(table, column)
+		return false, nil
+	}
+	if _, err := r.rewrite(stmt); err != nil {
+		return nil, err
+	}
+	return referenced, nil
+}
+
+// nested drops the qualifiers of tables read in a subquery or union, whose
+// rows cannot be identified from the rows of the statement
+func nested(read []TableColumns) []TableColumns {
+	for i := range read {
+		read[i].Qualifier = ""
+	}
+	return read
+}
+
+// AppendKeyColumns appends columns of the tables of a SELECT statement to its
+// select list, so that each returned row carries the keys of the rows it was
+// read from, and returns the statement. It reports false, leaving the
+// statement unchanged, if extra columns would change the rows the statement
+// returns, as with DISTINCT, GROUP BY, aggregates and unions.
+func AppendKeyColumns(stmt sqlparser.Statement, keys []TableColumns) (string, bool) {
+	sel, ok := stmt.(*sqlparser.Select)
+	if !ok || sel.Distinct != "" || len(sel.GroupBy) > 0 || sel.Having != nil || hasAggregate(sel.SelectExprs) {
+		return "", false
+	}
+	for _, key := range keys {
+		for _, column := range key.Columns {
+			sel.SelectExprs = append(sel.SelectExprs, &sqlparser.AliasedExpr{
+				Expr: &sqlparser.ColName{
+					Name:      sqlparser.NewColIdent(column),
+					Qualifier: sqlparser.TableName{Name: sqlparser.NewTableIdent(key.Qualifier)},
+				},
+			})
+		}
+	}
+	return sqlparser.String(sel), true
+}
+
+// hasAggregate checks if a select list calls an aggregate function outside of
+// subqueries
+func hasAggregate(exprs sqlparser.SelectExprs) bool {
+	found := false
+	_ = sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		switch n := node.(type) {
+		case *sqlparser.Subquery:
+			return false, nil
+		case *sqlparser.GroupConcatExpr:
+			found = true
+		case *sqlparser.FuncExpr:
+			found = found || n.IsAggregate()
+		}
+		return !found, nil
+	}, exprs)
+	return found
+}
@@ -0,0 +1,239 @@
+package sqlparser
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xwb1989/sqlparser"
+)
+
+// tableInstance is one occurrence of a table in a statement. The same table
+// can appear several times, e.g. in a self-join or a subquery, and each
+// occurrence gets its own copy of the row-level condition.
+type tableInstance struct {
+	// table is the name of the table
+	table string
+	// qualifier is the alias of the occurrence, or the table name if it has none
+	qualifier string
+	// where is the WHERE clause of the statement that owns the occurrence
+	where **sqlparser.Where
+	// join is set when the occurrence is on the nullable side of an outer join,
+	// in which case the condition belongs to the join's ON clause
+	join *sqlparser.JoinTableExpr
+}
+
+// collectTableInstances returns the table occurrences of a FROM clause.
+// Derived tables are not included since their own SELECT is visited separately.
+func collectTableInstances(tableExprs sqlparser.TableExprs, where **sqlparser.Where, join *sqlparser.JoinTableExpr) []tableInstance {
+	var instances []tableInstance
+	for _, tableExpr := range tableExprs {
+		switch expr := tableExpr.(type) {
+		case *sqlparser.AliasedTableExpr:
+			tableName, ok := expr.Expr.(sqlparser.TableName)
+			if !ok {
+				continue
+			}
+			qualifier := tableName.Name.String()
+			if !expr.As.IsEmpty() {
+				qualifier = expr.As.String()
+			}
+			instances = append(instances, tableInstance{
+				table:     tableName.Name.String(),
+				qualifier: qualifier,
+				where:     where,
+				join:      join,
+			})
+		case *sqlparser.ParenTableExpr:
+			instances = append(instances, collectTableInstances(expr.Exprs, where, join)...)
+		case *sqlparser.JoinTableExpr:
+			// Rows of the nullable side of an outer join are filtered in the ON
+			// clause so the join still produces the rows of the other side
+			leftJoin, rightJoin := join, join
+			switch expr.Join {
+			case sqlparser.LeftJoinStr:
+				rightJoin = expr
+			case sqlparser.RightJoinStr:
+				leftJoin = expr
+			}
+			instances = append(instances, collectTableInstances(sqlparser.TableExprs{expr.LeftExpr}, where, leftJoin)...)
+			instances = append(instances, collectTableInstances(sqlparser.TableExprs{expr.RightExpr}, where, rightJoin)...)
+		}
+	}
+	return instances
+}
+
+// qualifyColumns qualifies every column reference of a row-level condition with
+// the qualifier of a table occurrence. Unqualified columns and columns qualified
+// with the table name are rewritten; columns inside subqueries belong to the
+// subquery and are left alone.
+func qualifyColumns(expr sqlparser.Expr, table, qualifier string) error {
+	return sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		switch n := node.(type) {
+		case *sqlparser.Subquery:
+			return false, nil
+		case *sqlparser.ColName:
+			if n.Qualifier.IsEmpty() || (n.Qualifier.Qualifier.IsEmpty() && strings.EqualFold(n.Qualifier.Name.String(), table)) {
+				n.Qualifier = sqlparser.TableName{Name: sqlparser.NewTableIdent(qualifier)}
+			}
+		}
+		return true, nil
+	}, expr)
+}
+
+// cloneExpr returns a deep copy of an expression so that it can be changed
+// independently of the original
+func cloneExpr(expr sqlparser.Expr) (sqlparser.Expr, error) {
+	if expr == nil {
+		return nil, nil
+	}
+	var err error
+	switch e := expr.(type) {
+	case *sqlparser.AndExpr:
+		clone := &sqlparser.AndExpr{}
+		if clone.Left, err = cloneExpr(e.Left); err != nil {
+			return nil, err
+		}
+		if clone.Right, err = cloneExpr(e.Right); err != nil {
+			return nil, err
+		}
+		return clone, nil
+	case *sqlparser.OrExpr:
+		clone := &sqlparser.OrExpr{}
+		if clone.Left, err = cloneExpr(e.Left); err != nil {
+			return nil, err
+		}
+		if clone.Right, err = cloneExpr(e.Right); err != nil {
+			return nil, err
+		}
+		return clone, nil
+	case *sqlparser.NotExpr:
+		clone := &sqlparser.NotExpr{}
+		if clone.Expr, err = cloneExpr(e.Expr); err != nil {
+			return nil, err
+		}
+		return clone, nil
+	case *sqlparser.ParenExpr:
+		clone := &sqlparser.ParenExpr{}
+		if clone.Expr, err = cloneExpr(e.Expr); err != nil {
+			return nil, err
+		}
+		return clone, nil
+	case *sqlparser.ComparisonExpr:
+		clone := &sqlparser.ComparisonExpr{Operator: e.Operator}
+		if clone.Left, err = cloneExpr(e.Left); err != nil {
+			return nil, err
+		}
+		if clone.Right, err = cloneExpr(e.Right); err != nil {
+			return nil, err
+		}
+		if clone.Escape, err = cloneExpr(e.Escape); err != nil {
+			return nil, err
+		}
+		return clone, nil
+	case *sqlparser.RangeCond:
+		clone := &sqlparser.RangeCond{Operator: e.Operator}
+		if clone.Left, err = cloneExpr(e.Left); err != nil {
+			return nil, err
+		}
+		if clone.From, err = cloneExpr(e.From); err != nil {
+			return nil, err
+		}
+		if clone.To, err = cloneExpr(e.To); err != nil {
+			return nil, err
+		}
+		return clone, nil
+	case *sqlparser.IsExpr:
+		clone := &sqlparser.IsExpr{Operator: e.Operator}
+		if clone.Expr, err = cloneExpr(e.Expr); err != nil {
+			return nil, err
+		}
+		return clone, nil
+	case *sqlparser.BinaryExpr:
+		clone := &sqlparser.BinaryExpr{Operator: e.Operator}
+		if clone.Left, err = cloneExpr(e.Left); err != nil {
+			return nil, err
+		}
+		if clone.Right, err = cloneExpr(e.Right); err != nil {
+			return nil, err
+		}
+		return clone, nil
+	case *sqlparser.UnaryExpr:
+		clone := &sqlparser.UnaryExpr{Operator: e.Operator}
+		if clone.Expr, err = cloneExpr(e.Expr); err != nil {
+			return nil, err
+		}
+		return clone, nil
+	case sqlparser.ValTuple:
+		clone := make(sqlparser.ValTuple, len(e))
+		for i := range e {
+			if clone[i], err = cloneExpr(e[i]); err != nil {
+				return nil, err
+			}
+		}
+		return clone, nil
+	case *sqlparser.ColName:
+		return &sqlparser.ColName{Name: e.Name, Qualifier: e.Qualifier}, nil
+	case *sqlparser.SQLVal:
+		return &sqlparser.SQLVal{Type: e.Type, Val: append([]byte(nil), e.Val...)}, nil
+	case *sqlparser.NullVal:
+		return &sqlparser.NullVal{}, nil
+	case sqlparser.BoolVal:
+		return e, nil
+	case *sqlparser.FuncExpr:
+		clone := &sqlparser.FuncExpr{Qualifier: e.Qualifier, Name: e.Name, Distinct: e.Distinct}
+		for _, selectExpr := range e.Exprs {
+			aliased, ok := selectExpr.(*sqlparser.AliasedExpr)
+			if !ok {
+				clone.Exprs = append(clone.Exprs, selectExpr)
+				continue
+			}
+			arg, err := cloneExpr(aliased.Expr)
+			if err != nil {
+				return nil, err
+			}
+			clone.Exprs = append(clone.Exprs, &sqlparser.AliasedExpr{Expr: arg, As: aliased.As})
+		}
+		return clone, nil
+	case *sqlparser.CaseExpr:
+		clone := &sqlparser.CaseExpr{}
+		if clone.Expr, err = cloneExpr(e.Expr); err != nil {
+			return nil, err
+		}
+		for _, when := range e.Whens {
+			cloneWhen := &sqlparser.When{}
+			if cloneWhen.Cond, err = cloneExpr(when.Cond); err != nil {
+				return nil, err
+			}
+			if cloneWhen.Val, err = cloneExpr(when.Val); err != nil {
+				return nil, err
+			}
+			clone.Whens = append(clone.Whens, cloneWhen)
+		}
+		if clone.Else, err = cloneExpr(e.Else); err != nil {
+			return nil, err
+		}
+		return clone, nil
+	default:
+		// Less common expressions such as subqueries are copied by formatting
+		// and parsing them again
+		return parseConditionExpr(sqlparser.String(expr))
+	}
+}
+
+// parseRowCondition parses the row-level conditions cached by a
+// SecurityTransformer; tests replace it to count parses
+var parseRowCondition = parseConditionExpr
+
+// parseConditionExpr parses a row-level condition into an expression
+func parseConditionExpr(condition string) (sqlparser.Expr, error) {
+	// Parse the condition into an expression by wrapping it in a SELECT
+	conditionStmt, err := sqlparser.Parse(fmt.Sprintf("SELECT * FROM dual WHERE %s", condition))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse security condition %q: %v", condition, err)
+	}
+	selectStmt, ok := conditionStmt.(*sqlparser.Select)
+	if !ok || selectStmt.Where == nil || len(selectStmt.OrderBy) > 0 || selectStmt.Limit != nil || selectStmt.GroupBy != nil {
+		return nil, fmt.Errorf("invalid security condition: %q", condition)
+	}
+	return selectStmt.Where.Expr, nil
+}
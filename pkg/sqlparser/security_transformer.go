@@ -3,299 +3,241 @@ package sqlparser
 import (
 	"fmt"
 	"strings"
+	"sync"
 
 	"github.com/wemcdonald/secure_sqlite/pkg/auth"
 	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+	"github.com/wemcdonald/secure_sqlite/pkg/rbac"
 	"github.com/xwb1989/sqlparser"
 )
 
-// SecurityTransformer handles SQL query transformation for security
+// SecurityTransformer handles SQL query transformation for security. It holds
+// no state of the statements it transforms, only parsed conditions, so it may
+// be shared.
 type SecurityTransformer struct {
 	AuthProvider auth.Provider
-	currentStmt  sqlparser.Statement
+
+	// conditions caches parsed row-level conditions by their text
+	conditions   map[string]sqlparser.Expr
+	conditionsMu sync.Mutex
 }
 
 // NewSecurityTransformer creates a new security transformer
 func NewSecurityTransformer(authProvider auth.Provider) *SecurityTransformer {
 	return &SecurityTransformer{
 		AuthProvider: authProvider,
+		conditions:   make(map[string]sqlparser.Expr),
 	}
 }
 
 // TransformQuery transforms a SQL query based on user permissions
 func (t *SecurityTransformer) TransformQuery(stmt sqlparser.Statement, userID int64) (string, error) {
+	if userID <= 0 {
+		return "", fmt.Errorf("invalid user ID: %d", userID)
+	}
+	query, _, err := t.TransformQueryWithSession(stmt, &Session{
+		Username: fmt.Sprintf("user_%d", userID),
+		UserID:   userID,
+	})
+	return query, err
+}
+
+// TransformQueryWithSession transforms a SQL query based on the permissions of
+// the session user. Session variable functions used in row-level conditions are
+// replaced with named parameters whose values are returned as args.
+func (t *SecurityTransformer) TransformQueryWithSession(stmt sqlparser.Statement, session *Session) (string, []interface{}, error) {
 	if stmt == nil {
-		return "", fmt.Errorf("statement cannot be nil")
+		return "", nil, fmt.Errorf("statement cannot be nil")
+	}
+	if session == nil || session.Username == "" {
+		return "", nil, fmt.Errorf("session user cannot be empty")
 	}
-	t.currentStmt = stmt
-	switch stmt.(type) {
-	case *sqlparser.Select:
-		// Get user permissions from auth provider
-		userPerms, err := t.AuthProvider.GetUserPermissions(fmt.Sprintf("user_%d", userID))
-		if err != nil {
-			return "", fmt.Errorf("failed to get user permissions: %w", err)
-		}
 
-		// Check if user has any row-level permissions
-		hasRowPermission := false
-		for _, perm := range userPerms {
-			if perm.Type == permissions.RowPermission {
-				hasRowPermission = true
-				break
-			}
-		}
+	// Get the permissions of the user and their roles
+	userPerms, err := rbac.NewRBACManager(t.AuthProvider).GetEffectivePermissions(session.Username)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get user permissions: %w", err)
+	}
+	userPerms = append(userPerms, session.Permissions...)
 
-		// If no row-level permissions, return original query
-		if !hasRowPermission {
-			return sqlparser.String(stmt), nil
+	// Check if user has any row-level permissions
+	hasRowPermission := false
+	for _, perm := range userPerms {
+		if perm.Type == permissions.RowPermission {
+			hasRowPermission = true
+			break
 		}
+	}
 
-		// Apply row-level security transformations
-		if err := t.addSelectSecurity(stmt, userID); err != nil {
-			return "", err
-		}
-		return sqlparser.String(stmt), nil
-	case *sqlparser.Update:
-		if err := t.addUpdateSecurity(stmt, userID); err != nil {
-			return "", err
-		}
-		return sqlparser.String(stmt), nil
-	case *sqlparser.Delete:
-		if err := t.addDeleteSecurity(stmt, userID); err != nil {
-			return "", err
+	// If no row-level permissions or filters, return original query
+	if !hasRowPermission && len(session.RowFilters) == 0 {
+		return sqlparser.String(stmt), nil, nil
+	}
+
+	// Apply row-level security transformations
+	switch stmt.(type) {
+	case *sqlparser.Select, *sqlparser.Union, *sqlparser.Insert, *sqlparser.Update, *sqlparser.Delete:
+		binder := newSessionBinder(session)
+		if err := t.addRowSecurity(stmt, userPerms, session, binder); err != nil {
+			return "", nil, err
 		}
-		return sqlparser.String(stmt), nil
-	default:
-		return sqlparser.String(stmt), nil
+		return sqlparser.String(stmt), binder.args, nil
 	}
+	return sqlparser.String(stmt), nil, nil
 }
 
-// addSelectSecurity adds row-level security conditions to SELECT statements
-func (t *SecurityTransformer) addSelectSecurity(ast sqlparser.Statement, userID int64) error {
-	selectStmt, ok := ast.(*sqlparser.Select)
-	if !ok {
-		return fmt.Errorf("expected SELECT statement")
+// addRowSecurity adds the row-level security conditions to every occurrence of
+// a protected table in the statement, including joins, subqueries and the
+// target of UPDATE and DELETE statements
+func (t *SecurityTransformer) addRowSecurity(stmt sqlparser.Statement, userPerms []permissions.Permission, session *Session, binder *sessionBinder) error {
+	// Collect all occurrences before modifying the statement so that the
+	// added conditions are not visited again
+	var instances []tableInstance
+	switch s := stmt.(type) {
+	case *sqlparser.Update:
+		instances = append(instances, collectTableInstances(s.TableExprs, &s.Where, nil)...)
+	case *sqlparser.Delete:
+		instances = append(instances, collectTableInstances(s.TableExprs, &s.Where, nil)...)
+	}
+	err := sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		if selectStmt, ok := node.(*sqlparser.Select); ok {
+			instances = append(instances, collectTableInstances(selectStmt.From, &selectStmt.Where, nil)...)
+		}
+		return true, nil
+	}, stmt)
+	if err != nil {
+		return err
 	}
 
-	// Get row-level security conditions for each table
-	var conditions []string
-	for _, table := range t.getTablesFromSelect(selectStmt) {
-		condition, err := t.getRowLevelSecurityConditions(table, userID)
+	for _, instance := range instances {
+		conditionExpr, err := t.rowLevelSecurityCondition(instance, userPerms, session, binder)
 		if err != nil {
 			return err
 		}
-		if condition != "" {
-			conditions = append(conditions, condition)
+		if conditionExpr == nil {
+			continue
 		}
-	}
 
-	if len(conditions) > 0 {
-		// Parse the conditions into an expression by wrapping it in a SELECT
-		conditionStmt, err := sqlparser.Parse(fmt.Sprintf("SELECT * FROM dual WHERE %s", strings.Join(conditions, " AND ")))
-		if err != nil {
-			return fmt.Errorf("failed to parse security conditions: %v", err)
+		if instance.join != nil && len(instance.join.Condition.Using) == 0 {
+			// Add the condition to the ON clause of the outer join
+			instance.join.Condition.On = andConditions(instance.join.Condition.On, conditionExpr)
+			continue
 		}
-		conditionExpr := conditionStmt.(*sqlparser.Select).Where.Expr
 
-		// Add the conditions to the WHERE clause
-		if selectStmt.Where == nil {
-			selectStmt.Where = &sqlparser.Where{
-				Type: "where",
-				Expr: conditionExpr,
-			}
-		} else {
-			// Combine with existing WHERE clause
-			selectStmt.Where.Expr = &sqlparser.AndExpr{
-				Left:  selectStmt.Where.Expr,
-				Right: conditionExpr,
-			}
-		}
+		// Add the condition to the WHERE clause
+		*instance.where = addWhereCondition(*instance.where, conditionExpr)
 	}
 
 	return nil
 }
 
-// addUpdateSecurity adds row-level security conditions to UPDATE statements
-func (t *SecurityTransformer) addUpdateSecurity(ast sqlparser.Statement, userID int64) error {
-	updateStmt, ok := ast.(*sqlparser.Update)
-	if !ok {
-		return fmt.Errorf("expected UPDATE statement")
+// rowLevelSecurityCondition returns the row-level security condition for one
+// occurrence of a table, qualified with the occurrence's alias and with session
+// variables bound. Several granted conditions for the same table are combined
+// with OR, and the session's row filters for the table are added with AND.
+// Returns nil if the table is not protected.
+func (t *SecurityTransformer) rowLevelSecurityCondition(instance tableInstance, userPerms []permissions.Permission, session *Session, binder *sessionBinder) (sqlparser.Expr, error) {
+	if instance.table == "" {
+		return nil, fmt.Errorf("table name cannot be empty")
 	}
 
-	// Get row-level security conditions for the target table
-	aliasedTableExpr, ok := updateStmt.TableExprs[0].(*sqlparser.AliasedTableExpr)
-	if !ok {
-		return fmt.Errorf("expected AliasedTableExpr")
-	}
-	tableName, ok := aliasedTableExpr.Expr.(sqlparser.TableName)
-	if !ok {
-		return fmt.Errorf("expected TableName")
-	}
-	table := tableName.Name.String()
+	var result sqlparser.Expr
+	for _, perm := range userPerms {
+		if perm.Type != permissions.RowPermission || !strings.EqualFold(perm.Table, instance.table) {
+			continue
+		}
+		// Revoked permissions do not contribute a condition
+		if perm.Condition == "" || strings.HasPrefix(perm.Condition, permissions.RevokedPermissionPrefix) {
+			continue
+		}
 
-	conditions, err := t.getRowLevelSecurityConditions(table, userID)
-	if err != nil {
-		return err
-	}
-	if conditions != "" {
-		// Parse the conditions into an expression by wrapping it in a SELECT
-		conditionStmt, err := sqlparser.Parse(fmt.Sprintf("SELECT * FROM dual WHERE %s", conditions))
+		conditionExpr, err := t.instanceCondition(perm.Condition, instance, binder)
 		if err != nil {
-			return fmt.Errorf("failed to parse security conditions: %v", err)
+			return nil, err
 		}
-		conditionExpr := conditionStmt.(*sqlparser.Select).Where.Expr
-
-		// Add the conditions to the WHERE clause
-		if updateStmt.Where == nil {
-			updateStmt.Where = &sqlparser.Where{
-				Type: "where",
-				Expr: conditionExpr,
-			}
+		if result == nil {
+			result = conditionExpr
 		} else {
-			// Combine with existing WHERE clause
-			updateStmt.Where.Expr = &sqlparser.AndExpr{
-				Left:  updateStmt.Where.Expr,
-				Right: conditionExpr,
-			}
+			result = &sqlparser.OrExpr{Left: result, Right: conditionExpr}
 		}
 	}
 
-	return nil
+	for _, filter := range session.RowFilters[strings.ToLower(instance.table)] {
+		filterExpr, err := t.instanceCondition(filter, instance, binder)
+		if err != nil {
+			return nil, err
+		}
+		result = andConditions(result, filterExpr)
+	}
+	return result, nil
 }
 
-// addDeleteSecurity adds row-level security conditions to DELETE statements
-func (t *SecurityTransformer) addDeleteSecurity(ast sqlparser.Statement, userID int64) error {
-	deleteStmt, ok := ast.(*sqlparser.Delete)
-	if !ok {
-		return fmt.Errorf("expected DELETE statement")
+// instanceCondition returns a copy of a condition for one occurrence of a table
+func (t *SecurityTransformer) instanceCondition(condition string, instance tableInstance, binder *sessionBinder) (sqlparser.Expr, error) {
+	template, err := t.parseCondition(condition)
+	if err != nil {
+		return nil, err
 	}
-
-	// Get row-level security conditions for the target table
-	aliasedTableExpr, ok := deleteStmt.TableExprs[0].(*sqlparser.AliasedTableExpr)
-	if !ok {
-		return fmt.Errorf("expected AliasedTableExpr")
+	conditionExpr, err := cloneExpr(template)
+	if err != nil {
+		return nil, err
 	}
-	tableName, ok := aliasedTableExpr.Expr.(sqlparser.TableName)
-	if !ok {
-		return fmt.Errorf("expected TableName")
+	if err := qualifyColumns(conditionExpr, instance.table, instance.qualifier); err != nil {
+		return nil, err
 	}
-	table := tableName.Name.String()
-
-	conditions, err := t.getRowLevelSecurityConditions(table, userID)
+	conditionExpr, err = binder.bind(conditionExpr)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to bind session variables: %v", err)
 	}
-	if conditions != "" {
-		// Parse the conditions into an expression by wrapping it in a SELECT
-		conditionStmt, err := sqlparser.Parse(fmt.Sprintf("SELECT * FROM dual WHERE %s", conditions))
-		if err != nil {
-			return fmt.Errorf("failed to parse security conditions: %v", err)
-		}
-		conditionExpr := conditionStmt.(*sqlparser.Select).Where.Expr
-
-		// Add the conditions to the WHERE clause
-		if deleteStmt.Where == nil {
-			deleteStmt.Where = &sqlparser.Where{
-				Type: "where",
-				Expr: conditionExpr,
-			}
-		} else {
-			// Combine with existing WHERE clause
-			deleteStmt.Where.Expr = &sqlparser.AndExpr{
-				Left:  deleteStmt.Where.Expr,
-				Right: conditionExpr,
-			}
-		}
-	}
-
-	return nil
+	return conditionExpr, nil
 }
 
-// getTablesFromSelect extracts table names from a SELECT statement
-func (t *SecurityTransformer) getTablesFromSelect(selectStmt *sqlparser.Select) []string {
-	tables := make([]string, 0)
-	for _, tableExpr := range selectStmt.From {
-		switch expr := tableExpr.(type) {
-		case *sqlparser.AliasedTableExpr:
-			if tableName, ok := expr.Expr.(sqlparser.TableName); ok {
-				tables = append(tables, tableName.Name.String())
-			}
-		case *sqlparser.JoinTableExpr:
-			if left, ok := expr.LeftExpr.(*sqlparser.AliasedTableExpr); ok {
-				if tableName, ok := left.Expr.(sqlparser.TableName); ok {
-					tables = append(tables, tableName.Name.String())
-				}
-			}
-			if right, ok := expr.RightExpr.(*sqlparser.AliasedTableExpr); ok {
-				if tableName, ok := right.Expr.(sqlparser.TableName); ok {
-					tables = append(tables, tableName.Name.String())
-				}
-			}
-		}
-	}
-	return tables
-}
+// parseCondition returns the parsed form of a row-level condition. Each
+// condition is parsed once and the result is used as a template.
+func (t *SecurityTransformer) parseCondition(condition string) (sqlparser.Expr, error) {
+	t.conditionsMu.Lock()
+	defer t.conditionsMu.Unlock()
 
-// getRowLevelSecurityConditions gets the row-level security conditions for a table and user
-func (t *SecurityTransformer) getRowLevelSecurityConditions(table string, userID int64) (string, error) {
-	if table == "" {
-		return "", fmt.Errorf("table name cannot be empty")
+	if conditionExpr, ok := t.conditions[condition]; ok {
+		return conditionExpr, nil
 	}
-	if userID <= 0 {
-		return "", fmt.Errorf("invalid user ID: %d", userID)
-	}
-
-	// Get user permissions from auth provider
-	userPerms, err := t.AuthProvider.GetUserPermissions(fmt.Sprintf("user_%d", userID))
+	conditionExpr, err := parseRowCondition(condition)
 	if err != nil {
-		return "", fmt.Errorf("failed to get user permissions: %w", err)
+		return nil, err
 	}
+	t.conditions[condition] = conditionExpr
+	return conditionExpr, nil
+}
 
-	// Find row-level security permission for the table
-	for _, perm := range userPerms {
-		if perm.Type == permissions.RowPermission && perm.Table == table {
-			// Get the table alias from the condition
-			alias := t.getTableAlias(table)
-			if alias != "" {
-				// Replace table name with alias in the condition
-				return strings.ReplaceAll(perm.Condition, "user_id", alias+".user_id"), nil
-			}
-			return perm.Condition, nil
+// addWhereCondition combines a condition with an existing WHERE clause
+func addWhereCondition(where *sqlparser.Where, condition sqlparser.Expr) *sqlparser.Where {
+	if where == nil {
+		return &sqlparser.Where{
+			Type: sqlparser.WhereStr,
+			Expr: parenthesizeOr(condition),
 		}
 	}
+	where.Expr = andConditions(where.Expr, condition)
+	return where
+}
 
-	return "", nil // No row-level security for this table
+// andConditions combines two conditions with AND. The formatter does not
+// parenthesize by precedence, so OR expressions on either side are wrapped to
+// keep the condition from being bypassed.
+func andConditions(left, right sqlparser.Expr) sqlparser.Expr {
+	if left == nil {
+		return parenthesizeOr(right)
+	}
+	return &sqlparser.AndExpr{
+		Left:  parenthesizeOr(left),
+		Right: parenthesizeOr(right),
+	}
 }
 
-// getTableAlias returns the alias for a table in the current statement
-func (t *SecurityTransformer) getTableAlias(table string) string {
-	switch stmt := t.currentStmt.(type) {
-	case *sqlparser.Select:
-		for _, tableExpr := range stmt.From {
-			switch expr := tableExpr.(type) {
-			case *sqlparser.AliasedTableExpr:
-				if tableName, ok := expr.Expr.(sqlparser.TableName); ok && tableName.Name.String() == table {
-					if !expr.As.IsEmpty() {
-						return expr.As.String()
-					}
-				}
-			case *sqlparser.JoinTableExpr:
-				if left, ok := expr.LeftExpr.(*sqlparser.AliasedTableExpr); ok {
-					if tableName, ok := left.Expr.(sqlparser.TableName); ok && tableName.Name.String() == table {
-						if !left.As.IsEmpty() {
-							return left.As.String()
-						}
-					}
-				}
-				if right, ok := expr.RightExpr.(*sqlparser.AliasedTableExpr); ok {
-					if tableName, ok := right.Expr.(sqlparser.TableName); ok && tableName.Name.String() == table {
-						if !right.As.IsEmpty() {
-							return right.As.String()
-						}
-					}
-				}
-			}
-		}
+// parenthesizeOr wraps an OR expression in parentheses
+func parenthesizeOr(expr sqlparser.Expr) sqlparser.Expr {
+	if _, ok := expr.(*sqlparser.OrExpr); ok {
+		return &sqlparser.ParenExpr{Expr: expr}
 	}
-	return ""
+	return expr
 }
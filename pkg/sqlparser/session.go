@@ -0,0 +1,240 @@
+package sqlparser
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/permissions"
+	"github.com/xwb1989/sqlparser"
+)
+
+// Session variable functions that may appear in row-level conditions
+const (
+	// FuncCurrentUser resolves to the session username
+	FuncCurrentUser = "current_user"
+	// FuncCurrentUserID resolves to the session user ID
+	FuncCurrentUserID = "current_user_id"
+	// FuncCurrentRoles resolves to the roles held by the session user and
+	// may only be used as the sole element of an IN list
+	FuncCurrentRoles = "current_roles"
+	// FuncCurrentSetting resolves to a named session attribute,
+	// e.g. current_setting('tenant_id')
+	FuncCurrentSetting = "current_setting"
+)
+
+// sessionArgPrefix is the prefix used for named parameters bound from session values
+const sessionArgPrefix = "sess_"
+
+// checkArgPrefix is the prefix used for session values bound in check queries,
+// which may be built from a statement already using sessionArgPrefix
+const checkArgPrefix = "chk_"
+
+// Session describes the caller on whose behalf a statement is executed.
+// Row-level conditions reference it through the session variable functions
+// and the values are always passed to the database as bound parameters.
+type Session struct {
+	Username   string
+	UserID     int64
+	Roles      []string
+	Attributes map[string]interface{}
+
+	// RowFilters holds additional conditions per table that are combined with
+	// the granted row-level conditions using AND
+	RowFilters map[string][]string
+
+	// Permissions holds permissions the session holds in addition to those of
+	// the user, e.g. through a break-glass elevation
+	Permissions []permissions.Permission
+}
+
+// NewSession creates a new session for a user
+func NewSession(username string, userID int64, roles []string) *Session {
+	return &Session{
+		Username:   username,
+		UserID:     userID,
+		Roles:      roles,
+		Attributes: make(map[string]interface{}),
+	}
+}
+
+// SetAttribute sets a session attribute readable through current_setting(name)
+func (s *Session) SetAttribute(name string, value interface{}) {
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]interface{})
+	}
+	s.Attributes[strings.ToLower(name)] = value
+}
+
+// Attribute returns a session attribute and whether it is set
+func (s *Session) Attribute(name string) (interface{}, bool) {
+	value, ok := s.Attributes[strings.ToLower(name)]
+	return value, ok
+}
+
+// AddRowFilter adds a condition that rows of a table must satisfy in addition
+// to the granted row-level conditions
+func (s *Session) AddRowFilter(table, condition string) {
+	if s.RowFilters == nil {
+		s.RowFilters = make(map[string][]string)
+	}
+	table = strings.ToLower(table)
+	s.RowFilters[table] = append(s.RowFilters[table], condition)
+}
+
+// sessionBinder replaces session variable functions with bound parameters
+type sessionBinder struct {
+	session *Session
+	prefix  string
+	args    []interface{}
+}
+
+// newSessionBinder creates a new session binder
+func newSessionBinder(session *Session) *sessionBinder {
+	return &sessionBinder{
+		session: session,
+		prefix:  sessionArgPrefix,
+	}
+}
+
+// bind rewrites expr in place, replacing every session variable function with
+// a named parameter, and returns the possibly replaced root expression
+func (b *sessionBinder) bind(expr sqlparser.Expr) (sqlparser.Expr, error) {
+	// Expand current_roles() inside IN lists first since it yields several values
+	var tuples []*sqlparser.ComparisonExpr
+	var funcs []*sqlparser.FuncExpr
+	err := sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		switch n := node.(type) {
+		case *sqlparser.ComparisonExpr:
+			if tuple, ok := n.Right.(sqlparser.ValTuple); ok && len(tuple) == 1 && isSessionFunc(tuple[0], FuncCurrentRoles) {
+				tuples = append(tuples, n)
+				return false, sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+					if fn, ok := node.(*sqlparser.FuncExpr); ok && isSessionFuncName(fn) {
+						funcs = append(funcs, fn)
+					}
+					return true, nil
+				}, n.Left)
+			}
+		case *sqlparser.FuncExpr:
+			if isSessionFuncName(n) {
+				funcs = append(funcs, n)
+				return false, nil
+			}
+		}
+		return true, nil
+	}, expr)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cmp := range tuples {
+		if cmp.Operator != sqlparser.InStr && cmp.Operator != sqlparser.NotInStr {
+			return nil, fmt.Errorf("%s() may only be used with IN or NOT IN", FuncCurrentRoles)
+		}
+		cmp.Right = b.bindList(b.session.Roles)
+	}
+
+	for _, fn := range funcs {
+		value, err := b.resolve(fn)
+		if err != nil {
+			return nil, err
+		}
+		expr = sqlparser.ReplaceExpr(expr, fn, b.bindValue(value))
+	}
+
+	return expr, nil
+}
+
+// resolve returns the session value for a scalar session variable function
+func (b *sessionBinder) resolve(fn *sqlparser.FuncExpr) (interface{}, error) {
+	name := fn.Name.Lowered()
+	switch name {
+	case FuncCurrentUser:
+		if len(fn.Exprs) != 0 {
+			return nil, fmt.Errorf("%s() takes no arguments", name)
+		}
+		return b.session.Username, nil
+	case FuncCurrentUserID:
+		if len(fn.Exprs) != 0 {
+			return nil, fmt.Errorf("%s() takes no arguments", name)
+		}
+		return b.session.UserID, nil
+	case FuncCurrentSetting:
+		if len(fn.Exprs) != 1 {
+			return nil, fmt.Errorf("%s() takes exactly one argument", name)
+		}
+		aliased, ok := fn.Exprs[0].(*sqlparser.AliasedExpr)
+		if !ok {
+			return nil, fmt.Errorf("%s() requires a string literal argument", name)
+		}
+		literal, ok := aliased.Expr.(*sqlparser.SQLVal)
+		if !ok || literal.Type != sqlparser.StrVal {
+			return nil, fmt.Errorf("%s() requires a string literal argument", name)
+		}
+		value, ok := b.session.Attribute(string(literal.Val))
+		if !ok {
+			return nil, fmt.Errorf("session attribute %q is not set", string(literal.Val))
+		}
+		return value, nil
+	case FuncCurrentRoles:
+		return nil, fmt.Errorf("%s() may only be used as the only element of an IN list", name)
+	default:
+		return nil, fmt.Errorf("unknown session function: %s", name)
+	}
+}
+
+// bindValue appends a value to the bound arguments and returns its placeholder
+func (b *sessionBinder) bindValue(value interface{}) sqlparser.Expr {
+	name := fmt.Sprintf("%s%d", b.prefix, len(b.args)+1)
+	b.args = append(b.args, sql.Named(name, value))
+	return sqlparser.NewValArg([]byte(":" + name))
+}
+
+// bindList binds every value of a list and returns the resulting tuple.
+// An empty list becomes (NULL) so that IN never matches.
+func (b *sessionBinder) bindList(values []string) sqlparser.ValTuple {
+	if len(values) == 0 {
+		return sqlparser.ValTuple{&sqlparser.NullVal{}}
+	}
+	tuple := make(sqlparser.ValTuple, 0, len(values))
+	for _, value := range values {
+		tuple = append(tuple, b.bindValue(value))
+	}
+	return tuple
+}
+
+// isSessionFunc reports whether expr is a call to the given session function
+func isSessionFunc(expr sqlparser.Expr, name string) bool {
+	fn, ok := expr.(*sqlparser.FuncExpr)
+	return ok && fn.Qualifier.IsEmpty() && fn.Name.Lowered() == name
+}
+
+// isSessionFuncName reports whether fn is one of the session variable functions
+func isSessionFuncName(fn *sqlparser.FuncExpr) bool {
+	if !fn.Qualifier.IsEmpty() {
+		return false
+	}
+	switch fn.Name.Lowered() {
+	case FuncCurrentUser, FuncCurrentUserID, FuncCurrentRoles, FuncCurrentSetting:
+		return true
+	}
+	return false
+}
+
+// BindStatementArgs converts the positional arguments of a statement that has
+// been rewritten by the parser into named arguments. The parser renders ?
+// placeholders as :v1, :v2, ... so positional binding would break as soon as
+// session parameters are interleaved with them.
+func BindStatementArgs(args []interface{}) []interface{} {
+	named := make([]interface{}, 0, len(args))
+	position := 0
+	for _, arg := range args {
+		if _, ok := arg.(sql.NamedArg); ok {
+			named = append(named, arg)
+			continue
+		}
+		position++
+		named = append(named, sql.Named(fmt.Sprintf("v%d", position), arg))
+	}
+	return named
+}
@@ -17,12 +17,6 @@ type AuthProvider interface {
 	// UpdateUserPermissions updates the permissions for a user
 	UpdateUserPermissions(username string, permissions []permissions.Permission) error
 
-	// Query executes a SELECT query
-	Query(query string, args ...interface{}) (*sql.Rows, error)
-
-	// QueryRow executes a query that returns at most one row
-	QueryRow(query string, args ...interface{}) *sql.Row
-
 	// GetUserID returns the ID for a given username
 	GetUserID(username string) (int64, error)
 
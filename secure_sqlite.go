@@ -2,17 +2,108 @@
 package secure_sqlite
 
 import (
+	"context"
+
+	"github.com/wemcdonald/secure_sqlite/pkg/abac"
+	"github.com/wemcdonald/secure_sqlite/pkg/audit"
 	"github.com/wemcdonald/secure_sqlite/pkg/auth"
+	"github.com/wemcdonald/secure_sqlite/pkg/encryption"
+	"github.com/wemcdonald/secure_sqlite/pkg/masking"
+	"github.com/wemcdonald/secure_sqlite/pkg/rbac"
 	"github.com/wemcdonald/secure_sqlite/pkg/secure_sqlite"
 )
 
+// DriverName is the name of the database/sql driver that enforces the checks
+// of a handle on every statement
+const DriverName = secure_sqlite.DriverName
+
 // Open creates a new secure SQLite database connection
-func Open(dataSourceName string, authProvider auth.Provider, username, token string) (*secure_sqlite.SecureSQLite, error) {
-	return secure_sqlite.Open(dataSourceName, authProvider, username, token)
+func Open(dataSourceName string, authProvider auth.Provider, username, token string, opts ...secure_sqlite.Option) (*secure_sqlite.SecureSQLite, error) {
+	return secure_sqlite.Open(dataSourceName, authProvider, username, token, opts...)
+}
+
+// WithSuperuser makes a user a superuser when the database is opened
+func WithSuperuser(username string) secure_sqlite.Option {
+	return secure_sqlite.WithSuperuser(username)
+}
+
+// WithAuditSink sends the audit events of the database to a sink
+func WithAuditSink(sink audit.Sink) secure_sqlite.Option {
+	return secure_sqlite.WithAuditSink(sink)
+}
+
+// WithBreakGlass defines the emergency roles of break-glass elevations
+func WithBreakGlass(policies ...secure_sqlite.BreakGlassPolicy) secure_sqlite.Option {
+	return secure_sqlite.WithBreakGlass(policies...)
+}
+
+// WithAccessWorkflow lets users of the database request temporary access
+// through a workflow
+func WithAccessWorkflow(workflow *rbac.AccessWorkflow) secure_sqlite.Option {
+	return secure_sqlite.WithAccessWorkflow(workflow)
+}
+
+// WithChangeHistory records the rows that UPDATE and DELETE statements change
+// in the given tables
+func WithChangeHistory(tables ...string) secure_sqlite.Option {
+	return secure_sqlite.WithChangeHistory(tables...)
+}
+
+// WithSensitiveColumns tags columns of a table as sensitive, so that reads of
+// them are recorded to the audit sink
+func WithSensitiveColumns(table string, columns ...string) secure_sqlite.Option {
+	return secure_sqlite.WithSensitiveColumns(table, columns...)
+}
+
+// WithABAC evaluates the policies of an ABAC manager for the statements of
+// the database
+func WithABAC(manager *abac.ABACManager) secure_sqlite.Option {
+	return secure_sqlite.WithABAC(manager)
+}
+
+// WithMasking masks columns according to the rules of a masking manager
+func WithMasking(manager *masking.Manager) secure_sqlite.Option {
+	return secure_sqlite.WithMasking(manager)
+}
+
+// WithColumnEncryption encrypts columns with keys of a key provider
+func WithColumnEncryption(provider encryption.KeyProvider, columns ...encryption.Column) secure_sqlite.Option {
+	return secure_sqlite.WithColumnEncryption(provider, columns...)
+}
+
+// WithHardened hides the underlying connection of the database behind the
+// audited Unsafe method
+func WithHardened() secure_sqlite.Option {
+	return secure_sqlite.WithHardened()
+}
+
+// NewConnector returns a connector of the database/sql driver whose statements
+// run as a user
+func NewConnector(dataSourceName string, authProvider auth.Provider, username, token string, opts ...secure_sqlite.Option) *secure_sqlite.Connector {
+	return secure_sqlite.NewConnector(dataSourceName, authProvider, username, token, opts...)
+}
+
+// RegisterAuthProvider makes an authentication provider available to DSNs of
+// the database/sql driver under a name
+func RegisterAuthProvider(name string, provider auth.Provider) {
+	secure_sqlite.RegisterAuthProvider(name, provider)
+}
+
+// WithPrincipal returns a context whose statements on connections of the
+// database/sql driver run as a user
+func WithPrincipal(ctx context.Context, username, token string) context.Context {
+	return secure_sqlite.WithPrincipal(ctx, username, token)
 }
 
 // Re-export types for convenience
 type (
-	SecureSQLite = secure_sqlite.SecureSQLite
-	DBError      = secure_sqlite.DBError
+	SecureSQLite      = secure_sqlite.SecureSQLite
+	DBError           = secure_sqlite.DBError
+	Option            = secure_sqlite.Option
+	BreakGlassPolicy  = secure_sqlite.BreakGlassPolicy
+	BreakGlassRequest = secure_sqlite.BreakGlassRequest
+	RowChange         = secure_sqlite.RowChange
+	Rows              = secure_sqlite.Rows
+	Connector         = secure_sqlite.Connector
+	AuditSink         = audit.Sink
 )
@@ -0,0 +1,14 @@
+//go:build sqlcipher
+
+package secure_sqlite
+
+import (
+	"github.com/wemcdonald/secure_sqlite/pkg/encryption"
+	"github.com/wemcdonald/secure_sqlite/pkg/secure_sqlite"
+)
+
+// WithDatabaseEncryption encrypts the whole database file with the current key
+// of a key provider, which is only built with the sqlcipher tag
+func WithDatabaseEncryption(provider encryption.KeyProvider) secure_sqlite.Option {
+	return secure_sqlite.WithDatabaseEncryption(provider)
+}